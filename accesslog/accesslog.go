@@ -0,0 +1,279 @@
+// Package accesslog writes an access log of the traffic served by a
+// juggler server, in the formats of the HTTP access logs, so that the
+// existing log pipelines can ingest it like HTTP traffic. The Logger's
+// Handler writes a line for each CALL, PUB and SUB request once it is
+// acknowledged or rejected, and a line for each call result (RES),
+// formatted by a Format: the Apache Common Log Format (see CommonFormat)
+// or JSON (see JSONFormat).
+package accesslog
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// StatusOK is the status of a request that was acknowledged and of a
+// successful call result. The other statuses are the codes of the NACK
+// (see message.CodeBadRequest and others), message.CodeHandlerError for
+// an error result and message.CodeTimeout for a call whose result was
+// not received in time.
+const StatusOK = 200
+
+// Entry is an entry of the access log.
+type Entry struct {
+	// Time is the time in UTC at which the request was received, that
+	// of the CALL for a RES.
+	Time time.Time `json:"time"`
+
+	// Type is the type of the entry, i.e. CALL, PUB, SUB or RES.
+	Type string `json:"type"`
+
+	MsgUUID    uuid.UUID `json:"msg_uuid"` // of the CALL for a RES
+	ConnUUID   uuid.UUID `json:"conn_uuid"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Identity   string    `json:"identity,omitempty"` // see juggler.Conn.Identity
+	Protocol   string    `json:"protocol,omitempty"` // subprotocol of the connection
+
+	URI     string `json:"uri,omitempty"`     // for a CALL or RES
+	Channel string `json:"channel,omitempty"` // for a PUB or SUB
+
+	// Size is the size in bytes of the arguments of the CALL, PUB or
+	// RES.
+	Size int `json:"size"`
+
+	// Status is StatusOK, the code of the NACK or, for a RES,
+	// message.CodeHandlerError if it is an error result and
+	// message.CodeTimeout if it was not received in time.
+	Status int `json:"status"`
+
+	// Latency is the time between the request and its ACK or NACK, or
+	// between the CALL and its result for a RES.
+	Latency time.Duration `json:"latency"`
+}
+
+// Logger writes the access log of the requests to W.
+type Logger struct {
+	// W receives the lines of the access log, one write per line. The
+	// writes are serialized.
+	W io.Writer
+
+	// Format formats the entries. It defaults to CommonFormat.
+	Format Format
+
+	// Vars can be set to track the number of AccessLogLines written and
+	// of FailedAccessLogLines.
+	Vars *expvar.Map
+
+	// LogFunc, if set, is called with the errors to format or write the
+	// lines.
+	LogFunc func(string, ...interface{})
+
+	wmu sync.Mutex // serializes the writes to W
+
+	mu      sync.Mutex
+	pending map[string]*pendingEntry // by request UUID
+}
+
+// pendingEntry is the entry of a request that is waiting for its ACK
+// or NACK or, for a CALL, its result.
+type pendingEntry struct {
+	entry *Entry
+	acked bool        // only for a CALL, waiting for its result
+	timer *time.Timer // only for a CALL
+}
+
+// Handler returns a juggler.Handler that logs the requests and their
+// responses before calling h. It should be the first handler of the
+// chain, so that the requests rejected by the others are logged. A
+// fire-and-forget CALL or PUB (see message.NoAck) is logged when it is
+// received.
+func (l *Logger) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		switch msg := msg.(type) {
+		case *message.Call:
+			e := newEntry(c, msg)
+			e.URI, e.Size = msg.Payload.URI, len(msg.Payload.Args)
+			l.track(e, message.NoAck(msg), juggler.CallWait(msg))
+
+		case *message.Pub:
+			e := newEntry(c, msg)
+			e.Channel, e.Size = msg.Payload.Channel, len(msg.Payload.Args)
+			if message.NoAck(msg) {
+				// a fire-and-forget PUB has no ACK to wait for
+				l.write(e, StatusOK)
+				break
+			}
+			l.track(e, false, 0)
+
+		case *message.Sub:
+			e := newEntry(c, msg)
+			e.Channel = msg.Payload.Channel
+			l.track(e, false, 0)
+
+		case *message.Ack:
+			l.done(msg.Payload.For.String(), StatusOK)
+
+		case *message.Nack:
+			l.done(msg.Payload.For.String(), msg.Payload.Code)
+
+		case *message.Res:
+			status := StatusOK
+			if isErrResult(msg.Payload.Args) {
+				status = message.CodeHandlerError
+			}
+			l.result(msg.Payload.For.String(), len(msg.Payload.Args), status)
+		}
+		h.Handle(ctx, c, msg)
+	})
+}
+
+func newEntry(c *juggler.Conn, m message.Msg) *Entry {
+	e := &Entry{
+		Time:     time.Now().UTC(),
+		Type:     m.Type().String(),
+		MsgUUID:  m.UUID(),
+		ConnUUID: c.UUID,
+		Identity: c.Identity,
+		Protocol: c.Subprotocol(),
+	}
+	if addr := c.RemoteAddr(); addr != nil {
+		e.RemoteAddr = addr.String()
+	}
+	return e
+}
+
+// track registers the entry of a request until its ACK or NACK. If
+// acked is true, the entry is written and, for a CALL, it waits for its
+// result. If wait is > 0, the result of the call times out if it is not
+// received after that delay.
+func (l *Logger) track(e *Entry, acked bool, wait time.Duration) {
+	if acked {
+		l.write(e, StatusOK)
+		if e.Type != message.CallMsg.String() {
+			return
+		}
+	}
+
+	key := e.MsgUUID.String()
+	pe := &pendingEntry{entry: e, acked: acked}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending == nil {
+		l.pending = make(map[string]*pendingEntry)
+	}
+	if old := l.pending[key]; old != nil && old.timer != nil {
+		old.timer.Stop()
+	}
+	if wait > 0 {
+		pe.timer = time.AfterFunc(wait, func() {
+			l.result(key, 0, message.CodeTimeout)
+		})
+	}
+	l.pending[key] = pe
+}
+
+// done writes the entry of the pending request with the status of its
+// ACK or NACK. An acknowledged CALL remains pending until its result.
+// It does nothing if the request is not waiting for its ACK or NACK.
+func (l *Logger) done(key string, status int) {
+	var e *Entry
+	l.mu.Lock()
+	if pe := l.pending[key]; pe != nil && !pe.acked {
+		// the entry of a CALL is shared with its RES, write a copy
+		cpy := *pe.entry
+		e = &cpy
+		if status == StatusOK && e.Type == message.CallMsg.String() {
+			pe.acked = true
+		} else {
+			delete(l.pending, key)
+			if pe.timer != nil {
+				pe.timer.Stop()
+			}
+		}
+	}
+	l.mu.Unlock()
+	if e != nil {
+		l.write(e, status)
+	}
+}
+
+// result writes the RES entry of the pending call with the size of the
+// result and its status. It does nothing if the call is not pending.
+func (l *Logger) result(key string, size, status int) {
+	l.mu.Lock()
+	pe := l.pending[key]
+	if pe != nil {
+		delete(l.pending, key)
+		if pe.timer != nil {
+			pe.timer.Stop()
+		}
+	}
+	l.mu.Unlock()
+	if pe == nil {
+		return
+	}
+
+	e := *pe.entry
+	e.Type = message.ResMsg.String()
+	e.Size = size
+	l.write(&e, status)
+}
+
+// write writes the line of the entry e with the status.
+func (l *Logger) write(e *Entry, status int) {
+	e.Status = status
+	e.Latency = time.Now().Sub(e.Time)
+
+	f := l.Format
+	if f == nil {
+		f = CommonFormat
+	}
+	b, err := f.Format(e)
+	if err == nil {
+		l.wmu.Lock()
+		_, err = l.W.Write(append(b, '\n'))
+		l.wmu.Unlock()
+	}
+	if err != nil {
+		l.add("FailedAccessLogLines")
+		if l.LogFunc != nil {
+			l.LogFunc("accesslog: failed to write line of %s %v: %v", e.Type, e.MsgUUID, err)
+		}
+		return
+	}
+	l.add("AccessLogLines")
+}
+
+func (l *Logger) add(key string) {
+	if l.Vars != nil {
+		l.Vars.Add(key, 1)
+	}
+}
+
+// isErrResult returns true if args is an error result (see
+// message.ErrResult).
+func isErrResult(args json.RawMessage) bool {
+	var v struct {
+		Error *json.RawMessage `json:"error"`
+	}
+	return json.Unmarshal(args, &v) == nil && v.Error != nil
+}
+
+// host returns the host of the network address addr, or addr itself if
+// it has no port.
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
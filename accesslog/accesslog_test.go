@@ -0,0 +1,150 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// entryWriter collects the entries of the lines formatted as JSON.
+type entryWriter struct {
+	ch chan *Entry
+}
+
+func (w entryWriter) Write(p []byte) (int, error) {
+	var e Entry
+	if err := json.Unmarshal(p, &e); err != nil {
+		return 0, err
+	}
+	w.ch <- &e
+	return len(p), nil
+}
+
+func TestLogger(t *testing.T) {
+	w := entryWriter{make(chan *Entry, 10)}
+	vars := new(expvar.Map).Init()
+	l := &Logger{W: w, Format: JSONFormat, Vars: vars}
+	h := l.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {}))
+	c := juggler.NewDetachedConn(&juggler.Server{})
+	c.Identity = "u1"
+	ctx := context.Background()
+
+	next := func(label string) *Entry {
+		select {
+		case e := <-w.ch:
+			return e
+		case <-time.After(time.Second):
+			require.FailNow(t, "no entry", label)
+		}
+		return nil
+	}
+	none := func(label string) {
+		select {
+		case e := <-w.ch:
+			assert.Fail(t, "unexpected entry", "%s: %s %s", label, e.Type, e.URI)
+		default:
+		}
+	}
+
+	call, err := message.NewCall("ok", map[string]int{"a": 1}, time.Second)
+	require.NoError(t, err, "NewCall")
+	h.Handle(ctx, c, call)
+	none("call before ACK")
+	h.Handle(ctx, c, message.NewAck(call))
+	e := next("call")
+	assert.Equal(t, "CALL", e.Type, "type")
+	assert.Equal(t, call.UUID(), e.MsgUUID, "msg UUID")
+	assert.Equal(t, c.UUID, e.ConnUUID, "conn UUID")
+	assert.Equal(t, "u1", e.Identity, "identity")
+	assert.Equal(t, "ok", e.URI, "URI")
+	assert.Equal(t, len(`{"a":1}`), e.Size, "size")
+	assert.Equal(t, StatusOK, e.Status, "status")
+
+	h.Handle(ctx, c, message.NewRes(&message.ResPayload{MsgUUID: call.UUID(), URI: "ok", Args: json.RawMessage(`"done"`)}))
+	e = next("res")
+	assert.Equal(t, "RES", e.Type, "res type")
+	assert.Equal(t, call.UUID(), e.MsgUUID, "res msg UUID")
+	assert.Equal(t, "ok", e.URI, "res URI")
+	assert.Equal(t, len(`"done"`), e.Size, "res size")
+	assert.Equal(t, StatusOK, e.Status, "res status")
+	assert.True(t, e.Latency > 0, "res latency")
+
+	call, err = message.NewCall("fail", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	h.Handle(ctx, c, call)
+	h.Handle(ctx, c, message.NewAck(call))
+	next("fail call")
+	h.Handle(ctx, c, message.NewRes(&message.ResPayload{MsgUUID: call.UUID(), URI: "fail", Args: json.RawMessage(`{"error":{"message":"failed"}}`)}))
+	e = next("fail res")
+	assert.Equal(t, message.CodeHandlerError, e.Status, "error result status")
+
+	call, err = message.NewCall("forbidden", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	h.Handle(ctx, c, call)
+	h.Handle(ctx, c, message.NewNack(call, message.CodeForbidden, errors.New("forbidden")))
+	e = next("forbidden")
+	assert.Equal(t, "CALL", e.Type, "forbidden type")
+	assert.Equal(t, message.CodeForbidden, e.Status, "forbidden status")
+
+	call, err = message.NewCall("slow", nil, 50*time.Millisecond)
+	require.NoError(t, err, "NewCall")
+	h.Handle(ctx, c, call)
+	h.Handle(ctx, c, message.NewAck(call))
+	next("slow call")
+	e = next("slow res")
+	assert.Equal(t, "RES", e.Type, "slow type")
+	assert.Equal(t, message.CodeTimeout, e.Status, "slow status")
+
+	pub, err := message.NewPub("c", 1)
+	require.NoError(t, err, "NewPub")
+	h.Handle(ctx, c, pub)
+	h.Handle(ctx, c, message.NewAck(pub))
+	e = next("pub")
+	assert.Equal(t, "PUB", e.Type, "pub type")
+	assert.Equal(t, "c", e.Channel, "pub channel")
+	assert.Equal(t, 1, e.Size, "pub size")
+
+	pub, err = message.NewPub("c", 1)
+	require.NoError(t, err, "NewPub")
+	pub.Payload.NoAck = true
+	h.Handle(ctx, c, pub)
+	e = next("fire-and-forget pub")
+	assert.Equal(t, StatusOK, e.Status, "fire-and-forget pub status")
+
+	sub := message.NewSub("d.*", true)
+	h.Handle(ctx, c, sub)
+	h.Handle(ctx, c, message.NewAck(sub))
+	e = next("sub")
+	assert.Equal(t, "SUB", e.Type, "sub type")
+	assert.Equal(t, "d.*", e.Channel, "sub channel")
+	assert.Equal(t, 0, e.Size, "sub size")
+
+	// an ACK without request is not logged
+	h.Handle(ctx, c, message.NewAck(sub))
+	none("duplicate ACK")
+	assert.Equal(t, "10", vars.Get("AccessLogLines").String(), "lines metric")
+}
+
+func TestLoggerCommonFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{W: &buf}
+	h := l.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {}))
+	c := juggler.NewDetachedConn(&juggler.Server{})
+
+	sub := message.NewSub("a", false)
+	h.Handle(context.Background(), c, sub)
+	h.Handle(context.Background(), c, message.NewAck(sub))
+	line := buf.String()
+	assert.True(t, strings.HasSuffix(line, "\n"), "newline")
+	assert.Contains(t, line, `"SUB a -" 200 -`, "request line")
+}
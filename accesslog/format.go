@@ -0,0 +1,91 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Format defines the method required to format the entries of the
+// access log. The returned line must not end with a newline, the Logger
+// adds it.
+type Format interface {
+	Format(*Entry) ([]byte, error)
+}
+
+// FormatFunc is a function signature that implements the Format
+// interface.
+type FormatFunc func(*Entry) ([]byte, error)
+
+// Format implements Format for the FormatFunc by calling the function
+// itself.
+func (fn FormatFunc) Format(e *Entry) ([]byte, error) {
+	return fn(e)
+}
+
+// The formats of the access log.
+var (
+	// CommonFormat formats the entries in the Apache Common Log Format,
+	// with the type of the entry as method, the URI or channel as path
+	// and the subprotocol as protocol of the request line, followed by
+	// the latency in microseconds (as Apache's %D), the connection UUID
+	// and the message UUID:
+	//
+	//     127.0.0.1 - alice [02/Jan/2006:15:04:05 +0000] "CALL a.b juggler.v2.json" 200 7 1250 <conn UUID> <msg UUID>
+	//
+	// The missing remote address, identity, protocol and size are "-".
+	CommonFormat Format = FormatFunc(formatCommon)
+
+	// JSONFormat formats the entries as JSON objects, see Entry.
+	JSONFormat Format = FormatFunc(formatJSON)
+)
+
+// commonTimeLayout is the time layout of the Common Log Format.
+const commonTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+func formatCommon(e *Entry) ([]byte, error) {
+	target := e.URI
+	if target == "" {
+		target = e.Channel
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(orDash(host(e.RemoteAddr)))
+	buf.WriteString(" - ")
+	buf.WriteString(orDash(e.Identity))
+	buf.WriteString(" [")
+	buf.WriteString(e.Time.Format(commonTimeLayout))
+	buf.WriteString(`] "`)
+	buf.WriteString(e.Type)
+	buf.WriteByte(' ')
+	buf.WriteString(orDash(target))
+	buf.WriteByte(' ')
+	buf.WriteString(orDash(e.Protocol))
+	buf.WriteString(`" `)
+	buf.WriteString(strconv.Itoa(e.Status))
+	buf.WriteByte(' ')
+	if e.Size > 0 {
+		buf.WriteString(strconv.Itoa(e.Size))
+	} else {
+		buf.WriteByte('-')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(int64(e.Latency/time.Microsecond), 10))
+	buf.WriteByte(' ')
+	buf.WriteString(e.ConnUUID.String())
+	buf.WriteByte(' ')
+	buf.WriteString(e.MsgUUID.String())
+	return buf.Bytes(), nil
+}
+
+func formatJSON(e *Entry) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,48 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommonFormat(t *testing.T) {
+	cuid, muid := uuid.NewRandom(), uuid.NewRandom()
+	e := &Entry{
+		Time:       time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Type:       "CALL",
+		MsgUUID:    muid,
+		ConnUUID:   cuid,
+		RemoteAddr: "127.0.0.1:1234",
+		Identity:   "alice",
+		Protocol:   "juggler.v2.json",
+		URI:        "a.b",
+		Size:       7,
+		Status:     StatusOK,
+		Latency:    1250 * time.Microsecond,
+	}
+	b, err := CommonFormat.Format(e)
+	require.NoError(t, err, "Format")
+	assert.Equal(t, `127.0.0.1 - alice [02/Jan/2016:03:04:05 +0000] "CALL a.b juggler.v2.json" 200 7 1250 `+cuid.String()+" "+muid.String(), string(b), "call")
+
+	e = &Entry{Time: e.Time, Type: "SUB", MsgUUID: muid, ConnUUID: cuid, Channel: "c", Status: 403}
+	b, err = CommonFormat.Format(e)
+	require.NoError(t, err, "Format")
+	assert.Equal(t, `- - - [02/Jan/2016:03:04:05 +0000] "SUB c -" 403 - 0 `+cuid.String()+" "+muid.String(), string(b), "sub")
+}
+
+func TestJSONFormat(t *testing.T) {
+	e := &Entry{Type: "PUB", MsgUUID: uuid.NewRandom(), ConnUUID: uuid.NewRandom(), Channel: "c", Size: 1, Status: StatusOK, Latency: time.Millisecond}
+	b, err := JSONFormat.Format(e)
+	require.NoError(t, err, "Format")
+
+	var got Entry
+	require.NoError(t, json.Unmarshal(b, &got), "Unmarshal")
+	assert.Equal(t, e.Channel, got.Channel, "channel")
+	assert.Equal(t, e.Latency, got.Latency, "latency")
+	assert.Equal(t, e.MsgUUID, got.MsgUUID, "msg UUID")
+}
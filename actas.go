@@ -0,0 +1,41 @@
+package juggler
+
+import (
+	"errors"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// ErrActAsDenied is the error of the NACK returned for the CALL requests
+// made on behalf of an identity that the connection is not allowed to
+// act as (see Server.AuthorizeActAs).
+var ErrActAsDenied = errors.New("juggler: not allowed to act as that identity")
+
+// authorizeActAs returns true if the connection is allowed to make the
+// call m on behalf of the identity in its metadata, otherwise it sends
+// the NACK and returns false.
+func authorizeActAs(c *Conn, m *message.Call, addFn func(string, int64)) bool {
+	id := m.Meta.ActAs
+	if id == c.Identity {
+		// acting as itself is a no-op
+		return true
+	}
+	if fn := c.srv.AuthorizeActAs; fn == nil || c.Identity == "" || !fn(c, m, id) {
+		addFn("DeniedActAsCalls", 1)
+		c.Send(message.NewNack(m, message.CodeForbidden, ErrActAsDenied))
+		return false
+	}
+	addFn("ActAsCalls", 1)
+	return true
+}
+
+// callIdentity returns the identity of the call m sent to the callees,
+// and the identity of the connection as actor if the call is made on
+// behalf of another identity. The call must have been authorized by
+// authorizeActAs.
+func callIdentity(c *Conn, m *message.Call) (identity, actor string) {
+	if m.Meta.ActAs == "" || m.Meta.ActAs == c.Identity {
+		return c.Identity, ""
+	}
+	return m.Meta.ActAs, c.Identity
+}
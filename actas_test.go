@@ -0,0 +1,143 @@
+package juggler_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// echoIdentityBroker returns the identity and the actor of each call as
+// its result.
+type echoIdentityBroker struct {
+	broker.CallerBroker
+	ch chan *message.ResPayload
+}
+
+func (b echoIdentityBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	args, _ := json.Marshal(cp.Identity + "/" + cp.Actor)
+	b.ch <- &message.ResPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: cp.URI, Args: args}
+	return nil
+}
+
+func (b echoIdentityBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return fakeResultsConn{b.ch}, nil
+}
+
+func TestActAs(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &juggler.Server{
+		CallerBroker: echoIdentityBroker{ch: make(chan *message.ResPayload, 10)},
+		Vars:         vars,
+		ConnState: func(c *juggler.Conn, state juggler.ConnState) {
+			if state == juggler.Accepting {
+				c.Identity = "gateway"
+			}
+		},
+		AuthorizeActAs: func(c *juggler.Conn, m *message.Call, identity string) bool {
+			return c.Identity == "gateway" && strings.HasPrefix(identity, "user:") && m.Payload.URI != "admin"
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	results := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		switch m.(type) {
+		case *message.Res, *message.Nack:
+			results <- m
+		}
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	cases := []struct {
+		actAs string
+		uri   string
+		args  string // empty for a NACK
+	}{
+		{"", "a", `"gateway/"`},
+		{"gateway", "a", `"gateway/"`},
+		{"user:1", "a", `"user:1/gateway"`},
+		{"user:1", "admin", ``},
+		{"other", "a", ``},
+	}
+	for _, c := range cases {
+		ctx := context.Background()
+		if c.actAs != "" {
+			ctx = client.WithActAs(ctx, c.actAs)
+		}
+		_, err := cli.CallCtx(ctx, c.uri, nil, time.Second)
+		require.NoError(t, err, "Call %s as %s", c.uri, c.actAs)
+
+		select {
+		case m := <-results:
+			if c.args == "" {
+				if nack, ok := m.(*message.Nack); assert.True(t, ok, "%s as %s: NACK", c.uri, c.actAs) {
+					assert.Equal(t, message.CodeForbidden, nack.Payload.Code, "%s as %s: NACK code", c.uri, c.actAs)
+				}
+				continue
+			}
+			if res, ok := m.(*message.Res); assert.True(t, ok, "%s as %s: RES", c.uri, c.actAs) {
+				assert.Equal(t, c.args, string(res.Payload.Args), "%s as %s: RES args", c.uri, c.actAs)
+			}
+		case <-time.After(time.Second):
+			assert.Fail(t, "no response", "%s as %s", c.uri, c.actAs)
+		}
+	}
+
+	assert.Equal(t, "1", vars.Get("ActAsCalls").String(), "ActAsCalls")
+	assert.Equal(t, "2", vars.Get("DeniedActAsCalls").String(), "DeniedActAsCalls")
+}
+
+func TestActAsWithoutHook(t *testing.T) {
+	server := &juggler.Server{CallerBroker: echoIdentityBroker{ch: make(chan *message.ResPayload, 10)}}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	results := make(chan message.Msg, 10)
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}},
+		client.SetHandler(client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+			results <- m
+		})))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	_, err = cli.CallCtx(client.WithActAs(context.Background(), "user:1"), "a", nil, time.Second)
+	require.NoError(t, err, "Call")
+	for {
+		select {
+		case m := <-results:
+			if _, ok := m.(*message.Ack); ok {
+				continue
+			}
+			nack, ok := m.(*message.Nack)
+			require.True(t, ok, "NACK")
+			assert.Equal(t, message.CodeForbidden, nack.Payload.Code, "NACK code")
+			assert.Equal(t, juggler.ErrActAsDenied.Error(), nack.Payload.Message, "NACK message")
+			return
+		case <-time.After(time.Second):
+			t.Fatal("no response")
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Package audit records an audit trail of the requests served by a
+// juggler server. The Logger's Handler creates a Record for each CALL,
+// PUB, SUB and UNSB request once its outcome is known, and writes it to
+// a Sink: the JSON lines of a file (see FileSink) or a redis stream (see
+// RedisStreamSink). Other destinations, e.g. a Kafka topic, implement
+// the Sink interface with the client of their choice.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// Record is the audit record of a request.
+type Record struct {
+	// Time is the time in UTC at which the request was received.
+	Time time.Time `json:"time"`
+
+	// Type is the type of the request, i.e. CALL, PUB, SUB or UNSB.
+	Type string `json:"type"`
+
+	MsgUUID  uuid.UUID `json:"msg_uuid"`
+	ConnUUID uuid.UUID `json:"conn_uuid"`
+	Identity string    `json:"identity,omitempty"` // see juggler.Conn.Identity
+	Tenant   string    `json:"tenant,omitempty"`   // see juggler.Conn.Tenant
+
+	// ActAs is the identity on behalf of which a CALL is made, if any
+	// (see message.Meta.ActAs). Identity is then the identity of the
+	// connection that acts as it.
+	ActAs string `json:"act_as,omitempty"`
+
+	URI     string `json:"uri,omitempty"`     // for a CALL
+	Channel string `json:"channel,omitempty"` // for a PUB, SUB or UNSB
+	Pattern bool   `json:"pattern,omitempty"` // for a SUB or UNSB
+
+	// ArgsHash is the hex-encoded SHA-256 hash of the arguments of a
+	// CALL or PUB, so that the trail does not hold their content.
+	ArgsHash string `json:"args_hash,omitempty"`
+
+	// Code is 0 if the request succeeded, i.e. it was acknowledged or,
+	// for a CALL, its result was sent. Otherwise it is the code of the
+	// NACK, or message.CodeTimeout for a call whose result was not
+	// received in time.
+	Code int `json:"code"`
+
+	// Error is the message of the NACK or of the error result of a
+	// CALL, if any.
+	Error string `json:"error,omitempty"`
+
+	// Latency is the time between the request and its NACK, its ACK or,
+	// for a CALL, its result.
+	Latency time.Duration `json:"latency"`
+}
+
+// Sink defines the method required to store the audit records.
+type Sink interface {
+	Write(*Record) error
+}
+
+// SinkFunc is a function signature that implements the Sink interface.
+type SinkFunc func(*Record) error
+
+// Write implements Sink for the SinkFunc by calling the function
+// itself.
+func (fn SinkFunc) Write(r *Record) error {
+	return fn(r)
+}
+
+// Logger writes the audit records of the requests to its Sink.
+type Logger struct {
+	// Sink receives the audit records. It is called by the goroutines
+	// of the connections, so it should be fast.
+	Sink Sink
+
+	// Vars can be set to track the number of AuditRecords written and
+	// of FailedAuditRecords.
+	Vars *expvar.Map
+
+	// LogFunc, if set, is called with the errors of the Sink.
+	LogFunc func(string, ...interface{})
+
+	mu      sync.Mutex
+	pending map[string]*pendingRecord // by request UUID
+}
+
+// pendingRecord is the record of a request that is waiting for its
+// outcome.
+type pendingRecord struct {
+	rec   *Record
+	timer *time.Timer // only for a CALL
+}
+
+// Handler returns a juggler.Handler that records the requests and the
+// responses that conclude them before calling h. It should be the first
+// handler of the chain, so that the requests rejected by the others are
+// recorded. A fire-and-forget PUB (see message.NoAck) is recorded when
+// it is received.
+func (l *Logger) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		switch msg := msg.(type) {
+		case *message.Call:
+			r := newRecord(c, msg)
+			r.URI = msg.Payload.URI
+			r.ActAs = msg.Meta.ActAs
+			r.ArgsHash = argsHash(msg.Payload.Args)
+			l.track(r, juggler.CallWait(msg))
+
+		case *message.Pub:
+			r := newRecord(c, msg)
+			r.Channel = msg.Payload.Channel
+			r.ArgsHash = argsHash(msg.Payload.Args)
+			if msg.Payload.NoAck {
+				// a fire-and-forget PUB has no ACK to wait for
+				l.write(r, 0, "")
+				break
+			}
+			l.track(r, 0)
+
+		case *message.Sub:
+			r := newRecord(c, msg)
+			r.Channel, r.Pattern = msg.Payload.Channel, msg.Payload.Pattern
+			l.track(r, 0)
+
+		case *message.Unsb:
+			r := newRecord(c, msg)
+			r.Channel, r.Pattern = msg.Payload.Channel, msg.Payload.Pattern
+			l.track(r, 0)
+
+		case *message.Ack:
+			// the ACK of a CALL is not its outcome, the result is
+			if msg.Payload.ForType != message.CallMsg {
+				l.done(msg.Payload.For.String(), 0, "")
+			}
+
+		case *message.Nack:
+			l.done(msg.Payload.For.String(), msg.Payload.Code, msg.Payload.Message)
+
+		case *message.Res:
+			l.done(msg.Payload.For.String(), 0, errResult(msg.Payload.Args))
+		}
+		h.Handle(ctx, c, msg)
+	})
+}
+
+func newRecord(c *juggler.Conn, m message.Msg) *Record {
+	return &Record{
+		Time:     time.Now().UTC(),
+		Type:     m.Type().String(),
+		MsgUUID:  m.UUID(),
+		ConnUUID: c.UUID,
+		Identity: c.Identity,
+		Tenant:   c.Tenant,
+	}
+}
+
+// track registers the record of a request until its outcome is known.
+// If wait is > 0, the request times out if it is still pending after
+// that delay.
+func (l *Logger) track(r *Record, wait time.Duration) {
+	key := r.MsgUUID.String()
+	pr := &pendingRecord{rec: r}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending == nil {
+		l.pending = make(map[string]*pendingRecord)
+	}
+	if old := l.pending[key]; old != nil && old.timer != nil {
+		old.timer.Stop()
+	}
+	if wait > 0 {
+		pr.timer = time.AfterFunc(wait, func() {
+			l.done(key, message.CodeTimeout, "")
+		})
+	}
+	l.pending[key] = pr
+}
+
+// done writes the record of the pending request with the outcome code
+// and error message. It does nothing if the request is not pending.
+func (l *Logger) done(key string, code int, msg string) {
+	l.mu.Lock()
+	pr := l.pending[key]
+	if pr != nil {
+		delete(l.pending, key)
+		if pr.timer != nil {
+			pr.timer.Stop()
+		}
+	}
+	l.mu.Unlock()
+	if pr != nil {
+		l.write(pr.rec, code, msg)
+	}
+}
+
+// write writes the record r with the outcome code and error message.
+func (l *Logger) write(r *Record, code int, msg string) {
+	r.Code, r.Error = code, msg
+	r.Latency = time.Now().Sub(r.Time)
+	if err := l.Sink.Write(r); err != nil {
+		l.add("FailedAuditRecords")
+		if l.LogFunc != nil {
+			l.LogFunc("audit: failed to write record of %s %v: %v", r.Type, r.MsgUUID, err)
+		}
+		return
+	}
+	l.add("AuditRecords")
+}
+
+func (l *Logger) add(key string) {
+	if l.Vars != nil {
+		l.Vars.Add(key, 1)
+	}
+}
+
+// argsHash returns the hex-encoded SHA-256 hash of args, or an empty
+// string if there are no arguments.
+func argsHash(args json.RawMessage) string {
+	if len(args) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(args)
+	return hex.EncodeToString(sum[:])
+}
+
+// errResult returns the message of the error result args, or an empty
+// string if it is not an error result (see message.ErrResult).
+func errResult(args json.RawMessage) string {
+	var v struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(args, &v); err != nil || v.Error == nil {
+		return ""
+	}
+	if v.Error.Message == "" {
+		return "error result"
+	}
+	return v.Error.Message
+}
@@ -0,0 +1,200 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeCallerBroker struct {
+	broker.CallerBroker
+}
+
+func (f fakeCallerBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return fakeResultsConn{make(chan *message.ResPayload)}, nil
+}
+
+type fakeResultsConn struct {
+	ch chan *message.ResPayload
+}
+
+func (f fakeResultsConn) Results() <-chan *message.ResPayload { return f.ch }
+func (f fakeResultsConn) ResultsErr() error                   { return nil }
+func (f fakeResultsConn) Close() error                        { close(f.ch); return nil }
+
+type fakePubSubBroker struct {
+	broker.PubSubBroker
+}
+
+func (f fakePubSubBroker) NewPubSubConn() (broker.PubSubConn, error) {
+	return &fakePubSubConn{ch: make(chan *message.EvntPayload)}, nil
+}
+
+type fakePubSubConn struct {
+	once sync.Once
+	ch   chan *message.EvntPayload
+}
+
+func (f *fakePubSubConn) Subscribe(channel string, pattern bool) error   { return nil }
+func (f *fakePubSubConn) Unsubscribe(channel string, pattern bool) error { return nil }
+func (f *fakePubSubConn) Events() <-chan *message.EvntPayload            { return f.ch }
+func (f *fakePubSubConn) EventsErr() error                               { return nil }
+func (f *fakePubSubConn) Close() error {
+	f.once.Do(func() { close(f.ch) })
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	recs := make(chan *Record, 10)
+	l := &Logger{Sink: SinkFunc(func(r *Record) error {
+		recs <- r
+		return nil
+	})}
+
+	server := &juggler.Server{
+		CallerBroker: fakeCallerBroker{},
+		PubSubBroker: fakePubSubBroker{},
+		ConnState: func(c *juggler.Conn, cs juggler.ConnState) {
+			if cs == juggler.Accepting {
+				c.Identity = "u1"
+			}
+		},
+		Handler: l.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+			call, ok := msg.(*message.Call)
+			if !ok {
+				if msg.Type().IsRead() {
+					c.Send(message.NewAck(msg))
+					return
+				}
+				juggler.ProcessMsg(c, msg)
+				return
+			}
+			switch call.Payload.URI {
+			case "forbidden":
+				c.Send(message.NewNack(msg, message.CodeForbidden, errors.New("forbidden")))
+			case "slow":
+				c.Send(message.NewAck(msg))
+			default:
+				c.Send(message.NewAck(msg))
+				args := []byte("1")
+				if call.Payload.URI == "fail" {
+					args = []byte(`{"error":{"message":"failed"}}`)
+				}
+				c.Send(message.NewRes(&message.ResPayload{MsgUUID: call.UUID(), URI: call.Payload.URI, Args: args}))
+			}
+		})),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, nil,
+		client.SetHandler(client.HandlerFunc(func(ctx context.Context, m message.Msg) {})))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	next := func(label string) *Record {
+		select {
+		case r := <-recs:
+			return r
+		case <-time.After(time.Second):
+			require.FailNow(t, "no record", label)
+		}
+		return nil
+	}
+
+	id, err := cli.Call("ok", map[string]int{"a": 1}, time.Second)
+	require.NoError(t, err, "Call ok")
+	r := next("ok")
+	assert.Equal(t, "CALL", r.Type, "type")
+	assert.Equal(t, id, r.MsgUUID, "msg UUID")
+	assert.Equal(t, "u1", r.Identity, "identity")
+	assert.Equal(t, "ok", r.URI, "URI")
+	assert.Equal(t, argsHash([]byte(`{"a":1}`)), r.ArgsHash, "args hash")
+	assert.Equal(t, 0, r.Code, "code")
+	assert.True(t, r.Latency > 0, "latency")
+
+	_, err = cli.Call("fail", nil, time.Second)
+	require.NoError(t, err, "Call fail")
+	r = next("fail")
+	assert.Equal(t, 0, r.Code, "fail code")
+	assert.Equal(t, "failed", r.Error, "error result")
+
+	_, err = cli.Call("forbidden", nil, time.Second)
+	require.NoError(t, err, "Call forbidden")
+	r = next("forbidden")
+	assert.Equal(t, message.CodeForbidden, r.Code, "forbidden code")
+	assert.Equal(t, "forbidden", r.Error, "NACK message")
+
+	_, err = cli.Call("slow", nil, 50*time.Millisecond)
+	require.NoError(t, err, "Call slow")
+	r = next("slow")
+	assert.Equal(t, message.CodeTimeout, r.Code, "slow code")
+
+	_, err = cli.Pub("c", 1)
+	require.NoError(t, err, "Pub")
+	r = next("pub")
+	assert.Equal(t, "PUB", r.Type, "pub type")
+	assert.Equal(t, "c", r.Channel, "pub channel")
+	assert.Equal(t, argsHash([]byte("1")), r.ArgsHash, "pub args hash")
+
+	_, err = cli.Sub("d.*", true)
+	require.NoError(t, err, "Sub")
+	r = next("sub")
+	assert.Equal(t, "SUB", r.Type, "sub type")
+	assert.Equal(t, "d.*", r.Channel, "sub channel")
+	assert.True(t, r.Pattern, "sub pattern")
+	assert.Equal(t, "", r.ArgsHash, "sub args hash")
+}
+
+func TestFileSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewFileSink(&buf)
+	require.NoError(t, s.Write(&Record{Type: "CALL", URI: "a"}), "Write")
+	require.NoError(t, s.Write(&Record{Type: "PUB", Channel: "b"}), "Write")
+	require.NoError(t, s.Close(), "Close")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Equal(t, 2, len(lines), "lines") {
+		var r Record
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &r), "Unmarshal")
+		assert.Equal(t, "PUB", r.Type, "type")
+		assert.Equal(t, "b", r.Channel, "channel")
+	}
+}
+
+func TestRedisStreamSink(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	s := &RedisStreamSink{Pool: pool, Stream: "audit", MaxLen: 100}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Write(&Record{Type: "CALL", URI: "a"}), "%d: Write", i)
+	}
+	assert.Error(t, (&RedisStreamSink{Pool: pool}).Write(&Record{}), "missing stream")
+
+	rc := pool.Get()
+	defer rc.Close()
+	n, err := redis.Int(rc.Do("XLEN", "audit"))
+	require.NoError(t, err, "XLEN")
+	assert.Equal(t, 3, n, "stream length")
+}
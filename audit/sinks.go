@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/PuerkitoBio/juggler/broker/redisbroker"
+)
+
+// FileSink is a Sink that writes the records as JSON lines, one record
+// per line.
+type FileSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewFileSink returns a FileSink that writes the records to w.
+func NewFileSink(w io.Writer) *FileSink {
+	return &FileSink{w: w, enc: json.NewEncoder(w)}
+}
+
+// OpenFile returns a FileSink that appends the records to the file at
+// path, which is created if it does not exist.
+func OpenFile(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileSink(f), nil
+}
+
+// Write implements Sink for the FileSink.
+func (s *FileSink) Write(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(r)
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// RedisStreamSink is a Sink that adds the records to a redis stream,
+// with the JSON-encoded record in the "record" field of the entries.
+// Streams require redis 5.0 or later.
+type RedisStreamSink struct {
+	// Pool is the pool of redis connections.
+	Pool redisbroker.Pool
+
+	// Stream is the key of the stream.
+	Stream string
+
+	// MaxLen, if > 0, is the approximate maximum number of entries kept
+	// in the stream, the oldest ones are trimmed.
+	MaxLen int
+}
+
+// Write implements Sink for the RedisStreamSink.
+func (s *RedisStreamSink) Write(r *Record) error {
+	if s.Stream == "" {
+		return errors.New("audit: missing stream")
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{s.Stream}
+	if s.MaxLen > 0 {
+		args = append(args, "MAXLEN", "~", s.MaxLen)
+	}
+	args = append(args, "*", "record", b)
+
+	rc := s.Pool.Get()
+	defer rc.Close()
+	_, err = rc.Do("XADD", args...)
+	return err
+}
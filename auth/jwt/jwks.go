@@ -0,0 +1,304 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned by a KeySet that has no key for the key ID
+// of a token.
+var ErrUnknownKey = errors.New("jwt: unknown key")
+
+// KeySet defines the method required to get the keys that verify the
+// signatures of the tokens.
+type KeySet interface {
+	// Key returns the key identified by kid, the "kid" header of a
+	// token, which may be empty. It is an *rsa.PublicKey, an
+	// *ecdsa.PublicKey or, for the HMAC algorithms, the []byte secret.
+	// It returns ErrUnknownKey if it has no such key.
+	Key(kid string) (interface{}, error)
+}
+
+// Keys is a static KeySet of the keys by key ID. The key of the tokens
+// without a key ID is the one with an empty key ID, or the single key of
+// the set.
+type Keys map[string]interface{}
+
+// Key implements KeySet for Keys.
+func (ks Keys) Key(kid string) (interface{}, error) {
+	if k, ok := ks[kid]; ok {
+		return k, nil
+	}
+	if kid == "" && len(ks) == 1 {
+		for _, k := range ks {
+			return k, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// KeySets is a KeySet that returns the key of the first of its key sets
+// that has it, e.g. to accept the tokens of multiple issuers.
+type KeySets []KeySet
+
+// Key implements KeySet for KeySets.
+func (kss KeySets) Key(kid string) (interface{}, error) {
+	err := ErrUnknownKey
+	for _, ks := range kss {
+		k, e := ks.Key(kid)
+		if e == nil {
+			return k, nil
+		}
+		if e != ErrUnknownKey {
+			err = e
+		}
+	}
+	return nil, err
+}
+
+// DefaultJWKSTTL is the default duration for which a JWKS caches the
+// keys of its endpoint.
+const DefaultJWKSTTL = time.Hour
+
+// DefaultJWKSMinRefresh is the default minimum delay between two
+// fetches of the keys of a JWKS endpoint.
+const DefaultJWKSMinRefresh = time.Minute
+
+// DefaultJWKSTimeout is the timeout of the default HTTP client of a
+// JWKS.
+const DefaultJWKSTimeout = 10 * time.Second
+
+// maxJWKSSize is the maximum size of the key set returned by a JWKS
+// endpoint.
+const maxJWKSSize = 1 << 20
+
+// JWKS is a KeySet of the keys of a JSON Web Key Set endpoint, e.g. the
+// jwks_uri of an OpenID Connect provider. The keys are fetched when
+// they are first needed, and fetched again once they expire or when a
+// token has an unknown key ID, so that the rotation of the keys of the
+// provider is picked up. The RSA and EC keys are supported, the other
+// keys and the keys for encryption are ignored. The key set is limited
+// to 1MB.
+type JWKS struct {
+	// URL is the URL of the endpoint.
+	URL string
+
+	// Client is the HTTP client used to fetch the keys. If nil, a
+	// client with a timeout of DefaultJWKSTimeout is used.
+	Client *http.Client
+
+	// TTL is the duration for which the keys are cached. If 0,
+	// DefaultJWKSTTL is used.
+	TTL time.Duration
+
+	// MinRefresh is the minimum delay between two fetches of the keys,
+	// so that the tokens with unknown key IDs do not overload the
+	// endpoint. If 0, DefaultJWKSMinRefresh is used.
+	MinRefresh time.Duration
+
+	mu       sync.Mutex
+	keys     map[string]interface{}
+	fetched  time.Time     // time of the last attempt to fetch the keys
+	fetching chan struct{} // closed when the fetch in progress is done, nil if none
+	err      error         // error of the last attempt
+	expires  time.Time
+}
+
+// Key implements KeySet for the JWKS. It fetches the keys if they are
+// not cached, if they expired, or if kid is not a known key ID, unless
+// they were fetched in the last MinRefresh. A single fetch is made at a
+// time, without blocking the callers whose key is cached: the expired
+// keys are used until they are fetched again.
+func (j *JWKS) Key(kid string) (interface{}, error) {
+	j.mu.Lock()
+	now := time.Now()
+	k, ok := Keys(j.keys).lookup(kid)
+	if (!ok || now.After(j.expires)) && now.Sub(j.fetched) >= j.minRefresh() {
+		j.startRefresh(now)
+	}
+	done := j.fetching
+	j.mu.Unlock()
+
+	if ok {
+		return k, nil
+	}
+	if done != nil {
+		<-done
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if k, ok := Keys(j.keys).lookup(kid); ok {
+		return k, nil
+	}
+	if j.keys == nil && j.err != nil {
+		return nil, j.err
+	}
+	return nil, ErrUnknownKey
+}
+
+// Refresh fetches the keys of the endpoint, or waits for the fetch in
+// progress.
+func (j *JWKS) Refresh() error {
+	j.mu.Lock()
+	done := j.startRefresh(time.Now())
+	j.mu.Unlock()
+
+	<-done
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// startRefresh starts fetching the keys in a goroutine, unless a fetch
+// is in progress, and returns the channel closed when the fetch is
+// done. j.mu must be held.
+func (j *JWKS) startRefresh(now time.Time) chan struct{} {
+	if j.fetching != nil {
+		return j.fetching
+	}
+	j.fetched = now
+	done := make(chan struct{})
+	j.fetching = done
+
+	go func() {
+		keys, err := j.fetch()
+
+		j.mu.Lock()
+		// the expired keys are kept if they cannot be fetched again
+		j.err = err
+		if err == nil {
+			j.keys = keys
+			ttl := j.TTL
+			if ttl == 0 {
+				ttl = DefaultJWKSTTL
+			}
+			j.expires = now.Add(ttl)
+		}
+		j.fetching = nil
+		j.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+var defaultClient = &http.Client{Timeout: DefaultJWKSTimeout}
+
+func (j *JWKS) fetch() (map[string]interface{}, error) {
+	cli := j.Client
+	if cli == nil {
+		cli = defaultClient
+	}
+	res, err := cli.Get(j.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwt: JWKS endpoint %s: %s", j.URL, res.Status)
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxJWKSSize)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("jwt: JWKS endpoint %s: %v", j.URL, err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, b := range set.Keys {
+		kid, k, err := ParseJWK(b)
+		if err != nil {
+			continue
+		}
+		keys[kid] = k
+	}
+	return keys, nil
+}
+
+func (j *JWKS) minRefresh() time.Duration {
+	if j.MinRefresh == 0 {
+		return DefaultJWKSMinRefresh
+	}
+	return j.MinRefresh
+}
+
+// lookup is Key without the error.
+func (ks Keys) lookup(kid string) (interface{}, bool) {
+	k, err := ks.Key(kid)
+	return k, err == nil
+}
+
+// jwk is a JSON Web Key, with the parameters of the RSA and EC keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWK parses the JSON Web Key b, and returns its key ID and its
+// public key, an *rsa.PublicKey or an *ecdsa.PublicKey.
+func ParseJWK(b []byte) (string, interface{}, error) {
+	var k jwk
+	if err := json.Unmarshal(b, &k); err != nil {
+		return "", nil, err
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return "", nil, fmt.Errorf("jwt: key %q is not a signature key", k.Kid)
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err1 := decodeInt(k.N)
+		e, err2 := decodeInt(k.E)
+		if err1 != nil || err2 != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return "", nil, fmt.Errorf("jwt: invalid RSA key %q", k.Kid)
+		}
+		return k.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return "", nil, fmt.Errorf("jwt: unsupported curve %q of key %q", k.Crv, k.Kid)
+		}
+		x, err1 := decodeInt(k.X)
+		y, err2 := decodeInt(k.Y)
+		if err1 != nil || err2 != nil || !curve.IsOnCurve(x, y) {
+			return "", nil, fmt.Errorf("jwt: invalid EC key %q", k.Kid)
+		}
+		return k.Kid, &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return "", nil, fmt.Errorf("jwt: unsupported key type %q of key %q", k.Kty, k.Kid)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,199 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rsaJWK(kid string, pub *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// jwksServer is a test JWKS endpoint.
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []interface{}
+	fetches int
+}
+
+func newJWKSServer(keys ...interface{}) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+	}))
+	return s
+}
+
+func (s *jwksServer) add(key interface{}) {
+	s.mu.Lock()
+	s.keys = append(s.keys, key)
+	s.mu.Unlock()
+}
+
+func (s *jwksServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func TestJWKS(t *testing.T) {
+	k1, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "generate key")
+	k2, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "generate key")
+	ec, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err, "generate EC key")
+
+	srv := newJWKSServer(
+		rsaJWK("k1", &k1.PublicKey),
+		map[string]string{
+			"kty": "EC",
+			"kid": "ec",
+			"crv": "P-384",
+			"x":   base64.RawURLEncoding.EncodeToString(ec.X.Bytes()),
+			"y":   base64.RawURLEncoding.EncodeToString(ec.Y.Bytes()),
+		},
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		map[string]string{"kty": "oct", "kid": "oct", "k": "c2VjcmV0"},
+	)
+	defer srv.Close()
+
+	j := &JWKS{URL: srv.URL, MinRefresh: 50 * time.Millisecond}
+	k, err := j.Key("k1")
+	require.NoError(t, err, "k1")
+	assert.Equal(t, 0, k1.PublicKey.N.Cmp(k.(*rsa.PublicKey).N), "k1 modulus")
+	k, err = j.Key("ec")
+	require.NoError(t, err, "ec")
+	assert.Equal(t, elliptic.P384(), k.(*ecdsa.PublicKey).Curve, "ec curve")
+	_, err = j.Key("enc")
+	assert.Equal(t, ErrUnknownKey, err, "encryption key")
+	_, err = j.Key("oct")
+	assert.Equal(t, ErrUnknownKey, err, "oct key")
+	assert.Equal(t, 1, srv.count(), "fetched once")
+
+	// the rotated keys are fetched, at most once per MinRefresh
+	srv.add(rsaJWK("k2", &k2.PublicKey))
+	_, err = j.Key("k2")
+	assert.Equal(t, ErrUnknownKey, err, "k2 before MinRefresh")
+	time.Sleep(60 * time.Millisecond)
+	_, err = j.Key("k2")
+	assert.NoError(t, err, "k2 after MinRefresh")
+	assert.Equal(t, 2, srv.count(), "fetched twice")
+
+	// the keys of multiple endpoints
+	kss := KeySets{Keys{"static": []byte("secret")}, j}
+	_, err = kss.Key("static")
+	assert.NoError(t, err, "static key")
+	_, err = kss.Key("k1")
+	assert.NoError(t, err, "k1 key")
+
+	// an unreachable endpoint
+	bad := &JWKS{URL: "http://127.0.0.1:1"}
+	_, err = bad.Key("k1")
+	assert.Error(t, err, "unreachable")
+	assert.NotEqual(t, ErrUnknownKey, err, "unreachable error")
+}
+
+func TestJWKSFetch(t *testing.T) {
+	k1, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "generate key")
+	k2, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "generate key")
+
+	var (
+		mu      sync.Mutex
+		fetches int
+		keys    = []interface{}{rsaJWK("k1", &k1.PublicKey)}
+		block   chan struct{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		set, ch := map[string]interface{}{"keys": keys}, block
+		mu.Unlock()
+		if ch != nil {
+			<-ch
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer srv.Close()
+
+	j := &JWKS{URL: srv.URL, TTL: time.Millisecond, MinRefresh: time.Millisecond}
+	_, err = j.Key("k1")
+	require.NoError(t, err, "k1")
+
+	// a hung endpoint does not block the callers with a cached key
+	mu.Lock()
+	block = make(chan struct{})
+	keys = append(keys, rsaJWK("k2", &k2.PublicKey))
+	mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	start := time.Now()
+	_, err = j.Key("k1")
+	require.NoError(t, err, "expired k1")
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "expired k1 not blocked")
+
+	// the callers with an unknown key wait for the single fetch
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := j.Key("k2")
+			errs <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(block)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, <-errs, "k2 %d", i)
+	}
+	mu.Lock()
+	assert.Equal(t, 2, fetches, "single fetch")
+	mu.Unlock()
+
+	// the timeout of the client and the size of the key set
+	hung := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer slow.Close()
+	defer close(hung)
+	_, err = (&JWKS{URL: slow.URL, Client: &http.Client{Timeout: 50 * time.Millisecond}}).Key("k1")
+	assert.Error(t, err, "timeout")
+	assert.Equal(t, DefaultJWKSTimeout, defaultClient.Timeout, "default client timeout")
+
+	large := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys": [`))
+		for n := 0; n <= maxJWKSSize; n += 3 {
+			w.Write([]byte(`{},`))
+		}
+		w.Write([]byte(`{}]}`))
+	}))
+	defer large.Close()
+	_, err = (&JWKS{URL: large.URL}).Key("k1")
+	assert.Error(t, err, "key set too large")
+	assert.NotEqual(t, ErrUnknownKey, err, "key set too large error")
+}
@@ -0,0 +1,489 @@
+// Package jwt authenticates the connections of a juggler server with
+// the JSON Web Tokens of an OAuth2 or OpenID Connect provider. The
+// Authenticator validates the signed tokens with the keys of the JWKS
+// endpoints of the provider (see JWKS), checks their issuer, their
+// audience and their validity period, and sets the Identity and the
+// Tenant of the connections from their claims.
+//
+// The clients send their token in the Authorization header of the
+// upgrade request, as a bearer token:
+//
+//	Authorization: Bearer <token>
+//
+// or in the access_token query parameter of the upgrade request (see
+// Authenticator.TokenParam), as the JavaScript client does, or in an
+// AUTH message sent as the first message of the connection:
+//
+//	{"meta": {"type": "AUTH", ...}, "payload": {"token": "<token>"}}
+//
+// which is acknowledged with an ACK, or refused with a NACK before the
+// connection is closed. The connection is closed with ErrTokenExpired
+// once its token expires, unless the client refreshes it with an AUTH
+// message with a new token for the same identity, which the server
+// acknowledges with an ACK. The Authenticator is wired in a server with
+// its Upgrade, ConnState and Handler:
+//
+//	auth := &jwt.Authenticator{Keys: &jwt.JWKS{URL: jwksURL}, Issuer: iss, Audience: aud}
+//	srv.ConnState = auth.ConnState
+//	srv.Handler = auth.Handler(handler)
+//	http.Handle("/ws", auth.Upgrade(upgrader, srv))
+//
+// The AUTH message is registered with message.RegisterRead, so that the
+// Go clients import this package to send it, with NewAuth and
+// client.Client.SendCustom.
+package jwt
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/context"
+)
+
+// ErrTokenExpired is the error of the connections closed because their
+// token expired.
+var ErrTokenExpired = errors.New("jwt: the token of the connection expired")
+
+// DefaultAuthTimeout is the default time for a client to send its AUTH
+// message when the upgrade request has no token.
+const DefaultAuthTimeout = 10 * time.Second
+
+// DefaultTokenParam is the default query parameter of the token.
+const DefaultTokenParam = "access_token"
+
+// DefaultIdentityClaim is the default claim of the identity of the
+// connections.
+const DefaultIdentityClaim = "sub"
+
+// Auth is the AUTH message that a client sends with its token, as first
+// message of the connection if its upgrade request has no token, or at
+// any time to refresh its token before it expires.
+type Auth struct {
+	message.Meta `json:"meta"`
+	Payload      struct {
+		Token string `json:"token"`
+	} `json:"payload"`
+}
+
+// AuthMsg is the type of the AUTH message.
+var AuthMsg = message.RegisterRead("AUTH", func() message.Msg { return &Auth{} })
+
+// NewAuth returns a new AUTH message with the token.
+func NewAuth(token string) *Auth {
+	a := &Auth{Meta: message.NewMeta(AuthMsg)}
+	a.Payload.Token = token
+	return a
+}
+
+// Authenticator authenticates the connections of a server with tokens.
+type Authenticator struct {
+	// Keys is the key set that verifies the signatures of the tokens,
+	// typically a JWKS, or KeySets for multiple endpoints.
+	Keys KeySet
+
+	// Algorithms are the accepted signature algorithms of the tokens.
+	// If nil, DefaultAlgorithms are accepted.
+	Algorithms []string
+
+	// Issuer, if set, is the required issuer of the tokens (the "iss"
+	// claim).
+	Issuer string
+
+	// Audience, if set, is the audience that the tokens must have among
+	// their "aud" claim.
+	Audience string
+
+	// Leeway is the tolerance of the validation of the validity period
+	// of the tokens, for the clock skew between the servers and the
+	// provider.
+	Leeway time.Duration
+
+	// IdentityClaim is the string claim set as Identity of the
+	// connections. If empty, DefaultIdentityClaim is used. The
+	// tokens without that claim are refused.
+	IdentityClaim string
+
+	// TenantClaim, if set, is the string claim set as Tenant of the
+	// connections, e.g. the organization of the client.
+	TenantClaim string
+
+	// TokenParam is the query parameter of the upgrade request that
+	// holds the token, for the clients that cannot set the headers of
+	// the upgrade request, e.g. the browsers. If empty,
+	// DefaultTokenParam is used. The Authorization header takes
+	// precedence over it.
+	TokenParam string
+
+	// AuthTimeout is the time for a client to send its AUTH message
+	// if its upgrade request has no token. If 0, DefaultAuthTimeout is
+	// used.
+	AuthTimeout time.Duration
+
+	// Vars can be set to track the number of AuthenticatedConns, of
+	// RejectedTokens, of TokenRefreshes and of ExpiredTokenConns.
+	Vars *expvar.Map
+
+	// LogFunc is the logging function for the refused tokens. If nil,
+	// log.Printf is used.
+	LogFunc func(string, ...interface{})
+
+	mu      sync.Mutex
+	pending map[*websocket.Conn]*Claims // authenticated, not yet served
+	conns   map[*juggler.Conn]*authConn
+}
+
+// authConn is an authenticated connection.
+type authConn struct {
+	claims *Claims
+	timer  *time.Timer // nil if the token does not expire
+}
+
+// Validate validates the token and returns its claims. It fails if the
+// signature is invalid, if the token is expired or not valid yet, or if
+// it does not have the Issuer or the Audience.
+func (a *Authenticator) Validate(token string) (*Claims, error) {
+	hdr, claims, signed, sig, err := parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	algs := a.Algorithms
+	if algs == nil {
+		algs = DefaultAlgorithms
+	}
+	if hdr.Alg == "none" || !isIn(algs, hdr.Alg) {
+		return nil, ErrUnsupportedAlg
+	}
+	key, err := a.Keys.Key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(hdr.Alg, key, signed, sig); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !claims.ExpiresAt.IsZero() && !now.Before(claims.ExpiresAt.Add(a.Leeway)) {
+		return nil, ErrExpired
+	}
+	if !claims.NotBefore.IsZero() && now.Add(a.Leeway).Before(claims.NotBefore) {
+		return nil, ErrNotYetValid
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return nil, ErrInvalidIssuer
+	}
+	if a.Audience != "" && !isIn(claims.Audience, a.Audience) {
+		return nil, ErrInvalidAudience
+	}
+	return claims, nil
+}
+
+// authenticate validates the token and checks that it has an identity.
+func (a *Authenticator) authenticate(token string) (*Claims, error) {
+	claims, err := a.Validate(token)
+	if err != nil {
+		a.add("RejectedTokens", 1)
+		return nil, err
+	}
+	if a.identity(claims) == "" {
+		a.add("RejectedTokens", 1)
+		return nil, fmt.Errorf("jwt: no %s claim in the token", a.identityClaim())
+	}
+	return claims, nil
+}
+
+// IdentityOf validates the token and returns its identity, for the
+// front-ends that authenticate their clients without a juggler.Conn,
+// e.g. the MQTT clients. It fails as Validate does, or if the token
+// has no identity.
+func (a *Authenticator) IdentityOf(token string) (string, error) {
+	claims, err := a.authenticate(token)
+	if err != nil {
+		return "", err
+	}
+	return a.identity(claims), nil
+}
+
+func (a *Authenticator) identityClaim() string {
+	if a.IdentityClaim == "" {
+		return DefaultIdentityClaim
+	}
+	return a.IdentityClaim
+}
+
+func (a *Authenticator) identity(claims *Claims) string {
+	return claims.String(a.identityClaim())
+}
+
+// Upgrade returns an http.Handler that upgrades the connections, as
+// juggler.Upgrade does, once their token is validated. The requests
+// with an invalid token are refused before the upgrade, with a
+// 401 status code, and the connections whose upgrade request has no
+// token must send an AUTH message with their token within AuthTimeout.
+// The connections are served by srv, whose ConnState must call the
+// ConnState of the Authenticator.
+func (a *Authenticator) Upgrade(upgrader *websocket.Upgrader, srv *juggler.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var claims *Claims
+		if token, ok := a.requestToken(r); ok {
+			var err error
+			if claims, err = a.authenticate(token); err != nil {
+				a.logf("jwt: refused token of %s: %v", r.RemoteAddr, err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer wsConn.Close()
+
+		// the agreed-upon subprotocol must be one of the supported ones.
+		if !isIn(juggler.Subprotocols, wsConn.Subprotocol()) {
+			return
+		}
+
+		if claims == nil {
+			if claims, err = a.readAuth(wsConn); err != nil {
+				a.logf("jwt: refused AUTH of %s: %v", r.RemoteAddr, err)
+				return
+			}
+		}
+
+		a.mu.Lock()
+		if a.pending == nil {
+			a.pending = make(map[*websocket.Conn]*Claims)
+		}
+		a.pending[wsConn] = claims
+		a.mu.Unlock()
+		defer func() {
+			a.mu.Lock()
+			delete(a.pending, wsConn)
+			a.mu.Unlock()
+		}()
+
+		// this call blocks until the juggler connection is closed
+		srv.ServeConn(wsConn, juggler.AllowedMessagesFromHeader(r.Header)...)
+	})
+}
+
+// readAuth reads the AUTH message of the connection, validates its
+// token and responds with an ACK or a NACK.
+func (a *Authenticator) readAuth(wsConn *websocket.Conn) (*Claims, error) {
+	proto, ok := message.LookupProtocol(wsConn.Subprotocol())
+	if !ok {
+		proto = message.V1
+	}
+
+	timeout := a.AuthTimeout
+	if timeout == 0 {
+		timeout = DefaultAuthTimeout
+	}
+	wsConn.SetReadDeadline(time.Now().Add(timeout))
+	defer wsConn.SetReadDeadline(time.Time{})
+
+	_, r, err := wsConn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	m, err := proto.DecodeRequest(r, AuthMsg)
+	if err != nil {
+		return nil, err
+	}
+	am, ok := m.(*Auth)
+	if !ok {
+		return nil, fmt.Errorf("jwt: %s message before AUTH", m.Type())
+	}
+
+	claims, err := a.authenticate(am.Payload.Token)
+	var resp message.Msg = message.NewAck(am)
+	if err != nil {
+		resp = message.NewNack(am, message.CodeUnauthorized, err)
+	}
+
+	wsConn.SetWriteDeadline(time.Now().Add(timeout))
+	defer wsConn.SetWriteDeadline(time.Time{})
+	w, werr := wsConn.NextWriter(websocket.TextMessage)
+	if werr == nil {
+		if werr = proto.Encode(w, resp); werr == nil {
+			werr = w.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return claims, werr
+}
+
+// ConnState sets the Identity and the Tenant of the connections in the
+// Accepting state from the claims of their token, and closes them with
+// ErrTokenExpired once it expires. It should be the first of the
+// ConnState functions of the server, so that the others see the
+// identity of the connections. The connections that were not upgraded
+// by the Upgrade handler of the Authenticator are left as is.
+func (a *Authenticator) ConnState(c *juggler.Conn, state juggler.ConnState) {
+	switch state {
+	case juggler.Accepting:
+		a.mu.Lock()
+		claims := a.pending[c.UnderlyingConn()]
+		if claims == nil {
+			a.mu.Unlock()
+			return
+		}
+		if a.conns == nil {
+			a.conns = make(map[*juggler.Conn]*authConn)
+		}
+		a.conns[c] = &authConn{claims: claims}
+		a.mu.Unlock()
+
+		c.Identity = a.identity(claims)
+		if a.TenantClaim != "" {
+			c.Tenant = claims.String(a.TenantClaim)
+		}
+		a.add("AuthenticatedConns", 1)
+
+	case juggler.Connected:
+		// the connection can only be closed once it is connected
+		a.mu.Lock()
+		if ac := a.conns[c]; ac != nil {
+			a.setClaims(c, ac, ac.claims)
+		}
+		a.mu.Unlock()
+
+	case juggler.Closed:
+		a.mu.Lock()
+		ac := a.conns[c]
+		delete(a.conns, c)
+		if ac != nil && ac.timer != nil {
+			ac.timer.Stop()
+		}
+		a.mu.Unlock()
+	}
+}
+
+// setClaims sets the claims of the connection and schedules its close
+// when they expire. The lock must be held.
+func (a *Authenticator) setClaims(c *juggler.Conn, ac *authConn, claims *Claims) {
+	ac.claims = claims
+	if ac.timer != nil {
+		ac.timer.Stop()
+		ac.timer = nil
+	}
+	if claims.ExpiresAt.IsZero() {
+		return
+	}
+	ac.timer = time.AfterFunc(claims.ExpiresAt.Add(a.Leeway).Sub(time.Now()), func() {
+		a.add("ExpiredTokenConns", 1)
+		c.Close(ErrTokenExpired)
+	})
+}
+
+// Handler returns a juggler.Handler that handles the AUTH messages that
+// refresh the tokens of the connections, and calls h with the other
+// messages: h should call juggler.ProcessMsg at some point, as the
+// handler of a server. The new token must be valid and have the identity of the
+// connection, otherwise it is refused with a NACK, with
+// message.CodeUnauthorized or message.CodeForbidden, and the previous
+// token still applies.
+func (a *Authenticator) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		am, ok := msg.(*Auth)
+		if !ok {
+			h.Handle(ctx, c, msg)
+			return
+		}
+		if code, err := a.refresh(c, am.Payload.Token); err != nil {
+			a.logf("jwt: refused token refresh of %v: %v", c.UUID, err)
+			c.Send(message.NewNack(am, code, err))
+			return
+		}
+		a.add("TokenRefreshes", 1)
+		c.Send(message.NewAck(am))
+	})
+}
+
+// refresh replaces the claims of the connection with those of the
+// token. It returns the code of the NACK if the token is refused.
+func (a *Authenticator) refresh(c *juggler.Conn, token string) (int, error) {
+	claims, err := a.authenticate(token)
+	if err != nil {
+		return message.CodeUnauthorized, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ac := a.conns[c]
+	if ac == nil {
+		return message.CodeForbidden, errors.New("jwt: the connection is not authenticated with a token")
+	}
+	if id := a.identity(claims); id != c.Identity {
+		return message.CodeForbidden, fmt.Errorf("jwt: the token is for %q, not %q", id, c.Identity)
+	}
+	if a.TenantClaim != "" && claims.String(a.TenantClaim) != c.Tenant {
+		return message.CodeForbidden, errors.New("jwt: the token is for another tenant")
+	}
+	a.setClaims(c, ac, claims)
+	return 0, nil
+}
+
+// ClaimsOf returns the claims of the current token of the connection,
+// or nil if it is not authenticated by the Authenticator.
+func (a *Authenticator) ClaimsOf(c *juggler.Conn) *Claims {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ac := a.conns[c]; ac != nil {
+		return ac.claims
+	}
+	return nil
+}
+
+// requestToken returns the bearer token of the Authorization header of
+// the upgrade request, or of its query parameter.
+func (a *Authenticator) requestToken(r *http.Request) (string, bool) {
+	if v := r.Header.Get("Authorization"); len(v) >= 7 && strings.EqualFold(v[:7], "bearer ") {
+		return strings.TrimSpace(v[7:]), true
+	}
+	param := a.TokenParam
+	if param == "" {
+		param = DefaultTokenParam
+	}
+	if v := r.URL.Query().Get(param); v != "" {
+		return v, true
+	}
+	return "", false
+}
+
+func isIn(list []string, v string) bool {
+	for _, vv := range list {
+		if vv == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Authenticator) add(key string, n int64) {
+	if a.Vars != nil {
+		a.Vars.Add(key, n)
+	}
+}
+
+func (a *Authenticator) logf(f string, args ...interface{}) {
+	if a.LogFunc != nil {
+		a.LogFunc(f, args...)
+		return
+	}
+	log.Printf(f, args...)
+}
@@ -0,0 +1,153 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/jugglertest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestAuthenticator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "generate key")
+	token := func(sub string, ttl time.Duration) string {
+		exp := float64(time.Now().Add(ttl).UnixNano()) / 1e9
+		return sign(t, "RS256", "k1", key, map[string]interface{}{"sub": sub, "org": "acme", "aud": "juggler", "exp": exp})
+	}
+
+	vars := new(expvar.Map).Init()
+	auth := &Authenticator{
+		Keys:        Keys{"k1": &key.PublicKey},
+		Audience:    "juggler",
+		TenantClaim: "org",
+		AuthTimeout: time.Second,
+		Vars:        vars,
+		LogFunc:     func(string, ...interface{}) {},
+	}
+	brk := &jugglertest.Broker{}
+	server := &juggler.Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		ConnState:    auth.ConnState,
+		Handler: auth.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+			// the CALLs are refused with the identity of the connection
+			if _, ok := m.(*message.Call); ok {
+				c.Send(message.NewNack(m, message.CodeForbidden, errors.New(c.Identity+"/"+c.Tenant)))
+				return
+			}
+			juggler.ProcessMsg(c, m)
+		})),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(auth.Upgrade(upg, server))
+	defer srv.Close()
+	url := strings.Replace(srv.URL, "http:", "ws:", 1)
+
+	dialURL := func(url, tok string) (*client.Client, chan message.Msg, error) {
+		msgs := make(chan message.Msg, 10)
+		h := http.Header{}
+		if tok != "" {
+			h.Set("Authorization", "Bearer "+tok)
+		}
+		cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, url, h,
+			client.SetHandler(client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+				msgs <- m
+			})))
+		return cli, msgs, err
+	}
+	dial := func(tok string) (*client.Client, chan message.Msg, error) {
+		return dialURL(url, tok)
+	}
+	recv := func(msgs chan message.Msg) message.Msg {
+		select {
+		case m := <-msgs:
+			return m
+		case <-time.After(time.Second):
+			t.Fatal("no message received")
+		}
+		return nil
+	}
+	identity := func(cli *client.Client, msgs chan message.Msg) string {
+		_, err := cli.Call("whoami", nil, time.Second)
+		require.NoError(t, err, "Call")
+		nack, ok := recv(msgs).(*message.Nack)
+		require.True(t, ok, "NACK of the CALL")
+		return nack.Payload.Message
+	}
+
+	// the token in the header of the upgrade request
+	cli, msgs, err := dial(token("alice", time.Minute))
+	require.NoError(t, err, "Dial alice")
+	defer cli.Close()
+	assert.Equal(t, "alice/acme", identity(cli, msgs), "alice identity")
+
+	_, _, err = dial(token("alice", -time.Minute))
+	assert.Error(t, err, "Dial with an expired token")
+
+	// the token in the query parameter, as the JavaScript client sends it
+	qcli, qmsgs, err := dialURL(url+"?access_token="+token("dave", time.Minute), "")
+	require.NoError(t, err, "Dial dave")
+	defer qcli.Close()
+	assert.Equal(t, "dave/acme", identity(qcli, qmsgs), "dave identity")
+
+	// the token in an AUTH message
+	cli, msgs, err = dial("")
+	require.NoError(t, err, "Dial bob")
+	defer cli.Close()
+	require.NoError(t, cli.SendCustom(context.Background(), NewAuth(token("bob", 300*time.Millisecond))), "AUTH bob")
+	_, ok := recv(msgs).(*message.Ack)
+	require.True(t, ok, "ACK of the AUTH")
+	assert.Equal(t, "bob/acme", identity(cli, msgs), "bob identity")
+
+	// refresh the token before it expires
+	require.NoError(t, cli.SendCustom(context.Background(), NewAuth(token("bob", time.Minute))), "refresh bob")
+	_, ok = recv(msgs).(*message.Ack)
+	require.True(t, ok, "ACK of the refresh")
+	require.NoError(t, cli.SendCustom(context.Background(), NewAuth(token("alice", time.Minute))), "refresh alice")
+	nack, ok := recv(msgs).(*message.Nack)
+	require.True(t, ok, "NACK of the refresh for another identity")
+	assert.Equal(t, message.CodeForbidden, nack.Payload.Code, "NACK code")
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, "bob/acme", identity(cli, msgs), "bob identity after refresh")
+
+	// the connection is closed when its token expires
+	cli, _, err = dial(token("carol", 200*time.Millisecond))
+	require.NoError(t, err, "Dial carol")
+	defer cli.Close()
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not closed")
+	}
+
+	// the first message must be an AUTH
+	cli, _, err = dial("")
+	require.NoError(t, err, "Dial anonymous")
+	defer cli.Close()
+	_, err = cli.Call("whoami", nil, time.Second)
+	require.NoError(t, err, "Call")
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not closed")
+	}
+
+	assert.Equal(t, "4", vars.Get("AuthenticatedConns").String(), "AuthenticatedConns")
+	assert.Equal(t, "1", vars.Get("RejectedTokens").String(), "RejectedTokens")
+	assert.Equal(t, "1", vars.Get("TokenRefreshes").String(), "TokenRefreshes")
+	assert.Equal(t, "1", vars.Get("ExpiredTokenConns").String(), "ExpiredTokenConns")
+}
@@ -0,0 +1,240 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hashes of the algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// The errors of the validation of the tokens.
+var (
+	ErrMalformed        = errors.New("jwt: malformed token")
+	ErrUnsupportedAlg   = errors.New("jwt: unsupported algorithm")
+	ErrInvalidSignature = errors.New("jwt: invalid signature")
+	ErrExpired          = errors.New("jwt: token is expired")
+	ErrNotYetValid      = errors.New("jwt: token is not valid yet")
+	ErrInvalidIssuer    = errors.New("jwt: invalid issuer")
+	ErrInvalidAudience  = errors.New("jwt: invalid audience")
+)
+
+// DefaultAlgorithms are the signature algorithms of the tokens accepted
+// by an Authenticator with no Algorithms. The HMAC algorithms are not
+// accepted by default, they require a shared secret instead of the
+// public keys of the JWKS endpoints.
+var DefaultAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Claims are the claims of a validated token.
+type Claims struct {
+	Issuer    string    // iss
+	Subject   string    // sub
+	Audience  []string  // aud, a single string or an array of strings
+	ExpiresAt time.Time // exp, zero if the token does not expire
+	NotBefore time.Time // nbf
+	IssuedAt  time.Time // iat
+
+	// Raw are the JSON values of all the claims of the token, by name,
+	// including the registered claims above.
+	Raw map[string]json.RawMessage
+}
+
+// String returns the value of the claim name if it is a string, e.g.
+// the "sub" or "email" claims, or an empty string otherwise.
+func (c *Claims) String(name string) string {
+	var s string
+	if b, ok := c.Raw[name]; ok {
+		json.Unmarshal(b, &s)
+	}
+	return s
+}
+
+// header is the JOSE header of a token.
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parse decodes the token and returns its header, its claims, the
+// signed part and the signature. It does not verify anything.
+func parse(token string) (*header, *Claims, string, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, "", nil, ErrMalformed
+	}
+
+	var hdr header
+	if err := decodePart(parts[0], &hdr); err != nil {
+		return nil, nil, "", nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := decodePart(parts[1], &raw); err != nil {
+		return nil, nil, "", nil, err
+	}
+	claims, err := newClaims(raw)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, "", nil, ErrMalformed
+	}
+	return &hdr, claims, parts[0] + "." + parts[1], sig, nil
+}
+
+func decodePart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// registeredClaims are the registered claims supported by Claims.
+type registeredClaims struct {
+	Iss string          `json:"iss"`
+	Sub string          `json:"sub"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *float64        `json:"exp"`
+	Nbf *float64        `json:"nbf"`
+	Iat *float64        `json:"iat"`
+}
+
+func newClaims(raw map[string]json.RawMessage) (*Claims, error) {
+	b, _ := json.Marshal(raw)
+	var rc registeredClaims
+	if err := json.Unmarshal(b, &rc); err != nil {
+		return nil, ErrMalformed
+	}
+
+	c := &Claims{
+		Issuer:    rc.Iss,
+		Subject:   rc.Sub,
+		ExpiresAt: numericDate(rc.Exp),
+		NotBefore: numericDate(rc.Nbf),
+		IssuedAt:  numericDate(rc.Iat),
+		Raw:       raw,
+	}
+	if aud := bytes.TrimSpace(rc.Aud); len(aud) > 0 && aud[0] == '[' {
+		if err := json.Unmarshal(aud, &c.Audience); err != nil {
+			return nil, ErrMalformed
+		}
+	} else if len(aud) > 0 && string(aud) != "null" {
+		var s string
+		if err := json.Unmarshal(aud, &s); err != nil {
+			return nil, ErrMalformed
+		}
+		c.Audience = []string{s}
+	}
+	return c, nil
+}
+
+// numericDate returns the time of the NumericDate v, the number of
+// seconds since the epoch, or the zero time if v is nil.
+func numericDate(v *float64) time.Time {
+	if v == nil {
+		return time.Time{}
+	}
+	sec := int64(*v)
+	return time.Unix(sec, int64((*v-float64(sec))*1e9))
+}
+
+// verify verifies the signature sig of the signed part of a token with
+// the algorithm alg and the key.
+func verify(alg string, key interface{}, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return ErrUnsupportedAlg
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return ErrUnsupportedAlg
+	}
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("jwt: the key of %s is not a secret", alg)
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("jwt: the key of %s is not an RSA key", alg)
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		}
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != curveOf(alg) {
+			return fmt.Errorf("jwt: the key of %s is not an ECDSA key of its curve", alg)
+		}
+		// the signature is the concatenation of R and S
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlg
+}
+
+// curveOf returns the curve of the ECDSA algorithm alg.
+func curveOf(alg string) elliptic.Curve {
+	switch alg {
+	case "ES256":
+		return elliptic.P256()
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	}
+	return nil
+}
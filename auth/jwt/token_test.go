@@ -0,0 +1,126 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sign returns a token with the claims, signed with key using alg.
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	hdr, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err, "marshal header")
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err, "marshal claims")
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	var sig []byte
+	if alg[:2] == "HS" {
+		mac := hmac.New(hash.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	} else {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			if alg[0] == 'R' {
+				sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+			} else {
+				sig, err = rsa.SignPSS(rand.Reader, key, hash, digest, nil)
+			}
+			require.NoError(t, err, "sign %s", alg)
+		case *ecdsa.PrivateKey:
+			r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+			require.NoError(t, err, "sign %s", alg)
+			size := (key.Curve.Params().BitSize + 7) / 8
+			sig = make([]byte, 2*size)
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(sig[size-len(rb):size], rb)
+			copy(sig[2*size-len(sb):], sb)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestValidate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "generate RSA key")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "generate EC key")
+	secret := []byte("secret")
+
+	a := &Authenticator{
+		Keys:       Keys{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey, "hmac": secret},
+		Algorithms: []string{"RS256", "PS384", "ES256", "HS256"},
+		Issuer:     "https://issuer",
+		Audience:   "juggler",
+		Leeway:     time.Minute,
+	}
+
+	now := time.Now().Unix()
+	valid := func(extra map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"iss": "https://issuer", "aud": "juggler", "sub": "user", "exp": now + 60}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"RS256", sign(t, "RS256", "rsa", rsaKey, valid(nil)), nil},
+		{"PS384", sign(t, "PS384", "rsa", rsaKey, valid(nil)), nil},
+		{"ES256", sign(t, "ES256", "ec", ecKey, valid(nil)), nil},
+		{"HS256", sign(t, "HS256", "hmac", secret, valid(nil)), nil},
+		{"audience array", sign(t, "RS256", "rsa", rsaKey, valid(map[string]interface{}{"aud": []string{"a", "juggler"}})), nil},
+		{"within leeway", sign(t, "RS256", "rsa", rsaKey, valid(map[string]interface{}{"exp": now - 30})), nil},
+		{"expired", sign(t, "RS256", "rsa", rsaKey, valid(map[string]interface{}{"exp": now - 120})), ErrExpired},
+		{"not yet valid", sign(t, "RS256", "rsa", rsaKey, valid(map[string]interface{}{"nbf": now + 120})), ErrNotYetValid},
+		{"issuer", sign(t, "RS256", "rsa", rsaKey, valid(map[string]interface{}{"iss": "other"})), ErrInvalidIssuer},
+		{"audience", sign(t, "RS256", "rsa", rsaKey, valid(map[string]interface{}{"aud": "other"})), ErrInvalidAudience},
+		{"algorithm", sign(t, "RS512", "rsa", rsaKey, valid(nil)), ErrUnsupportedAlg},
+		{"unknown key", sign(t, "RS256", "x", rsaKey, valid(nil)), ErrUnknownKey},
+		{"wrong key", sign(t, "HS256", "hmac", []byte("other"), valid(nil)), ErrInvalidSignature},
+		{"malformed", "a.b", ErrMalformed},
+	}
+	for _, c := range cases {
+		claims, err := a.Validate(c.token)
+		if c.err != nil {
+			assert.Equal(t, c.err, err, c.name)
+			continue
+		}
+		if assert.NoError(t, err, c.name) {
+			assert.Equal(t, "user", claims.Subject, "%s subject", c.name)
+			assert.Equal(t, "user", claims.String("sub"), "%s sub", c.name)
+			assert.Contains(t, claims.Audience, "juggler", "%s audience", c.name)
+		}
+	}
+
+	// a token signed with an algorithm for another type of key
+	_, err = a.Validate(sign(t, "HS256", "rsa", secret, valid(nil)))
+	assert.Error(t, err, "HS256 with an RSA key")
+
+	// alg none is never accepted
+	parts := strings.Split(sign(t, "HS256", "hmac", secret, valid(nil)), ".")
+	hdr := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	_, err = (&Authenticator{Keys: a.Keys, Algorithms: []string{"none"}}).Validate(hdr + "." + parts[1] + ".")
+	assert.Equal(t, ErrUnsupportedAlg, err, "none")
+}
@@ -0,0 +1,158 @@
+package juggler
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// batchOps collects the broker operations of the messages of a Batch
+// while they go through the Handler, so that they are executed together
+// once all messages are handled.
+type batchOps struct {
+	calls broker.BatchBroker // nil if the CallerBroker does not execute batches
+	pubs  broker.BatchBroker // nil if the PubSubBroker does not execute batches
+	ops   []*batchOp
+}
+
+// batchOp is a call request or an event of a batch, with the message
+// it is for.
+type batchOp struct {
+	msg    message.Msg
+	call   *broker.BatchCall
+	pub    *broker.BatchPub
+	cached bool // the call is registered to cache its result
+	err    error
+}
+
+// processBatch handles each message of the batch m as if it was sent on
+// its own, and executes the call requests and events that reach the
+// brokers together, in a single broker.Batch per URI for the calls and
+// a single one for the events. The ACKs and NACKs of the requests are
+// sent once the batches are executed, in the order of the messages.
+func processBatch(c *Conn, m *message.Batch, addFn func(string, int64)) {
+	ops := &batchOps{}
+	ops.calls, _ = c.srv.CallerBroker.(broker.BatchBroker)
+	ops.pubs, _ = c.srv.PubSubBroker.(broker.BatchBroker)
+	if ops.calls != nil || ops.pubs != nil {
+		c.batchmu.Lock()
+		c.batch = ops
+		c.batchmu.Unlock()
+	}
+
+	for _, msg := range m.Payload.Msgs {
+		if h := c.srv.Handler; h != nil {
+			h.Handle(context.Background(), c, msg)
+		} else {
+			ProcessMsg(c, msg)
+		}
+	}
+
+	c.batchmu.Lock()
+	c.batch = nil
+	c.batchmu.Unlock()
+	ops.exec(c, addFn)
+}
+
+// addBatchCall adds the call request to the batch being processed, if
+// any. It returns false if the call must be registered on its own.
+// Only the round-robin routing mode is supported in batches.
+func (c *Conn) addBatchCall(m *message.Call, cp *message.CallPayload, cached bool) bool {
+	c.batchmu.Lock()
+	defer c.batchmu.Unlock()
+	if c.batch == nil || c.batch.calls == nil || cp.Routing != message.RoundRobin {
+		return false
+	}
+	c.batch.ops = append(c.batch.ops, &batchOp{
+		msg:    m,
+		call:   &broker.BatchCall{Payload: cp, Timeout: m.Payload.Timeout},
+		cached: cached,
+	})
+	return true
+}
+
+// addBatchPub adds the event to publish on the channel of the broker to
+// the batch being processed, if any. It returns false if the event must
+// be published on its own.
+func (c *Conn) addBatchPub(m *message.Pub, channel string, pp *message.PubPayload) bool {
+	c.batchmu.Lock()
+	defer c.batchmu.Unlock()
+	if c.batch == nil || c.batch.pubs == nil {
+		return false
+	}
+	c.batch.ops = append(c.batch.ops, &batchOp{
+		msg: m,
+		pub: &broker.BatchPub{Channel: channel, Payload: pp},
+	})
+	return true
+}
+
+// exec executes the collected operations and sends the ACK or NACK of
+// each of them. The call requests are executed in a batch per URI, so
+// that each batch is stored in a single hash slot in a redis cluster.
+// If a batch fails, all its operations fail.
+func (ops *batchOps) exec(c *Conn, addFn func(string, int64)) {
+	if len(ops.ops) == 0 {
+		return
+	}
+
+	var uris []string
+	calls := make(map[string][]*batchOp)
+	var pubs []*batchOp
+	for _, op := range ops.ops {
+		if op.call == nil {
+			pubs = append(pubs, op)
+			continue
+		}
+		uri := op.call.Payload.URI
+		if _, ok := calls[uri]; !ok {
+			uris = append(uris, uri)
+		}
+		calls[uri] = append(calls[uri], op)
+	}
+
+	for _, uri := range uris {
+		execBatchOps(ops.calls, calls[uri], addFn)
+	}
+	if len(pubs) > 0 {
+		execBatchOps(ops.pubs, pubs, addFn)
+	}
+
+	for _, op := range ops.ops {
+		switch m := op.msg.(type) {
+		case *message.Call:
+			if op.err != nil {
+				callFailed(c, m, op.err, op.cached, addFn)
+				continue
+			}
+		case *message.Pub:
+			if op.err != nil {
+				c.Send(message.NewNack(m, message.CodeHandlerError, op.err))
+				continue
+			}
+		}
+		sendAck(c, op.msg)
+	}
+}
+
+// execBatchOps executes the operations in a single batch with bb, and
+// records the error, if any, on each operation.
+func execBatchOps(bb broker.BatchBroker, ops []*batchOp, addFn func(string, int64)) {
+	var b broker.Batch
+	for _, op := range ops {
+		if op.call != nil {
+			b.Calls = append(b.Calls, *op.call)
+		} else {
+			b.Pubs = append(b.Pubs, *op.pub)
+		}
+	}
+
+	addFn("BatchExecs", 1)
+	if err := bb.ExecBatch(&b); err != nil {
+		addFn("FailedBatchExecs", 1)
+		for _, op := range ops {
+			op.err = err
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package juggler_test
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeBatchBroker struct {
+	fakeCallerBroker
+	broker.PubSubBroker
+
+	mu      sync.Mutex
+	batches []*broker.Batch
+}
+
+func (f *fakeBatchBroker) ExecBatch(b *broker.Batch) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range b.Calls {
+		if c.Payload.URI == "fail" {
+			return errors.New("batch failed")
+		}
+	}
+	f.batches = append(f.batches, b)
+	return nil
+}
+
+func TestBatch(t *testing.T) {
+	bb := &fakeBatchBroker{}
+	server := &juggler.Server{CallerBroker: bb, PubSubBroker: bb, Vars: new(expvar.Map).Init()}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call, pub"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	// the client handles the messages concurrently, so they may be
+	// received in any order
+	expect := func(name string, ids []uuid.UUID, typ message.Type) {
+		want := make(map[string]bool, len(ids))
+		got := make(map[string]bool, len(ids))
+		for i, id := range ids {
+			want[id.String()] = true
+			select {
+			case m := <-msgs:
+				assert.Equal(t, typ, m.Type(), "%s: %d: type", name, i)
+				switch m := m.(type) {
+				case *message.Ack:
+					got[m.Payload.For.String()] = true
+				case *message.Nack:
+					got[m.Payload.For.String()] = true
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: %d: no response", name, i)
+			}
+		}
+		assert.Equal(t, want, got, "%s: responses", name)
+	}
+
+	ids, err := cli.PubBatch("c", []interface{}{1, 2, 3})
+	require.NoError(t, err, "PubBatch")
+	expect("PubBatch", ids, message.AckMsg)
+
+	ids, err = cli.CallBatch("a", []interface{}{1, 2}, time.Minute)
+	require.NoError(t, err, "CallBatch")
+	expect("CallBatch", ids, message.AckMsg)
+
+	ids, err = cli.CallBatch("fail", []interface{}{1, 2}, time.Minute)
+	require.NoError(t, err, "CallBatch")
+	expect("failed CallBatch", ids, message.NackMsg)
+
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	if assert.Equal(t, 2, len(bb.batches), "executed batches") {
+		assert.Equal(t, 3, len(bb.batches[0].Pubs), "events")
+		assert.Equal(t, "c", bb.batches[0].Pubs[0].Channel, "channel")
+		assert.Equal(t, 2, len(bb.batches[1].Calls), "calls")
+	}
+	assert.Equal(t, "3", server.Vars.Get("BatchExecs").String(), "BatchExecs")
+	assert.Equal(t, "1", server.Vars.Get("FailedBatchExecs").String(), "FailedBatchExecs")
+	assert.Equal(t, "3", server.Vars.Get("MsgsBTCH").String(), "MsgsBTCH")
+}
@@ -0,0 +1,87 @@
+package juggler
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// Broadcast writes an event with args on channel directly to the
+// connections served by srv for which filter returns true, or to all
+// of them if filter is nil, without going through the broker, e.g. to
+// announce a maintenance of this server. The connections don't have to
+// be subscribed to channel. It returns the number of connections the
+// event was sent to.
+func (srv *Server) Broadcast(channel string, args interface{}, filter func(*Conn) bool) (int, error) {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return 0, err
+	}
+	ev := &message.EvntPayload{
+		MsgUUID:   message.NewID(),
+		Channel:   channel,
+		Args:      b,
+		Timestamp: time.Now().UTC(),
+	}
+	return srv.broadcast(ev, filter), nil
+}
+
+// broadcast sends ev to the connections for which filter returns true,
+// concurrently so that a slow client doesn't delay the others.
+func (srv *Server) broadcast(ev *message.EvntPayload, filter func(*Conn) bool) int {
+	list := srv.served.list(filter)
+
+	var wg sync.WaitGroup
+	wg.Add(len(list))
+	for _, c := range list {
+		go func(c *Conn) {
+			defer wg.Done()
+			c.Send(message.NewEvnt(ev))
+		}(c)
+	}
+	wg.Wait()
+
+	if srv.Vars != nil {
+		srv.Vars.Add("Broadcasts", 1)
+		srv.Vars.Add("BroadcastEvnts", int64(len(list)))
+	}
+	return len(list)
+}
+
+// BroadcastAll publishes the broadcast of an event with args on channel
+// on message.BroadcastChannel, so that every server of the cluster that
+// relays the broadcasts (see RelayBroadcasts) writes it to all its
+// connections.
+func (srv *Server) BroadcastAll(channel string, args interface{}) error {
+	pp, err := message.NewBroadcast(channel, args)
+	if err != nil {
+		return err
+	}
+	return srv.PubSubBroker.Publish(message.BroadcastChannel, pp)
+}
+
+// RelayBroadcasts subscribes psc to message.BroadcastChannel and writes
+// the broadcasts published by BroadcastAll to all the connections served
+// by srv. It blocks until psc is closed, and returns the error that
+// caused its events to stop, if any. The psc should be dedicated to the
+// broadcasts. The clients cannot publish on the broadcast channel, as
+// the PUB requests on the system channels are rejected.
+func (srv *Server) RelayBroadcasts(psc broker.PubSubConn) error {
+	if err := psc.Subscribe(message.BroadcastChannel, false); err != nil {
+		return err
+	}
+	for pld := range psc.Events() {
+		ev, ok := message.BroadcastEvnt(pld)
+		if !ok {
+			if srv.Vars != nil {
+				srv.Vars.Add("InvalidBroadcasts", 1)
+			}
+			continue
+		}
+		srv.broadcast(ev, nil)
+	}
+	return psc.EventsErr()
+}
@@ -0,0 +1,162 @@
+package juggler_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// publishBroker records the payloads published on the broadcast channel.
+type publishBroker struct {
+	fakePubSubBroker
+	ch chan *message.PubPayload
+}
+
+func (b publishBroker) Publish(channel string, pp *message.PubPayload) error {
+	if channel == message.BroadcastChannel {
+		b.ch <- pp
+	}
+	return nil
+}
+
+func TestBroadcast(t *testing.T) {
+	ids := make(chan string, 3)
+	ids <- "u1"
+	ids <- "u2"
+	ids <- "u3"
+	vars := new(expvar.Map).Init()
+	psb := publishBroker{ch: make(chan *message.PubPayload, 1)}
+	server := &juggler.Server{
+		PubSubBroker: psb,
+		Vars:         vars,
+		ConnState: func(c *juggler.Conn, cs juggler.ConnState) {
+			if cs == juggler.Accepting {
+				c.Identity = <-ids
+			}
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	// the SUB makes sure that the connection is served before the
+	// broadcasts
+	dial := func() (*client.Client, chan message.Msg) {
+		msgs := make(chan message.Msg, 10)
+		h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+			msgs <- m
+		})
+		hdr := http.Header{"Juggler-Allowed-Messages": {"sub"}}
+		cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, hdr, client.SetHandler(h))
+		require.NoError(t, err, "Dial")
+		_, err = cli.Sub("a", false)
+		require.NoError(t, err, "Sub")
+		waitMsg(t, msgs, message.AckMsg, "Sub")
+		return cli, msgs
+	}
+	evnt := func(ch chan message.Msg, label string) *message.Evnt {
+		select {
+		case m := <-ch:
+			ev, ok := m.(*message.Evnt)
+			require.True(t, ok, "%s: got %s", label, m.Type())
+			return ev
+		case <-time.After(time.Second):
+			require.FailNow(t, "no event", label)
+		}
+		return nil
+	}
+	none := func(ch chan message.Msg, label string) {
+		select {
+		case m := <-ch:
+			assert.Fail(t, "unexpected message", "%s: %s", label, m.Type())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	cli1, msgs1 := dial()
+	defer cli1.Close()
+	cli2, msgs2 := dial()
+	defer cli2.Close()
+
+	n, err := server.Broadcast("maintenance", "in 5 minutes", nil)
+	require.NoError(t, err, "Broadcast")
+	assert.Equal(t, 2, n, "all connections")
+	for i, ch := range []chan message.Msg{msgs1, msgs2} {
+		ev := evnt(ch, "Broadcast")
+		assert.Equal(t, "maintenance", ev.Payload.Channel, "%d: channel", i)
+		assert.Equal(t, `"in 5 minutes"`, string(ev.Payload.Args), "%d: args", i)
+	}
+
+	n, err = server.Broadcast("kick", 1, func(c *juggler.Conn) bool { return c.Identity == "u2" })
+	require.NoError(t, err, "Broadcast filtered")
+	assert.Equal(t, 1, n, "filtered connections")
+	evnt(msgs2, "Broadcast filtered")
+	none(msgs1, "filtered out")
+
+	// the cluster-wide broadcast is published on the broadcast channel and
+	// relayed to all connections
+	require.NoError(t, server.BroadcastAll("maintenance", "now"), "BroadcastAll")
+	var pp *message.PubPayload
+	select {
+	case pp = <-psb.ch:
+	case <-time.After(time.Second):
+		require.FailNow(t, "no broadcast published")
+	}
+
+	psc := &fakePubSubConn{ch: make(chan *message.EvntPayload)}
+	done := make(chan error)
+	go func() { done <- server.RelayBroadcasts(psc) }()
+	psc.ch <- &message.EvntPayload{MsgUUID: pp.MsgUUID, Channel: message.BroadcastChannel, Args: pp.Args}
+	psc.ch <- &message.EvntPayload{MsgUUID: message.NewID(), Channel: message.BroadcastChannel, Args: json.RawMessage(`{"event":"other"}`)}
+	for i, ch := range []chan message.Msg{msgs1, msgs2} {
+		ev := evnt(ch, "BroadcastAll")
+		assert.Equal(t, pp.MsgUUID, ev.Payload.For, "%d: relayed msg UUID", i)
+		assert.Equal(t, "maintenance", ev.Payload.Channel, "%d: relayed channel", i)
+		assert.Equal(t, `"now"`, string(ev.Payload.Args), "%d: relayed args", i)
+	}
+	psc.Close()
+	assert.NoError(t, <-done, "RelayBroadcasts")
+
+	// the clients cannot publish broadcasts
+	msgs := make(chan message.Msg, 10)
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"pub"}}, client.SetHandler(client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+			msgs <- m
+		})))
+	require.NoError(t, err, "Dial publisher")
+	defer cli.Close()
+	_, err = cli.Pub(message.BroadcastChannel, json.RawMessage(`{"event":"broadcast","channel":"maintenance"}`))
+	require.NoError(t, err, "Pub")
+	select {
+	case m := <-msgs:
+		if nack, ok := m.(*message.Nack); assert.True(t, ok, "PUB on broadcast channel: got %s", m.Type()) {
+			assert.Equal(t, message.CodeForbidden, nack.Payload.Code, "NACK code")
+			assert.Equal(t, juggler.ErrSystemChannel.Error(), nack.Payload.Message, "NACK message")
+		}
+	case <-time.After(time.Second):
+		require.FailNow(t, "no NACK")
+	}
+	select {
+	case <-psb.ch:
+		assert.Fail(t, "client broadcast published")
+	default:
+	}
+	assert.Equal(t, "1", vars.Get("SystemChannelPubs").String(), "system channel PUBs metric")
+
+	assert.Equal(t, "3", vars.Get("Broadcasts").String(), "broadcasts metric")
+	assert.Equal(t, "5", vars.Get("BroadcastEvnts").String(), "events metric")
+	assert.Equal(t, "1", vars.Get("InvalidBroadcasts").String(), "invalid metric")
+}
@@ -1,9 +1,12 @@
 // Package broker defines the generic interfaces that a broker must
 // implement in order to act as a juggler broker. The redisbroker
-// package implements those interfaces against a redis backend.
+// package implements those interfaces against a redis backend, and the
+// brokertest package tests that an implementation conforms to them.
 package broker
 
 import (
+	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/PuerkitoBio/juggler/message"
@@ -17,26 +20,144 @@ import (
 // on the message. It should not be set to less than 1ms.
 var DefaultCallTimeout = time.Minute
 
+// ErrNoAttemptLeft is returned by CalleeBroker.Retry when the call
+// request cannot be attempted again.
+var ErrNoAttemptLeft = errors.New("juggler/broker: no attempt left")
+
+// ErrUnsupportedVersion is returned by CallerBroker.Call and
+// CallerBroker.CallAt when the call request has a version and no callee
+// listens on the versioned URI (see message.VersionedURI).
+var ErrUnsupportedVersion = errors.New("juggler/broker: unsupported version")
+
+// ErrCallerGone is returned by CalleeBroker.Result when the connection
+// that made the call is not served anymore, because it was closed or
+// because its server died, so that the result can never be delivered.
+var ErrCallerGone = errors.New("juggler/broker: caller connection gone")
+
+// ErrNoCallee is returned by CallerBroker.Call when the call request is
+// sticky or broadcast (see message.RoutingMode) and no callee instance
+// listens on its URI.
+var ErrNoCallee = errors.New("juggler/broker: no callee listening")
+
 // CallerBroker defines the methods for a broker in the caller role.
 type CallerBroker interface {
 	// NewResultsConn returns a new ResultsConn that can be used
 	// to process results from calls for the specified connection UUID.
+	// The connection is registered as served by the calling server
+	// until the ResultsConn is closed.
 	NewResultsConn(uuid.UUID) (ResultsConn, error)
 
 	// Call registers a call request in the broker.
 	Call(cp *message.CallPayload, timeout time.Duration) error
+
+	// CallAt registers a call request in the broker so that it is
+	// processed at the specified time. The timeout of the call is
+	// cp.Timeout, starting at that time.
+	CallAt(cp *message.CallPayload, at time.Time) error
+
+	// CallAfter registers a call request in the broker so that it is
+	// processed after the specified delay. The timeout of the call is
+	// cp.Timeout, starting after that delay.
+	CallAfter(cp *message.CallPayload, delay time.Duration) error
 }
 
 // CalleeBroker defines the methods for a broker in the callee role.
 type CalleeBroker interface {
 	// NewCallsConn returns a new CallsConn that can be used to
-	// process call requests for the specified URIs. For use in
-	// a redis cluster, all URIs must belong to the same
+	// process call requests for the specified URIs. A URI can be
+	// a pattern (see message.MatchURI), in which case the connection
+	// also receives the call requests to the matching URIs that no
+	// other callee listens on, with the concrete URI in the payload.
+	// For use in a redis cluster, all URIs must belong to the same
 	// cluster slot.
 	NewCallsConn(uris ...string) (CallsConn, error)
 
-	// Result registers a call result in the broker.
+	// Result registers a call result in the broker. It returns
+	// ErrCallerGone if the connection of the caller is not served
+	// anymore.
 	Result(rp *message.ResPayload, timeout time.Duration) error
+
+	// Retry registers the next attempt of a call request in the
+	// broker, after the backoff delay of the call. It returns
+	// ErrNoAttemptLeft if the call cannot be retried.
+	Retry(cp *message.CallPayload) error
+}
+
+// QuarantineBroker defines the methods for a broker that tracks the
+// consecutive failures of call requests, and quarantines the call
+// requests that keep failing.
+type QuarantineBroker interface {
+	// AddFailure records a failure of the call request identified by
+	// key, and returns the number of consecutive failures for that key.
+	AddFailure(cp *message.CallPayload, key string) (int, error)
+
+	// ResetFailures clears the failures recorded for the call request
+	// identified by key.
+	ResetFailures(cp *message.CallPayload, key string) error
+
+	// Quarantine stores the call request in the dead-letter queue of
+	// its URI, and clears its recorded failures.
+	Quarantine(dl *message.DeadLetterPayload) error
+}
+
+// RequeueBroker defines the method for a callee broker that can put
+// back the call requests received by a callee that did not process
+// them, e.g. because it is drained before a restart, so that another
+// callee processes them.
+type RequeueBroker interface {
+	// Requeue registers the call request again for its remaining
+	// time-to-live, as the same attempt. A call request that has
+	// expired is dropped.
+	Requeue(cp *message.CallPayload) error
+}
+
+// RegistryBroker defines the methods for a broker that keeps the registry
+// of live callee instances.
+type RegistryBroker interface {
+	// Heartbeat registers the callee instance for its URIs, or refreshes
+	// its registration. The registration expires after ttl if it is not
+	// refreshed.
+	Heartbeat(ci *message.CalleeInfo, ttl time.Duration) error
+
+	// Unregister removes the registration of the callee instance for its
+	// URIs.
+	Unregister(ci *message.CalleeInfo) error
+
+	// Callees returns the live callee instances registered for uri.
+	Callees(uri string) ([]*message.CalleeInfo, error)
+}
+
+// PatternBroker defines the method for a registry broker that routes the
+// call requests to the callees that listen on a URI pattern (see
+// CalleeBroker.NewCallsConn).
+type PatternBroker interface {
+	// CalleePatterns returns the URI patterns listened on by live
+	// callees.
+	CalleePatterns() ([]string, error)
+}
+
+// CacheBroker defines the methods for a broker that caches the results
+// of call requests.
+type CacheBroker interface {
+	// CachedResult returns the cached result of the call request to uri
+	// identified by key, or nil if no result is cached.
+	CachedResult(uri, key string) (json.RawMessage, error)
+
+	// CacheResult caches the result of the call request to uri identified
+	// by key, for the duration of ttl.
+	CacheResult(uri, key string, result json.RawMessage, ttl time.Duration) error
+}
+
+// SchemaBroker defines the methods for a broker that stores the schemas
+// of the arguments and results of the call requests to a URI.
+type SchemaBroker interface {
+	// RegisterSchema stores the schema document of uri, replacing any
+	// existing one.
+	RegisterSchema(uri string, doc json.RawMessage) error
+
+	// Schema returns the schema document of uri, or nil if no schema
+	// is registered.
+	Schema(uri string) (json.RawMessage, error)
 }
 
 // PubSubBroker defines the methods for a broker in the pub-sub role.
@@ -50,6 +171,89 @@ type PubSubBroker interface {
 	Publish(channel string, pp *message.PubPayload) error
 }
 
+// HistoryBroker defines the methods for a broker that retains the events
+// published on pub-sub channels.
+type HistoryBroker interface {
+	// History returns the events retained for channel that were
+	// published between from and to inclusively, oldest first. A zero
+	// from or to means no bound. If limit is > 0 and more events are
+	// retained in that range, only the limit most recent ones are
+	// returned.
+	History(channel string, from, to time.Time, limit int) ([]*message.EvntPayload, error)
+}
+
+// Subscription is a subscription to a pub-sub channel, which is treated
+// as a pattern if Pattern is true.
+type Subscription struct {
+	Channel string `json:"channel"`
+	Pattern bool   `json:"pattern,omitempty"`
+}
+
+// StickyBroker defines the methods for a broker that stores the sticky
+// subscriptions of the identities, which apply to all the connections of
+// an identity (see message.Sub).
+type StickyBroker interface {
+	// AddSticky adds the sticky subscription sub of identity. Adding an
+	// existing subscription is not an error.
+	AddSticky(identity string, sub Subscription) error
+
+	// RemoveSticky removes the sticky subscription sub of identity.
+	// Removing an unknown subscription is not an error.
+	RemoveSticky(identity string, sub Subscription) error
+
+	// Sticky returns the sticky subscriptions of identity, in no
+	// particular order.
+	Sticky(identity string) ([]Subscription, error)
+}
+
+// Inspector defines the methods for a broker that reports the backlog
+// of its call requests and results, e.g. for the admin tooling or to
+// scale the callees.
+type Inspector interface {
+	// QueueLen returns the number of call requests of uri waiting for a
+	// callee, on all priorities and callee instances.
+	QueueLen(uri string) (int, error)
+
+	// PendingResults returns the number of results waiting to be read
+	// by the connection identified by connUUID.
+	PendingResults(connUUID uuid.UUID) (int, error)
+
+	// ExpiredCount returns the number of call requests of uri waiting
+	// for a callee that expired, and will be dropped or retried when a
+	// callee receives them.
+	ExpiredCount(uri string) (int, error)
+}
+
+// Batch is a set of broker operations to execute atomically, so that
+// downstream systems never observe only part of them, e.g. a call
+// request and the event announcing it.
+type Batch struct {
+	Calls []BatchCall
+	Pubs  []BatchPub
+}
+
+// BatchCall is a call request of a Batch, registered as with
+// CallerBroker.Call.
+type BatchCall struct {
+	Payload *message.CallPayload
+	Timeout time.Duration
+}
+
+// BatchPub is an event of a Batch, published as with
+// PubSubBroker.Publish.
+type BatchPub struct {
+	Channel string
+	Payload *message.PubPayload
+}
+
+// BatchBroker defines the methods for a broker that executes batches of
+// operations atomically.
+type BatchBroker interface {
+	// ExecBatch executes the operations of the batch atomically: either
+	// all of them are applied, or none is and an error is returned.
+	ExecBatch(b *Batch) error
+}
+
 // ResultsConn defines the methods to list the results from calls
 // made on the ResultsConn connection UUID.
 type ResultsConn interface {
@@ -96,7 +300,7 @@ type CallsConn interface {
 // for a connection.
 type PubSubConn interface {
 	// Subscribe subscribes the connection to channel, which is treated
-	// as a pattern if pattern is true.
+	// as a pattern in the PatternSyntax of the broker if pattern is true.
 	Subscribe(channel string, pattern bool) error
 
 	// Unsubscribe unsubscribes the connection from the channel, which
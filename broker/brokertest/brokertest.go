@@ -0,0 +1,587 @@
+// Package brokertest implements a conformance test suite for the
+// implementations of the broker interfaces, so that a broker other than
+// redisbroker can check that it behaves as the juggler servers and
+// callees expect, the way golang.org/x/net/nettest does for net.Conn.
+//
+// The suite is run from a test of the broker's package, with a function
+// that creates a new broker for each test:
+//
+//     func TestConformance(t *testing.T) {
+//         brokertest.TestCallBroker(t, func() (brokertest.CallBroker, func(), error) {
+//             b, err := mybroker.New(addr)
+//             return b, func() { b.Flush() }, err
+//         })
+//         brokertest.TestPubSubBroker(t, func() (broker.PubSubBroker, func(), error) {
+//             ...
+//         })
+//     }
+//
+// It checks that the call requests and results are delivered once, with
+// their payload intact (including large payloads), that the expired
+// ones are dropped, that concurrent consumers share the call requests
+// and that each pub-sub connection receives all the events of its
+// subscriptions, and that closing a connection closes its channel and
+// keeps the pending call requests for the other connections, and that
+// the call requests put back with broker.RequeueBroker, if the broker
+// implements it, are delivered again. The tests use URIs and channels prefixed with "brokertest.".
+package brokertest
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Timeout is the maximum duration to wait for a call request, a result
+// or an event to be delivered.
+var Timeout = 5 * time.Second
+
+// LargePayloadSize is the size in bytes of the arguments of the large
+// payloads.
+var LargePayloadSize = 1 << 20
+
+// CallBroker is a broker in the caller and callee roles.
+type CallBroker interface {
+	broker.CallerBroker
+	broker.CalleeBroker
+}
+
+// MakeCallBroker creates a new CallBroker without pending call requests
+// or results, and returns the function to call to release it once the
+// test is done.
+type MakeCallBroker func() (b CallBroker, stop func(), err error)
+
+// MakePubSubBroker creates a new PubSubBroker, and returns the function
+// to call to release it once the test is done.
+type MakePubSubBroker func() (b broker.PubSubBroker, stop func(), err error)
+
+// TestCallBroker runs the tests of the call requests and results on the
+// brokers created by mb, a new broker for each test.
+func TestCallBroker(t *testing.T, mb MakeCallBroker) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, CallBroker)
+	}{
+		{"CallResult", testCallResult},
+		{"LargePayload", testLargeCallPayload},
+		{"ExpiredCall", testExpiredCall},
+		{"ExpiredResult", testExpiredResult},
+		{"CallerGone", testCallerGone},
+		{"ConcurrentCallees", testConcurrentCallees},
+		{"CloseCalls", testCloseCalls},
+		{"CloseResults", testCloseResults},
+		{"Requeue", testRequeue},
+	}
+	for _, tt := range tests {
+		func() {
+			b, stop, err := mb()
+			require.NoError(t, err, "%s: make broker", tt.name)
+			defer stop()
+			t.Logf("brokertest: %s", tt.name)
+			tt.fn(t, b)
+		}()
+	}
+}
+
+// TestPubSubBroker runs the tests of the pub-sub connections on the
+// brokers created by mb, a new broker for each test.
+func TestPubSubBroker(t *testing.T, mb MakePubSubBroker) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, broker.PubSubBroker)
+	}{
+		{"PubSub", testPubSub},
+		{"Pattern", testPattern},
+		{"Unsubscribe", testUnsubscribe},
+		{"LargePayload", testLargeEvntPayload},
+		{"ConcurrentSubscribers", testConcurrentSubscribers},
+		{"ClosePubSub", testClosePubSub},
+	}
+	for _, tt := range tests {
+		func() {
+			b, stop, err := mb()
+			require.NoError(t, err, "%s: make broker", tt.name)
+			defer stop()
+			t.Logf("brokertest: %s", tt.name)
+			tt.fn(t, b)
+		}()
+	}
+}
+
+func newCall(uri string, args string) *message.CallPayload {
+	return &message.CallPayload{
+		ConnUUID: uuid.NewRandom(),
+		MsgUUID:  uuid.NewRandom(),
+		URI:      uri,
+		Args:     json.RawMessage(args),
+	}
+}
+
+func newRes(cp *message.CallPayload, args string) *message.ResPayload {
+	return &message.ResPayload{
+		ConnUUID: cp.ConnUUID,
+		MsgUUID:  cp.MsgUUID,
+		URI:      cp.URI,
+		Args:     json.RawMessage(args),
+	}
+}
+
+// largeArgs returns a JSON string of LargePayloadSize bytes.
+func largeArgs() string {
+	return `"` + strings.Repeat("x", LargePayloadSize-2) + `"`
+}
+
+func nextCall(t *testing.T, cc broker.CallsConn, label string) *message.CallPayload {
+	select {
+	case cp, ok := <-cc.Calls():
+		require.True(t, ok, "%s: calls channel closed: %v", label, cc.CallsErr())
+		return cp
+	case <-time.After(Timeout):
+		require.FailNow(t, "no call request", label)
+	}
+	return nil
+}
+
+func nextRes(t *testing.T, rc broker.ResultsConn, label string) *message.ResPayload {
+	select {
+	case rp, ok := <-rc.Results():
+		require.True(t, ok, "%s: results channel closed: %v", label, rc.ResultsErr())
+		return rp
+	case <-time.After(Timeout):
+		require.FailNow(t, "no result", label)
+	}
+	return nil
+}
+
+func testCallResult(t *testing.T, b CallBroker) {
+	cp := newCall("brokertest.a", `{"x":1}`)
+	cp.Headers = message.Headers{"trace-id": "t1"}
+	cp.Deadline = time.Now().Add(time.Minute).UTC()
+	rc, err := b.NewResultsConn(cp.ConnUUID)
+	require.NoError(t, err, "CallResult: NewResultsConn")
+	defer rc.Close()
+	cc, err := b.NewCallsConn(cp.URI)
+	require.NoError(t, err, "CallResult: NewCallsConn")
+	defer cc.Close()
+
+	require.NoError(t, b.Call(cp, time.Minute), "CallResult: Call")
+	got := nextCall(t, cc, "CallResult: call")
+	assert.Equal(t, cp.MsgUUID.String(), got.MsgUUID.String(), "CallResult: call message UUID")
+	assert.Equal(t, cp.ConnUUID.String(), got.ConnUUID.String(), "CallResult: call connection UUID")
+	assert.Equal(t, cp.URI, got.URI, "CallResult: call URI")
+	assert.Equal(t, string(cp.Args), string(got.Args), "CallResult: call arguments")
+	assert.Equal(t, cp.Headers, got.Headers, "CallResult: call headers")
+	assert.True(t, cp.Deadline.Equal(got.Deadline), "CallResult: call deadline %v, want %v", got.Deadline, cp.Deadline)
+	assert.False(t, got.EnqueueTimestamp.IsZero(), "CallResult: call enqueue timestamp")
+	assert.True(t, got.QueueWait() < Timeout, "CallResult: call queue wait %v", got.QueueWait())
+
+	rp := newRes(got, `"ok"`)
+	rp.Headers = message.Headers{"trace-id": "t1", "server-timing": "1"}
+	rp.Timing = &message.Timing{QueueWait: got.QueueWait(), Handler: time.Millisecond}
+	require.NoError(t, b.Result(rp, time.Minute), "CallResult: Result")
+	res := nextRes(t, rc, "CallResult: result")
+	assert.Equal(t, cp.MsgUUID.String(), res.MsgUUID.String(), "CallResult: result message UUID")
+	assert.Equal(t, cp.URI, res.URI, "CallResult: result URI")
+	assert.Equal(t, `"ok"`, string(res.Args), "CallResult: result")
+	assert.Equal(t, rp.Headers, res.Headers, "CallResult: result headers")
+	assert.Equal(t, rp.Timing, res.Timing, "CallResult: result timing")
+}
+
+func testLargeCallPayload(t *testing.T, b CallBroker) {
+	args := largeArgs()
+	cp := newCall("brokertest.a", args)
+	rc, err := b.NewResultsConn(cp.ConnUUID)
+	require.NoError(t, err, "LargePayload: NewResultsConn")
+	defer rc.Close()
+	cc, err := b.NewCallsConn(cp.URI)
+	require.NoError(t, err, "LargePayload: NewCallsConn")
+	defer cc.Close()
+
+	require.NoError(t, b.Call(cp, time.Minute), "LargePayload: Call")
+	got := nextCall(t, cc, "LargePayload: call")
+	assert.True(t, string(got.Args) == args, "LargePayload: call arguments of %d bytes, want %d", len(got.Args), len(args))
+
+	require.NoError(t, b.Result(newRes(got, args), time.Minute), "LargePayload: Result")
+	res := nextRes(t, rc, "LargePayload: result")
+	assert.True(t, string(res.Args) == args, "LargePayload: result of %d bytes, want %d", len(res.Args), len(args))
+}
+
+func testExpiredCall(t *testing.T, b CallBroker) {
+	expired := newCall("brokertest.a", "1")
+	live := newCall("brokertest.a", "2")
+	require.NoError(t, b.Call(expired, 10*time.Millisecond), "ExpiredCall: Call")
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, b.Call(live, time.Minute), "ExpiredCall: Call")
+
+	cc, err := b.NewCallsConn("brokertest.a")
+	require.NoError(t, err, "ExpiredCall: NewCallsConn")
+	defer cc.Close()
+
+	got := nextCall(t, cc, "ExpiredCall: call")
+	assert.Equal(t, live.MsgUUID.String(), got.MsgUUID.String(), "ExpiredCall: the expired call is dropped")
+}
+
+func testExpiredResult(t *testing.T, b CallBroker) {
+	cp := newCall("brokertest.a", "1")
+	rc, err := b.NewResultsConn(cp.ConnUUID)
+	require.NoError(t, err, "ExpiredResult: NewResultsConn")
+	defer rc.Close()
+
+	expired := newRes(cp, "1")
+	live := newRes(cp, "2")
+	live.MsgUUID = uuid.NewRandom()
+	require.NoError(t, b.Result(expired, 10*time.Millisecond), "ExpiredResult: Result")
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, b.Result(live, time.Minute), "ExpiredResult: Result")
+
+	got := nextRes(t, rc, "ExpiredResult: result")
+	assert.Equal(t, live.MsgUUID.String(), got.MsgUUID.String(), "ExpiredResult: the expired result is dropped")
+}
+
+// testCallerGone requires the broker to reject the results for the
+// connections that are not served anymore.
+func testCallerGone(t *testing.T, b CallBroker) {
+	cp := newCall("brokertest.a", "1")
+	rc, err := b.NewResultsConn(cp.ConnUUID)
+	require.NoError(t, err, "CallerGone: NewResultsConn")
+	require.NoError(t, rc.Close(), "CallerGone: Close")
+
+	assert.Equal(t, broker.ErrCallerGone, b.Result(newRes(cp, "1"), time.Minute), "CallerGone: Result for a closed connection")
+}
+
+func testConcurrentCallees(t *testing.T, b CallBroker) {
+	const (
+		callees   = 3
+		consumers = 2 // per callee connection
+		callers   = 5
+		calls     = 20 // per caller
+	)
+
+	var (
+		mu     sync.Mutex
+		seen   = make(map[string]int)
+		wg     sync.WaitGroup
+		done   = make(chan struct{})
+		closed bool
+	)
+	for i := 0; i < callees; i++ {
+		cc, err := b.NewCallsConn("brokertest.a")
+		require.NoError(t, err, "ConcurrentCallees: NewCallsConn %d", i)
+		defer cc.Close()
+
+		for j := 0; j < consumers; j++ {
+			go func() {
+				for cp := range cc.Calls() {
+					mu.Lock()
+					seen[cp.MsgUUID.String()]++
+					if len(seen) == callers*calls && !closed {
+						close(done)
+						closed = true
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+
+	var sent []string
+	var sentMu sync.Mutex
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < calls; j++ {
+				cp := newCall("brokertest.a", "1")
+				if assert.NoError(t, b.Call(cp, time.Minute), "ConcurrentCallees: Call %d-%d", i, j) {
+					sentMu.Lock()
+					sent = append(sent, cp.MsgUUID.String())
+					sentMu.Unlock()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(Timeout):
+	}
+	// leave time for duplicates to be received
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range sent {
+		assert.Equal(t, 1, seen[id], "ConcurrentCallees: call %s received once", id)
+	}
+	assert.Equal(t, len(sent), len(seen), "ConcurrentCallees: received calls")
+}
+
+func testCloseCalls(t *testing.T, b CallBroker) {
+	cc, err := b.NewCallsConn("brokertest.a")
+	require.NoError(t, err, "CloseCalls: NewCallsConn")
+	ch := cc.Calls()
+	require.NoError(t, cc.Close(), "CloseCalls: Close")
+	waitClosed(t, func() bool {
+		select {
+		case _, ok := <-ch:
+			return !ok
+		case <-time.After(Timeout):
+			return false
+		}
+	}, "CloseCalls: calls channel closed")
+
+	// the call requests made after the close are delivered to another
+	// connection
+	cp := newCall("brokertest.a", "1")
+	require.NoError(t, b.Call(cp, time.Minute), "CloseCalls: Call")
+	cc, err = b.NewCallsConn("brokertest.a")
+	require.NoError(t, err, "CloseCalls: NewCallsConn")
+	defer cc.Close()
+	got := nextCall(t, cc, "CloseCalls: call")
+	assert.Equal(t, cp.MsgUUID.String(), got.MsgUUID.String(), "CloseCalls: call delivered to the new connection")
+}
+
+// testRequeue checks that a requeued call request is delivered again,
+// if the broker implements broker.RequeueBroker.
+func testRequeue(t *testing.T, b CallBroker) {
+	rb, ok := b.(broker.RequeueBroker)
+	if !ok {
+		return
+	}
+
+	cp := newCall("brokertest.a", "1")
+	require.NoError(t, b.Call(cp, time.Minute), "Requeue: Call")
+	cc, err := b.NewCallsConn("brokertest.a")
+	require.NoError(t, err, "Requeue: NewCallsConn")
+	defer cc.Close()
+	got := nextCall(t, cc, "Requeue: call")
+	require.NoError(t, rb.Requeue(got), "Requeue: Requeue")
+
+	again := nextCall(t, cc, "Requeue: requeued call")
+	assert.Equal(t, cp.MsgUUID.String(), again.MsgUUID.String(), "Requeue: requeued call message UUID")
+	assert.Equal(t, got.Attempt, again.Attempt, "Requeue: requeued call attempt")
+	assert.True(t, again.TTLAfterRead > 0 && again.TTLAfterRead <= got.TTLAfterRead, "Requeue: requeued call TTL %v, was %v", again.TTLAfterRead, got.TTLAfterRead)
+}
+
+func testCloseResults(t *testing.T, b CallBroker) {
+	rc, err := b.NewResultsConn(uuid.NewRandom())
+	require.NoError(t, err, "CloseResults: NewResultsConn")
+	ch := rc.Results()
+	require.NoError(t, rc.Close(), "CloseResults: Close")
+	waitClosed(t, func() bool {
+		select {
+		case _, ok := <-ch:
+			return !ok
+		case <-time.After(Timeout):
+			return false
+		}
+	}, "CloseResults: results channel closed")
+}
+
+// waitClosed fails the test if closed returns false. Closed drains the
+// values received before the close.
+func waitClosed(t *testing.T, closed func() bool, label string) {
+	deadline := time.Now().Add(Timeout)
+	for time.Now().Before(deadline) {
+		if closed() {
+			return
+		}
+	}
+	require.FailNow(t, "channel not closed", label)
+}
+
+// probeArgs are the arguments of the events published to check that a
+// subscription is active, that are ignored by nextEvnt.
+const probeArgs = `"brokertest.probe"`
+
+// subscribe subscribes psc to channel and waits until the subscription
+// is active, by publishing events on probe, a channel that matches the
+// subscription, until one is received.
+func subscribe(t *testing.T, b broker.PubSubBroker, psc broker.PubSubConn, channel string, pattern bool, probe string, label string) {
+	require.NoError(t, psc.Subscribe(channel, pattern), "%s: Subscribe", label)
+
+	deadline := time.Now().Add(Timeout)
+	for time.Now().Before(deadline) {
+		require.NoError(t, b.Publish(probe, &message.PubPayload{
+			MsgUUID:   uuid.NewRandom(),
+			Args:      json.RawMessage(probeArgs),
+			Timestamp: time.Now().UTC(),
+		}), "%s: Publish probe", label)
+
+		select {
+		case ev, ok := <-psc.Events():
+			require.True(t, ok, "%s: events channel closed: %v", label, psc.EventsErr())
+			if string(ev.Args) == probeArgs {
+				return
+			}
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	require.FailNow(t, "subscription not active", label)
+}
+
+func nextEvnt(t *testing.T, psc broker.PubSubConn, label string) *message.EvntPayload {
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case ev, ok := <-psc.Events():
+			require.True(t, ok, "%s: events channel closed: %v", label, psc.EventsErr())
+			if string(ev.Args) != probeArgs {
+				return ev
+			}
+		case <-timeout:
+			require.FailNow(t, "no event", label)
+			return nil
+		}
+	}
+}
+
+func publish(t *testing.T, b broker.PubSubBroker, channel, args string, label string) *message.PubPayload {
+	pp := &message.PubPayload{
+		MsgUUID:   uuid.NewRandom(),
+		Args:      json.RawMessage(args),
+		Timestamp: time.Now().UTC(),
+	}
+	require.NoError(t, b.Publish(channel, pp), "%s: Publish", label)
+	return pp
+}
+
+func testPubSub(t *testing.T, b broker.PubSubBroker) {
+	psc, err := b.NewPubSubConn()
+	require.NoError(t, err, "PubSub: NewPubSubConn")
+	defer psc.Close()
+	subscribe(t, b, psc, "brokertest.a", false, "brokertest.a", "PubSub")
+
+	publish(t, b, "brokertest.b", "1", "PubSub")
+	pp := &message.PubPayload{
+		MsgUUID:   uuid.NewRandom(),
+		Args:      json.RawMessage(`{"x":2}`),
+		Timestamp: time.Now().UTC(),
+		Headers:   message.Headers{"trace-id": "t1"},
+	}
+	require.NoError(t, b.Publish("brokertest.a", pp), "PubSub: Publish")
+	ev := nextEvnt(t, psc, "PubSub: event")
+	assert.Equal(t, pp.MsgUUID.String(), ev.MsgUUID.String(), "PubSub: event message UUID, not the event of the other channel")
+	assert.Equal(t, "brokertest.a", ev.Channel, "PubSub: event channel")
+	assert.Equal(t, "", ev.Pattern, "PubSub: event pattern")
+	assert.Equal(t, string(pp.Args), string(ev.Args), "PubSub: event arguments")
+	assert.True(t, pp.Timestamp.Equal(ev.Timestamp), "PubSub: event timestamp %v, want %v", ev.Timestamp, pp.Timestamp)
+	assert.Equal(t, pp.Headers, ev.Headers, "PubSub: event headers")
+}
+
+func testPattern(t *testing.T, b broker.PubSubBroker) {
+	psc, err := b.NewPubSubConn()
+	require.NoError(t, err, "Pattern: NewPubSubConn")
+	defer psc.Close()
+	subscribe(t, b, psc, "brokertest.p.*", true, "brokertest.p.probe", "Pattern")
+
+	publish(t, b, "brokertest.q", "1", "Pattern")
+	pp := publish(t, b, "brokertest.p.x", "2", "Pattern")
+	ev := nextEvnt(t, psc, "Pattern: event")
+	assert.Equal(t, pp.MsgUUID.String(), ev.MsgUUID.String(), "Pattern: event message UUID, not the event of the other channel")
+	assert.Equal(t, "brokertest.p.x", ev.Channel, "Pattern: event channel")
+	assert.Equal(t, "brokertest.p.*", ev.Pattern, "Pattern: event pattern")
+}
+
+func testUnsubscribe(t *testing.T, b broker.PubSubBroker) {
+	psc, err := b.NewPubSubConn()
+	require.NoError(t, err, "Unsubscribe: NewPubSubConn")
+	defer psc.Close()
+	subscribe(t, b, psc, "brokertest.a", false, "brokertest.a", "Unsubscribe")
+	subscribe(t, b, psc, "brokertest.b", false, "brokertest.b", "Unsubscribe")
+
+	require.NoError(t, psc.Unsubscribe("brokertest.a", false), "Unsubscribe: Unsubscribe")
+	// the unsubscription may be asynchronous, so the events of a are
+	// published until an event of b, published after them, is the only
+	// one received.
+	deadline := time.Now().Add(Timeout)
+	for time.Now().Before(deadline) {
+		publish(t, b, "brokertest.a", "1", "Unsubscribe")
+		marker := publish(t, b, "brokertest.b", "2", "Unsubscribe")
+
+		ev := nextEvnt(t, psc, "Unsubscribe: event")
+		if ev.MsgUUID.String() == marker.MsgUUID.String() {
+			return
+		}
+		assert.Equal(t, "brokertest.a", ev.Channel, "Unsubscribe: event channel")
+		nextEvnt(t, psc, "Unsubscribe: marker")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "events received after the unsubscription", "Unsubscribe")
+}
+
+func testLargeEvntPayload(t *testing.T, b broker.PubSubBroker) {
+	psc, err := b.NewPubSubConn()
+	require.NoError(t, err, "LargePayload: NewPubSubConn")
+	defer psc.Close()
+	subscribe(t, b, psc, "brokertest.a", false, "brokertest.a", "LargePayload")
+
+	args := largeArgs()
+	publish(t, b, "brokertest.a", args, "LargePayload")
+	ev := nextEvnt(t, psc, "LargePayload: event")
+	assert.True(t, string(ev.Args) == args, "LargePayload: event arguments of %d bytes, want %d", len(ev.Args), len(args))
+}
+
+func testConcurrentSubscribers(t *testing.T, b broker.PubSubBroker) {
+	const (
+		subscribers = 3
+		publishers  = 4
+		events      = 10 // per publisher
+	)
+
+	pscs := make([]broker.PubSubConn, subscribers)
+	for i := range pscs {
+		psc, err := b.NewPubSubConn()
+		require.NoError(t, err, "ConcurrentSubscribers: NewPubSubConn %d", i)
+		defer psc.Close()
+		subscribe(t, b, psc, "brokertest.a", false, "brokertest.a", "ConcurrentSubscribers")
+		pscs[i] = psc
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(publishers)
+	for i := 0; i < publishers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < events; j++ {
+				pp := &message.PubPayload{MsgUUID: uuid.NewRandom(), Args: json.RawMessage("1"), Timestamp: time.Now().UTC()}
+				assert.NoError(t, b.Publish("brokertest.a", pp), "ConcurrentSubscribers: Publish %d-%d", i, j)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, psc := range pscs {
+		seen := make(map[string]bool)
+		for len(seen) < publishers*events {
+			ev := nextEvnt(t, psc, "ConcurrentSubscribers: event")
+			assert.False(t, seen[ev.MsgUUID.String()], "ConcurrentSubscribers: event %s received once by subscriber %d", ev.MsgUUID, i)
+			seen[ev.MsgUUID.String()] = true
+		}
+	}
+}
+
+func testClosePubSub(t *testing.T, b broker.PubSubBroker) {
+	psc, err := b.NewPubSubConn()
+	require.NoError(t, err, "ClosePubSub: NewPubSubConn")
+	subscribe(t, b, psc, "brokertest.a", false, "brokertest.a", "ClosePubSub")
+	ch := psc.Events()
+	require.NoError(t, psc.Close(), "ClosePubSub: Close")
+	waitClosed(t, func() bool {
+		select {
+		case _, ok := <-ch:
+			return !ok
+		case <-time.After(Timeout):
+			return false
+		}
+	}, "ClosePubSub: events channel closed")
+}
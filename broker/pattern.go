@@ -0,0 +1,239 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// PatternSyntax defines the semantics of the channel patterns of the
+// pattern subscriptions (see PubSubConn.Subscribe), so that they match
+// the same channels regardless of the broker. The brokers translate the
+// patterns to their own syntax, and filter the events if the translation
+// matches more channels.
+type PatternSyntax int
+
+// The list of pattern syntaxes.
+const (
+	// GlobPatterns are the glob-style patterns of redis: "*" matches any
+	// sequence of characters, "?" matches any character, "[abc]" and
+	// "[a-c]" match one of the characters of the set, "[^abc]" any other
+	// character, and "\" escapes the next character.
+	GlobPatterns PatternSyntax = iota
+
+	// MQTTPatterns are the MQTT-style patterns on the segments of the
+	// channels, separated by dots: the "+" segment matches exactly one
+	// segment, and the "#" segment, only allowed as the last segment,
+	// matches zero or more segments. For example, "sensors.+.temp"
+	// matches "sensors.kitchen.temp", and "sensors.#" matches "sensors"
+	// and "sensors.kitchen.temp". The tenant of a tenant name is matched
+	// literally (see message.TenantName).
+	MQTTPatterns
+
+	// ExactPatterns have no wildcard, a pattern only matches the channel
+	// with the same name.
+	ExactPatterns
+)
+
+// The wildcard segments of the MQTTPatterns.
+const (
+	mqttSegmentWildcard = "+"
+	mqttTailWildcard    = "#"
+)
+
+var patternSyntaxNames = [...]string{
+	GlobPatterns:  "glob",
+	MQTTPatterns:  "mqtt",
+	ExactPatterns: "exact",
+}
+
+// String returns the name of the pattern syntax.
+func (s PatternSyntax) String() string {
+	if s < 0 || int(s) >= len(patternSyntaxNames) {
+		return fmt.Sprintf("<unknown: %d>", int(s))
+	}
+	return patternSyntaxNames[s]
+}
+
+// ParsePatternSyntax returns the pattern syntax named name, either
+// "glob", "mqtt" or "exact". The empty name is GlobPatterns.
+func ParsePatternSyntax(name string) (PatternSyntax, error) {
+	if name == "" {
+		return GlobPatterns, nil
+	}
+	for i, n := range patternSyntaxNames {
+		if n == name {
+			return PatternSyntax(i), nil
+		}
+	}
+	return 0, fmt.Errorf("juggler/broker: unknown pattern syntax %q", name)
+}
+
+// Match returns true if channel matches pattern in the syntax s.
+func (s PatternSyntax) Match(pattern, channel string) bool {
+	switch s {
+	case MQTTPatterns:
+		ptenant, p := message.SplitTenant(pattern)
+		ctenant, c := message.SplitTenant(channel)
+		if ptenant != ctenant {
+			return false
+		}
+		ps, cs := strings.Split(p, "."), strings.Split(c, ".")
+		for i, seg := range ps {
+			if seg == mqttTailWildcard && i == len(ps)-1 {
+				return true
+			}
+			if i >= len(cs) || (seg != mqttSegmentWildcard && seg != cs[i]) {
+				return false
+			}
+		}
+		return len(ps) == len(cs)
+	case ExactPatterns:
+		return pattern == channel
+	default:
+		return globMatch(pattern, channel)
+	}
+}
+
+// Glob returns the glob-style pattern (see GlobPatterns) that matches the
+// channels that pattern matches in the syntax s, for the brokers that
+// support glob-style patterns, such as redis. If exact is false, the
+// glob-style pattern matches more channels, and the events must be
+// filtered with Match.
+func (s PatternSyntax) Glob(pattern string) (glob string, exact bool) {
+	switch s {
+	case MQTTPatterns:
+		tenant, p := message.SplitTenant(pattern)
+		var prefix string
+		if tenant != "" {
+			prefix = escapeGlob(tenant) + message.TenantSeparator
+		}
+
+		segs := strings.Split(p, ".")
+		exact = true
+		for i, seg := range segs {
+			switch {
+			case seg == mqttTailWildcard && i == len(segs)-1:
+				// matches zero or more segments, the glob also matches
+				// the names that only share a prefix with the segments.
+				if i == 0 {
+					return prefix + "*", false
+				}
+				return prefix + strings.Join(segs[:i], ".") + "*", false
+			case seg == mqttSegmentWildcard:
+				segs[i] = "*"
+				exact = false
+			default:
+				segs[i] = escapeGlob(seg)
+			}
+		}
+		return prefix + strings.Join(segs, "."), exact
+	case ExactPatterns:
+		return escapeGlob(pattern), true
+	default:
+		return pattern, true
+	}
+}
+
+// escapeGlob escapes the special characters of the glob-style patterns
+// in s.
+func escapeGlob(s string) string {
+	if !strings.ContainsAny(s, `*?[]\`) {
+		return s
+	}
+	var b bytes.Buffer
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// globMatch returns true if s matches the glob-style pattern, with the
+// semantics of redis.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			var match bool
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == s[0] {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if s[0] >= lo && s[0] <= hi {
+						match = true
+					}
+					pattern = pattern[2:]
+				default:
+					if pattern[0] == s[0] {
+						match = true
+					}
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) > 0 {
+				// skip the closing bracket
+				pattern = pattern[1:]
+			}
+			if match == not {
+				return false
+			}
+			s = s[1:]
+
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePatternSyntax(t *testing.T) {
+	for _, s := range []PatternSyntax{GlobPatterns, MQTTPatterns, ExactPatterns} {
+		got, err := ParsePatternSyntax(s.String())
+		require.NoError(t, err, "%s", s)
+		assert.Equal(t, s, got, "%s", s)
+	}
+	got, err := ParsePatternSyntax("")
+	require.NoError(t, err, "empty")
+	assert.Equal(t, GlobPatterns, got, "default")
+	_, err = ParsePatternSyntax("regexp")
+	assert.Error(t, err, "unknown")
+}
+
+func TestPatternMatch(t *testing.T) {
+	cases := []struct {
+		syntax   PatternSyntax
+		pattern  string
+		channels map[string]bool
+	}{
+		{GlobPatterns, "a.*", map[string]bool{"a.b": true, "a.b.c": true, "a/b": false, "a.": true, "b.a": false}},
+		{GlobPatterns, "a?[bc]", map[string]bool{"axb": true, "axc": true, "axd": false, "ab": false}},
+		{GlobPatterns, "a[^b]", map[string]bool{"ab": false, "ac": true}},
+		{GlobPatterns, "a[b-d]", map[string]bool{"ac": true, "ae": false}},
+		{GlobPatterns, `a\*`, map[string]bool{"a*": true, "ab": false}},
+		{MQTTPatterns, "a.+", map[string]bool{"a.b": true, "a.b.c": false, "a": false, "a.+": true}},
+		{MQTTPatterns, "a.+.c", map[string]bool{"a.b.c": true, "a.b.d": false, "a.b.c.d": false}},
+		{MQTTPatterns, "a.#", map[string]bool{"a": true, "a.b": true, "a.b.c": true, "ab": false, "b": false}},
+		{MQTTPatterns, "#", map[string]bool{"a": true, "a.b": true}},
+		{MQTTPatterns, "a.*", map[string]bool{"a.*": true, "a.b": false}},
+		{MQTTPatterns, "t/+.b", map[string]bool{"t/a.b": true, "u/a.b": false, "a.b": false}},
+		{MQTTPatterns, "#", map[string]bool{"t/a": false}},
+		{ExactPatterns, "a.*", map[string]bool{"a.*": true, "a.b": false}},
+	}
+	for _, c := range cases {
+		glob, exact := c.syntax.Glob(c.pattern)
+		for ch, want := range c.channels {
+			assert.Equal(t, want, c.syntax.Match(c.pattern, ch), "%s %q: %q", c.syntax, c.pattern, ch)
+
+			// the glob translation matches at least the same channels, and
+			// exactly those if exact is true
+			gm := globMatch(glob, ch)
+			if want {
+				assert.True(t, gm, "%s %q: glob %q matches %q", c.syntax, c.pattern, glob, ch)
+			} else if exact {
+				assert.False(t, gm, "%s %q: exact glob %q does not match %q", c.syntax, c.pattern, glob, ch)
+			}
+		}
+	}
+}
+
+func TestPatternGlob(t *testing.T) {
+	cases := []struct {
+		syntax  PatternSyntax
+		pattern string
+		glob    string
+		exact   bool
+	}{
+		{GlobPatterns, "a.*", "a.*", true},
+		{MQTTPatterns, "a.b", "a.b", true},
+		{MQTTPatterns, "a.+", "a.*", false},
+		{MQTTPatterns, "a.#", "a*", false},
+		{MQTTPatterns, "#", "*", false},
+		{MQTTPatterns, "a?.+", `a\?.*`, false},
+		{MQTTPatterns, "t/a.#", "t/a*", false},
+		{ExactPatterns, "a[1].*", `a\[1\].\*`, true},
+	}
+	for _, c := range cases {
+		glob, exact := c.syntax.Glob(c.pattern)
+		assert.Equal(t, c.glob, glob, "%s %q: glob", c.syntax, c.pattern)
+		assert.Equal(t, c.exact, exact, "%s %q: exact", c.syntax, c.pattern)
+	}
+}
@@ -0,0 +1,143 @@
+package redisbroker
+
+import (
+	"fmt"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ broker.BatchBroker = (*Broker)(nil)
+
+// script to register the call requests and publish the events of a
+// batch. The KEYS are the expiration and list keys of each call request,
+// followed by the sequence key of each event if the events are stamped
+// with their sequence number. ARGV[1] is the number of call requests,
+// ARGV[2] the list capacity, ARGV[3] is 1 to stamp the events, followed
+// by the timeout and payload of each call request and the channel and
+// payload of each event. The capacity of the lists is checked before
+// any write, so that the batch is either fully applied or not at all.
+// It returns the sequence numbers of the events, if they are stamped.
+var batchScript = redis.NewScript(-1, `
+	local ncalls = tonumber(ARGV[1])
+	local limit = tonumber(ARGV[2])
+	local stamp = ARGV[3] == "1"
+	if limit > 0 then
+		local counts = {}
+		for i = 1, ncalls do
+			local k = KEYS[2 * i]
+			counts[k] = (counts[k] or redis.call("LLEN", k)) + 1
+			if counts[k] > limit then
+				return redis.error_reply("list capacity exceeded")
+			end
+		end
+	end
+
+	for i = 1, ncalls do
+		local timeout = tonumber(ARGV[2 + 2 * i])
+		redis.call("SET", KEYS[2 * i - 1], timeout, "PX", timeout)
+		redis.call("LPUSH", KEYS[2 * i], ARGV[3 + 2 * i])
+	end
+	local seqs = {}
+	for i = 4 + 2 * ncalls, #ARGV, 2 do
+		local p = ARGV[i + 1]
+		if stamp then
+			local seq = redis.call("INCR", KEYS[2 * ncalls + #seqs + 1])
+			seqs[#seqs + 1] = seq
+			p = '{"seq":' .. seq .. ',' .. string.sub(p, 2)
+		end
+		redis.call("PUBLISH", ARGV[i], p)
+	end
+	return seqs
+`)
+
+// ExecBatch registers the call requests and publishes the events of the
+// batch atomically, in a single script. The call requests are routed
+// to the URI patterns as with Broker.Call, but only the round-robin
+// routing mode is supported. In a redis cluster, all call requests of
+// a batch must be stored in the same hash slot, i.e. be for the same
+// URI, otherwise the batch fails. If EventSequence is set, the events
+// are stamped with their sequence number as with Broker.Publish, and
+// their sequence keys must also be in that slot, e.g. by using a hash
+// tag in the channels. The events are retained for the channel history
+// once the batch is applied, if HistoryCap is set.
+func (b *Broker) ExecBatch(bt *broker.Batch) error {
+	if len(bt.Calls) == 0 && len(bt.Pubs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, 2*len(bt.Calls))
+	args := redis.Args{len(bt.Calls), b.CallCap, 0}
+	if b.EventSequence {
+		args[2] = 1
+	}
+	for _, c := range bt.Calls {
+		cp, err := b.routePattern(c.Payload)
+		if err != nil {
+			return err
+		}
+		cp = firstAttempt(cp, c.Timeout)
+		if err := checkPriority(cp); err != nil {
+			return err
+		}
+		if cp.Routing != message.RoundRobin {
+			return fmt.Errorf("unsupported routing mode %s in batch", cp.Routing)
+		}
+
+		p, err := b.codec().marshal(cp)
+		if err != nil {
+			return err
+		}
+		uri := queueURI(cp)
+		keys = append(keys, fmt.Sprintf(callTimeoutKey, uri, cp.MsgUUID), callListKey(uri, cp.Priority))
+		args = args.Add(timeoutMs(c.Timeout), p)
+	}
+
+	pubs := make([][]byte, len(bt.Pubs))
+	for i, pub := range bt.Pubs {
+		p, err := marshalPub(pub.Payload)
+		if err != nil {
+			return err
+		}
+		pubs[i] = p
+		args = args.Add(pub.Channel, p)
+	}
+	if b.EventSequence {
+		for _, pub := range bt.Pubs {
+			keys = append(keys, fmt.Sprintf(seqKey, pub.Channel))
+		}
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	// turn it into a cluster-aware RetryConn if running in a cluster
+	if len(keys) > 0 {
+		rc = clusterifyConn(rc, keys...)
+	} else if bc, ok := rc.(binder); ok {
+		// events only, select a random node as for Publish
+		bc.Bind()
+	}
+
+	scriptArgs := redis.Args{len(keys)}.AddFlat(keys)
+	seqs, err := redis.Int64s(batchScript.Do(rc, append(scriptArgs, args...)...))
+	if err != nil {
+		return err
+	}
+	for i, seq := range seqs {
+		pubs[i] = stampSeq(pubs[i], uint64(seq))
+	}
+
+	if b.HistoryCap > 0 {
+		for i, pub := range bt.Pubs {
+			if err := b.retainEvent(pub.Channel, pub.Payload, pubs[i]); err != nil {
+				logf(b.LogFunc, "ExecBatch: failed to retain event %v: %v", pub.Payload.MsgUUID, err)
+				if b.Vars != nil {
+					b.Vars.Add("FailedHistoryStores", 1)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package redisbroker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecBatch(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+		CallCap: 2,
+	}
+
+	newCall := func() broker.BatchCall {
+		cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+		return broker.BatchCall{Payload: cp, Timeout: time.Second}
+	}
+	pub := broker.BatchPub{Channel: "a", Payload: &message.PubPayload{MsgUUID: uuid.NewRandom()}}
+
+	require.NoError(t, brk.ExecBatch(&broker.Batch{}), "empty batch")
+
+	c1, c2, c3 := newCall(), newCall(), newCall()
+	require.NoError(t, brk.ExecBatch(&broker.Batch{Calls: []broker.BatchCall{c1}, Pubs: []broker.BatchPub{pub}}), "ExecBatch")
+	expectUUIDs(t, pool.Get(), fmt.Sprintf(callKey, "a"), c1.Payload.MsgUUID)
+
+	rc := pool.Get()
+	n, err := redis.Int(rc.Do("EXISTS", fmt.Sprintf(callTimeoutKey, "a", c1.Payload.MsgUUID)))
+	rc.Close()
+	require.NoError(t, err, "EXISTS")
+	assert.Equal(t, 1, n, "timeout key")
+
+	// exceeds the capacity, nothing is applied
+	err = brk.ExecBatch(&broker.Batch{Calls: []broker.BatchCall{c2, c3}})
+	assert.Error(t, err, "capacity exceeded")
+	expectUUIDs(t, pool.Get(), fmt.Sprintf(callKey, "a"), c1.Payload.MsgUUID)
+
+	c2.Payload.Routing = message.Broadcast
+	err = brk.ExecBatch(&broker.Batch{Calls: []broker.BatchCall{c2}})
+	assert.Error(t, err, "unsupported routing mode")
+	expectUUIDs(t, pool.Get(), fmt.Sprintf(callKey, "a"), c1.Payload.MsgUUID)
+}
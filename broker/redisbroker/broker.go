@@ -12,6 +12,134 @@
 // requests are hashed on the call URI, and the results
 // are hashed on the calling connection's UUID.
 //
+// Each call request and result is stored along with its expiring key
+// by a single Lua script, in one round trip, so that a request is never
+// stored without its expiration and a request rejected because its
+// list is full leaves nothing behind. The scripts are run with EVALSHA
+// and only sent to a redis server the first time it doesn't know them.
+//
+// When many servers share the broker, the results of a call are
+// only useful to the server that serves the calling connection.
+// Each results connection holds a lease on its connection UUID,
+// in the same slot as the results, recording the ID of its server
+// (see Broker.ServerID) and refreshed until it is closed. If the
+// callees set Broker.CheckLeases, a result for a connection without a
+// lease, because it was closed or because its server died, is rejected
+// with broker.ErrCallerGone instead of being stored. As the servers
+// that predate the leases never set them, CheckLeases must only be set
+// on the callees once all the servers are upgraded. Results are not
+// re-delivered to another server, as a new connection has a new UUID,
+// and the results left over for a connection whose server died expire
+// with their timeout.
+//
+// Call requests are routed according to the routing mode of the
+// call payload. In the default round-robin mode, the request is
+// pushed on the URI's list and the first callee to pop it processes
+// it. Each calls connection also registers itself in a sorted set of
+// callee instances for its URIs, scored by the expiration time of its
+// registration and refreshed while it polls for calls, and listens on
+// an instance-specific list. In sticky mode, the instance is selected
+// by hashing the routing key over the live instances, and in broadcast
+// mode, the request is pushed on the list of every live instance, or
+// on none of them if one of their lists is full. If no instance is
+// live, sticky and broadcast calls fail with broker.ErrNoCallee. The
+// instances are selected before the script that stores the request
+// runs, so that it only writes to the keys it is given, all in the
+// slot of the URI. A callee that terminates without closing its calls
+// connection stops receiving the sticky and broadcast calls once its
+// registration expires, and the calls routed to it until then will
+// expire.
+//
+// Scheduled call requests (see Broker.CallAt) are stored in a sorted
+// set per URI, scored by the time at which they are due. Each calls
+// connection moves the due requests of its URIs from the sorted set
+// to the lists, so that they are processed as any other call request,
+// and scheduled requests are only processed if a callee is listening
+// on their URI. Due times are compared with the clock of the callee.
+// A due request that cannot be registered, e.g. because its list is
+// full, is stored again in the sorted set, due immediately.
+//
+// Call requests with more than one attempt are registered again after
+// their backoff delay, when the callee asks for a retry or when the
+// request expires before being picked up. Retries with a backoff delay
+// are scheduled call requests.
+//
+// Call requests with a priority above 0 are stored in a separate list
+// per URI and priority level, in the same slot as the URI's call list,
+// and likewise for the instance-specific lists. Calls connections
+// listen on the lists of the highest priority first, so that high
+// priority requests are processed before the backlog of lower priority
+// ones. The CallCap applies to each list.
+//
+// The consecutive failures of a call request are counted in an
+// expiring key (see FailuresTTL), and quarantined call requests are
+// stored in a dead-letter list per URI, both in the same slot as the
+// URI's call list.
+//
+// Live callee instances register themselves in a sorted set per URI,
+// scored by the expiration time of their registration and refreshed
+// by heartbeats, with their information stored in a hash per URI (see
+// Broker.Heartbeat). Expired registrations are removed when listing
+// the callees of a URI.
+//
+// Calls connections can listen on URI patterns (see message.MatchURI),
+// e.g. "billing.*", so that a callee serves a whole namespace. The
+// patterns are stored with their expiration time in a sorted set,
+// refreshed by the calls connections, and cached by the Broker that
+// registers the call requests for PatternsRefreshInterval. A call
+// request to a URI without any registered callee instance is routed
+// to the most specific live pattern that matches its URI, and stored
+// in the keys of the pattern instead of those of the URI, with the
+// pattern recorded in the payload. The concrete URI is left untouched.
+//
+// Call requests and results larger than Broker.CompressThreshold are
+// stored compressed with gzip, the gzip header being the flag that
+// identifies a compressed payload when it is read back. If Broker.Keys
+// is set, the arguments of the call requests and results are stored
+// encrypted with AES-GCM, with the ID of their key.
+//
+// The events received by a pub-sub connection can be sharded
+// over a fixed number of goroutines by hashing their channel (see
+// Broker.EventShards), with a bounded buffer per shard.
+//
+// When HistoryCap is set, the published events are also retained in a
+// sorted set per channel, scored by their timestamp and trimmed to the
+// HistoryCap most recent events and to the HistoryTTL, so that they can
+// be queried with Broker.History.
+//
+// When EventSequence is set, the events are stamped with a sequence
+// number per channel, incremented in a counter key of the channel by
+// the same script that publishes the event, so that the sequence
+// numbers of a channel are in the order of its events. The events are
+// published on the node of that key in a redis cluster instead of on
+// a random node.
+//
+// Call requests with a version are stored in the keys of their
+// versioned URI (see message.VersionedURI), on which the callees that
+// support that version listen. They fail with
+// broker.ErrUnsupportedVersion if no callee instance is registered for
+// the versioned URI.
+//
+// When CallStreams is set, the round-robin call requests are stored in
+// a redis stream per URI and priority instead of a list, in the same
+// slot as the URI's call list, and the calls connections read them as
+// the consumers of a consumer group, named after their callee instance.
+// A request delivered to a callee stays pending in the group until the
+// callee stores its result, or registers its retry or its quarantine,
+// with the same Broker, at which point it is acknowledged and removed
+// from the stream. The requests that stay pending longer than
+// StreamClaimIdle, e.g. because their callee died, are claimed by
+// another calls connection of the URI and delivered again if they did
+// not expire, so that they are processed at least once. The calls
+// connections also keep reading the lists, where the sticky, broadcast
+// and batched requests are still stored, and where the servers that
+// don't set CallStreams store all their requests, so that the option
+// can be enabled on the callees first and on the servers after.
+//
+// Batches of call requests and events (see Broker.ExecBatch) are
+// applied atomically by a single script, so in a redis cluster, the
+// call requests of a batch must be in the same slot.
+//
 // If an RPC URI is much more sollicitated than others,
 // it can be spread over multiple URIs using
 // "RPC_URI_%d" where %d is e.g. a number from 1 to 100.
@@ -23,13 +151,18 @@
 package redisbroker
 
 import (
-	"encoding/json"
+	"crypto/sha1"
+	"encoding/binary"
 	"expvar"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/internal/uuidstr"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/PuerkitoBio/redisc"
 	"github.com/garyburd/redigo/redis"
@@ -85,90 +218,588 @@ type Broker struct {
 	// URI will fail with an error. The default of 0 means no limit.
 	CallCap int
 
+	// MaxPendingCalls is the maximum number of call requests received
+	// by a calls connection that are not taken from its channel by the
+	// callee yet. Once it is reached, the connection stops receiving
+	// call requests until the callee takes one, so that the excess call
+	// requests remain in redis for the other callees instead of waiting
+	// in memory for a busy callee. When CallStreams is set, the limit
+	// applies separately to the call requests stored in streams and in
+	// lists. The default of 0 means no limit.
+	MaxPendingCalls int
+
+	// CompressThreshold is the size in bytes above which the call
+	// requests and results are stored compressed with gzip in redis.
+	// The compressed payloads are detected when they are read, so all
+	// the servers and callees that share the broker must support them
+	// before it is set. The default of 0 disables compression.
+	CompressThreshold int
+
+	// Keys, if set, provides the keys to encrypt the arguments of the
+	// call requests, results and dead letters, and the cached results
+	// stored in redis, so that they are never stored in plaintext. The encrypted arguments are
+	// detected when they are read, and decrypted with the key they were
+	// encrypted with, so all the servers and callees that share the
+	// broker must have the keys before it is set.
+	Keys KeyProvider
+
+	// DeadLetterCap is the maximum number of call requests kept in the
+	// dead-letter queue of a URI (see Broker.Quarantine), the oldest ones
+	// are dropped. The default of 0 uses DefaultDeadLetterCap, and a
+	// negative value means no limit.
+	DeadLetterCap int
+
 	// ResultCap is the capacity of the RES queue per connection UUID.
 	// If it is exceeded for a given connection, Broker.Result calls
 	// for that connection will fail with an error. The default of 0
 	// means no limit.
 	ResultCap int
 
+	// SchedulePollInterval is the interval at which calls connections
+	// check for due scheduled call requests. The default of 0 uses
+	// DefaultSchedulePollInterval.
+	SchedulePollInterval time.Duration
+
+	// HistoryCap is the maximum number of events retained per pub-sub
+	// channel for the channel history (see Broker.History). The default
+	// of 0 disables the retention of events.
+	HistoryCap int
+
+	// HistoryTTL is the maximum age of the events retained for the
+	// channel history. The default of 0 means no age limit, the events
+	// are only dropped when the HistoryCap is exceeded.
+	HistoryTTL time.Duration
+
+	// EventShards is the number of goroutines that deliver the events
+	// received by a pub-sub connection. Each event is dispatched to the
+	// goroutine selected by hashing its channel, so that the events of
+	// a channel are delivered in order and a hot channel cannot starve
+	// the delivery of the other channels. The default of 0 starts a
+	// goroutine per event.
+	EventShards int
+
+	// EventShardBuffer is the number of events buffered per shard when
+	// EventShards is set. The events received for a shard whose buffer
+	// is full are dropped. The default of 0 uses
+	// DefaultEventShardBuffer.
+	EventShardBuffer int
+
+	// EventSequence stamps the published events with their sequence
+	// number in their channel (see message.EvntPayload.Seq), so that
+	// the subscribers can detect the events they missed. The events of
+	// a channel are delivered in order by the pub-sub connections, on a
+	// single shard if EventShards is 0.
+	EventSequence bool
+
+	// PatternSyntax is the syntax of the channel patterns of the pattern
+	// subscriptions. The patterns other than broker.GlobPatterns are
+	// translated to the glob-style patterns of redis, and the events of
+	// the channels that they do not match are filtered out. The default
+	// is broker.GlobPatterns, the patterns of redis.
+	PatternSyntax broker.PatternSyntax
+
+	// ServerID identifies the server instance that serves the
+	// connections of the results connections created with the
+	// broker, it is recorded in their lease (see Broker.ConnServer).
+	// If empty, a random UUID is generated on first use.
+	ServerID string
+
+	// ConnLeaseTTL is the time-to-live of the lease held by a results
+	// connection on its connection UUID, refreshed at a third of that
+	// interval. The default of 0 uses DefaultConnLeaseTTL.
+	ConnLeaseTTL time.Duration
+
+	// CheckLeases rejects the results for a connection without a lease
+	// with broker.ErrCallerGone, instead of storing them until they
+	// expire. It is set on the callees, and must only be set once all
+	// the servers that share the broker hold leases on their
+	// connections, otherwise the results of their calls are dropped.
+	CheckLeases bool
+
+	// CallStreams stores the round-robin call requests in redis streams
+	// read with a consumer group, instead of lists, so that the requests
+	// delivered to a callee that dies are delivered again to another
+	// callee (see the package documentation). It requires redis 6.2 or
+	// later, and the callees must set it before the servers do.
+	CallStreams bool
+
+	// StreamClaimIdle is the time after which a call request delivered
+	// from a stream and not acknowledged yet is claimed by another calls
+	// connection, when CallStreams is set. It should be longer than the
+	// time it takes to process a call. The default of 0 uses
+	// DefaultStreamClaimIdle.
+	StreamClaimIdle time.Duration
+
 	// Vars can be set to an *expvar.Map to collect metrics about the
 	// broker. It should be set before starting to make calls with the
 	// broker.
 	Vars *expvar.Map
+
+	// live URI patterns of the callees, see routePattern.
+	patterns patternCache
+
+	// call requests delivered from the streams, to acknowledge.
+	acks streamAcks
+
+	// generated server ID if ServerID is empty.
+	idOnce sync.Once
+	id     string
 }
 
+// DefaultSchedulePollInterval is the default interval at which calls
+// connections check for due scheduled call requests.
+var DefaultSchedulePollInterval = time.Second
+
+// DefaultConnLeaseTTL is the default time-to-live of the lease held by
+// a results connection on its connection UUID.
+var DefaultConnLeaseTTL = 30 * time.Second
+
+// error returned by resultScript when the caller has no lease.
+const errCallerGone = "caller gone"
+
+// script to store the call result along with its expiration
+// information, if the caller's connection has a lease or if leases
+// are not checked. The list of results expires with its most recent
+// result, so that it does not outlive the server of the connection.
+var resultScript = redis.NewScript(3, `
+	if ARGV[4] == "1" and redis.call("EXISTS", KEYS[3]) == 0 then
+		return redis.error_reply("caller gone")
+	end
+	local limit = tonumber(ARGV[3])
+	if limit > 0 and redis.call("LLEN", KEYS[2]) >= limit then
+		return redis.error_reply("list capacity exceeded")
+	end
+	local to = tonumber(ARGV[1])
+	redis.call("SET", KEYS[1], ARGV[1], "PX", to)
+	local res = redis.call("LPUSH", KEYS[2], ARGV[2])
+	if redis.call("PTTL", KEYS[2]) < to then
+		redis.call("PEXPIRE", KEYS[2], to)
+	end
+	return res
+`)
+
 // script to store the call request or call result along with
-// its expiration information.
+// its expiration information, if the list is not full.
 var callOrResScript = redis.NewScript(2, `
-	redis.call("SET", KEYS[1], ARGV[1], "PX", tonumber(ARGV[1]))
-	local res = redis.call("LPUSH", KEYS[2], ARGV[2])
 	local limit = tonumber(ARGV[3])
-	if res > limit and limit > 0 then
-		local diff = res - limit
-		redis.call("LTRIM", KEYS[2], diff, limit + diff)
+	if limit > 0 and redis.call("LLEN", KEYS[2]) >= limit then
 		return redis.error_reply("list capacity exceeded")
 	end
-	return res
+	redis.call("SET", KEYS[1], ARGV[1], "PX", tonumber(ARGV[1]))
+	return redis.call("LPUSH", KEYS[2], ARGV[2])
 `)
 
+// script to store a sticky or broadcast call request on the lists of the
+// selected callee instances, along with the expiration information, if
+// all the instances are still registered and none of their lists is
+// full. The keys are the sorted set of the callee instances, followed by
+// the expiring key and the list of each instance, in the order of their
+// IDs, all in the same slot.
+var routedCallScript = redis.NewScript(-1, `
+	local limit = tonumber(ARGV[3])
+	local n = (#KEYS - 1) / 2
+	for i = 1, n do
+		local expires = redis.call("ZSCORE", KEYS[1], ARGV[4 + i])
+		if not expires or tonumber(expires) <= tonumber(ARGV[4]) then
+			return redis.error_reply("no callee listening")
+		end
+		if limit > 0 and redis.call("LLEN", KEYS[2 * i + 1]) >= limit then
+			return redis.error_reply("list capacity exceeded")
+		end
+	end
+	for i = 1, n do
+		redis.call("SET", KEYS[2 * i], ARGV[1], "PX", tonumber(ARGV[1]))
+		redis.call("LPUSH", KEYS[2 * i + 1], ARGV[2])
+	end
+	return n
+`)
+
+// error returned by routedCallScript when a selected instance is gone.
+const errNoCalleeListening = "no callee listening"
+
 const (
 	// redis cluster-compliant keys, so that both keys are in the same slot
 	callKey        = "juggler:calls:{%s}"            // 1: URI
 	callTimeoutKey = "juggler:calls:timeout:{%s}:%s" // 1: URI, 2: mUUID
 
+	// redis cluster-compliant key for scheduled calls, in the same slot as callKey
+	scheduledCallKey = "juggler:calls:scheduled:{%s}" // 1: URI
+
+	// redis cluster-compliant keys for routed calls, in the same slot as callKey
+	calleesKey           = "juggler:callees:instances:{%s}"   // 1: URI
+	calleeCallKey        = "juggler:calls:{%s}:%s"            // 1: URI, 2: callee UUID
+	calleeCallTimeoutKey = "juggler:calls:timeout:{%s}:%s:%s" // 1: URI, 2: mUUID, 3: callee UUID
+
+	// redis cluster-compliant keys for calls with a priority above 0, in
+	// the same slot as callKey
+	priorityCallKey       = "juggler:calls:priority:{%s}:%d"    // 1: URI, 2: priority
+	calleePriorityCallKey = "juggler:calls:priority:{%s}:%d:%s" // 1: URI, 2: priority, 3: callee UUID
+
 	// redis cluster-compliant keys, so that both keys are in the same slot
 	resKey        = "juggler:results:{%s}"            // 1: cUUID
 	resTimeoutKey = "juggler:results:timeout:{%s}:%s" // 1: cUUID, 2: mUUID
+
+	// redis cluster-compliant key for the lease of a connection, in the
+	// same slot as resKey
+	resLeaseKey = "juggler:results:lease:{%s}" // 1: cUUID
 )
 
-// Call registers a call request in the broker.
+// Call registers a call request in the broker. The request is
+// routed to the callees according to cp.Routing, and is delivered
+// before the pending requests of lower cp.Priority. If cp.MaxAttempts
+// is > 1, the timeout applies to each attempt. If no callee listens on
+// cp.URI but a callee listens on a URI pattern that matches it, the
+// request is routed to the callees of that pattern. If cp.Version is
+// set, it returns broker.ErrUnsupportedVersion if no callee listens on
+// the versioned URI.
 func (b *Broker) Call(cp *message.CallPayload, timeout time.Duration) error {
-	k1 := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
-	k2 := fmt.Sprintf(callKey, cp.URI)
-	return registerCallOrRes(b.Pool, cp, timeout, b.CallCap, k1, k2)
+	cp, err := b.routePattern(cp)
+	if err != nil {
+		return err
+	}
+	return registerCall(b.Pool, firstAttempt(cp, timeout), timeout, b.CallCap, b.codec(), b.CallStreams)
 }
 
-// Result registers a call result in the broker.
-func (b *Broker) Result(rp *message.ResPayload, timeout time.Duration) error {
-	k1 := fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
-	k2 := fmt.Sprintf(resKey, rp.ConnUUID)
-	return registerCallOrRes(b.Pool, rp, timeout, b.ResultCap, k1, k2)
+// firstAttempt returns cp with the first attempt and its timeout recorded
+// if the call may be retried. The provided payload is left untouched.
+func firstAttempt(cp *message.CallPayload, timeout time.Duration) *message.CallPayload {
+	if cp.MaxAttempts > 1 && cp.Attempt == 0 {
+		cpy := *cp
+		cpy.Attempt = 1
+		cpy.Timeout = timeout
+		cp = &cpy
+	}
+	return cp
 }
 
-func registerCallOrRes(pool Pool, pld interface{}, timeout time.Duration, cap int, k1, k2 string) error {
-	p, err := json.Marshal(pld)
+// CallAt registers a call request in the broker so that it is processed
+// at the specified time, with the timeout set in cp.Timeout starting at
+// that time. The request is routed according to cp.Routing once it is
+// due. The URI pattern, if any, is selected when the request is
+// scheduled.
+func (b *Broker) CallAt(cp *message.CallPayload, at time.Time) error {
+	cp, err := b.routePattern(cp)
+	if err != nil {
+		return err
+	}
+	return scheduleCall(b.Pool, firstAttempt(cp, cp.Timeout), at, b.codec())
+}
+
+// CallAfter registers a call request in the broker so that it is
+// processed after the specified delay. See CallAt.
+func (b *Broker) CallAfter(cp *message.CallPayload, delay time.Duration) error {
+	return b.CallAt(cp, time.Now().Add(delay))
+}
+
+func scheduleCall(pool Pool, cp *message.CallPayload, at time.Time, pc payloadCodec) error {
+	if err := checkPriority(cp); err != nil {
+		return err
+	}
+
+	p, err := pc.marshal(cp)
 	if err != nil {
 		return err
 	}
 
+	k := fmt.Sprintf(scheduledCallKey, queueURI(cp))
 	rc := pool.Get()
 	defer rc.Close()
 
 	// turn it into a cluster-aware RetryConn if running in a cluster
-	rc = clusterifyConn(rc, k1, k2)
+	rc = clusterifyConn(rc, k)
+	_, err = rc.Do("ZADD", k, unixMs(at), p)
+	return err
+}
+
+// unixMs returns t as the number of milliseconds since the unix epoch.
+func unixMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// callListKey returns the key of the call requests list for the URI
+// and priority.
+func callListKey(uri string, priority int) string {
+	if priority == 0 {
+		return fmt.Sprintf(callKey, uri)
+	}
+	return fmt.Sprintf(priorityCallKey, uri, priority)
+}
+
+// calleeCallListKey returns the key of the call requests list of the
+// callee instance for the URI and priority.
+func calleeCallListKey(uri string, priority int, id string) string {
+	if priority == 0 {
+		return fmt.Sprintf(calleeCallKey, uri, id)
+	}
+	return fmt.Sprintf(calleePriorityCallKey, uri, priority, id)
+}
+
+func checkPriority(cp *message.CallPayload) error {
+	if cp.Priority < 0 || cp.Priority > message.MaxPriority {
+		return fmt.Errorf("invalid priority %d, must be between 0 and %d", cp.Priority, message.MaxPriority)
+	}
+	return nil
+}
+
+func registerCall(pool Pool, cp *message.CallPayload, timeout time.Duration, cap int, pc payloadCodec, streams bool) error {
+	if err := checkPriority(cp); err != nil {
+		return err
+	}
+
+	// stamp a copy, the provided payload is left untouched
+	stamped := *cp
+	stamped.EnqueueTimestamp = time.Now().UTC()
+	cp = &stamped
+
+	uri := queueURI(cp)
+	k1 := fmt.Sprintf(callTimeoutKey, uri, cp.MsgUUID)
+	k2 := callListKey(uri, cp.Priority)
+	switch cp.Routing {
+	case message.RoundRobin:
+		if streams {
+			return registerStreamCall(pool, cp, timeout, cap, pc, k1, callStreamKey(uri, cp.Priority))
+		}
+		return registerCallOrRes(pool, cp, timeout, cap, pc, k1, k2)
+	case message.Sticky, message.Broadcast:
+		return registerRoutedCall(pool, cp, timeout, cap, pc, k1)
+	default:
+		return fmt.Errorf("unsupported routing mode %s", cp.Routing)
+	}
+}
+
+// Retry registers the next attempt of the call request, after its
+// backoff delay. It returns broker.ErrNoAttemptLeft if the call
+// cannot be retried. If the backoff delay is 0, the call is registered
+// immediately, otherwise it is scheduled to run after the delay.
+func (b *Broker) Retry(cp *message.CallPayload) error {
+	if err := retryCall(b.Pool, cp, b.CallCap, b.codec(), b.CallStreams, b.Vars); err != nil {
+		return err
+	}
+	b.ackStreamCall(cp.MsgUUID)
+	return nil
+}
+
+// Requeue registers the call request again for its remaining
+// time-to-live, without counting a new attempt, e.g. when the callee
+// that received it is drained before processing it. A call request
+// that has expired is dropped.
+func (b *Broker) Requeue(cp *message.CallPayload) error {
+	ttl := cp.TTLAfterRead - time.Now().Sub(cp.ReadTimestamp)
+	if ttl <= 0 {
+		b.ackStreamCall(cp.MsgUUID)
+		return nil
+	}
+
+	err := registerCall(b.Pool, cp, ttl, b.CallCap, b.codec(), b.CallStreams)
+	if b.Vars != nil {
+		if err != nil {
+			b.Vars.Add("FailedRequeues", 1)
+		} else {
+			b.Vars.Add("Requeues", 1)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	b.ackStreamCall(cp.MsgUUID)
+	return nil
+}
+
+func retryCall(pool Pool, cp *message.CallPayload, cap int, pc payloadCodec, streams bool, vars *expvar.Map) error {
+	if !cp.CanRetry() {
+		return broker.ErrNoAttemptLeft
+	}
 
+	delay := cp.RetryBackoff()
+	next := *cp
+	next.Attempt = cp.Attempt + 1
+	if cp.Attempt == 0 {
+		next.Attempt = 2
+	}
+
+	var err error
+	if delay <= 0 {
+		err = registerCall(pool, &next, next.Timeout, cap, pc, streams)
+	} else {
+		err = scheduleCall(pool, &next, time.Now().Add(delay), pc)
+	}
+	if vars != nil {
+		if err != nil {
+			vars.Add("FailedRetries", 1)
+		} else {
+			vars.Add("Retries", 1)
+		}
+	}
+	return err
+}
+
+func registerRoutedCall(pool Pool, cp *message.CallPayload, timeout time.Duration, cap int, pc payloadCodec, k1 string) error {
+	p, err := pc.marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	uri := queueURI(cp)
+	k := fmt.Sprintf(calleesKey, uri)
+	now := unixMs(time.Now())
+
+	rc := pool.Get()
+	defer rc.Close()
+
+	// turn it into a cluster-aware RetryConn if running in a cluster,
+	// all the keys of the URI are in the same slot.
+	rc = clusterifyConn(rc, k, k1)
+
+	ids, err := redis.Strings(rc.Do("ZRANGEBYSCORE", k, "("+strconv.FormatInt(now, 10), "+inf"))
+	if err != nil {
+		return err
+	}
+	ids = routedInstances(cp, ids)
+	if len(ids) == 0 {
+		return broker.ErrNoCallee
+	}
+
+	keys := redis.Args{k}
+	for _, id := range ids {
+		tk := k1
+		if cp.Routing == message.Broadcast {
+			tk = fmt.Sprintf(calleeCallTimeoutKey, uri, cp.MsgUUID, id)
+		}
+		keys = keys.Add(tk, calleeCallListKey(uri, cp.Priority, id))
+	}
+	args := redis.Args{len(keys)}.AddFlat(keys).Add(
+		timeoutMs(timeout), // argv[1] : the timeout in milliseconds
+		p,                  // argv[2] : the call payload
+		cap,                // argv[3] : the LIST capacity
+		now,                // argv[4] : the current time in milliseconds
+	).AddFlat(ids) // argv[5..] : the IDs of the instances
+
+	_, err = routedCallScript.Do(rc, args...)
+	if e, ok := err.(redis.Error); ok && string(e) == errNoCalleeListening {
+		return broker.ErrNoCallee
+	}
+	return err
+}
+
+// routedInstances returns the IDs of the callee instances that receive
+// the sticky or broadcast call request, from the IDs of the live
+// instances of its URI. A sticky call request is routed to the instance
+// selected by the hash of its routing key, so that the same key goes to
+// the same instance as long as the set of instances does not change.
+func routedInstances(cp *message.CallPayload, ids []string) []string {
+	if len(ids) == 0 || cp.Routing != message.Sticky {
+		return ids
+	}
+	sort.Strings(ids)
+	sum := sha1.Sum([]byte(cp.RoutingKey))
+	h := binary.BigEndian.Uint32(sum[:4])
+	return ids[h%uint32(len(ids)) : h%uint32(len(ids))+1]
+}
+
+// timeoutMs returns the timeout in milliseconds, using
+// broker.DefaultCallTimeout if timeout is 0.
+func timeoutMs(timeout time.Duration) int {
 	to := int(timeout / time.Millisecond)
 	if to == 0 {
 		to = int(broker.DefaultCallTimeout / time.Millisecond)
 	}
+	return to
+}
+
+// Result registers a call result in the broker. If CheckLeases is set,
+// it returns broker.ErrCallerGone if the connection of the caller has
+// no lease, in which case the result is dropped.
+func (b *Broker) Result(rp *message.ResPayload, timeout time.Duration) error {
+	p, err := b.codec().marshal(rp)
+	if err != nil {
+		return err
+	}
+
+	cid := uuidstr.String(rp.ConnUUID)
+	k1 := fmt.Sprintf(resTimeoutKey, cid, rp.MsgUUID)
+	k2 := fmt.Sprintf(resKey, cid)
+	k3 := fmt.Sprintf(resLeaseKey, cid)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	// turn it into a cluster-aware RetryConn if running in a cluster
+	rc = clusterifyConn(rc, k1, k2, k3)
+
+	_, err = resultScript.Do(rc,
+		k1,                 // key[1] : the SET key with expiration
+		k2,                 // key[2] : the LIST key
+		k3,                 // key[3] : the lease of the connection
+		timeoutMs(timeout), // argv[1] : the timeout in milliseconds
+		p,                  // argv[2] : the result payload
+		b.ResultCap,        // argv[3] : the LIST capacity
+		b.CheckLeases,      // argv[4] : check the lease if true
+	)
+	if e, ok := err.(redis.Error); ok && string(e) == errCallerGone {
+		if b.Vars != nil {
+			b.Vars.Add("OrphanedResults", 1)
+		}
+		b.ackStreamCall(rp.MsgUUID)
+		return broker.ErrCallerGone
+	}
+	if err == nil {
+		b.ackStreamCall(rp.MsgUUID)
+	}
+	return err
+}
+
+func registerCallOrRes(pool Pool, pld interface{}, timeout time.Duration, cap int, pc payloadCodec, k1, k2 string) error {
+	p, err := pc.marshal(pld)
+	if err != nil {
+		return err
+	}
+
+	rc := pool.Get()
+	defer rc.Close()
+
+	// turn it into a cluster-aware RetryConn if running in a cluster
+	rc = clusterifyConn(rc, k1, k2)
 
 	_, err = callOrResScript.Do(rc,
-		k1,  // key[1] : the SET key with expiration
-		k2,  // key[2] : the LIST key
-		to,  // argv[1] : the timeout in milliseconds
-		p,   // argv[2] : the call payload
-		cap, // argv[3] : the LIST capacity
+		k1,                 // key[1] : the SET key with expiration
+		k2,                 // key[2] : the LIST key
+		timeoutMs(timeout), // argv[1] : the timeout in milliseconds
+		p,                  // argv[2] : the call payload
+		cap,                // argv[3] : the LIST capacity
 	)
 	return err
 }
 
 // Publish publishes an event to a channel.
 func (b *Broker) Publish(channel string, pp *message.PubPayload) error {
-	p, err := json.Marshal(pp)
+	p, err := marshalPub(pp)
 	if err != nil {
 		return err
 	}
 
+	if b.EventSequence {
+		seq, err := b.publishSeq(channel, p)
+		if err != nil {
+			return err
+		}
+		p = stampSeq(p, seq)
+	} else if err := b.publish(channel, p); err != nil {
+		return err
+	}
+
+	if b.HistoryCap > 0 {
+		// the event is published, a failure to retain it is only logged
+		if err := b.retainEvent(channel, pp, p); err != nil {
+			logf(b.LogFunc, "Publish: failed to retain event %v: %v", pp.MsgUUID, err)
+			if b.Vars != nil {
+				b.Vars.Add("FailedHistoryStores", 1)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Broker) publish(channel string, p []byte) error {
 	rc := b.Pool.Get()
 	defer rc.Close()
 
@@ -180,7 +811,7 @@ func (b *Broker) Publish(channel string, pp *message.PubPayload) error {
 		// Bind without a key selects a random node.
 		bc.Bind()
 	}
-	_, err = rc.Do("PUBLISH", channel, p)
+	_, err := rc.Do("PUBLISH", channel, p)
 	return err
 }
 
@@ -192,10 +823,18 @@ func (b *Broker) NewPubSubConn() (broker.PubSubConn, error) {
 	if err != nil {
 		return nil, err
 	}
+	shards := b.EventShards
+	if shards <= 0 && b.EventSequence {
+		// deliver the events of a channel in order
+		shards = 1
+	}
 	return &pubSubConn{
-		psc:   redis.PubSubConn{Conn: rc},
-		logFn: b.LogFunc,
-		vars:  b.Vars,
+		psc:      redis.PubSubConn{Conn: rc},
+		logFn:    b.LogFunc,
+		vars:     b.Vars,
+		shards:   shards,
+		shardBuf: b.EventShardBuffer,
+		syntax:   b.PatternSyntax,
 	}, nil
 }
 
@@ -206,31 +845,111 @@ func (b *Broker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &callsConn{
+	c := &callsConn{
 		c:       rc,
+		id:      uuid.NewRandom(),
 		pool:    b.Pool,
 		uris:    uris,
 		vars:    b.Vars,
 		timeout: b.BlockingTimeout,
+		callCap: b.CallCap,
+		codec:   b.codec(),
+		pollInt: b.SchedulePollInterval,
 		logFn:   b.LogFunc,
-	}, nil
+		stop:    make(chan struct{}),
+	}
+	if b.MaxPendingCalls > 0 {
+		c.pending = make(chan struct{}, b.MaxPendingCalls)
+	}
+	if b.CallStreams {
+		// the streams are read on their own connection, as the lists
+		// are polled with a blocking command.
+		sc, err := b.Dial()
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		c.sc = sc
+		c.acks = &b.acks
+		if b.MaxPendingCalls > 0 {
+			c.streamPending = make(chan struct{}, b.MaxPendingCalls)
+		}
+		c.claimIdle = b.StreamClaimIdle
+		if c.claimIdle <= 0 {
+			c.claimIdle = DefaultStreamClaimIdle
+		}
+	}
+	return c, nil
 }
 
 // NewResultsConn returns a new results connection that can be used
-// to process the call results for the specified connection UUID.
+// to process the call results for the specified connection UUID. The
+// results connection holds a lease on the connection UUID until it is
+// closed.
 func (b *Broker) NewResultsConn(connUUID uuid.UUID) (broker.ResultsConn, error) {
 	rc, err := b.Dial()
 	if err != nil {
 		return nil, err
 	}
-	return &resultsConn{
+
+	ttl := b.ConnLeaseTTL
+	if ttl <= 0 {
+		ttl = DefaultConnLeaseTTL
+	}
+	c := &resultsConn{
 		c:        rc,
 		pool:     b.Pool,
 		connUUID: connUUID,
 		vars:     b.Vars,
 		timeout:  b.BlockingTimeout,
 		logFn:    b.LogFunc,
-	}, nil
+		codec:    b.codec(),
+		leaseKey: fmt.Sprintf(resLeaseKey, uuidstr.String(connUUID)),
+		leaseTTL: ttl,
+		serverID: b.serverID(),
+		done:     make(chan struct{}),
+	}
+	if err := c.setLease(); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	c.wg.Add(1)
+	go c.refreshLease()
+	return c, nil
+}
+
+// codec returns the codec of the call requests and results stored in
+// redis.
+func (b *Broker) codec() payloadCodec {
+	return payloadCodec{compress: b.CompressThreshold, keys: b.Keys}
+}
+
+// serverID returns the ServerID, or the ID generated if it is empty.
+func (b *Broker) serverID() string {
+	if b.ServerID != "" {
+		return b.ServerID
+	}
+	b.idOnce.Do(func() {
+		b.id = uuid.NewRandom().String()
+	})
+	return b.id
+}
+
+// ConnServer returns the ID of the server that serves the connection
+// UUID (see Broker.ServerID), or an empty string if the connection is
+// not served anymore.
+func (b *Broker) ConnServer(connUUID uuid.UUID) (string, error) {
+	k := fmt.Sprintf(resLeaseKey, uuidstr.String(connUUID))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	id, err := redis.String(rc.Do("GET", k))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return id, err
 }
 
 const (
@@ -19,7 +19,7 @@ import (
 
 const cap = 2
 
-func testBrokerCallOrRes(t *testing.T, keyFmt string, run func(*Broker, uuid.UUID) (uuid.UUID, error)) {
+func testBrokerCallOrRes(t *testing.T, keyFmt, timeoutKeyFmt string, run func(*Broker, uuid.UUID) (uuid.UUID, error)) {
 	cmd, port := redistest.StartServer(t, nil, "")
 	defer cmd.Process.Kill()
 
@@ -49,14 +49,21 @@ func testBrokerCallOrRes(t *testing.T, keyFmt string, run func(*Broker, uuid.UUI
 	key := fmt.Sprintf(keyFmt, keyUUID)
 	expectUUIDs(t, pool.Get(), key, uuids[1], uuids[0])
 
+	// the rejected payload leaves no expiration key behind
+	rc := pool.Get()
+	defer rc.Close()
+	for i, uid := range uuids {
+		n, err := redis.Int(rc.Do("EXISTS", fmt.Sprintf(timeoutKeyFmt, keyUUID, uid)))
+		require.NoError(t, err, "EXISTS %d", i)
+		assert.Equal(t, i < cap, n == 1, "expiration key %d", i)
+	}
+
 	// call on a different URI works fine
 	diffKeyUUID := uuid.NewRandom()
 	_, err := run(broker, diffKeyUUID)
 	assert.NoError(t, err, "Call on different key")
 
 	// popping a value should pop uuids[0]
-	rc := pool.Get()
-	defer rc.Close()
 	_, err = rc.Do("RPOP", key)
 	require.NoError(t, err, "RPOP")
 
@@ -72,7 +79,7 @@ func testBrokerCallOrRes(t *testing.T, keyFmt string, run func(*Broker, uuid.UUI
 
 func TestBrokerCall(t *testing.T) {
 	connUUID := uuid.NewRandom()
-	testBrokerCallOrRes(t, callKey, func(b *Broker, keyParm uuid.UUID) (uuid.UUID, error) {
+	testBrokerCallOrRes(t, callKey, callTimeoutKey, func(b *Broker, keyParm uuid.UUID) (uuid.UUID, error) {
 		cp := &message.CallPayload{
 			ConnUUID: connUUID,
 			MsgUUID:  uuid.NewRandom(),
@@ -84,7 +91,13 @@ func TestBrokerCall(t *testing.T) {
 }
 
 func TestBrokerResult(t *testing.T) {
-	testBrokerCallOrRes(t, resKey, func(b *Broker, keyParm uuid.UUID) (uuid.UUID, error) {
+	testBrokerCallOrRes(t, resKey, resTimeoutKey, func(b *Broker, keyParm uuid.UUID) (uuid.UUID, error) {
+		// the connection must hold a lease to receive results
+		rc := b.Pool.Get()
+		defer rc.Close()
+		if _, err := rc.Do("SET", fmt.Sprintf(resLeaseKey, keyParm), "s"); err != nil {
+			return nil, err
+		}
 		rp := &message.ResPayload{
 			ConnUUID: keyParm,
 			MsgUUID:  uuid.NewRandom(),
@@ -0,0 +1,86 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+var _ broker.CacheBroker = (*Broker)(nil)
+
+// redis cluster-compliant keys, in the same slot as callKey. The results
+// cached by a broker with Keys are stored encrypted under sealedCacheKey,
+// so that they are never mistaken for plaintext results.
+const (
+	cacheKey       = "juggler:cache:{%s}:%s"        // 1: URI, 2: cache key
+	sealedCacheKey = "juggler:cache:sealed:{%s}:%s" // 1: URI, 2: cache key
+)
+
+// sealedResult is a cached result encrypted with the key ArgsKey.
+type sealedResult struct {
+	Result  json.RawMessage `json:"result"`
+	ArgsKey string          `json:"args_key"`
+}
+
+// CachedResult returns the cached result of the call request to uri
+// identified by key, or nil if no result is cached. If Keys is set, only
+// the results cached encrypted are returned.
+func (b *Broker) CachedResult(uri, key string) (json.RawMessage, error) {
+	k := b.cacheKey(uri, key)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	res, err := redis.Bytes(rc.Do("GET", k))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil || b.Keys == nil {
+		return res, err
+	}
+
+	var sr sealedResult
+	if err := unmarshalPayload(res, &sr); err != nil {
+		return nil, err
+	}
+	return open(b.Keys, sr.ArgsKey, sr.Result, uuid.UUID(k))
+}
+
+// CacheResult caches the result of the call request to uri identified
+// by key, for the duration of ttl. If Keys is set, the result is stored
+// encrypted, as the arguments of the call results.
+func (b *Broker) CacheResult(uri, key string, result json.RawMessage, ttl time.Duration) error {
+	k := b.cacheKey(uri, key)
+
+	p := []byte(result)
+	if b.Keys != nil {
+		// the redis key is authenticated with the result, so that it
+		// cannot be moved to another entry.
+		id, sealed, err := seal(b.Keys, result, uuid.UUID(k))
+		if err != nil {
+			return err
+		}
+		if p, err = marshalPayload(sealedResult{Result: sealed, ArgsKey: id}, b.CompressThreshold); err != nil {
+			return err
+		}
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	_, err := rc.Do("SET", k, p, "PX", timeoutMs(ttl))
+	return err
+}
+
+func (b *Broker) cacheKey(uri, key string) string {
+	if b.Keys != nil {
+		return fmt.Sprintf(sealedCacheKey, uri, key)
+	}
+	return fmt.Sprintf(cacheKey, uri, key)
+}
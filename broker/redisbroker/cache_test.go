@@ -0,0 +1,81 @@
+package redisbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	res, err := brk.CachedResult("a", "k")
+	require.NoError(t, err, "CachedResult before CacheResult")
+	assert.Nil(t, res, "no cached result")
+
+	require.NoError(t, brk.CacheResult("a", "k", json.RawMessage(`{"x":1}`), 50*time.Millisecond), "CacheResult")
+	res, err = brk.CachedResult("a", "k")
+	require.NoError(t, err, "CachedResult")
+	assert.Equal(t, `{"x":1}`, string(res), "cached result")
+
+	res, err = brk.CachedResult("b", "k")
+	require.NoError(t, err, "CachedResult for other URI")
+	assert.Nil(t, res, "no cached result for other URI")
+
+	time.Sleep(100 * time.Millisecond)
+	res, err = brk.CachedResult("a", "k")
+	require.NoError(t, err, "CachedResult after expiration")
+	assert.Nil(t, res, "expired cached result")
+}
+
+func TestEncryptedCache(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		Keys:    testKeys("k1"),
+		LogFunc: logIfVerbose,
+	}
+
+	require.NoError(t, brk.CacheResult("a", "k", json.RawMessage(`"secret"`), time.Second), "CacheResult")
+	res, err := brk.CachedResult("a", "k")
+	require.NoError(t, err, "CachedResult")
+	assert.Equal(t, `"secret"`, string(res), "decrypted cached result")
+
+	rc := pool.Get()
+	defer rc.Close()
+	stored, err := redis.Bytes(rc.Do("GET", fmt.Sprintf(sealedCacheKey, "a", "k")))
+	require.NoError(t, err, "GET")
+	assert.False(t, bytes.Contains(stored, []byte("secret")), "stored result encrypted")
+
+	// a sealed result cannot be moved to another entry
+	_, err = rc.Do("SET", fmt.Sprintf(sealedCacheKey, "a", "other"), stored)
+	require.NoError(t, err, "SET")
+	_, err = brk.CachedResult("a", "other")
+	assert.Error(t, err, "CachedResult of a moved result")
+
+	// the plaintext results are ignored
+	plain := &Broker{Pool: pool, Dial: pool.Dial, LogFunc: logIfVerbose}
+	require.NoError(t, plain.CacheResult("a", "p", json.RawMessage(`1`), time.Second), "CacheResult without keys")
+	res, err = brk.CachedResult("a", "p")
+	require.NoError(t, err, "CachedResult of a plaintext result")
+	assert.Nil(t, res, "plaintext result ignored")
+}
@@ -1,15 +1,16 @@
 package redisbroker
 
 import (
-	"encoding/json"
 	"expvar"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/internal/uuidstr"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
 )
 
 var _ broker.CallsConn = (*callsConn)(nil)
@@ -21,14 +22,53 @@ var delAndPTTLScript = redis.NewScript(1, `
 	return res
 `)
 
+// script to remove and return the due scheduled call requests, up to
+// the limit.
+var dueCallsScript = redis.NewScript(1, `
+	local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[2]))
+	if #due > 0 then
+		redis.call("ZREM", KEYS[1], unpack(due))
+	end
+	return due
+`)
+
+// maximum number of due scheduled calls moved per script execution.
+const maxDueCalls = 100
+
 type callsConn struct {
 	c       redis.Conn
+	id      uuid.UUID // callee instance identifier, for sticky and broadcast calls
 	pool    Pool
 	uris    []string
 	timeout time.Duration
+	callCap int           // to register retries and scheduled calls
+	codec   payloadCodec  // of the stored calls
+	pollInt time.Duration // to check for due scheduled calls
 	logFn   func(string, ...interface{})
 	vars    *expvar.Map
 
+	// pending and streamPending hold a value for each call request
+	// received from the lists and the streams and not taken from ch yet,
+	// nil if their number is not limited.
+	pending       chan struct{}
+	streamPending chan struct{}
+
+	// streams connection, acknowledgements and claim idle time when the
+	// round-robin calls are stored in streams, sc is nil otherwise.
+	sc        redis.Conn
+	acks      *streamAcks
+	claimIdle time.Duration
+
+	// closeConnsOnce closes c and sc once, when the connection is
+	// closed or a poll loop stops.
+	closeConnsOnce sync.Once
+	closeConnsErr  error
+
+	// stop signals the goroutine that moves the due scheduled calls
+	// to stop, closed once by Close.
+	stop      chan struct{}
+	closeOnce sync.Once
+
 	// once makes sure only the first call to Calls starts the goroutine.
 	once sync.Once
 	ch   chan *message.CallPayload
@@ -38,9 +78,60 @@ type callsConn struct {
 	err   error
 }
 
-// Close closes the connection.
+// Close closes the connection. The callee instance is unregistered
+// from its URIs so that it stops receiving sticky and broadcast calls.
 func (c *callsConn) Close() error {
-	return c.c.Close()
+	c.closeOnce.Do(func() { close(c.stop) })
+	c.unregisterInstance()
+	c.unregisterPatterns()
+	return c.closeConns()
+}
+
+// closeConns closes the redis connections used to poll the calls, so
+// that the poll loops stop.
+func (c *callsConn) closeConns() error {
+	c.closeConnsOnce.Do(func() {
+		c.closeConnsErr = c.c.Close()
+		if c.sc != nil {
+			if err := c.sc.Close(); c.closeConnsErr == nil {
+				c.closeConnsErr = err
+			}
+		}
+	})
+	return c.closeConnsErr
+}
+
+// registerInstance registers or refreshes the callee instance in the
+// callees set of each URI of the connection, and removes the expired
+// instances.
+func (c *callsConn) registerInstance() {
+	now := time.Now()
+	expires := unixMs(now.Add(registrationTTLFactor * c.pollInterval()))
+	for _, uri := range c.uris {
+		k := fmt.Sprintf(calleesKey, uri)
+		rc := c.pool.Get()
+		rc = clusterifyConn(rc, k)
+		if _, err := rc.Do("ZADD", k, expires, uuidstr.String(c.id)); err != nil {
+			logf(c.logFn, "Calls: registration of callee instance %v failed: %v", c.id, err)
+		} else if _, err := rc.Do("ZREMRANGEBYSCORE", k, "-inf", unixMs(now)); err != nil {
+			logf(c.logFn, "Calls: failed to remove expired callee instances: %v", err)
+		}
+		rc.Close()
+	}
+}
+
+// unregisterInstance removes the callee instance from the callees set
+// of each URI of the connection.
+func (c *callsConn) unregisterInstance() {
+	for _, uri := range c.uris {
+		k := fmt.Sprintf(calleesKey, uri)
+		rc := c.pool.Get()
+		rc = clusterifyConn(rc, k)
+		if _, err := rc.Do("ZREM", k, uuidstr.String(c.id)); err != nil {
+			logf(c.logFn, "Calls: unregistration of callee instance %v failed: %v", c.id, err)
+		}
+		rc.Close()
+	}
 }
 
 // CallsErr returns the error that caused the Calls channel to close.
@@ -51,6 +142,16 @@ func (c *callsConn) CallsErr() error {
 	return err
 }
 
+// setErr sets the error that caused the Calls channel to close, if it
+// is not set yet.
+func (c *callsConn) setErr(err error) {
+	c.errmu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errmu.Unlock()
+}
+
 // Calls returns a stream of call requests for the URIs specified when
 // creating the callsConn. For use in a redis cluster, all URIs must
 // belong to the same cluster slot.
@@ -58,31 +159,69 @@ func (c *callsConn) Calls() <-chan *message.CallPayload {
 	c.once.Do(func() {
 		c.ch = make(chan *message.CallPayload)
 
-		// compute all keys and timeout
-		keys := make([]string, len(c.uris))
-		for i, uri := range c.uris {
-			keys[i] = fmt.Sprintf(callKey, uri)
-		}
+		// register the callee instance, so that it can receive
+		// sticky and broadcast calls.
+		c.registerInstance()
+		c.registerPatterns()
+
+		// compute all keys (shared and instance-specific) and timeout
+		keys := c.listKeys()
 		to := int(c.timeout / time.Second)
 		args := redis.Args{}.AddFlat(keys).Add(to)
 
 		// make the poll connection cluster-aware if running in a cluster
 		rc := clusterifyConn(c.c, keys...)
 
-		go c.pollCalls(rc, args)
+		// the channel is closed once all the poll loops are stopped, and
+		// each loop closes the connections when it stops, so that the
+		// other loops stop too.
+		var loops sync.WaitGroup
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			defer c.closeConns()
+			c.pollCalls(rc, args)
+		}()
+		if c.sc != nil {
+			loops.Add(1)
+			go func() {
+				defer loops.Done()
+				defer c.closeConns()
+				c.pollStreams()
+			}()
+		}
+		go func() {
+			loops.Wait()
+			close(c.ch)
+		}()
+		go c.moveScheduledCalls()
 	})
 
 	return c.ch
 }
 
-func (c *callsConn) pollCalls(pollConn redis.Conn, pollArgs redis.Args) {
-	defer close(c.ch)
+// listKeys returns the keys of the call lists of the connection's URIs,
+// shared and instance-specific. BRPOP pops from the first non-empty
+// list, so the keys of the highest priority come first.
+func (c *callsConn) listKeys() []string {
+	keys := make([]string, 0, 2*(message.MaxPriority+1)*len(c.uris))
+	for p := message.MaxPriority; p >= 0; p-- {
+		for _, uri := range c.uris {
+			keys = append(keys, callListKey(uri, p), calleeCallListKey(uri, p, uuidstr.String(c.id)))
+		}
+	}
+	return keys
+}
 
+func (c *callsConn) pollCalls(pollConn redis.Conn, pollArgs redis.Args) {
 	wg := sync.WaitGroup{}
 	for {
+		c.acquirePending(c.pending)
+
 		// BRPOP returns array with [0]: key name, [1]: payload.
 		v, err := redis.Values(pollConn.Do("BRPOP", pollArgs...))
 		if err != nil {
+			releasePending(c.pending)
 			if err == redis.ErrNil {
 				// no available value
 				continue
@@ -90,9 +229,7 @@ func (c *callsConn) pollCalls(pollConn redis.Conn, pollArgs redis.Args) {
 
 			// possibly a closed connection, in any case stop
 			// the loop.
-			c.errmu.Lock()
-			c.err = err
-			c.errmu.Unlock()
+			c.setErr(err)
 			wg.Wait()
 			return
 		}
@@ -102,13 +239,133 @@ func (c *callsConn) pollCalls(pollConn redis.Conn, pollArgs redis.Args) {
 	}
 }
 
+// moveScheduledCalls periodically moves the due scheduled calls of the
+// connection's URIs to the call lists and refreshes its callee instance
+// and URI patterns, until the connection is closed.
+func (c *callsConn) moveScheduledCalls() {
+	t := time.NewTicker(c.pollInterval())
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+
+		for _, uri := range c.uris {
+			for c.moveDueCalls(uri) == maxDueCalls {
+				// there may be more due calls
+			}
+		}
+		c.registerInstance()
+		c.registerPatterns()
+	}
+}
+
+func (c *callsConn) pollInterval() time.Duration {
+	if c.pollInt <= 0 {
+		return DefaultSchedulePollInterval
+	}
+	return c.pollInt
+}
+
+// moveDueCalls moves the due scheduled calls of the URI to the call
+// lists, and returns the number of due calls moved. The due calls that
+// cannot be registered, e.g. because their list is full, are scheduled
+// again to be due now, so that they are moved on a next poll.
+func (c *callsConn) moveDueCalls(uri string) int {
+	k := fmt.Sprintf(scheduledCallKey, uri)
+	rc := c.pool.Get()
+	rc = clusterifyConn(rc, k)
+	vals, err := redis.Values(dueCallsScript.Do(rc, k, unixMs(time.Now()), maxDueCalls))
+	rc.Close()
+	if err != nil {
+		if c.vars != nil {
+			c.vars.Add("FailedScheduledCallsChecks", 1)
+		}
+		logf(c.logFn, "Calls: check for due scheduled calls failed: %v", err)
+		return 0
+	}
+
+	var moved int
+	for _, v := range vals {
+		var cp message.CallPayload
+		b, err := redis.Bytes(v, nil)
+		if err == nil {
+			err = c.codec.unmarshal(b, &cp)
+		}
+		if err != nil {
+			if c.vars != nil {
+				c.vars.Add("FailedCallPayloadUnmarshals", 1)
+			}
+			logf(c.logFn, "Calls: failed to unmarshal scheduled call payload: %v", err)
+			continue
+		}
+		if err := registerCall(c.pool, &cp, cp.Timeout, c.callCap, c.codec, c.sc != nil); err != nil {
+			if c.vars != nil {
+				c.vars.Add("FailedScheduledCalls", 1)
+			}
+			logf(c.logFn, "Calls: failed to register scheduled call %v: %v", cp.MsgUUID, err)
+			c.rescheduleCall(k, &cp, b)
+			continue
+		}
+		moved++
+		if c.vars != nil {
+			c.vars.Add("ScheduledCalls", 1)
+		}
+	}
+	return moved
+}
+
+// rescheduleCall stores the scheduled call cp with its payload p in the
+// sorted set k again, due now.
+func (c *callsConn) rescheduleCall(k string, cp *message.CallPayload, p []byte) {
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+	if _, err := rc.Do("ZADD", k, unixMs(time.Now()), p); err != nil {
+		if c.vars != nil {
+			c.vars.Add("LostScheduledCalls", 1)
+		}
+		logf(c.logFn, "Calls: failed to reschedule call %v, dropping call: %v", cp.MsgUUID, err)
+	}
+}
+
+// acquirePending waits until the number of call requests received and
+// not taken counted by pending is below the limit, if any, or until the
+// connection is closed, and counts the next call request to receive.
+func (c *callsConn) acquirePending(pending chan struct{}) {
+	if pending == nil {
+		return
+	}
+	select {
+	case pending <- struct{}{}:
+	case <-c.stop:
+		// the connection is closed, the poll fails
+	}
+}
+
+// releasePending uncounts a call request counted by acquirePending,
+// once it is taken, dropped or not received.
+func releasePending(pending chan struct{}) {
+	if pending == nil {
+		return
+	}
+	select {
+	case <-pending:
+	default:
+	}
+}
+
 // receives the raw value retured from BRPOP.
 func (c *callsConn) sendCall(v []interface{}, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer releasePending(c.pending)
 
 	// unmarshal the payload
 	var cp message.CallPayload
-	if err := unmarshalBRPOPValue(&cp, v); err != nil {
+	if err := unmarshalBRPOPValue(&cp, v, c.codec); err != nil {
 		if c.vars != nil {
 			c.vars.Add("FailedCallPayloadUnmarshals", 1)
 		}
@@ -116,8 +373,13 @@ func (c *callsConn) sendCall(v []interface{}, wg *sync.WaitGroup) {
 		return
 	}
 
-	// check if call is expired
-	k := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
+	// check if call is expired, each instance has its own expiration
+	// key for broadcast calls.
+	uri := queueURI(&cp)
+	k := fmt.Sprintf(callTimeoutKey, uri, cp.MsgUUID)
+	if cp.Routing == message.Broadcast {
+		k = fmt.Sprintf(calleeCallTimeoutKey, uri, cp.MsgUUID, uuidstr.String(c.id))
+	}
 
 	rc := c.pool.Get()
 	defer rc.Close()
@@ -135,10 +397,20 @@ func (c *callsConn) sendCall(v []interface{}, wg *sync.WaitGroup) {
 		if c.vars != nil {
 			c.vars.Add("ExpiredCalls", 1)
 		}
+		if cp.CanRetry() {
+			logf(c.logFn, "Calls: message %v expired, retrying call", cp.MsgUUID)
+			if err := retryCall(c.pool, &cp, c.callCap, c.codec, c.sc != nil, c.vars); err != nil {
+				logf(c.logFn, "Calls: retry of message %v failed: %v", cp.MsgUUID, err)
+			}
+			return
+		}
 		logf(c.logFn, "Calls: message %v expired, dropping call", cp.MsgUUID)
 		return
 	}
 
+	if cp.Attempt == 0 {
+		cp.Attempt = 1
+	}
 	cp.ReadTimestamp = time.Now().UTC()
 	cp.TTLAfterRead = time.Duration(pttl) * time.Millisecond
 	c.ch <- &cp
@@ -147,13 +419,10 @@ func (c *callsConn) sendCall(v []interface{}, wg *sync.WaitGroup) {
 	}
 }
 
-func unmarshalBRPOPValue(dst interface{}, src []interface{}) error {
+func unmarshalBRPOPValue(dst interface{}, src []interface{}, pc payloadCodec) error {
 	var p []byte
 	if _, err := redis.Scan(src, nil, &p); err != nil {
 		return err
 	}
-	if err := json.Unmarshal(p, dst); err != nil {
-		return err
-	}
-	return nil
+	return pc.unmarshal(p, dst)
 }
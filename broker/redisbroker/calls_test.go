@@ -1,12 +1,16 @@
 package redisbroker
 
 import (
+	"expvar"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/PuerkitoBio/juggler/broker"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -67,3 +71,416 @@ func TestCalls(t *testing.T) {
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
 }
+
+func TestCallsRouting(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+	}
+
+	// broadcast and sticky without any live callee fail, an expired
+	// instance is not live.
+	rc := pool.Get()
+	defer rc.Close()
+	_, err := rc.Do("ZADD", fmt.Sprintf(calleesKey, "a"), unixMs(time.Now().Add(-time.Second)), "dead")
+	require.NoError(t, err, "ZADD expired instance")
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Routing: message.Broadcast}
+	assert.Equal(t, broker.ErrNoCallee, brk.Call(cp, time.Second), "broadcast without callee")
+	cp = &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Routing: message.Sticky, RoutingKey: "k"}
+	assert.Equal(t, broker.ErrNoCallee, brk.Call(cp, time.Second), "sticky without callee")
+
+	// start two callee instances on URI "a"
+	var mu sync.Mutex
+	received := make(map[int][]uuid.UUID)
+	wg := sync.WaitGroup{}
+	conns := make([]*callsConn, 2)
+	for i := range conns {
+		cc, err := brk.NewCallsConn("a")
+		require.NoError(t, err, "get Calls connection %d", i)
+		conns[i] = cc.(*callsConn)
+
+		ch := cc.Calls()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for cp := range ch {
+				mu.Lock()
+				received[i] = append(received[i], cp.MsgUUID)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond) // ensure instances are registered :(
+
+	bcast := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Routing: message.Broadcast}
+	require.NoError(t, brk.Call(bcast, time.Second), "broadcast Call")
+
+	sticky1 := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Routing: message.Sticky, RoutingKey: "k"}
+	sticky2 := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Routing: message.Sticky, RoutingKey: "k"}
+	require.NoError(t, brk.Call(sticky1, time.Second), "sticky Call 1")
+	require.NoError(t, brk.Call(sticky2, time.Second), "sticky Call 2")
+
+	// a broadcast is stored on none of the lists if one of them is full
+	_, err = rc.Do("ZADD", fmt.Sprintf(calleesKey, "a"), unixMs(time.Now().Add(time.Minute)), "full")
+	require.NoError(t, err, "ZADD full instance")
+	_, err = rc.Do("LPUSH", calleeCallListKey("a", 0, "full"), "x")
+	require.NoError(t, err, "LPUSH full instance")
+	brk.CallCap = 1
+	full := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Routing: message.Broadcast}
+	assert.Error(t, brk.Call(full, time.Second), "broadcast with a full list")
+
+	time.Sleep(10 * time.Millisecond) // ensure time to pop the last message :(
+	for i, cc := range conns {
+		require.NoError(t, cc.Close(), "close calls connection %d", i)
+	}
+	wg.Wait()
+
+	var nSticky int
+	for i := range conns {
+		assert.Contains(t, received[i], bcast.MsgUUID, "%d: received broadcast call", i)
+		assert.NotContains(t, received[i], full.MsgUUID, "%d: received broadcast call with a full list", i)
+		if len(received[i]) == 3 {
+			// calls are sent concurrently, order is not guaranteed
+			assert.Contains(t, received[i], sticky1.MsgUUID, "%d: received sticky call 1", i)
+			assert.Contains(t, received[i], sticky2.MsgUUID, "%d: received sticky call 2", i)
+			nSticky++
+		}
+	}
+	assert.Equal(t, 1, nSticky, "sticky calls received by a single instance")
+}
+
+func TestCallsRetry(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+
+		SchedulePollInterval: 10 * time.Millisecond,
+	}
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+
+	// retry each received call until there is no attempt left
+	var attempts []int
+	var errs []error
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for cp := range cc.Calls() {
+			attempts = append(attempts, cp.Attempt)
+			errs = append(errs, brk.Retry(cp))
+		}
+	}()
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", MaxAttempts: 2, Backoff: 10 * time.Millisecond}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+
+	time.Sleep(100 * time.Millisecond) // ensure time to pop the messages :(
+	require.NoError(t, cc.Close(), "close calls connection")
+	wg.Wait()
+	assert.Equal(t, []int{1, 2}, attempts, "got expected attempts")
+	assert.Equal(t, []error{nil, broker.ErrNoAttemptLeft}, errs, "got expected Retry errors")
+}
+
+func TestCallsScheduled(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+
+		SchedulePollInterval: 10 * time.Millisecond,
+	}
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+
+	var mu sync.Mutex
+	received := make(map[string]time.Time)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for cp := range cc.Calls() {
+			mu.Lock()
+			received[cp.MsgUUID.String()] = time.Now()
+			mu.Unlock()
+		}
+	}()
+
+	start := time.Now()
+	cp1 := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Timeout: time.Second}
+	cp2 := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Timeout: time.Second}
+	cp3 := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Timeout: time.Second}
+	require.NoError(t, brk.CallAfter(cp1, 50*time.Millisecond), "CallAfter")
+	require.NoError(t, brk.CallAt(cp2, start.Add(-time.Second)), "CallAt in the past")
+	require.NoError(t, brk.CallAfter(cp3, time.Hour), "CallAfter in the future")
+
+	time.Sleep(200 * time.Millisecond) // ensure time to pop the messages :(
+	require.NoError(t, cc.Close(), "close calls connection")
+	wg.Wait()
+
+	if assert.Contains(t, received, cp1.MsgUUID.String(), "received delayed call") {
+		assert.True(t, received[cp1.MsgUUID.String()].Sub(start) >= 50*time.Millisecond, "delayed call received after delay")
+	}
+	assert.Contains(t, received, cp2.MsgUUID.String(), "received past call")
+	assert.NotContains(t, received, cp3.MsgUUID.String(), "future call not received")
+}
+
+func TestCallsScheduledFull(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	vars := new(expvar.Map).Init()
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+		CallCap: 1,
+		Vars:    vars,
+	}
+
+	// the due calls are moved without polling for calls
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+	c := cc.(*callsConn)
+
+	rc := pool.Get()
+	defer rc.Close()
+	_, err = rc.Do("LPUSH", callListKey("a", 0), "x")
+	require.NoError(t, err, "LPUSH")
+
+	// a due call that cannot be registered is not lost
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Timeout: time.Second}
+	require.NoError(t, brk.CallAt(cp, time.Now().Add(-time.Second)), "CallAt")
+	assert.Equal(t, 0, c.moveDueCalls("a"), "moved with a full list")
+	n, err := redis.Int(rc.Do("ZCARD", fmt.Sprintf(scheduledCallKey, "a")))
+	require.NoError(t, err, "ZCARD")
+	assert.Equal(t, 1, n, "still scheduled")
+	assert.Equal(t, "1", vars.Get("FailedScheduledCalls").String(), "FailedScheduledCalls")
+
+	_, err = rc.Do("RPOP", callListKey("a", 0))
+	require.NoError(t, err, "RPOP")
+	assert.Equal(t, 1, c.moveDueCalls("a"), "moved")
+	n, err = redis.Int(rc.Do("ZCARD", fmt.Sprintf(scheduledCallKey, "a")))
+	require.NoError(t, err, "ZCARD")
+	assert.Equal(t, 0, n, "not scheduled anymore")
+	n, err = redis.Int(rc.Do("LLEN", callListKey("a", 0)))
+	require.NoError(t, err, "LLEN")
+	assert.Equal(t, 1, n, "registered")
+}
+
+func TestCallsPriority(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Priority: message.MaxPriority + 1}
+	assert.Error(t, brk.Call(cp, time.Second), "Call with invalid priority")
+	assert.Error(t, brk.CallAfter(cp, time.Second), "CallAfter with invalid priority")
+
+	// register lower priority calls first
+	var want []uuid.UUID
+	for _, p := range []int{0, 1, message.MaxPriority, 1} {
+		cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Priority: p}
+		require.NoError(t, brk.Call(cp, time.Second), "Call with priority %d", p)
+		want = append(want, cp.MsgUUID)
+	}
+	// expected order: MaxPriority, then both priority 1 in order, then 0
+	want = []uuid.UUID{want[2], want[1], want[3], want[0]}
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+
+	rc := pool.Get()
+	defer rc.Close()
+	args := redis.Args{}.AddFlat(cc.(*callsConn).listKeys()).Add(1)
+	for i, id := range want {
+		v, err := redis.Values(rc.Do("BRPOP", args...))
+		require.NoError(t, err, "BRPOP %d", i)
+		var cp message.CallPayload
+		require.NoError(t, unmarshalBRPOPValue(&cp, v, payloadCodec{}), "unmarshal %d", i)
+		assert.Equal(t, id.String(), cp.MsgUUID.String(), "%d: call in priority order", i)
+	}
+}
+
+func TestCallsPattern(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+	}
+
+	recv := func(ch <-chan *message.CallPayload, msg string) *message.CallPayload {
+		select {
+		case cp := <-ch:
+			return cp
+		case <-time.After(time.Second):
+			require.FailNow(t, "no call received", msg)
+		}
+		return nil
+	}
+
+	pcc, err := brk.NewCallsConn("billing.*")
+	require.NoError(t, err, "get pattern Calls connection")
+	defer pcc.Close()
+	pch := pcc.Calls()
+
+	ecc, err := brk.NewCallsConn("billing.refund")
+	require.NoError(t, err, "get exact Calls connection")
+	defer ecc.Close()
+	ech := ecc.Calls()
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "billing.charge"}
+	require.NoError(t, brk.Call(cp, time.Second), "Call matching the pattern")
+	got := recv(pch, "pattern")
+	assert.Equal(t, cp.MsgUUID.String(), got.MsgUUID.String(), "call routed to pattern")
+	assert.Equal(t, "billing.charge", got.URI, "concrete URI")
+	assert.Equal(t, "billing.*", got.Pattern, "pattern")
+	assert.Equal(t, "", cp.Pattern, "payload untouched")
+
+	cp = &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "billing.refund"}
+	require.NoError(t, brk.Call(cp, time.Second), "Call with exact callee")
+	got = recv(ech, "exact")
+	assert.Equal(t, cp.MsgUUID.String(), got.MsgUUID.String(), "call routed to exact URI")
+	assert.Equal(t, "", got.Pattern, "no pattern")
+
+	cp = &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "billing.invoice.create"}
+	require.NoError(t, brk.Call(cp, time.Second), "Call not matching the pattern")
+	rc := pool.Get()
+	defer rc.Close()
+	n, err := redis.Int(rc.Do("LLEN", fmt.Sprintf(callKey, cp.URI)))
+	require.NoError(t, err, "LLEN")
+	assert.Equal(t, 1, n, "call stored on its URI")
+
+	pcc.Close()
+	members, err := redis.Strings(rc.Do("ZRANGE", patternsKey, 0, -1))
+	require.NoError(t, err, "ZRANGE")
+	assert.Equal(t, 0, len(members), "pattern unregistered")
+}
+
+func TestCallsVersion(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+	}
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Version: "2"}
+	assert.Equal(t, broker.ErrUnsupportedVersion, brk.Call(cp, time.Second), "Call without callee")
+	assert.Equal(t, broker.ErrUnsupportedVersion, brk.CallAfter(cp, time.Second), "CallAfter without callee")
+
+	cc, err := brk.NewCallsConn("a", "a@2")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+	ch := cc.Calls()
+
+	cp3 := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Version: "3"}
+	assert.Equal(t, broker.ErrUnsupportedVersion, brk.Call(cp3, time.Second), "Call with unsupported version")
+	require.NoError(t, brk.Call(cp, time.Second), "Call with supported version")
+
+	select {
+	case got := <-ch:
+		assert.Equal(t, cp.MsgUUID.String(), got.MsgUUID.String(), "versioned call")
+		assert.Equal(t, "a", got.URI, "URI")
+		assert.Equal(t, "2", got.Version, "version")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no call received")
+	}
+
+	rc := pool.Get()
+	defer rc.Close()
+	n, err := redis.Int(rc.Do("LLEN", fmt.Sprintf(callKey, "a")))
+	require.NoError(t, err, "LLEN")
+	assert.Equal(t, 0, n, "unversioned list unused")
+}
+
+func TestCallsMaxPending(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+		MaxPendingCalls: 1,
+	}
+
+	cps := make([]*message.CallPayload, 3)
+	for i := range cps {
+		cps[i] = &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+		require.NoError(t, brk.Call(cps[i], time.Minute), "Call %d", i)
+	}
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+	ch := cc.Calls()
+
+	// a single call request is received until it is taken
+	queueLen := func(want int, label string) {
+		var n int
+		for i := 0; i < 100; i++ {
+			n, err = brk.QueueLen("a")
+			require.NoError(t, err, "%s: QueueLen", label)
+			if n == want {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, want, n, "%s: queue length", label)
+	}
+	queueLen(2, "before take")
+	time.Sleep(50 * time.Millisecond)
+	queueLen(2, "still before take")
+
+	for i := range cps {
+		select {
+		case cp := <-ch:
+			assert.Equal(t, cps[i].MsgUUID, cp.MsgUUID, "call %d", i)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no call received", "call %d", i)
+		}
+		if i == 0 {
+			queueLen(1, "after take")
+		}
+	}
+}
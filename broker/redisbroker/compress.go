@@ -0,0 +1,74 @@
+package redisbroker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+)
+
+// the first bytes of a gzip stream, that no JSON value starts with, so
+// that compressed payloads are detected when they are read.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// marshalPayload returns the JSON encoding of v, compressed with gzip if
+// it is larger than min bytes and min is > 0.
+func marshalPayload(v interface{}, min int) ([]byte, error) {
+	p, err := json.Marshal(v)
+	if err != nil || min <= 0 || len(p) <= min {
+		return p, err
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalPayload decodes the JSON payload p into v, decompressing it
+// first if it was compressed by marshalPayload.
+func unmarshalPayload(p []byte, v interface{}) error {
+	if bytes.HasPrefix(p, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if p, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(p, v)
+}
+
+// payloadCodec encodes the call requests and results stored in redis.
+type payloadCodec struct {
+	compress int         // compression threshold, see Broker.CompressThreshold
+	keys     KeyProvider // encrypts the arguments if set, see Broker.Keys
+}
+
+// marshal returns the encoding of v to store in redis.
+func (pc payloadCodec) marshal(v interface{}) ([]byte, error) {
+	if pc.keys != nil {
+		var err error
+		if v, err = encryptArgs(v, pc.keys); err != nil {
+			return nil, err
+		}
+	}
+	return marshalPayload(v, pc.compress)
+}
+
+// unmarshal decodes the payload p stored in redis into v. The payloads
+// with encrypted arguments are decrypted even if the codec does not
+// encrypt them, as long as it has their key.
+func (pc payloadCodec) unmarshal(p []byte, v interface{}) error {
+	if ok, err := unmarshalEncrypted(p, v, pc.keys); ok {
+		return err
+	}
+	return unmarshalPayload(p, v)
+}
@@ -0,0 +1,65 @@
+package redisbroker
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalPayload(t *testing.T) {
+	rp := &message.ResPayload{MsgUUID: uuid.NewRandom(), URI: "a", Args: []byte(`"` + strings.Repeat("a", 1000) + `"`)}
+
+	p, err := marshalPayload(rp, 0)
+	require.NoError(t, err, "marshal without threshold")
+	assert.False(t, bytes.HasPrefix(p, gzipMagic), "not compressed without threshold")
+
+	small, err := marshalPayload(rp, len(p))
+	require.NoError(t, err, "marshal under threshold")
+	assert.Equal(t, p, small, "not compressed under threshold")
+
+	cp, err := marshalPayload(rp, 100)
+	require.NoError(t, err, "marshal over threshold")
+	assert.True(t, bytes.HasPrefix(cp, gzipMagic), "compressed over threshold")
+	assert.True(t, len(cp) < len(p), "compressed is smaller")
+
+	for i, b := range [][]byte{p, cp} {
+		var got message.ResPayload
+		require.NoError(t, unmarshalPayload(b, &got), "%d: unmarshal", i)
+		assert.Equal(t, rp.Args, got.Args, "%d: args", i)
+	}
+}
+
+func TestCompressedResults(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:              pool,
+		Dial:              pool.Dial,
+		CompressThreshold: 100,
+		LogFunc:           logIfVerbose,
+	}
+
+	connUUID := uuid.NewRandom()
+	rc, err := brk.NewResultsConn(connUUID)
+	require.NoError(t, err, "NewResultsConn")
+	defer rc.Close()
+
+	rp := &message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a", Args: []byte(`"` + strings.Repeat("a", 1000) + `"`)}
+	require.NoError(t, brk.Result(rp, time.Second), "Result")
+
+	select {
+	case got := <-rc.Results():
+		assert.Equal(t, rp.Args, got.Args, "decompressed result")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no result received")
+	}
+}
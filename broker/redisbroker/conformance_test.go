@@ -0,0 +1,49 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/broker/brokertest"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestConformance(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	// the concurrent tests need more connections than redistest.NewPool
+	// allows.
+	pool := &redis.Pool{
+		MaxIdle: 10,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", ":"+port)
+		},
+	}
+	defer pool.Close()
+	newBroker := func() (*Broker, func(), error) {
+		rc := pool.Get()
+		defer rc.Close()
+		if _, err := rc.Do("FLUSHALL"); err != nil {
+			return nil, nil, err
+		}
+
+		brk := &Broker{
+			Pool:            pool,
+			Dial:            pool.Dial,
+			BlockingTimeout: time.Second,
+			CheckLeases:     true,
+			LogFunc:         logIfVerbose,
+		}
+		return brk, func() {}, nil
+	}
+
+	brokertest.TestCallBroker(t, func() (brokertest.CallBroker, func(), error) {
+		return newBroker()
+	})
+	brokertest.TestPubSubBroker(t, func() (broker.PubSubBroker, func(), error) {
+		return newBroker()
+	})
+}
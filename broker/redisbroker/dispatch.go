@@ -0,0 +1,96 @@
+package redisbroker
+
+import (
+	"expvar"
+	"hash/fnv"
+	"strconv"
+	"sync"
+)
+
+// DefaultEventShardBuffer is the default number of events buffered per
+// shard when the events of a pub-sub connection are sharded (see
+// Broker.EventShards).
+var DefaultEventShardBuffer = 100
+
+// rawEvent is an event as received on a pub-sub connection.
+type rawEvent struct {
+	channel string
+	pattern string
+	data    []byte
+}
+
+// eventShards dispatches the events received on a pub-sub connection
+// to a fixed number of goroutines, selected by hashing the channel of
+// the event. The events of a channel are delivered in order, and each
+// shard has at most one event waiting to be delivered, so that the
+// shards take turns and a hot channel only fills the buffer of its own
+// shard.
+type eventShards struct {
+	shards []chan rawEvent
+	send   func(rawEvent)
+	vars   *expvar.Map
+	wg     sync.WaitGroup
+}
+
+// newEventShards starts n shards with a buffer of size buf, that call
+// send for each event.
+func newEventShards(n, buf int, vars *expvar.Map, send func(rawEvent)) *eventShards {
+	if buf <= 0 {
+		buf = DefaultEventShardBuffer
+	}
+	s := &eventShards{
+		shards: make([]chan rawEvent, n),
+		send:   send,
+		vars:   vars,
+	}
+	for i := range s.shards {
+		s.shards[i] = make(chan rawEvent, buf)
+		s.wg.Add(1)
+		go s.run(i)
+	}
+	return s
+}
+
+// shardOf returns the index of the shard of the channel.
+func (s *eventShards) shardOf(channel string) int {
+	h := fnv.New32a()
+	h.Write([]byte(channel))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// dispatch queues the event on the shard of its channel. It never
+// blocks, the event is dropped and false is returned if the buffer of
+// the shard is full.
+func (s *eventShards) dispatch(ev rawEvent) bool {
+	i := s.shardOf(ev.channel)
+	select {
+	case s.shards[i] <- ev:
+		return true
+	default:
+		if s.vars != nil {
+			s.vars.Add("DroppedEvents", 1)
+			s.vars.Add("DroppedEvents."+strconv.Itoa(i), 1)
+		}
+		return false
+	}
+}
+
+func (s *eventShards) run(i int) {
+	defer s.wg.Done()
+
+	key := "Events." + strconv.Itoa(i)
+	for ev := range s.shards[i] {
+		s.send(ev)
+		if s.vars != nil {
+			s.vars.Add(key, 1)
+		}
+	}
+}
+
+// close stops the shards once their buffered events are delivered.
+func (s *eventShards) close() {
+	for _, ch := range s.shards {
+		close(ch)
+	}
+	s.wg.Wait()
+}
@@ -0,0 +1,68 @@
+package redisbroker
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventShards(t *testing.T) {
+	var mu sync.Mutex
+	got := make(map[string][]string)
+	release := make(chan struct{})
+	cold := make(chan struct{}, 1)
+
+	vars := new(expvar.Map).Init()
+	s := newEventShards(4, 2, vars, func(ev rawEvent) {
+		if ev.channel == "hot" {
+			<-release
+		} else {
+			cold <- struct{}{}
+		}
+		mu.Lock()
+		got[ev.channel] = append(got[ev.channel], string(ev.data))
+		mu.Unlock()
+	})
+
+	// find a channel on another shard than the hot one
+	coldCh := "cold"
+	for i := 0; s.shardOf(coldCh) == s.shardOf("hot"); i++ {
+		coldCh = "cold" + strconv.Itoa(i)
+	}
+
+	// one event is being sent and two are buffered, the others are dropped
+	var dropped int
+	for i := 0; i < 10; i++ {
+		if !s.dispatch(rawEvent{channel: "hot", data: []byte(strconv.Itoa(i))}) {
+			dropped++
+		}
+		if i == 0 {
+			// wait for the first event to be picked up by the shard
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	assert.Equal(t, 7, dropped, "dropped events")
+
+	// the hot channel does not block the other shards
+	require.True(t, s.dispatch(rawEvent{channel: coldCh, data: []byte("c")}), "dispatch cold")
+	select {
+	case <-cold:
+	case <-time.After(time.Second):
+		assert.Fail(t, "cold event not delivered")
+	}
+
+	close(release)
+	s.close()
+
+	assert.Equal(t, []string{"0", "1", "2"}, got["hot"], "hot events in order")
+	assert.Equal(t, []string{"c"}, got[coldCh], "cold events")
+	assert.Equal(t, "7", vars.Get("DroppedEvents").String(), "DroppedEvents")
+	hot := strconv.Itoa(s.shardOf("hot"))
+	assert.Equal(t, "7", vars.Get("DroppedEvents."+hot).String(), "DroppedEvents of the hot shard")
+	assert.Equal(t, "3", vars.Get("Events."+hot).String(), "Events of the hot shard")
+}
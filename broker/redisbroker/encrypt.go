@@ -0,0 +1,260 @@
+package redisbroker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// ErrUnknownKey is returned by a KeyProvider when it does not have the
+// key with the requested ID.
+var ErrUnknownKey = errors.New("redisbroker: unknown encryption key")
+
+// KeyProvider provides the keys used to encrypt the arguments of the
+// call requests and results stored in redis (see Broker.Keys). Each
+// key has an ID that is stored with the encrypted arguments, so that
+// the keys can be rotated: the new payloads are encrypted with the
+// current key, and the stored ones are decrypted with the key they
+// were encrypted with.
+type KeyProvider interface {
+	// CurrentKey returns the ID and the key to use to encrypt the
+	// arguments. The key must be 16, 24 or 32 bytes long to use
+	// AES-128, AES-192 or AES-256.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the key with the ID, or ErrUnknownKey.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider with a fixed set of keys.
+type StaticKeys struct {
+	// Current is the ID of the key used to encrypt the arguments.
+	Current string
+
+	// Keys are the keys by ID. It must hold the current key, and the
+	// keys of the payloads that may still be stored in redis.
+	Keys map[string][]byte
+}
+
+// CurrentKey implements KeyProvider for StaticKeys.
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+// Key implements KeyProvider for StaticKeys.
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// ParseKeys parses the comma-separated list of keys s, each key being
+// its ID and its base64-encoded (standard encoding) value separated by
+// a colon, e.g. "k2:<base64>,k1:<base64>". The first key is the current
+// one. White space around the keys is ignored.
+func ParseKeys(s string) (*StaticKeys, error) {
+	keys := &StaticKeys{Keys: make(map[string][]byte)}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		ix := strings.Index(kv, ":")
+		if ix <= 0 {
+			return nil, fmt.Errorf("redisbroker: invalid key %q, must be ID:base64", kv)
+		}
+		id := kv[:ix]
+		key, err := base64.StdEncoding.DecodeString(kv[ix+1:])
+		if err != nil {
+			return nil, fmt.Errorf("redisbroker: invalid key %s: %v", id, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("redisbroker: invalid key %s: %v", id, err)
+		}
+		if _, ok := keys.Keys[id]; ok {
+			return nil, fmt.Errorf("redisbroker: duplicate key %s", id)
+		}
+		if keys.Current == "" {
+			keys.Current = id
+		}
+		keys.Keys[id] = key
+	}
+	return keys, nil
+}
+
+// encryptedCall and encryptedRes are the payloads stored with their
+// arguments encrypted with the key ArgsKey. The call request of an
+// encryptedDeadLetter is an encryptedCall.
+type encryptedCall struct {
+	*message.CallPayload
+	ArgsKey string `json:"args_key,omitempty"`
+}
+
+type encryptedRes struct {
+	*message.ResPayload
+	ArgsKey string `json:"args_key,omitempty"`
+}
+
+type encryptedDeadLetter struct {
+	*message.DeadLetterPayload
+	Call *encryptedCall `json:"call"`
+}
+
+// encryptArgs returns the call request, result or dead letter v with
+// its arguments encrypted with the current key of keys. Other values
+// and payloads without arguments are returned as-is.
+func encryptArgs(v interface{}, keys KeyProvider) (interface{}, error) {
+	switch v := v.(type) {
+	case *message.CallPayload:
+		if len(v.Args) == 0 {
+			return v, nil
+		}
+		id, args, err := seal(keys, v.Args, v.MsgUUID)
+		if err != nil {
+			return nil, err
+		}
+		cp := *v
+		cp.Args = args
+		return &encryptedCall{CallPayload: &cp, ArgsKey: id}, nil
+
+	case *message.ResPayload:
+		if len(v.Args) == 0 {
+			return v, nil
+		}
+		id, args, err := seal(keys, v.Args, v.MsgUUID)
+		if err != nil {
+			return nil, err
+		}
+		rp := *v
+		rp.Args = args
+		return &encryptedRes{ResPayload: &rp, ArgsKey: id}, nil
+
+	case *message.DeadLetterPayload:
+		if v.Call == nil || len(v.Call.Args) == 0 {
+			return v, nil
+		}
+		ec, err := encryptArgs(v.Call, keys)
+		if err != nil {
+			return nil, err
+		}
+		dl := *v
+		return &encryptedDeadLetter{DeadLetterPayload: &dl, Call: ec.(*encryptedCall)}, nil
+	}
+	return v, nil
+}
+
+// unmarshalEncrypted decodes the stored payload p into the call request,
+// result or dead letter v, decrypting its arguments if they were
+// encrypted. It returns false if v is none of those payloads.
+func unmarshalEncrypted(p []byte, v interface{}, keys KeyProvider) (bool, error) {
+	switch v := v.(type) {
+	case *message.CallPayload:
+		ec := encryptedCall{CallPayload: v}
+		if err := unmarshalPayload(p, &ec); err != nil {
+			return true, err
+		}
+		return true, decryptArgs(keys, ec.ArgsKey, &v.Args, v.MsgUUID)
+
+	case *message.ResPayload:
+		er := encryptedRes{ResPayload: v}
+		if err := unmarshalPayload(p, &er); err != nil {
+			return true, err
+		}
+		return true, decryptArgs(keys, er.ArgsKey, &v.Args, v.MsgUUID)
+
+	case *message.DeadLetterPayload:
+		ed := encryptedDeadLetter{DeadLetterPayload: v, Call: &encryptedCall{CallPayload: &message.CallPayload{}}}
+		if err := unmarshalPayload(p, &ed); err != nil {
+			return true, err
+		}
+		if ed.Call == nil {
+			v.Call = nil
+			return true, nil
+		}
+		v.Call = ed.Call.CallPayload
+		return true, decryptArgs(keys, ed.Call.ArgsKey, &v.Call.Args, v.Call.MsgUUID)
+	}
+	return false, nil
+}
+
+// decryptArgs replaces the arguments encrypted with the key id by their
+// plaintext. It does nothing if id is empty, i.e. if the arguments are
+// not encrypted.
+func decryptArgs(keys KeyProvider, id string, args *json.RawMessage, msgUUID uuid.UUID) error {
+	if id == "" {
+		return nil
+	}
+	if keys == nil {
+		return fmt.Errorf("redisbroker: no key provider to decrypt the arguments encrypted with key %q", id)
+	}
+	plain, err := open(keys, id, *args, msgUUID)
+	if err != nil {
+		return err
+	}
+	*args = plain
+	return nil
+}
+
+// seal encrypts args with AES-GCM using the current key of keys, and
+// returns the ID of the key and the JSON string of the base64-encoded
+// nonce and ciphertext. The message UUID is authenticated with the
+// arguments, so that they cannot be moved to another payload.
+func seal(keys KeyProvider, args json.RawMessage, msgUUID uuid.UUID) (string, json.RawMessage, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+	b, err := json.Marshal(gcm.Seal(nonce, nonce, args, msgUUID))
+	if err != nil {
+		return "", nil, err
+	}
+	return id, b, nil
+}
+
+// open decrypts the arguments encrypted by seal with the key id.
+func open(keys KeyProvider, id string, args json.RawMessage, msgUUID uuid.UUID) (json.RawMessage, error) {
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	if err := json.Unmarshal(args, &b); err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("redisbroker: invalid encrypted arguments")
+	}
+	nonce, ct := b[:gcm.NonceSize()], b[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ct, msgUUID)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,135 @@
+package redisbroker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeys(current string) *StaticKeys {
+	return &StaticKeys{
+		Current: current,
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 16),
+			"k2": bytes.Repeat([]byte{2}, 32),
+		},
+	}
+}
+
+func TestPayloadCodecEncryption(t *testing.T) {
+	secret := `"` + strings.Repeat("secret", 50) + `"`
+	cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a", Args: []byte(secret)}
+	rp := &message.ResPayload{MsgUUID: uuid.NewRandom(), URI: "a", Args: []byte(secret)}
+	dl := &message.DeadLetterPayload{Call: cp, Key: "k", Failures: 2}
+
+	pc := payloadCodec{keys: testKeys("k1")}
+	for _, compress := range []int{0, 100} {
+		pc.compress = compress
+
+		p, err := pc.marshal(cp)
+		require.NoError(t, err, "%d: marshal call", compress)
+		assert.False(t, bytes.Contains(p, []byte("secret")), "%d: call args encrypted", compress)
+		assert.Equal(t, secret, string(cp.Args), "%d: call args unchanged", compress)
+
+		// rotated keys decrypt the payloads of the previous key
+		var gotCall message.CallPayload
+		require.NoError(t, payloadCodec{keys: testKeys("k2")}.unmarshal(p, &gotCall), "%d: unmarshal call", compress)
+		assert.Equal(t, secret, string(gotCall.Args), "%d: call args decrypted", compress)
+		assert.Equal(t, "a", gotCall.URI, "%d: call URI", compress)
+
+		p, err = pc.marshal(rp)
+		require.NoError(t, err, "%d: marshal result", compress)
+		assert.False(t, bytes.Contains(p, []byte("secret")), "%d: result args encrypted", compress)
+		var gotRes message.ResPayload
+		require.NoError(t, pc.unmarshal(p, &gotRes), "%d: unmarshal result", compress)
+		assert.Equal(t, secret, string(gotRes.Args), "%d: result args decrypted", compress)
+
+		p, err = pc.marshal(dl)
+		require.NoError(t, err, "%d: marshal dead letter", compress)
+		assert.False(t, bytes.Contains(p, []byte("secret")), "%d: dead letter args encrypted", compress)
+		var gotDL message.DeadLetterPayload
+		require.NoError(t, pc.unmarshal(p, &gotDL), "%d: unmarshal dead letter", compress)
+		if assert.NotNil(t, gotDL.Call, "%d: dead letter call", compress) {
+			assert.Equal(t, secret, string(gotDL.Call.Args), "%d: dead letter args decrypted", compress)
+		}
+		assert.Equal(t, 2, gotDL.Failures, "%d: dead letter failures", compress)
+	}
+
+	pc.compress = 0
+	p, err := pc.marshal(cp)
+	require.NoError(t, err, "marshal call")
+	var got message.CallPayload
+	assert.Error(t, payloadCodec{}.unmarshal(p, &got), "no key provider")
+	assert.Error(t, payloadCodec{keys: &StaticKeys{}}.unmarshal(p, &got), "unknown key")
+
+	// the arguments cannot be moved to another payload
+	tampered := bytes.Replace(p, []byte(cp.MsgUUID.String()), []byte(uuid.NewRandom().String()), 1)
+	assert.Error(t, pc.unmarshal(tampered, &got), "other message UUID")
+
+	// the plaintext payloads can still be read
+	p, err = payloadCodec{}.marshal(cp)
+	require.NoError(t, err, "marshal plaintext")
+	require.NoError(t, pc.unmarshal(p, &got), "unmarshal plaintext")
+	assert.Equal(t, secret, string(got.Args), "plaintext args")
+
+	_, err = payloadCodec{keys: &StaticKeys{Current: "x"}}.marshal(cp)
+	assert.Equal(t, ErrUnknownKey, err, "unknown current key")
+}
+
+func TestEncryptedCalls(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		Keys:            testKeys("k1"),
+		LogFunc:         logIfVerbose,
+	}
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Args: []byte(`"secret"`)}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+
+	rc := pool.Get()
+	vals, err := redis.ByteSlices(rc.Do("LRANGE", callListKey("a", 0), 0, -1))
+	rc.Close()
+	require.NoError(t, err, "LRANGE")
+	if assert.Equal(t, 1, len(vals), "stored calls") {
+		assert.False(t, bytes.Contains(vals[0], []byte("secret")), "stored args encrypted")
+	}
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+	select {
+	case got := <-cc.Calls():
+		assert.Equal(t, `"secret"`, string(got.Args), "decrypted call")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no call received")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	k16, k32 := base64.StdEncoding.EncodeToString(make([]byte, 16)), base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	keys, err := ParseKeys("k2:" + k32 + ", k1:" + k16)
+	require.NoError(t, err, "ParseKeys")
+	assert.Equal(t, "k2", keys.Current, "current key")
+	assert.Equal(t, 2, len(keys.Keys), "keys")
+
+	for _, s := range []string{"", "k1", ":" + k16, "k1:!", "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 10)), "k1:" + k16 + ",k1:" + k32} {
+		_, err := ParseKeys(s)
+		assert.Error(t, err, "%q", s)
+	}
+}
@@ -0,0 +1,109 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ broker.HistoryBroker = (*Broker)(nil)
+
+// redis cluster-compliant key
+const historyKey = "juggler:history:{%s}" // 1: channel
+
+// script to retain the event in the history of its channel, dropping
+// the events that exceed the capacity or the time-to-live.
+var retainEventScript = redis.NewScript(1, `
+	local score = tonumber(ARGV[1])
+	redis.call("ZADD", KEYS[1], score, ARGV[2])
+	local cap = tonumber(ARGV[3])
+	redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -(cap + 1))
+	local ttl = tonumber(ARGV[4])
+	if ttl > 0 then
+		redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", "(" .. (score - ttl))
+		redis.call("PEXPIRE", KEYS[1], ttl)
+	end
+	return 0
+`)
+
+// retainEvent stores the published event p in the history of channel.
+func (b *Broker) retainEvent(channel string, pp *message.PubPayload, p []byte) error {
+	ts := pp.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	k := fmt.Sprintf(historyKey, channel)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	_, err := retainEventScript.Do(rc, k, unixMs(ts), p, b.HistoryCap, timeoutMs(b.HistoryTTL))
+	return err
+}
+
+// History returns the events retained for channel that were published
+// between from and to inclusively, oldest first. A zero from or to
+// means no bound. If limit is > 0 and more events are retained in that
+// range, only the limit most recent ones are returned. Events are only
+// retained if the HistoryCap is set, and the events published with a
+// TTL are not returned once they expired.
+func (b *Broker) History(channel string, from, to time.Time, limit int) ([]*message.EvntPayload, error) {
+	if b.HistoryTTL > 0 {
+		if min := time.Now().Add(-b.HistoryTTL); from.Before(min) {
+			from = min
+		}
+	}
+	min, max := "-inf", "+inf"
+	if !from.IsZero() {
+		min = strconv.FormatInt(unixMs(from), 10)
+	}
+	if !to.IsZero() {
+		max = strconv.FormatInt(unixMs(to), 10)
+	}
+
+	k := fmt.Sprintf(historyKey, channel)
+	args := redis.Args{k, max, min}
+	if limit > 0 {
+		args = args.Add("LIMIT", 0, limit)
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	vals, err := redis.ByteSlices(rc.Do("ZREVRANGEBYSCORE", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	evs := make([]*message.EvntPayload, 0, len(vals))
+	// most recent events first, reverse the order
+	for i := len(vals) - 1; i >= 0; i-- {
+		var pp message.PubPayload
+		if err := json.Unmarshal(vals[i], &pp); err != nil {
+			return nil, err
+		}
+		ep := &message.EvntPayload{
+			MsgUUID:     pp.MsgUUID,
+			Channel:     channel,
+			Args:        pp.Args,
+			ContentType: pp.ContentType,
+			Timestamp:   pp.Timestamp,
+			TTL:         pp.TTL,
+			Seq:         pp.Seq,
+			Headers:     pp.Headers,
+		}
+		if left, ok := ep.TimeLeft(now); ok && left <= 0 {
+			continue
+		}
+		evs = append(evs, ep)
+	}
+	return evs, nil
+}
@@ -0,0 +1,77 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:       pool,
+		Dial:       pool.Dial,
+		LogFunc:    logIfVerbose,
+		HistoryCap: 3,
+	}
+
+	start := time.Now().UTC().Add(-time.Minute)
+	for i := 0; i < 5; i++ {
+		pp := &message.PubPayload{
+			MsgUUID:   uuid.NewRandom(),
+			Args:      json.RawMessage(strconv.Itoa(i)),
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+		}
+		require.NoError(t, brk.Publish("a", pp), "Publish %d", i)
+	}
+
+	evs, err := brk.History("a", time.Time{}, time.Time{}, 0)
+	require.NoError(t, err, "History")
+	if assert.Equal(t, 3, len(evs), "capped events") {
+		for i, ev := range evs {
+			assert.Equal(t, "a", ev.Channel, "%d: channel", i)
+			assert.Equal(t, strconv.Itoa(i+2), string(ev.Args), "%d: oldest first", i)
+		}
+	}
+
+	evs, err = brk.History("a", time.Time{}, time.Time{}, 2)
+	require.NoError(t, err, "History with limit")
+	if assert.Equal(t, 2, len(evs), "limited events") {
+		assert.Equal(t, "3", string(evs[0].Args), "most recent events")
+		assert.Equal(t, "4", string(evs[1].Args), "most recent events")
+	}
+
+	evs, err = brk.History("a", start.Add(2*time.Second), start.Add(3*time.Second), 0)
+	require.NoError(t, err, "History with time range")
+	assert.Equal(t, 2, len(evs), "events in time range")
+
+	brk.HistoryTTL = 30 * time.Second
+	evs, err = brk.History("a", time.Time{}, time.Time{}, 0)
+	require.NoError(t, err, "History with TTL")
+	assert.Equal(t, 0, len(evs), "expired events")
+
+	// the events published with a TTL are not returned once they expired
+	now := time.Now().UTC()
+	require.NoError(t, brk.Publish("c", &message.PubPayload{MsgUUID: uuid.NewRandom(), Args: json.RawMessage("1"), Timestamp: now.Add(-time.Second), TTL: time.Millisecond}), "Publish expired")
+	require.NoError(t, brk.Publish("c", &message.PubPayload{MsgUUID: uuid.NewRandom(), Args: json.RawMessage("2"), Timestamp: now, TTL: time.Minute}), "Publish with TTL")
+	evs, err = brk.History("c", time.Time{}, time.Time{}, 0)
+	require.NoError(t, err, "History with expired events")
+	if assert.Equal(t, 1, len(evs), "events not expired") {
+		assert.Equal(t, "2", string(evs[0].Args), "event not expired")
+		assert.Equal(t, time.Minute, evs[0].TTL, "TTL")
+	}
+
+	evs, err = brk.History("b", time.Time{}, time.Time{}, 0)
+	require.NoError(t, err, "History of other channel")
+	assert.Equal(t, 0, len(evs), "no events for other channel")
+}
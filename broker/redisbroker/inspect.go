@@ -0,0 +1,478 @@
+package redisbroker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/internal/uuidstr"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+var _ broker.Inspector = (*Broker)(nil)
+
+// QueueInfo is the state of the call requests of a URI, as returned
+// by Broker.Queues.
+type QueueInfo struct {
+	URI         string `json:"uri"`
+	Pending     int    `json:"pending"`             // waiting for a callee, on all priorities and callee instances
+	InFlight    int    `json:"in_flight,omitempty"` // delivered from a stream and not acknowledged yet, see Broker.CallStreams
+	Scheduled   int    `json:"scheduled"`           // scheduled for later, see Broker.CallAt
+	DeadLetters int    `json:"dead_letters"`        // quarantined, see Broker.Quarantine
+}
+
+// PendingCall is a call request waiting for a callee, as returned by
+// Broker.PendingCalls.
+type PendingCall struct {
+	Call     *message.CallPayload `json:"call"`
+	Priority int                  `json:"priority"`
+	Callee   string               `json:"callee,omitempty"` // UUID of the callee instance, for routed calls
+	TTL      time.Duration        `json:"ttl"`              // time left before the request expires
+	Expired  bool                 `json:"expired"`          // expired, dropped when delivered
+}
+
+// the kinds of keys of the call requests.
+const (
+	pendingKind = iota
+	scheduledKind
+	deadLetterKind
+)
+
+// callsKey is a key of the call requests of a URI.
+type callsKey struct {
+	key      string
+	kind     int
+	uri      string
+	priority int
+	callee   string
+	stream   bool
+}
+
+// parseCallsKey parses a key of the call requests. It returns false
+// if k is not the key of a list or stream of pending, scheduled or
+// quarantined requests.
+func parseCallsKey(k string) (*callsKey, bool) {
+	rest := strings.TrimPrefix(k, "juggler:calls:")
+	if rest == k {
+		return nil, false
+	}
+
+	ck := &callsKey{key: k}
+	if s := strings.TrimPrefix(rest, "stream:"); s != rest {
+		ck.stream = true
+		rest = s
+	}
+
+	var prio bool
+	switch {
+	case strings.HasPrefix(rest, "{"):
+	case strings.HasPrefix(rest, "priority:{"):
+		prio = true
+	case ck.stream:
+		// only the pending requests are stored in streams
+		return nil, false
+	case strings.HasPrefix(rest, "scheduled:{"):
+		ck.kind = scheduledKind
+	case strings.HasPrefix(rest, "deadletter:{"):
+		ck.kind = deadLetterKind
+	default:
+		// timeout, failures and patterns keys
+		return nil, false
+	}
+
+	start := strings.Index(rest, "{")
+	end := strings.Index(rest[start:], "}")
+	if end < 0 {
+		return nil, false
+	}
+	ck.uri = rest[start+1 : start+end]
+
+	parts := strings.Split(rest[start+end+1:], ":")[1:]
+	if prio {
+		if len(parts) == 0 {
+			return nil, false
+		}
+		p, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, false
+		}
+		ck.priority = p
+		parts = parts[1:]
+	}
+	switch {
+	case len(parts) == 1 && ck.kind == pendingKind && !ck.stream:
+		ck.callee = parts[0]
+	case len(parts) != 0:
+		return nil, false
+	}
+	return ck, true
+}
+
+// scanCallsKeys returns the keys of the call requests that match the
+// pattern, on the redis server of rc.
+func scanCallsKeys(rc redis.Conn, pattern string) ([]*callsKey, error) {
+	var keys []*callsKey
+	cursor := "0"
+	for {
+		vals, err := redis.Values(rc.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		cursor, err = redis.String(vals[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		ks, err := redis.Strings(vals[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range ks {
+			if ck, ok := parseCallsKey(k); ok {
+				keys = append(keys, ck)
+			}
+		}
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// uriCallsKeys returns the keys of the call requests of the URI.
+func (b *Broker) uriCallsKeys(rc redis.Conn, uri string) ([]*callsKey, error) {
+	var keys []*callsKey
+	ks, err := scanCallsKeys(rc, "juggler:calls:*{"+globEscape(uri)+"}*")
+	if err != nil {
+		return nil, err
+	}
+	for _, ck := range ks {
+		if ck.uri == uri {
+			keys = append(keys, ck)
+		}
+	}
+	return keys, nil
+}
+
+// globEscape escapes the special characters of the redis glob-style
+// patterns in s.
+func globEscape(s string) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// keyLen returns the number of call requests stored in the key, and
+// the number of those requests that are in flight if it is a stream.
+func keyLen(rc redis.Conn, ck *callsKey) (n, inFlight int, err error) {
+	switch {
+	case ck.kind == scheduledKind:
+		n, err = redis.Int(rc.Do("ZCARD", ck.key))
+	case ck.stream:
+		n, err = redis.Int(rc.Do("XLEN", ck.key))
+		if err == nil {
+			inFlight, _, err = streamGroupInfo(rc, ck.key)
+		}
+	default:
+		n, err = redis.Int(rc.Do("LLEN", ck.key))
+	}
+	return n, inFlight, err
+}
+
+// streamGroupInfo returns the number of call requests of the stream k
+// delivered to the calls connections and not acknowledged yet, and the
+// ID of the last request delivered. The requests are removed from the
+// stream when they are acknowledged, so the requests after that ID are
+// waiting for a callee and the others are in flight.
+func streamGroupInfo(rc redis.Conn, k string) (inFlight int, lastID string, err error) {
+	groups, err := redis.Values(rc.Do("XINFO", "GROUPS", k))
+	if err != nil {
+		return 0, "", err
+	}
+	for _, g := range groups {
+		vals, err := redis.Values(g, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		var name string
+		var pending int
+		for i := 0; i+1 < len(vals); i += 2 {
+			field, _ := redis.String(vals[i], nil)
+			switch field {
+			case "name":
+				name, _ = redis.String(vals[i+1], nil)
+			case "pending":
+				pending, _ = redis.Int(vals[i+1], nil)
+			case "last-delivered-id":
+				lastID, _ = redis.String(vals[i+1], nil)
+			}
+		}
+		if name == callsGroup {
+			return pending, lastID, nil
+		}
+	}
+	// no consumer group yet, no call request was delivered
+	return 0, "0-0", nil
+}
+
+// Queues returns the state of the call requests of each URI that has
+// pending, scheduled or quarantined requests, sorted by URI. The keys
+// are scanned on the redis server of a connection from the Pool, so
+// in a redis cluster it only returns the URIs stored on one node, and
+// it should be called with a Pool for each node.
+func (b *Broker) Queues() ([]*QueueInfo, error) {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	keys, err := scanCallsKeys(rc, "juggler:calls:*")
+	if err != nil {
+		return nil, err
+	}
+
+	byURI := make(map[string]*QueueInfo)
+	for _, ck := range keys {
+		n, inFlight, err := keyLen(rc, ck)
+		if err != nil {
+			return nil, err
+		}
+		qi := byURI[ck.uri]
+		if qi == nil {
+			qi = &QueueInfo{URI: ck.uri}
+			byURI[ck.uri] = qi
+		}
+		switch ck.kind {
+		case pendingKind:
+			qi.Pending += n - inFlight
+			qi.InFlight += inFlight
+		case scheduledKind:
+			qi.Scheduled += n
+		case deadLetterKind:
+			qi.DeadLetters += n
+		}
+	}
+
+	qis := make([]*QueueInfo, 0, len(byURI))
+	for _, qi := range byURI {
+		qis = append(qis, qi)
+	}
+	sort.Sort(queuesByURI(qis))
+	return qis, nil
+}
+
+// QueueLen returns the number of call requests of the URI waiting for
+// a callee, on all priorities and callee instances. The requests of the
+// streams that are in flight are not counted.
+func (b *Broker) QueueLen(uri string) (int, error) {
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, fmt.Sprintf(callKey, uri))
+
+	keys, err := b.uriCallsKeys(rc, uri)
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for _, ck := range keys {
+		if ck.kind != pendingKind {
+			continue
+		}
+		n, inFlight, err := keyLen(rc, ck)
+		if err != nil {
+			return 0, err
+		}
+		total += n - inFlight
+	}
+	return total, nil
+}
+
+// PendingResults returns the number of results waiting to be read by
+// the connection identified by connUUID, including the results that
+// expired.
+func (b *Broker) PendingResults(connUUID uuid.UUID) (int, error) {
+	k := fmt.Sprintf(resKey, uuidstr.String(connUUID))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	return redis.Int(rc.Do("LLEN", k))
+}
+
+// ExpiredCount returns the number of call requests of the URI waiting
+// for a callee that expired. It reads all the pending call requests of
+// the URI, as PendingCalls does.
+func (b *Broker) ExpiredCount(uri string) (int, error) {
+	pcs, err := b.PendingCalls(uri)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, pc := range pcs {
+		if pc.Expired {
+			n++
+		}
+	}
+	return n, nil
+}
+
+type queuesByURI []*QueueInfo
+
+func (q queuesByURI) Len() int           { return len(q) }
+func (q queuesByURI) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q queuesByURI) Less(i, j int) bool { return q[i].URI < q[j].URI }
+
+// PendingCalls returns the call requests of the URI waiting for a
+// callee, highest priority first and, for each priority, in the order
+// they are delivered. The requests that expired are returned too, they
+// are dropped when a callee receives them. The requests of the streams
+// that are in flight are not returned, they are counted in the
+// InFlight field of the QueueInfo.
+func (b *Broker) PendingCalls(uri string) ([]*PendingCall, error) {
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, fmt.Sprintf(callKey, uri))
+
+	keys, err := b.uriCallsKeys(rc, uri)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byPriority(keys))
+
+	var pcs []*PendingCall
+	for _, ck := range keys {
+		if ck.kind != pendingKind {
+			continue
+		}
+		ps, err := pendingPayloads(rc, ck)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range ps {
+			var cp message.CallPayload
+			if err := b.codec().unmarshal(p, &cp); err != nil {
+				return nil, err
+			}
+
+			tk := fmt.Sprintf(callTimeoutKey, uri, cp.MsgUUID)
+			if ck.callee != "" && cp.Routing == message.Broadcast {
+				tk = fmt.Sprintf(calleeCallTimeoutKey, uri, cp.MsgUUID, ck.callee)
+			}
+			ttl, err := redis.Int64(rc.Do("PTTL", tk))
+			if err != nil {
+				return nil, err
+			}
+
+			pc := &PendingCall{Call: &cp, Priority: ck.priority, Callee: ck.callee}
+			if ttl < 0 {
+				pc.Expired = true
+			} else {
+				pc.TTL = time.Duration(ttl) * time.Millisecond
+			}
+			pcs = append(pcs, pc)
+		}
+	}
+	return pcs, nil
+}
+
+// pendingPayloads returns the payloads of the call requests of the
+// key, in the order they are delivered.
+func pendingPayloads(rc redis.Conn, ck *callsKey) ([][]byte, error) {
+	if ck.stream {
+		_, lastID, err := streamGroupInfo(rc, ck.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := rc.Do("XRANGE", ck.key, "("+lastID, "+")
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseEntries(ck.key, v)
+		if err != nil {
+			return nil, err
+		}
+		ps := make([][]byte, 0, len(entries))
+		for _, e := range entries {
+			ps = append(ps, e.payload)
+		}
+		return ps, nil
+	}
+
+	vals, err := redis.ByteSlices(rc.Do("LRANGE", ck.key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	// requests are pushed on the left and popped on the right
+	for i, j := 0, len(vals)-1; i < j; i, j = i+1, j-1 {
+		vals[i], vals[j] = vals[j], vals[i]
+	}
+	return vals, nil
+}
+
+type byPriority []*callsKey
+
+func (k byPriority) Len() int      { return len(k) }
+func (k byPriority) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k byPriority) Less(i, j int) bool {
+	if k[i].priority != k[j].priority {
+		return k[i].priority > k[j].priority
+	}
+	if k[i].stream != k[j].stream {
+		// streams are read along with the lists, list first
+		return k[j].stream
+	}
+	return k[i].callee < k[j].callee
+}
+
+// script to delete the lists and streams of call requests and return
+// the number of requests deleted.
+var drainScript = redis.NewScript(-1, `
+	local n = 0
+	for _, k in ipairs(KEYS) do
+		local t = redis.call("TYPE", k).ok
+		if t == "zset" then
+			n = n + redis.call("ZCARD", k)
+		elseif t == "stream" then
+			n = n + redis.call("XLEN", k)
+		else
+			n = n + redis.call("LLEN", k)
+		end
+		redis.call("DEL", k)
+	end
+	return n
+`)
+
+// Drain removes the pending and scheduled call requests of the URI, on
+// all priorities and callee instances, so that they are never delivered.
+// The quarantined requests are kept. It returns the number of requests
+// removed. The callers of the removed requests do not receive a result.
+func (b *Broker) Drain(uri string) (int, error) {
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, fmt.Sprintf(callKey, uri))
+
+	keys, err := b.uriCallsKeys(rc, uri)
+	if err != nil {
+		return 0, err
+	}
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, 0)
+	for _, ck := range keys {
+		if ck.kind != deadLetterKind {
+			args = append(args, ck.key)
+		}
+	}
+	if len(args) == 1 {
+		return 0, nil
+	}
+	args[0] = len(args) - 1
+	return redis.Int(drainScript.Do(rc, args...))
+}
@@ -0,0 +1,116 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCallsKey(t *testing.T) {
+	cases := []struct {
+		key  string
+		want *callsKey
+	}{
+		{"juggler:calls:{a.b}", &callsKey{kind: pendingKind, uri: "a.b"}},
+		{"juggler:calls:{a.b}:c1", &callsKey{kind: pendingKind, uri: "a.b", callee: "c1"}},
+		{"juggler:calls:priority:{a}:2", &callsKey{kind: pendingKind, uri: "a", priority: 2}},
+		{"juggler:calls:priority:{a}:2:c1", &callsKey{kind: pendingKind, uri: "a", priority: 2, callee: "c1"}},
+		{"juggler:calls:scheduled:{a}", &callsKey{kind: scheduledKind, uri: "a"}},
+		{"juggler:calls:deadletter:{a}", &callsKey{kind: deadLetterKind, uri: "a"}},
+		{"juggler:calls:timeout:{a}:123", nil},
+		{"juggler:calls:failures:{a}:k", nil},
+		{"juggler:calls:patterns", nil},
+		{"juggler:calls:priority:{a}:x", nil},
+		{"juggler:callees:instances:{a}", nil},
+	}
+	for _, c := range cases {
+		got, ok := parseCallsKey(c.key)
+		if c.want == nil {
+			assert.False(t, ok, c.key)
+			continue
+		}
+		if assert.True(t, ok, c.key) {
+			c.want.key = c.key
+			assert.Equal(t, c.want, got, c.key)
+		}
+	}
+}
+
+func TestInspectAndDrain(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	newCall := func(uri string, priority int) *message.CallPayload {
+		return &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: uri, Priority: priority}
+	}
+	c1, c2, c3 := newCall("a", 0), newCall("a", 2), newCall("a", 0)
+	require.NoError(t, brk.Call(c1, time.Minute), "Call 1")
+	require.NoError(t, brk.Call(c2, time.Minute), "Call 2")
+	require.NoError(t, brk.Call(c3, time.Millisecond), "Call 3")
+	require.NoError(t, brk.Call(newCall("b", 0), time.Minute), "Call b")
+	require.NoError(t, brk.CallAfter(newCall("a", 0), time.Hour), "CallAfter")
+	dl := &message.DeadLetterPayload{Call: newCall("a", 0), Key: "k", Failures: 1, Error: "boom", Timestamp: time.Now().UTC()}
+	require.NoError(t, brk.Quarantine(dl), "Quarantine")
+	time.Sleep(10 * time.Millisecond)
+
+	qis, err := brk.Queues()
+	require.NoError(t, err, "Queues")
+	assert.Equal(t, []*QueueInfo{
+		{URI: "a", Pending: 3, Scheduled: 1, DeadLetters: 1},
+		{URI: "b", Pending: 1},
+	}, qis, "queues")
+
+	pcs, err := brk.PendingCalls("a")
+	require.NoError(t, err, "PendingCalls")
+	if assert.Equal(t, 3, len(pcs), "pending calls") {
+		assert.Equal(t, c2.MsgUUID, pcs[0].Call.MsgUUID, "highest priority first")
+		assert.Equal(t, 2, pcs[0].Priority, "priority")
+		assert.Equal(t, c1.MsgUUID, pcs[1].Call.MsgUUID, "oldest first")
+		assert.False(t, pcs[1].Expired, "not expired")
+		assert.True(t, pcs[1].TTL > 0, "TTL")
+		assert.Equal(t, c3.MsgUUID, pcs[2].Call.MsgUUID, "newest last")
+		assert.True(t, pcs[2].Expired, "expired")
+	}
+
+	n, err := brk.QueueLen("a")
+	require.NoError(t, err, "QueueLen")
+	assert.Equal(t, 3, n, "queue length")
+	n, err = brk.ExpiredCount("a")
+	require.NoError(t, err, "ExpiredCount")
+	assert.Equal(t, 1, n, "expired count")
+
+	res, err := brk.NewResultsConn(c1.ConnUUID)
+	require.NoError(t, err, "NewResultsConn")
+	defer res.Close()
+	require.NoError(t, brk.Result(&message.ResPayload{ConnUUID: c1.ConnUUID, MsgUUID: c1.MsgUUID, URI: "a"}, time.Minute), "Result")
+	n, err = brk.PendingResults(c1.ConnUUID)
+	require.NoError(t, err, "PendingResults")
+	assert.Equal(t, 1, n, "pending results")
+
+	n, err = brk.Drain("a")
+	require.NoError(t, err, "Drain")
+	assert.Equal(t, 4, n, "drained requests")
+
+	qis, err = brk.Queues()
+	require.NoError(t, err, "Queues after Drain")
+	assert.Equal(t, []*QueueInfo{
+		{URI: "a", DeadLetters: 1},
+		{URI: "b", Pending: 1},
+	}, qis, "queues after drain")
+
+	n, err = brk.Drain("c")
+	require.NoError(t, err, "Drain empty")
+	assert.Equal(t, 0, n, "nothing drained")
+}
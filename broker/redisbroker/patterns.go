@@ -0,0 +1,210 @@
+package redisbroker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/internal/uuidstr"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ broker.PatternBroker = (*Broker)(nil)
+
+// sorted set of the URI patterns listened on by calls connections,
+// members are "<callee UUID>:<pattern>" scored by their expiration time.
+const patternsKey = "juggler:calls:patterns"
+
+// PatternsRefreshInterval is the interval at which the Broker reloads
+// the URI patterns listened on by the callees when it registers call
+// requests.
+var PatternsRefreshInterval = time.Second
+
+// registrationTTLFactor is the number of schedule poll intervals after
+// which a callee instance or a pattern expires if its calls connection
+// does not refresh it.
+const registrationTTLFactor = 10
+
+// patternCache caches the live URI patterns of a Broker.
+type patternCache struct {
+	mu       sync.Mutex
+	patterns []string
+	loaded   time.Time
+}
+
+// queueURI returns the URI that identifies the keys of the call
+// request, which is its pattern if it is routed to a pattern, or its
+// versioned URI if it has a version.
+func queueURI(cp *message.CallPayload) string {
+	if cp.Pattern != "" {
+		return cp.Pattern
+	}
+	return message.VersionedURI(cp.URI, cp.Version)
+}
+
+// livePatterns returns the URI patterns listened on by a live calls
+// connection, reloading them if they are older than
+// PatternsRefreshInterval.
+func (b *Broker) livePatterns() ([]string, error) {
+	pc := &b.patterns
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if !pc.loaded.IsZero() && time.Since(pc.loaded) < PatternsRefreshInterval {
+		return pc.patterns, nil
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, patternsKey)
+
+	members, err := redis.Strings(rc.Do("ZRANGEBYSCORE", patternsKey, "("+strconv.FormatInt(unixMs(time.Now()), 10), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(members))
+	patterns := make([]string, 0, len(members))
+	for _, m := range members {
+		ix := strings.Index(m, ":")
+		if ix < 0 {
+			continue
+		}
+		if p := m[ix+1:]; !seen[p] {
+			seen[p] = true
+			patterns = append(patterns, p)
+		}
+	}
+	pc.patterns = patterns
+	pc.loaded = time.Now()
+	return patterns, nil
+}
+
+// CalleePatterns returns the URI patterns listened on by a live calls
+// connection. The patterns are reloaded at most once every
+// PatternsRefreshInterval.
+func (b *Broker) CalleePatterns() ([]string, error) {
+	return b.livePatterns()
+}
+
+// routePattern returns the call request to register, with its Pattern
+// set if it must be routed to the callees of a pattern. It is routed to
+// the most specific live pattern that matches its URI, unless a callee
+// listens on the URI itself. Call requests with a version are checked
+// with checkVersion instead. The provided payload is left untouched.
+func (b *Broker) routePattern(cp *message.CallPayload) (*message.CallPayload, error) {
+	if cp.Pattern != "" {
+		return cp, nil
+	}
+	if cp.Version != "" {
+		return cp, b.checkVersion(cp)
+	}
+
+	patterns, err := b.livePatterns()
+	if err != nil {
+		return nil, err
+	}
+	pattern := message.BestURIPattern(patterns, cp.URI)
+	if pattern == "" {
+		return cp, nil
+	}
+
+	// callees listening on the URI itself take precedence
+	n, err := b.countInstances(cp.URI)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return cp, nil
+	}
+
+	cpy := *cp
+	cpy.Pattern = pattern
+	return &cpy, nil
+}
+
+// checkVersion returns broker.ErrUnsupportedVersion if no callee
+// instance listens on the versioned URI of the call request. Versioned
+// call requests are not routed to URI patterns.
+func (b *Broker) checkVersion(cp *message.CallPayload) error {
+	n, err := b.countInstances(queueURI(cp))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return broker.ErrUnsupportedVersion
+	}
+	return nil
+}
+
+// countInstances returns the number of live callee instances
+// registered for the URI.
+func (b *Broker) countInstances(uri string) (int, error) {
+	k := fmt.Sprintf(calleesKey, uri)
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+	return redis.Int(rc.Do("ZCOUNT", k, "("+strconv.FormatInt(unixMs(time.Now()), 10), "+inf"))
+}
+
+// registerPatterns registers or refreshes the URI patterns of the calls
+// connection, and removes the expired patterns.
+func (c *callsConn) registerPatterns() {
+	if !c.hasPatterns() {
+		return
+	}
+
+	now := time.Now()
+	expires := unixMs(now.Add(registrationTTLFactor * c.pollInterval()))
+	args := redis.Args{patternsKey}
+	for _, uri := range c.uris {
+		if message.IsURIPattern(uri) {
+			args = args.Add(expires, uuidstr.String(c.id)+":"+uri)
+		}
+	}
+
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, patternsKey)
+	if _, err := rc.Do("ZADD", args...); err != nil {
+		logf(c.logFn, "Calls: failed to register URI patterns: %v", err)
+		return
+	}
+	if _, err := rc.Do("ZREMRANGEBYSCORE", patternsKey, "-inf", unixMs(now)); err != nil {
+		logf(c.logFn, "Calls: failed to remove expired URI patterns: %v", err)
+	}
+}
+
+// unregisterPatterns removes the URI patterns of the calls connection.
+func (c *callsConn) unregisterPatterns() {
+	if !c.hasPatterns() {
+		return
+	}
+
+	args := redis.Args{patternsKey}
+	for _, uri := range c.uris {
+		if message.IsURIPattern(uri) {
+			args = args.Add(uuidstr.String(c.id) + ":" + uri)
+		}
+	}
+
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, patternsKey)
+	if _, err := rc.Do("ZREM", args...); err != nil {
+		logf(c.logFn, "Calls: failed to unregister URI patterns: %v", err)
+	}
+}
+
+func (c *callsConn) hasPatterns() bool {
+	for _, uri := range c.uris {
+		if message.IsURIPattern(uri) {
+			return true
+		}
+	}
+	return false
+}
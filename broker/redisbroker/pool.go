@@ -0,0 +1,110 @@
+package redisbroker
+
+import (
+	"time"
+
+	"github.com/PuerkitoBio/redisc"
+	"github.com/garyburd/redigo/redis"
+)
+
+// PoolConfig defines the options of a redis pool created with NewPool.
+type PoolConfig struct {
+	// MaxIdle is the maximum number of idle connections in the pool.
+	MaxIdle int
+
+	// MaxActive is the maximum number of connections allocated by the
+	// pool at a given time. The default of 0 means no limit.
+	MaxActive int
+
+	// Wait makes Get wait for a connection to be returned to the pool
+	// when MaxActive is reached, instead of returning a connection that
+	// fails with redis.ErrPoolExhausted.
+	Wait bool
+
+	// IdleTimeout is the time after which idle connections are closed.
+	// The default of 0 means that idle connections are not closed.
+	IdleTimeout time.Duration
+
+	// TestOnBorrow tests the idle connections with a PING before they
+	// are returned by Get, so that the connections closed by the redis
+	// server are discarded. Only the connections that were idle for at
+	// least TestIdleAfter are tested, all the idle connections are
+	// tested if it is 0.
+	TestOnBorrow  bool
+	TestIdleAfter time.Duration
+}
+
+// NewPool returns a redis pool configured with conf that dials the
+// redis server at addr with the dial options. It can be used as
+// Broker.Pool, with its Dial method as Broker.Dial, or as the
+// CreatePool function of a redisc.Cluster.
+func NewPool(addr string, conf PoolConfig, opts ...redis.DialOption) *redis.Pool {
+	p := &redis.Pool{
+		MaxIdle:     conf.MaxIdle,
+		MaxActive:   conf.MaxActive,
+		Wait:        conf.Wait,
+		IdleTimeout: conf.IdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, opts...)
+		},
+	}
+	if conf.TestOnBorrow {
+		after := conf.TestIdleAfter
+		p.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+			if after > 0 && time.Since(t) < after {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		}
+	}
+	return p
+}
+
+// PoolStats is the state of the connections of a redis pool.
+type PoolStats struct {
+	// ActiveCount is the number of connections allocated by the pool,
+	// including the idle connections.
+	ActiveCount int `json:"active"`
+
+	// IdleCount is the number of idle connections in the pool.
+	IdleCount int `json:"idle"`
+
+	// MaxActive is the maximum number of connections of the pool, or 0
+	// if there is no limit or it is unknown. The pool is saturated when
+	// ActiveCount reaches MaxActive.
+	MaxActive int `json:"max_active,omitempty"`
+}
+
+// Ping sends a PING to the redis server of the Broker's Pool, or to a
+// node of the cluster if it is a redisc.Cluster, and returns the error,
+// if any, so that the health of the broker can be checked.
+func (b *Broker) Ping() error {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("PING")
+	return err
+}
+
+// Stats returns the state of the connections of the Broker's Pool if it
+// is a *redis.Pool, or of the pool of each node of the cluster, by
+// address, if it is a *redisc.Cluster. The pool of a redis.Pool is
+// reported with an empty address. It returns nil for other types of
+// pools.
+func (b *Broker) Stats() map[string]PoolStats {
+	switch p := b.Pool.(type) {
+	case *redis.Pool:
+		return map[string]PoolStats{
+			"": {ActiveCount: p.ActiveCount(), IdleCount: p.IdleCount(), MaxActive: p.MaxActive},
+		}
+
+	case *redisc.Cluster:
+		stats := make(map[string]PoolStats)
+		for addr, st := range p.Stats() {
+			stats[addr] = PoolStats{ActiveCount: st.ActiveCount, IdleCount: st.IdleCount}
+		}
+		return stats
+	}
+	return nil
+}
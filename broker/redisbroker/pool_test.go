@@ -0,0 +1,48 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePool struct {
+	Pool
+}
+
+func TestPoolPingStats(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := NewPool(":"+port, PoolConfig{MaxIdle: 2, MaxActive: 3, Wait: true, IdleTimeout: time.Minute, TestOnBorrow: true})
+	defer pool.Close()
+	assert.Equal(t, 2, pool.MaxIdle, "MaxIdle")
+	assert.Equal(t, 3, pool.MaxActive, "MaxActive")
+	assert.True(t, pool.Wait, "Wait")
+	assert.Equal(t, time.Minute, pool.IdleTimeout, "IdleTimeout")
+	require.NotNil(t, pool.TestOnBorrow, "TestOnBorrow")
+
+	b := &Broker{Pool: pool, Dial: pool.Dial}
+	require.NoError(t, b.Ping(), "Ping")
+	assert.Equal(t, map[string]PoolStats{"": {ActiveCount: 1, IdleCount: 1, MaxActive: 3}}, b.Stats(), "Stats after Ping")
+
+	rc := pool.Get()
+	assert.Equal(t, map[string]PoolStats{"": {ActiveCount: 1, IdleCount: 0, MaxActive: 3}}, b.Stats(), "Stats with a connection in use")
+	rc.Close()
+
+	// the idle connection is tested with a PING when it is borrowed
+	cmd.Process.Kill()
+	cmd.Wait()
+	assert.Error(t, b.Ping(), "Ping after the server is killed")
+	assert.Equal(t, 0, b.Stats()[""].IdleCount, "no idle connection")
+
+	// no test on borrow
+	pool = NewPool(":"+port, PoolConfig{})
+	assert.Nil(t, pool.TestOnBorrow, "TestOnBorrow disabled")
+
+	b = &Broker{Pool: fakePool{}}
+	assert.Nil(t, b.Stats(), "Stats of unknown pool")
+}
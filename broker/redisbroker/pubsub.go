@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"expvar"
 	"sync"
+	"time"
 
 	"github.com/PuerkitoBio/juggler/broker"
 	"github.com/PuerkitoBio/juggler/message"
@@ -17,8 +18,20 @@ type pubSubConn struct {
 	logFn func(string, ...interface{})
 	vars  *expvar.Map
 
-	// wmu controls writes (sub/unsub calls) to the connection.
+	// number of shards and buffer size per shard of the events, see
+	// Broker.EventShards.
+	shards   int
+	shardBuf int
+
+	// syntax of the pattern subscriptions, see Broker.PatternSyntax.
+	syntax broker.PatternSyntax
+
+	// wmu controls writes (sub/unsub calls) to the connection, and
+	// protects access to globs.
 	wmu sync.Mutex
+	// the patterns subscribed to, by the redis pattern they translate
+	// to, unless the syntax is broker.GlobPatterns.
+	globs map[string]map[string]bool
 
 	// once makes sure only the first call to Events starts the goroutine.
 	once sync.Once
@@ -47,6 +60,10 @@ func (c *pubSubConn) Unsubscribe(channel string, pattern bool) error {
 }
 
 func (c *pubSubConn) subUnsub(ch string, pat bool, sub bool) error {
+	if pat && c.syntax != broker.GlobPatterns {
+		return c.subUnsubGlob(ch, sub)
+	}
+
 	var fn func(...interface{}) error
 	switch {
 	case pat && sub:
@@ -65,6 +82,65 @@ func (c *pubSubConn) subUnsub(ch string, pat bool, sub bool) error {
 	return err
 }
 
+// subUnsubGlob subscribes or unsubscribes the pattern through the redis
+// pattern it translates to, which is shared by the patterns that
+// translate to the same one.
+func (c *pubSubConn) subUnsubGlob(pattern string, sub bool) error {
+	glob, _ := c.syntax.Glob(pattern)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	pats := c.globs[glob]
+	if sub {
+		if pats[pattern] {
+			return nil
+		}
+		if len(pats) == 0 {
+			if err := c.psc.PSubscribe(glob); err != nil {
+				return err
+			}
+		}
+		if c.globs == nil {
+			c.globs = make(map[string]map[string]bool)
+		}
+		if pats == nil {
+			pats = make(map[string]bool)
+			c.globs[glob] = pats
+		}
+		pats[pattern] = true
+		return nil
+	}
+
+	if !pats[pattern] {
+		return nil
+	}
+	if len(pats) == 1 {
+		if err := c.psc.PUnsubscribe(glob); err != nil {
+			return err
+		}
+		delete(c.globs, glob)
+		return nil
+	}
+	delete(pats, pattern)
+	return nil
+}
+
+// patterns returns the patterns subscribed to of the redis pattern glob
+// that match channel.
+func (c *pubSubConn) patterns(glob, channel string) []string {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var list []string
+	for p := range c.globs[glob] {
+		if c.syntax.Match(p, channel) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
 // Events returns the stream of events from channels that the redis
 // connection is subscribed to.
 func (c *pubSubConn) Events() <-chan *message.EvntPayload {
@@ -79,16 +155,37 @@ func (c *pubSubConn) Events() <-chan *message.EvntPayload {
 func (c *pubSubConn) listen() {
 	defer close(c.evch)
 
+	var shards *eventShards
+	if c.shards > 0 {
+		shards = newEventShards(c.shards, c.shardBuf, c.vars, c.sendEvent)
+	}
+
 	wg := sync.WaitGroup{}
+	dispatch := func(ev rawEvent) {
+		if shards != nil {
+			shards.dispatch(ev)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.sendEvent(ev)
+		}()
+	}
+
 	for {
 		switch v := c.psc.Receive().(type) {
 		case redis.Message:
-			wg.Add(1)
-			go c.sendEvent(v.Channel, "", v.Data, &wg)
+			dispatch(rawEvent{channel: v.Channel, data: v.Data})
 
 		case redis.PMessage:
-			wg.Add(1)
-			go c.sendEvent(v.Channel, v.Pattern, v.Data, &wg)
+			if c.syntax == broker.GlobPatterns {
+				dispatch(rawEvent{channel: v.Channel, pattern: v.Pattern, data: v.Data})
+				break
+			}
+			for _, p := range c.patterns(v.Pattern, v.Channel) {
+				dispatch(rawEvent{channel: v.Channel, pattern: p, data: v.Data})
+			}
 
 		case error:
 			// possibly because the pub-sub connection was closed, but
@@ -97,16 +194,17 @@ func (c *pubSubConn) listen() {
 			c.errmu.Lock()
 			c.err = v
 			c.errmu.Unlock()
+			if shards != nil {
+				shards.close()
+			}
 			wg.Wait()
 			return
 		}
 	}
 }
 
-func (c *pubSubConn) sendEvent(channel, pattern string, pld []byte, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	ep, err := newEvntPayload(channel, pattern, pld)
+func (c *pubSubConn) sendEvent(ev rawEvent) {
+	ep, err := newEvntPayload(ev.channel, ev.pattern, ev.data)
 	if err != nil {
 		if c.vars != nil {
 			c.vars.Add("FailedEvntPayloadUnmarshals", 1)
@@ -114,6 +212,31 @@ func (c *pubSubConn) sendEvent(channel, pattern string, pld []byte, wg *sync.Wai
 		logf(c.logFn, "Events: failed to unmarshal event payload: %v", err)
 		return
 	}
+
+	if left, ok := ep.TimeLeft(time.Now()); ok {
+		// drop the event if it cannot be delivered before it expires
+		var expired bool
+		if left <= 0 {
+			expired = true
+		} else {
+			t := time.NewTimer(left)
+			select {
+			case c.evch <- ep:
+			case <-t.C:
+				expired = true
+			}
+			t.Stop()
+		}
+		if c.vars != nil {
+			if expired {
+				c.vars.Add("ExpiredEvents", 1)
+			} else {
+				c.vars.Add("Events", 1)
+			}
+		}
+		return
+	}
+
 	c.evch <- ep
 	if c.vars != nil {
 		c.vars.Add("Events", 1)
@@ -126,10 +249,15 @@ func newEvntPayload(channel, pattern string, pld []byte) (*message.EvntPayload,
 		return nil, err
 	}
 	ep := &message.EvntPayload{
-		MsgUUID: pp.MsgUUID,
-		Channel: channel,
-		Pattern: pattern,
-		Args:    pp.Args,
+		MsgUUID:     pp.MsgUUID,
+		Channel:     channel,
+		Pattern:     pattern,
+		Args:        pp.Args,
+		ContentType: pp.ContentType,
+		Timestamp:   pp.Timestamp,
+		TTL:         pp.TTL,
+		Seq:         pp.Seq,
+		Headers:     pp.Headers,
 	}
 	return ep, nil
 }
@@ -1,10 +1,13 @@
 package redisbroker
 
 import (
+	"encoding/json"
+	"expvar"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/PuerkitoBio/juggler/broker"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/PuerkitoBio/redisc/redistest"
 	"github.com/pborman/uuid"
@@ -74,3 +77,75 @@ func TestPubSub(t *testing.T) {
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
 }
+
+func TestPubSubPatternSyntax(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:          pool,
+		Dial:          pool.Dial,
+		LogFunc:       logIfVerbose,
+		PatternSyntax: broker.MQTTPatterns,
+	}
+
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "get PubSub connection")
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	var got []string
+	go func() {
+		defer wg.Done()
+		for ep := range psc.Events() {
+			got = append(got, ep.Pattern+" "+ep.Channel)
+		}
+	}()
+
+	// both patterns translate to the redis pattern "*"
+	require.NoError(t, psc.Subscribe("+", true), "Subscribe +")
+	require.NoError(t, psc.Subscribe("#", true), "Subscribe #")
+	time.Sleep(10 * time.Millisecond) // ensure time to process the subscriptions
+	for _, ch := range []string{"a", "a.b"} {
+		require.NoError(t, brk.Publish(ch, &message.PubPayload{MsgUUID: uuid.NewRandom()}), "Publish %s", ch)
+	}
+
+	time.Sleep(10 * time.Millisecond) // ensure time to pop the messages
+
+	// the redis pattern is still subscribed for "+"
+	require.NoError(t, psc.Unsubscribe("#", true), "Unsubscribe #")
+	require.NoError(t, brk.Publish("c", &message.PubPayload{MsgUUID: uuid.NewRandom()}), "Publish c")
+	require.NoError(t, brk.Publish("c.d", &message.PubPayload{MsgUUID: uuid.NewRandom()}), "Publish c.d")
+
+	time.Sleep(10 * time.Millisecond) // ensure time to pop the last message :(
+	require.NoError(t, psc.Close(), "close pubsub connection")
+	wg.Wait()
+	assert.ElementsMatch(t, []string{"+ a", "# a", "# a.b", "+ c"}, got, "got expected events")
+}
+
+func TestSendExpiredEvent(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	c := &pubSubConn{vars: vars, evch: make(chan *message.EvntPayload)}
+
+	raw := func(ts time.Time, ttl time.Duration) rawEvent {
+		b, err := json.Marshal(&message.PubPayload{MsgUUID: uuid.NewRandom(), Timestamp: ts, TTL: ttl})
+		require.NoError(t, err, "Marshal")
+		return rawEvent{channel: "a", data: b}
+	}
+
+	// nobody reads the events, so they expire before they are delivered
+	c.sendEvent(raw(time.Now().UTC().Add(-time.Second), time.Millisecond))
+	assert.Equal(t, "1", vars.Get("ExpiredEvents").String(), "already expired")
+	c.sendEvent(raw(time.Now().UTC(), 20*time.Millisecond))
+	assert.Equal(t, "2", vars.Get("ExpiredEvents").String(), "expired while waiting")
+
+	go c.sendEvent(raw(time.Now().UTC(), time.Minute))
+	select {
+	case ep := <-c.evch:
+		assert.Equal(t, time.Minute, ep.TTL, "TTL")
+	case <-time.After(time.Second):
+		require.Fail(t, "event not delivered")
+	}
+	assert.Equal(t, "2", vars.Get("ExpiredEvents").String(), "not expired")
+}
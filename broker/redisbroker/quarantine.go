@@ -0,0 +1,137 @@
+package redisbroker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ broker.QuarantineBroker = (*Broker)(nil)
+
+// FailuresTTL is the time-to-live of the failures recorded for a call
+// request. Failures of a call request that does not fail again for that
+// duration are forgotten, so that they are not considered consecutive.
+var FailuresTTL = time.Hour
+
+// DefaultDeadLetterCap is the default maximum number of call requests
+// kept in the dead-letter queue of a URI.
+var DefaultDeadLetterCap = 1000
+
+const (
+	// redis cluster-compliant keys, in the same slot as callKey
+	failuresKey   = "juggler:calls:failures:{%s}:%s" // 1: URI, 2: failure key
+	deadLetterKey = "juggler:calls:deadletter:{%s}"  // 1: URI
+)
+
+// script to increment the failures of a call request, setting the
+// expiration of the counter.
+var addFailureScript = redis.NewScript(1, `
+	local res = redis.call("INCR", KEYS[1])
+	redis.call("PEXPIRE", KEYS[1], tonumber(ARGV[1]))
+	return res
+`)
+
+// script to store the dead-letter payload and clear the failures,
+// trimming the dead-letter list to its most recent entries.
+var quarantineScript = redis.NewScript(2, `
+	redis.call("DEL", KEYS[1])
+	local res = redis.call("LPUSH", KEYS[2], ARGV[1])
+	local limit = tonumber(ARGV[2])
+	if limit > 0 and res > limit then
+		redis.call("LTRIM", KEYS[2], 0, limit - 1)
+	end
+	return res
+`)
+
+// AddFailure records a failure of the call request identified by key,
+// and returns the number of consecutive failures for that key.
+func (b *Broker) AddFailure(cp *message.CallPayload, key string) (int, error) {
+	k := fmt.Sprintf(failuresKey, cp.URI, key)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	return redis.Int(addFailureScript.Do(rc, k, int(FailuresTTL/time.Millisecond)))
+}
+
+// ResetFailures clears the failures recorded for the call request
+// identified by key.
+func (b *Broker) ResetFailures(cp *message.CallPayload, key string) error {
+	k := fmt.Sprintf(failuresKey, cp.URI, key)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	_, err := rc.Do("DEL", k)
+	return err
+}
+
+// Quarantine stores the call request in the dead-letter queue of its
+// URI, and clears its recorded failures. The oldest call requests of
+// the queue are dropped once it holds more than DeadLetterCap call
+// requests. The call request is acknowledged if it was delivered from a
+// stream.
+func (b *Broker) Quarantine(dl *message.DeadLetterPayload) error {
+	// dead letters are not compressed
+	p, err := payloadCodec{keys: b.Keys}.marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	k1 := fmt.Sprintf(failuresKey, dl.Call.URI, dl.Key)
+	k2 := fmt.Sprintf(deadLetterKey, dl.Call.URI)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	limit := b.DeadLetterCap
+	if limit == 0 {
+		limit = DefaultDeadLetterCap
+	}
+	n, err := redis.Int(quarantineScript.Do(rc, k1, k2, p, limit))
+	if err != nil {
+		return err
+	}
+	if b.Vars != nil {
+		b.Vars.Add("QuarantinedCalls", 1)
+		if limit > 0 && n > limit {
+			b.Vars.Add("DroppedDeadLetters", int64(n-limit))
+		}
+	}
+	b.ackStreamCall(dl.Call.MsgUUID)
+	return nil
+}
+
+// DeadLetters returns the call requests quarantined in the dead-letter
+// queue of the URI, most recent first.
+func (b *Broker) DeadLetters(uri string) ([]*message.DeadLetterPayload, error) {
+	k := fmt.Sprintf(deadLetterKey, uri)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	vals, err := redis.Values(rc.Do("LRANGE", k, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	dls := make([]*message.DeadLetterPayload, 0, len(vals))
+	for _, v := range vals {
+		p, err := redis.Bytes(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		var dl message.DeadLetterPayload
+		if err := b.codec().unmarshal(p, &dl); err != nil {
+			return nil, err
+		}
+		dls = append(dls, &dl)
+	}
+	return dls, nil
+}
@@ -0,0 +1,68 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuarantine(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	for i := 1; i <= 3; i++ {
+		n, err := brk.AddFailure(cp, "k")
+		require.NoError(t, err, "AddFailure %d", i)
+		assert.Equal(t, i, n, "failures after AddFailure %d", i)
+	}
+
+	require.NoError(t, brk.ResetFailures(cp, "k"), "ResetFailures")
+	n, err := brk.AddFailure(cp, "k")
+	require.NoError(t, err, "AddFailure after reset")
+	assert.Equal(t, 1, n, "failures after reset")
+
+	dl := &message.DeadLetterPayload{Call: cp, Key: "k", Failures: 1, Error: "boom", Timestamp: time.Now().UTC()}
+	require.NoError(t, brk.Quarantine(dl), "Quarantine")
+	n, err = brk.AddFailure(cp, "k")
+	require.NoError(t, err, "AddFailure after Quarantine")
+	assert.Equal(t, 1, n, "failures after Quarantine")
+
+	dls, err := brk.DeadLetters("a")
+	require.NoError(t, err, "DeadLetters")
+	if assert.Equal(t, 1, len(dls), "dead letters") {
+		assert.Equal(t, cp.MsgUUID, dls[0].Call.MsgUUID, "call")
+		assert.Equal(t, "boom", dls[0].Error, "error")
+	}
+
+	dls, err = brk.DeadLetters("b")
+	require.NoError(t, err, "DeadLetters for other URI")
+	assert.Equal(t, 0, len(dls), "no dead letters for other URI")
+
+	// the dead-letter queue keeps the most recent call requests
+	brk.DeadLetterCap = 2
+	var ids []string
+	for i := 0; i < 3; i++ {
+		cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "c"}
+		ids = append(ids, cp.MsgUUID.String())
+		require.NoError(t, brk.Quarantine(&message.DeadLetterPayload{Call: cp, Key: "k"}), "Quarantine %d", i)
+	}
+	dls, err = brk.DeadLetters("c")
+	require.NoError(t, err, "DeadLetters with a cap")
+	if assert.Equal(t, 2, len(dls), "dead letters with a cap") {
+		assert.Equal(t, ids[2], dls[0].Call.MsgUUID.String(), "most recent")
+		assert.Equal(t, ids[1], dls[1].Call.MsgUUID.String(), "second most recent")
+	}
+}
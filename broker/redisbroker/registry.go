@@ -0,0 +1,122 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ broker.RegistryBroker = (*Broker)(nil)
+
+const (
+	// redis cluster-compliant keys, in the same slot as callKey
+	registryKey     = "juggler:callees:live:{%s}" // 1: URI
+	registryInfoKey = "juggler:callees:info:{%s}" // 1: URI
+)
+
+// script to register or refresh a callee instance, scored by the
+// expiration time of its registration.
+var heartbeatScript = redis.NewScript(2, `
+	redis.call("ZADD", KEYS[1], tonumber(ARGV[2]), ARGV[1])
+	return redis.call("HSET", KEYS[2], ARGV[1], ARGV[3])
+`)
+
+// script to remove a callee instance.
+var unregisterScript = redis.NewScript(2, `
+	redis.call("ZREM", KEYS[1], ARGV[1])
+	return redis.call("HDEL", KEYS[2], ARGV[1])
+`)
+
+// script to remove the expired callee instances and return the info
+// of the live ones.
+var calleesScript = redis.NewScript(2, `
+	local expired = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+	if #expired > 0 then
+		redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+		redis.call("HDEL", KEYS[2], unpack(expired))
+	end
+	local live = redis.call("ZRANGEBYSCORE", KEYS[1], "(" .. ARGV[1], "+inf")
+	if #live == 0 then
+		return {}
+	end
+	return redis.call("HMGET", KEYS[2], unpack(live))
+`)
+
+// Heartbeat registers the callee instance for its URIs, or refreshes
+// its registration. The registration expires after ttl if it is not
+// refreshed. Expiration is based on the clock of the callee.
+func (b *Broker) Heartbeat(ci *message.CalleeInfo, ttl time.Duration) error {
+	p, err := json.Marshal(ci)
+	if err != nil {
+		return err
+	}
+
+	expires := unixMs(ci.Heartbeat.Add(ttl))
+	for _, uri := range ci.URIs {
+		if err := b.runRegistryScript(heartbeatScript, uri, ci.ID.String(), expires, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unregister removes the registration of the callee instance for its
+// URIs.
+func (b *Broker) Unregister(ci *message.CalleeInfo) error {
+	for _, uri := range ci.URIs {
+		if err := b.runRegistryScript(unregisterScript, uri, ci.ID.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Broker) runRegistryScript(script *redis.Script, uri string, args ...interface{}) error {
+	k1 := fmt.Sprintf(registryKey, uri)
+	k2 := fmt.Sprintf(registryInfoKey, uri)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	_, err := script.Do(rc, redis.Args{k1, k2}.Add(args...)...)
+	return err
+}
+
+// Callees returns the live callee instances registered for uri. The
+// expired registrations are removed. Expiration is checked against the
+// clock of the caller.
+func (b *Broker) Callees(uri string) ([]*message.CalleeInfo, error) {
+	k1 := fmt.Sprintf(registryKey, uri)
+	k2 := fmt.Sprintf(registryInfoKey, uri)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	vals, err := redis.Values(calleesScript.Do(rc, k1, k2, unixMs(time.Now())))
+	if err != nil {
+		return nil, err
+	}
+	cis := make([]*message.CalleeInfo, 0, len(vals))
+	for _, v := range vals {
+		if v == nil {
+			// registered without info, ignore
+			continue
+		}
+		p, err := redis.Bytes(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		var ci message.CalleeInfo
+		if err := json.Unmarshal(p, &ci); err != nil {
+			return nil, err
+		}
+		cis = append(cis, &ci)
+	}
+	return cis, nil
+}
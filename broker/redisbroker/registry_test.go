@@ -0,0 +1,56 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	cis, err := brk.Callees("a")
+	require.NoError(t, err, "Callees before Heartbeat")
+	assert.Equal(t, 0, len(cis), "no callee")
+
+	now := time.Now().UTC()
+	ci1 := &message.CalleeInfo{ID: uuid.NewRandom(), Hostname: "h1", URIs: []string{"a", "b"}, Heartbeat: now}
+	ci2 := &message.CalleeInfo{ID: uuid.NewRandom(), Hostname: "h2", URIs: []string{"a"}, Heartbeat: now}
+	ci3 := &message.CalleeInfo{ID: uuid.NewRandom(), Hostname: "h3", URIs: []string{"a"}, Heartbeat: now.Add(-time.Minute)}
+	require.NoError(t, brk.Heartbeat(ci1, time.Second), "Heartbeat 1")
+	require.NoError(t, brk.Heartbeat(ci2, time.Second), "Heartbeat 2")
+	require.NoError(t, brk.Heartbeat(ci3, time.Second), "Heartbeat expired")
+
+	cis, err = brk.Callees("a")
+	require.NoError(t, err, "Callees a")
+	hosts := make(map[string]bool)
+	for _, ci := range cis {
+		hosts[ci.Hostname] = true
+	}
+	assert.Equal(t, map[string]bool{"h1": true, "h2": true}, hosts, "live callees of a")
+
+	cis, err = brk.Callees("b")
+	require.NoError(t, err, "Callees b")
+	if assert.Equal(t, 1, len(cis), "live callees of b") {
+		assert.Equal(t, ci1.ID.String(), cis[0].ID.String(), "callee of b")
+		assert.Equal(t, []string{"a", "b"}, cis[0].URIs, "URIs of callee")
+	}
+
+	require.NoError(t, brk.Unregister(ci1), "Unregister")
+	cis, err = brk.Callees("b")
+	require.NoError(t, err, "Callees b after Unregister")
+	assert.Equal(t, 0, len(cis), "no callee of b after Unregister")
+}
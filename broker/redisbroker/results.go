@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/internal/uuidstr"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
@@ -21,6 +22,17 @@ type resultsConn struct {
 	timeout  time.Duration
 	logFn    func(string, ...interface{})
 	vars     *expvar.Map
+	codec    payloadCodec // of the stored results
+
+	// lease of the connection UUID, refreshed until done is closed.
+	leaseKey string
+	leaseTTL time.Duration
+	serverID string
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	// closeOnce makes sure the lease is released only once.
+	closeOnce sync.Once
 
 	// once makes sure only the first call to Results starts the goroutine.
 	once sync.Once
@@ -31,9 +43,59 @@ type resultsConn struct {
 	err   error
 }
 
-// Close closes the connection.
+// Close closes the connection and releases the lease on the connection
+// UUID, so that the results stored from then on for that connection fail
+// with broker.ErrCallerGone (see Broker.CheckLeases). The results not yet
+// received are deleted.
 func (c *resultsConn) Close() error {
-	return c.c.Close()
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+		err = c.c.Close()
+
+		key := fmt.Sprintf(resKey, uuidstr.String(c.connUUID))
+		rc := c.pool.Get()
+		defer rc.Close()
+		rc = clusterifyConn(rc, c.leaseKey, key)
+		if _, e := rc.Do("DEL", c.leaseKey, key); e != nil && err == nil {
+			err = e
+		}
+	})
+	return err
+}
+
+// setLease sets the lease on the connection UUID for this server.
+func (c *resultsConn) setLease() error {
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, c.leaseKey)
+
+	_, err := rc.Do("SET", c.leaseKey, c.serverID, "PX", int(c.leaseTTL/time.Millisecond))
+	return err
+}
+
+// refreshLease refreshes the lease at a third of its time-to-live until
+// the connection is closed, so that a failed refresh can be retried
+// before the lease expires.
+func (c *resultsConn) refreshLease() {
+	defer c.wg.Done()
+
+	t := time.NewTicker(c.leaseTTL / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if err := c.setLease(); err != nil {
+				if c.vars != nil {
+					c.vars.Add("FailedConnLeaseRefreshes", 1)
+				}
+				logf(c.logFn, "Results: failed to refresh lease of %v: %v", c.connUUID, err)
+			}
+		}
+	}
 }
 
 // ResultsErr returns the error that caused the Results channel to close.
@@ -51,7 +113,7 @@ func (c *resultsConn) Results() <-chan *message.ResPayload {
 		c.ch = make(chan *message.ResPayload)
 
 		// compute key and timeout
-		key := fmt.Sprintf(resKey, c.connUUID)
+		key := fmt.Sprintf(resKey, uuidstr.String(c.connUUID))
 		to := int(c.timeout / time.Second)
 
 		// make connection cluster-aware if running in a cluster
@@ -96,7 +158,7 @@ func (c *resultsConn) sendResult(v []interface{}, wg *sync.WaitGroup) {
 
 	// unmarshal the payload
 	var rp message.ResPayload
-	if err := unmarshalBRPOPValue(&rp, v); err != nil {
+	if err := unmarshalBRPOPValue(&rp, v, c.codec); err != nil {
 		if c.vars != nil {
 			c.vars.Add("FailedResPayloadUnmarshals", 1)
 		}
@@ -105,7 +167,7 @@ func (c *resultsConn) sendResult(v []interface{}, wg *sync.WaitGroup) {
 	}
 
 	// check if call is expired
-	k := fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
+	k := fmt.Sprintf(resTimeoutKey, uuidstr.String(rp.ConnUUID), rp.MsgUUID)
 
 	rc := c.pool.Get()
 	defer rc.Close()
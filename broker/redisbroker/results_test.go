@@ -1,12 +1,16 @@
 package redisbroker
 
 import (
+	"expvar"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/PuerkitoBio/juggler/broker"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -21,6 +25,7 @@ func TestResults(t *testing.T) {
 		Pool:            pool,
 		Dial:            pool.Dial,
 		BlockingTimeout: time.Second,
+		CheckLeases:     true,
 		LogFunc:         logIfVerbose,
 	}
 
@@ -54,10 +59,13 @@ func TestResults(t *testing.T) {
 	}
 	var expected []uuid.UUID
 	for i, c := range cases {
+		err := brk.Result(c.rp, c.timeout)
 		if c.exp {
 			expected = append(expected, c.rp.MsgUUID)
+			require.NoError(t, err, "Result %d", i)
+		} else {
+			assert.Equal(t, broker.ErrCallerGone, err, "Result %d", i)
 		}
-		require.NoError(t, brk.Result(c.rp, c.timeout), "Result %d", i)
 	}
 
 	time.Sleep(10 * time.Millisecond) // ensure time to pop the last message :(
@@ -68,3 +76,69 @@ func TestResults(t *testing.T) {
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
 }
+
+func TestResultsLease(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:         pool,
+		Dial:         pool.Dial,
+		ServerID:     "s1",
+		ConnLeaseTTL: 30 * time.Millisecond,
+		CheckLeases:  true,
+		LogFunc:      logIfVerbose,
+		Vars:         new(expvar.Map).Init(),
+	}
+
+	connUUID := uuid.NewRandom()
+	res, err := brk.NewResultsConn(connUUID)
+	require.NoError(t, err, "NewResultsConn")
+
+	// the lease is refreshed past its TTL
+	time.Sleep(100 * time.Millisecond)
+	id, err := brk.ConnServer(connUUID)
+	require.NoError(t, err, "ConnServer")
+	assert.Equal(t, "s1", id, "server of the connection")
+
+	rp := &message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Result(rp, 50*time.Millisecond), "Result")
+
+	// the list of results expires with its result
+	rc := pool.Get()
+	defer rc.Close()
+	pttl, err := redis.Int(rc.Do("PTTL", fmt.Sprintf(resKey, connUUID)))
+	require.NoError(t, err, "PTTL")
+	assert.True(t, pttl > 0 && pttl <= 50, "results list PTTL %d", pttl)
+
+	require.NoError(t, res.Close(), "Close")
+	id, err = brk.ConnServer(connUUID)
+	require.NoError(t, err, "ConnServer after Close")
+	assert.Equal(t, "", id, "no server after Close")
+	n, err := redis.Int(rc.Do("EXISTS", fmt.Sprintf(resKey, connUUID)))
+	require.NoError(t, err, "EXISTS")
+	assert.Equal(t, 0, n, "results deleted on Close")
+
+	rp.MsgUUID = uuid.NewRandom()
+	assert.Equal(t, broker.ErrCallerGone, brk.Result(rp, time.Second), "Result after Close")
+	assert.Equal(t, "1", brk.Vars.Get("OrphanedResults").String(), "OrphanedResults")
+
+	// without the check, the result is stored until it expires
+	brk.CheckLeases = false
+	rp.MsgUUID = uuid.NewRandom()
+	require.NoError(t, brk.Result(rp, time.Second), "Result without lease check")
+	n, err = redis.Int(rc.Do("LLEN", fmt.Sprintf(resKey, connUUID)))
+	require.NoError(t, err, "LLEN")
+	assert.Equal(t, 1, n, "result stored without lease check")
+
+	// a generated server ID is stable
+	brk2 := &Broker{Pool: pool, Dial: pool.Dial, LogFunc: logIfVerbose}
+	res2, err := brk2.NewResultsConn(connUUID)
+	require.NoError(t, err, "NewResultsConn")
+	defer res2.Close()
+	id, err = brk2.ConnServer(connUUID)
+	require.NoError(t, err, "ConnServer")
+	assert.Equal(t, brk2.serverID(), id, "generated server ID")
+	assert.NotEqual(t, "", id, "server ID generated")
+}
@@ -0,0 +1,43 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ broker.SchemaBroker = (*Broker)(nil)
+
+// redis cluster-compliant key, in the same slot as callKey
+const schemaKey = "juggler:schemas:{%s}" // 1: URI
+
+// RegisterSchema stores the schema document of uri, replacing any
+// existing one. The schema does not expire.
+func (b *Broker) RegisterSchema(uri string, doc json.RawMessage) error {
+	k := fmt.Sprintf(schemaKey, uri)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	_, err := rc.Do("SET", k, []byte(doc))
+	return err
+}
+
+// Schema returns the schema document of uri, or nil if no schema is
+// registered.
+func (b *Broker) Schema(uri string) (json.RawMessage, error) {
+	k := fmt.Sprintf(schemaKey, uri)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	doc, err := redis.Bytes(rc.Do("GET", k))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return doc, err
+}
@@ -0,0 +1,36 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	doc, err := brk.Schema("a")
+	require.NoError(t, err, "Schema before RegisterSchema")
+	assert.Nil(t, doc, "no schema")
+
+	require.NoError(t, brk.RegisterSchema("a", json.RawMessage(`{"args":{"type":"string"}}`)), "RegisterSchema")
+	require.NoError(t, brk.RegisterSchema("a", json.RawMessage(`{"args":{"type":"number"}}`)), "RegisterSchema again")
+	doc, err = brk.Schema("a")
+	require.NoError(t, err, "Schema")
+	assert.Equal(t, `{"args":{"type":"number"}}`, string(doc), "schema replaced")
+
+	doc, err = brk.Schema("b")
+	require.NoError(t, err, "Schema for other URI")
+	assert.Nil(t, doc, "no schema for other URI")
+}
@@ -0,0 +1,59 @@
+package redisbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/garyburd/redigo/redis"
+)
+
+// redis cluster-compliant key, in the slot of the channel's history
+const seqKey = "juggler:seq:{%s}" // 1: channel
+
+// script to increment the sequence number of the channel and publish
+// the event stamped with it. The payload is a JSON object without seq
+// field, the sequence number is inserted as its first field, as done
+// by stampSeq.
+var publishSeqScript = redis.NewScript(1, `
+	local seq = redis.call("INCR", KEYS[1])
+	redis.call("PUBLISH", ARGV[1], '{"seq":' .. seq .. ',' .. string.sub(ARGV[2], 2))
+	return seq
+`)
+
+// marshalPub returns the JSON encoding of the event pp to publish,
+// without its sequence number.
+func marshalPub(pp *message.PubPayload) ([]byte, error) {
+	if pp.Seq != 0 {
+		cp := *pp
+		cp.Seq = 0
+		pp = &cp
+	}
+	return json.Marshal(pp)
+}
+
+// publishSeq publishes the event p on channel with the next sequence
+// number of the channel, and returns that sequence number.
+func (b *Broker) publishSeq(channel string, p []byte) (uint64, error) {
+	k := fmt.Sprintf(seqKey, channel)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	seq, err := redis.Int64(publishSeqScript.Do(rc, k, channel, p))
+	return uint64(seq), err
+}
+
+// stampSeq returns the payload p published with the sequence number
+// seq, as stamped by the publish scripts.
+func stampSeq(p []byte, seq uint64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"seq":`)
+	buf.WriteString(strconv.FormatUint(seq, 10))
+	buf.WriteByte(',')
+	buf.Write(p[1:])
+	return buf.Bytes()
+}
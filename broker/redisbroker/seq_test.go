@@ -0,0 +1,82 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventSequence(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:          pool,
+		Dial:          pool.Dial,
+		LogFunc:       logIfVerbose,
+		HistoryCap:    10,
+		EventSequence: true,
+	}
+
+	newPub := func(i int) *message.PubPayload {
+		return &message.PubPayload{
+			MsgUUID:   uuid.NewRandom(),
+			Args:      json.RawMessage(strconv.Itoa(i)),
+			Timestamp: time.Now().UTC().Add(time.Duration(i) * time.Millisecond),
+			Seq:       99, // ignored
+		}
+	}
+	require.NoError(t, brk.Publish("a", newPub(1)), "Publish a")
+	require.NoError(t, brk.Publish("b", newPub(2)), "Publish b")
+	require.NoError(t, brk.Publish("a", newPub(3)), "Publish a")
+	require.NoError(t, brk.ExecBatch(&broker.Batch{Pubs: []broker.BatchPub{
+		{Channel: "a", Payload: newPub(4)},
+		{Channel: "a", Payload: newPub(5)},
+	}}), "ExecBatch")
+
+	evs, err := brk.History("a", time.Time{}, time.Time{}, 0)
+	require.NoError(t, err, "History a")
+	if assert.Equal(t, 4, len(evs), "events of a") {
+		for i, ev := range evs {
+			assert.Equal(t, uint64(i+1), ev.Seq, "%d: sequence number", i)
+		}
+		assert.Equal(t, "5", string(evs[3].Args), "args")
+	}
+
+	evs, err = brk.History("b", time.Time{}, time.Time{}, 0)
+	require.NoError(t, err, "History b")
+	if assert.Equal(t, 1, len(evs), "events of b") {
+		assert.Equal(t, uint64(1), evs[0].Seq, "sequence number of b")
+	}
+
+	// without sequence, the events are not stamped
+	brk.EventSequence = false
+	require.NoError(t, brk.Publish("c", newPub(6)), "Publish c")
+	evs, err = brk.History("c", time.Time{}, time.Time{}, 0)
+	require.NoError(t, err, "History c")
+	if assert.Equal(t, 1, len(evs), "events of c") {
+		assert.Equal(t, uint64(0), evs[0].Seq, "no sequence number")
+	}
+}
+
+func TestStampSeq(t *testing.T) {
+	p, err := marshalPub(&message.PubPayload{MsgUUID: uuid.NewRandom(), Args: json.RawMessage(`{"x":1}`), Seq: 3})
+	require.NoError(t, err, "marshalPub")
+
+	var pp message.PubPayload
+	require.NoError(t, json.Unmarshal(p, &pp), "Unmarshal")
+	assert.Equal(t, uint64(0), pp.Seq, "sequence number not marshaled")
+
+	require.NoError(t, json.Unmarshal(stampSeq(p, 42), &pp), "Unmarshal stamped")
+	assert.Equal(t, uint64(42), pp.Seq, "stamped sequence number")
+	assert.Equal(t, `{"x":1}`, string(pp.Args), "args")
+}
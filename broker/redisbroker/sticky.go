@@ -0,0 +1,70 @@
+package redisbroker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ broker.StickyBroker = (*Broker)(nil)
+
+// redis cluster-compliant key
+const stickyKey = "juggler:sticky:{%s}" // 1: identity
+
+// stickyMember returns the member of the sticky subscriptions set for
+// sub, prefixed so that a channel and a pattern with the same name are
+// distinct.
+func stickyMember(sub broker.Subscription) string {
+	if sub.Pattern {
+		return "p:" + sub.Channel
+	}
+	return "c:" + sub.Channel
+}
+
+// AddSticky adds the sticky subscription sub of identity.
+func (b *Broker) AddSticky(identity string, sub broker.Subscription) error {
+	return b.doSticky("SADD", identity, stickyMember(sub))
+}
+
+// RemoveSticky removes the sticky subscription sub of identity. The
+// set of the identity is deleted with its last subscription.
+func (b *Broker) RemoveSticky(identity string, sub broker.Subscription) error {
+	return b.doSticky("SREM", identity, stickyMember(sub))
+}
+
+func (b *Broker) doSticky(cmd, identity string, args ...interface{}) error {
+	k := fmt.Sprintf(stickyKey, identity)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	_, err := rc.Do(cmd, redis.Args{k}.Add(args...)...)
+	return err
+}
+
+// Sticky returns the sticky subscriptions of identity.
+func (b *Broker) Sticky(identity string) ([]broker.Subscription, error) {
+	k := fmt.Sprintf(stickyKey, identity)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	members, err := redis.Strings(rc.Do("SMEMBERS", k))
+	if err != nil {
+		return nil, err
+	}
+	subs := make([]broker.Subscription, 0, len(members))
+	for _, m := range members {
+		switch {
+		case strings.HasPrefix(m, "c:"):
+			subs = append(subs, broker.Subscription{Channel: m[2:]})
+		case strings.HasPrefix(m, "p:"):
+			subs = append(subs, broker.Subscription{Channel: m[2:], Pattern: true})
+		}
+	}
+	return subs, nil
+}
@@ -0,0 +1,46 @@
+package redisbroker
+
+import (
+	"testing"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSticky(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	subs, err := brk.Sticky("alice")
+	require.NoError(t, err, "Sticky without subscriptions")
+	assert.Equal(t, 0, len(subs), "no subscriptions")
+
+	a, ap := broker.Subscription{Channel: "a"}, broker.Subscription{Channel: "a", Pattern: true}
+	require.NoError(t, brk.AddSticky("alice", a), "AddSticky a")
+	require.NoError(t, brk.AddSticky("alice", a), "AddSticky a again")
+	require.NoError(t, brk.AddSticky("alice", ap), "AddSticky pattern a")
+	require.NoError(t, brk.AddSticky("bob", broker.Subscription{Channel: "b"}), "AddSticky bob")
+
+	subs, err = brk.Sticky("alice")
+	require.NoError(t, err, "Sticky")
+	assert.ElementsMatch(t, []broker.Subscription{a, ap}, subs, "channel and pattern")
+
+	require.NoError(t, brk.RemoveSticky("alice", a), "RemoveSticky")
+	require.NoError(t, brk.RemoveSticky("alice", broker.Subscription{Channel: "z"}), "RemoveSticky unknown")
+	subs, err = brk.Sticky("alice")
+	require.NoError(t, err, "Sticky after remove")
+	assert.Equal(t, []broker.Subscription{ap}, subs, "pattern left")
+
+	subs, err = brk.Sticky("bob")
+	require.NoError(t, err, "Sticky of bob")
+	assert.Equal(t, []broker.Subscription{{Channel: "b"}}, subs, "other identity")
+}
@@ -0,0 +1,459 @@
+package redisbroker
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/internal/uuidstr"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+// DefaultStreamClaimIdle is the default time after which a call request
+// delivered from a stream and not acknowledged is claimed by another
+// calls connection.
+var DefaultStreamClaimIdle = 2 * time.Minute
+
+const (
+	// redis cluster-compliant keys for the streams of round-robin calls,
+	// in the same slot as callKey
+	streamCallKey         = "juggler:calls:stream:{%s}"             // 1: URI
+	priorityStreamCallKey = "juggler:calls:stream:priority:{%s}:%d" // 1: URI, 2: priority
+
+	// consumer group of the calls connections on the streams
+	callsGroup = "juggler"
+
+	// field of the call payload in the stream entries
+	streamPayloadField = "p"
+
+	// maximum number of pending call requests claimed per XAUTOCLAIM
+	maxClaimedCalls = 100
+)
+
+// callStreamKey returns the key of the call requests stream for the URI
+// and priority.
+func callStreamKey(uri string, priority int) string {
+	if priority == 0 {
+		return fmt.Sprintf(streamCallKey, uri)
+	}
+	return fmt.Sprintf(priorityStreamCallKey, uri, priority)
+}
+
+// script to store the call request in the stream along with its
+// expiration information, if the stream is not full.
+var streamCallScript = redis.NewScript(2, `
+	local limit = tonumber(ARGV[3])
+	if limit > 0 and redis.call("XLEN", KEYS[2]) >= limit then
+		return redis.error_reply("stream capacity exceeded")
+	end
+	redis.call("SET", KEYS[1], ARGV[1], "PX", tonumber(ARGV[1]))
+	return redis.call("XADD", KEYS[2], "*", ARGV[4], ARGV[2])
+`)
+
+// script to acknowledge a call request delivered from a stream, remove
+// it from the stream and delete its expiration information.
+var ackStreamCallScript = redis.NewScript(2, `
+	local n = redis.call("XACK", KEYS[1], ARGV[1], ARGV[2])
+	redis.call("XDEL", KEYS[1], ARGV[2])
+	redis.call("DEL", KEYS[2])
+	return n
+`)
+
+func registerStreamCall(pool Pool, cp *message.CallPayload, timeout time.Duration, cap int, pc payloadCodec, k1, k2 string) error {
+	p, err := pc.marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	rc := pool.Get()
+	defer rc.Close()
+
+	// turn it into a cluster-aware RetryConn if running in a cluster
+	rc = clusterifyConn(rc, k1, k2)
+
+	_, err = streamCallScript.Do(rc,
+		k1,                 // key[1] : the SET key with expiration
+		k2,                 // key[2] : the STREAM key
+		timeoutMs(timeout), // argv[1] : the timeout in milliseconds
+		p,                  // argv[2] : the call payload
+		cap,                // argv[3] : the STREAM capacity
+		streamPayloadField, // argv[4] : the field of the payload
+	)
+	return err
+}
+
+// streamEntry is a call request read from a stream.
+type streamEntry struct {
+	key     string
+	id      string
+	payload []byte // nil if the entry was deleted from the stream
+}
+
+// ack acknowledges the entry and deletes the expiration key tk of its
+// call request, if tk is not empty.
+func (e streamEntry) ack(pool Pool, tk string, logFn func(string, ...interface{}), vars *expvar.Map) {
+	rc := pool.Get()
+	defer rc.Close()
+
+	var err error
+	if tk == "" {
+		rc = clusterifyConn(rc, e.key)
+		if _, err = rc.Do("XACK", e.key, callsGroup, e.id); err == nil {
+			_, err = rc.Do("XDEL", e.key, e.id)
+		}
+	} else {
+		rc = clusterifyConn(rc, e.key, tk)
+		_, err = ackStreamCallScript.Do(rc, e.key, tk, callsGroup, e.id)
+	}
+	if err != nil {
+		if vars != nil {
+			vars.Add("FailedCallAcks", 1)
+		}
+		logf(logFn, "Calls: failed to acknowledge call %s of stream %s: %v", e.id, e.key, err)
+		return
+	}
+	if vars != nil {
+		vars.Add("CallAcks", 1)
+	}
+}
+
+// pendingAck is a call request delivered from a stream, waiting to be
+// acknowledged.
+type pendingAck struct {
+	entry    streamEntry
+	tk       string // expiration key of the call request
+	deadline time.Time
+}
+
+// streamAcks tracks the call requests delivered from the streams by the
+// calls connections of a Broker until they are acknowledged. The
+// requests that are never acknowledged, e.g. because they expired
+// before their result was stored, are forgotten once they expire, and
+// removed from the stream when they are claimed.
+type streamAcks struct {
+	mu      sync.Mutex
+	pending map[string]pendingAck // by message UUID
+	pruneAt time.Time
+}
+
+func (a *streamAcks) add(msgUUID uuid.UUID, pa pendingAck) {
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending == nil {
+		a.pending = make(map[string]pendingAck)
+	}
+	if now.After(a.pruneAt) {
+		for k, v := range a.pending {
+			if now.After(v.deadline) {
+				delete(a.pending, k)
+			}
+		}
+		a.pruneAt = now.Add(time.Minute)
+	}
+	a.pending[uuidstr.String(msgUUID)] = pa
+}
+
+func (a *streamAcks) remove(msgUUID uuid.UUID) (pendingAck, bool) {
+	k := uuidstr.String(msgUUID)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pa, ok := a.pending[k]
+	if ok {
+		delete(a.pending, k)
+	}
+	return pa, ok
+}
+
+// ackStreamCall acknowledges the call request identified by msgUUID if
+// it was delivered from a stream by a calls connection of the Broker.
+func (b *Broker) ackStreamCall(msgUUID uuid.UUID) {
+	if pa, ok := b.acks.remove(msgUUID); ok {
+		pa.entry.ack(b.Pool, pa.tk, b.LogFunc, b.Vars)
+	}
+}
+
+// streamKeys returns the keys of the call streams of the connection's
+// URIs, highest priority first.
+func (c *callsConn) streamKeys() []string {
+	keys := make([]string, 0, (message.MaxPriority+1)*len(c.uris))
+	for p := message.MaxPriority; p >= 0; p-- {
+		for _, uri := range c.uris {
+			keys = append(keys, callStreamKey(uri, p))
+		}
+	}
+	return keys
+}
+
+// createGroups creates the consumer group of the streams, along with
+// the streams, if they don't exist.
+func createGroups(rc redis.Conn, keys []string) error {
+	for _, k := range keys {
+		_, err := rc.Do("XGROUP", "CREATE", k, callsGroup, "0", "MKSTREAM")
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollStreams reads the call requests of the streams as a consumer of
+// the group, and claims the pending requests that were not acknowledged
+// by their consumer for claimIdle, until the connection is closed.
+func (c *callsConn) pollStreams() {
+	keys := c.streamKeys()
+	consumer := uuidstr.String(c.id)
+	rc := clusterifyConn(c.sc, keys...)
+
+	// wait at most the poll interval so that the pending requests are
+	// claimed regularly.
+	block := c.pollInterval()
+	if c.timeout > 0 && c.timeout < block {
+		block = c.timeout
+	}
+	args := redis.Args{"GROUP", callsGroup, consumer, "COUNT", 1, "BLOCK", int(block / time.Millisecond), "STREAMS"}.AddFlat(keys)
+	for range keys {
+		args = args.Add(">")
+	}
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	if err := createGroups(rc, keys); err != nil {
+		c.setErr(err)
+		return
+	}
+
+	var claimAt time.Time
+	for {
+		if now := time.Now(); now.After(claimAt) {
+			for _, k := range keys {
+				if err := c.claimCalls(rc, k, consumer, &wg); err != nil {
+					c.setErr(err)
+					return
+				}
+			}
+			claimAt = now.Add(c.pollInterval())
+		}
+
+		c.acquirePending(c.streamPending)
+		v, err := rc.Do("XREADGROUP", args...)
+		if err != nil {
+			releasePending(c.streamPending)
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				// the stream was deleted, e.g. by Broker.Drain
+				if err = createGroups(rc, keys); err == nil {
+					continue
+				}
+			}
+			c.setErr(err)
+			return
+		}
+		if v == nil {
+			// no available value
+			releasePending(c.streamPending)
+			continue
+		}
+
+		streams, err := redis.Values(v, nil)
+		if err != nil {
+			releasePending(c.streamPending)
+			c.setErr(err)
+			return
+		}
+
+		// the first entry is counted before the read, the others (one
+		// per stream at most) once received.
+		counted := true
+		for _, s := range streams {
+			entries, err := parseStreamEntries(s)
+			if err != nil {
+				logf(c.logFn, "Calls: XREADGROUP returned an invalid reply: %v", err)
+				continue
+			}
+			for _, e := range entries {
+				if !counted {
+					c.acquirePending(c.streamPending)
+				}
+				counted = false
+				wg.Add(1)
+				go func(e streamEntry) {
+					defer releasePending(c.streamPending)
+					c.sendStreamCall(e, false, &wg)
+				}(e)
+			}
+		}
+		if counted {
+			releasePending(c.streamPending)
+		}
+	}
+}
+
+// claimCalls claims the call requests of the stream k that were pending
+// for at least claimIdle and sends them to the callee.
+func (c *callsConn) claimCalls(rc redis.Conn, k, consumer string, wg *sync.WaitGroup) error {
+	cursor := "0-0"
+	for {
+		vals, err := redis.Values(rc.Do("XAUTOCLAIM", k, callsGroup, consumer,
+			int(c.claimIdle/time.Millisecond), cursor, "COUNT", maxClaimedCalls))
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				return createGroups(rc, []string{k})
+			}
+			if c.vars != nil {
+				c.vars.Add("FailedCallClaims", 1)
+			}
+			// XAUTOCLAIM requires redis 6.2, a failure to claim the
+			// calls does not prevent the processing of new calls.
+			logf(c.logFn, "Calls: XAUTOCLAIM failed: %v", err)
+			return nil
+		}
+		if len(vals) < 2 {
+			return nil
+		}
+
+		cursor, err = redis.String(vals[0], nil)
+		if err != nil {
+			return err
+		}
+		entries, err := parseEntries(k, vals[1])
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if c.vars != nil {
+				c.vars.Add("ClaimedCalls", 1)
+			}
+			wg.Add(1)
+			go c.sendStreamCall(e, true, wg)
+		}
+		if cursor == "0-0" || len(entries) == 0 {
+			return nil
+		}
+	}
+}
+
+// parseStreamEntries parses a stream of the XREADGROUP reply, as
+// [key, [[id, [field, value, ...]], ...]].
+func parseStreamEntries(v interface{}) ([]streamEntry, error) {
+	vals, err := redis.Values(v, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) != 2 {
+		return nil, fmt.Errorf("unexpected stream reply of length %d", len(vals))
+	}
+	k, err := redis.String(vals[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseEntries(k, vals[1])
+}
+
+// parseEntries parses the entries of the stream k, as
+// [[id, [field, value, ...]], ...]. The fields are nil for the
+// entries that were deleted from the stream.
+func parseEntries(k string, v interface{}) ([]streamEntry, error) {
+	vals, err := redis.Values(v, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, len(vals))
+	for _, ev := range vals {
+		evs, err := redis.Values(ev, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(evs) != 2 {
+			return nil, fmt.Errorf("unexpected entry reply of length %d", len(evs))
+		}
+		e := streamEntry{key: k}
+		if e.id, err = redis.String(evs[0], nil); err != nil {
+			return nil, err
+		}
+		if evs[1] != nil {
+			fields, err := redis.ByteSlices(evs[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i+1 < len(fields); i += 2 {
+				if string(fields[i]) == streamPayloadField {
+					e.payload = fields[i+1]
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// sendStreamCall sends the call request of the stream entry e to the
+// callee, if it did not expire. The call requests that are claimed
+// have already been delivered once, so they are not retried when they
+// expire.
+func (c *callsConn) sendStreamCall(e streamEntry, claimed bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var cp message.CallPayload
+	if e.payload == nil {
+		// the entry was acknowledged and deleted in the meantime
+		e.ack(c.pool, "", c.logFn, c.vars)
+		return
+	}
+	if err := c.codec.unmarshal(e.payload, &cp); err != nil {
+		if c.vars != nil {
+			c.vars.Add("FailedCallPayloadUnmarshals", 1)
+		}
+		logf(c.logFn, "Calls: XREADGROUP failed to unmarshal call payload: %v", err)
+		e.ack(c.pool, "", c.logFn, c.vars)
+		return
+	}
+
+	// the expiration key is kept until the call is acknowledged, so
+	// that a claimed call can be delivered again if it did not expire.
+	tk := fmt.Sprintf(callTimeoutKey, queueURI(&cp), cp.MsgUUID)
+	rc := c.pool.Get()
+	rc = clusterifyConn(rc, tk)
+	pttl, err := redis.Int(rc.Do("PTTL", tk))
+	rc.Close()
+	if err != nil {
+		if c.vars != nil {
+			c.vars.Add("FailedPTTLCalls", 1)
+		}
+		logf(c.logFn, "Calls: PTTL failed: %v", err)
+		return
+	}
+	if pttl <= 0 {
+		if c.vars != nil {
+			c.vars.Add("ExpiredCalls", 1)
+		}
+		e.ack(c.pool, tk, c.logFn, c.vars)
+		if !claimed && cp.CanRetry() {
+			logf(c.logFn, "Calls: message %v expired, retrying call", cp.MsgUUID)
+			if err := retryCall(c.pool, &cp, c.callCap, c.codec, true, c.vars); err != nil {
+				logf(c.logFn, "Calls: retry of message %v failed: %v", cp.MsgUUID, err)
+			}
+			return
+		}
+		logf(c.logFn, "Calls: message %v expired, dropping call", cp.MsgUUID)
+		return
+	}
+
+	if cp.Attempt == 0 {
+		cp.Attempt = 1
+	}
+	cp.ReadTimestamp = time.Now().UTC()
+	cp.TTLAfterRead = time.Duration(pttl) * time.Millisecond
+	c.acks.add(cp.MsgUUID, pendingAck{entry: e, tk: tk, deadline: time.Now().Add(cp.TTLAfterRead)})
+	c.ch <- &cp
+	if c.vars != nil {
+		c.vars.Add("Calls", 1)
+	}
+}
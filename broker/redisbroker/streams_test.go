@@ -0,0 +1,113 @@
+package redisbroker
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStreamCallsKey(t *testing.T) {
+	ck, ok := parseCallsKey("juggler:calls:stream:{a.b}")
+	if assert.True(t, ok, "stream key") {
+		assert.Equal(t, &callsKey{key: "juggler:calls:stream:{a.b}", uri: "a.b", stream: true}, ck, "stream key")
+	}
+	ck, ok = parseCallsKey("juggler:calls:stream:priority:{a}:2")
+	if assert.True(t, ok, "priority stream key") {
+		assert.Equal(t, &callsKey{key: "juggler:calls:stream:priority:{a}:2", uri: "a", priority: 2, stream: true}, ck, "priority stream key")
+	}
+	_, ok = parseCallsKey("juggler:calls:stream:scheduled:{a}")
+	assert.False(t, ok, "stream scheduled key")
+	_, ok = parseCallsKey("juggler:calls:stream:{a}:c1")
+	assert.False(t, ok, "stream callee key")
+}
+
+func TestCallStreams(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	vars := new(expvar.Map).Init()
+	brk := &Broker{
+		Pool:                 pool,
+		Dial:                 pool.Dial,
+		BlockingTimeout:      100 * time.Millisecond,
+		SchedulePollInterval: 50 * time.Millisecond,
+		CallStreams:          true,
+		StreamClaimIdle:      200 * time.Millisecond,
+		LogFunc:              logIfVerbose,
+		Vars:                 vars,
+	}
+
+	cc1, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn 1")
+	defer cc1.Close()
+	ch1 := cc1.Calls()
+
+	cp1 := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp1, time.Minute), "Call 1")
+
+	rc := pool.Get()
+	defer rc.Close()
+	n, err := redis.Int(rc.Do("XLEN", callStreamKey("a", 0)))
+	require.NoError(t, err, "XLEN")
+	assert.Equal(t, 1, n, "call stored in the stream")
+	n, err = redis.Int(rc.Do("LLEN", callListKey("a", 0)))
+	require.NoError(t, err, "LLEN")
+	assert.Equal(t, 0, n, "call not stored in the list")
+
+	select {
+	case cp := <-ch1:
+		assert.Equal(t, cp1.MsgUUID, cp.MsgUUID, "call 1 received")
+		assert.Equal(t, 1, cp.Attempt, "attempt")
+	case <-time.After(time.Second):
+		require.Fail(t, "call 1 not received")
+	}
+
+	qis, err := brk.Queues()
+	require.NoError(t, err, "Queues")
+	assert.Equal(t, []*QueueInfo{{URI: "a", InFlight: 1}}, qis, "call 1 in flight")
+
+	// storing the result acknowledges the call
+	res, err := brk.NewResultsConn(cp1.ConnUUID)
+	require.NoError(t, err, "NewResultsConn")
+	defer res.Close()
+	require.NoError(t, brk.Result(&message.ResPayload{ConnUUID: cp1.ConnUUID, MsgUUID: cp1.MsgUUID, URI: "a"}, time.Minute), "Result 1")
+	n, err = redis.Int(rc.Do("XLEN", callStreamKey("a", 0)))
+	require.NoError(t, err, "XLEN after result")
+	assert.Equal(t, 0, n, "call removed from the stream")
+	assert.Equal(t, "1", vars.Get("CallAcks").String(), "CallAcks")
+
+	// a call delivered to a callee that dies is claimed by another one
+	require.NoError(t, cc1.Close(), "Close 1")
+	for range ch1 {
+	}
+
+	cp2 := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", MaxAttempts: 2}
+	require.NoError(t, brk.Call(cp2, time.Minute), "Call 2")
+	_, err = rc.Do("XREADGROUP", "GROUP", callsGroup, "dead", "COUNT", 1, "STREAMS", callStreamKey("a", 0), ">")
+	require.NoError(t, err, "XREADGROUP")
+
+	cc2, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn 2")
+	defer cc2.Close()
+
+	var claimed *message.CallPayload
+	select {
+	case claimed = <-cc2.Calls():
+		assert.Equal(t, cp2.MsgUUID, claimed.MsgUUID, "call 2 claimed")
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "call 2 not claimed")
+	}
+	assert.Equal(t, "1", vars.Get("ClaimedCalls").String(), "ClaimedCalls")
+
+	// the retry acknowledges the claimed call
+	require.NoError(t, brk.Retry(claimed), "Retry 2")
+	assert.Equal(t, "2", vars.Get("CallAcks").String(), "CallAcks after retry")
+}
@@ -0,0 +1,156 @@
+package juggler
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+var cacheable = struct {
+	sync.RWMutex
+	uris map[string]time.Duration
+}{}
+
+// SetCacheableURIs sets the URIs of the pure or read-only functions
+// whose results can be cached, with the time-to-live of the cached
+// results. It replaces the URIs previously set, and a nil map disables
+// caching. It is safe to call concurrently, and it applies to all
+// servers.
+//
+// The cache is only used if the Server's CallerBroker implements
+// broker.CacheBroker. When a CALL is received for a cacheable URI, the
+// server looks up the result of a call with the same arguments in the
+// cache and sends it immediately if found, without going through the
+// callees. Otherwise, the result is cached when it is received, unless
+// it is an error result (see message.ErrResult). Arguments are compared
+// byte for byte, so the same arguments encoded differently are cached
+// separately.
+func SetCacheableURIs(uris map[string]time.Duration) {
+	m := make(map[string]time.Duration, len(uris))
+	for uri, ttl := range uris {
+		if ttl > 0 {
+			m[uri] = ttl
+		}
+	}
+
+	cacheable.Lock()
+	cacheable.uris = m
+	cacheable.Unlock()
+}
+
+// cacheFor returns the cache broker and time-to-live to use for the
+// results of calls to uri, or a nil broker if the results of uri are
+// not cached.
+func (srv *Server) cacheFor(uri string) (broker.CacheBroker, time.Duration) {
+	cacheable.RLock()
+	ttl := cacheable.uris[uri]
+	cacheable.RUnlock()
+	if ttl <= 0 {
+		return nil, 0
+	}
+
+	cb, ok := srv.CallerBroker.(broker.CacheBroker)
+	if !ok {
+		return nil, 0
+	}
+	return cb, ttl
+}
+
+// resultCacheKey returns the cache key of a call with the arguments.
+func resultCacheKey(args json.RawMessage) string {
+	h := sha1.Sum(args)
+	return hex.EncodeToString(h[:])
+}
+
+// pendingCache is a call whose result must be cached once received.
+type pendingCache struct {
+	cb      broker.CacheBroker
+	uri     string
+	key     string
+	ttl     time.Duration
+	expires time.Time // when the call can no longer return a result
+}
+
+// addPendingCache registers the call so that its result is cached when
+// received on the connection.
+func (c *Conn) addPendingCache(m *message.Call, cb broker.CacheBroker, key string, ttl time.Duration) {
+	now := time.Now()
+	pc := &pendingCache{
+		cb:      cb,
+		uri:     message.VersionedURI(m.Payload.URI, m.Payload.Version),
+		key:     key,
+		ttl:     ttl,
+		expires: now.Add(CallWait(m)),
+	}
+
+	c.cachemu.Lock()
+	defer c.cachemu.Unlock()
+
+	if c.cachePending == nil {
+		c.cachePending = make(map[string]*pendingCache)
+	}
+	// drop the calls that expired without a result
+	for id, pc := range c.cachePending {
+		if now.After(pc.expires) {
+			delete(c.cachePending, id)
+		}
+	}
+	c.cachePending[m.UUID().String()] = pc
+}
+
+// removePendingCache removes the call from the pending calls and
+// returns it, or nil if it was not pending.
+func (c *Conn) removePendingCache(id string) *pendingCache {
+	c.cachemu.Lock()
+	defer c.cachemu.Unlock()
+
+	pc := c.cachePending[id]
+	delete(c.cachePending, id)
+	return pc
+}
+
+// cacheResult caches the result if it is for a pending cacheable call.
+func (c *Conn) cacheResult(res *message.ResPayload) {
+	pc := c.removePendingCache(res.MsgUUID.String())
+	// binary results are not cached, the cache only stores the arguments
+	if pc == nil || res.ContentType != "" || isErrResult(res.Args) {
+		return
+	}
+
+	if err := pc.cb.CacheResult(pc.uri, pc.key, res.Args, pc.ttl); err != nil {
+		if c.srv.Vars != nil {
+			c.srv.Vars.Add("FailedCacheStores", 1)
+		}
+		return
+	}
+	if c.srv.Vars != nil {
+		c.srv.Vars.Add("CacheStores", 1)
+	}
+}
+
+// CallWait returns the maximum time to wait for the result of the call,
+// taking all attempts into account (see message.TotalWait). No result
+// can be received for the call once that delay has elapsed.
+func CallWait(m *message.Call) time.Duration {
+	timeout := m.Payload.Timeout
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	return message.TotalWait(timeout, m.Payload.Backoff, m.Payload.MaxAttempts)
+}
+
+func isErrResult(args json.RawMessage) bool {
+	var v struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(args, &v); err != nil {
+		// not an object, cannot be an error result
+		return false
+	}
+	return v.Error != nil
+}
@@ -0,0 +1,97 @@
+package juggler
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCacheBroker struct {
+	broker.CallerBroker
+	cached map[string]json.RawMessage
+}
+
+func (f *fakeCacheBroker) CachedResult(uri, key string) (json.RawMessage, error) {
+	return f.cached[uri+":"+key], nil
+}
+
+func (f *fakeCacheBroker) CacheResult(uri, key string, result json.RawMessage, ttl time.Duration) error {
+	f.cached[uri+":"+key] = result
+	return nil
+}
+
+func TestCacheFor(t *testing.T) {
+	defer SetCacheableURIs(nil)
+
+	cb := &fakeCacheBroker{cached: make(map[string]json.RawMessage)}
+	srv := &Server{CallerBroker: cb}
+	SetCacheableURIs(map[string]time.Duration{"a": time.Second, "b": 0})
+
+	got, ttl := srv.cacheFor("a")
+	assert.Equal(t, cb, got, "cacheable URI")
+	assert.Equal(t, time.Second, ttl, "cacheable URI TTL")
+	got, _ = srv.cacheFor("b")
+	assert.Nil(t, got, "URI with no TTL")
+	got, _ = srv.cacheFor("c")
+	assert.Nil(t, got, "URI not cacheable")
+
+	srv.CallerBroker = cb.CallerBroker
+	got, _ = srv.cacheFor("a")
+	assert.Nil(t, got, "broker without cache")
+}
+
+func TestCacheResult(t *testing.T) {
+	cb := &fakeCacheBroker{cached: make(map[string]json.RawMessage)}
+	conn := newConn(&websocket.Conn{}, &Server{})
+
+	m1, err := message.NewCall("a", 1, time.Second)
+	require.NoError(t, err, "NewCall")
+	m2, err := message.NewCall("a", 2, time.Second)
+	require.NoError(t, err, "NewCall")
+	m3, err := message.NewCall("a", 3, time.Second)
+	require.NoError(t, err, "NewCall")
+
+	conn.addPendingCache(m1, cb, "k1", time.Second)
+	conn.addPendingCache(m2, cb, "k2", time.Second)
+	conn.addPendingCache(m3, cb, "k3", time.Second)
+	conn.removePendingCache(m3.UUID().String())
+
+	conn.cacheResult(&message.ResPayload{MsgUUID: m1.UUID(), URI: "a", Args: json.RawMessage(`{"x":1}`)})
+	conn.cacheResult(&message.ResPayload{MsgUUID: m2.UUID(), URI: "a", Args: json.RawMessage(`{"error":{"message":"boom"}}`)})
+	conn.cacheResult(&message.ResPayload{MsgUUID: m3.UUID(), URI: "a", Args: json.RawMessage(`3`)})
+	conn.cacheResult(&message.ResPayload{MsgUUID: uuid.NewRandom(), URI: "a", Args: json.RawMessage(`4`)})
+
+	assert.Equal(t, map[string]json.RawMessage{"a:k1": json.RawMessage(`{"x":1}`)}, cb.cached, "cached results")
+	assert.Equal(t, 0, len(conn.cachePending), "no pending call")
+}
+
+func TestCallWait(t *testing.T) {
+	m, err := message.NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	assert.Equal(t, time.Second, CallWait(m), "single attempt")
+
+	m.Payload.MaxAttempts = 3
+	m.Payload.Backoff = 100 * time.Millisecond
+	assert.Equal(t, 3300*time.Millisecond, CallWait(m), "3 attempts")
+
+	m.Payload.Timeout = 0
+	m.Payload.MaxAttempts = 0
+	assert.Equal(t, broker.DefaultCallTimeout, CallWait(m), "default timeout")
+
+	// the waits that overflow are clamped
+	m.Payload.Timeout = time.Second
+	m.Payload.MaxAttempts = 200
+	assert.Equal(t, time.Duration(math.MaxInt64), CallWait(m), "200 attempts")
+	m.Payload.MaxAttempts = 1 << 30
+	assert.Equal(t, time.Duration(math.MaxInt64), CallWait(m), "1<<30 attempts")
+	m.Payload.Backoff = 0
+	assert.Equal(t, time.Duration(1<<30)*time.Second, CallWait(m), "1<<30 attempts without backoff")
+}
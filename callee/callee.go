@@ -5,25 +5,102 @@
 package callee
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/juggler/broker"
 	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
 )
 
+// DefaultHeartbeatInterval is the default interval at which the
+// registration of a callee instance is refreshed.
+var DefaultHeartbeatInterval = 10 * time.Second
+
 // ErrCallExpired is returned when a call is processed but the
 // call timeout is exceeded, meaning that the client is no longer
 // expecting the result. The result is dropped and this error is
 // returned from InvokeAndStoreResult.
 var ErrCallExpired = errors.New("juggler/callee: call expired")
 
+// ErrCallRetried is returned from InvokeAndStoreResult when the
+// call failed with a retryable error and the next attempt of the
+// call was registered in the broker. No result is stored.
+var ErrCallRetried = errors.New("juggler/callee: call retried")
+
+// ErrCallQuarantined is returned from InvokeAndStoreResult when the
+// call failed too many consecutive times and was quarantined in the
+// dead-letter queue. The error result is stored, but the call is not
+// retried.
+var ErrCallQuarantined = errors.New("juggler/callee: call quarantined")
+
+// ErrCallPanicked is returned from InvokeAndStoreResult when the Thunk
+// panicked, the panic was recovered (see Callee.RecoverPanics) and a
+// *PanicError was stored as the error result of the call.
+var ErrCallPanicked = errors.New("juggler/callee: call panicked")
+
+// ErrCallRelocated is stored as the error result of a signed call
+// request whose URI is not the URI signed by the caller, nor a rewrite
+// of it allowed by Callee.SignedURIRewrite, e.g. because the broker
+// moved it to another URI.
+var ErrCallRelocated = errors.New("juggler/callee: signed call relocated to another URI")
+
+// PanicError is the error of a call whose Thunk panicked, when panics
+// are recovered (see Callee.RecoverPanics). Its message is stored as
+// the error result of the call, without the stack trace.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+// Error returns the error message for the PanicError.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("juggler/callee: call panicked: %v", e.Value)
+}
+
+// Retryable wraps err so that, when it is returned by a Thunk, the
+// call is attempted again if it has attempts left (see
+// message.CallPayload.MaxAttempts). Once all attempts have failed,
+// err is stored as the result of the call.
+func Retryable(err error) error {
+	return retryableError{err}
+}
+
+type retryableError struct {
+	error
+}
+
+// Result is the result of a call with headers. A Thunk returns a
+// *Result instead of the value of the result to set the headers of the
+// RES message sent to the caller, e.g. to send back the trace ID of the
+// call (see message.ResPayload.Headers). The headers of the call request
+// are in message.CallPayload.Headers.
+type Result struct {
+	// Value is the value of the result.
+	Value interface{}
+
+	// Headers is the headers of the result.
+	Headers message.Headers
+}
+
 // Thunk is the function signature for functions that handle calls
 // to a URI. Generally, it should be used to decode the arguments
 // to the type expected by the actual underlying function, call that
 // strongly-typed function, and transfer the results back in the
-// generic empty interface.
+// generic empty interface. A long-running function should stop when
+// the context returned by CallContext is done.
 type Thunk func(*message.CallPayload) (interface{}, error)
 
 // Callee is a peer that handles call requests for some URIs.
@@ -34,68 +111,527 @@ type Callee struct {
 	// Broker is the callee broker to use to listen for call requests
 	// and to store results.
 	Broker broker.CalleeBroker
+
+	// Quarantine is the broker to use to track the consecutive failures
+	// of call requests, and to quarantine the call requests that keep
+	// failing. Failures are not tracked if it is nil or if MaxFailures
+	// is 0.
+	Quarantine broker.QuarantineBroker
+
+	// MaxFailures is the number of consecutive failures (including
+	// panics) of a call request after which it is quarantined.
+	MaxFailures int
+
+	// FailureKey returns the key that identifies a call request to
+	// track its failures, e.g. an idempotency key extracted from the
+	// arguments. If nil, a hash of the URI and arguments is used.
+	FailureKey func(*message.CallPayload) string
+
+	// Registry is the broker to use to register the callee instance as
+	// live for its URIs, so that servers can reject the calls for which
+	// no callee is available. The instance is not registered if it is
+	// nil.
+	Registry broker.RegistryBroker
+
+	// Routing is the list of routing modes of the call requests that
+	// the callee accepts (see message.RoutingMode), recorded in its
+	// registration so that the servers that check for live callees
+	// reject the others (see juggler.Server.CheckCallees). All routing
+	// modes are accepted if it is empty.
+	Routing []message.RoutingMode
+
+	// Events is the broker to use to publish the registration and the
+	// unregistration of the callee instance on message.CalleesChannel.
+	// They are not published if it is nil.
+	Events broker.PubSubBroker
+
+	// HeartbeatInterval is the interval at which the registration of
+	// the callee instance is refreshed. The registration expires after
+	// 3 intervals without heartbeat. If 0, DefaultHeartbeatInterval is
+	// used.
+	HeartbeatInterval time.Duration
+
+	// Codecs is the codec to use per URI to decode the arguments of the
+	// calls with DecodeArgs and to encode their results. By default,
+	// message.JSON is used. Error results are always encoded as JSON.
+	// The results are stored with the content type of their codec (see
+	// message.ContentType).
+	Codecs message.Codecs
+
+	// RecoverPanics recovers the panics of the Thunks, so that a
+	// *PanicError is stored as the error result of the call and the
+	// caller gets it instead of waiting for the call to expire. The
+	// panicking calls are not retried. If false, panics are propagated.
+	RecoverPanics bool
+
+	// PanicHook is called with the call request and the error of each
+	// recovered panic, e.g. to report it to an error tracker. It is
+	// called before the error result is stored.
+	PanicHook func(*message.CallPayload, *PanicError)
+
+	// Verifier, if set, verifies the signature of the arguments of the
+	// call requests (see message.VerifyCall). The requests that are not
+	// signed or whose signature is invalid are not processed, the error
+	// is stored as their result.
+	Verifier message.Verifier
+
+	// SignedURIRewrite, if set, returns true if the servers may rewrite
+	// the URI signed by the caller to the URI of the call request (see
+	// message.CallPayload.SignedURI), e.g. with the tenant of the caller
+	// or with the rewrite rules of the servers. If nil, or if it returns
+	// false, the signed call requests whose SignedURI differs from their
+	// URI are rejected with ErrCallRelocated when Verifier is set.
+	SignedURIRewrite func(signedURI, uri string) bool
+
+	// ShedExpired sheds the call requests whose timeout is elapsed when
+	// they are about to be processed, e.g. after waiting behind slow
+	// calls, instead of processing them for a result that would be
+	// dropped. InvokeAndStoreResult returns ErrCallShed for those.
+	ShedExpired bool
+
+	// MaxQueueAge, if set, sheds the call requests that have waited
+	// longer than MaxQueueAge since the server received them (see
+	// message.CallPayload.Timestamp) when they are about to be
+	// processed. As their caller still waits, ErrCallShed is stored as
+	// their error result so that it gets it without waiting for the
+	// timeout, and InvokeAndStoreResult returns ErrCallShed.
+	MaxQueueAge time.Duration
+
+	// Vars can be set to an *expvar.Map to collect metrics about the
+	// callee (see doc/metrics.md).
+	Vars *expvar.Map
+
+	// Workers is the number of goroutines that process the call
+	// requests in Listen, for the URIs that are not in MaxConcurrency.
+	// If 0, a single goroutine is used.
+	Workers int
+
+	// MaxConcurrency is the maximum number of calls processed
+	// concurrently by Listen, by URI as in the keys of the Thunks, e.g.
+	// to cap an expensive URI independently of Workers. Those URIs are
+	// listened on their own calls connection, so that their excess call
+	// requests are left to the other callees. They remain in the broker
+	// if it limits the calls received by a connection and not taken yet
+	// (e.g. redisbroker.Broker.MaxPendingCalls).
+	MaxConcurrency map[string]int
+
+	// LogFunc is the function used to log the stack traces of the
+	// recovered panics and the signature verification failures. If nil,
+	// the standard logger is used.
+	LogFunc func(string, ...interface{})
+
+	mu       sync.Mutex
+	services map[string]Thunk         // registered with RegisterService, by URI
+	conns    map[broker.CallsConn]int // served by Listen and Serve, with the number of loops
+	draining bool                     // set by Drain
+	loops    sync.WaitGroup           // running Listen and Serve loops
+}
+
+// DecodeArgs decodes the arguments of the call request into v, using
+// the codec of its URI.
+func (c *Callee) DecodeArgs(cp *message.CallPayload, v interface{}) error {
+	return c.Codecs.Codec(cp.URI).Decode(cp.Args, v)
+}
+
+// CallContext returns a context that is done when the call request cp
+// expires, either because its time-to-live once read is elapsed or
+// because the deadline of the caller is reached (see
+// message.CallPayload.Deadline), so that a Thunk stops working on a
+// call whose result would be dropped. The cancel function must be
+// called once the call is processed.
+func CallContext(cp *message.CallPayload) (context.Context, context.CancelFunc) {
+	deadline, ok := callDeadline(cp)
+	if !ok {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// callDeadline returns the time at which the call request cp expires,
+// the earliest of its time-to-live and the deadline of the caller, or
+// false if it has neither.
+func callDeadline(cp *message.CallPayload) (time.Time, bool) {
+	deadline := cp.Deadline
+	if cp.TTLAfterRead > 0 {
+		read := cp.ReadTimestamp
+		if read.IsZero() {
+			read = time.Now()
+		}
+		if d := read.Add(cp.TTLAfterRead); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return deadline, !deadline.IsZero()
 }
 
 // InvokeAndStoreResult processes the provided call payload by calling
 // fn and storing the result so that it can be sent back to the caller.
 // If the call timeout is exceeded, the result is dropped and
-// ErrCallExpired is returned.
+// ErrCallExpired is returned. A call whose caller's deadline is already
+// reached is not processed and ErrCallExpired is returned, and a call
+// that waited too long is shed and ErrCallShed is returned (see
+// Callee.ShedExpired and Callee.MaxQueueAge). If the connection of the caller is not
+// served anymore, the result is dropped and broker.ErrCallerGone is
+// returned. If fn returns an error wrapped with Retryable and the call
+// has attempts left, the next attempt is registered and ErrCallRetried
+// is returned. The stored result reports the time the call waited in
+// the broker and the time spent in fn (see message.Timing).
+//
+// If failures are tracked (see Callee.Quarantine), a call that fails or
+// panics MaxFailures consecutive times is quarantined instead of being
+// retried, and ErrCallQuarantined is returned. Panics are propagated
+// once the failure is recorded, unless Callee.RecoverPanics is set, in
+// which case the error result is stored and ErrCallPanicked is returned.
 func (c *Callee) InvokeAndStoreResult(cp *message.CallPayload, fn Thunk) error {
 	ttl := cp.TTLAfterRead
 	start := time.Now()
+	if !cp.Deadline.IsZero() && !start.Before(cp.Deadline) {
+		return ErrCallExpired
+	}
+	if c.shed(cp, start) {
+		return ErrCallShed
+	}
+	remaining := func() time.Duration {
+		remain := ttl - time.Now().Sub(start)
+		if !cp.Deadline.IsZero() {
+			if left := cp.Deadline.Sub(time.Now()); left < remain {
+				remain = left
+			}
+		}
+		return remain
+	}
+
+	var key string
+	if c.Quarantine != nil && c.MaxFailures > 0 {
+		key = c.failureKey(cp)
+		defer func() {
+			if e := recover(); e != nil {
+				c.addFailure(cp, key, fmt.Sprint(e), string(debug.Stack()))
+				panic(e)
+			}
+		}()
+	}
 
-	v, err := fn(cp)
-	if remain := ttl - time.Now().Sub(start); remain > 0 {
+	v, err := c.invoke(cp, fn)
+	pe, panicked := err.(*PanicError)
+	if key != "" {
+		if err != nil {
+			errMsg, stack := err.Error(), ""
+			if panicked {
+				errMsg, stack = fmt.Sprint(pe.Value), string(pe.Stack)
+			}
+			if c.addFailure(cp, key, errMsg, stack) {
+				if re, ok := err.(retryableError); ok {
+					err = re.error
+				}
+				if remain := remaining(); remain > 0 {
+					c.storeResult(cp, v, err, time.Now().Sub(start), remain)
+				}
+				return ErrCallQuarantined
+			}
+		} else if err := c.Quarantine.ResetFailures(cp, key); err != nil {
+			// the call succeeded, its result is stored anyway
+			if c.Vars != nil {
+				c.Vars.Add("FailedFailureResets", 1)
+			}
+			c.logf("juggler/callee: failed to reset the failures of call %v to %s: %v", cp.MsgUUID, cp.URI, err)
+		}
+	}
+
+	if re, ok := err.(retryableError); ok {
+		if cp.CanRetry() {
+			if err := c.Broker.Retry(cp); err != nil {
+				return err
+			}
+			return ErrCallRetried
+		}
+		err = re.error
+	}
+	if remain := remaining(); remain > 0 {
 		// register the result
-		return c.storeResult(cp, v, err, remain)
+		if err := c.storeResult(cp, v, err, time.Now().Sub(start), remain); err != nil {
+			return err
+		}
+		if panicked {
+			return ErrCallPanicked
+		}
+		return nil
 	}
 	return ErrCallExpired
 }
 
+// invoke calls fn, returning the panic as a *PanicError if panics are
+// recovered.
+func (c *Callee) invoke(cp *message.CallPayload, fn Thunk) (v interface{}, err error) {
+	if c.Verifier != nil {
+		err := message.VerifyCall(c.Verifier, cp)
+		if err == nil && cp.SignedURI != "" && cp.SignedURI != cp.URI &&
+			(c.SignedURIRewrite == nil || !c.SignedURIRewrite(cp.SignedURI, cp.URI)) {
+			err = ErrCallRelocated
+		}
+		if err != nil {
+			c.logf("juggler/callee: call %v to %s rejected: %v", cp.MsgUUID, cp.URI, err)
+			return nil, err
+		}
+	}
+	if c.RecoverPanics {
+		defer func() {
+			if e := recover(); e != nil {
+				pe := &PanicError{Value: e, Stack: debug.Stack()}
+				c.logf("juggler/callee: call %v to %s panicked: %v\n%s", cp.MsgUUID, cp.URI, e, pe.Stack)
+				if c.PanicHook != nil {
+					c.PanicHook(cp, pe)
+				}
+				v, err = nil, pe
+			}
+		}()
+	}
+	return fn(cp)
+}
+
+func (c *Callee) logf(f string, args ...interface{}) {
+	if c.LogFunc != nil {
+		c.LogFunc(f, args...)
+		return
+	}
+	log.Printf(f, args...)
+}
+
 // Listen is a helper method that listens for call requests for the
 // requested URIs and calls the corresponding Thunk to execute the
 // request. The m map has URIs as keys, and the associated Thunk
-// function as value. If a redis cluster is used, all URIs in m
-// must belong to the same hash slot.
+// function as value. A key can be a URI pattern, e.g. "billing.*",
+// whose Thunk is called for the requests routed to the pattern, with
+// the concrete URI in the call payload. A key can also be a versioned
+// URI (see message.VersionedURI), e.g. "billing.charge@2", to serve
+// the calls that request that version. The URIs of the services
+// registered with RegisterService are served too, unless m has the
+// same URI. If a redis cluster is used, all URIs must belong to the
+// same hash slot.
 //
-// The method implements a single-producer, single-consumer helper,
+// The method implements a single-producer, multiple-consumer helper,
 // where a single redis connection is used to listen for call requests
-// on the URIs, and for each request, a single goroutine executes
-// the calls and stores the results. If there's an error when storing
-// the result, that error is ignored and the next request is processed.
-// More advanced concurrency patterns and error handling can be
-// implemented using Callee.Broker.Calls directly, and starting multiple
-// consumer goroutines reading from the same calls channel and calling
+// on the URIs, and Workers goroutines (one by default) execute the
+// calls and store the results. The URIs of MaxConcurrency are listened
+// on their own connection, with as many goroutines as their limit. If
+// there's an error when storing the result, that error is ignored and
+// the next request is processed. Serve can be called by multiple goroutines to process the call
+// requests of a connection concurrently. More advanced concurrency
+// patterns and error handling can be implemented using
+// Callee.Broker.Calls directly, and starting multiple consumer
+// goroutines reading from the same calls channel and calling
 // InvokeAndStoreResult to process each call request.
 //
 // The function blocks until the call request loop exits. It returns
 // the error that caused the loop to stop, or the error to initiate
-// the connection to the broker.
+// the connection to the broker. It returns nil once the callee is
+// drained (see Drain).
 func (c *Callee) Listen(m map[string]Thunk) error {
+	thunks := c.Thunks()
+	for uri, fn := range m {
+		thunks[uri] = fn
+	}
+	m = thunks
 	if len(m) == 0 {
 		return nil
 	}
 
+	// the URIs with a concurrency limit are listened on their own
+	// connection, by as many loops as their limit.
 	uris := make([]string, 0, len(m))
+	var shared []string
+	var conns []broker.CallsConn
+	var loops []int
 	for k := range m {
 		uris = append(uris, k)
+		if n := c.MaxConcurrency[k]; n > 0 {
+			conn, err := c.Broker.NewCallsConn(k)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conns, loops = append(conns, conn), append(loops, n)
+			continue
+		}
+		shared = append(shared, k)
+	}
+	if len(shared) > 0 {
+		conn, err := c.Broker.NewCallsConn(shared...)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		n := c.Workers
+		if n <= 0 {
+			n = 1
+		}
+		conns, loops = append(conns, conn), append(loops, n)
+	}
+
+	if c.Registry != nil {
+		unregister, err := c.Register(uris...)
+		if err != nil {
+			return err
+		}
+		defer unregister()
+	}
+
+	// the first loop that stops closes all connections, so that all
+	// loops stop.
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	for i, conn := range conns {
+		wg.Add(loops[i])
+		for j := 0; j < loops[i]; j++ {
+			go func(conn broker.CallsConn) {
+				defer wg.Done()
+				err := c.Serve(conn, m)
+				once.Do(func() {
+					first = err
+					for _, conn := range conns {
+						conn.Close()
+					}
+				})
+			}(conn)
+		}
+	}
+	wg.Wait()
+	return first
+}
+
+// Register registers the callee instance as live for the URIs in
+// Registry, and refreshes the registration every HeartbeatInterval
+// until the returned function is called, which unregisters the
+// instance. Listen calls it automatically if Registry is set. Errors
+// to refresh the registration are ignored, the registration expires
+// if the heartbeats keep failing. The registration and unregistration
+// are published with Events, if set, and the errors to publish them
+// are ignored.
+func (c *Callee) Register(uris ...string) (func(), error) {
+	host, _ := os.Hostname()
+	ci := &message.CalleeInfo{
+		ID:        message.NewID(),
+		Hostname:  host,
+		URIs:      uris,
+		Routing:   c.Routing,
+		Heartbeat: time.Now().UTC(),
+	}
+
+	interval := c.HeartbeatInterval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	ttl := 3 * interval
+	if err := c.Registry.Heartbeat(ci, ttl); err != nil {
+		return nil, err
+	}
+	c.publishCallee(message.CalleeRegisteredEvent, ci)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+
+			cpy := *ci
+			cpy.Heartbeat = time.Now().UTC()
+			c.Registry.Heartbeat(&cpy, ttl)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+			c.Registry.Unregister(ci)
+			c.publishCallee(message.CalleeUnregisteredEvent, ci)
+		})
+	}, nil
+}
+
+// publishCallee publishes the event of the callee instance ci on the
+// callees system channel, if Events is set.
+func (c *Callee) publishCallee(event string, ci *message.CalleeInfo) {
+	if c.Events == nil {
+		return
 	}
-	conn, err := c.Broker.NewCallsConn(uris...)
+	now := time.Now().UTC()
+	b, err := json.Marshal(&message.SystemEvent{Event: event, Callee: ci, Timestamp: now})
 	if err != nil {
-		return err
+		return
 	}
-	defer conn.Close()
+	c.Events.Publish(message.CalleesChannel, &message.PubPayload{MsgUUID: message.NewID(), Args: b, Timestamp: now})
+}
 
-	for cp := range conn.Calls() {
-		// errors are ignored, use InvokeAndStoreResult directly to handle them.
-		c.InvokeAndStoreResult(cp, m[cp.URI])
+func (c *Callee) failureKey(cp *message.CallPayload) string {
+	if c.FailureKey != nil {
+		return c.FailureKey(cp)
 	}
-	return conn.CallsErr()
+	h := sha1.New()
+	h.Write([]byte(cp.URI))
+	h.Write([]byte{0})
+	h.Write(cp.Args)
+	return hex.EncodeToString(h.Sum(nil))
 }
 
-func (c *Callee) storeResult(cp *message.CallPayload, v interface{}, e error, timeout time.Duration) error {
+// addFailure records a failure of the call request, and quarantines
+// it if it has reached MaxFailures consecutive failures. It returns
+// true if the call was quarantined.
+func (c *Callee) addFailure(cp *message.CallPayload, key, msg, stack string) bool {
+	n, err := c.Quarantine.AddFailure(cp, key)
+	if err != nil {
+		if c.Vars != nil {
+			c.Vars.Add("FailedFailureRecords", 1)
+		}
+		c.logf("juggler/callee: failed to record the failure of call %v to %s: %v", cp.MsgUUID, cp.URI, err)
+		return false
+	}
+	if n < c.MaxFailures {
+		return false
+	}
+
+	dl := &message.DeadLetterPayload{
+		Call:      cp,
+		Key:       key,
+		Failures:  n,
+		Error:     msg,
+		Stack:     stack,
+		Timestamp: time.Now().UTC(),
+	}
+	if err := c.Quarantine.Quarantine(dl); err != nil {
+		if c.Vars != nil {
+			c.Vars.Add("FailedQuarantines", 1)
+		}
+		c.logf("juggler/callee: failed to quarantine call %v to %s: %v", cp.MsgUUID, cp.URI, err)
+		return false
+	}
+	return true
+}
+
+// storeResult stores the result v or the error e of the call, that took
+// handler to process, for the timeout.
+func (c *Callee) storeResult(cp *message.CallPayload, v interface{}, e error, handler, timeout time.Duration) error {
+	var headers message.Headers
+	if r, ok := v.(*Result); ok {
+		v, headers = r.Value, r.Headers
+	}
+
 	// if there's an error, that's what gets stored
+	codec := c.Codecs.Codec(cp.URI)
 	if e != nil {
+		codec = message.JSON
 		if ms, ok := e.(json.Marshaler); ok {
 			v = ms
 		} else {
@@ -105,16 +641,19 @@ func (c *Callee) storeResult(cp *message.CallPayload, v interface{}, e error, ti
 		}
 	}
 
-	b, err := json.Marshal(v)
+	b, err := codec.Encode(v)
 	if err != nil {
 		return err
 	}
 
 	rp := &message.ResPayload{
-		ConnUUID: cp.ConnUUID,
-		MsgUUID:  cp.MsgUUID,
-		URI:      cp.URI,
-		Args:     b,
+		ConnUUID:    cp.ConnUUID,
+		MsgUUID:     cp.MsgUUID,
+		URI:         cp.URI,
+		Args:        b,
+		ContentType: message.ContentType(codec),
+		Headers:     headers,
+		Timing:      &message.Timing{QueueWait: cp.QueueWait(), Handler: handler},
 	}
 	return c.Broker.Result(rp, timeout)
 }
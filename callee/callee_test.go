@@ -2,7 +2,10 @@ package callee
 
 import (
 	"encoding/json"
+	"expvar"
+	"fmt"
 	"io"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,9 +17,10 @@ import (
 )
 
 type mockCalleeBroker struct {
-	cps []*message.CallPayload
-	err error
-	rps []*message.ResPayload
+	cps     []*message.CallPayload
+	err     error
+	rps     []*message.ResPayload
+	retries []*message.CallPayload
 }
 
 func (b *mockCalleeBroker) Result(rp *message.ResPayload, timeout time.Duration) error {
@@ -24,10 +28,88 @@ func (b *mockCalleeBroker) Result(rp *message.ResPayload, timeout time.Duration)
 	return nil
 }
 
+func (b *mockCalleeBroker) Retry(cp *message.CallPayload) error {
+	b.retries = append(b.retries, cp)
+	return nil
+}
+
 func (b *mockCalleeBroker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
 	return &mockCallsConn{cps: b.cps, err: b.err}, nil
 }
 
+type mockQuarantineBroker struct {
+	failures map[string]int
+	dls      []*message.DeadLetterPayload
+	err      error
+}
+
+func (b *mockQuarantineBroker) AddFailure(cp *message.CallPayload, key string) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.failures[key]++
+	return b.failures[key], nil
+}
+
+func (b *mockQuarantineBroker) ResetFailures(cp *message.CallPayload, key string) error {
+	if b.err != nil {
+		return b.err
+	}
+	delete(b.failures, key)
+	return nil
+}
+
+func (b *mockQuarantineBroker) Quarantine(dl *message.DeadLetterPayload) error {
+	delete(b.failures, dl.Key)
+	b.dls = append(b.dls, dl)
+	return nil
+}
+
+type mockRegistryBroker struct {
+	mu         sync.Mutex
+	heartbeats []*message.CalleeInfo
+	unregister []*message.CalleeInfo
+}
+
+func (b *mockRegistryBroker) Heartbeat(ci *message.CalleeInfo, ttl time.Duration) error {
+	b.mu.Lock()
+	b.heartbeats = append(b.heartbeats, ci)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *mockRegistryBroker) Unregister(ci *message.CalleeInfo) error {
+	b.mu.Lock()
+	b.unregister = append(b.unregister, ci)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *mockRegistryBroker) Callees(uri string) ([]*message.CalleeInfo, error) {
+	return nil, nil
+}
+
+type mockPubSubBroker struct {
+	mu     sync.Mutex
+	events []*message.SystemEvent
+}
+
+func (b *mockPubSubBroker) NewPubSubConn() (broker.PubSubConn, error) { return nil, nil }
+
+func (b *mockPubSubBroker) Publish(channel string, pp *message.PubPayload) error {
+	var ev message.SystemEvent
+	if err := json.Unmarshal(pp.Args, &ev); err != nil {
+		return err
+	}
+	if channel != message.CalleesChannel {
+		return fmt.Errorf("unexpected channel %s", channel)
+	}
+	b.mu.Lock()
+	b.events = append(b.events, &ev)
+	b.mu.Unlock()
+	return nil
+}
+
 type mockCallsConn struct {
 	cps []*message.CallPayload
 	err error
@@ -87,5 +169,459 @@ func TestCallee(t *testing.T) {
 	})
 
 	assert.Equal(t, io.EOF, err, "Listen returns expected error")
+	for i, rp := range brk.rps {
+		// the handler duration varies, see TestCalleeResultTiming
+		assert.NotNil(t, rp.Timing, "%d: result timing", i)
+		rp.Timing = nil
+	}
 	assert.Equal(t, exp, brk.rps, "got expected results")
 }
+
+func TestCalleeResultHeaders(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk}
+
+	thunk := func(cp *message.CallPayload) (interface{}, error) {
+		return &Result{Value: 1, Headers: message.Headers{"server-timing": "1"}}, nil
+	}
+	cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second}
+	require.NoError(t, cle.InvokeAndStoreResult(cp, thunk), "InvokeAndStoreResult")
+	if assert.Equal(t, 1, len(brk.rps), "result stored") {
+		assert.Equal(t, `1`, string(brk.rps[0].Args), "result value")
+		assert.Equal(t, message.Headers{"server-timing": "1"}, brk.rps[0].Headers, "result headers")
+	}
+}
+
+func TestCalleeResultTiming(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk}
+
+	thunk := func(cp *message.CallPayload) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return 1, nil
+	}
+	now := time.Now().UTC()
+	cp := &message.CallPayload{
+		MsgUUID:          uuid.NewRandom(),
+		URI:              "a",
+		TTLAfterRead:     time.Second,
+		EnqueueTimestamp: now.Add(-time.Second),
+		ReadTimestamp:    now,
+	}
+	require.NoError(t, cle.InvokeAndStoreResult(cp, thunk), "InvokeAndStoreResult")
+	if assert.Equal(t, 1, len(brk.rps), "result stored") {
+		tm := brk.rps[0].Timing
+		if assert.NotNil(t, tm, "result timing") {
+			assert.Equal(t, time.Second, tm.QueueWait, "queue wait")
+			assert.True(t, tm.Handler >= 10*time.Millisecond && tm.Handler < time.Second, "handler duration %v", tm.Handler)
+		}
+	}
+}
+
+func TestCalleeDeadline(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk}
+
+	// the caller gave up on the call, it is not processed
+	var invoked bool
+	thunk := func(cp *message.CallPayload) (interface{}, error) {
+		invoked = true
+		return "ok", nil
+	}
+	cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second, Deadline: time.Now().Add(-time.Millisecond)}
+	assert.Equal(t, ErrCallExpired, cle.InvokeAndStoreResult(cp, thunk), "expired call")
+	assert.False(t, invoked, "expired call invoked")
+	assert.Equal(t, 0, len(brk.rps), "expired call result")
+
+	// the context is done at the deadline of the caller, before its TTL
+	cp = &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second, Deadline: time.Now().Add(10 * time.Millisecond)}
+	thunk = func(cp *message.CallPayload) (interface{}, error) {
+		ctx, cancel := CallContext(cp)
+		defer cancel()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return "ok", nil
+		}
+	}
+	assert.Equal(t, ErrCallExpired, cle.InvokeAndStoreResult(cp, thunk), "call past deadline")
+	assert.Equal(t, 0, len(brk.rps), "call past deadline result")
+
+	// the context is done at the TTL, before the deadline of the caller
+	cp = &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: 10 * time.Millisecond, ReadTimestamp: time.Now().UTC(), Deadline: time.Now().Add(time.Minute)}
+	ctx, cancel := CallContext(cp)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok && deadline.Equal(cp.ReadTimestamp.Add(cp.TTLAfterRead)), "TTL deadline")
+
+	ctx, cancel = CallContext(&message.CallPayload{})
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok, "no deadline")
+}
+
+func TestCalleeRetry(t *testing.T) {
+	cuid := uuid.NewRandom()
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk}
+
+	retryThunk := func(cp *message.CallPayload) (interface{}, error) {
+		return nil, Retryable(io.ErrUnexpectedEOF)
+	}
+
+	// has attempts left, gets retried
+	cp := &message.CallPayload{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second, MaxAttempts: 2, Attempt: 1}
+	assert.Equal(t, ErrCallRetried, cle.InvokeAndStoreResult(cp, retryThunk), "first attempt is retried")
+	assert.Equal(t, []*message.CallPayload{cp}, brk.retries, "retry registered")
+	assert.Equal(t, 0, len(brk.rps), "no result stored")
+
+	// last attempt, stores the unwrapped error
+	cp = &message.CallPayload{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second, MaxAttempts: 2, Attempt: 2}
+	assert.NoError(t, cle.InvokeAndStoreResult(cp, retryThunk), "last attempt stores the result")
+	assert.Equal(t, 1, len(brk.retries), "no retry registered")
+	if assert.Equal(t, 1, len(brk.rps), "result stored") {
+		var er message.ErrResult
+		require.NoError(t, json.Unmarshal(brk.rps[0].Args, &er), "unmarshal ErrResult")
+		assert.Equal(t, io.ErrUnexpectedEOF.Error(), er.Error.Message, "error is stored")
+	}
+}
+
+func TestCalleeQuarantine(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	qb := &mockQuarantineBroker{failures: make(map[string]int)}
+	cle := &Callee{Broker: brk, Quarantine: qb, MaxFailures: 2}
+
+	retryThunk := func(cp *message.CallPayload) (interface{}, error) {
+		return nil, Retryable(io.ErrUnexpectedEOF)
+	}
+	panicThunk := func(cp *message.CallPayload) (interface{}, error) {
+		panic("boom")
+	}
+	newCall := func(uri string) *message.CallPayload {
+		return &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: uri,
+			Args: json.RawMessage(`"x"`), TTLAfterRead: time.Second, MaxAttempts: 5, Attempt: 1}
+	}
+
+	// first failure is retried, second is quarantined
+	assert.Equal(t, ErrCallRetried, cle.InvokeAndStoreResult(newCall("a"), retryThunk), "first failure")
+	assert.Equal(t, ErrCallQuarantined, cle.InvokeAndStoreResult(newCall("a"), retryThunk), "second failure")
+	assert.Equal(t, 1, len(brk.retries), "retried once")
+	assert.Equal(t, 1, len(brk.rps), "error result stored")
+	if assert.Equal(t, 1, len(qb.dls), "quarantined") {
+		assert.Equal(t, 2, qb.dls[0].Failures, "failures")
+		assert.Equal(t, io.ErrUnexpectedEOF.Error(), qb.dls[0].Error, "error")
+	}
+
+	// success resets the failures
+	assert.Equal(t, ErrCallRetried, cle.InvokeAndStoreResult(newCall("b"), retryThunk), "failure")
+	assert.NoError(t, cle.InvokeAndStoreResult(newCall("b"), okThunk), "success")
+	assert.Equal(t, 0, len(qb.failures), "failures reset")
+
+	// panics are counted and propagated
+	assert.Panics(t, func() { cle.InvokeAndStoreResult(newCall("c"), panicThunk) }, "first panic")
+	assert.Panics(t, func() { cle.InvokeAndStoreResult(newCall("c"), panicThunk) }, "second panic")
+	if assert.Equal(t, 2, len(qb.dls), "panic quarantined") {
+		assert.Equal(t, "boom", qb.dls[1].Error, "panic value")
+		assert.NotEmpty(t, qb.dls[1].Stack, "stack trace")
+	}
+
+	// custom failure key, different calls share the same key
+	cle.FailureKey = func(cp *message.CallPayload) string { return "same" }
+	assert.Equal(t, ErrCallRetried, cle.InvokeAndStoreResult(newCall("d"), retryThunk), "first failure with key")
+	assert.Equal(t, ErrCallQuarantined, cle.InvokeAndStoreResult(newCall("e"), retryThunk), "second failure with key")
+	if assert.Equal(t, 3, len(qb.dls), "quarantined with key") {
+		assert.Equal(t, "same", qb.dls[2].Key, "failure key")
+	}
+
+	// broker errors are counted, the result of a success is stored anyway
+	vars := new(expvar.Map).Init()
+	cle.Vars = vars
+	qb.err = io.ErrClosedPipe
+	nrps := len(brk.rps)
+	assert.NoError(t, cle.InvokeAndStoreResult(newCall("f"), okThunk), "success with failed reset")
+	assert.Equal(t, nrps+1, len(brk.rps), "result stored")
+	assert.Equal(t, ErrCallRetried, cle.InvokeAndStoreResult(newCall("f"), retryThunk), "failure with failed record")
+	assert.Equal(t, "1", vars.Get("FailedFailureResets").String(), "FailedFailureResets")
+	assert.Equal(t, "1", vars.Get("FailedFailureRecords").String(), "FailedFailureRecords")
+}
+
+func TestCalleeRecoverPanics(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	qb := &mockQuarantineBroker{failures: make(map[string]int)}
+	var logs []string
+	var hooked []*PanicError
+	cle := &Callee{
+		Broker:        brk,
+		Quarantine:    qb,
+		MaxFailures:   2,
+		RecoverPanics: true,
+		PanicHook: func(cp *message.CallPayload, pe *PanicError) {
+			hooked = append(hooked, pe)
+		},
+		LogFunc: func(f string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(f, args...))
+		},
+	}
+
+	panicThunk := func(cp *message.CallPayload) (interface{}, error) {
+		panic("boom")
+	}
+	newCall := func() *message.CallPayload {
+		return &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a",
+			Args: json.RawMessage(`"x"`), TTLAfterRead: time.Second, MaxAttempts: 5, Attempt: 1}
+	}
+
+	// the panic is stored as error result, and not retried
+	assert.Equal(t, ErrCallPanicked, cle.InvokeAndStoreResult(newCall(), panicThunk), "first panic")
+	assert.Equal(t, 0, len(brk.retries), "not retried")
+	if assert.Equal(t, 1, len(brk.rps), "error result stored") {
+		assert.Equal(t, `{"error":{"message":"juggler/callee: call panicked: boom"}}`, string(brk.rps[0].Args), "error result")
+	}
+	if assert.Equal(t, 1, len(hooked), "hook called") {
+		assert.Equal(t, "boom", hooked[0].Value, "panic value")
+		assert.NotEmpty(t, hooked[0].Stack, "stack trace")
+	}
+	if assert.Equal(t, 1, len(logs), "stack trace logged") {
+		assert.Contains(t, logs[0], "panicked: boom", "log message")
+		assert.Contains(t, logs[0], "TestCalleeRecoverPanics", "logged stack trace")
+	}
+
+	// recovered panics are still counted as failures
+	assert.Equal(t, ErrCallQuarantined, cle.InvokeAndStoreResult(newCall(), panicThunk), "second panic")
+	assert.Equal(t, 2, len(brk.rps), "error result stored when quarantined")
+	if assert.Equal(t, 1, len(qb.dls), "panic quarantined") {
+		assert.Equal(t, "boom", qb.dls[0].Error, "panic value")
+		assert.NotEmpty(t, qb.dls[0].Stack, "stack trace")
+	}
+}
+
+func TestCalleeVerifier(t *testing.T) {
+	keys := &message.HMACKeys{Current: "k1", Keys: map[string][]byte{"k1": []byte("secret")}}
+	signed := func(args string) *message.CallPayload {
+		cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "ok", Args: json.RawMessage(args), TTLAfterRead: time.Second}
+		sig, err := keys.Sign(message.SignedData(cp.MsgUUID, cp.URI, "", cp.ContentType, cp.Args))
+		require.NoError(t, err, "Sign")
+		cp.Signature = sig
+		return cp
+	}
+
+	tampered := signed(`1`)
+	tampered.Args = json.RawMessage(`2`)
+	brk := &mockCalleeBroker{
+		cps: []*message.CallPayload{
+			signed(`1`),
+			tampered,
+			{MsgUUID: uuid.NewRandom(), URI: "ok", Args: json.RawMessage(`1`), TTLAfterRead: time.Second},
+		},
+		err: io.EOF,
+	}
+
+	var logs []string
+	cle := &Callee{Broker: brk, Verifier: keys, LogFunc: func(f string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(f, args...))
+	}}
+	err := cle.Listen(map[string]Thunk{"ok": okThunk})
+	assert.Equal(t, io.EOF, err, "Listen returns expected error")
+
+	if assert.Equal(t, 3, len(brk.rps), "results") {
+		assert.Equal(t, `"ok"`, string(brk.rps[0].Args), "signed call")
+		var er message.ErrResult
+		require.NoError(t, json.Unmarshal(brk.rps[1].Args, &er), "Unmarshal tampered")
+		assert.Equal(t, message.ErrInvalidSignature.Error(), er.Error.Message, "tampered call")
+		require.NoError(t, json.Unmarshal(brk.rps[2].Args, &er), "Unmarshal unsigned")
+		assert.Equal(t, message.ErrMissingSignature.Error(), er.Error.Message, "unsigned call")
+	}
+	assert.Equal(t, 2, len(logs), "logged rejections")
+}
+
+func TestCalleeSignedURIRewrite(t *testing.T) {
+	keys := &message.HMACKeys{Current: "k1", Keys: map[string][]byte{"k1": []byte("secret")}}
+	signed := func(signedURI, uri string) *message.CallPayload {
+		cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: uri, SignedURI: signedURI, Args: json.RawMessage(`1`), TTLAfterRead: time.Second}
+		sig, err := keys.Sign(message.SignedData(cp.MsgUUID, signedURI, "", cp.ContentType, cp.Args))
+		require.NoError(t, err, "Sign")
+		cp.Signature = sig
+		return cp
+	}
+
+	brk := &mockCalleeBroker{
+		cps: []*message.CallPayload{
+			// rewritten by a server with the tenant of the caller
+			signed("billing.read", "acme/billing.read"),
+			// relocated by the broker to another URI
+			signed("billing.read", "billing.delete"),
+		},
+		err: io.EOF,
+	}
+	cle := &Callee{Broker: brk, Verifier: keys, LogFunc: func(string, ...interface{}) {},
+		SignedURIRewrite: func(signedURI, uri string) bool {
+			_, name := message.SplitTenant(uri)
+			return name == signedURI
+		}}
+	err := cle.Listen(map[string]Thunk{"acme/billing.read": okThunk, "billing.delete": okThunk})
+	assert.Equal(t, io.EOF, err, "Listen returns expected error")
+
+	if assert.Equal(t, 2, len(brk.rps), "results") {
+		assert.Equal(t, `"ok"`, string(brk.rps[0].Args), "rewritten call")
+		var er message.ErrResult
+		require.NoError(t, json.Unmarshal(brk.rps[1].Args, &er), "Unmarshal relocated")
+		assert.Equal(t, ErrCallRelocated.Error(), er.Error.Message, "relocated call")
+	}
+
+	// without the hook, the rewritten calls are rejected too
+	brk = &mockCalleeBroker{cps: []*message.CallPayload{signed("billing.read", "acme/billing.read")}, err: io.EOF}
+	cle = &Callee{Broker: brk, Verifier: keys, LogFunc: func(string, ...interface{}) {}}
+	assert.Equal(t, io.EOF, cle.Listen(map[string]Thunk{"acme/billing.read": okThunk}), "Listen returns expected error")
+	if assert.Equal(t, 1, len(brk.rps), "results") {
+		var er message.ErrResult
+		require.NoError(t, json.Unmarshal(brk.rps[0].Args, &er), "Unmarshal rewritten")
+		assert.Equal(t, ErrCallRelocated.Error(), er.Error.Message, "rewritten call without hook")
+	}
+}
+
+// concurrencyBroker delivers its call requests to the calls connections
+// of their URI, and records the URIs of each connection.
+type concurrencyBroker struct {
+	mockCalleeBroker
+	mu   sync.Mutex
+	cps  []*message.CallPayload
+	uris [][]string
+}
+
+func (b *concurrencyBroker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.uris = append(b.uris, uris)
+
+	// the channel is closed once the call requests are buffered, so
+	// that Listen returns once they are processed.
+	ch := make(chan *message.CallPayload, len(b.cps))
+	for _, cp := range b.cps {
+		for _, uri := range uris {
+			if cp.URI == uri {
+				ch <- cp
+			}
+		}
+	}
+	close(ch)
+	return &mockChanCallsConn{ch: ch}, nil
+}
+
+func (b *concurrencyBroker) Result(rp *message.ResPayload, timeout time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mockCalleeBroker.Result(rp, timeout)
+}
+
+type mockChanCallsConn struct {
+	ch chan *message.CallPayload
+}
+
+func (c *mockChanCallsConn) Calls() <-chan *message.CallPayload { return c.ch }
+func (c *mockChanCallsConn) CallsErr() error                    { return nil }
+func (c *mockChanCallsConn) Close() error                       { return nil }
+
+func TestCalleeMaxConcurrency(t *testing.T) {
+	brk := &concurrencyBroker{}
+	for i := 0; i < 6; i++ {
+		brk.cps = append(brk.cps,
+			&message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "fast", TTLAfterRead: time.Second},
+			&message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "slow", TTLAfterRead: time.Second})
+	}
+	cle := &Callee{Broker: brk, Workers: 3, MaxConcurrency: map[string]int{"slow": 1}}
+
+	var mu sync.Mutex
+	running, max := make(map[string]int), make(map[string]int)
+	thunk := func(cp *message.CallPayload) (interface{}, error) {
+		mu.Lock()
+		running[cp.URI]++
+		if running[cp.URI] > max[cp.URI] {
+			max[cp.URI] = running[cp.URI]
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running[cp.URI]--
+		mu.Unlock()
+		return "ok", nil
+	}
+	require.NoError(t, cle.Listen(map[string]Thunk{"fast": thunk, "slow": thunk}), "Listen")
+
+	assert.Equal(t, 12, len(brk.rps), "results")
+	assert.Equal(t, 1, max["slow"], "slow URI concurrency")
+	assert.True(t, max["fast"] > 1 && max["fast"] <= 3, "fast URI concurrency %d", max["fast"])
+	assert.ElementsMatch(t, [][]string{{"fast"}, {"slow"}}, brk.uris, "calls connections")
+}
+
+func TestCalleeRegister(t *testing.T) {
+	brk := &mockRegistryBroker{}
+	pb := &mockPubSubBroker{}
+	cle := &Callee{Registry: brk, Events: pb, HeartbeatInterval: 10 * time.Millisecond, Routing: []message.RoutingMode{message.Sticky}}
+
+	unregister, err := cle.Register("a", "b")
+	require.NoError(t, err, "Register")
+	time.Sleep(35 * time.Millisecond)
+	unregister()
+	unregister()
+
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+	if assert.True(t, len(brk.heartbeats) >= 3, "heartbeats: %d", len(brk.heartbeats)) {
+		first, last := brk.heartbeats[0], brk.heartbeats[len(brk.heartbeats)-1]
+		assert.Equal(t, []string{"a", "b"}, first.URIs, "registered URIs")
+		assert.Equal(t, []message.RoutingMode{message.Sticky}, first.Routing, "registered routing modes")
+		assert.Equal(t, first.ID.String(), last.ID.String(), "same instance")
+		assert.True(t, last.Heartbeat.After(first.Heartbeat), "heartbeat refreshed")
+	}
+	if assert.Equal(t, 1, len(brk.unregister), "unregistered once") {
+		assert.Equal(t, brk.heartbeats[0].ID.String(), brk.unregister[0].ID.String(), "unregistered instance")
+	}
+
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if assert.Equal(t, 2, len(pb.events), "published events") {
+		assert.Equal(t, message.CalleeRegisteredEvent, pb.events[0].Event, "registered")
+		assert.Equal(t, []string{"a", "b"}, pb.events[0].Callee.URIs, "registered URIs")
+		assert.Equal(t, message.CalleeUnregisteredEvent, pb.events[1].Event, "unregistered")
+	}
+}
+
+func TestCalleeCodecs(t *testing.T) {
+	codec := message.Base64{
+		Marshal: func(v interface{}) ([]byte, error) { return v.([]byte), nil },
+		Unmarshal: func(b []byte, v interface{}) error {
+			*(v.(*[]byte)) = b
+			return nil
+		},
+	}
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk, Codecs: message.Codecs{"bin": codec}}
+
+	reverse := func(cp *message.CallPayload) (interface{}, error) {
+		var b []byte
+		if err := cle.DecodeArgs(cp, &b); err != nil {
+			return nil, err
+		}
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return b, nil
+	}
+
+	cp := &message.CallPayload{URI: "bin", Args: json.RawMessage(`"AAEC"`), TTLAfterRead: time.Second}
+	require.NoError(t, cle.InvokeAndStoreResult(cp, reverse), "call with codec")
+	cp = &message.CallPayload{URI: "bin", Args: json.RawMessage(`{}`), TTLAfterRead: time.Second}
+	require.NoError(t, cle.InvokeAndStoreResult(cp, reverse), "call with invalid args")
+
+	if assert.Equal(t, 2, len(brk.rps), "results") {
+		assert.Equal(t, `"AgEA"`, string(brk.rps[0].Args), "encoded result")
+		assert.Equal(t, message.DefaultBinaryContentType, brk.rps[0].ContentType, "content type of the result")
+		assert.Equal(t, "", brk.rps[1].ContentType, "content type of the error result")
+		var er message.ErrResult
+		require.NoError(t, json.Unmarshal(brk.rps[1].Args, &er), "error result is JSON")
+		assert.NotEmpty(t, er.Error.Message, "error message")
+	}
+}
@@ -0,0 +1,143 @@
+package callee
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// ErrCallNotProcessed is stored as the error result of a call request
+// received by a callee that is drained before processing it, if the
+// broker cannot requeue it, so that the caller does not wait for the
+// call to expire.
+var ErrCallNotProcessed = errors.New("juggler/callee: call not processed, callee drained")
+
+// Serve processes the call requests received on conn with the Thunks
+// of m, as Listen does, until conn is closed or the callee is drained.
+// It can be called by many goroutines with the same conn to process
+// the call requests concurrently. When the callee is drained, the call
+// requests received on conn that are not started yet are requeued (see
+// Drain) and it returns nil, otherwise it returns the error that closed
+// conn.
+func (c *Callee) Serve(conn broker.CallsConn, m map[string]Thunk) error {
+	if !c.addConn(conn) {
+		return nil
+	}
+	defer c.removeConn(conn)
+
+	for cp := range conn.Calls() {
+		if c.isDraining() {
+			c.requeue(cp)
+			continue
+		}
+
+		// errors are ignored, use InvokeAndStoreResult directly to handle them.
+		fn := m[message.VersionedURI(cp.URI, cp.Version)]
+		if fn == nil && cp.Pattern != "" {
+			fn = m[cp.Pattern]
+		}
+		c.InvokeAndStoreResult(cp, fn)
+	}
+	if c.isDraining() {
+		return nil
+	}
+	return conn.CallsErr()
+}
+
+// Drain gracefully stops the Listen and Serve loops of the callee, e.g.
+// before a rolling restart, so that no call request is lost: the calls
+// connections are closed so that no new call request is received, the
+// in-flight calls are completed and their results stored, and the call
+// requests already received but not started are requeued in the broker
+// for another callee if it implements broker.RequeueBroker, otherwise
+// ErrCallNotProcessed is stored as their result.
+//
+// It blocks until the loops are stopped, or until ctx is done, in which
+// case it returns ctx.Err() and the remaining in-flight calls keep
+// running. Once the callee is drained, Listen and Serve return
+// immediately.
+func (c *Callee) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	c.draining = true
+	conns := c.conns
+	c.conns = nil
+	c.mu.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addConn registers conn as served by a loop, so that Drain closes it.
+// It returns false if the callee is drained.
+func (c *Callee) addConn(conn broker.CallsConn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.draining {
+		return false
+	}
+	if c.conns == nil {
+		c.conns = make(map[broker.CallsConn]int)
+	}
+	c.conns[conn]++
+	c.loops.Add(1)
+	return true
+}
+
+// removeConn unregisters a loop that served conn.
+func (c *Callee) removeConn(conn broker.CallsConn) {
+	c.mu.Lock()
+	if n := c.conns[conn]; n > 1 {
+		c.conns[conn] = n - 1
+	} else {
+		delete(c.conns, conn)
+	}
+	c.mu.Unlock()
+	c.loops.Done()
+}
+
+func (c *Callee) isDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+// requeue puts back the call request cp received while the callee is
+// drained. The broadcast calls are dropped, as the other callees of the
+// URI received them too.
+func (c *Callee) requeue(cp *message.CallPayload) {
+	if cp.Routing == message.Broadcast {
+		return
+	}
+	if rb, ok := c.Broker.(broker.RequeueBroker); ok {
+		err := rb.Requeue(cp)
+		if err == nil {
+			return
+		}
+		c.logf("juggler/callee: requeue of call %v to %s failed: %v", cp.MsgUUID, cp.URI, err)
+	}
+
+	if deadline, ok := callDeadline(cp); ok {
+		if remain := deadline.Sub(time.Now()); remain > 0 {
+			if err := c.storeResult(cp, nil, ErrCallNotProcessed, 0, remain); err != nil {
+				c.logf("juggler/callee: result of call %v to %s not processed failed: %v", cp.MsgUUID, cp.URI, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package callee
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type mockRequeueBroker struct {
+	mockCalleeBroker
+	requeued []*message.CallPayload
+}
+
+func (b *mockRequeueBroker) Requeue(cp *message.CallPayload) error {
+	b.requeued = append(b.requeued, cp)
+	return nil
+}
+
+// bufCallsConn delivers its buffered call requests, and closes its
+// channel when it is closed, as the brokers do once the call requests
+// already received are delivered.
+type bufCallsConn struct {
+	ch   chan *message.CallPayload
+	once sync.Once
+}
+
+func newBufCallsConn(cps ...*message.CallPayload) *bufCallsConn {
+	c := &bufCallsConn{ch: make(chan *message.CallPayload, len(cps))}
+	for _, cp := range cps {
+		c.ch <- cp
+	}
+	return c
+}
+
+func (c *bufCallsConn) Calls() <-chan *message.CallPayload { return c.ch }
+func (c *bufCallsConn) CallsErr() error                    { return nil }
+func (c *bufCallsConn) Close() error {
+	c.once.Do(func() { close(c.ch) })
+	return nil
+}
+
+func newDrainCall(uri string) *message.CallPayload {
+	return &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: uri, TTLAfterRead: time.Minute, ReadTimestamp: time.Now().UTC()}
+}
+
+// blockingThunk returns a Thunk that signals started when it is called,
+// and returns once release is closed.
+func blockingThunk(started chan<- struct{}, release <-chan struct{}) Thunk {
+	return func(cp *message.CallPayload) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return "ok", nil
+	}
+}
+
+func TestDrain(t *testing.T) {
+	brk := &mockRequeueBroker{}
+	cle := &Callee{Broker: brk}
+
+	inflight := newDrainCall("a")
+	pending := []*message.CallPayload{newDrainCall("a"), newDrainCall("a"), {MsgUUID: uuid.NewRandom(), URI: "a", Routing: message.Broadcast}}
+	conn := newBufCallsConn(append([]*message.CallPayload{inflight}, pending...)...)
+
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- cle.Serve(conn, map[string]Thunk{"a": blockingThunk(started, release)})
+	}()
+	<-started
+
+	// the in-flight call is not completed before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, cle.Drain(ctx), "Drain with in-flight call")
+
+	close(release)
+	require.NoError(t, cle.Drain(context.Background()), "Drain")
+	assert.NoError(t, <-served, "Serve")
+
+	if assert.Equal(t, 1, len(brk.rps), "in-flight result") {
+		assert.Equal(t, inflight.MsgUUID, brk.rps[0].MsgUUID, "in-flight result")
+	}
+	if assert.Equal(t, 2, len(brk.requeued), "requeued calls") {
+		assert.Equal(t, pending[0].MsgUUID, brk.requeued[0].MsgUUID, "requeued call")
+		assert.Equal(t, pending[1].MsgUUID, brk.requeued[1].MsgUUID, "requeued call")
+	}
+
+	// the callee is drained, nothing is served
+	conn = newBufCallsConn(newDrainCall("a"))
+	assert.NoError(t, cle.Serve(conn, map[string]Thunk{"a": okThunk}), "Serve once drained")
+	assert.Equal(t, 1, len(conn.ch), "call not received once drained")
+}
+
+func TestDrainListen(t *testing.T) {
+	// the broker cannot requeue, the pending call gets an error result
+	pending := newDrainCall("a")
+	brk := &drainCalleeBroker{conn: newBufCallsConn(newDrainCall("a"), pending)}
+	cle := &Callee{Broker: brk}
+
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	listened := make(chan error, 1)
+	go func() {
+		listened <- cle.Listen(map[string]Thunk{"a": blockingThunk(started, release)})
+	}()
+	<-started
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- cle.Drain(context.Background())
+	}()
+	for !cle.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	assert.NoError(t, <-drained, "Drain")
+	assert.NoError(t, <-listened, "Listen")
+
+	var er message.ErrResult
+	er.Error.Message = ErrCallNotProcessed.Error()
+	b, err := json.Marshal(er)
+	require.NoError(t, err, "Marshal ErrResult")
+	if assert.Equal(t, 2, len(brk.rps), "results") {
+		assert.Equal(t, `"ok"`, string(brk.rps[0].Args), "in-flight result")
+		assert.Equal(t, pending.MsgUUID, brk.rps[1].MsgUUID, "pending call result")
+		assert.Equal(t, string(b), string(brk.rps[1].Args), "pending call error result")
+	}
+}
+
+// drainCalleeBroker returns its connection from NewCallsConn.
+type drainCalleeBroker struct {
+	mockCalleeBroker
+	conn broker.CallsConn
+}
+
+func (b *drainCalleeBroker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
+	return b.conn, nil
+}
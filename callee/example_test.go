@@ -10,6 +10,7 @@ import (
 	"github.com/PuerkitoBio/juggler/callee"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -95,3 +96,38 @@ func echoThunk(cp *message.CallPayload) (interface{}, error) {
 func echo(s string) string {
 	return s
 }
+
+// the service of the RegisterService example.
+type Greeter struct{}
+
+type GreetArgs struct {
+	Name string `json:"name"`
+}
+
+type GreetReply struct {
+	Greeting string `json:"greeting"`
+}
+
+// Hello is served on the URI example.Hello.
+func (Greeter) Hello(ctx context.Context, args *GreetArgs) (*GreetReply, error) {
+	return &GreetReply{Greeting: "hello, " + args.Name}, nil
+}
+
+func ExampleCallee_RegisterService() {
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", redisAddr)
+		},
+	}
+	c := &callee.Callee{Broker: &redisbroker.Broker{Pool: pool, Dial: pool.Dial}}
+
+	// register the methods of Greeter as the example.* URIs
+	if err := c.RegisterService("example", Greeter{}); err != nil {
+		log.Fatalf("RegisterService failed: %v", err)
+	}
+
+	// serve the URIs of the registered services
+	if err := c.Listen(nil); err != nil {
+		log.Fatalf("Listen failed: %v", err)
+	}
+}
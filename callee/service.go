@@ -0,0 +1,154 @@
+package callee
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+var (
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+type callPayloadKey struct{}
+
+// CallPayloadFromContext returns the call request of the context passed
+// to the methods of the services registered with RegisterService, or
+// nil if ctx is not the context of a call.
+func CallPayloadFromContext(ctx context.Context) *message.CallPayload {
+	cp, _ := ctx.Value(callPayloadKey{}).(*message.CallPayload)
+	return cp
+}
+
+type resultHeadersKey struct{}
+
+// SetResultHeader sets the header key of the result of the call to
+// value, from the methods of the services registered with
+// RegisterService (see Result). It does nothing if ctx is not the
+// context of a call.
+func SetResultHeader(ctx context.Context, key, value string) {
+	if h, ok := ctx.Value(resultHeadersKey{}).(message.Headers); ok {
+		h[key] = value
+	}
+}
+
+// RegisterService registers the methods of svc as the Thunks of the
+// URIs prefix.MethodName, which Listen serves along with the Thunks it
+// receives, and that are returned by Thunks. If prefix is empty, the
+// name of the type of svc is used.
+//
+// As with net/rpc, only the exported methods with a suitable signature
+// are registered:
+//
+//     func (t *T) MethodName(ctx context.Context, args *Args) (*Reply, error)
+//
+// Args can be any type, the arguments of the call are decoded into a new
+// *Args with DecodeArgs, so that the codec of the URI is used. A call
+// with no arguments gets a zero *Args. The reply is the result of the
+// call, or the error if it is not nil. The context is done when the call
+// expires (see CallContext), CallPayloadFromContext returns its call request, and the
+// headers of the result can be set with SetResultHeader.
+//
+// It returns an error if svc has no suitable method, or if a URI is
+// already registered.
+func (c *Callee) RegisterService(prefix string, svc interface{}) error {
+	v := reflect.ValueOf(svc)
+	if !v.IsValid() {
+		return errors.New("juggler/callee: nil service")
+	}
+	if prefix == "" {
+		prefix = reflect.Indirect(v).Type().Name()
+		if prefix == "" {
+			return fmt.Errorf("juggler/callee: no prefix for service of unnamed type %s", v.Type())
+		}
+	}
+
+	thunks := make(map[string]Thunk)
+	t := v.Type()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !isServiceMethod(m) {
+			continue
+		}
+		thunks[prefix+"."+m.Name] = c.methodThunk(v.Method(i), m.Type.In(2).Elem())
+	}
+	if len(thunks) == 0 {
+		return fmt.Errorf("juggler/callee: type %s has no suitable method", t)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for uri := range thunks {
+		if _, ok := c.services[uri]; ok {
+			return fmt.Errorf("juggler/callee: URI %s already registered", uri)
+		}
+	}
+	if c.services == nil {
+		c.services = make(map[string]Thunk, len(thunks))
+	}
+	for uri, fn := range thunks {
+		c.services[uri] = fn
+	}
+	return nil
+}
+
+// Thunks returns the Thunks of the services registered with
+// RegisterService, by URI, e.g. to process the call requests with
+// InvokeAndStoreResult.
+func (c *Callee) Thunks() map[string]Thunk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := make(map[string]Thunk, len(c.services))
+	for uri, fn := range c.services {
+		m[uri] = fn
+	}
+	return m
+}
+
+// isServiceMethod returns true if m is an exported method with the
+// signature of a service method.
+func isServiceMethod(m reflect.Method) bool {
+	if m.PkgPath != "" {
+		return false
+	}
+	mt := m.Type
+	if mt.NumIn() != 3 || mt.NumOut() != 2 {
+		return false
+	}
+	return mt.In(1) == typeOfContext && mt.In(2).Kind() == reflect.Ptr && mt.Out(1) == typeOfError
+}
+
+// methodThunk returns the Thunk that calls the service method fn, with
+// the arguments decoded into a new value of argsType.
+func (c *Callee) methodThunk(fn reflect.Value, argsType reflect.Type) Thunk {
+	return func(cp *message.CallPayload) (interface{}, error) {
+		args := reflect.New(argsType)
+		if len(cp.Args) > 0 {
+			if err := c.DecodeArgs(cp, args.Interface()); err != nil {
+				return nil, &message.ArgsError{Type: message.CallMsg, Name: cp.URI, Args: cp.Args, Err: err}
+			}
+		}
+
+		ctx, cancel := CallContext(cp)
+		defer cancel()
+		ctx = context.WithValue(ctx, callPayloadKey{}, cp)
+		headers := make(message.Headers)
+		ctx = context.WithValue(ctx, resultHeadersKey{}, headers)
+
+		out := fn.Call([]reflect.Value{reflect.ValueOf(ctx), args})
+		var v interface{}
+		err, _ := out[1].Interface().(error)
+		if err == nil {
+			v = out[0].Interface()
+		}
+		if len(headers) > 0 {
+			return &Result{Value: v, Headers: headers}, err
+		}
+		return v, err
+	}
+}
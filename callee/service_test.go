@@ -0,0 +1,140 @@
+package callee
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type mathArgs struct {
+	A, B int
+}
+
+type mathService struct{}
+
+func (mathService) Add(ctx context.Context, args *mathArgs) (int, error) {
+	return args.A + args.B, nil
+}
+
+func (mathService) Div(ctx context.Context, args *mathArgs) (*int, error) {
+	if args.B == 0 {
+		return nil, errors.New("division by zero")
+	}
+	v := args.A / args.B
+	return &v, nil
+}
+
+func (mathService) URI(ctx context.Context, args *struct{}) (string, error) {
+	_, ok := ctx.Deadline()
+	if cp := CallPayloadFromContext(ctx); cp != nil && ok {
+		return cp.URI, nil
+	}
+	return "", errors.New("no call payload or deadline")
+}
+
+// not registered, invalid signatures
+func (mathService) NoContext(args *mathArgs) (int, error)                       { return 0, nil }
+func (mathService) NoPointer(ctx context.Context, args mathArgs) (int, error)   { return 0, nil }
+func (mathService) NoError(ctx context.Context, args *mathArgs) (int, int)      { return 0, 0 }
+func (mathService) TooMany(ctx context.Context, args *mathArgs, x int) error    { return nil }
+func (mathService) unexported(ctx context.Context, args *mathArgs) (int, error) { return 0, nil }
+
+type emptyService struct{}
+
+func (emptyService) Foo() {}
+
+func TestRegisterService(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk}
+
+	require.NoError(t, cle.RegisterService("math", mathService{}), "RegisterService")
+	require.NoError(t, cle.RegisterService("", &mathService{}), "RegisterService with type name")
+
+	thunks := cle.Thunks()
+	uris := make([]string, 0, len(thunks))
+	for uri := range thunks {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	assert.Equal(t, []string{"math.Add", "math.Div", "math.URI", "mathService.Add", "mathService.Div", "mathService.URI"}, uris, "URIs")
+
+	assert.Error(t, cle.RegisterService("math", mathService{}), "already registered")
+	assert.Error(t, cle.RegisterService("empty", emptyService{}), "no suitable method")
+	assert.Error(t, cle.RegisterService("", nil), "nil service")
+	assert.Error(t, cle.RegisterService("", struct{}{}), "unnamed type")
+
+	cases := []struct {
+		uri  string
+		args string
+		res  string
+	}{
+		{"math.Add", `{"A":1,"B":2}`, `3`},
+		{"math.Add", ``, `0`},
+		{"math.Div", `{"A":6,"B":2}`, `3`},
+		{"math.Div", `{"A":6}`, `{"error":{"message":"division by zero"}}`},
+		{"math.Add", `"x"`, `{"error":{"message":"invalid CALL arguments for math.Add: `},
+		{"math.URI", `{}`, `"math.URI"`},
+	}
+	for i, c := range cases {
+		cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: c.uri, TTLAfterRead: time.Second}
+		if c.args != "" {
+			cp.Args = json.RawMessage(c.args)
+		}
+		require.NoError(t, cle.InvokeAndStoreResult(cp, thunks[c.uri]), "%d: InvokeAndStoreResult", i)
+		if assert.Equal(t, i+1, len(brk.rps), "%d: result stored", i) {
+			// the error message of the decoding depends on the Go version
+			assert.True(t, strings.HasPrefix(string(brk.rps[i].Args), c.res), "%d: result %s", i, brk.rps[i].Args)
+		}
+	}
+}
+
+func TestListenServices(t *testing.T) {
+	brk := &mockCalleeBroker{
+		cps: []*message.CallPayload{
+			{MsgUUID: uuid.NewRandom(), URI: "math.Add", Args: json.RawMessage(`{"A":1,"B":2}`), TTLAfterRead: time.Second},
+			{MsgUUID: uuid.NewRandom(), URI: "math.Div", Args: json.RawMessage(`{"A":1,"B":1}`), TTLAfterRead: time.Second},
+		},
+	}
+	cle := &Callee{Broker: brk}
+	require.NoError(t, cle.RegisterService("math", mathService{}), "RegisterService")
+
+	// the thunks of Listen take precedence
+	require.NoError(t, cle.Listen(map[string]Thunk{"math.Div": okThunk}), "Listen")
+	if assert.Equal(t, 2, len(brk.rps), "results") {
+		assert.Equal(t, `3`, string(brk.rps[0].Args), "service result")
+		assert.Equal(t, `"ok"`, string(brk.rps[1].Args), "Listen thunk result")
+	}
+}
+
+type traceService struct{}
+
+func (traceService) Echo(ctx context.Context, args *struct{}) (string, error) {
+	cp := CallPayloadFromContext(ctx)
+	SetResultHeader(ctx, "trace-id", cp.Headers.Get("trace-id"))
+	return "ok", nil
+}
+
+func TestServiceResultHeaders(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk}
+	require.NoError(t, cle.RegisterService("trace", traceService{}), "RegisterService")
+
+	// a no-op outside of a call
+	SetResultHeader(context.Background(), "a", "b")
+
+	cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "trace.Echo", TTLAfterRead: time.Second, Headers: message.Headers{"trace-id": "t1"}}
+	require.NoError(t, cle.InvokeAndStoreResult(cp, cle.Thunks()["trace.Echo"]), "InvokeAndStoreResult")
+	if assert.Equal(t, 1, len(brk.rps), "result stored") {
+		assert.Equal(t, `"ok"`, string(brk.rps[0].Args), "result")
+		assert.Equal(t, message.Headers{"trace-id": "t1"}, brk.rps[0].Headers, "result headers")
+	}
+}
@@ -0,0 +1,45 @@
+package callee
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// ErrCallShed is returned from InvokeAndStoreResult when the call
+// request is shed instead of being processed, because it waited too
+// long (see Callee.ShedExpired and Callee.MaxQueueAge).
+var ErrCallShed = errors.New("juggler/callee: call shed")
+
+// shed returns true if the call request cp, about to be processed at
+// now, must be shed. The call requests older than MaxQueueAge get
+// ErrCallShed as their error result, as their caller still waits.
+func (c *Callee) shed(cp *message.CallPayload, now time.Time) bool {
+	if c.ShedExpired && cp.TTLAfterRead > 0 && !cp.ReadTimestamp.IsZero() {
+		if !now.Before(cp.ReadTimestamp.Add(cp.TTLAfterRead)) {
+			c.addShed(cp)
+			return true
+		}
+	}
+
+	if c.MaxQueueAge > 0 && !cp.Timestamp.IsZero() && now.Sub(cp.Timestamp) > c.MaxQueueAge {
+		c.addShed(cp)
+		if deadline, ok := callDeadline(cp); ok {
+			if remain := deadline.Sub(now); remain > 0 {
+				if err := c.storeResult(cp, nil, ErrCallShed, 0, remain); err != nil {
+					c.logf("juggler/callee: result of shed call %v to %s failed: %v", cp.MsgUUID, cp.URI, err)
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (c *Callee) addShed(cp *message.CallPayload) {
+	if c.Vars != nil {
+		c.Vars.Add("ShedCalls", 1)
+		c.Vars.Add("ShedCalls."+cp.URI, 1)
+	}
+}
@@ -0,0 +1,61 @@
+package callee
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalleeShed(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	vars := new(expvar.Map).Init()
+	cle := &Callee{Broker: brk, ShedExpired: true, MaxQueueAge: time.Second, Vars: vars}
+
+	var invoked int
+	thunk := func(cp *message.CallPayload) (interface{}, error) {
+		invoked++
+		return "ok", nil
+	}
+
+	now := time.Now().UTC()
+	cases := []struct {
+		cp  *message.CallPayload
+		err error
+	}{
+		// the timeout elapsed while waiting for the callee
+		{&message.CallPayload{URI: "a", TTLAfterRead: 10 * time.Millisecond, ReadTimestamp: now.Add(-time.Second)}, ErrCallShed},
+		// waited too long, the caller gets an error result
+		{&message.CallPayload{URI: "b", TTLAfterRead: time.Minute, ReadTimestamp: now, Timestamp: now.Add(-2 * time.Second)}, ErrCallShed},
+		// processed
+		{&message.CallPayload{URI: "a", TTLAfterRead: time.Minute, ReadTimestamp: now, Timestamp: now.Add(-time.Millisecond)}, nil},
+		{&message.CallPayload{URI: "a", TTLAfterRead: time.Minute}, nil},
+	}
+	for i, c := range cases {
+		c.cp.MsgUUID = uuid.NewRandom()
+		assert.Equal(t, c.err, cle.InvokeAndStoreResult(c.cp, thunk), "%d: InvokeAndStoreResult", i)
+	}
+	assert.Equal(t, 2, invoked, "processed calls")
+
+	var er message.ErrResult
+	er.Error.Message = ErrCallShed.Error()
+	b, err := json.Marshal(er)
+	require.NoError(t, err, "Marshal ErrResult")
+	if assert.Equal(t, 3, len(brk.rps), "results") {
+		assert.Equal(t, cases[1].cp.MsgUUID, brk.rps[0].MsgUUID, "shed call result")
+		assert.Equal(t, string(b), string(brk.rps[0].Args), "shed call error result")
+	}
+	assert.Equal(t, "2", vars.Get("ShedCalls").String(), "ShedCalls")
+	assert.Equal(t, "1", vars.Get("ShedCalls.a").String(), "ShedCalls.a")
+	assert.Equal(t, "1", vars.Get("ShedCalls.b").String(), "ShedCalls.b")
+
+	// not shed by default
+	cle = &Callee{Broker: brk}
+	assert.NoError(t, cle.InvokeAndStoreResult(cases[0].cp, thunk), "expired call")
+	assert.Equal(t, 3, invoked, "expired call processed")
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+type actAsKey struct{}
+
+// WithActAs returns a copy of ctx with the identity on behalf of which
+// the CALL requests made with that context are sent, e.g. with CallCtx
+// or Invoke (see message.Meta.ActAs). The server rejects those calls
+// with a NACK with message.CodeForbidden unless the connection is
+// allowed to act as that identity, e.g. the connection of an API
+// gateway that calls on behalf of its end users.
+func WithActAs(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, actAsKey{}, identity)
+}
+
+// ActAsFromContext returns the identity of the context set by WithActAs,
+// or an empty string if there is none.
+func ActAsFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(actAsKey{}).(string)
+	return id
+}
+
+// setActAs sets the identity of ctx on the CALL request m, and on the
+// CALL requests of m if it is a batch. The identity already set on a
+// request is not overridden.
+func setActAs(ctx context.Context, m message.Msg) {
+	id := ActAsFromContext(ctx)
+	if id == "" {
+		return
+	}
+
+	set := func(m message.Msg) {
+		if call, ok := m.(*message.Call); ok && call.Meta.ActAs == "" {
+			call.Meta.ActAs = id
+		}
+	}
+	set(m)
+	if b, ok := m.(*message.Batch); ok {
+		for _, im := range b.Payload.Msgs {
+			set(im)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// PubBatch makes a publish request for each value of vs on the
+// specified channel, sent in a single batch message (see
+// message.Batch), so that the server can publish them in a single
+// round trip to the broker. The values are encoded as with Pub, and
+// each request is acknowledged separately. It returns the UUIDs of the
+// pub messages in the order of vs on success, or an error if the batch
+// could not be sent to the server.
+func (c *Client) PubBatch(channel string, vs []interface{}) ([]uuid.UUID, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]message.Msg, len(vs))
+	for i, v := range vs {
+		m, err := c.newPub(channel, v)
+		if err != nil {
+			return nil, err
+		}
+		msgs[i] = m
+	}
+	if err := c.writeBatch(msgs); err != nil {
+		return nil, err
+	}
+	return msgUUIDs(msgs), nil
+}
+
+// CallBatch makes a call request to uri for each value of vs, sent in a
+// single batch message (see message.Batch), so that the server can
+// register them in a single round trip to the broker. The calls are
+// made as with Call, each with its own ACK or NACK and result or Exp
+// message. It returns the UUIDs of the call messages in the order of vs
+// on success, or an error if the batch could not be sent to the server.
+func (c *Client) CallBatch(uri string, vs []interface{}, timeout time.Duration) ([]uuid.UUID, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.breaker != nil && !c.breaker.Allow(uri) {
+		return nil, ErrCircuitOpen
+	}
+
+	if timeout <= 0 {
+		timeout = c.callTimeout
+	}
+	msgs := make([]message.Msg, len(vs))
+	for i, v := range vs {
+		m, err := c.newCall(uri, v, timeout)
+		if err != nil {
+			return nil, err
+		}
+		msgs[i] = m
+	}
+	if err := c.writeBatch(msgs); err != nil {
+		return nil, err
+	}
+
+	// add the expected results
+	for _, m := range msgs {
+		c.addPending(m.UUID().String())
+		go c.handleExpiredCall(m.(*message.Call), timeout)
+	}
+	return msgUUIDs(msgs), nil
+}
+
+// writeBatch sends the messages in a single batch message.
+func (c *Client) writeBatch(msgs []message.Msg) error {
+	b, err := message.NewBatch(msgs...)
+	if err != nil {
+		return err
+	}
+	return c.doWrite(context.Background(), b)
+}
+
+func msgUUIDs(msgs []message.Msg) []uuid.UUID {
+	ids := make([]uuid.UUID, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.UUID()
+	}
+	return ids
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/PuerkitoBio/juggler/internal/circuit"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// ErrCircuitOpen is returned by Client.Call and Client.Invoke when the
+// circuit of the URI is open (see SetCircuitBreaker). The call request
+// is not sent.
+var ErrCircuitOpen = errors.New("juggler/client: circuit open")
+
+// Circuit is a circuit state change message. Like Exp, it is never sent
+// over the network, it is raised by the client for itself when the
+// state of the circuit of a URI changes (see SetCircuitBreaker).
+type Circuit struct {
+	message.Meta `json:"meta"`
+	Payload      struct {
+		URI   string `json:"uri"`
+		From  string `json:"from"`  // previous state, "closed", "open" or "half-open"
+		State string `json:"state"` // new state
+	} `json:"payload"`
+}
+
+// CircuitMsg is the message type of the circuit state change message.
+var CircuitMsg = message.Register("CIRCUIT")
+
+func newCircuit(uri string, from, to circuit.State) *Circuit {
+	m := &Circuit{
+		Meta: message.NewMeta(CircuitMsg),
+	}
+	m.Payload.URI = uri
+	m.Payload.From = from.String()
+	m.Payload.State = to.String()
+	return m
+}
+
+// recordCircuit records the outcome of a call in the circuit breaker,
+// if the message is the result of a call.
+func (c *Client) recordCircuit(m message.Msg) {
+	if c.breaker == nil {
+		return
+	}
+	switch m := m.(type) {
+	case *message.Res:
+		c.breaker.Success(m.Payload.URI)
+	case *message.Nack:
+		if m.Payload.ForType == message.CallMsg && circuit.IsFailure(m.Payload.Code) {
+			c.breaker.Failure(m.Payload.URI)
+		}
+	case *Exp:
+		c.breaker.Failure(m.Payload.URI)
+	}
+}
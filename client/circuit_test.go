@@ -0,0 +1,105 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/juggler/internal/wstest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	healthy := false
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+
+			call := m.(*message.Call)
+			mu.Lock()
+			ok := healthy
+			mu.Unlock()
+			if !ok {
+				if !assert.NoError(t, c.WriteJSON(message.NewNack(call, message.CodeHandlerError, errors.New("down"))), "WriteJSON NACK") {
+					return
+				}
+				continue
+			}
+			if !assert.NoError(t, c.WriteJSON(message.NewAck(call)), "WriteJSON ACK") {
+				return
+			}
+			res := message.NewRes(&message.ResPayload{MsgUUID: call.UUID(), URI: call.Payload.URI, Args: []byte(`1`)})
+			if !assert.NoError(t, c.WriteJSON(res), "WriteJSON RES") {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	circuits := make(chan *Circuit, 10)
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		if m, ok := m.(*Circuit); ok {
+			circuits <- m
+		}
+	})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h), SetCircuitBreaker(2, 50*time.Millisecond))
+	require.NoError(t, err, "Dial")
+
+	// the handler is called in a separate goroutine for each message, so
+	// the state changes may be received out of order.
+	expectStates := func(want ...string) {
+		var got []string
+		for range want {
+			select {
+			case m := <-circuits:
+				got = append(got, m.Payload.URI+":"+m.Payload.From+">"+m.Payload.State)
+			case <-time.After(time.Second):
+				assert.Fail(t, "no state change", "%v", want)
+				return
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		assert.Equal(t, want, got, "state changes")
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		assert.True(t, IsHandlerError(cli.Invoke(ctx, "a", nil, nil, time.Second)), "failed call %d", i)
+	}
+	expectStates("a:closed>open")
+
+	// fail fast while open, other URIs are not affected
+	_, err = cli.Call("a", nil, time.Second)
+	assert.Equal(t, ErrCircuitOpen, err, "Call with open circuit")
+	assert.Equal(t, ErrCircuitOpen, cli.Invoke(ctx, "a", nil, nil, time.Second), "Invoke with open circuit")
+	assert.True(t, IsHandlerError(cli.Invoke(ctx, "b", nil, nil, time.Second)), "other URI")
+
+	// the trial call after the cooldown closes the circuit
+	mu.Lock()
+	healthy = true
+	mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, cli.Invoke(ctx, "a", nil, nil, time.Second), "trial call")
+	expectStates("a:open>half-open", "a:half-open>closed")
+	assert.NoError(t, cli.Invoke(ctx, "a", nil, nil, time.Second), "closed circuit")
+
+	require.NoError(t, cli.Close(), "Close")
+	<-done
+}
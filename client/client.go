@@ -11,12 +11,26 @@
 // an ACK message, not a NACK) either generates a RES or an EXP,
 // but never both or none.
 //
+// The requests are sent with the methods that take a context, such as
+// CallCtx and PubCtx: the request is not sent if the context is done
+// before the write lock of the connection is acquired, and the context
+// deadline bounds the time to write it. Invoke waits for the result of
+// a call as long as its context is not done. The methods without a
+// context are deprecated.
+//
+// A Pool maintains connections to one or more servers and load-balances
+// the requests over them.
+//
 package client
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -24,8 +38,10 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/internal/circuit"
 	"github.com/PuerkitoBio/juggler/internal/wswriter"
 	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/juggler/session"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
 )
@@ -37,11 +53,31 @@ type Client struct {
 
 	// options
 	callTimeout             time.Duration
+	callMaxAttempts         int
+	callBackoff             time.Duration
+	callPriority            int
+	timeSyncSamples         int
+	timeSyncTimeout         time.Duration
+	codecs                  message.Codecs
+	channelCodecs           message.Codecs
+	versions                map[string]string
+	signer                  message.Signer
+	ackMode                 AckMode
+	breaker                 *circuit.Breaker
+	detectGaps              bool
 	handler                 Handler
 	readTimeout             time.Duration
 	writeTimeout            time.Duration
 	acquireWriteLockTimeout time.Duration
 	writeLimit              int64
+	recorder                *session.Recorder
+	headers                 message.Headers
+	proto                   message.Protocol
+	session                 string
+
+	// dial options, only used by Dial
+	tlsConfig *tls.Config
+	pins      []string
 
 	// stop signal for expiration goroutines, signals close of client
 	stop chan struct{}
@@ -50,11 +86,27 @@ type Client struct {
 	mu      sync.Mutex    // lock access to results map and err field
 	results map[string]struct{}
 	err     error
+
+	// requests waiting for their response (time synchronization
+	// exchanges and Invoke calls) and clock offset, protected by mu.
+	waiters     map[string]chan message.Msg
+	clockOffset time.Duration
+
+	// pings waiting for their pong, by data, protected by mu.
+	pings map[string]chan struct{}
+
+	// functions of the subscriptions made with SubFunc, protected by mu.
+	subFuncs map[subKey]*subFunc
+
+	// sequence number of the last event received by channel, only
+	// accessed by the goroutine that reads the messages.
+	lastSeqs map[string]uint64
 }
 
 // New creates a juggler client using the provided websocket
 // connection. Received messages are sent to the handler set by
-// the SetHandler option.
+// the SetHandler option, except for the events of the subscriptions
+// made with SubFunc.
 func New(conn *websocket.Conn, opts ...Option) *Client {
 	// wmu is the write lock, used as mutex so it can be select'ed upon.
 	// start with an available slot (initialize with a sent value).
@@ -63,22 +115,33 @@ func New(conn *websocket.Conn, opts ...Option) *Client {
 
 	c := &Client{
 		conn:    conn,
+		proto:   protocolFor(conn.Subprotocol()),
 		stop:    make(chan struct{}),
 		wmu:     wmu,
 		results: make(map[string]struct{}),
+		pings:   make(map[string]chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(c)
 	}
+	conn.SetPongHandler(c.handlePong(conn.PongHandler()))
 	go c.handleMessages()
+	if c.timeSyncSamples > 0 {
+		go c.SyncClock(c.timeSyncSamples, c.timeSyncTimeout)
+	}
 	return c
 }
 
 func (c *Client) handleMessages() {
 	defer close(c.stop)
 
+	readTimeout := c.readTimeout
+	if readTimeout == 0 {
+		readTimeout = DefaultReadTimeout
+	}
 	for {
-		_, r, err := c.conn.NextReader()
+		c.conn.SetReadDeadline(time.Time{})
+		mt, r, err := c.conn.NextReader()
 		if err != nil {
 			c.mu.Lock()
 			if c.err == nil {
@@ -87,11 +150,30 @@ func (c *Client) handleMessages() {
 			c.mu.Unlock()
 			return
 		}
+		if rec := c.recorder; rec != nil {
+			raw, err := ioutil.ReadAll(r)
+			if err != nil {
+				continue
+			}
+			rec.Record(c.session, session.Server, mt, raw)
+			r = bytes.NewReader(raw)
+		}
+		if readTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
 
-		m, err := message.UnmarshalResponse(r)
+		m, err := c.proto.DecodeResponse(r)
 		if err != nil {
 			continue
 		}
+		c.recordCircuit(m)
+		c.detectGap(m)
+		if c.handleWaiter(m) {
+			continue
+		}
+		if c.handleSubFunc(m) {
+			continue
+		}
 
 		switch m := m.(type) {
 		case *message.Res:
@@ -121,10 +203,65 @@ func (c *Client) handleMessages() {
 // create the client once the connection is established, using New.
 //
 // The Dialer's Subprotocols field should be set to one of (or any/all of)
-// juggler.Subprotocol. To limit the client to a restricted subset of
+// juggler.Subprotocols, the server selects the newest version that both
+// peers support.
+// If it is empty, all the registered versions of the protocol are
+// requested, the newest first, so that the newest version supported by
+// the server is negotiated (see message.Protocols). To limit the client to a restricted subset of
 // messages, set the Juggler-Allowed-Messages header on reqHeader
 // (see the documentation of juggler.Upgrade for details).
+//
+// If the Dialer's NetDial field is nil, the connection is established
+// using HappyEyeballs, with the Dialer's HandshakeTimeout as timeout
+// of each connection attempt, so that the resolved IPv4 and IPv6
+// addresses of the host are tried concurrently. The provided Dialer is
+// left untouched.
+//
+// To compress the messages with the permessage-deflate extension, set the
+// Dialer's EnableCompression field, the compression is used if the server
+// supports it (see SetCompressionLevel).
+//
+// To fail over between several servers, use Endpoints.Dial.
+//
+// To connect through a proxy, set the Dialer's Proxy field, e.g. with
+// ProxyFunc for an HTTP or a SOCKS5 proxy or the proxy of the
+// environment. The proxy is dialed with the NetDial function of the
+// Dialer, or HappyEyeballs if it is nil. To customize the network
+// connections, e.g. to bind them to a local address, set NetDial, e.g.
+// to HappyEyeballs with a net.Dialer that has a LocalAddr. If d is nil,
+// a zero Dialer with the proxy of the environment is used, as
+// websocket.DefaultDialer. The reqHeader are sent in the upgrade
+// request, e.g. for the authentication of the client.
+//
+// The TLS configuration of the Dialer is overridden by the SetTLSConfig
+// option, and the SetCertificatePins option checks the certificates of
+// the server.
 func Dial(d *websocket.Dialer, urlStr string, reqHeader http.Header, opts ...Option) (*Client, error) {
+	if d == nil {
+		d = &websocket.Dialer{Proxy: http.ProxyFromEnvironment}
+	}
+
+	// the options that apply to the connection are needed before the
+	// client is created, they are collected on a client that has no
+	// connection yet.
+	var dc Client
+	for _, opt := range opts {
+		opt(&dc)
+	}
+	d = dc.dialTLS(d)
+
+	if d.NetDial == nil || len(d.Subprotocols) == 0 {
+		cpy := *d
+		if cpy.NetDial == nil {
+			cpy.NetDial = HappyEyeballs(&net.Dialer{Timeout: d.HandshakeTimeout}, DefaultFallbackDelay)
+		}
+		if len(cpy.Subprotocols) == 0 {
+			for _, p := range message.Protocols() {
+				cpy.Subprotocols = append(cpy.Subprotocols, p.Name())
+			}
+		}
+		d = &cpy
+	}
 	conn, _, err := d.Dial(urlStr, reqHeader)
 	if err != nil {
 		return nil, err
@@ -132,6 +269,22 @@ func Dial(d *websocket.Dialer, urlStr string, reqHeader http.Header, opts ...Opt
 	return New(conn, opts...), nil
 }
 
+// protocolFor returns the version of the protocol named name, or
+// message.V1 if it is not a registered version, e.g. if the server did
+// not negotiate a subprotocol.
+func protocolFor(name string) message.Protocol {
+	if p, ok := message.LookupProtocol(name); ok {
+		return p
+	}
+	return message.V1
+}
+
+// Protocol returns the version of the protocol negotiated with the
+// server, whose codec encodes and decodes the messages of the client.
+func (c *Client) Protocol() message.Protocol {
+	return c.proto
+}
+
 // Close closes the connection. No more messages will be received.
 func (c *Client) Close() error {
 	c.mu.Lock()
@@ -177,7 +330,17 @@ func (c *Client) UnderlyingConn() *websocket.Conn {
 //
 // It returns the UUID of the call message on success, or an error if
 // the call request could not be sent to the server.
+//
+// Deprecated: use CallCtx.
 func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	return c.CallCtx(context.Background(), uri, v, timeout)
+}
+
+// CallCtx makes a call request like Call, that is not sent if ctx is
+// done before it can be written. If ctx is done after the request is
+// sent, the call is not canceled, use Invoke to wait for its result as
+// long as ctx is not done.
+func (c *Client) CallCtx(ctx context.Context, uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
@@ -185,14 +348,18 @@ func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UU
 		return nil, err
 	}
 
+	if c.breaker != nil && !c.breaker.Allow(uri) {
+		return nil, ErrCircuitOpen
+	}
+
 	if timeout <= 0 {
 		timeout = c.callTimeout
 	}
-	m, err := message.NewCall(uri, v, timeout)
+	m, err := c.newCall(uri, v, timeout)
 	if err != nil {
 		return nil, err
 	}
-	if err := c.doWrite(m); err != nil {
+	if err := c.doWrite(ctx, m); err != nil {
 		return nil, err
 	}
 
@@ -203,25 +370,78 @@ func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UU
 	return m.UUID(), nil
 }
 
+// newCall creates the call request to uri with the options of the
+// client.
+func (c *Client) newCall(uri string, v interface{}, timeout time.Duration) (*message.Call, error) {
+	codec := c.codecs[uri]
+	if codec != nil {
+		args, err := codec.Encode(v)
+		if err != nil {
+			return nil, err
+		}
+		v = args
+	}
+	m, err := message.NewCall(uri, v, timeout)
+	if err != nil {
+		return nil, err
+	}
+	m.Payload.ContentType = message.ContentType(codec)
+	m.Payload.MaxAttempts = c.callMaxAttempts
+	m.Payload.Backoff = c.callBackoff
+	m.Payload.Priority = c.callPriority
+	m.Payload.Version = c.versions[uri]
+	m.Payload.NoAck = c.ackMode == NoAckPubCall
+	return m, nil
+}
+
+// DecodeResult decodes the value of the result into v, using the codec
+// of its URI (see SetCodec). Error results are always encoded as JSON
+// (see message.ErrResult), and should be decoded with message.JSON.
+// The decoding errors are returned as *message.ArgsError.
+func (c *Client) DecodeResult(res *message.Res, v interface{}) error {
+	if err := c.codecs.Codec(res.Payload.URI).Decode(res.Payload.Args, v); err != nil {
+		return &message.ArgsError{Type: res.Type(), Name: res.Payload.URI, Args: res.Payload.Args, Err: err}
+	}
+	return nil
+}
+
+// DecodeEvent decodes the arguments of the event into v, using the codec
+// of its channel (see SetChannelCodec). The decoding errors are returned
+// as *message.ArgsError.
+func (c *Client) DecodeEvent(ev *message.Evnt, v interface{}) error {
+	if err := c.channelCodecs.Codec(ev.Payload.Channel).Decode(ev.Payload.Args, v); err != nil {
+		return &message.ArgsError{Type: ev.Type(), Name: ev.Payload.Channel, Args: ev.Payload.Args, Err: err}
+	}
+	return nil
+}
+
 func (c *Client) handleExpiredCall(m *message.Call, timeout time.Duration) {
 	// wait for the timeout
-	if timeout <= 0 {
-		timeout = broker.DefaultCallTimeout
-	}
 	select {
 	case <-c.stop:
 		return
-	case <-time.After(timeout):
+	case <-time.After(callExpiration(m, timeout)):
 	}
 
 	// check if still waiting for a result
 	if ok := c.deletePending(m.UUID().String()); ok {
 		// if so, send an Exp message
 		exp := newExp(m)
+		c.recordCircuit(exp)
 		go c.handler.Handle(context.Background(), exp)
 	}
 }
 
+// callExpiration returns the time after which the result of the call
+// request m is not expected anymore. Each attempt has its own timeout,
+// so it includes all attempts and backoff delays.
+func callExpiration(m *message.Call, timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	return message.TotalWait(timeout, m.Payload.Backoff, m.Payload.MaxAttempts)
+}
+
 // add a pending call.
 func (c *Client) addPending(key string) {
 	c.mu.Lock()
@@ -243,7 +463,15 @@ func (c *Client) deletePending(key string) bool {
 // channel, which is treated as a pattern if pattern is true. It
 // returns the UUID of the sub message on success, or an error if
 // the request could not be sent to the server.
+//
+// Deprecated: use SubCtx.
 func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
+	return c.SubCtx(context.Background(), channel, pattern)
+}
+
+// SubCtx makes a subscription request like Sub, that is not sent if
+// ctx is done before it can be written.
+func (c *Client) SubCtx(ctx context.Context, channel string, pattern bool) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
@@ -252,7 +480,7 @@ func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
 	}
 
 	m := message.NewSub(channel, pattern)
-	if err := c.doWrite(m); err != nil {
+	if err := c.doWrite(ctx, m); err != nil {
 		return nil, err
 	}
 	return m.UUID(), nil
@@ -261,27 +489,63 @@ func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
 // Unsb makes an unsubscription request to the server for the specified
 // channel, which is treated as a pattern if pattern is true. It
 // returns the UUID of the unsb message on success, or an error if
-// the request could not be sent to the server.
+// the request could not be sent to the server. The function registered
+// for that subscription with SubFunc, if any, is removed.
+//
+// Deprecated: use UnsbCtx.
 func (c *Client) Unsb(channel string, pattern bool) (uuid.UUID, error) {
+	return c.UnsbCtx(context.Background(), channel, pattern)
+}
+
+// UnsbCtx makes an unsubscription request like Unsb, that is not sent
+// if ctx is done before it can be written.
+func (c *Client) UnsbCtx(ctx context.Context, channel string, pattern bool) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
+	c.removeSubFunc(channel, pattern)
 
 	m := message.NewUnsb(channel, pattern)
-	if err := c.doWrite(m); err != nil {
+	if err := c.doWrite(ctx, m); err != nil {
 		return nil, err
 	}
 	return m.UUID(), nil
 }
 
 // Pub makes a publish request to the server on the specified channel.
-// The v value is marshaled as JSON and sent as event payload. It returns
+// The v value is marshaled as JSON, or encoded with the codec of the
+// channel (see SetChannelCodec), and sent as event payload. It returns
 // the UUID of the pub message on success, or an error if the request could
 // not be sent to the server.
+//
+// Deprecated: use PubCtx.
 func (c *Client) Pub(channel string, v interface{}) (uuid.UUID, error) {
+	return c.PubTTLCtx(context.Background(), channel, v, 0)
+}
+
+// PubCtx makes a publish request like Pub, that is not sent if ctx is
+// done before it can be written.
+func (c *Client) PubCtx(ctx context.Context, channel string, v interface{}) (uuid.UUID, error) {
+	return c.PubTTLCtx(ctx, channel, v, 0)
+}
+
+// PubTTL makes a publish request like Pub, for an event that expires
+// after ttl. The event is dropped for the subscribers it cannot be
+// delivered to before it expires, which is useful for real-time data
+// where a stale event is worse than no event. A ttl of 0 means no
+// expiration.
+//
+// Deprecated: use PubTTLCtx.
+func (c *Client) PubTTL(channel string, v interface{}, ttl time.Duration) (uuid.UUID, error) {
+	return c.PubTTLCtx(context.Background(), channel, v, ttl)
+}
+
+// PubTTLCtx makes a publish request like PubTTL, that is not sent if
+// ctx is done before it can be written.
+func (c *Client) PubTTLCtx(ctx context.Context, channel string, v interface{}, ttl time.Duration) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
@@ -289,21 +553,75 @@ func (c *Client) Pub(channel string, v interface{}) (uuid.UUID, error) {
 		return nil, err
 	}
 
-	m, err := message.NewPub(channel, v)
+	m, err := c.newPub(channel, v)
 	if err != nil {
 		return nil, err
 	}
-	if err := c.doWrite(m); err != nil {
+	m.Payload.TTL = ttl
+	if err := c.doWrite(ctx, m); err != nil {
 		return nil, err
 	}
 	return m.UUID(), nil
 }
 
+// newPub creates the publish request on channel with the codec of the
+// channel.
+func (c *Client) newPub(channel string, v interface{}) (*message.Pub, error) {
+	codec := c.channelCodecs[channel]
+	if codec != nil {
+		args, err := codec.Encode(v)
+		if err != nil {
+			return nil, err
+		}
+		v = args
+	}
+	m, err := message.NewPub(channel, v)
+	if err != nil {
+		return nil, err
+	}
+	m.Payload.ContentType = message.ContentType(codec)
+	m.Payload.NoAck = c.ackMode != AckAll
+	return m, nil
+}
+
+// sign signs the CALL request m, and the CALL requests of m if it is a
+// batch, if the client has a signer. It is called once their metadata
+// is set.
+func (c *Client) sign(m message.Msg) error {
+	if c.signer == nil {
+		return nil
+	}
+
+	msgs := []message.Msg{m}
+	if b, ok := m.(*message.Batch); ok {
+		msgs = b.Payload.Msgs
+	}
+	for _, m := range msgs {
+		if call, ok := m.(*message.Call); ok {
+			if err := message.SignCall(c.signer, call); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // doWrite calls writeMsg and handles errors so that the connection is
-// marked as failed if the error is fatal.
-func (c *Client) doWrite(m message.Msg) error {
-	err := c.writeMsg(m)
+// marked as failed if the error is fatal. If ctx is done before the
+// write lock is acquired, its error is returned.
+func (c *Client) doWrite(ctx context.Context, m message.Msg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.setHeaders(ctx, m)
+	setActAs(ctx, m)
+	if err := c.sign(m); err != nil {
+		return err
+	}
+	err := c.writeMsg(ctx, m)
 	switch err {
+	case wswriter.ErrWriteCanceled:
+		return ctx.Err()
 	case wswriter.ErrWriteLimitExceeded,
 		wswriter.ErrWriteLockTimeout:
 		c.mu.Lock()
@@ -315,15 +633,28 @@ func (c *Client) doWrite(m message.Msg) error {
 	return err
 }
 
-func (c *Client) writeMsg(m message.Msg) error {
-	w := wswriter.Exclusive(c.conn, c.wmu, c.acquireWriteLockTimeout, c.writeTimeout)
+func (c *Client) writeMsg(ctx context.Context, m message.Msg) error {
+	// the write must complete before the deadline of ctx
+	writeTimeout := c.writeTimeout
+	if writeTimeout == 0 {
+		writeTimeout = DefaultWriteTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := deadline.Sub(time.Now()); writeTimeout <= 0 || left < writeTimeout {
+			writeTimeout = left
+		}
+	}
+	w := wswriter.ExclusiveDone(c.conn, c.wmu, ctx.Done(), c.acquireWriteLockTimeout, writeTimeout)
+	if rec := c.recorder; rec != nil {
+		w = rec.Writer(w, c.session, session.Client)
+	}
 	defer w.Close()
 
 	lw := io.Writer(w)
 	if l := c.writeLimit; l > 0 {
 		lw = wswriter.Limit(w, l)
 	}
-	return json.NewEncoder(lw).Encode(m)
+	return c.proto.Encode(lw, m)
 }
 
 // Handler defines the method required to handle a message received
@@ -353,6 +684,141 @@ func SetCallTimeout(timeout time.Duration) Option {
 	}
 }
 
+// SetCallRetry sets the maximum number of attempts of call requests,
+// and the backoff delay before the first retry, doubled on each
+// subsequent retry. The call timeout applies to each attempt, so the
+// client waits for the result of all attempts before raising an
+// expired call message. The zero value of maxAttempts means a single
+// attempt, and it must not exceed message.MaxAttempts.
+func SetCallRetry(maxAttempts int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.callMaxAttempts = maxAttempts
+		c.callBackoff = backoff
+	}
+}
+
+// SetCallPriority sets the priority of call requests, from 0, the
+// default and lowest priority, to message.MaxPriority. Call requests
+// with a higher priority are delivered to the callees before those
+// with a lower priority.
+func SetCallPriority(priority int) Option {
+	return func(c *Client) {
+		c.callPriority = priority
+	}
+}
+
+// SetCallVersion sets the version of the URI accepted by the client in
+// its calls to uri. The calls are only delivered to callees that support
+// that version, and are rejected with a NACK with
+// message.CodeUnsupportedVersion if there is none (see IsUnsupportedVersion).
+func SetCallVersion(uri, version string) Option {
+	return func(c *Client) {
+		if c.versions == nil {
+			c.versions = make(map[string]string)
+		}
+		c.versions[uri] = version
+	}
+}
+
+// AckMode defines the requests of a client that are acknowledged by the
+// server (see SetDefaultAckMode).
+type AckMode int
+
+// The list of acknowledgement modes.
+const (
+	// AckAll acknowledges all requests, the default.
+	AckAll AckMode = iota
+
+	// NoAckPub makes the PUB requests fire-and-forget: the server does
+	// not send an ACK when they succeed, only a NACK when they fail.
+	NoAckPub
+
+	// NoAckPubCall makes the PUB and CALL requests fire-and-forget. The
+	// calls still get their result or expire.
+	NoAckPubCall
+)
+
+// SetDefaultAckMode sets the acknowledgement mode of the requests made
+// by the client. Fire-and-forget requests (see message.NoAck) halve the
+// number of frames, e.g. for high-frequency telemetry published by a
+// producer that does not wait for the ACKs. The default is AckAll.
+func SetDefaultAckMode(mode AckMode) Option {
+	return func(c *Client) {
+		c.ackMode = mode
+	}
+}
+
+// SetSigner sets the signer of the calls made by the client. The
+// signature is sent in the metadata of the CALL messages, so that
+// callees can verify that their URI, arguments and the identity they
+// act as were not tampered with (see message.VerifyCall).
+func SetSigner(s message.Signer) Option {
+	return func(c *Client) {
+		c.signer = s
+	}
+}
+
+// SetCircuitBreaker enables a circuit breaker per URI: after threshold
+// consecutive failed calls to a URI, the client fails fast the calls to
+// that URI with ErrCircuitOpen for the cooldown period, after which a
+// single trial call is allowed to check if the URI recovered. Expired
+// calls and NACKs that report unhealthy callees (e.g. no callee or a
+// server error) are failures, results are successes. A Circuit message
+// is sent to the handler when the state of a circuit changes. The zero
+// value of threshold disables the circuit breaker.
+func SetCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *Client) {
+		if threshold <= 0 {
+			c.breaker = nil
+			return
+		}
+		c.breaker = &circuit.Breaker{
+			Threshold: threshold,
+			Cooldown:  cooldown,
+			OnStateChange: func(uri string, from, to circuit.State) {
+				go c.handler.Handle(context.Background(), newCircuit(uri, from, to))
+			},
+		}
+	}
+}
+
+// SetTimeSync sets the number of time synchronization exchanges to run
+// when the client is created, to estimate the offset of the server clock
+// (see Client.SyncClock). The exchanges run in the background, and
+// Client.ClockOffset returns 0 until they succeed. The timeout applies
+// to each exchange. The zero value of samples disables the exchange.
+func SetTimeSync(samples int, timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeSyncSamples = samples
+		c.timeSyncTimeout = timeout
+	}
+}
+
+// SetCodec sets the codec to use to encode the arguments of the calls
+// to uri, and to decode their results with Client.DecodeResult. By
+// default, message.JSON is used.
+func SetCodec(uri string, codec message.Codec) Option {
+	return func(c *Client) {
+		if c.codecs == nil {
+			c.codecs = make(message.Codecs)
+		}
+		c.codecs[uri] = codec
+	}
+}
+
+// SetChannelCodec sets the codec to use to encode the arguments of the
+// events published on channel, and to decode the events received on
+// that channel with Client.DecodeEvent. By default, message.JSON is
+// used.
+func SetChannelCodec(channel string, codec message.Codec) Option {
+	return func(c *Client) {
+		if c.channelCodecs == nil {
+			c.channelCodecs = make(message.Codecs)
+		}
+		c.channelCodecs[channel] = codec
+	}
+}
+
 // SetHandler sets the handler that is called with each message
 // received from the server. Each invocation runs in its own
 // goroutine, so proper synchronization must be used when accessing
@@ -363,14 +829,28 @@ func SetHandler(h Handler) Option {
 	}
 }
 
-// SetReadTimeout sets the read timeout of the connection.
+// DefaultReadTimeout is the default timeout to read a message from the
+// server, used when SetReadTimeout is not set.
+var DefaultReadTimeout = 30 * time.Second
+
+// DefaultWriteTimeout is the default timeout to write a message to the
+// server, used when SetWriteTimeout is not set.
+var DefaultWriteTimeout = 10 * time.Second
+
+// SetReadTimeout sets the timeout to read a message from the server. It
+// is set on the connection with SetReadDeadline once the message
+// starts, so that it does not apply to an idle connection. The default
+// of 0 uses DefaultReadTimeout, a negative value means no timeout.
 func SetReadTimeout(timeout time.Duration) Option {
 	return func(c *Client) {
 		c.readTimeout = timeout
 	}
 }
 
-// SetWriteTimeout sets the write timeout of the connection.
+// SetWriteTimeout sets the timeout to write a message to the server, so
+// that a stalled server cannot hold the write lock of the connection
+// forever. The default of 0 uses DefaultWriteTimeout, a negative value
+// means no timeout.
 func SetWriteTimeout(timeout time.Duration) Option {
 	return func(c *Client) {
 		c.writeTimeout = timeout
@@ -391,7 +871,30 @@ func SetAcquireWriteLockTimeout(timeout time.Duration) Option {
 // should be closed.
 func SetReadLimit(limit int64) Option {
 	return func(c *Client) {
-		c.conn.SetReadLimit(limit)
+		if c.conn != nil {
+			c.conn.SetReadLimit(limit)
+		}
+	}
+}
+
+// SetCompressionLevel sets the compression level of the messages sent on
+// the connection, from flate.BestSpeed to flate.BestCompression, if the
+// permessage-deflate extension was negotiated with the server. An
+// invalid level is ignored.
+func SetCompressionLevel(level int) Option {
+	return func(c *Client) {
+		if c.conn != nil {
+			c.conn.SetCompressionLevel(level)
+		}
+	}
+}
+
+// SetHeaders sets the headers set on all the requests of the client,
+// e.g. its locale, unless the request or the context of the request
+// (see WithHeaders) sets the same header.
+func SetHeaders(h message.Headers) Option {
+	return func(c *Client) {
+		c.headers = h.Clone()
 	}
 }
 
@@ -404,6 +907,17 @@ func SetWriteLimit(limit int64) Option {
 	}
 }
 
+// SetRecorder sets the recorder of the data frames received and sent by
+// the client, so that its session can be replayed against a server (see
+// the session package). The session of the frames is a random UUID
+// generated for the client.
+func SetRecorder(r *session.Recorder) Option {
+	return func(c *Client) {
+		c.recorder = r
+		c.session = message.NewID().String()
+	}
+}
+
 // Exp is an expired call message. It is never sent over the network, but
 // it is raised by the client for itself, when the timeout for a call
 // result has expired. As such, its message type returns false for
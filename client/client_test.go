@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -322,3 +324,191 @@ func TestClientConcurrent(t *testing.T) {
 	<-done
 	<-cli.CloseNotify()
 }
+
+var bytesCodec = message.Base64{
+	Marshal: func(v interface{}) ([]byte, error) { return v.([]byte), nil },
+	Unmarshal: func(b []byte, v interface{}) error {
+		*(v.(*[]byte)) = b
+		return nil
+	},
+}
+
+func TestClientCodec(t *testing.T) {
+	done := make(chan bool, 1)
+	var buf bytes.Buffer
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h), SetCodec("bin", bytesCodec),
+		SetChannelCodec("img", message.Binary))
+	require.NoError(t, err, "Dial")
+
+	_, err = cli.Call("bin", []byte{0, 1, 2}, time.Second)
+	require.NoError(t, err, "Call with codec")
+	_, err = cli.Call("json", []byte{0, 1, 2}, time.Second)
+	require.NoError(t, err, "Call without codec")
+	_, err = cli.Pub("img", []byte{0, 1, 2})
+	require.NoError(t, err, "Pub with codec")
+	cli.Close()
+	<-done
+
+	dec := json.NewDecoder(&buf)
+	for i, want := range []struct{ args, ct string }{{`"AAEC"`, message.DefaultBinaryContentType}, {`"AAEC"`, ""}} {
+		var m message.Call
+		require.NoError(t, dec.Decode(&m), "Decode %d", i)
+		assert.Equal(t, want.args, string(m.Payload.Args), "%d: args", i)
+		assert.Equal(t, want.ct, m.Payload.ContentType, "%d: content type", i)
+	}
+	var pub message.Pub
+	require.NoError(t, dec.Decode(&pub), "Decode pub")
+	assert.Equal(t, `"AAEC"`, string(pub.Payload.Args), "pub args")
+	assert.Equal(t, message.DefaultBinaryContentType, pub.Payload.ContentType, "pub content type")
+
+	ev := message.NewEvnt(&message.EvntPayload{Channel: "img", Args: json.RawMessage(`"AAEC"`), ContentType: message.DefaultBinaryContentType})
+	var eb []byte
+	require.NoError(t, cli.DecodeEvent(ev, &eb), "DecodeEvent with codec")
+	assert.Equal(t, []byte{0, 1, 2}, eb, "decoded event")
+
+	res := message.NewRes(&message.ResPayload{URI: "bin", Args: json.RawMessage(`"AAEC"`)})
+	var b []byte
+	require.NoError(t, cli.DecodeResult(res, &b), "DecodeResult with codec")
+	assert.Equal(t, []byte{0, 1, 2}, b, "decoded result")
+
+	res = message.NewRes(&message.ResPayload{URI: "json", Args: json.RawMessage(`"AAEC"`)})
+	var s string
+	require.NoError(t, cli.DecodeResult(res, &s), "DecodeResult without codec")
+	assert.Equal(t, "AAEC", s, "decoded JSON result")
+}
+
+func TestClientSigner(t *testing.T) {
+	done := make(chan bool, 1)
+	var buf bytes.Buffer
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	keys := &message.HMACKeys{Current: "k1", Keys: map[string][]byte{"k1": []byte("secret")}}
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h), SetSigner(keys))
+	require.NoError(t, err, "Dial")
+
+	_, err = cli.Call("a", 1, time.Second)
+	require.NoError(t, err, "Call")
+	cli.Close()
+	<-done
+
+	var m message.Call
+	require.NoError(t, json.NewDecoder(&buf).Decode(&m), "Decode")
+	if assert.NotNil(t, m.Meta.Sig, "signature") {
+		assert.Equal(t, "k1", m.Meta.Sig.KeyID, "key ID")
+		cp := &message.CallPayload{MsgUUID: m.UUID(), URI: m.Payload.URI, Args: m.Payload.Args, Signature: m.Meta.Sig}
+		assert.NoError(t, message.VerifyCall(keys, cp), "VerifyCall")
+	}
+}
+
+func TestClientHeaders(t *testing.T) {
+	done := make(chan bool, 1)
+	var buf bytes.Buffer
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h),
+		SetHeaders(message.Headers{"locale": "fr", "app": "test"}))
+	require.NoError(t, err, "Dial")
+
+	ctx := WithHeaders(context.Background(), message.Headers{"trace-id": "t1"})
+	ctx = WithHeaders(ctx, message.Headers{"locale": "en"})
+	_, err = cli.CallCtx(ctx, "a", 1, time.Second)
+	require.NoError(t, err, "CallCtx")
+	_, err = cli.Pub("b", 1)
+	require.NoError(t, err, "Pub")
+	_, err = cli.PubBatch("c", []interface{}{1})
+	require.NoError(t, err, "PubBatch")
+	cli.Close()
+	<-done
+
+	dec := json.NewDecoder(&buf)
+	var call message.Call
+	require.NoError(t, dec.Decode(&call), "Decode call")
+	assert.Equal(t, message.Headers{"locale": "en", "app": "test", "trace-id": "t1"}, call.Headers, "call headers")
+	var pub message.Pub
+	require.NoError(t, dec.Decode(&pub), "Decode pub")
+	assert.Equal(t, message.Headers{"locale": "fr", "app": "test"}, pub.Headers, "pub headers")
+	assert.Equal(t, "fr", pub.Header("locale"), "pub locale")
+	m, err := message.UnmarshalRequest(io.MultiReader(dec.Buffered(), &buf))
+	if assert.NoError(t, err, "Decode batch") {
+		b := m.(*message.Batch)
+		assert.Equal(t, "fr", b.Header("locale"), "batch locale")
+		if assert.Len(t, b.Payload.Msgs, 1, "batch messages") {
+			assert.Equal(t, "test", message.HeadersOf(b.Payload.Msgs[0]).Get("app"), "batched pub headers")
+		}
+	}
+}
+
+func TestClientCtx(t *testing.T) {
+	done := make(chan bool, 1)
+	var buf bytes.Buffer
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h))
+	require.NoError(t, err, "Dial")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cli.CallCtx(ctx, "a", nil, 0)
+	assert.Equal(t, context.Canceled, err, "CallCtx with canceled context")
+
+	// hold the write lock so that the request cannot be written
+	<-cli.wmu
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = cli.PubCtx(ctx, "b", 1)
+	assert.Equal(t, context.DeadlineExceeded, err, "PubCtx while the lock is held")
+	cli.wmu <- struct{}{}
+
+	// the client is still usable
+	_, err = cli.SubCtx(context.Background(), "c", false)
+	require.NoError(t, err, "SubCtx")
+	_, err = cli.UnsbCtx(context.Background(), "c", false)
+	require.NoError(t, err, "UnsbCtx")
+
+	require.NoError(t, cli.Close(), "Close")
+	<-done
+	assert.NotContains(t, buf.String(), `"uri":"a"`, "call not sent")
+	assert.NotContains(t, buf.String(), `"channel":"b"`, "pub not sent")
+	assert.Equal(t, 2, strings.Count(buf.String(), `"channel":"c"`), "sub and unsb sent")
+}
+
+func TestClientReadTimeout(t *testing.T) {
+	done := make(chan bool, 1)
+	stop := make(chan struct{})
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		// start a message larger than the write buffer, and stall
+		w, err := c.NextWriter(websocket.TextMessage)
+		require.NoError(t, err, "NextWriter")
+		_, err = w.Write(bytes.Repeat([]byte(" "), 10000))
+		require.NoError(t, err, "Write")
+		<-stop
+	})
+	defer srv.Close()
+
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h), SetReadTimeout(50*time.Millisecond))
+	require.NoError(t, err, "Dial")
+
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "client not closed after the read timeout")
+	}
+	close(stop)
+	<-done
+	if err := cli.Close(); assert.Error(t, err, "Close") {
+		if ne, ok := err.(net.Error); assert.True(t, ok, "net error") {
+			assert.True(t, ne.Timeout(), "timeout error")
+		}
+	}
+}
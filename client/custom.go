@@ -0,0 +1,23 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// SendCustom sends the message m of a custom type registered with
+// message.RegisterRead to the server, e.g. a domain-specific control
+// frame, which passes it to its custom message handler (see
+// juggler.Server.CustomMsgHandler). It returns an error if m is not of
+// such a type or if it could not be sent to the server. The messages
+// of the custom types registered with message.RegisterWrite are sent
+// to the handler of the client (see SetHandler), as the other
+// messages received from the server.
+func (c *Client) SendCustom(ctx context.Context, m message.Msg) error {
+	if !m.Type().IsCustomRead() {
+		return fmt.Errorf("juggler/client: %s is not a custom request message", m.Type())
+	}
+	return c.doWrite(ctx, m)
+}
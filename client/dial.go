@@ -0,0 +1,183 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultFallbackDelay is the default delay before a connection attempt
+// to the next address is started, if the previous attempts are still
+// pending. RFC 6555 recommends a delay of 150 to 250ms.
+const DefaultFallbackDelay = 250 * time.Millisecond
+
+// HappyEyeballs returns a dial function that can be used as
+// websocket.Dialer.NetDial. It resolves the host of the address and
+// races connection attempts to its IP addresses, alternating between
+// IPv6 and IPv4 addresses as described in RFC 6555. The attempts are
+// started fallbackDelay apart, or as soon as the previous attempt
+// failed, and the first connection established is returned, the others
+// are closed. This avoids waiting for the TCP timeout of an unreachable
+// address, e.g. on a broken IPv6 network, before trying the next one.
+//
+// The connection attempts use d, which may be nil. If fallbackDelay is
+// <= 0, DefaultFallbackDelay is used.
+func HappyEyeballs(d *net.Dialer, fallbackDelay time.Duration) func(network, addr string) (net.Conn, error) {
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	if fallbackDelay <= 0 {
+		fallbackDelay = DefaultFallbackDelay
+	}
+
+	return func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return d.Dial(network, addr)
+		}
+
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		addrs := sortAddrs(network, ips, port)
+		if len(addrs) == 0 {
+			return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+		}
+		return raceDial(d.Dial, network, addrs, fallbackDelay)
+	}
+}
+
+// ProxyEnv is the proxy specification of ProxyFunc for the proxy of
+// the environment.
+const ProxyEnv = "env"
+
+// ProxyFunc returns the function to set as websocket.Dialer.Proxy to
+// connect through the proxy described by spec, which is either:
+//
+//   - the URL of an HTTP proxy, e.g. "http://proxy:3128", that tunnels
+//     the connections with the CONNECT method;
+//   - the URL of a SOCKS5 proxy, e.g. "socks5://proxy:1080";
+//   - ProxyEnv, for the proxy of the HTTP_PROXY, HTTPS_PROXY and
+//     NO_PROXY environment variables (see http.ProxyFromEnvironment),
+//     the proxy of the "ws" URLs being the HTTP proxy and the one of
+//     the "wss" URLs the HTTPS proxy;
+//   - an empty string, for no proxy, in which case it returns nil.
+//
+// The credentials of the proxy, if any, are the user information of its
+// URL, sent with the basic authentication scheme to the HTTP proxies.
+func ProxyFunc(spec string) (func(*http.Request) (*url.URL, error), error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case ProxyEnv:
+		return http.ProxyFromEnvironment, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return nil, fmt.Errorf("juggler/client: unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("juggler/client: no host in proxy URL %q", spec)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// sortAddrs returns the addresses to try for the port on the IPs that
+// are valid for the network, alternating between IPv6 and IPv4 and
+// starting with IPv6.
+func sortAddrs(network string, ips []net.IP, port string) []string {
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if network != "tcp6" {
+				v4 = append(v4, net.JoinHostPort(ip.String(), port))
+			}
+		} else if network != "tcp4" {
+			v6 = append(v6, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	addrs := make([]string, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i])
+		}
+	}
+	return addrs
+}
+
+// raceDial races the connection attempts to addrs using dial, and
+// returns the first connection established, or the error of the first
+// attempt if all attempts fail.
+func raceDial(dial func(string, string) (net.Conn, error), network string, addrs []string, fallbackDelay time.Duration) (net.Conn, error) {
+	results := make(chan dialResult, len(addrs))
+
+	var next, pending int
+	start := func() <-chan time.Time {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(network, addr)
+			results <- dialResult{conn, err}
+		}()
+
+		if next < len(addrs) {
+			return time.After(fallbackDelay)
+		}
+		return nil
+	}
+
+	var firstErr error
+	fallback := start()
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go closeLosers(results, pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(addrs) {
+				// do not wait for the fallback delay after a failure
+				fallback = start()
+			}
+
+		case <-fallback:
+			fallback = start()
+		}
+	}
+	return nil, firstErr
+}
+
+// dialResult is the result of a connection attempt.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// closeLosers closes the connections established by the n attempts
+// still pending once a connection won the race.
+func closeLosers(results <-chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// lookupSRV is the function used to resolve SRV records, replaced in
+// tests.
+var lookupSRV = net.LookupSRV
+
+// Endpoints is a list of server URLs to dial with failover, so that
+// clients survive the loss of a single server without an external load
+// balancer. Dial tries the URLs in turn until a connection succeeds,
+// starting with the last URL that succeeded. An Endpoints value is safe
+// for concurrent use.
+type Endpoints struct {
+	// URLs are the URLs of the servers, tried in order.
+	URLs []string
+
+	// Random tries the URLs in random order instead, after the last URL
+	// that succeeded, if any, so that the clients are spread over the
+	// servers.
+	Random bool
+
+	mu   sync.Mutex
+	last string
+}
+
+// LookupEndpoints resolves the SRV records of the service for the
+// domain name, as with net.LookupSRV over TCP, and returns the
+// Endpoints with the URL for each target, with the scheme (e.g. "ws"
+// or "wss") and the path of the endpoint (e.g. "/ws"). The URLs are in
+// the order defined by the priorities and weights of the records.
+func LookupEndpoints(scheme, service, name, path string) (*Endpoints, error) {
+	_, addrs, err := lookupSRV(service, "tcp", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("juggler/client: no SRV record for %s", name)
+	}
+
+	urls := make([]string, len(addrs))
+	for i, a := range addrs {
+		host := net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port)))
+		urls[i] = scheme + "://" + host + path
+	}
+	return &Endpoints{URLs: urls}, nil
+}
+
+// Last returns the last URL that was dialed successfully, or an empty
+// string if no connection succeeded yet.
+func (e *Endpoints) Last() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.last
+}
+
+// Dial creates a Client connected to the first of the URLs that
+// accepts the connection, as with the Dial function. It returns the
+// error of the last attempt if no connection succeeded.
+func (e *Endpoints) Dial(d *websocket.Dialer, reqHeader http.Header, opts ...Option) (*Client, error) {
+	urls := e.order()
+	if len(urls) == 0 {
+		return nil, errors.New("juggler/client: no endpoint")
+	}
+
+	var err error
+	for _, u := range urls {
+		var c *Client
+		if c, err = Dial(d, u, reqHeader, opts...); err == nil {
+			e.mu.Lock()
+			e.last = u
+			e.mu.Unlock()
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("juggler/client: failed to connect to %d endpoints, last error: %v", len(urls), err)
+}
+
+// order returns the URLs in the order to try, starting with the last
+// URL that succeeded.
+func (e *Endpoints) order() []string {
+	e.mu.Lock()
+	last := e.last
+	e.mu.Unlock()
+
+	urls := make([]string, 0, len(e.URLs))
+	if last != "" {
+		urls = append(urls, last)
+	}
+	start := len(urls)
+	for _, u := range e.URLs {
+		if u != last {
+			urls = append(urls, u)
+		}
+	}
+	if e.Random {
+		rest := append([]string(nil), urls[start:]...)
+		for i, j := range rand.Perm(len(rest)) {
+			urls[start+i] = rest[j]
+		}
+	}
+	return urls
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/PuerkitoBio/juggler/internal/wstest"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointsDial(t *testing.T) {
+	done := make(chan bool, 10)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		c.NextReader()
+	})
+	defer srv.Close()
+
+	// a closed listener, so that the connection is refused
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Listen")
+	down := "ws://" + l.Addr().String()
+	l.Close()
+
+	e := &Endpoints{URLs: []string{down, srv.URL}}
+	c, err := e.Dial(&websocket.Dialer{}, nil)
+	require.NoError(t, err, "Dial with failover")
+	c.Close()
+	assert.Equal(t, srv.URL, e.Last(), "last-good endpoint")
+	assert.Equal(t, []string{srv.URL, down}, e.order(), "last-good endpoint first")
+
+	e.Random = true
+	for i := 0; i < 10; i++ {
+		got := e.order()
+		assert.Equal(t, srv.URL, got[0], "%d: last-good endpoint first when random", i)
+		assert.Equal(t, 2, len(got), "%d: all URLs", i)
+	}
+
+	e = &Endpoints{URLs: []string{down}}
+	_, err = e.Dial(&websocket.Dialer{}, nil)
+	assert.Error(t, err, "no endpoint available")
+	assert.Equal(t, "", e.Last(), "no last-good endpoint")
+
+	_, err = (&Endpoints{}).Dial(&websocket.Dialer{}, nil)
+	assert.Error(t, err, "no endpoint")
+}
+
+func TestLookupEndpoints(t *testing.T) {
+	defer func() { lookupSRV = net.LookupSRV }()
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		assert.Equal(t, "juggler", service, "service")
+		assert.Equal(t, "tcp", proto, "proto")
+		assert.Equal(t, "example.com", name, "name")
+		return "", []*net.SRV{
+			{Target: "a.example.com.", Port: 9000, Priority: 1},
+			{Target: "b.example.com.", Port: 9001, Priority: 2},
+		}, nil
+	}
+
+	e, err := LookupEndpoints("wss", "juggler", "example.com", "/ws")
+	require.NoError(t, err, "LookupEndpoints")
+	assert.Equal(t, []string{"wss://a.example.com:9000/ws", "wss://b.example.com:9001/ws"}, e.URLs, "URLs")
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, nil
+	}
+	_, err = LookupEndpoints("wss", "juggler", "example.com", "/ws")
+	assert.Error(t, err, "no record")
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// Error is the error of a NACK message received from the server. Use
+// NackError to get the Error of a NACK message, and the Is* functions
+// to check for the standard codes defined in the message package.
+type Error struct {
+	// Code is the code of the NACK, usually one of the message.Code
+	// constants.
+	Code int
+
+	// Message is the error message of the NACK.
+	Message string
+
+	// Details is the optional structured payload of the error, if any.
+	Details json.RawMessage
+
+	// Nack is the NACK message that failed the request.
+	Nack *message.Nack
+}
+
+// Error returns the error message.
+func (e *Error) Error() string {
+	return fmt.Sprintf("juggler/client: %d %s", e.Code, e.Message)
+}
+
+// DecodeDetails decodes the structured payload of the error into v.
+// It does nothing and returns nil if the error has no details.
+func (e *Error) DecodeDetails(v interface{}) error {
+	if len(e.Details) == 0 {
+		return nil
+	}
+	return json.Unmarshal(e.Details, v)
+}
+
+// NackError returns the error of the NACK message as an *Error.
+func NackError(m *message.Nack) error {
+	return &Error{
+		Code:    m.Payload.Code,
+		Message: m.Payload.Message,
+		Details: m.Payload.Details,
+		Nack:    m,
+	}
+}
+
+// IsCode returns true if err is an *Error with the specified code.
+func IsCode(err error, code int) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
+}
+
+// IsUnauthorized returns true if err is an *Error with the
+// message.CodeUnauthorized code.
+func IsUnauthorized(err error) bool {
+	return IsCode(err, message.CodeUnauthorized)
+}
+
+// IsTimeout returns true if err is an *Error with the
+// message.CodeTimeout code.
+func IsTimeout(err error) bool {
+	return IsCode(err, message.CodeTimeout)
+}
+
+// IsNoCallee returns true if err is an *Error with the
+// message.CodeNoCallee code.
+func IsNoCallee(err error) bool {
+	return IsCode(err, message.CodeNoCallee)
+}
+
+// IsRateLimited returns true if err is an *Error with the
+// message.CodeRateLimited code.
+func IsRateLimited(err error) bool {
+	return IsCode(err, message.CodeRateLimited)
+}
+
+// IsHandlerError returns true if err is an *Error with the
+// message.CodeHandlerError code.
+func IsHandlerError(err error) bool {
+	return IsCode(err, message.CodeHandlerError)
+}
+
+// IsPayloadTooLarge returns true if err is an *Error with the
+// message.CodePayloadTooLarge code.
+func IsPayloadTooLarge(err error) bool {
+	return IsCode(err, message.CodePayloadTooLarge)
+}
+
+// IsUnsupportedVersion returns true if err is an *Error with the
+// message.CodeUnsupportedVersion code.
+func IsUnsupportedVersion(err error) bool {
+	return IsCode(err, message.CodeUnsupportedVersion)
+}
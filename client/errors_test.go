@@ -0,0 +1,61 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type rateLimitErr struct {
+	RetryAfter int `json:"retry_after"`
+}
+
+func (e rateLimitErr) Error() string { return "rate limited" }
+
+func (e rateLimitErr) MarshalJSON() ([]byte, error) {
+	type plain rateLimitErr
+	return json.Marshal(plain(e))
+}
+
+func TestNackError(t *testing.T) {
+	call, err := message.NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+
+	err = NackError(message.NewNack(call, message.CodeRateLimited, rateLimitErr{RetryAfter: 3}))
+	assert.True(t, IsRateLimited(err), "IsRateLimited")
+	assert.False(t, IsTimeout(err), "IsTimeout")
+	assert.Equal(t, "juggler/client: 429 rate limited", err.Error(), "error message")
+
+	var details rateLimitErr
+	require.NoError(t, err.(*Error).DecodeDetails(&details), "DecodeDetails")
+	assert.Equal(t, 3, details.RetryAfter, "details")
+
+	err = NackError(message.NewNack(call, message.CodeHandlerError, io.EOF))
+	assert.True(t, IsHandlerError(err), "IsHandlerError")
+	assert.Nil(t, err.(*Error).Details, "no details")
+	require.NoError(t, err.(*Error).DecodeDetails(&details), "DecodeDetails without details")
+
+	cases := []struct {
+		code int
+		fn   func(error) bool
+	}{
+		{message.CodeUnauthorized, IsUnauthorized},
+		{message.CodeTimeout, IsTimeout},
+		{message.CodeNoCallee, IsNoCallee},
+		{message.CodeRateLimited, IsRateLimited},
+		{message.CodeHandlerError, IsHandlerError},
+		{message.CodePayloadTooLarge, IsPayloadTooLarge},
+		{message.CodeUnsupportedVersion, IsUnsupportedVersion},
+	}
+	for _, c := range cases {
+		assert.True(t, c.fn(NackError(message.NewNack(call, c.code, io.EOF))), "%d: matching code", c.code)
+		assert.False(t, c.fn(NackError(message.NewNack(call, 499, io.EOF))), "%d: other code", c.code)
+		assert.False(t, c.fn(errors.New("x")), "%d: other error", c.code)
+	}
+}
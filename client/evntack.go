@@ -0,0 +1,43 @@
+package client
+
+import (
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// SubAcked makes a subscription request to channel in acknowledged mode,
+// on servers that support it (see juggler.Server.EventAcks). The events
+// of the subscription carry a delivery tag (see message.EvntPayload.Tag)
+// that must be acknowledged with AckEvnts once the event is processed.
+// The events that are not acknowledged are delivered again when the
+// same identity subscribes again, e.g. after a reconnect, along with
+// the events published in the meantime. The request is not sent if ctx
+// is done before it can be written. It returns the UUID of the sub
+// message on success, or an error if the request could not be sent to
+// the server.
+func (c *Client) SubAcked(ctx context.Context, channel string) (uuid.UUID, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	m := message.NewSub(channel, false)
+	m.Payload.Acked = true
+	if err := c.doWrite(ctx, m); err != nil {
+		return nil, err
+	}
+	return m.UUID(), nil
+}
+
+// AckEvnts acknowledges the events of the subscriptions in acknowledged
+// mode with the delivery tags, so that they are not delivered again.
+// The acknowledgement is a call to message.EvntAckURI with the default
+// call timeout, whose result is the message.EvntAck with the tags that
+// were acknowledged. It returns the UUID of the call message on success,
+// or an error if the request could not be sent to the server.
+func (c *Client) AckEvnts(ctx context.Context, tags ...string) (uuid.UUID, error) {
+	return c.CallCtx(ctx, message.EvntAckURI, &message.EvntAck{Tags: tags}, 0)
+}
@@ -0,0 +1,20 @@
+package client
+
+import (
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// GrantCredits grants the server credits to send that many more events
+// for the subscription to channel, which is a pattern if pattern is
+// true, on servers with flow control (see juggler.Server.FlowControl).
+// Once a subscription got a grant, the server stops sending its events
+// when the credits run out, so the client should grant more credits as
+// it processes the events. The grant is a call to message.CreditURI
+// with the default call timeout, whose result is the message.CreditGrant
+// with the credits left. It returns the UUID of the call message on
+// success, or an error if the request could not be sent to the server.
+func (c *Client) GrantCredits(ctx context.Context, channel string, pattern bool, credits int) (uuid.UUID, error) {
+	return c.CallCtx(ctx, message.CreditURI, &message.CreditGrant{Channel: channel, Pattern: pattern, Credits: credits}, 0)
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// Gap is a missed events message. Like Exp, it is never sent over the
+// network, it is raised by the client for itself when it receives an
+// event whose sequence number is not the one following the last event
+// received on its channel (see SetGapDetection).
+type Gap struct {
+	message.Meta `json:"meta"`
+	Payload      struct {
+		Channel string `json:"channel"`
+		From    uint64 `json:"from"` // sequence number of the first missed event
+		To      uint64 `json:"to"`   // sequence number of the last missed event
+	} `json:"payload"`
+}
+
+// GapMsg is the message type of the missed events message.
+var GapMsg = message.Register("GAP")
+
+func newGap(channel string, from, to uint64) *Gap {
+	m := &Gap{
+		Meta: message.NewMeta(GapMsg),
+	}
+	m.Payload.Channel = channel
+	m.Payload.From = from
+	m.Payload.To = to
+	return m
+}
+
+// SetGapDetection enables the detection of the missed events, based on
+// the sequence numbers stamped on the events by the broker (see
+// message.EvntPayload.Seq). When an event is received with a sequence
+// number that skips some after the last event received on its channel,
+// a Gap message is sent to the handler with the range of missed events,
+// e.g. so that they can be fetched from the channel history. The events
+// may have been dropped by the server or the broker, or published while
+// the client was not subscribed to the channel. The events without a
+// sequence number are ignored, and an older sequence number resets the
+// detection for the channel, e.g. if the broker's counter was reset.
+func SetGapDetection(enabled bool) Option {
+	return func(c *Client) {
+		c.detectGaps = enabled
+	}
+}
+
+// detectGap records the sequence number of the event m and raises a
+// Gap message if events were missed since the last event of its channel.
+func (c *Client) detectGap(m message.Msg) {
+	ev, ok := m.(*message.Evnt)
+	if !ok || !c.detectGaps || ev.Payload.Seq == 0 {
+		return
+	}
+
+	if c.lastSeqs == nil {
+		c.lastSeqs = make(map[string]uint64)
+	}
+	ch, seq := ev.Payload.Channel, ev.Payload.Seq
+	last, ok := c.lastSeqs[ch]
+	c.lastSeqs[ch] = seq
+	if ok && seq > last+1 {
+		go c.handler.Handle(context.Background(), newGap(ch, last+1, seq-1))
+	}
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/juggler/internal/wstest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientGapDetection(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		seqs := []struct {
+			channel string
+			seq     uint64
+		}{
+			{"a", 1}, {"a", 2}, {"b", 5}, {"a", 5}, {"b", 6}, {"a", 0}, {"a", 6}, {"b", 1}, {"b", 3},
+		}
+		for _, s := range seqs {
+			ev := message.NewEvnt(&message.EvntPayload{MsgUUID: message.NewID(), Channel: s.channel, Seq: s.seq})
+			if !assert.NoError(t, c.WriteJSON(ev), "WriteJSON EVNT") {
+				return
+			}
+		}
+		c.NextReader()
+	})
+	defer srv.Close()
+
+	gaps := make(chan *Gap, 10)
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		if m, ok := m.(*Gap); ok {
+			gaps <- m
+		}
+	})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h), SetGapDetection(true))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-gaps:
+			got = append(got, fmt.Sprintf("%s:%d-%d", m.Payload.Channel, m.Payload.From, m.Payload.To))
+		case <-time.After(time.Second):
+			require.FailNow(t, "no gap")
+		}
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{"a:3-4", "b:2-2"}, got, "gaps")
+
+	select {
+	case m := <-gaps:
+		assert.Fail(t, "unexpected gap", "%v", m.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
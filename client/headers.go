@@ -0,0 +1,65 @@
+package client
+
+import (
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+type headersKey struct{}
+
+// WithHeaders returns a copy of ctx with the headers h, which are set on
+// the requests made with that context, e.g. with CallCtx or PubCtx, in
+// addition to the headers set by the SetHeaders option. The headers of
+// the messages received from the server are read with their Header
+// method, or with message.HeadersOf.
+func WithHeaders(ctx context.Context, h message.Headers) context.Context {
+	if prev := HeadersFromContext(ctx); len(prev) > 0 {
+		merged := prev.Clone()
+		for k, v := range h {
+			merged[k] = v
+		}
+		h = merged
+	}
+	return context.WithValue(ctx, headersKey{}, h)
+}
+
+// HeadersFromContext returns the headers of the context set by
+// WithHeaders, or nil if there are none.
+func HeadersFromContext(ctx context.Context) message.Headers {
+	h, _ := ctx.Value(headersKey{}).(message.Headers)
+	return h
+}
+
+// setHeaders sets the headers of the client and of ctx on the request m,
+// and on the requests of m if it is a batch. The headers of ctx take
+// precedence over those of the client, and the headers already set on m
+// are not overridden.
+func (c *Client) setHeaders(ctx context.Context, m message.Msg) {
+	ch, xh := c.headers, HeadersFromContext(ctx)
+	if len(ch) == 0 && len(xh) == 0 {
+		return
+	}
+
+	set := func(m message.Msg) {
+		hm, ok := m.(interface {
+			SetHeader(string, string)
+		})
+		if !ok {
+			return
+		}
+		own := message.HeadersOf(m).Clone()
+		for _, h := range []message.Headers{ch, xh} {
+			for k, v := range h {
+				if _, ok := own[k]; !ok {
+					hm.SetHeader(k, v)
+				}
+			}
+		}
+	}
+	set(m)
+	if b, ok := m.(*message.Batch); ok {
+		for _, im := range b.Payload.Msgs {
+			set(im)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// ErrCallExpired is returned by Client.Invoke when the result of the
+// call is not received before the call timeout expires.
+var ErrCallExpired = errors.New("juggler/client: call expired")
+
+// ResultError is the error returned by Client.Invoke when the call
+// returns an error result (see message.ErrResult).
+type ResultError struct {
+	// URI is the URI of the call.
+	URI string
+
+	// Message is the message of the error result.
+	Message string
+
+	// Result is the error result, which may have more fields than the
+	// message.
+	Result json.RawMessage
+}
+
+// Error returns the error message.
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("juggler/client: call to %s failed: %s", e.URI, e.Message)
+}
+
+// Invoke makes a call request like Call and waits for its result, which
+// is decoded into result as with DecodeResult, unless result is nil.
+// The RES or NACK of the call is not sent to the handler. It returns
+// an *Error if the request is rejected with a NACK, a *ResultError if
+// the call returns an error result, ErrCallExpired if no result is
+// received before the call timeout, ErrCircuitOpen if the circuit of
+// the URI is open (see SetCircuitBreaker), and the error of ctx if it
+// is done before the result is received. If ctx has a deadline that
+// expires before the call timeout, the time left before the deadline
+// is used as timeout.
+func (c *Client) Invoke(ctx context.Context, uri string, v, result interface{}, timeout time.Duration) error {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if c.breaker != nil && !c.breaker.Allow(uri) {
+		return ErrCircuitOpen
+	}
+
+	if timeout <= 0 {
+		timeout = c.callTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return context.DeadlineExceeded
+		}
+		if timeout <= 0 || left < timeout {
+			timeout = left
+		}
+	}
+
+	m, err := c.newCall(uri, v, timeout)
+	if err != nil {
+		return err
+	}
+	ch := c.addWaiter(m)
+	defer c.deleteWaiter(m)
+
+	if err := c.doWrite(ctx, m); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+
+	case <-c.stop:
+		c.mu.Lock()
+		err = c.err
+		c.mu.Unlock()
+		if err == nil {
+			err = errors.New("closed connection")
+		}
+		return err
+
+	case <-time.After(callExpiration(m, timeout)):
+		if c.breaker != nil {
+			c.breaker.Failure(uri)
+		}
+		return ErrCallExpired
+
+	case resp := <-ch:
+		switch resp := resp.(type) {
+		case *message.Nack:
+			return NackError(resp)
+		case *message.Res:
+			if resp.Payload.ContentType == "" {
+				if msg, ok := errResultMessage(resp.Payload.Args); ok {
+					return &ResultError{URI: uri, Message: msg, Result: resp.Payload.Args}
+				}
+			}
+			if result == nil {
+				return nil
+			}
+			return c.DecodeResult(resp, result)
+		}
+		return fmt.Errorf("juggler/client: unexpected call response %s", resp.Type())
+	}
+}
+
+// CallJSON makes a call request with args and waits for its result,
+// which is decoded into out unless it is nil. It is Invoke with the
+// default call timeout of the client (see SetCallTimeout), the ctx
+// deadline still applies. Args and result are JSON unless a codec is
+// set for the URI (see SetCodec). A result that cannot be decoded into
+// out returns a *message.ArgsError, the other errors are those of
+// Invoke.
+func (c *Client) CallJSON(ctx context.Context, uri string, args, out interface{}) error {
+	return c.Invoke(ctx, uri, args, out, 0)
+}
+
+// errResultMessage returns the message of the error result and true
+// if args is an error result.
+func errResultMessage(args json.RawMessage) (string, bool) {
+	var v struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(args, &v); err != nil || v.Error == nil {
+		// not an object, or no error field
+		return "", false
+	}
+	return v.Error.Message, true
+}
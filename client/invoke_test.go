@@ -0,0 +1,110 @@
+package client
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/juggler/internal/wstest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvoke(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+
+			call := m.(*message.Call)
+			if call.Payload.URI == "nack" {
+				if !assert.NoError(t, c.WriteJSON(message.NewNack(call, message.CodeBadRequest, io.EOF)), "WriteJSON NACK") {
+					return
+				}
+				continue
+			}
+			if !assert.NoError(t, c.WriteJSON(message.NewAck(call)), "WriteJSON ACK") {
+				return
+			}
+
+			var args []byte
+			switch call.Payload.URI {
+			case "echo":
+				args = call.Payload.Args
+			case "fail":
+				args = []byte(`{"error": {"message": "boom"}}`)
+			case "never":
+				continue
+			}
+			res := message.NewRes(&message.ResPayload{
+				MsgUUID: call.UUID(),
+				URI:     call.Payload.URI,
+				Args:    args,
+			})
+			if !assert.NoError(t, c.WriteJSON(res), "WriteJSON RES") {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	var handled int32
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		atomic.AddInt32(&handled, 1)
+	})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h), SetCallTimeout(time.Second))
+	require.NoError(t, err, "Dial")
+
+	ctx := context.Background()
+	var got map[string]int
+	require.NoError(t, cli.Invoke(ctx, "echo", map[string]int{"a": 1}, &got, time.Second), "Invoke echo")
+	assert.Equal(t, map[string]int{"a": 1}, got, "result")
+	assert.NoError(t, cli.Invoke(ctx, "echo", 1, nil, time.Second), "Invoke without result")
+
+	got = nil
+	require.NoError(t, cli.CallJSON(ctx, "echo", map[string]int{"b": 2}, &got), "CallJSON echo")
+	assert.Equal(t, map[string]int{"b": 2}, got, "CallJSON result")
+	err = cli.CallJSON(ctx, "echo", "x", &got)
+	if assert.IsType(t, &message.ArgsError{}, err, "malformed result") {
+		ae := err.(*message.ArgsError)
+		assert.Equal(t, message.ResMsg, ae.Type, "malformed result type")
+		assert.Equal(t, "echo", ae.Name, "malformed result URI")
+		assert.Equal(t, `"x"`, string(ae.Args), "malformed result args")
+	}
+
+	err = cli.Invoke(ctx, "fail", nil, nil, time.Second)
+	if assert.IsType(t, &ResultError{}, err, "error result") {
+		assert.Equal(t, "boom", err.(*ResultError).Message, "error result message")
+	}
+	err = cli.Invoke(ctx, "nack", nil, nil, time.Second)
+	assert.True(t, IsCode(err, message.CodeBadRequest), "NACK error")
+
+	err = cli.Invoke(ctx, "never", nil, nil, 20*time.Millisecond)
+	assert.Equal(t, ErrCallExpired, err, "expired call")
+
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = cli.Invoke(cctx, "never", nil, nil, time.Minute)
+	assert.Error(t, err, "context deadline")
+	assert.True(t, time.Since(start) < time.Second, "context deadline used as timeout")
+
+	// the responses to Invoke are not sent to the handler
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&handled), "handled messages")
+
+	require.NoError(t, cli.Close(), "Close")
+	<-done
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+)
+
+// ErrPingTimeout is returned by Client.Ping when the server does not
+// answer the ping before the timeout.
+var ErrPingTimeout = errors.New("juggler/client: ping timed out")
+
+// Ping sends a websocket ping to the server and waits for its pong for
+// up to timeout. It returns nil if the pong is received, ErrPingTimeout
+// if it is not received in time, or the error of the connection if it
+// fails. It can be used to check that the connection is healthy.
+func (c *Client) Ping(timeout time.Duration) error {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	data := uuid.NewRandom().String()
+	ch := make(chan struct{})
+	c.mu.Lock()
+	c.pings[data] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pings, data)
+		c.mu.Unlock()
+	}()
+
+	if err := c.conn.WriteControl(websocket.PingMessage, []byte(data), time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-c.stop:
+		c.mu.Lock()
+		err = c.err
+		c.mu.Unlock()
+		if err == nil {
+			err = errors.New("closed connection")
+		}
+		return err
+	case <-time.After(timeout):
+		return ErrPingTimeout
+	}
+}
+
+// handlePong signals the Ping waiting for the pong with data, and calls
+// the pong handler ph that was set on the connection.
+func (c *Client) handlePong(ph func(string) error) func(string) error {
+	return func(data string) error {
+		c.mu.Lock()
+		if ch := c.pings[data]; ch != nil {
+			close(ch)
+			delete(c.pings, data)
+		}
+		c.mu.Unlock()
+		return ph(data)
+	}
+}
@@ -0,0 +1,325 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// DefaultHealthCheckInterval is the default interval between two health
+// checks of a connection of a Pool.
+const DefaultHealthCheckInterval = 10 * time.Second
+
+var (
+	// ErrNoConn is returned by the methods of a Pool when it has no
+	// healthy connection to send the request on.
+	ErrNoConn = errors.New("juggler/client: no connection available")
+
+	// ErrPoolClosed is returned by the methods of a Pool once it is
+	// closed.
+	ErrPoolClosed = errors.New("juggler/client: pool closed")
+)
+
+// Pool maintains connections to one or more juggler servers and
+// load-balances the requests over them, in turn. Each connection is
+// health-checked with Client.Ping, and replaced with a new connection
+// when it fails or is closed. The calls to idempotent URIs that fail
+// because of their connection are retried transparently on another
+// connection.
+//
+// The fields must be set before the call to Open, and must not be
+// modified afterwards. The messages received on the connections are
+// handled by the Handler of each client, as set by Dial, so a single
+// handler is typically used for all the clients.
+type Pool struct {
+	// Dial returns a new client connected to the server at urlStr, e.g.
+	// with the Dial function of the package, the dialer, the request
+	// headers and the options of the clients.
+	Dial func(urlStr string) (*Client, error)
+
+	// URLs are the URLs of the servers. The connections are spread over
+	// the URLs in turn.
+	URLs []string
+
+	// Size is the number of connections maintained by the pool. If it
+	// is <= 0, one connection is maintained per URL.
+	Size int
+
+	// HealthCheckInterval is the interval between two health checks of
+	// a connection, and the delay before a failed connection attempt is
+	// retried. If it is 0, DefaultHealthCheckInterval is used.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout is the time to wait for the pong of a health
+	// check, after which the connection is closed and replaced. If it
+	// is 0, half the HealthCheckInterval is used.
+	HealthCheckTimeout time.Duration
+
+	// Idempotent returns true if the calls to uri can safely be made
+	// more than once. Those calls are retried on another connection
+	// when their connection fails, once per connection. If Idempotent
+	// is nil, no call is retried.
+	Idempotent func(uri string) bool
+
+	// LogFunc is the function called to log events, such as failed
+	// connections. If nil, events are not logged.
+	LogFunc func(string, ...interface{})
+
+	mu     sync.Mutex
+	conns  []*poolConn
+	next   int
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// poolConn is a connection of a Pool. Its client is nil while it is
+// being replaced.
+type poolConn struct {
+	url string
+	c   *Client
+}
+
+// Open opens the connections of the pool, and starts maintaining them.
+// The connections that fail are retried in the background, it returns
+// an error only if no connection could be established, in which case
+// the pool is closed.
+func (p *Pool) Open() error {
+	if len(p.URLs) == 0 {
+		return errors.New("juggler/client: no URL in pool")
+	}
+	size := p.Size
+	if size <= 0 {
+		size = len(p.URLs)
+	}
+
+	p.mu.Lock()
+	p.stop = make(chan struct{})
+	p.conns = make([]*poolConn, size)
+	p.mu.Unlock()
+
+	var firstErr error
+	var ok bool
+	for i := range p.conns {
+		pc := &poolConn{url: p.URLs[i%len(p.URLs)]}
+		c, err := p.Dial(pc.url)
+		if err != nil {
+			p.logf("Pool: failed to connect to %s: %v", pc.url, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			pc.c = c
+			ok = true
+		}
+
+		p.mu.Lock()
+		p.conns[i] = pc
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go p.maintain(pc, c)
+	}
+
+	if !ok {
+		p.Close()
+		return firstErr
+	}
+	return nil
+}
+
+// Close closes the pool and its connections.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	if p.stop != nil {
+		close(p.stop)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return nil
+}
+
+// maintain health-checks the connection pc, whose current client is c,
+// and replaces it when it fails, until the pool is closed.
+func (p *Pool) maintain(pc *poolConn, c *Client) {
+	defer p.wg.Done()
+
+	interval := p.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	timeout := p.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = interval / 2
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var closed <-chan struct{}
+		if c != nil {
+			closed = c.CloseNotify()
+		}
+
+		select {
+		case <-p.stop:
+			if c != nil {
+				c.Close()
+			}
+			return
+
+		case <-closed:
+			p.logf("Pool: connection to %s closed", pc.url)
+			c = p.replace(pc)
+
+		case <-ticker.C:
+			if c == nil {
+				c = p.replace(pc)
+				continue
+			}
+			if err := c.Ping(timeout); err != nil {
+				p.logf("Pool: health check of connection to %s failed: %v", pc.url, err)
+				c.Close()
+				c = p.replace(pc)
+			}
+		}
+	}
+}
+
+// replace unsets the client of pc and dials a new one. It returns the
+// new client, or nil if the connection failed.
+func (p *Pool) replace(pc *poolConn) *Client {
+	p.mu.Lock()
+	pc.c = nil
+	p.mu.Unlock()
+
+	c, err := p.Dial(pc.url)
+	if err != nil {
+		p.logf("Pool: failed to connect to %s: %v", pc.url, err)
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close()
+		return nil
+	}
+	pc.c = c
+	return c
+}
+
+// Get returns the next healthy client of the pool, in turn. It returns
+// ErrNoConn if no client is healthy.
+func (p *Pool) Get() (*Client, error) {
+	return p.get(nil)
+}
+
+// get returns the next healthy client that is not in tried.
+func (p *Pool) get(tried map[*Client]bool) (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	for i := 0; i < len(p.conns); i++ {
+		pc := p.conns[p.next]
+		p.next = (p.next + 1) % len(p.conns)
+		if pc != nil && pc.c != nil && !tried[pc.c] {
+			return pc.c, nil
+		}
+	}
+	return nil, ErrNoConn
+}
+
+// Call makes a call request as with Client.Call on the next healthy
+// connection. If the URI is idempotent and the request cannot be sent
+// on that connection, it is sent on another one.
+func (p *Pool) Call(uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := p.retry(uri, func(c *Client) error {
+		var err error
+		id, err = c.CallCtx(context.Background(), uri, v, timeout)
+		return err
+	})
+	return id, err
+}
+
+// Invoke makes a call request and waits for its result as with
+// Client.Invoke on the next healthy connection. If the URI is
+// idempotent and the connection fails before the result is received,
+// the call is made on another connection, as long as ctx is not done.
+func (p *Pool) Invoke(ctx context.Context, uri string, v, result interface{}, timeout time.Duration) error {
+	return p.retry(uri, func(c *Client) error {
+		return c.Invoke(ctx, uri, v, result, timeout)
+	})
+}
+
+// Pub makes a publish request as with Client.Pub on the next healthy
+// connection. Publish requests are never retried.
+func (p *Pool) Pub(channel string, v interface{}) (uuid.UUID, error) {
+	c, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	return c.PubCtx(context.Background(), channel, v)
+}
+
+// retry calls fn with the next healthy client, and again with another
+// client if uri is idempotent and fn failed because of its connection.
+func (p *Pool) retry(uri string, fn func(c *Client) error) error {
+	idempotent := p.Idempotent != nil && p.Idempotent(uri)
+
+	tried := make(map[*Client]bool)
+	var lastErr error
+	for {
+		c, err := p.get(tried)
+		if err != nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+
+		err = fn(c)
+		if err == nil || !idempotent || !isConnError(err) {
+			return err
+		}
+		p.logf("Pool: call to %s failed, retrying on another connection: %v", uri, err)
+		tried[c] = true
+		lastErr = err
+	}
+}
+
+// isConnError returns true if err is a failure of the connection, and
+// not the outcome of the request.
+func isConnError(err error) bool {
+	switch err.(type) {
+	case *Error, *ResultError,
+		*json.UnsupportedTypeError, *json.UnsupportedValueError, *json.MarshalerError:
+		return false
+	}
+	switch err {
+	case ErrCallExpired, ErrCircuitOpen, context.Canceled, context.DeadlineExceeded:
+		return false
+	}
+	return true
+}
+
+func (p *Pool) logf(f string, args ...interface{}) {
+	if p.LogFunc != nil {
+		p.LogFunc(f, args...)
+	}
+}
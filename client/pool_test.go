@@ -0,0 +1,129 @@
+package client
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/juggler/internal/wstest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startNamedServer starts a server that answers the calls with its name,
+// and closes the connection on calls to "drop" if drop is true.
+func startNamedServer(t *testing.T, done chan bool, name string, drop bool) *httptest.Server {
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+			call := m.(*message.Call)
+			if drop && call.Payload.URI == "drop" {
+				return
+			}
+			if !assert.NoError(t, c.WriteJSON(message.NewAck(call)), "WriteJSON ACK") {
+				return
+			}
+			res := message.NewRes(&message.ResPayload{
+				MsgUUID: call.UUID(),
+				URI:     call.Payload.URI,
+				Args:    []byte(`"` + name + `"`),
+			})
+			if !assert.NoError(t, c.WriteJSON(res), "WriteJSON RES") {
+				return
+			}
+		}
+	})
+	return srv
+}
+
+func TestPool(t *testing.T) {
+	done := make(chan bool, 100)
+	srvA := startNamedServer(t, done, "a", true)
+	defer srvA.Close()
+	srvB := startNamedServer(t, done, "b", false)
+	defer srvB.Close()
+
+	p := &Pool{
+		Dial: func(urlStr string) (*Client, error) {
+			return Dial(&websocket.Dialer{}, urlStr, nil)
+		},
+		URLs:                []string{srvA.URL, srvB.URL},
+		HealthCheckInterval: 50 * time.Millisecond,
+		Idempotent:          func(uri string) bool { return uri == "drop" },
+	}
+	require.NoError(t, p.Open(), "Open")
+
+	ctx := context.Background()
+	counts := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		var name string
+		require.NoError(t, p.Invoke(ctx, "who", nil, &name, time.Second), "%d: Invoke", i)
+		counts[name]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, counts, "load-balanced calls")
+
+	// calls on a fail with the connection, and are retried on b
+	for i := 0; i < 2; i++ {
+		var name string
+		require.NoError(t, p.Invoke(ctx, "drop", nil, &name, time.Second), "%d: Invoke drop", i)
+		assert.Equal(t, "b", name, "%d: retried on b", i)
+	}
+
+	// the dropped connection is replaced
+	time.Sleep(150 * time.Millisecond)
+	counts = make(map[string]int)
+	for i := 0; i < 4; i++ {
+		var name string
+		require.NoError(t, p.Invoke(ctx, "who", nil, &name, time.Second), "%d: Invoke after reconnect", i)
+		counts[name]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, counts, "load-balanced calls after reconnect")
+
+	c, err := p.Get()
+	require.NoError(t, err, "Get")
+	assert.NoError(t, c.Ping(time.Second), "Ping")
+
+	require.NoError(t, p.Close(), "Close")
+	_, err = p.Get()
+	assert.Equal(t, ErrPoolClosed, err, "Get after Close")
+	assert.Equal(t, ErrPoolClosed, p.Invoke(ctx, "who", nil, nil, time.Second), "Invoke after Close")
+}
+
+func TestPoolNoConn(t *testing.T) {
+	p := &Pool{
+		Dial: func(urlStr string) (*Client, error) {
+			return nil, errors.New("dial failed")
+		},
+		URLs: []string{"ws://a", "ws://b"},
+	}
+	assert.EqualError(t, p.Open(), "dial failed", "Open")
+}
+
+func TestIsConnError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("closed connection"), true},
+		{&Error{Code: message.CodeHandlerError}, false},
+		{&ResultError{URI: "a"}, false},
+		{ErrCallExpired, false},
+		{ErrCircuitOpen, false},
+		{context.Canceled, false},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.want, isConnError(c.err), "%d: %v", i, c.err)
+	}
+}
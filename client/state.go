@@ -0,0 +1,68 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/PuerkitoBio/juggler/internal/mergepatch"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// ErrNoState is returned by States.Apply when a patch is received for
+// a channel without a known state.
+var ErrNoState = errors.New("no state for channel")
+
+// States tracks the state of the state channels the client is
+// subscribed to. The server sends the full state of such channels
+// on the first event, and then only the changes as a JSON merge patch.
+// The zero value is ready to use, and it is safe to use concurrently.
+type States struct {
+	mu sync.Mutex
+	m  map[string]json.RawMessage
+}
+
+// Apply updates the state of the channel of the event and returns the
+// new full state. If the event is a patch and the state of the channel
+// is unknown, ErrNoState is returned; the full state will be received
+// on a subsequent event.
+func (s *States) Apply(ev *message.Evnt) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := ev.Payload.Channel
+	state := ev.Payload.Args
+	if ev.Payload.Patch {
+		cur, ok := s.m[ch]
+		if !ok {
+			return nil, ErrNoState
+		}
+		b, err := mergepatch.Apply(cur, ev.Payload.Args)
+		if err != nil {
+			return nil, err
+		}
+		state = b
+	}
+
+	if s.m == nil {
+		s.m = make(map[string]json.RawMessage)
+	}
+	s.m[ch] = state
+	return state, nil
+}
+
+// State returns the current state of the channel, or nil if it is
+// unknown.
+func (s *States) State(channel string) json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[channel]
+}
+
+// Forget removes the state of the channel, typically when unsubscribing
+// from it.
+func (s *States) Forget(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, channel)
+}
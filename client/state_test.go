@@ -0,0 +1,35 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStates(t *testing.T) {
+	newEvnt := func(channel string, patch bool, args string) *message.Evnt {
+		ev := message.NewEvnt(&message.EvntPayload{Channel: channel, Args: json.RawMessage(args)})
+		ev.Payload.Patch = patch
+		return ev
+	}
+
+	var s States
+	_, err := s.Apply(newEvnt("a", true, `{"x":1}`))
+	assert.Equal(t, ErrNoState, err, "patch without state")
+
+	got, err := s.Apply(newEvnt("a", false, `{"x":1,"y":{"z":2}}`))
+	require.NoError(t, err, "full state")
+	assert.JSONEq(t, `{"x":1,"y":{"z":2}}`, string(got), "full state")
+
+	got, err = s.Apply(newEvnt("a", true, `{"x":null,"y":{"w":3}}`))
+	require.NoError(t, err, "patch")
+	assert.JSONEq(t, `{"y":{"z":2,"w":3}}`, string(got), "patched state")
+	assert.JSONEq(t, `{"y":{"z":2,"w":3}}`, string(s.State("a")), "State")
+	assert.Nil(t, s.State("b"), "State of unknown channel")
+
+	s.Forget("a")
+	assert.Nil(t, s.State("a"), "State after Forget")
+}
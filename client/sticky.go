@@ -0,0 +1,53 @@
+package client
+
+import (
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// SubSticky makes a sticky subscription request to channel, which is
+// treated as a pattern if pattern is true, on servers that support it
+// (see juggler.Server.Sticky). The subscription is tied to the identity
+// of the client: all the connections of that identity receive its
+// events, including those opened later, until UnsbSticky is called. The
+// request is not sent if ctx is done before it can be written. It
+// returns the UUID of the sub message on success, or an error if the
+// request could not be sent to the server.
+func (c *Client) SubSticky(ctx context.Context, channel string, pattern bool) (uuid.UUID, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	m := message.NewSub(channel, pattern)
+	m.Payload.Sticky = true
+	if err := c.doWrite(ctx, m); err != nil {
+		return nil, err
+	}
+	return m.UUID(), nil
+}
+
+// UnsbSticky removes the sticky subscription to channel of the identity
+// of the client, which unsubscribes all its connections. The request is
+// not sent if ctx is done before it can be written. It returns the UUID
+// of the unsb message on success, or an error if the request could not
+// be sent to the server.
+func (c *Client) UnsbSticky(ctx context.Context, channel string, pattern bool) (uuid.UUID, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	c.removeSubFunc(channel, pattern)
+
+	m := message.NewUnsb(channel, pattern)
+	m.Payload.Sticky = true
+	if err := c.doWrite(ctx, m); err != nil {
+		return nil, err
+	}
+	return m.UUID(), nil
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// subKey identifies a subscription, by channel and pattern flag.
+type subKey struct {
+	channel string
+	pattern bool
+}
+
+// subFunc is a function registered with SubFunc, along with the UUID of
+// the SUB request that registered it.
+type subFunc struct {
+	id uuid.UUID
+	fn func(*message.Evnt)
+}
+
+// SubFunc makes a subscription request like Sub, and calls fn with each
+// event received for that subscription instead of the client's handler.
+// The events received on a channel via a pattern subscription are sent
+// to the function of the pattern. The events of the subscriptions
+// without a function are sent to the handler, as are the ACK and NACK
+// of the request. The function is removed if the request is NACKed, or
+// when Unsb is called for the same channel and pattern flag. Calling
+// SubFunc again for the same subscription replaces its function.
+//
+// As for the handler, fn is called in its own goroutine for each event.
+//
+// Deprecated: use SubFuncCtx.
+func (c *Client) SubFunc(channel string, pattern bool, fn func(*message.Evnt)) (uuid.UUID, error) {
+	return c.SubFuncCtx(context.Background(), channel, pattern, fn)
+}
+
+// SubFuncCtx makes a subscription request like SubFunc, that is not
+// sent if ctx is done before it can be written.
+func (c *Client) SubFuncCtx(ctx context.Context, channel string, pattern bool, fn func(*message.Evnt)) (uuid.UUID, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	m := message.NewSub(channel, pattern)
+	k := subKey{channel, pattern}
+	c.mu.Lock()
+	prev := c.subFuncs[k]
+	if c.subFuncs == nil {
+		c.subFuncs = make(map[subKey]*subFunc)
+	}
+	c.subFuncs[k] = &subFunc{id: m.UUID(), fn: fn}
+	c.mu.Unlock()
+
+	if err := c.doWrite(ctx, m); err != nil {
+		c.mu.Lock()
+		if sf := c.subFuncs[k]; sf != nil && uuid.Equal(sf.id, m.UUID()) {
+			if prev != nil {
+				c.subFuncs[k] = prev
+			} else {
+				delete(c.subFuncs, k)
+			}
+		}
+		c.mu.Unlock()
+		return nil, err
+	}
+	return m.UUID(), nil
+}
+
+// removeSubFunc removes the function of the subscription, if any.
+func (c *Client) removeSubFunc(channel string, pattern bool) {
+	c.mu.Lock()
+	delete(c.subFuncs, subKey{channel, pattern})
+	c.mu.Unlock()
+}
+
+// handleSubFunc calls the function of the subscription of the event,
+// and removes the function of a NACKed subscription request. It returns
+// true if the message was handled.
+func (c *Client) handleSubFunc(m message.Msg) bool {
+	switch m := m.(type) {
+	case *message.Evnt:
+		k := subKey{m.Payload.Channel, false}
+		if m.Payload.Pattern != "" {
+			k = subKey{m.Payload.Pattern, true}
+		}
+		c.mu.Lock()
+		sf := c.subFuncs[k]
+		c.mu.Unlock()
+		if sf == nil {
+			return false
+		}
+		go sf.fn(m)
+		return true
+
+	case *message.Nack:
+		if m.Payload.ForType != message.SubMsg {
+			return false
+		}
+		c.mu.Lock()
+		for k, sf := range c.subFuncs {
+			if uuid.Equal(sf.id, m.Payload.For) {
+				delete(c.subFuncs, k)
+				break
+			}
+		}
+		c.mu.Unlock()
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/juggler/internal/wstest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientSubFunc(t *testing.T) {
+	done := make(chan bool, 1)
+	unsb := make(chan struct{})
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		// read the SUB requests, NACK the last one
+		var last *message.Sub
+		for i := 0; i < 4; i++ {
+			var m message.Sub
+			require.NoError(t, c.ReadJSON(&m), "ReadJSON %d", i)
+			last = &m
+		}
+		require.NoError(t, c.WriteJSON(message.NewNack(last, message.CodeForbidden, assert.AnError)), "WriteJSON NACK")
+
+		evnts := []*message.EvntPayload{
+			{Channel: "a"},
+			{Channel: "b.1", Pattern: "b.*"},
+			{Channel: "b.1"},
+			{Channel: "c"},
+			{Channel: "d"},
+		}
+		for i, ep := range evnts {
+			require.NoError(t, c.WriteJSON(message.NewEvnt(ep)), "WriteJSON %d", i)
+		}
+
+		// read the UNSB request, then send an event on its channel
+		var m message.Unsb
+		require.NoError(t, c.ReadJSON(&m), "ReadJSON UNSB")
+		<-unsb
+		require.NoError(t, c.WriteJSON(message.NewEvnt(&message.EvntPayload{Channel: "a"})), "WriteJSON after UNSB")
+		c.ReadMessage() // wait for the client to close
+	})
+	defer srv.Close()
+
+	evs := make(chan string, 10)
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		switch m := m.(type) {
+		case *message.Evnt:
+			evs <- "handler:" + m.Payload.Channel
+		case *message.Nack:
+			evs <- "nack"
+		}
+	})
+	fn := func(name string) func(*message.Evnt) {
+		return func(ev *message.Evnt) {
+			evs <- name + ":" + ev.Payload.Channel
+		}
+	}
+
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	_, err = cli.SubFunc("a", false, fn("a"))
+	require.NoError(t, err, "SubFunc a")
+	_, err = cli.SubFunc("b.*", true, fn("b.*"))
+	require.NoError(t, err, "SubFunc b.*")
+	_, err = cli.Sub("c", false)
+	require.NoError(t, err, "Sub c")
+	_, err = cli.SubFunc("d", false, fn("d"))
+	require.NoError(t, err, "SubFunc d")
+
+	got := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		select {
+		case ev := <-evs:
+			got[ev] = true
+		case <-time.After(time.Second):
+			require.Fail(t, "missing event", "%d", i)
+		}
+	}
+	want := map[string]bool{
+		"nack":        true,
+		"a:a":         true,
+		"b.*:b.1":     true,
+		"handler:b.1": true,
+		"handler:c":   true,
+		"handler:d":   true,
+	}
+	assert.Equal(t, want, got, "events")
+
+	_, err = cli.Unsb("a", false)
+	require.NoError(t, err, "Unsb a")
+	close(unsb)
+	select {
+	case ev := <-evs:
+		assert.Equal(t, "handler:a", ev, "event after Unsb")
+	case <-time.After(time.Second):
+		require.Fail(t, "missing event after Unsb")
+	}
+}
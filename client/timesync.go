@@ -0,0 +1,171 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// ErrTimeSyncTimeout is returned by Client.SyncClock when the server
+// does not answer a time synchronization exchange before the timeout,
+// typically because it does not support it.
+var ErrTimeSyncTimeout = errors.New("juggler/client: time synchronization timed out")
+
+// SyncClock estimates the offset of the server clock relative to the
+// client clock by running samples time synchronization exchanges with
+// the server (see message.TimeSync). The offset of the exchange with
+// the smallest round-trip delay is kept, and returned by ClockOffset.
+// The server must have the time synchronization enabled (see
+// juggler.Server.TimeSync). The timeout applies to each exchange, and
+// if it is 0, broker.DefaultCallTimeout is used.
+func (c *Client) SyncClock(samples int, timeout time.Duration) (time.Duration, error) {
+	if samples <= 0 {
+		samples = 1
+	}
+
+	var best, bestDelay time.Duration
+	for i := 0; i < samples; i++ {
+		offset, delay, err := c.timeSyncExchange(timeout)
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 || delay < bestDelay {
+			best, bestDelay = offset, delay
+		}
+	}
+
+	c.mu.Lock()
+	c.clockOffset = best
+	c.mu.Unlock()
+	return best, nil
+}
+
+// ClockOffset returns the offset of the server clock relative to the
+// client clock, as estimated by the last successful call to SyncClock.
+// The server time is the client time plus the offset. It returns 0 if
+// the clock was never synchronized.
+func (c *Client) ClockOffset() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clockOffset
+}
+
+// EventLag returns the delivery lag of the event, that is the time
+// between its publication and now, corrected with the ClockOffset.
+// It should be called as soon as the event is received.
+func (c *Client) EventLag(ev *message.Evnt) time.Duration {
+	return time.Now().Add(c.ClockOffset()).Sub(ev.Payload.Timestamp)
+}
+
+// timeSyncExchange runs a single time synchronization exchange and
+// returns the estimated offset and round-trip delay.
+func (c *Client) timeSyncExchange(timeout time.Duration) (offset, delay time.Duration, err error) {
+	c.mu.Lock()
+	err = c.err
+	c.mu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	m, err := message.NewCall(message.TimeSyncURI, &message.TimeSync{ClientTime: time.Now().UTC()}, timeout)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ch := c.addWaiter(m)
+	defer c.deleteWaiter(m)
+
+	if err := c.doWrite(context.Background(), m); err != nil {
+		return 0, 0, err
+	}
+
+	select {
+	case <-c.stop:
+		c.mu.Lock()
+		err = c.err
+		c.mu.Unlock()
+		if err == nil {
+			err = errors.New("closed connection")
+		}
+		return 0, 0, err
+
+	case <-time.After(timeout):
+		return 0, 0, ErrTimeSyncTimeout
+
+	case resp := <-ch:
+		received := time.Now().UTC()
+		switch resp := resp.(type) {
+		case *message.Nack:
+			return 0, 0, fmt.Errorf("juggler/client: time synchronization failed: %d %s", resp.Payload.Code, resp.Payload.Message)
+		case *message.Res:
+			var ts message.TimeSync
+			if err := json.Unmarshal(resp.Payload.Args, &ts); err != nil {
+				return 0, 0, err
+			}
+			offset, delay = ts.Offset(received)
+			return offset, delay, nil
+		}
+		return 0, 0, fmt.Errorf("juggler/client: unexpected time synchronization response %s", resp.Type())
+	}
+}
+
+// addWaiter registers the request m so that its NACK or RES is sent
+// on the returned channel instead of the handler. It must be called
+// before the request is sent.
+func (c *Client) addWaiter(m message.Msg) chan message.Msg {
+	ch := make(chan message.Msg, 1)
+	c.mu.Lock()
+	if c.waiters == nil {
+		c.waiters = make(map[string]chan message.Msg)
+	}
+	c.waiters[m.UUID().String()] = ch
+	c.mu.Unlock()
+	return ch
+}
+
+// deleteWaiter removes the registration of the request m.
+func (c *Client) deleteWaiter(m message.Msg) {
+	c.mu.Lock()
+	delete(c.waiters, m.UUID().String())
+	c.mu.Unlock()
+}
+
+// handleWaiter returns true if the message is a response to a request
+// registered with addWaiter, sending it to the waiting request if it
+// is a NACK or RES. Such messages are not sent to the handler.
+func (c *Client) handleWaiter(m message.Msg) bool {
+	var key string
+	switch m := m.(type) {
+	case *message.Ack:
+		key = m.Payload.For.String()
+	case *message.Nack:
+		key = m.Payload.For.String()
+	case *message.Res:
+		key = m.Payload.For.String()
+	default:
+		return false
+	}
+
+	c.mu.Lock()
+	ch, ok := c.waiters[key]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	if m.Type() != message.AckMsg {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+	return true
+}
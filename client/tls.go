@@ -0,0 +1,114 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrCertificatePin is returned by Dial when none of the certificates
+// of the server has a pinned public key (see SetCertificatePins).
+var ErrCertificatePin = errors.New("juggler/client: no pinned public key in the server certificates")
+
+// SetTLSConfig sets the TLS configuration of the connections to the
+// "wss" URLs, e.g. with the RootCAs of a custom CA bundle or a client
+// certificate. It overrides the TLSClientConfig of the Dialer. It only
+// applies to the connections established by Dial and Endpoints.Dial,
+// the connection of a client created with New is already established.
+func SetTLSConfig(conf *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = conf
+	}
+}
+
+// SetCertificatePins pins the public keys of the certificates of the
+// server: the connections established by Dial and Endpoints.Dial fail
+// with ErrCertificatePin unless a certificate of the verified chain of
+// the server has one of the pinned keys. If the verification of the
+// chain is disabled by the TLS configuration (see
+// tls.Config.InsecureSkipVerify), the key of the certificate of the
+// server itself must be pinned.
+//
+// The pins are the base64-encoded SHA-256 hashes of the DER-encoded
+// SubjectPublicKeyInfo of the certificates, as returned by SPKIHash,
+// the same as the pin-sha256 of HTTP Public Key Pinning. Pinning the key
+// of an intermediate CA, or a backup key, avoids locking out the clients
+// when the certificate of the server is renewed.
+func SetCertificatePins(pins ...string) Option {
+	return func(c *Client) {
+		c.pins = pins
+	}
+}
+
+// SPKIHash returns the base64-encoded SHA-256 hash of the DER-encoded
+// SubjectPublicKeyInfo of cert, for SetCertificatePins.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// dialTLS returns d with the TLS configuration and the pins of the
+// options of c, or d itself if c has none.
+func (c *Client) dialTLS(d *websocket.Dialer) *websocket.Dialer {
+	if c.tlsConfig == nil && len(c.pins) == 0 {
+		return d
+	}
+
+	conf := c.tlsConfig
+	if conf == nil {
+		conf = d.TLSClientConfig
+	}
+	if conf == nil {
+		conf = &tls.Config{}
+	} else {
+		conf = conf.Clone()
+	}
+	if len(c.pins) > 0 {
+		conf.VerifyPeerCertificate = verifyPins(c.pins, conf.VerifyPeerCertificate)
+	}
+
+	cpy := *d
+	cpy.TLSClientConfig = conf
+	return &cpy
+}
+
+// verifyPins returns the tls.Config.VerifyPeerCertificate function that
+// checks the pins, after the next function if it is not nil.
+func verifyPins(pins []string, next func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	set := make(map[string]bool, len(pins))
+	for _, p := range pins {
+		set[p] = true
+	}
+
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+
+		if len(chains) == 0 {
+			// not verified, only the certificate of the server is trusted
+			if len(rawCerts) == 0 {
+				return ErrCertificatePin
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			chains = [][]*x509.Certificate{{cert}}
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if set[SPKIHash(cert)] {
+					return nil
+				}
+			}
+		}
+		return ErrCertificatePin
+	}
+}
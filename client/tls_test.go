@@ -0,0 +1,66 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialTLS(t *testing.T) {
+	upg := &websocket.Upgrader{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upg.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	u := strings.Replace(srv.URL, "https:", "wss:", 1)
+
+	cert, err := x509.ParseCertificate(srv.TLS.Certificates[0].Certificate[0])
+	require.NoError(t, err, "ParseCertificate")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	pin := SPKIHash(cert)
+	const otherPin = "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	cases := []struct {
+		name string
+		opts []Option
+		err  bool
+	}{
+		{"unknown CA", nil, true},
+		{"CA bundle", []Option{SetTLSConfig(&tls.Config{RootCAs: pool})}, false},
+		{"pinned", []Option{SetTLSConfig(&tls.Config{RootCAs: pool}), SetCertificatePins(otherPin, pin)}, false},
+		{"not pinned", []Option{SetTLSConfig(&tls.Config{RootCAs: pool}), SetCertificatePins(otherPin)}, true},
+		{"pinned unverified", []Option{SetTLSConfig(&tls.Config{InsecureSkipVerify: true}), SetCertificatePins(pin)}, false},
+		{"not pinned unverified", []Option{SetTLSConfig(&tls.Config{InsecureSkipVerify: true}), SetCertificatePins(otherPin)}, true},
+	}
+	for _, c := range cases {
+		cli, err := Dial(&websocket.Dialer{}, u, nil, c.opts...)
+		if c.err {
+			assert.Error(t, err, c.name)
+			continue
+		}
+		if assert.NoError(t, err, c.name) {
+			cli.Close()
+		}
+	}
+
+	// the pins apply to the TLS configuration of the Dialer
+	_, err = Dial(&websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool}}, u, nil, SetCertificatePins(otherPin))
+	assert.Equal(t, ErrCertificatePin, err, "pin error")
+}
@@ -0,0 +1,447 @@
+// Command juggler-admin is a command-line tool to query the admin
+// endpoints of a juggler server, as served by juggler-server on its
+// admin_addr address, and to inspect the redis broker directly.
+//
+//     - config dump : print the effective configuration of the server as JSON
+//     - callees URI : print the live callee instances registered for URI
+//     - nacks : print the connections that exceeded the NACK rate limit
+//     - connections close UUID : close the connection identified by UUID
+//     - connections : print the open connections
+//     - metrics : print the metrics of the server as JSON
+//     - policy set FILE : replace the policy with the JSON or YAML policy in FILE, or stdin if "-"
+//     - policy audit : print the recent changes of the policy as JSON
+//     - policy : print the current policy as JSON
+//     - queues : print the call requests of each URI (broker)
+//     - calls URI : print the pending call requests of URI (broker)
+//     - drain URI : remove the pending and scheduled call requests of URI (broker)
+//     - publish CHANNEL [JSON] : publish a test event on CHANNEL (broker)
+//
+// The broker commands connect to the redis server set with the -redis
+// flag. In a redis cluster, the queues command only scans the node set
+// with -redis, it must be run for each node without -redis-cluster.
+//
+// If the server requires an admin token, it is set with the -token flag
+// or the JUGGLER_ADMIN_TOKEN environment variable.
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker/redisbroker"
+	"github.com/PuerkitoBio/juggler/internal/completion"
+	"github.com/PuerkitoBio/juggler/internal/srvhandler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/redisc"
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	addrFlag         = flag.String("addr", "localhost:9002", "Admin `address` of the server.")
+	helpFlag         = flag.Bool("help", false, "Show help.")
+	redisAddrFlag    = flag.String("redis", ":6379", "Redis `address` of the broker.")
+	redisClusterFlag = flag.Bool("redis-cluster", false, "Use redis cluster.")
+	timeoutFlag      = flag.Duration("timeout", 10*time.Second, "HTTP request `timeout`.")
+	tokenFlag        = flag.String("token", os.Getenv("JUGGLER_ADMIN_TOKEN"), "Admin `token` of the server.")
+)
+
+type cmd struct {
+	Name string
+	Help string
+	Run  func(*http.Client, ...string) error
+}
+
+var commands = []*cmd{
+	{
+		Name: "config dump",
+		Help: "print the effective configuration of the server as JSON",
+		Run:  configDump,
+	},
+	{
+		Name: "callees",
+		Help: "print the live callee instances registered for URI",
+		Run:  callees,
+	},
+	{
+		Name: "nacks",
+		Help: "print the connections that exceeded the NACK rate limit",
+		Run:  nacks,
+	},
+	{
+		Name: "connections close",
+		Help: "close the connection identified by UUID",
+		Run:  connectionsClose,
+	},
+	{
+		Name: "connections",
+		Help: "print the open connections",
+		Run:  connections,
+	},
+	{
+		Name: "metrics",
+		Help: "print the metrics of the server as JSON",
+		Run:  metrics,
+	},
+	{
+		Name: "policy set",
+		Help: "replace the policy with the JSON or YAML policy in FILE, or stdin if \"-\"",
+		Run:  policySet,
+	},
+	{
+		Name: "policy audit",
+		Help: "print the recent changes of the policy as JSON",
+		Run:  policyAudit,
+	},
+	{
+		Name: "policy",
+		Help: "print the current policy as JSON",
+		Run:  policy,
+	},
+	{
+		Name: "queues",
+		Help: "print the call requests of each URI (broker)",
+		Run:  queues,
+	},
+	{
+		Name: "calls",
+		Help: "print the pending call requests of URI (broker)",
+		Run:  calls,
+	},
+	{
+		Name: "drain",
+		Help: "remove the pending and scheduled call requests of URI (broker)",
+		Run:  drain,
+	},
+	{
+		Name: "publish",
+		Help: "publish a test event on CHANNEL (broker)",
+		Run:  publish,
+	},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *helpFlag {
+		flag.Usage()
+		return
+	}
+
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.Name
+	}
+	if ok, err := completion.Run(os.Stdout, "juggler-admin", flag.CommandLine, flag.Args(), names...); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	c, args := findCmd(flag.Args())
+	if c == nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{Timeout: *timeoutFlag}
+	if err := c.Run(client, args...); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", c.Name, err)
+		os.Exit(1)
+	}
+}
+
+// findCmd returns the command matching the first words of args, and
+// the remaining arguments.
+func findCmd(args []string) (*cmd, []string) {
+	for _, c := range commands {
+		words := strings.Fields(c.Name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == c.Name {
+			return c, args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] COMMAND\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", c.Name, c.Help)
+	}
+	fmt.Fprintf(os.Stderr, "  %s %s\n    \tprint the shell completion script\n", completion.Command, strings.Join(completion.Shells, "|"))
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flag.PrintDefaults()
+}
+
+func configDump(client *http.Client, _ ...string) error {
+	return printJSON(client, "/config")
+}
+
+func metrics(client *http.Client, _ ...string) error {
+	return printJSON(client, "/metrics")
+}
+
+func policy(client *http.Client, _ ...string) error {
+	return printJSON(client, "/policy")
+}
+
+func policyAudit(client *http.Client, _ ...string) error {
+	return printJSON(client, "/policy/audit")
+}
+
+func policySet(client *http.Client, args ...string) error {
+	if len(args) != 1 {
+		return errors.New("usage: policy set FILE")
+	}
+
+	var b []byte
+	var err error
+	if args[0] == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	_, err = do(client, "PUT", "/policy", bytes.NewReader(b))
+	return err
+}
+
+// printJSON prints the indented JSON returned by the admin endpoint at
+// path.
+func printJSON(client *http.Client, path string) error {
+	b, err := get(client, path)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", "  "); err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(os.Stdout)
+	return err
+}
+
+func callees(client *http.Client, args ...string) error {
+	if len(args) != 1 {
+		return errors.New("usage: callees URI")
+	}
+	b, err := get(client, "/callees?uri="+url.QueryEscape(args[0]))
+	if err != nil {
+		return err
+	}
+
+	var cis []*message.CalleeInfo
+	if err := json.Unmarshal(b, &cis); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tHOSTNAME\tHEARTBEAT\tURIS")
+	for _, ci := range cis {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ci.ID, ci.Hostname, ci.Heartbeat.Format(time.RFC3339), strings.Join(ci.URIs, ","))
+	}
+	return w.Flush()
+}
+
+func nacks(client *http.Client, _ ...string) error {
+	b, err := get(client, "/nacks")
+	if err != nil {
+		return err
+	}
+
+	var offs []srvhandler.NackOffender
+	if err := json.Unmarshal(b, &offs); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONN\tREMOTE\tEXCEEDED\tTHROTTLED")
+	for _, off := range offs {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%t\n", off.ConnUUID, off.RemoteAddr, off.Exceeded, off.Throttled)
+	}
+	return w.Flush()
+}
+
+func connections(client *http.Client, _ ...string) error {
+	b, err := get(client, "/connections")
+	if err != nil {
+		return err
+	}
+
+	var infos []srvhandler.ConnInfo
+	if err := json.Unmarshal(b, &infos); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONN\tREMOTE\tIDENTITY\tCONNECTED\tCALLS\tCHANNELS\tPATTERNS")
+	for _, ci := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", ci.ConnUUID, ci.RemoteAddr, ci.Identity,
+			ci.Connected.Format(time.RFC3339), ci.InFlightCalls, strings.Join(ci.Channels, ","), strings.Join(ci.Patterns, ","))
+	}
+	return w.Flush()
+}
+
+func connectionsClose(client *http.Client, args ...string) error {
+	if len(args) != 1 {
+		return errors.New("usage: connections close UUID")
+	}
+	_, err := do(client, "POST", "/connections/"+url.QueryEscape(args[0])+"/close", nil)
+	return err
+}
+
+func queues(_ *http.Client, _ ...string) error {
+	brk, err := newBroker()
+	if err != nil {
+		return err
+	}
+	qis, err := brk.Queues()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "URI\tPENDING\tSCHEDULED\tDEAD LETTERS")
+	for _, qi := range qis {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", qi.URI, qi.Pending, qi.Scheduled, qi.DeadLetters)
+	}
+	return w.Flush()
+}
+
+func calls(_ *http.Client, args ...string) error {
+	if len(args) != 1 {
+		return errors.New("usage: calls URI")
+	}
+	brk, err := newBroker()
+	if err != nil {
+		return err
+	}
+	pcs, err := brk.PendingCalls(args[0])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MSG\tCONN\tPRIORITY\tCALLEE\tATTEMPT\tTTL")
+	for _, pc := range pcs {
+		ttl := pc.TTL.String()
+		if pc.Expired {
+			ttl = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\n", pc.Call.MsgUUID, pc.Call.ConnUUID, pc.Priority, pc.Callee, pc.Call.Attempt, ttl)
+	}
+	return w.Flush()
+}
+
+func drain(_ *http.Client, args ...string) error {
+	if len(args) != 1 {
+		return errors.New("usage: drain URI")
+	}
+	brk, err := newBroker()
+	if err != nil {
+		return err
+	}
+	n, err := brk.Drain(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d call requests removed\n", n)
+	return nil
+}
+
+func publish(_ *http.Client, args ...string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("usage: publish CHANNEL [JSON]")
+	}
+	pp := &message.PubPayload{MsgUUID: message.NewID(), Timestamp: time.Now().UTC()}
+	if len(args) == 2 {
+		var v interface{}
+		if err := json.Unmarshal([]byte(args[1]), &v); err != nil {
+			return fmt.Errorf("invalid JSON arguments: %v", err)
+		}
+		pp.Args = json.RawMessage(args[1])
+	}
+
+	brk, err := newBroker()
+	if err != nil {
+		return err
+	}
+	if err := brk.Publish(args[0], pp); err != nil {
+		return err
+	}
+	fmt.Println(pp.MsgUUID)
+	return nil
+}
+
+// newBroker returns the redis broker at the address of the -redis flag.
+func newBroker() (*redisbroker.Broker, error) {
+	createPool := func(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
+		return &redis.Pool{
+			MaxIdle: 1,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr, opts...)
+			},
+		}, nil
+	}
+
+	if *redisClusterFlag {
+		cluster := &redisc.Cluster{
+			StartupNodes: []string{*redisAddrFlag},
+			CreatePool:   createPool,
+		}
+		if err := cluster.Refresh(); err != nil {
+			return nil, err
+		}
+		return &redisbroker.Broker{Pool: cluster, Dial: cluster.Dial}, nil
+	}
+	pool, _ := createPool(*redisAddrFlag)
+	return &redisbroker.Broker{Pool: pool, Dial: pool.Dial}, nil
+}
+
+// get executes a GET request on the admin endpoint at path and returns
+// the body of the response.
+func get(client *http.Client, path string) ([]byte, error) {
+	return do(client, "GET", path, nil)
+}
+
+// do executes a request with method and body on the admin endpoint at
+// path and returns the body of the response.
+func do(client *http.Client, method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://"+*addrFlag+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if *tokenFlag != "" {
+		req.Header.Set("Authorization", "Bearer "+*tokenFlag)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// archive writes events to hourly NDJSON files per channel.
+type archive struct {
+	Dir           string
+	FlushInterval time.Duration
+	LogFunc       func(string, ...interface{})
+
+	files map[string]*hourFile // by path
+}
+
+// hourFile is an open file of the archive.
+type hourFile struct {
+	f    *os.File
+	enc  *json.Encoder
+	last time.Time // last write
+}
+
+// Run writes the events received on ch until it is closed, and closes
+// the idle files every FlushInterval.
+func (a *archive) Run(ch <-chan *message.EvntPayload) {
+	defer a.closeAll()
+
+	interval := a.FlushInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := a.write(ev); err != nil {
+				a.LogFunc("failed to archive event %v of %s: %v", ev.MsgUUID, ev.Channel, err)
+			}
+		case now := <-t.C:
+			a.closeIdle(now.Add(-interval))
+		}
+	}
+}
+
+// path returns the path of the file of the event.
+func (a *archive) path(ev *message.EvntPayload) string {
+	ts := ev.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	ts = ts.UTC()
+	return filepath.Join(a.Dir, url.QueryEscape(ev.Channel), ts.Format("2006-01-02"), ts.Format("15")+".ndjson")
+}
+
+func (a *archive) write(ev *message.EvntPayload) error {
+	p := a.path(ev)
+	hf := a.files[p]
+	if hf == nil {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		hf = &hourFile{f: f, enc: json.NewEncoder(f)}
+		if a.files == nil {
+			a.files = make(map[string]*hourFile)
+		}
+		a.files[p] = hf
+	}
+	hf.last = time.Now()
+	return hf.enc.Encode(ev)
+}
+
+// closeIdle closes the files that were not written to since before.
+func (a *archive) closeIdle(before time.Time) {
+	for p, hf := range a.files {
+		if hf.last.Before(before) {
+			a.close(p, hf)
+		}
+	}
+}
+
+func (a *archive) closeAll() {
+	for p, hf := range a.files {
+		a.close(p, hf)
+	}
+}
+
+func (a *archive) close(p string, hf *hourFile) {
+	if err := hf.f.Close(); err != nil {
+		a.LogFunc("failed to close %s: %v", p, err)
+	}
+	delete(a.files, p)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "juggler-archive")
+	require.NoError(t, err, "TempDir")
+	defer os.RemoveAll(dir)
+
+	a := &archive{Dir: dir, FlushInterval: time.Hour, LogFunc: t.Logf}
+	ch := make(chan *message.EvntPayload)
+	done := make(chan struct{})
+	go func() {
+		a.Run(ch)
+		close(done)
+	}()
+
+	ts := time.Date(2016, 3, 4, 10, 30, 0, 0, time.UTC)
+	evs := []*message.EvntPayload{
+		{MsgUUID: uuid.NewRandom(), Channel: "a", Args: json.RawMessage(`1`), Timestamp: ts},
+		{MsgUUID: uuid.NewRandom(), Channel: "a", Args: json.RawMessage(`2`), Timestamp: ts.Add(10 * time.Minute)},
+		{MsgUUID: uuid.NewRandom(), Channel: "a", Args: json.RawMessage(`3`), Timestamp: ts.Add(time.Hour)},
+		{MsgUUID: uuid.NewRandom(), Channel: "b/c", Args: json.RawMessage(`4`), Timestamp: ts},
+	}
+	for _, ev := range evs {
+		ch <- ev
+	}
+	close(ch)
+	<-done
+
+	read := func(path string) []string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, path))
+		require.NoError(t, err, "ReadFile %s", path)
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+
+	lines := read("a/2016-03-04/10.ndjson")
+	if assert.Equal(t, 2, len(lines), "events of hour 10") {
+		var ev message.EvntPayload
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &ev), "Unmarshal")
+		assert.Equal(t, evs[1].MsgUUID.String(), ev.MsgUUID.String(), "event in order")
+	}
+	assert.Equal(t, 1, len(read("a/2016-03-04/11.ndjson")), "events of hour 11")
+	assert.Equal(t, 1, len(read("b%2Fc/2016-03-04/10.ndjson")), "escaped channel")
+	assert.Equal(t, 0, len(a.files), "files closed")
+}
+
+func TestArchiveCloseIdle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "juggler-archive")
+	require.NoError(t, err, "TempDir")
+	defer os.RemoveAll(dir)
+
+	a := &archive{Dir: dir, LogFunc: t.Logf}
+	require.NoError(t, a.write(&message.EvntPayload{Channel: "a", Timestamp: time.Now()}), "write")
+	a.closeIdle(time.Now().Add(-time.Minute))
+	assert.Equal(t, 1, len(a.files), "recent file kept open")
+	a.closeIdle(time.Now().Add(time.Minute))
+	assert.Equal(t, 0, len(a.files), "idle file closed")
+}
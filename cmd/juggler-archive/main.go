@@ -0,0 +1,103 @@
+// Command juggler-archive subscribes to pub-sub channels and exports
+// their events to hourly NDJSON files, one JSON-encoded event payload
+// per line, so that event streams can be processed offline without
+// tapping the production redis. The files are written under the
+// output directory as:
+//
+//     <dir>/<channel>/<YYYY-MM-DD>/<HH>.ndjson
+//
+// based on the UTC timestamp of each event. A file is closed once
+// no event for its hour was received for the flush interval, after
+// which it can be uploaded to object storage, e.g. with a periodic
+// "gsutil rsync" or "aws s3 sync" of the closed files.
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker/redisbroker"
+	"github.com/PuerkitoBio/juggler/internal/completion"
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	channelsFlag      = flag.String("channels", "", "Comma-separated list of `channels` to archive, patterns if they contain '*', '?' or '['.")
+	dirFlag           = flag.String("dir", ".", "Output `directory` of the archive.")
+	flushIntervalFlag = flag.Duration("flush-interval", time.Minute, "Close the hourly files without event for this `duration`.")
+	helpFlag          = flag.Bool("help", false, "Show help.")
+	redisAddrFlag     = flag.String("redis", ":6379", "Redis `address`.")
+)
+
+func main() {
+	flag.Parse()
+	if *helpFlag {
+		flag.Usage()
+		return
+	}
+
+	if ok, err := completion.Run(os.Stdout, "juggler-archive", flag.CommandLine, flag.Args()); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	channels := strings.Split(*channelsFlag, ",")
+	if *channelsFlag == "" {
+		log.Fatal("no channel to archive")
+	}
+
+	pool := newRedisPool(*redisAddrFlag)
+	brk := &redisbroker.Broker{
+		Pool: pool,
+		Dial: pool.Dial,
+	}
+	psc, err := brk.NewPubSubConn()
+	if err != nil {
+		log.Fatalf("NewPubSubConn failed: %v", err)
+	}
+
+	for _, ch := range channels {
+		ch = strings.TrimSpace(ch)
+		if err := psc.Subscribe(ch, isPattern(ch)); err != nil {
+			log.Fatalf("Subscribe to %s failed: %v", ch, err)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		psc.Close()
+	}()
+
+	a := &archive{Dir: *dirFlag, FlushInterval: *flushIntervalFlag, LogFunc: log.Printf}
+	log.Printf("archiving events of %s to %s", *channelsFlag, *dirFlag)
+	a.Run(psc.Events())
+	if err := psc.EventsErr(); err != nil {
+		log.Printf("events stopped: %v", err)
+	}
+}
+
+// isPattern returns true if the channel is a redis pattern.
+func isPattern(ch string) bool {
+	return strings.ContainsAny(ch, "*?[")
+}
+
+func newRedisPool(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle: 1,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+}
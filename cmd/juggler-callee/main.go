@@ -4,45 +4,79 @@
 //     - test.echo (string) : returns the received string
 //     - test.reverse (string) : reverses each rune in the received string
 //     - test.delay (string) : sleeps for the duration received as string, converted to number (in ms)
+//     - test.fail (string) : fails at the rate set by -fail-rate, otherwise returns the received string
+//
+// More URIs can be served by Go plugins (-plugins, with Go 1.8+ and cgo
+// on linux and darwin), which must export a Thunks function returning
+// the thunks by URI:
+//
+//     package main
+//
+//     func Thunks() map[string]callee.Thunk {
+//         return map[string]callee.Thunk{"my.uri": myThunk}
+//     }
+//
+// Build them with go build -buildmode=plugin. A plugin URI replaces
+// the built-in URI with the same name.
 //
 package main
 
 import (
 	"encoding/json"
+	"errors"
 	"expvar"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/juggler/broker"
 	"github.com/PuerkitoBio/juggler/broker/redisbroker"
 	"github.com/PuerkitoBio/juggler/callee"
+	"github.com/PuerkitoBio/juggler/internal/completion"
+	"github.com/PuerkitoBio/juggler/internal/sdnotify"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/PuerkitoBio/redisc"
 	"github.com/garyburd/redigo/redis"
 )
 
 var (
-	brokerBlockingTimeoutFlag = flag.Duration("broker-blocking-timeout", 0, "Blocking `timeout` when polling for call requests.")
-	brokerResultCapFlag       = flag.Int("broker-result-cap", 0, "Capacity of the `results` queue.")
-	helpFlag                  = flag.Bool("help", false, "Show help.")
-	numDelayURIsFlag          = flag.Int("n", 0, "Number of test.delay `URIs`.")
-	httpServerPortFlag        = flag.Int("port", 9001, "HTTP server `port` to serve debug endpoints.")
-	redisAddrFlag             = flag.String("redis", ":6379", "Redis `address`.")
-	redisClusterFlag          = flag.Bool("redis-cluster", false, "Use redis cluster.")
-	redisPoolIdleTimeoutFlag  = flag.Duration("redis-idle-timeout", 0, "Redis idle connection `timeout`.")
-	redisPoolMaxActiveFlag    = flag.Int("redis-max-active", 0, "Maximum active redis `connections`.")
-	redisPoolMaxIdleFlag      = flag.Int("redis-max-idle", 0, "Maximum idle redis `connections`.")
-	workersFlag               = flag.Int("workers", 1, "Number of concurrent `workers` processing call requests.")
+	brokerBlockingTimeoutFlag   = flag.Duration("broker-blocking-timeout", 0, "Blocking `timeout` when polling for call requests.")
+	brokerResultCapFlag         = flag.Int("broker-result-cap", 0, "Capacity of the `results` queue.")
+	brokerCompressThresholdFlag = flag.Int("broker-compress-threshold", 0, "Compress the results larger than this number of `bytes`.")
+	brokerKeysFileFlag          = flag.String("broker-keys-file", "", "Decrypt the call requests and encrypt the results with the keys of this `file` (see redisbroker.ParseKeys).")
+	brokerCallStreamsFlag       = flag.Bool("broker-call-streams", false, "Read the call requests stored in redis streams, along with the lists.")
+	brokerCheckLeasesFlag       = flag.Bool("broker-check-leases", false, "Drop the results for the connections without a lease, once all servers hold leases.")
+	brokerStreamClaimIdleFlag   = flag.Duration("broker-stream-claim-idle", 0, "Claim the call requests of the streams not acknowledged after this `duration`.")
+	failRateFlag                = flag.Float64("fail-rate", 0.5, "Failure `rate` of the test.fail URI, from 0 to 1.")
+	helpFlag                    = flag.Bool("help", false, "Show help.")
+	numDelayURIsFlag            = flag.Int("n", 0, "Number of test.delay `URIs`.")
+	maxFailuresFlag             = flag.Int("max-failures", 0, "Quarantine calls after this number of consecutive `failures`.")
+	maxQueueAgeFlag             = flag.Duration("max-queue-age", 0, "Shed the calls that waited longer than this `duration`, with an error result.")
+	pluginsFlag                 = flag.String("plugins", "", "Comma-separated `paths` of the Go plugins that serve more URIs.")
+	httpServerPortFlag          = flag.Int("port", 9001, "HTTP server `port` to serve debug endpoints.")
+	recoverPanicsFlag           = flag.Bool("recover-panics", false, "Recover the panics of the calls and return them as error results.")
+	redisAddrFlag               = flag.String("redis", ":6379", "Redis `address`.")
+	redisClusterFlag            = flag.Bool("redis-cluster", false, "Use redis cluster.")
+	redisPoolIdleTimeoutFlag    = flag.Duration("redis-idle-timeout", 0, "Redis idle connection `timeout`.")
+	redisPoolMaxActiveFlag      = flag.Int("redis-max-active", 0, "Maximum active redis `connections`.")
+	redisPoolMaxIdleFlag        = flag.Int("redis-max-idle", 0, "Maximum idle redis `connections`.")
+	shedExpiredFlag             = flag.Bool("shed-expired", false, "Shed the calls whose timeout is elapsed instead of processing them.")
+	workersFlag                 = flag.Int("workers", 1, "Number of concurrent `workers` processing call requests.")
 )
 
 var uris = map[string]callee.Thunk{
 	"test.echo":    echoThunk,
 	"test.reverse": reverseThunk,
 	"test.delay":   delayThunk,
+	"test.fail":    failThunk,
 }
 
 func main() {
@@ -51,6 +85,15 @@ func main() {
 		flag.Usage()
 		return
 	}
+
+	if ok, err := completion.Run(os.Stdout, "juggler-callee", flag.CommandLine, flag.Args()); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *workersFlag <= 0 {
 		*workersFlag = 1
 	}
@@ -58,6 +101,19 @@ func main() {
 	for i := 0; i < *numDelayURIsFlag; i++ {
 		uris["test.delay."+strconv.Itoa(i)] = delayThunk
 	}
+	if *pluginsFlag != "" {
+		for _, path := range strings.Split(*pluginsFlag, ",") {
+			thunks, err := loadPlugin(path)
+			if err != nil {
+				log.Fatalf("failed to load plugin %s: %v", path, err)
+			}
+			for uri, t := range thunks {
+				uris[uri] = t
+			}
+			log.Printf("loaded %d URIs from plugin %s", len(thunks), path)
+		}
+	}
+	rand.Seed(time.Now().UnixNano())
 
 	var pool redisbroker.Pool
 	var dial func() (redis.Conn, error)
@@ -74,7 +130,28 @@ func main() {
 	}
 
 	vars := expvar.NewMap("callee")
-	c := &callee.Callee{Broker: newBroker(pool, dial, vars)}
+	brk := newBroker(pool, dial, vars)
+	if *brokerKeysFileFlag != "" {
+		b, err := ioutil.ReadFile(*brokerKeysFileFlag)
+		if err != nil {
+			log.Fatalf("failed to read the keys file: %v", err)
+		}
+		keys, err := redisbroker.ParseKeys(strings.TrimSpace(string(b)))
+		if err != nil {
+			log.Fatalf("invalid keys: %v", err)
+		}
+		brk.Keys = keys
+	}
+	c := &callee.Callee{
+		Broker:        brk,
+		Quarantine:    brk,
+		MaxFailures:   *maxFailuresFlag,
+		Registry:      brk,
+		RecoverPanics: *recoverPanicsFlag,
+		ShedExpired:   *shedExpiredFlag,
+		MaxQueueAge:   *maxQueueAgeFlag,
+		Vars:          vars,
+	}
 
 	// start a web server to serve pprof and expvar data
 	log.Printf("serving debug endpoints on %d", *httpServerPortFlag)
@@ -103,6 +180,13 @@ func main() {
 		}
 		defer cc.Close()
 
+		// register the callee instance so that servers know it is live
+		unregister, err := c.Register(keys...)
+		if err != nil {
+			log.Fatalf("Register failed: %v", err)
+		}
+		defer unregister()
+
 		wg.Add(*workersFlag)
 		for i := 0; i < *workersFlag; i++ {
 			go func() {
@@ -115,6 +199,34 @@ func main() {
 					vars.Add("Requests."+cp.URI, 1)
 
 					if err := c.InvokeAndStoreResult(cp, uris[cp.URI]); err != nil {
+						if err == callee.ErrCallQuarantined {
+							log.Printf("quarantined request %v %s", cp.MsgUUID, cp.URI)
+							vars.Add("Quarantined", 1)
+							vars.Add("Quarantined."+cp.URI, 1)
+							continue
+						}
+						if err == callee.ErrCallRetried {
+							log.Printf("retried request %v %s (attempt %d)", cp.MsgUUID, cp.URI, cp.Attempt)
+							vars.Add("Retried", 1)
+							vars.Add("Retried."+cp.URI, 1)
+							continue
+						}
+						if err == callee.ErrCallPanicked {
+							log.Printf("panicked request %v %s", cp.MsgUUID, cp.URI)
+							vars.Add("Panicked", 1)
+							vars.Add("Panicked."+cp.URI, 1)
+							continue
+						}
+						if err == callee.ErrCallShed {
+							log.Printf("shed request %v %s", cp.MsgUUID, cp.URI)
+							continue
+						}
+						if err == broker.ErrCallerGone {
+							log.Printf("orphaned result %v %s", cp.MsgUUID, cp.URI)
+							vars.Add("Orphaned", 1)
+							vars.Add("Orphaned."+cp.URI, 1)
+							continue
+						}
 						if err != callee.ErrCallExpired {
 							log.Printf("InvokeAndStoreResult failed: %v", err)
 							vars.Add("Failed", 1)
@@ -133,9 +245,25 @@ func main() {
 			}()
 		}
 	}
+
+	// signal readiness to systemd, and ping its watchdog as long as
+	// redis is reachable.
+	sdnotify.ReadyAndWatch(pingRedis(pool), log.Printf)
+
 	wg.Wait()
 }
 
+// pingRedis returns a health check function that sends a PING
+// to the redis server of the pool.
+func pingRedis(pool redisbroker.Pool) func() error {
+	return func() error {
+		rc := pool.Get()
+		defer rc.Close()
+		_, err := rc.Do("PING")
+		return err
+	}
+}
+
 func logWrapThunk(t callee.Thunk) callee.Thunk {
 	return func(cp *message.CallPayload) (interface{}, error) {
 		log.Printf("received call for %s from %v", cp.URI, cp.MsgUUID)
@@ -178,6 +306,17 @@ func reverse(s string) string {
 	return string(chars)
 }
 
+// errSimulatedFailure is the error returned by the failed test.fail
+// calls.
+var errSimulatedFailure = errors.New("simulated failure")
+
+func failThunk(cp *message.CallPayload) (interface{}, error) {
+	if rand.Float64() < *failRateFlag {
+		return nil, errSimulatedFailure
+	}
+	return echoThunk(cp)
+}
+
 func echoThunk(cp *message.CallPayload) (interface{}, error) {
 	var s string
 	if err := json.Unmarshal(cp.Args, &s); err != nil {
@@ -190,13 +329,17 @@ func echo(s string) string {
 	return s
 }
 
-func newBroker(pool redisbroker.Pool, dial func() (redis.Conn, error), vars *expvar.Map) broker.CalleeBroker {
+func newBroker(pool redisbroker.Pool, dial func() (redis.Conn, error), vars *expvar.Map) *redisbroker.Broker {
 	return &redisbroker.Broker{
-		Pool:            pool,
-		Dial:            dial,
-		BlockingTimeout: *brokerBlockingTimeoutFlag,
-		ResultCap:       *brokerResultCapFlag,
-		Vars:            vars,
+		Pool:              pool,
+		Dial:              dial,
+		BlockingTimeout:   *brokerBlockingTimeoutFlag,
+		ResultCap:         *brokerResultCapFlag,
+		CompressThreshold: *brokerCompressThresholdFlag,
+		CallStreams:       *brokerCallStreamsFlag,
+		CheckLeases:       *brokerCheckLeasesFlag,
+		StreamClaimIdle:   *brokerStreamClaimIdleFlag,
+		Vars:              vars,
 	}
 }
 
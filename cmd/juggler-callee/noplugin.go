@@ -0,0 +1,14 @@
+// +build !go1.8 !cgo !linux,!darwin
+
+package main
+
+import (
+	"errors"
+
+	"github.com/PuerkitoBio/juggler/callee"
+)
+
+// loadPlugin fails, the Go plugins are not supported by this build.
+func loadPlugin(path string) (map[string]callee.Thunk, error) {
+	return nil, errors.New("Go plugins are not supported by this build")
+}
@@ -0,0 +1,33 @@
+// +build go1.8,cgo,linux go1.8,cgo,darwin
+
+package main
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/PuerkitoBio/juggler/callee"
+)
+
+// thunksSymbol is the name of the function exported by the plugins
+// that returns their thunks by URI.
+const thunksSymbol = "Thunks"
+
+// loadPlugin opens the Go plugin at path and returns the thunks
+// returned by its Thunks function, which must have the signature
+// func() map[string]callee.Thunk.
+func loadPlugin(path string) (map[string]callee.Thunk, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(thunksSymbol)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := sym.(func() map[string]callee.Thunk)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s must be a func() map[string]callee.Thunk, got %T", path, thunksSymbol, sym)
+	}
+	return fn(), nil
+}
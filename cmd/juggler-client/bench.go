@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// defaultBenchTimeout is the timeout of the calls, and the time the pub
+// benchmark waits for the ACK of the messages.
+const defaultBenchTimeout = 10 * time.Second
+
+var benchCmd = &cmd{
+	Usage:   "usage: bench CONN_ID URI N CONCURRENCY [PAYLOAD_BYTES [TIMEOUT]]",
+	MinArgs: 4,
+	Help: "make N calls to URI on the connection identified by CONN_ID, with\n\tCONCURRENCY calls in flight and a payload of PAYLOAD_BYTES bytes, and\n\t" +
+		"report the latency of the results and the errors. TIMEOUT is the call\n\t" +
+		fmt.Sprintf("timeout (defaults to %s)", defaultBenchTimeout),
+
+	Run: func(_ *cmd, args ...string) {
+		c, ix := getConn(args[0])
+		if c == nil {
+			printErr("invalid connection ID: %s", args[0])
+			return
+		}
+		bo, err := parseBenchArgs(args[2:])
+		if err != nil {
+			printErr("[%d] %v", ix+1, err)
+			return
+		}
+
+		uri := args[1]
+		printf("[%d] === bench %d calls to %s, concurrency %d", ix+1, bo.n, uri, bo.concurrency)
+		r := runBench(bo, func(v interface{}) error {
+			return c.Invoke(context.Background(), uri, v, nil, bo.timeout)
+		})
+		r.print(ix)
+	},
+}
+
+var pbenchCmd = &cmd{
+	Usage:   "usage: pbench CONN_ID CHANNEL N CONCURRENCY [PAYLOAD_BYTES [TIMEOUT]]",
+	MinArgs: 4,
+	Help: "publish N messages to CHANNEL on the connection identified by\n\tCONN_ID, with CONCURRENCY messages in flight and a payload of PAYLOAD_BYTES\n\t" +
+		"bytes, and report the latency of the ACK and the errors. TIMEOUT is\n\t" +
+		fmt.Sprintf("the time to wait for each ACK (defaults to %s)", defaultBenchTimeout),
+
+	Run: func(_ *cmd, args ...string) {
+		c, ix := getConn(args[0])
+		if c == nil {
+			printErr("invalid connection ID: %s", args[0])
+			return
+		}
+		bo, err := parseBenchArgs(args[2:])
+		if err != nil {
+			printErr("[%d] %v", ix+1, err)
+			return
+		}
+
+		channel := args[1]
+		printf("[%d] === pbench %d messages to %s, concurrency %d", ix+1, bo.n, channel, bo.concurrency)
+
+		acks := newAckTracker()
+		l := loggers[ix]
+		l.setAcks(acks)
+		defer l.setAcks(nil)
+
+		r := runBench(bo, func(v interface{}) error {
+			ch := make(chan message.Msg, 1)
+			id, err := c.PubCtx(context.Background(), channel, v)
+			if err != nil {
+				return err
+			}
+			acks.wait(id, ch)
+			defer acks.cancel(id)
+
+			select {
+			case m := <-ch:
+				if nack, ok := m.(*message.Nack); ok {
+					return client.NackError(nack)
+				}
+				return nil
+			case <-time.After(bo.timeout):
+				return errAckTimeout
+			}
+		})
+		r.print(ix)
+	},
+}
+
+// errAckTimeout is the error of the published messages that are not
+// acknowledged before the timeout.
+var errAckTimeout = errors.New("no ACK received")
+
+// benchOpts is the configuration of a benchmark.
+type benchOpts struct {
+	n           int
+	concurrency int
+	payload     string
+	timeout     time.Duration
+}
+
+// parseBenchArgs parses the N CONCURRENCY [PAYLOAD_BYTES [TIMEOUT]]
+// arguments of the bench commands.
+func parseBenchArgs(args []string) (*benchOpts, error) {
+	bo := &benchOpts{timeout: defaultBenchTimeout}
+
+	var err error
+	if bo.n, err = strconv.Atoi(args[0]); err != nil || bo.n <= 0 {
+		return nil, fmt.Errorf("invalid number of requests: %s", args[0])
+	}
+	if bo.concurrency, err = strconv.Atoi(args[1]); err != nil || bo.concurrency <= 0 {
+		return nil, fmt.Errorf("invalid concurrency: %s", args[1])
+	}
+	if len(args) > 2 {
+		size, err := strconv.Atoi(args[2])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid payload size: %s", args[2])
+		}
+		bo.payload = strings.Repeat("x", size)
+	}
+	if len(args) > 3 {
+		if bo.timeout, err = time.ParseDuration(args[3]); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %v", err)
+		}
+	}
+	return bo, nil
+}
+
+// benchResult is the result of a benchmark.
+type benchResult struct {
+	elapsed   time.Duration
+	latencies []time.Duration // of the successful requests
+	errors    map[string]int  // by error message
+}
+
+// runBench calls fn n times with the payload, with up to concurrency
+// calls in flight, and collects the results.
+func runBench(bo *benchOpts, fn func(v interface{}) error) *benchResult {
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		res = &benchResult{errors: make(map[string]int)}
+	)
+
+	sem := make(chan struct{}, bo.concurrency)
+	start := time.Now()
+	for i := 0; i < bo.n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			t := time.Now()
+			err := fn(bo.payload)
+			d := time.Since(t)
+
+			mu.Lock()
+			if err != nil {
+				res.errors[err.Error()]++
+			} else {
+				res.latencies = append(res.latencies, d)
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	return res
+}
+
+// print prints the statistics of the benchmark run on the connection
+// at index ix. The errors are printed with printErr, so that the command
+// fails in script mode.
+func (r *benchResult) print(ix int) {
+	n := len(r.latencies)
+	nerr := 0
+	for _, cnt := range r.errors {
+		nerr += cnt
+	}
+
+	printf("[%d] === %d requests in %s (%.1f/s), %d succeeded, %d failed",
+		ix+1, n+nerr, r.elapsed, float64(n+nerr)/r.elapsed.Seconds(), n, nerr)
+	if n > 0 {
+		sort.Sort(durations(r.latencies))
+		printf("[%d] === latency min %s, p50 %s, p90 %s, p99 %s, max %s", ix+1,
+			r.latencies[0], percentile(r.latencies, 50), percentile(r.latencies, 90),
+			percentile(r.latencies, 99), r.latencies[n-1])
+	}
+
+	msgs := make([]string, 0, len(r.errors))
+	for msg := range r.errors {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+	for _, msg := range msgs {
+		printErr("[%d] %d errors: %s", ix+1, r.errors[msg], msg)
+	}
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(x, y int)      { d[x], d[y] = d[y], d[x] }
+func (d durations) Less(x, y int) bool { return d[x] < d[y] }
+
+// percentile returns the nearest-rank percentile p of the sorted
+// durations.
+func percentile(durs []time.Duration, p int) time.Duration {
+	ix := (p*len(durs)+99)/100 - 1
+	if ix < 0 {
+		ix = 0
+	}
+	return durs[ix]
+}
+
+// ackTracker sends the ACK and NACK of the published messages to the
+// pbench requests that wait for them. As the ACK may be received before
+// the request starts waiting, the unclaimed responses are kept until
+// the request waits or cancels.
+type ackTracker struct {
+	mu        sync.Mutex
+	waiters   map[string]chan<- message.Msg
+	unclaimed map[string]message.Msg
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{
+		waiters:   make(map[string]chan<- message.Msg),
+		unclaimed: make(map[string]message.Msg),
+	}
+}
+
+// wait registers ch to receive the ACK or NACK of the message id. If it
+// is already received, it is sent immediately. The channel must be
+// buffered.
+func (at *ackTracker) wait(id uuid.UUID, ch chan<- message.Msg) {
+	key := id.String()
+
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if m, ok := at.unclaimed[key]; ok {
+		delete(at.unclaimed, key)
+		ch <- m
+		return
+	}
+	at.waiters[key] = ch
+}
+
+// cancel removes the registration of the message id.
+func (at *ackTracker) cancel(id uuid.UUID) {
+	key := id.String()
+
+	at.mu.Lock()
+	delete(at.waiters, key)
+	delete(at.unclaimed, key)
+	at.mu.Unlock()
+}
+
+// handle returns true if m is the ACK or NACK of a PUB, in which case
+// it is sent to the waiting request.
+func (at *ackTracker) handle(m message.Msg) bool {
+	var key string
+	switch m := m.(type) {
+	case *message.Ack:
+		if m.Payload.ForType != message.PubMsg {
+			return false
+		}
+		key = m.Payload.For.String()
+	case *message.Nack:
+		if m.Payload.ForType != message.PubMsg {
+			return false
+		}
+		key = m.Payload.For.String()
+	default:
+		return false
+	}
+
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if ch, ok := at.waiters[key]; ok {
+		delete(at.waiters, key)
+		ch <- m
+		return true
+	}
+	at.unclaimed[key] = m
+	return true
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
@@ -15,11 +17,14 @@ import (
 	"github.com/PuerkitoBio/juggler/client"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 )
 
 var (
 	commands    map[string]*cmd
 	connections []*client.Client
+	loggers     []*connMsgLogger // the handlers, by connection
+	lastSent    []uuid.UUID      // the UUID of the last message sent, by connection
 )
 
 func init() {
@@ -38,6 +43,10 @@ func init() {
 		"unsb":       unsbCmd,
 		"punsb":      punsbCmd,
 		"rand":       randCmd,
+		"expect":     expectCmd,
+		"sleep":      sleepCmd,
+		"bench":      benchCmd,
+		"pbench":     pbenchCmd,
 	}
 }
 
@@ -76,12 +85,18 @@ var exitCmd = &cmd{
 }
 
 var connectCmd = &cmd{
-	Usage:   "usage: connect [URL [PROTO]]",
+	Usage:   "usage: connect [URL[,URL...] [PROTO]]",
 	MinArgs: 0,
-	Help:    fmt.Sprintf("connect to URL using subprotocol PROTO (defaults to %s)", *defaultSubprotoFlag),
+	Help:    fmt.Sprintf("connect to the first available URL using subprotocol PROTO (defaults to %s)", *defaultSubprotoFlag),
 
 	Run: func(_ *cmd, args ...string) {
 		var d websocket.Dialer
+		proxy, err := client.ProxyFunc(*proxyFlag)
+		if err != nil {
+			printErr("invalid proxy: %v", err)
+			return
+		}
+		d.Proxy = proxy
 
 		addr := *defaultConnFlag
 		if len(args) > 0 {
@@ -94,23 +109,48 @@ var connectCmd = &cmd{
 		}
 		d.Subprotocols = subs
 
-		conn, err := client.Dial(&d, addr, nil,
-			client.SetHandler(connMsgLogger(len(connections)+1)))
+		l := &connMsgLogger{id: len(connections) + 1, inbox: newInbox()}
+		endpoints := &client.Endpoints{URLs: strings.Split(addr, ",")}
+		conn, err := endpoints.Dial(&d, http.Header(headerFlags), client.SetHandler(l))
 		if err != nil {
 			printErr("Dial failed: %v", err)
 			return
 		}
 
 		connections = append(connections, conn)
-		printf("[%d] connected to %s", len(connections), addr)
+		loggers = append(loggers, l)
+		lastSent = append(lastSent, nil)
+		printf("[%d] connected to %s", len(connections), endpoints.Last())
 	},
 }
 
 // TODO : log raw messages if -raw is set, somehow...?
 
-type connMsgLogger int
+// connMsgLogger logs the messages received on a connection and keeps
+// them in its inbox for the expect command. While a pbench command runs,
+// the ACK and NACK of the published messages go to its tracker instead.
+type connMsgLogger struct {
+	id    int
+	inbox *inbox
+
+	mu   sync.Mutex
+	acks *ackTracker
+}
+
+func (l *connMsgLogger) setAcks(at *ackTracker) {
+	l.mu.Lock()
+	l.acks = at
+	l.mu.Unlock()
+}
+
+func (l *connMsgLogger) Handle(ctx context.Context, m message.Msg) {
+	l.mu.Lock()
+	at := l.acks
+	l.mu.Unlock()
+	if at != nil && at.handle(m) {
+		return
+	}
 
-func (l connMsgLogger) Handle(ctx context.Context, m message.Msg) {
 	var s string
 	switch m := m.(type) {
 	case *message.Nack:
@@ -132,9 +172,13 @@ func (l connMsgLogger) Handle(ctx context.Context, m message.Msg) {
 			n = 40
 		}
 		val := string(m.Payload.Args[:n])
+		if m.Payload.Patch {
+			val = "patch " + val
+		}
 		s = fmt.Sprintf("for %s %v (%s)", message.PubMsg, m.Payload.For, val)
 	}
-	printf("[%d] <<< %-4s message: %v %s", l, m.Type(), m.UUID(), s)
+	printf("[%d] <<< %-4s message: %v %s", l.id, m.Type(), m.UUID(), s)
+	l.inbox.add(m)
 }
 
 var disconnectCmd = &cmd{
@@ -225,11 +269,12 @@ var callCmd = &cmd{
 				pld = &rm
 			}
 
-			uuid, err := c.Call(args[1], pld, to)
+			uuid, err := c.CallCtx(context.Background(), args[1], pld, to)
 			if err != nil {
 				printErr("[%d] Call failed: %v", ix+1, err)
 				return
 			}
+			lastSent[ix] = uuid
 			printf("[%d] >>> CALL message: %v", ix+1, uuid)
 		} else {
 			printErr("invalid connection ID: %s", args[0])
@@ -249,11 +294,12 @@ var pubCmd = &cmd{
 				v = strings.Join(args[2:], " ")
 			}
 
-			uuid, err := c.Pub(args[1], v)
+			uuid, err := c.PubCtx(context.Background(), args[1], v)
 			if err != nil {
 				printErr("[%d] Pub failed: %v", ix+1, err)
 				return
 			}
+			lastSent[ix] = uuid
 			printf("[%d] >>> PUB  message: %v", ix+1, uuid)
 		} else {
 			printErr("invalid connection ID: %s", args[0])
@@ -280,11 +326,12 @@ var psubCmd = &cmd{
 func getSubFunc(pattern bool) func(*cmd, ...string) {
 	return func(cmd *cmd, args ...string) {
 		if c, ix := getConn(args[0]); c != nil {
-			uuid, err := c.Sub(args[1], pattern)
+			uuid, err := c.SubCtx(context.Background(), args[1], pattern)
 			if err != nil {
 				printErr("[%d] Sub failed: %v", ix+1, err)
 				return
 			}
+			lastSent[ix] = uuid
 			printf("[%d] >>> SUB  message: %v", ix+1, uuid)
 		} else {
 			printErr("invalid connection ID: %s", args[0])
@@ -311,11 +358,12 @@ var punsbCmd = &cmd{
 func getUnsbFunc(pattern bool) func(*cmd, ...string) {
 	return func(cmd *cmd, args ...string) {
 		if c, ix := getConn(args[0]); c != nil {
-			uuid, err := c.Unsb(args[1], pattern)
+			uuid, err := c.UnsbCtx(context.Background(), args[1], pattern)
 			if err != nil {
 				printErr("[%d] Unsb failed: %v", ix+1, err)
 				return
 			}
+			lastSent[ix] = uuid
 			printf("[%d] >>> UNSB message: %v", ix+1, uuid)
 		} else {
 			printErr("invalid connection ID: %s", args[0])
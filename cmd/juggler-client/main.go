@@ -1,5 +1,16 @@
 // Command juggler-client is an interactive command-line tool to send
 // commands to a juggler server.
+//
+// The commands can also be executed non-interactively, from a script
+// file with one command per line (-f) and from a semicolon-separated
+// list of commands (-e), e.g. to run protocol smoke tests in CI:
+//
+//     juggler-client -e "connect; sub 1 ch; expect 1 ACK last; pub 1 ch x; expect 1 EVNT ch x"
+//
+// The empty lines and the lines starting with # are ignored. The
+// execution stops at the first command that fails, and the exit code is
+// 0 if all commands succeeded, 1 if a command failed and 2 if the script
+// is invalid.
 package main
 
 import (
@@ -7,10 +18,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/internal/completion"
+	"github.com/PuerkitoBio/juggler/message"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -21,16 +36,55 @@ commands. Press ^D (ctrl-D) to exit.
 
 var (
 	term *terminal.Terminal
+
+	// out is where the messages are printed, the terminal in interactive
+	// mode and stdout in script mode.
+	out io.Writer = os.Stdout
+
+	// errCount is the number of errors printed, used to detect the
+	// commands that failed in script mode.
+	errCount int
 )
 
 var (
-	defaultConnFlag     = flag.String("addr", "ws://localhost:9000/ws", "Default server `address` used in connect command.")
-	defaultSubprotoFlag = flag.String("proto", "juggler.0", "Default `subprotocol` used in connect command.")
+	defaultConnFlag     = flag.String("addr", "ws://localhost:9000/ws", "Default server `address` used in connect command, or comma-separated list of addresses to fail over.")
+	defaultSubprotoFlag = flag.String("proto", message.V2.Name(), "Default `subprotocol` used in connect command.")
 	rawFlag             = flag.Bool("raw", false, "Log raw messages.")
 	timestampFmtFlag    = flag.String("timestamp", time.StampMilli, "Timestamp `format`, using Go time format syntax.")
+	scriptFileFlag      = flag.String("f", "", "Execute the commands of the script `file`, one per line, and exit.")
+	scriptCmdsFlag      = flag.String("e", "", "Execute the semicolon-separated `commands` and exit.")
 	helpFlag            = flag.Bool("help", false, "Show help.")
+	proxyFlag           = flag.String("proxy", client.ProxyEnv, "Proxy `URL` of the connections, http://host:port or socks5://host:port, \"env\" for the proxy of the environment or empty for none.")
+	headerFlags         = make(headerFlag)
 )
 
+func init() {
+	flag.Var(headerFlags, "H", "`Header` of the upgrade requests of the connections, as \"Name: value\", may be repeated.")
+}
+
+// headerFlag is the flag of the headers of the upgrade requests, that
+// may be repeated.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var parts []string
+	for k, vs := range h {
+		for _, v := range vs {
+			parts = append(parts, k+": "+v)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h headerFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q, must be \"Name: value\"", s)
+	}
+	http.Header(h).Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
 func main() {
 	var exitCode int
 
@@ -40,6 +94,18 @@ func main() {
 		return
 	}
 
+	if ok, err := completion.Run(os.Stdout, "juggler-client", flag.CommandLine, flag.Args()); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *scriptFileFlag != "" || *scriptCmdsFlag != "" {
+		os.Exit(runScript(*scriptFileFlag, *scriptCmdsFlag))
+	}
+
 	// call os.Exit in a defer, otherwise defer to reset the terminal
 	// will not be run.
 	defer func() {
@@ -52,6 +118,7 @@ func main() {
 	t, fn := setupTerminal()
 	defer fn()
 	term = t
+	out = t
 
 	printfTs(welcomeMessage, "")
 	for {
@@ -105,7 +172,7 @@ func printfTs(msg, ts string, args ...interface{}) {
 		t := time.Now().Format(ts)
 		msg = t + " | " + msg
 	}
-	fmt.Fprintf(term, msg+"\n", args...)
+	fmt.Fprintf(out, msg+"\n", args...)
 }
 
 func printf(msg string, args ...interface{}) {
@@ -113,6 +180,15 @@ func printf(msg string, args ...interface{}) {
 }
 
 func printErr(msg string, args ...interface{}) {
+	errCount++
+	if term == nil {
+		ts := *timestampFmtFlag
+		if ts != "" {
+			msg = time.Now().Format(ts) + " | " + msg
+		}
+		fmt.Fprintf(os.Stderr, msg+"\n", args...)
+		return
+	}
 	term.Write(term.Escape.Red)
 	printf(msg, args...)
 	term.Write(term.Escape.Reset)
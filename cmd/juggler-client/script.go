@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// exit codes of the non-interactive mode.
+const (
+	exitOK      = 0 // all commands succeeded
+	exitFailed  = 1 // a command failed
+	exitInvalid = 2 // the script is invalid or cannot be read
+)
+
+// defaultExpectTimeout is the time the expect command waits for a
+// message when no timeout is specified.
+const defaultExpectTimeout = 5 * time.Second
+
+// maxInboxMsgs is the maximum number of messages kept in the inbox of
+// a connection, the oldest ones are dropped.
+const maxInboxMsgs = 1000
+
+// scriptLine is a command of a script, with its location for the error
+// messages.
+type scriptLine struct {
+	loc string
+	cmd string
+}
+
+// runScript executes the commands of the script file if it is set,
+// then the semicolon-separated commands of cmds, and returns the exit
+// code. It stops at the first command that fails. In a file, each line
+// is a command, and the empty lines and those starting with # are
+// ignored.
+func runScript(file, cmds string) int {
+	var lines []scriptLine
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			printErr("failed to open script: %v", err)
+			return exitInvalid
+		}
+		s := bufio.NewScanner(f)
+		for n := 1; s.Scan(); n++ {
+			lines = append(lines, scriptLine{loc: fmt.Sprintf("%s:%d", file, n), cmd: s.Text()})
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			printErr("failed to read script: %v", err)
+			return exitInvalid
+		}
+	}
+	if cmds != "" {
+		for i, c := range strings.Split(cmds, ";") {
+			lines = append(lines, scriptLine{loc: fmt.Sprintf("-e:%d", i+1), cmd: c})
+		}
+	}
+
+	for _, l := range lines {
+		args := strings.Fields(l.cmd)
+		if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			continue
+		}
+		cmd := commands[args[0]]
+		if cmd == nil {
+			printErr("%s: unknown command: %q", l.loc, args[0])
+			return exitInvalid
+		}
+		args = args[1:]
+		if len(args) < cmd.MinArgs {
+			printErr("%s: %s", l.loc, cmd.Usage)
+			return exitInvalid
+		}
+		if cmd == exitCmd {
+			return exitOK
+		}
+
+		n := errCount
+		cmd.Run(cmd, args...)
+		if errCount > n {
+			printErr("%s: command failed: %s", l.loc, strings.TrimSpace(l.cmd))
+			return exitFailed
+		}
+	}
+	return exitOK
+}
+
+// inbox keeps the messages received on a connection, until they are
+// consumed by the expect command. It is safe for concurrent use.
+type inbox struct {
+	mu     sync.Mutex
+	msgs   []message.Msg
+	notify chan struct{} // closed and replaced when a message is added
+}
+
+func newInbox() *inbox {
+	return &inbox{notify: make(chan struct{})}
+}
+
+func (ib *inbox) add(m message.Msg) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	if len(ib.msgs) >= maxInboxMsgs {
+		ib.msgs = ib.msgs[1:]
+	}
+	ib.msgs = append(ib.msgs, m)
+	close(ib.notify)
+	ib.notify = make(chan struct{})
+}
+
+// take removes and returns the oldest message that satisfies match,
+// waiting up to timeout for it. It returns nil if there is no such
+// message.
+func (ib *inbox) take(match func(message.Msg) bool, timeout time.Duration) message.Msg {
+	deadline := time.After(timeout)
+	for {
+		ib.mu.Lock()
+		for i, m := range ib.msgs {
+			if match(m) {
+				ib.msgs = append(ib.msgs[:i], ib.msgs[i+1:]...)
+				ib.mu.Unlock()
+				return m
+			}
+		}
+		notify := ib.notify
+		ib.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+// lastUUIDArg is the FILTER argument of the expect command that stands
+// for the UUID of the last message sent on the connection.
+const lastUUIDArg = "last"
+
+var expectCmd = &cmd{
+	Usage:   "usage: expect CONN_ID MSG_TYPE [FILTER [PAYLOAD_REGEX]] [TIMEOUT]",
+	MinArgs: 2,
+	Help: "wait for a message of MSG_TYPE (e.g. ACK, NACK, RES, EXP or EVNT)\n\treceived on the connection identified by CONN_ID, for up to TIMEOUT\n\t" +
+		fmt.Sprintf("(defaults to %s). Each message can be expected once, in any order.\n\t", defaultExpectTimeout) +
+		"For EVNT, FILTER is the channel of the event and PAYLOAD_REGEX a regular\n\texpression that its payload must match. For the other types, FILTER is\n\t" +
+		"the UUID of the message it responds to, or \"" + lastUUIDArg + "\" for the last message sent\n\ton the connection. " +
+		"A trailing argument that is a valid duration is the TIMEOUT",
+
+	Run: func(_ *cmd, args ...string) {
+		c, ix := getConn(args[0])
+		if c == nil {
+			printErr("invalid connection ID: %s", args[0])
+			return
+		}
+		t, ok := parseMsgType(args[1])
+		if !ok {
+			printErr("[%d] invalid message type: %s", ix+1, args[1])
+			return
+		}
+		args = args[2:]
+
+		to := defaultExpectTimeout
+		if n := len(args); n > 0 {
+			if d, err := time.ParseDuration(args[n-1]); err == nil {
+				to = d
+				args = args[:n-1]
+			}
+		}
+
+		match, desc, err := newMatcher(ix, t, args)
+		if err != nil {
+			printErr("[%d] invalid expect filter: %v", ix+1, err)
+			return
+		}
+
+		m := loggers[ix].inbox.take(match, to)
+		if m == nil {
+			printErr("[%d] no %s message%s received in %s", ix+1, t, desc, to)
+			return
+		}
+		printf("[%d] === %-4s message%s: %v", ix+1, t, desc, m.UUID())
+	},
+}
+
+// newMatcher returns the function that matches the messages of type t
+// expected on the connection at index ix, with the filter arguments, and
+// the description of the filter.
+func newMatcher(ix int, t message.Type, args []string) (func(message.Msg) bool, string, error) {
+	if len(args) == 0 {
+		return func(m message.Msg) bool { return m.Type() == t }, "", nil
+	}
+
+	if t == message.EvntMsg {
+		channel := args[0]
+		desc := " on " + channel
+		var rx *regexp.Regexp
+		if len(args) > 1 {
+			expr := strings.Join(args[1:], " ")
+			r, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, "", err
+			}
+			rx = r
+			desc += " matching " + expr
+		}
+		return func(m message.Msg) bool {
+			ev, ok := m.(*message.Evnt)
+			if !ok || ev.Payload.Channel != channel {
+				return false
+			}
+			return rx == nil || rx.Match(ev.Payload.Args)
+		}, desc, nil
+	}
+
+	if len(args) > 1 {
+		return nil, "", fmt.Errorf("PAYLOAD_REGEX is only supported for %s", message.EvntMsg)
+	}
+	var id uuid.UUID
+	if args[0] == lastUUIDArg {
+		id = lastSent[ix]
+		if id == nil {
+			return nil, "", errors.New("no message sent on the connection")
+		}
+	} else if id = uuid.Parse(args[0]); id == nil {
+		return nil, "", fmt.Errorf("invalid UUID: %s", args[0])
+	}
+	return func(m message.Msg) bool {
+		if m.Type() != t {
+			return false
+		}
+		forID, ok := forUUID(m)
+		return ok && uuid.Equal(forID, id)
+	}, fmt.Sprintf(" for %v", id), nil
+}
+
+// forUUID returns the UUID of the message that m responds to.
+func forUUID(m message.Msg) (uuid.UUID, bool) {
+	switch m := m.(type) {
+	case *message.Ack:
+		return m.Payload.For, true
+	case *message.Nack:
+		return m.Payload.For, true
+	case *message.Res:
+		return m.Payload.For, true
+	case *client.Exp:
+		return m.Payload.For, true
+	}
+	return nil, false
+}
+
+var sleepCmd = &cmd{
+	Usage:   "usage: sleep DURATION",
+	MinArgs: 1,
+	Help:    "pause for DURATION, e.g. to wait for the messages of the server",
+
+	Run: func(_ *cmd, args ...string) {
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			printErr("invalid duration: %v", err)
+			return
+		}
+		time.Sleep(d)
+	},
+}
+
+// parseMsgType returns the message type named s, case-insensitively.
+func parseMsgType(s string) (message.Type, bool) {
+	s = strings.ToUpper(s)
+	types := []message.Type{message.AckMsg, message.NackMsg, message.ResMsg, message.EvntMsg, client.ExpMsg}
+	for _, t := range types {
+		if t.String() == s {
+			return t, true
+		}
+	}
+	return 0, false
+}
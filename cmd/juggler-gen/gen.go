@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/token"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/juggler/schema"
+	"gopkg.in/yaml.v2"
+)
+
+// definition is the definition of a service.
+type definition struct {
+	Package string    `yaml:"package"`
+	Service string    `yaml:"service"`
+	Methods []*method `yaml:"methods"`
+}
+
+// method is a method of a service, that calls a URI.
+type method struct {
+	Name    string        `yaml:"name"`
+	URI     string        `yaml:"uri"`
+	Doc     string        `yaml:"doc"`
+	Args    string        `yaml:"args"`
+	Result  string        `yaml:"result"`
+	Timeout time.Duration `yaml:"timeout"`
+	Schema  interface{}   `yaml:"schema"`
+
+	// the schema to generate the types of Args and Result, if any
+	types *schema.URISchema
+}
+
+// parseDefinition decodes and checks the service definition, and sets
+// the Go types of the arguments and results that are generated from
+// the schemas.
+func parseDefinition(b []byte) (*definition, error) {
+	var def definition
+	if err := yaml.Unmarshal(b, &def); err != nil {
+		return nil, err
+	}
+
+	if !isIdent(def.Package) {
+		return nil, fmt.Errorf("invalid package name %q", def.Package)
+	}
+	if !isExported(def.Service) {
+		return nil, fmt.Errorf("invalid service name %q", def.Service)
+	}
+	if len(def.Methods) == 0 {
+		return nil, errors.New("no method")
+	}
+
+	names := make(map[string]bool)
+	uris := make(map[string]bool)
+	for _, m := range def.Methods {
+		if !isExported(m.Name) {
+			return nil, fmt.Errorf("invalid method name %q", m.Name)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("duplicate method %s", m.Name)
+		}
+		names[m.Name] = true
+		if m.URI == "" {
+			return nil, fmt.Errorf("%s: missing URI", m.Name)
+		}
+		if uris[m.URI] {
+			return nil, fmt.Errorf("%s: duplicate URI %s", m.Name, m.URI)
+		}
+		uris[m.URI] = true
+
+		if m.Schema != nil {
+			if err := m.parseSchema(); err != nil {
+				return nil, fmt.Errorf("%s: invalid schema: %v", m.Name, err)
+			}
+		}
+	}
+	return &def, nil
+}
+
+// parseSchema parses the schema of the method, and uses the types
+// generated from the schema for the arguments and result that have no
+// Go type.
+func (m *method) parseSchema() error {
+	b, err := json.Marshal(jsonValue(m.Schema))
+	if err != nil {
+		return err
+	}
+	us, err := schema.Parse(b)
+	if err != nil {
+		return err
+	}
+
+	var types schema.URISchema
+	if us.Args != nil && m.Args == "" {
+		types.Args = us.Args
+		m.Args = m.Name + "Args"
+	}
+	if us.Result != nil && m.Result == "" {
+		types.Result = us.Result
+		m.Result = m.Name + "Result"
+	}
+	if types.Args != nil || types.Result != nil {
+		m.types = &types
+	}
+	return nil
+}
+
+// jsonValue converts the maps decoded from YAML, which have keys of
+// any type, to maps with string keys so that they can be encoded as
+// JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		vs := make([]interface{}, len(v))
+		for i, item := range v {
+			vs[i] = jsonValue(item)
+		}
+		return vs
+	}
+	return v
+}
+
+// isIdent returns true if name is a valid Go identifier.
+func isIdent(name string) bool {
+	for i, r := range name {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return name != "" && token.Lookup(name) == token.IDENT
+}
+
+// isExported returns true if name is a valid exported Go identifier.
+func isExported(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return isIdent(name) && unicode.IsUpper(r)
+}
+
+// generate returns the source of the typed client and callee handler of
+// the service. The source is the name of the definition file, noted in
+// the header of the generated file.
+func generate(def *definition, source string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := fileTemplate.Execute(&buf, struct {
+		*definition
+		Source string
+	}{def, source}); err != nil {
+		return nil, err
+	}
+
+	for _, m := range def.Methods {
+		if m.types == nil {
+			continue
+		}
+		types, err := schema.GenerateGoTypes(m.Name, m.types)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", m.Name, err)
+		}
+		buf.Write(types)
+	}
+	return format.Source(buf.Bytes())
+}
+
+// durationLit returns the Go expression of the duration d.
+func durationLit(d time.Duration) string {
+	units := []struct {
+		d    time.Duration
+		name string
+	}{
+		{time.Hour, "time.Hour"},
+		{time.Minute, "time.Minute"},
+		{time.Second, "time.Second"},
+		{time.Millisecond, "time.Millisecond"},
+	}
+	for _, u := range units {
+		if d%u.d == 0 {
+			return fmt.Sprintf("%d * %s", d/u.d, u.name)
+		}
+	}
+	return fmt.Sprintf("time.Duration(%d)", int64(d))
+}
+
+var fileTemplate = template.Must(template.New("file").Funcs(template.FuncMap{
+	"duration": durationLit,
+	"hasTimeout": func(ms []*method) bool {
+		for _, m := range ms {
+			if m.Timeout > 0 {
+				return true
+			}
+		}
+		return false
+	},
+	"comment": func(s string) string {
+		return strings.Replace(strings.TrimSpace(s), "\n", "\n// ", -1)
+	},
+}).Parse(`// Code generated by juggler-gen from {{.Source}}; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	{{- if hasTimeout .Methods}}
+	"time"
+	{{end}}
+
+	"github.com/PuerkitoBio/juggler/callee"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// The URIs of the methods of the {{.Service}} service.
+const (
+{{- range .Methods}}
+	{{$.Service}}{{.Name}}URI = {{printf "%q" .URI}}
+{{- end}}
+)
+
+// {{.Service}}Client is the client of the {{.Service}} service. It makes
+// the calls with the Invoke method of its client.Client.
+type {{.Service}}Client struct {
+	c *client.Client
+}
+
+// New{{.Service}}Client returns a {{.Service}}Client that makes the calls with c.
+func New{{.Service}}Client(c *client.Client) *{{.Service}}Client {
+	return &{{.Service}}Client{c: c}
+}
+{{range .Methods}}
+// {{.Name}} calls {{.URI}}.
+{{- if .Doc}} It {{comment .Doc}}{{end}}
+func (c *{{$.Service}}Client) {{template "signature" .}} {
+	{{- if .Result}}
+	var res {{.Result}}
+	err := c.c.Invoke(ctx, {{$.Service}}{{.Name}}URI, {{if .Args}}args{{else}}nil{{end}}, &res, {{if .Timeout}}{{duration .Timeout}}{{else}}0{{end}})
+	return res, err
+	{{- else}}
+	return c.c.Invoke(ctx, {{$.Service}}{{.Name}}URI, {{if .Args}}args{{else}}nil{{end}}, nil, {{if .Timeout}}{{duration .Timeout}}{{else}}0{{end}})
+	{{- end}}
+}
+{{end}}
+// {{.Service}}Handler is the interface implemented by the callees of the
+// {{.Service}} service.
+type {{.Service}}Handler interface {
+{{- range .Methods}}
+	// {{.Name}} handles the calls to {{.URI}}.
+	{{template "signature" .}}
+{{- end}}
+}
+
+// {{.Service}}Thunks returns the thunks that handle the calls to the URIs of
+// the {{.Service}} service with h, to listen to with cal.Listen. The
+// arguments are decoded with cal.DecodeArgs, and the context of a call
+// is done when the call expires (see callee.CallContext).
+func {{.Service}}Thunks(cal *callee.Callee, h {{.Service}}Handler) map[string]callee.Thunk {
+	return map[string]callee.Thunk{
+	{{- range .Methods}}
+		{{$.Service}}{{.Name}}URI: func(cp *message.CallPayload) (interface{}, error) {
+			{{- if .Args}}
+			var args {{.Args}}
+			if err := cal.DecodeArgs(cp, &args); err != nil {
+				return nil, err
+			}
+			{{- end}}
+			ctx, cancel := callee.CallContext(cp)
+			defer cancel()
+			{{- if .Result}}
+			return h.{{.Name}}(ctx{{if .Args}}, args{{end}})
+			{{- else}}
+			return nil, h.{{.Name}}(ctx{{if .Args}}, args{{end}})
+			{{- end}}
+		},
+	{{- end}}
+	}
+}
+{{define "signature" -}}
+{{.Name}}(ctx context.Context{{if .Args}}, args {{.Args}}{{end}}) {{if .Result}}({{.Result}}, error){{else}}error{{end}}
+{{- end}}`))
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const billingDef = `
+package: billing
+service: Billing
+methods:
+  - name: CreateInvoice
+    uri: billing.create_invoice
+    doc: creates an invoice for the customer.
+    args: "*CreateInvoiceRequest"
+    result: "*Invoice"
+    timeout: 5s
+  - name: Ping
+    uri: billing.ping
+    schema:
+      result:
+        type: string
+  - name: Void
+    uri: billing.void
+    args: string
+    schema:
+      args:
+        type: integer
+`
+
+func TestParseDefinition(t *testing.T) {
+	def, err := parseDefinition([]byte(billingDef))
+	require.NoError(t, err, "parseDefinition")
+	if assert.Equal(t, 3, len(def.Methods), "methods") {
+		assert.Equal(t, 5*time.Second, def.Methods[0].Timeout, "timeout")
+		assert.Nil(t, def.Methods[0].types, "no generated types")
+		assert.Equal(t, "", def.Methods[1].Args, "no args")
+		assert.Equal(t, "PingResult", def.Methods[1].Result, "generated result type")
+		assert.Equal(t, "string", def.Methods[2].Args, "args type has precedence over the schema")
+		assert.Nil(t, def.Methods[2].types, "no generated types when the Go type is set")
+	}
+
+	cases := []struct {
+		def string
+		err string
+	}{
+		{"service: A\nmethods: [{name: A, uri: a}]", `invalid package name ""`},
+		{"package: type\nservice: A\nmethods: [{name: A, uri: a}]", `invalid package name "type"`},
+		{"package: p\nservice: a\nmethods: [{name: A, uri: a}]", `invalid service name "a"`},
+		{"package: p\nservice: A", "no method"},
+		{"package: p\nservice: A\nmethods: [{name: 1A, uri: a}]", `invalid method name "1A"`},
+		{"package: p\nservice: A\nmethods: [{name: A, uri: a}, {name: A, uri: b}]", "duplicate method A"},
+		{"package: p\nservice: A\nmethods: [{name: A}]", "A: missing URI"},
+		{"package: p\nservice: A\nmethods: [{name: A, uri: a}, {name: B, uri: a}]", "B: duplicate URI a"},
+		{"package: p\nservice: A\nmethods: [{name: A, uri: a, schema: {args: {type: x}}}]", `A: invalid schema: args: unknown type "x"`},
+	}
+	for _, c := range cases {
+		_, err := parseDefinition([]byte(c.def))
+		if assert.Error(t, err, c.def) {
+			assert.Equal(t, c.err, err.Error(), c.def)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	def, err := parseDefinition([]byte(billingDef))
+	require.NoError(t, err, "parseDefinition")
+	src, err := generate(def, "billing.yml")
+	require.NoError(t, err, "generate")
+
+	_, err = parser.ParseFile(token.NewFileSet(), "billing.go", src, 0)
+	require.NoError(t, err, "ParseFile")
+
+	s := string(src)
+	for _, want := range []string{
+		"// Code generated by juggler-gen from billing.yml; DO NOT EDIT.\n\npackage billing\n",
+		"\t\"time\"\n",
+		`BillingCreateInvoiceURI = "billing.create_invoice"`,
+		"// CreateInvoice calls billing.create_invoice. It creates an invoice for the customer.\n" +
+			"func (c *BillingClient) CreateInvoice(ctx context.Context, args *CreateInvoiceRequest) (*Invoice, error) {\n" +
+			"\tvar res *Invoice\n" +
+			"\terr := c.c.Invoke(ctx, BillingCreateInvoiceURI, args, &res, 5*time.Second)\n",
+		"func (c *BillingClient) Ping(ctx context.Context) (PingResult, error) {",
+		"\treturn c.c.Invoke(ctx, BillingVoidURI, args, nil, 0)\n",
+		"\tVoid(ctx context.Context, args string) error\n",
+		"func BillingThunks(cal *callee.Callee, h BillingHandler) map[string]callee.Thunk {",
+		"\t\t\treturn nil, h.Void(ctx, args)\n",
+		"type PingResult string\n",
+	} {
+		assert.Contains(t, s, want)
+	}
+}
+
+func TestDurationLit(t *testing.T) {
+	cases := map[time.Duration]string{
+		2 * time.Hour:           "2 * time.Hour",
+		90 * time.Minute:        "90 * time.Minute",
+		1500 * time.Millisecond: "1500 * time.Millisecond",
+		time.Microsecond:        "time.Duration(1000)",
+	}
+	for d, want := range cases {
+		assert.Equal(t, want, durationLit(d), d.String())
+	}
+}
@@ -0,0 +1,112 @@
+// Command juggler-gen generates a typed Go client and callee handler
+// for a service from its definition, so that the calls are made and
+// handled with the Go types of their arguments and results instead of
+// encoding them by hand. The definition is a YAML file that lists the
+// methods of the service:
+//
+//     package: billing
+//     service: Billing
+//     methods:
+//       - name: CreateInvoice
+//         uri: billing.create_invoice
+//         doc: creates an invoice for the customer.
+//         args: "*CreateInvoiceRequest"
+//         result: "*Invoice"
+//         timeout: 5s
+//       - name: Ping
+//         uri: billing.ping
+//         schema:
+//           result:
+//             type: string
+//
+// The args and result fields are the Go types of the arguments and the
+// result of the calls, which must be declared in the package. If the
+// method has a schema (see the schema package), the types of the parts
+// of the schema without a Go type are generated from the schema, named
+// after the method, e.g. PingResult. A method without arguments or
+// result has no corresponding parameter or return value.
+//
+// For the Billing service, the generated file declares:
+//
+//     // the URIs of the methods
+//     const BillingCreateInvoiceURI = "billing.create_invoice"
+//
+//     // the client, that makes the calls with Client.Invoke
+//     type BillingClient struct{ ... }
+//     func NewBillingClient(c *client.Client) *BillingClient
+//     func (c *BillingClient) CreateInvoice(ctx context.Context, args *CreateInvoiceRequest) (*Invoice, error)
+//
+//     // the interface implemented by the callees
+//     type BillingHandler interface {
+//       CreateInvoice(ctx context.Context, args *CreateInvoiceRequest) (*Invoice, error)
+//     }
+//
+//     // the thunks to register with Callee.Listen
+//     func BillingThunks(cal *callee.Callee, h BillingHandler) map[string]callee.Thunk
+//
+// The generated file is written to the -o file, or to stdout.
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/PuerkitoBio/juggler/internal/completion"
+)
+
+var (
+	helpFlag   = flag.Bool("help", false, "Show help.")
+	outputFlag = flag.String("o", "", "Output `file`, stdout if empty.")
+)
+
+func main() {
+	flag.Parse()
+	if *helpFlag {
+		flag.Usage()
+		return
+	}
+
+	if ok, err := completion.Run(os.Stdout, "juggler-gen", flag.CommandLine, flag.Args()); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "expected the path of a service definition")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	path := flag.Arg(0)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	def, err := parseDefinition(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid service definition %s: %v\n", path, err)
+		os.Exit(2)
+	}
+	src, err := generate(def, filepath.Base(path))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate the service %s: %v\n", def.Service, err)
+		os.Exit(3)
+	}
+
+	if *outputFlag == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := ioutil.WriteFile(*outputFlag, src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(3)
+	}
+}
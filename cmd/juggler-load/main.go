@@ -1,6 +1,16 @@
 // Command juggler-load is a juggler load generator. It runs a
 // number of client connections to a server, and for a
 // given duration, makes calls and collects results and statistics.
+//
+// The traffic can mix CALL, PUB and SUB requests by ratios (-mix), e.g.
+// eight calls for one publish and one subscription change:
+//
+//     juggler-load -c 1000 -mix call=8,pub=1,sub=1
+//
+// The report has the latency percentiles and histogram of each
+// operation, and is printed as text, JSON or CSV (-o) so that the
+// runs can be compared to benchmark the changes to the server and
+// brokers.
 package main
 
 import (
@@ -23,8 +33,10 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/internal/completion"
 	"github.com/PuerkitoBio/juggler/message"
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 )
 
 var (
@@ -35,9 +47,12 @@ var (
 	helpFlag        = flag.Bool("help", false, "Show help.")
 	numURIsFlag     = flag.Int("n", 0, "Spread calls to this `number` of URIs (added as a suffix to the URI).")
 	payloadFlag     = flag.String("p", "100", "Call `payload`.")
-	subprotoFlag    = flag.String("proto", "juggler.0", "Websocket `subprotocol`.")
+	subprotoFlag    = flag.String("proto", message.V2.Name(), "Websocket `subprotocol`.")
 	callRateFlag    = flag.Duration("r", 100*time.Millisecond, "Call `rate` per connection. A negative rate makes a call once the previous response is received.")
 	callTimeoutFlag = flag.Duration("t", time.Second, "Call `timeout`.")
+	channelFlag     = flag.String("ch", "test.load", "Pub and sub `channel`.")
+	mixFlag         = flag.String("mix", "call=1", "Traffic `mix` of call, pub and sub requests, as comma-separated op=weight ratios.")
+	formatFlag      = flag.String("o", "text", "Report `format`, text, json (durations in nanoseconds) or csv (durations in milliseconds).")
 	uriFlag         = flag.String("u", "test.delay", "Call `URI`.")
 	noDebugVarsFlag = flag.Bool("V", false, "No debug vars.")
 	waitFlag        = flag.Duration("w", 5*time.Second, "Wait `duration` for connections to stop.")
@@ -58,6 +73,8 @@ var (
 Address:    {{ .Run.Addr }}
 Protocol:   {{ .Run.Protocol }}
 URI:        {{ .Run.URI }} x {{.Run.NURIs}}
+Channel:    {{ .Run.Channel }}
+Mix:        {{ .Run.Mix }}
 Payload:    {{ .Run.Payload }}
 
 Connections: {{ .Run.Conns }}
@@ -69,21 +86,32 @@ Duration:    {{ .Run.Duration | printf "%s" }}
 
 Actual Duration: {{ .Run.ActualDuration | printf "%s" }}
 Calls:           {{ .Run.Calls }}
+Pubs:            {{ .Run.Pubs }}
+Subs:            {{ .Run.Subs }}
 Acks:            {{ .Run.Ack }}
 Nacks:           {{ .Run.Nack }}
 Results:         {{ .Run.Res }}
 Expired:         {{ .Run.Exp }}
-
---- CLIENT LATENCIES
-
-Minimum:         {{ pctl 0 .Latencies }}
-Maximum:         {{ pctl 100 .Latencies }}
-Average:         {{ avg .Latencies }}
-Median:          {{ pctl 50 .Latencies }}
-75th Percentile: {{ pctl 75 .Latencies }}
-90th Percentile: {{ pctl 90 .Latencies }}
-99th Percentile: {{ pctl 99 .Latencies }}
-
+Events:          {{ .Run.Evnt }}
+{{ range .Ops }}
+--- CLIENT LATENCIES ({{ .Name }})
+
+Requests:        {{ .Requests }}
+Completed:       {{ .Completed }}
+Failed:          {{ .Failed }}
+Throughput:      {{ .Throughput | printf "%.1f" }}/s
+
+Minimum:         {{ .Min }}
+Maximum:         {{ .Max }}
+Average:         {{ .Avg }}
+Median:          {{ .P50 }}
+75th Percentile: {{ .P75 }}
+90th Percentile: {{ .P90 }}
+99th Percentile: {{ .P99 }}
+
+Histogram:
+{{ range .Histogram }}  <= {{ .Label | printf "%-6s" }} {{ .Count }}
+{{ end }}{{ end }}
 --- SERVER STATISTICS
 
 Memory          Before          After           Diff.
@@ -239,10 +267,10 @@ func (b byteSize) String() string {
 }
 
 type templateStats struct {
-	Run       *runStats
-	Before    *expVars
-	After     *expVars
-	Latencies []time.Duration
+	Run    *runStats
+	Before *expVars
+	After  *expVars
+	Ops    []*opReport
 }
 
 type runStats struct {
@@ -250,6 +278,8 @@ type runStats struct {
 	Protocol string
 	URI      string
 	NURIs    int
+	Channel  string
+	Mix      string
 	Payload  string
 
 	Conns          int
@@ -259,10 +289,13 @@ type runStats struct {
 	ActualDuration time.Duration
 
 	Calls int64
+	Pubs  int64
+	Subs  int64
 	Ack   int64
 	Nack  int64
 	Res   int64
 	Exp   int64
+	Evnt  int64
 }
 
 type expVars struct {
@@ -307,11 +340,28 @@ func main() {
 		return
 	}
 
+	if ok, err := completion.Run(os.Stdout, "juggler-load", flag.CommandLine, flag.Args()); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.SetFlags(0)
 
 	if *connFlag <= 0 {
 		log.Fatalf("invalid -c value, must be greater than 0")
 	}
+	mix, err := parseMix(*mixFlag)
+	if err != nil {
+		log.Fatalf("invalid -mix value: %v", err)
+	}
+	switch *formatFlag {
+	case "text", "json", "csv":
+	default:
+		log.Fatalf("invalid -o value, must be text, json or csv")
+	}
 
 	<-time.After(*delayFlag)
 	rand.Seed(time.Now().UnixNano())
@@ -321,6 +371,8 @@ func main() {
 		Protocol: *subprotoFlag,
 		URI:      *uriFlag,
 		NURIs:    *numURIsFlag,
+		Channel:  *channelFlag,
+		Mix:      *mixFlag,
 		Payload:  *payloadFlag,
 		Conns:    *connFlag,
 		Rate:     *callRateFlag,
@@ -341,10 +393,10 @@ func main() {
 	}
 
 	clientStarted := make(chan struct{})
-	resLatency := make(chan []time.Duration)
+	results := make(chan map[string]*opResult)
 	stop := make(chan struct{})
 	for i := 0; i < stats.Conns; i++ {
-		go runClient(stats, clientStarted, stop, resLatency)
+		go runClient(stats, mix, clientStarted, stop, results)
 	}
 
 	// start clients with some jitter, up to 10ms
@@ -371,9 +423,17 @@ func main() {
 		}
 	}()
 
-	var latencies []time.Duration
+	merged := make(map[string]*opResult)
 	for i := 0; i < stats.Conns; i++ {
-		latencies = append(latencies, <-resLatency...)
+		for op, res := range <-results {
+			m := merged[op]
+			if m == nil {
+				m = &opResult{}
+				merged[op] = m
+			}
+			m.latencies = append(m.latencies, res.latencies...)
+			m.failed += res.failed
+		}
 	}
 	close(done)
 
@@ -385,9 +445,13 @@ func main() {
 		after = getExpVars(parsed)
 	}
 
-	ts := templateStats{Run: stats, Before: before, After: after, Latencies: latencies}
-	if err := tpl.Execute(os.Stdout, ts); err != nil {
-		log.Fatalf("template.Execute failed: %v", err)
+	requests := map[string]int64{callOp: stats.Calls, pubOp: stats.Pubs, subOp: stats.Subs}
+	ts := &templateStats{Run: stats, Before: before, After: after}
+	for _, mo := range mix {
+		ts.Ops = append(ts.Ops, newOpReport(mo.op, requests[mo.op], merged[mo.op], stats.ActualDuration))
+	}
+	if err := writeReport(os.Stdout, *formatFlag, ts); err != nil {
+		log.Fatalf("failed to write report: %v", err)
 	}
 }
 
@@ -417,11 +481,8 @@ func getURI(stats *runStats) string {
 	return uri
 }
 
-func runClient(stats *runStats, started chan<- struct{}, stop <-chan struct{}, resLatencies chan<- []time.Duration) {
+func runClient(stats *runStats, mix []mixOp, started chan<- struct{}, stop <-chan struct{}, results chan<- map[string]*opResult) {
 	var wgResults sync.WaitGroup
-	var mu sync.Mutex // protects latencies slice and startTimes map
-	var latencies []time.Duration
-	startTimes := make(map[string]time.Time)
 
 	var next chan int
 	if stats.Rate < 0 {
@@ -431,39 +492,43 @@ func runClient(stats *runStats, started chan<- struct{}, stop <-chan struct{}, r
 		next <- 1 // initialize ready to send
 	}
 
+	tr := newTracker(func(op string) {
+		if stats.Rate < 0 {
+			next <- 1
+		}
+		wgResults.Done()
+	})
+
 	cli, err := client.Dial(
 		&websocket.Dialer{Subprotocols: []string{stats.Protocol}},
 		stats.Addr, nil,
 		client.SetHandler(client.HandlerFunc(func(ctx context.Context, m message.Msg) {
-			switch m.Type() {
-			case message.ResMsg:
-				rm := m.(*message.Res)
-				mu.Lock()
-				dur := time.Now().Sub(startTimes[rm.Payload.For.String()])
-				latencies = append(latencies, dur)
-				mu.Unlock()
+			switch m := m.(type) {
+			case *message.Res:
 				atomic.AddInt64(&stats.Res, 1)
+				tr.received(m.Payload.For.String(), m)
 
-				if stats.Rate < 0 {
-					next <- 1
-				}
-
-			case client.ExpMsg:
+			case *client.Exp:
 				atomic.AddInt64(&stats.Exp, 1)
+				tr.received(m.Payload.For.String(), m)
 
-				if stats.Rate < 0 {
-					next <- 1
+			case *message.Ack:
+				atomic.AddInt64(&stats.Ack, 1)
+				if m.Payload.ForType != message.CallMsg {
+					// the call is completed by its result
+					tr.received(m.Payload.For.String(), m)
 				}
 
-			case message.AckMsg:
-				atomic.AddInt64(&stats.Ack, 1)
-				return
-			case message.NackMsg:
+			case *message.Nack:
 				atomic.AddInt64(&stats.Nack, 1)
+				tr.received(m.Payload.For.String(), m)
+
+			case *message.Evnt:
+				atomic.AddInt64(&stats.Evnt, 1)
+
 			default:
 				log.Fatalf("unexpected message type %s", m.Type())
 			}
-			wgResults.Done()
 		})))
 
 	if err != nil {
@@ -474,6 +539,7 @@ func runClient(stats *runStats, started chan<- struct{}, stop <-chan struct{}, r
 	if stats.Rate >= 0 {
 		after = time.After(0)
 	}
+	var subscribed bool
 	started <- struct{}{}
 loop:
 	for {
@@ -484,25 +550,42 @@ loop:
 		case <-after: // nil if Rate < 0
 		}
 
+		op := pickOp(mix)
 		wgResults.Add(1)
-		atomic.AddInt64(&stats.Calls, 1)
-		uid, err := cli.Call(getURI(stats), stats.Payload, stats.Timeout)
+		start := time.Now()
+
+		var uid uuid.UUID
+		var err error
+		switch op {
+		case callOp:
+			atomic.AddInt64(&stats.Calls, 1)
+			uid, err = cli.CallCtx(context.Background(), getURI(stats), stats.Payload, stats.Timeout)
+		case pubOp:
+			atomic.AddInt64(&stats.Pubs, 1)
+			uid, err = cli.PubCtx(context.Background(), stats.Channel, stats.Payload)
+		case subOp:
+			atomic.AddInt64(&stats.Subs, 1)
+			if subscribed {
+				uid, err = cli.UnsbCtx(context.Background(), stats.Channel, false)
+			} else {
+				uid, err = cli.SubCtx(context.Background(), stats.Channel, false)
+			}
+			subscribed = !subscribed
+		}
 		if err != nil {
-			log.Fatalf("Call failed: %v", err)
+			log.Fatalf("%s failed: %v", op, err)
 		}
-		mu.Lock()
-		startTimes[uid.String()] = time.Now()
-		mu.Unlock()
+		tr.sent(uid.String(), op, start)
 
 		if stats.Rate >= 0 {
 			after = time.After(stats.Rate)
 		}
 	}
-	// wait for sent calls to return or expire
+	// wait for sent requests to return or expire
 	wgResults.Wait()
 
 	if err := cli.Close(); err != nil {
 		log.Fatalf("Close failed: %v", err)
 	}
-	resLatencies <- latencies
+	results <- tr.results
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPctlFn(t *testing.T) {
@@ -38,3 +41,68 @@ func TestPctlFn(t *testing.T) {
 		assert.Equal(t, c.out, got, "%d", i)
 	}
 }
+
+func TestParseMix(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []mixOp
+		err bool
+	}{
+		{"call=1", []mixOp{{callOp, 1}}, false},
+		{"call=8, pub=1,sub=1", []mixOp{{callOp, 8}, {pubOp, 1}, {subOp, 1}}, false},
+		{"call=0,pub=2", []mixOp{{pubOp, 2}}, false},
+		{"", nil, true},
+		{"call=0", nil, true},
+		{"call", nil, true},
+		{"call=x", nil, true},
+		{"call=-1", nil, true},
+		{"evnt=1", nil, true},
+	}
+
+	for i, c := range cases {
+		got, err := parseMix(c.in)
+		if c.err {
+			assert.Error(t, err, "%d", i)
+			continue
+		}
+		if assert.NoError(t, err, "%d", i) {
+			assert.Equal(t, c.out, got, "%d", i)
+		}
+	}
+}
+
+func TestPickOp(t *testing.T) {
+	mix := []mixOp{{callOp, 3}, {pubOp, 0}, {subOp, 1}}
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[pickOp(mix)]++
+	}
+	assert.Equal(t, 0, counts[pubOp], "pub")
+	assert.True(t, counts[callOp] > counts[subOp], "call %d > sub %d", counts[callOp], counts[subOp])
+}
+
+func TestHistogram(t *testing.T) {
+	h := histogram([]time.Duration{0, time.Millisecond, 1500 * time.Microsecond, 3 * time.Second, time.Minute})
+	require.Len(t, h, len(latencyBuckets)+1)
+	counts := make(map[string]int)
+	for _, b := range h {
+		counts[b.Label()] = b.Count
+	}
+	assert.Equal(t, map[string]int{
+		"1ms": 2, "2ms": 1, "5ms": 0, "10ms": 0, "20ms": 0, "50ms": 0, "100ms": 0,
+		"200ms": 0, "500ms": 0, "1s": 0, "2s": 0, "5s": 1, "+Inf": 1,
+	}, counts)
+}
+
+func TestWriteCSV(t *testing.T) {
+	res := &opResult{latencies: []time.Duration{time.Millisecond, 3 * time.Millisecond}, failed: 1}
+	r := newOpReport(pubOp, 3, res, time.Second)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeCSV(&buf, []*opReport{r}), "writeCSV")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "op,requests,completed,failed,throughput,min_ms,"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[0], ",le_5s,le_+Inf"), lines[0])
+	assert.Equal(t, "pub,3,2,1,2.0,1.000,2.000,2.000,3.000,3.000,3.000,3.000,1,0,1,0,0,0,0,0,0,0,0,0,0", lines[1])
+}
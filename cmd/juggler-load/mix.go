@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// the operations of the traffic mix.
+const (
+	callOp = "call" // CALL, completed by its RES, or its NACK or expiration
+	pubOp  = "pub"  // PUB, completed by its ACK or NACK
+	subOp  = "sub"  // SUB or UNSB alternatively, completed by its ACK or NACK
+)
+
+var ops = []string{callOp, pubOp, subOp}
+
+// mixOp is an operation of the traffic mix with its weight.
+type mixOp struct {
+	op     string
+	weight int
+}
+
+// parseMix parses the comma-separated op=weight ratios of the traffic
+// mix, e.g. "call=8,pub=1,sub=1".
+func parseMix(s string) ([]mixOp, error) {
+	var mix []mixOp
+	var total int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		parts := strings.SplitN(part, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid mix %q, must be op=weight", part)
+		}
+
+		op := strings.TrimSpace(parts[0])
+		if !isIn(ops, op) {
+			return nil, fmt.Errorf("invalid mix operation %q, must be one of %s", op, strings.Join(ops, ", "))
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid mix weight %q for %s", parts[1], op)
+		}
+		if w > 0 {
+			mix = append(mix, mixOp{op: op, weight: w})
+			total += w
+		}
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("invalid mix %q, no operation has a weight", s)
+	}
+	return mix, nil
+}
+
+// pickOp returns an operation of the mix at random, according to the
+// weights.
+func pickOp(mix []mixOp) string {
+	var total int
+	for _, mo := range mix {
+		total += mo.weight
+	}
+	n := rand.Intn(total)
+	for _, mo := range mix {
+		if n < mo.weight {
+			return mo.op
+		}
+		n -= mo.weight
+	}
+	return mix[len(mix)-1].op
+}
+
+func isIn(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// opResult is the result of the requests of an operation made by a
+// connection.
+type opResult struct {
+	latencies []time.Duration // of the completed requests
+	failed    int             // NACK or expired
+}
+
+// inflight is a request waiting for its response.
+type inflight struct {
+	op    string
+	start time.Time
+}
+
+// response is a response received before its request was registered.
+type response struct {
+	m  message.Msg
+	at time.Time
+}
+
+// tracker tracks the requests of a connection until they complete, and
+// collects their results. As the response may be received before the
+// request is registered, the early responses are kept until it is.
+type tracker struct {
+	done func(op string) // called once for each completed request
+
+	mu       sync.Mutex
+	inflight map[string]inflight
+	early    map[string]response
+	results  map[string]*opResult
+}
+
+func newTracker(done func(string)) *tracker {
+	return &tracker{
+		done:     done,
+		inflight: make(map[string]inflight),
+		early:    make(map[string]response),
+		results:  make(map[string]*opResult),
+	}
+}
+
+// sent registers the request id of the operation op, started at start.
+func (t *tracker) sent(id, op string, start time.Time) {
+	t.mu.Lock()
+	r, ok := t.early[id]
+	if !ok {
+		t.inflight[id] = inflight{op: op, start: start}
+		t.mu.Unlock()
+		return
+	}
+	delete(t.early, id)
+	t.record(op, r.m, r.at.Sub(start))
+	t.mu.Unlock()
+
+	t.done(op)
+}
+
+// received completes the request id with the response m.
+func (t *tracker) received(id string, m message.Msg) {
+	now := time.Now()
+
+	t.mu.Lock()
+	req, ok := t.inflight[id]
+	if !ok {
+		t.early[id] = response{m: m, at: now}
+		t.mu.Unlock()
+		return
+	}
+	delete(t.inflight, id)
+	t.record(req.op, m, now.Sub(req.start))
+	t.mu.Unlock()
+
+	t.done(req.op)
+}
+
+// record must be called with the lock held.
+func (t *tracker) record(op string, m message.Msg, d time.Duration) {
+	res := t.results[op]
+	if res == nil {
+		res = &opResult{}
+		t.results[op] = res
+	}
+	switch m.Type() {
+	case message.ResMsg, message.AckMsg:
+		res.latencies = append(res.latencies, d)
+	default:
+		res.failed++
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of the latency
+// histograms, the latencies above the last one go in an unbounded
+// bucket.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// histBucket is a bucket of a latency histogram.
+type histBucket struct {
+	UpperBound time.Duration // 0 if unbounded
+	Count      int
+}
+
+// Label returns the label of the bucket in the reports.
+func (b histBucket) Label() string {
+	if b.UpperBound == 0 {
+		return "+Inf"
+	}
+	return b.UpperBound.String()
+}
+
+// histogram returns the number of durations in each of the latency
+// buckets.
+func histogram(durs []time.Duration) []histBucket {
+	buckets := make([]histBucket, len(latencyBuckets)+1)
+	for i, ub := range latencyBuckets {
+		buckets[i].UpperBound = ub
+	}
+	for _, d := range durs {
+		i := 0
+		for ; i < len(latencyBuckets); i++ {
+			if d <= latencyBuckets[i] {
+				break
+			}
+		}
+		buckets[i].Count++
+	}
+	return buckets
+}
+
+// opReport is the report of the requests of an operation of the mix.
+type opReport struct {
+	Name       string
+	Requests   int64
+	Completed  int
+	Failed     int
+	Throughput float64 // completed requests per second
+
+	Min, Max, Avg      time.Duration
+	P50, P75, P90, P99 time.Duration
+	Histogram          []histBucket
+}
+
+func newOpReport(name string, requests int64, res *opResult, elapsed time.Duration) *opReport {
+	r := &opReport{Name: name, Requests: requests}
+	if res == nil {
+		res = &opResult{}
+	}
+	durs := res.latencies
+
+	r.Completed = len(durs)
+	r.Failed = res.failed
+	if elapsed > 0 {
+		r.Throughput = float64(r.Completed) / elapsed.Seconds()
+	}
+	r.Min = pctlFn(0, durs)
+	r.Max = pctlFn(100, durs)
+	r.Avg = avgFn(durs)
+	r.P50 = pctlFn(50, durs)
+	r.P75 = pctlFn(75, durs)
+	r.P90 = pctlFn(90, durs)
+	r.P99 = pctlFn(99, durs)
+	r.Histogram = histogram(durs)
+	return r
+}
+
+// writeReport writes the report in the format, which is text, json or
+// csv.
+func writeReport(w io.Writer, format string, ts *templateStats) error {
+	switch format {
+	case "text":
+		return tpl.Execute(w, ts)
+	case "json":
+		enc := json.NewEncoder(w)
+		return enc.Encode(ts)
+	case "csv":
+		return writeCSV(w, ts.Ops)
+	default:
+		return fmt.Errorf("invalid report format %q", format)
+	}
+}
+
+// writeCSV writes a row for each operation, with the durations in
+// milliseconds.
+func writeCSV(w io.Writer, reports []*opReport) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"op", "requests", "completed", "failed", "throughput",
+		"min_ms", "avg_ms", "p50_ms", "p75_ms", "p90_ms", "p99_ms", "max_ms"}
+	for _, b := range histogram(nil) {
+		header = append(header, "le_"+b.Label())
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	for _, r := range reports {
+		row := []string{
+			r.Name,
+			strconv.FormatInt(r.Requests, 10),
+			strconv.Itoa(r.Completed),
+			strconv.Itoa(r.Failed),
+			strconv.FormatFloat(r.Throughput, 'f', 1, 64),
+			ms(r.Min), ms(r.Avg), ms(r.P50), ms(r.P75), ms(r.P90), ms(r.P99), ms(r.Max),
+		}
+		for _, b := range r.Histogram {
+			row = append(row, strconv.Itoa(b.Count))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
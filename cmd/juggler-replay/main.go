@@ -0,0 +1,92 @@
+// Command juggler-replay replays the websocket sessions recorded by a
+// juggler server or client (see the session package) against a server,
+// to reproduce an issue that depends on the timing of the requests.
+// The frames sent by the clients in the recording file are sent to the
+// server at the -url, on a new connection for each recorded session, at
+// their original pace multiplied by -speed:
+//
+//     juggler-replay -url ws://localhost:9000/ws -speed 2 sessions.jsonl
+//
+// The frames received from the server are printed to stdout as JSON
+// lines, in the format of the recording, if -v is set.
+//
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/internal/completion"
+	"github.com/PuerkitoBio/juggler/session"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	helpFlag    = flag.Bool("help", false, "Show help.")
+	lingerFlag  = flag.Duration("linger", session.DefaultLinger, "Wait this `duration` for the responses after the last frame of a session.")
+	speedFlag   = flag.Float64("speed", 1, "Pace `factor` of the frames, the frames are sent without delay if negative.")
+	urlFlag     = flag.String("url", "ws://localhost:9000/ws", "Websocket `URL` of the server.")
+	verboseFlag = flag.Bool("v", false, "Print the frames received from the server.")
+)
+
+func main() {
+	flag.Parse()
+	if *helpFlag {
+		flag.Usage()
+		return
+	}
+
+	if ok, err := completion.Run(os.Stdout, "juggler-replay", flag.CommandLine, flag.Args()); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "expected the recording file as argument")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	frames, err := session.ReadFrames(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid recording file: %v\n", err)
+		os.Exit(1)
+	}
+
+	rp := &session.Replayer{
+		Dialer: &websocket.Dialer{Subprotocols: juggler.Subprotocols},
+		URL:    *urlFlag,
+		Speed:  *speedFlag,
+		Linger: *lingerFlag,
+	}
+	if *verboseFlag {
+		var mu sync.Mutex
+		enc := json.NewEncoder(os.Stdout)
+		rp.Received = func(f *session.Frame) {
+			mu.Lock()
+			enc.Encode(f)
+			mu.Unlock()
+		}
+	}
+
+	start := time.Now()
+	if err := rp.Replay(frames); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to replay the sessions: %v\n", err)
+		os.Exit(3)
+	}
+	fmt.Fprintf(os.Stderr, "replayed %d frames in %v\n", len(frames), time.Since(start))
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	_ "net/http/pprof" // registers the profiles on http.DefaultServeMux
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/broker/redisbroker"
+	"github.com/PuerkitoBio/juggler/internal/srvhandler"
+	"gopkg.in/yaml.v2"
+)
+
+// newAdminServer returns the HTTP server that serves the admin endpoints
+// on the admin address of the configuration. It should not be exposed
+// publicly.
+func newAdminServer(rl *reloader, logFn func(string, ...interface{})) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/config", configHandler(rl.config, rl.maint))
+	mux.Handle("/maintenance", maintenanceHandler(rl.maint, logFn))
+	mux.Handle("/nacks", nacksHandler(rl.nackLimit))
+	mux.Handle("/connections", connectionsHandler(rl.conns, rl.closeConns, logFn))
+	mux.Handle("/connections/", connectionsHandler(rl.conns, rl.closeConns, logFn))
+	mux.Handle("/broadcast", broadcastHandler(rl.broadcast, rl.broadcastAll, logFn))
+	mux.Handle("/healthz", healthzHandler())
+	mux.Handle("/readyz", readyzHandler(rl.ready))
+	mux.Handle("/brokers", brokersHandler(map[string]interface{}{"pubsub": rl.psb, "caller": rl.cb}))
+	mux.Handle("/metrics", metricsHandler(rl.vars))
+	if rl.backlog != nil {
+		mux.Handle("/metrics/backlog", rl.backlog)
+	}
+	mux.Handle("/policy", policyHandler(rl.policy))
+	mux.Handle("/policy/audit", policyAuditHandler(rl.policy))
+	if rb, ok := rl.cb.(broker.RegistryBroker); ok {
+		mux.Handle("/callees", calleesHandler(rb))
+	}
+	if rl.config().Server.AdminDebug {
+		// the pprof and expvar packages register their handlers on the
+		// default mux, which is not served otherwise.
+		mux.Handle("/debug/", http.DefaultServeMux)
+	}
+	if rl.config().Server.AdminToken == "" {
+		logFn("admin_token is not set, the admin endpoints that change the server or expose its configuration are disabled")
+	}
+	return &http.Server{
+		Addr: rl.config().Server.AdminAddr,
+		Handler: adminAuth(func() string {
+			return rl.config().Server.AdminToken
+		}, mux),
+	}
+}
+
+// adminAuth returns a handler that calls h if the request has the
+// header "Authorization: Bearer <token>", and answers 401 otherwise.
+// The token is read from token on each request, so that a reloaded
+// token applies immediately. The health checks are always allowed. If
+// the token is empty, the requests are allowed except for the routes
+// that require a token (see requiresToken), which answer 403.
+func adminAuth(token func() string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		tok := token()
+		if tok == "" {
+			if requiresToken(r.URL.Path) {
+				http.Error(w, "admin_token required", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+tok)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="juggler-admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requiresToken returns true if the admin route of path changes the
+// server or exposes its configuration or internals, so that it is never
+// served without an admin token.
+func requiresToken(path string) bool {
+	switch {
+	case path == "/config", path == "/maintenance", path == "/broadcast":
+		return true
+	case path == "/policy", strings.HasPrefix(path, "/policy/"):
+		return true
+	case strings.HasPrefix(path, "/debug/"):
+		return true
+	case strings.HasPrefix(path, "/connections/") && strings.HasSuffix(path, "/close"):
+		return true
+	}
+	return false
+}
+
+// configHandler returns the effective configuration of the server, as
+// returned by conf, as JSON on GET, e.g.:
+//
+//     curl localhost:9002/config
+//
+func configHandler(conf func() *Config, maint *srvhandler.Maintenance) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		snap, err := configSnapshot(flag.CommandLine, conf(), maint)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snap)
+	})
+}
+
+// snapshot is the effective configuration of the server.
+type snapshot struct {
+	// Flags is the value of each command-line flag, including defaults.
+	Flags map[string]string `json:"flags"`
+
+	// Config is the configuration resolved from the flags and the
+	// configuration file, using the same keys as the file.
+	Config interface{} `json:"config"`
+
+	// Runtime is the state of the settings that can change while
+	// the server is running.
+	Runtime map[string]interface{} `json:"runtime"`
+}
+
+func configSnapshot(fs *flag.FlagSet, conf *Config, maint *srvhandler.Maintenance) (*snapshot, error) {
+	flags := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	v, err := yamlJSONValue(redactConfig(conf))
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot{
+		Flags:  flags,
+		Config: v,
+		Runtime: map[string]interface{}{
+			"maintenance":          maint.Enabled(),
+			"default_call_timeout": broker.DefaultCallTimeout.String(),
+		},
+	}, nil
+}
+
+// redacted replaces the secrets of the configuration in its snapshot.
+const redacted = "<redacted>"
+
+// redactConfig returns a copy of conf with its secrets redacted, so that
+// they are not served by the admin endpoints.
+func redactConfig(conf *Config) *Config {
+	c := *conf
+	if c.CallerBroker != nil {
+		cb := *c.CallerBroker
+		if cb.EncryptionKeys != "" {
+			cb.EncryptionKeys = redacted
+		}
+		c.CallerBroker = &cb
+	}
+	if c.Server != nil {
+		srv := *c.Server
+		if srv.AdminToken != "" {
+			srv.AdminToken = redacted
+		}
+		if len(srv.Webhooks) > 0 {
+			srv.Webhooks = make([]*Webhook, len(c.Server.Webhooks))
+			for i, wh := range c.Server.Webhooks {
+				cpy := *wh
+				if cpy.Secret != "" {
+					cpy.Secret = redacted
+				}
+				srv.Webhooks[i] = &cpy
+			}
+		}
+		c.Server = &srv
+	}
+	return &c
+}
+
+// yamlJSONValue returns the value of v that encodes as JSON with the same
+// keys as in YAML. It goes through YAML so that the keys and durations
+// are formatted as in the configuration file.
+func yamlJSONValue(v interface{}) (interface{}, error) {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var vv interface{}
+	if err := yaml.Unmarshal(b, &vv); err != nil {
+		return nil, err
+	}
+	return jsonValue(vv), nil
+}
+
+// jsonValue converts the maps decoded from YAML, which have interface{}
+// keys, to maps that can be encoded as JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			m[fmt.Sprint(k)] = jsonValue(vv)
+		}
+		return m
+	case []interface{}:
+		for i, vv := range v {
+			v[i] = jsonValue(vv)
+		}
+		return v
+	}
+	return v
+}
+
+// maintenanceHandler returns the state of the maintenance mode on GET,
+// and sets it on POST or PUT using the "enabled" form value, e.g.:
+//
+//     curl -X POST localhost:9002/maintenance?enabled=true
+//
+func maintenanceHandler(maint *srvhandler.Maintenance, logFn func(string, ...interface{})) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+		case "POST", "PUT":
+			enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+			if err != nil {
+				http.Error(w, "invalid enabled value: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			maint.SetEnabled(enabled)
+			logFn("maintenance mode set to %t via admin endpoint", enabled)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Enabled bool `json:"enabled"`
+		}{maint.Enabled()})
+	})
+}
+
+// calleesHandler returns the live callee instances registered for the
+// URI specified by the "uri" form value as JSON on GET, e.g.:
+//
+//     curl localhost:9002/callees?uri=test.echo
+//
+func calleesHandler(rb broker.RegistryBroker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		uri := r.FormValue("uri")
+		if uri == "" {
+			http.Error(w, "missing uri value", http.StatusBadRequest)
+			return
+		}
+
+		cis, err := rb.Callees(uri)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cis)
+	})
+}
+
+// nacksHandler returns the open connections that exceeded the NACK rate
+// limit as JSON on GET, e.g.:
+//
+//     curl localhost:9002/nacks
+//
+func nacksHandler(nackLimit *srvhandler.NackLimit) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(nackLimit.Offenders())
+	})
+}
+
+// healthzHandler answers 200 to any request as long as the process
+// serves HTTP requests, e.g.:
+//
+//     curl localhost:9002/healthz
+//
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// readyzHandler answers 200 if the server is ready to serve connections,
+// as reported by the ready function, and 503 otherwise, e.g.:
+//
+//     curl localhost:9002/readyz
+//
+func readyzHandler(ready func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// brokerHealth is implemented by the brokers that report their health
+// and the state of their connection pool, such as redisbroker.Broker.
+type brokerHealth interface {
+	Ping() error
+	Stats() map[string]redisbroker.PoolStats
+}
+
+// brokerState is the health of a broker, as returned by brokersHandler.
+type brokerState struct {
+	OK    bool                             `json:"ok"`
+	Error string                           `json:"error,omitempty"`
+	Pools map[string]redisbroker.PoolStats `json:"pools,omitempty"`
+}
+
+// brokersHandler returns the health of the brokers, by name, and the
+// state of their connection pools as JSON on GET, e.g.:
+//
+//     curl localhost:9002/brokers
+//
+// The brokers that don't implement brokerHealth are omitted. The pools
+// are saturated when their active count reaches their max_active.
+func brokersHandler(brokers map[string]interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		states := make(map[string]brokerState)
+		for name, b := range brokers {
+			bh, ok := b.(brokerHealth)
+			if !ok {
+				continue
+			}
+			st := brokerState{OK: true, Pools: bh.Stats()}
+			if err := bh.Ping(); err != nil {
+				st.OK = false
+				st.Error = err.Error()
+			}
+			states[name] = st
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(states)
+	})
+}
+
+// connectionsHandler returns the open connections as JSON on GET, and
+// closes the connection identified by UUID on POST to
+// /connections/UUID/close. On POST to /connections/close, it closes
+// the connections with the identity or subscribed to the channel set in
+// the query string with closeConns (see juggler.Server.CloseConnsByIdentity
+// and juggler.Server.CloseConnsSubscribedTo), and returns the number of
+// connections closed as JSON, e.g.:
+//
+//     curl localhost:9002/connections
+//     curl -X POST localhost:9002/connections/8b34.../close
+//     curl -X POST localhost:9002/connections/close?identity=alice
+//     curl -X POST localhost:9002/connections/close?channel=config.updates
+//
+func connectionsHandler(conns *srvhandler.Connections, closeConns func(identity, channel string, reason error) int, logFn func(string, ...interface{})) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/connections" || r.URL.Path == "/connections/" {
+			if r.Method != "GET" && r.Method != "HEAD" {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(conns.List())
+			return
+		}
+
+		if r.URL.Path == "/connections/close" {
+			if r.Method != "POST" {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			identity, channel := r.URL.Query().Get("identity"), r.URL.Query().Get("channel")
+			if (identity == "") == (channel == "") {
+				http.Error(w, "exactly one of identity or channel is required", http.StatusBadRequest)
+				return
+			}
+			n := closeConns(identity, channel, errClosedByAdmin)
+			if identity != "" {
+				logFn("%d connections of identity %q closed via admin endpoint", n, identity)
+			} else {
+				logFn("%d connections subscribed to %q closed via admin endpoint", n, channel)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"closed": n})
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/connections/"), "/")
+		if len(parts) != 2 || parts[1] != "close" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if !conns.Close(parts[0], errClosedByAdmin) {
+			http.NotFound(w, r)
+			return
+		}
+		logFn("%s: connection closed via admin endpoint", parts[0])
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// errClosedByAdmin is the error of the connections closed via the
+// admin endpoint.
+var errClosedByAdmin = errors.New("closed by admin")
+
+// maxBroadcastSize is the maximum size of the arguments of an event
+// sent to the broadcast admin endpoint.
+const maxBroadcastSize = 1 << 20
+
+// broadcastHandler writes an event on the channel set in the query
+// string with the JSON body as arguments to all the connections of the
+// server on POST, and returns the number of connections it was sent to
+// as JSON. If cluster=true is set, the event is published with
+// broadcastAll for all the servers that relay the broadcasts instead,
+// e.g.:
+//
+//     curl -X POST -d '"maintenance in 5 minutes"' localhost:9002/broadcast?channel=announcements
+//     curl -X POST -d '"maintenance in 5 minutes"' localhost:9002/broadcast?channel=announcements&cluster=true
+//
+func broadcastHandler(broadcast func(channel string, args json.RawMessage) (int, error), broadcastAll func(channel string, args json.RawMessage) error, logFn func(string, ...interface{})) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		channel := r.URL.Query().Get("channel")
+		if channel == "" {
+			http.Error(w, "missing channel value", http.StatusBadRequest)
+			return
+		}
+		var cluster bool
+		if v := r.URL.Query().Get("cluster"); v != "" {
+			var err error
+			if cluster, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "invalid cluster value: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBroadcastSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(b) == 0 {
+			b = []byte("null")
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			http.Error(w, "invalid arguments: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if cluster {
+			if err := broadcastAll(channel, b); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logFn("broadcast on %s published via admin endpoint", channel)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		n, err := broadcast(channel, b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logFn("broadcast on %s sent to %d connections via admin endpoint", channel, n)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"sent": n})
+	})
+}
+
+// metricsHandler returns the metrics of the server as JSON on GET, e.g.:
+//
+//     curl localhost:9002/metrics
+//
+func metricsHandler(vars *expvar.Map) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, vars.String())
+	})
+}
+
+// maxPolicySize is the maximum size of a policy document sent to the
+// policy admin endpoint.
+const maxPolicySize = 1 << 20
+
+// policyHandler returns the current policy as JSON on GET, and replaces
+// it on PUT with the policy in the body, in JSON or YAML with the same
+// keys as in the configuration file, e.g.:
+//
+//     curl localhost:9002/policy
+//     curl -X PUT -d '{"rate_limit": 100, "window": "1s"}' localhost:9002/policy
+//
+// If the policy is shared, the change applies to all the servers. The
+// changes are logged and recorded for the audit.
+func policyHandler(pm *policyManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+		case "PUT":
+			b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPolicySize))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var p srvhandler.Policy
+			if err := yaml.Unmarshal(b, &p); err != nil {
+				http.Error(w, "invalid policy: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := p.Validate(); err != nil {
+				http.Error(w, "invalid policy: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := pm.update(&p, "admin endpoint from "+r.RemoteAddr); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		v, err := yamlJSONValue(pm.policies.Policy())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+}
+
+// policyAuditHandler returns the recent changes of the policy as JSON on
+// GET, the most recent last, e.g.:
+//
+//     curl localhost:9002/policy/audit
+//
+func policyAuditHandler(pm *policyManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := yamlJSONValue(pm.audit())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if v == nil {
+			v = []interface{}{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// defaultBacklogInterval is the interval at which the backlog is sampled
+// when the configuration does not set it.
+const defaultBacklogInterval = 10 * time.Second
+
+// backlogExporter periodically samples the number of call requests
+// waiting for a callee on a list of URIs, so that autoscalers can scale
+// the callees on the backlog. The last sample is served in the
+// Prometheus text format, and published as a JSON event on a channel
+// if it is set. All the servers that export the backlog of a URI
+// sample the same queues.
+type backlogExporter struct {
+	inspector broker.Inspector
+	psb       broker.PubSubBroker
+	uris      []string
+	channel   string
+	interval  time.Duration
+	logFn     func(string, ...interface{})
+
+	mu     sync.Mutex
+	at     time.Time
+	counts map[string]int // by URI, missing if it could not be sampled
+}
+
+// backlogEvent is the payload of the events published on the backlog
+// channel.
+type backlogEvent struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Queues    map[string]int `json:"queues"`
+}
+
+// newBacklogExporter returns the backlog exporter configured in conf, or
+// nil if it is disabled or the caller broker cannot report its backlog.
+func newBacklogExporter(conf *Server, cb broker.CallerBroker, psb broker.PubSubBroker, logFn func(string, ...interface{})) *backlogExporter {
+	if len(conf.BacklogURIs) == 0 {
+		return nil
+	}
+	ib, ok := cb.(broker.Inspector)
+	if !ok {
+		logFn("backlog not exported, the caller broker does not report it")
+		return nil
+	}
+	interval := conf.BacklogInterval
+	if interval <= 0 {
+		interval = defaultBacklogInterval
+	}
+	return &backlogExporter{
+		inspector: ib,
+		psb:       psb,
+		uris:      conf.BacklogURIs,
+		channel:   conf.BacklogChannel,
+		interval:  interval,
+		logFn:     logFn,
+	}
+}
+
+// run samples the backlog at each interval, it never returns.
+func (be *backlogExporter) run() {
+	for {
+		be.sample()
+		time.Sleep(be.interval)
+	}
+}
+
+// sample reads the number of pending call requests of each URI, and
+// publishes them on the channel if it is set.
+func (be *backlogExporter) sample() {
+	counts := make(map[string]int, len(be.uris))
+	for _, uri := range be.uris {
+		n, err := be.inspector.QueueLen(uri)
+		if err != nil {
+			be.logFn("failed to sample the backlog of %s: %v", uri, err)
+			continue
+		}
+		counts[uri] = n
+	}
+	now := time.Now().UTC()
+
+	be.mu.Lock()
+	be.at, be.counts = now, counts
+	be.mu.Unlock()
+
+	if be.channel == "" {
+		return
+	}
+	b, err := json.Marshal(backlogEvent{Timestamp: now, Queues: counts})
+	if err != nil {
+		be.logFn("failed to marshal backlog: %v", err)
+		return
+	}
+	pp := &message.PubPayload{MsgUUID: message.NewID(), Args: b, Timestamp: now}
+	if err := be.psb.Publish(be.channel, pp); err != nil {
+		be.logFn("failed to publish backlog: %v", err)
+	}
+}
+
+// labelEscaper escapes the label values of the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP serves the last sample of the backlog on GET in the
+// Prometheus text format, e.g.:
+//
+//     curl localhost:9002/metrics/backlog
+//
+func (be *backlogExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	be.mu.Lock()
+	at, counts := be.at, be.counts
+	be.mu.Unlock()
+
+	uris := make([]string, 0, len(counts))
+	for uri := range counts {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP juggler_call_backlog Number of call requests waiting for a callee.")
+	fmt.Fprintln(w, "# TYPE juggler_call_backlog gauge")
+	ms := at.UnixNano() / int64(time.Millisecond)
+	for _, uri := range uris {
+		fmt.Fprintf(w, "juggler_call_backlog{uri=\"%s\"} %d %d\n", labelEscaper.Replace(uri), counts[uri], ms)
+	}
+}
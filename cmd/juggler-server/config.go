@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/internal/srvhandler"
 
 	"gopkg.in/yaml.v2"
 )
@@ -19,14 +21,48 @@ type Redis struct {
 	MaxActive   int           `yaml:"max_active"`
 	MaxIdle     int           `yaml:"max_idle"`
 	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	Cluster     bool          `yaml:"cluster"`
 	PubSub      *Redis        `yaml:"pubsub"`
 	Caller      *Redis        `yaml:"caller"`
+
+	// pool options, see redisbroker.PoolConfig. The idle connections
+	// are tested with a PING when they are borrowed from the pool if
+	// they were idle for at least TestIdleAfter.
+	Wait          bool          `yaml:"wait"`
+	TestIdleAfter time.Duration `yaml:"test_idle_after"`
 }
 
 // CallerBroker defines the configuration options for the caller broker.
 type CallerBroker struct {
-	BlockingTimeout time.Duration `yaml:"blocking_timeout"`
-	CallCap         int           `yaml:"call_cap"`
+	BlockingTimeout   time.Duration `yaml:"blocking_timeout"`
+	CallCap           int           `yaml:"call_cap"`
+	ServerID          string        `yaml:"server_id"`
+	ConnLeaseTTL      time.Duration `yaml:"conn_lease_ttl"`
+	CompressThreshold int           `yaml:"compress_threshold"`
+
+	// CallStreams stores the round-robin call requests in redis streams
+	// (see redisbroker.Broker.CallStreams). The callees must use the
+	// streams before it is set.
+	CallStreams bool `yaml:"call_streams"`
+
+	// EncryptionKeys encrypts the arguments of the call requests and
+	// results in redis with the keys (see redisbroker.ParseKeys), the
+	// first one being the current key. The callees must have the keys
+	// before it is set. It is redacted in /config.
+	EncryptionKeys string `yaml:"encryption_keys"`
+}
+
+// PubSubBroker defines the configuration options for the pub-sub broker.
+type PubSubBroker struct {
+	HistoryCap       int           `yaml:"history_cap"`
+	HistoryTTL       time.Duration `yaml:"history_ttl"`
+	EventShards      int           `yaml:"event_shards"`
+	EventShardBuffer int           `yaml:"event_shard_buffer"`
+	EventSequence    bool          `yaml:"event_sequence"`
+
+	// PatternSyntax is the syntax of the channel patterns, either "glob"
+	// (the default), "mqtt" or "exact" (see broker.PatternSyntax).
+	PatternSyntax string `yaml:"pattern_syntax"`
 }
 
 // Server defines the juggler server configuration options.
@@ -39,26 +75,237 @@ type Server struct {
 	WriteBufferSize    int           `yaml:"write_buffer_size"`
 	HandshakeTimeout   time.Duration `yaml:"handshake_timeout"`
 	WhitelistedOrigins []string      `yaml:"whitelisted_origins"`
+	EnableCompression  bool          `yaml:"enable_compression"`
+	CompressionLevel   int           `yaml:"compression_level"`
+
+	// TLS configuration, the server listens for TLS connections if
+	// both files are set, or if the autocert hosts are set to obtain the
+	// certificate from Let's Encrypt. The client auth is one of "none",
+	// "request", "require", "verify" or "require_and_verify", by default
+	// "require_and_verify" if the client CA file is set and "none"
+	// otherwise.
+	TLSCertFile      string   `yaml:"tls_cert_file"`
+	TLSKeyFile       string   `yaml:"tls_key_file"`
+	TLSClientCAFile  string   `yaml:"tls_client_ca_file"`
+	TLSClientAuth    string   `yaml:"tls_client_auth"`
+	AutocertHosts    []string `yaml:"autocert_hosts"`
+	AutocertCacheDir string   `yaml:"autocert_cache_dir"`
+	AutocertEmail    string   `yaml:"autocert_email"`
 
-	// websocket/juggler configuration
+	// websocket/juggler configuration. The read and write timeouts of 0
+	// use juggler.DefaultReadTimeout and juggler.DefaultWriteTimeout, a
+	// negative value means no timeout.
 	ReadLimit               int64         `yaml:"read_limit"`
 	ReadTimeout             time.Duration `yaml:"read_timeout"`
 	WriteLimit              int64         `yaml:"write_limit"`
 	WriteTimeout            time.Duration `yaml:"write_timeout"`
 	AcquireWriteLockTimeout time.Duration `yaml:"acquire_write_lock_timeout"`
 	AllowEmptySubprotocol   bool          `yaml:"allow_empty_subprotocol"`
+	TimeSync                bool          `yaml:"time_sync"`
+	CheckCallees            bool          `yaml:"check_callees"`
+	History                 bool          `yaml:"history"`
+	Sticky                  bool          `yaml:"sticky"`
+	FlowControl             bool          `yaml:"flow_control"`
+	CreditBuffer            int           `yaml:"credit_buffer"`
+	Strict                  bool          `yaml:"strict"`
+	SortableIDs             bool          `yaml:"sortable_ids"` // see message.NewSortableID
+
+	// name validation options, see juggler.NamePolicy. If ValidateNames
+	// is set, the requests with a URI or channel that does not follow
+	// the policy are NACKed before they reach the brokers.
+	ValidateNames        bool     `yaml:"validate_names"`
+	NameSeparator        string   `yaml:"name_separator"`
+	NameChars            string   `yaml:"name_chars"`
+	NameMaxDepth         int      `yaml:"name_max_depth"`
+	NameMaxLength        int      `yaml:"name_max_length"`
+	ReservedNamePrefixes []string `yaml:"reserved_name_prefixes"`
 
 	// handler options
 	CloseURI                string        `yaml:"close_uri"`
 	PanicURI                string        `yaml:"panic_uri"`
 	SlowProcessMsgThreshold time.Duration `yaml:"slow_process_msg_threshold"`
+
+	// logging options, the level is either "debug" (the default) to log
+	// the connections and the messages, or "info" to log the connections
+	// only. The -L flag disables all logging.
+	LogLevel string `yaml:"log_level"`
+
+	// maintenance mode options
+	Maintenance  bool     `yaml:"maintenance"`
+	ReadOnlyURIs []string `yaml:"read_only_uris"`
+
+	// results cache options, see juggler.SetCacheableURIs
+	CacheableURIs map[string]time.Duration `yaml:"cacheable_uris"`
+
+	// state channels options, see srvhandler.StateChannels
+	StateChannels      []string `yaml:"state_channels"`
+	StateFullSyncEvery int      `yaml:"state_full_sync_every"`
+
+	// schema validation options, see schema.Validator. The schemas are
+	// stored by the caller broker.
+	ValidateSchemas bool          `yaml:"validate_schemas"`
+	SchemaCacheTTL  time.Duration `yaml:"schema_cache_ttl"`
+
+	// circuit breaker options, see srvhandler.CircuitBreaker. It is
+	// disabled if CircuitThreshold is <= 0. The state changes are
+	// published as JSON events on CircuitChannel, if set. The state of
+	// the circuits is reset when the configuration is reloaded.
+	CircuitThreshold int           `yaml:"circuit_threshold"`
+	CircuitCooldown  time.Duration `yaml:"circuit_cooldown"`
+	CircuitChannel   string        `yaml:"circuit_channel"`
+
+	// NACK rate limit options, see srvhandler.NackLimit. The action is
+	// either "throttle" (the default) or "close".
+	NackLimit       int           `yaml:"nack_limit"`
+	NackLimitWindow time.Duration `yaml:"nack_limit_window"`
+	NackLimitAction string        `yaml:"nack_limit_action"`
+
+	// connection limits options, see juggler.ConnLimiter. A limit <= 0
+	// means no limit. The action on a connection that exceeds a limit is
+	// either "reject" (the default) or "evict_oldest".
+	MaxConns            int    `yaml:"max_conns"`
+	MaxConnsPerIdentity int    `yaml:"max_conns_per_identity"`
+	ConnLimitAction     string `yaml:"conn_limit_action"`
+
+	// deduplication options, see juggler.Deduplicator. The requests are
+	// not deduplicated if DedupWindow is <= 0.
+	DedupWindow time.Duration `yaml:"dedup_window"`
+
+	// acknowledged events options, see juggler.EventAcks. The SUB
+	// requests in acknowledged mode are rejected unless EventAcks is
+	// set, and the pub-sub broker must retain the events and stamp
+	// them (history_cap and event_sequence).
+	EventAcks   bool          `yaml:"event_acks"`
+	EventAckTTL time.Duration `yaml:"event_ack_ttl"`
+
+	// backlog exporter options, for the autoscalers of the callees. The
+	// number of call requests waiting for a callee on each of BacklogURIs
+	// is sampled every BacklogInterval (10s by default), served on the
+	// /metrics/backlog admin endpoint in the Prometheus text format and,
+	// if BacklogChannel is set, published as a JSON event on that channel.
+	BacklogURIs     []string      `yaml:"backlog_uris"`
+	BacklogInterval time.Duration `yaml:"backlog_interval"`
+	BacklogChannel  string        `yaml:"backlog_channel"`
+
+	// webhook options, see webhook.Subscriber. The events of the
+	// channels and patterns of each of Webhooks are POSTed to its URL,
+	// with WebhookMaxAttempts attempts (5 by default) separated by
+	// WebhookRetryDelay (1s by default), doubled after each attempt. The
+	// attempts are appended as JSON lines to WebhookLogFile if it is set.
+	Webhooks           []*Webhook    `yaml:"webhooks"`
+	WebhookMaxAttempts int           `yaml:"webhook_max_attempts"`
+	WebhookRetryDelay  time.Duration `yaml:"webhook_retry_delay"`
+	WebhookLogFile     string        `yaml:"webhook_log_file"`
+
+	// system channels options, see srvhandler.SystemChannels. If
+	// SystemChannels is set, the connections, the calls that expire
+	// without result and the server shutdown are published on the
+	// reserved juggler: channels. Only the connections authenticated
+	// with one of SystemPrivilegedIdentities can subscribe to them.
+	SystemChannels             bool     `yaml:"system_channels"`
+	SystemPrivilegedIdentities []string `yaml:"system_privileged_identities"`
+
+	// If RelayBroadcasts is set, the broadcasts published on the
+	// juggler:broadcast system channel, e.g. via the /broadcast admin
+	// endpoint of any server of the cluster, are written to all the
+	// connections (see juggler.Server.BroadcastAll).
+	RelayBroadcasts bool `yaml:"relay_broadcasts"`
+
+	// MQTT front-end configuration, disabled if MQTTAddr is empty. The
+	// MQTT clients publish and subscribe on the channels of the pubsub
+	// broker (see mqtt.Server), whose pattern_syntax should be "mqtt".
+	// It requires the JWT authentication without tenants: the clients
+	// send their token as password, and their requests are subject to
+	// the channel ACLs of the policy and to the system channels rules.
+	// It is served over TLS if the server listens for TLS connections.
+	MQTTAddr string `yaml:"mqtt_addr"`
+
+	// WAMP interoperability configuration, disabled if WAMPPath is
+	// empty. The WAMP clients that connect on WAMPPath are proxied to
+	// the juggler server at WAMPURL (see wamp.Proxy), by default the
+	// first of Paths on the loopback address of this server. It must be
+	// set if the server listens for TLS connections.
+	WAMPPath string `yaml:"wamp_path"`
+	WAMPURL  string `yaml:"wamp_url"`
+
+	// JWT authentication options, see jwt.Authenticator. If JWKSURLs is
+	// set, the connections must have a token signed with a key of one
+	// of those JWKS endpoints, issued by JWTIssuer for JWTAudience if
+	// they are set, in the Authorization header of the upgrade request
+	// or in an AUTH message. The identity of the connections is the
+	// JWTIdentityClaim of their token ("sub" by default) and their
+	// tenant the JWTTenantClaim, if set. The changes to these options
+	// require a restart.
+	JWKSURLs         []string      `yaml:"jwks_urls"`
+	JWTIssuer        string        `yaml:"jwt_issuer"`
+	JWTAudience      string        `yaml:"jwt_audience"`
+	JWTIdentityClaim string        `yaml:"jwt_identity_claim"`
+	JWTTenantClaim   string        `yaml:"jwt_tenant_claim"`
+	JWTLeeway        time.Duration `yaml:"jwt_leeway"`
+
+	// admin HTTP server configuration, disabled if AdminAddr is empty.
+	// If AdminToken is set, the requests must have the header
+	// "Authorization: Bearer <token>", except for the health checks. If
+	// it is not set, the endpoints that change the server or expose its
+	// configuration (/config, /maintenance, /broadcast, /policy, the
+	// close of connections and /debug/) are disabled. It is reloaded on
+	// SIGHUP, and redacted in /config.
+	// If AdminDebug is set, the net/http/pprof profiles are served under
+	// /debug/pprof/ and the expvar metrics of the process (server,
+	// broker and runtime) under /debug/vars.
+	AdminAddr  string `yaml:"admin_addr"`
+	AdminToken string `yaml:"admin_token"`
+	AdminDebug bool   `yaml:"admin_debug"`
+
+	// audit trail options, see audit.Logger. The records of the requests
+	// are appended as JSON lines to AuditFile and added to the redis
+	// stream AuditStream of the pubsub redis, if set. The stream keeps
+	// about AuditStreamMaxLen entries if it is > 0.
+	AuditFile         string `yaml:"audit_file"`
+	AuditStream       string `yaml:"audit_stream"`
+	AuditStreamMaxLen int    `yaml:"audit_stream_max_len"`
+
+	// access log options, see accesslog.Logger. If AccessLogFile is set,
+	// a line is appended to that file for each CALL, PUB and SUB request
+	// and for each call result, in the AccessLogFormat: either "common"
+	// (the default) for the Apache Common Log Format or "json".
+	AccessLogFile   string `yaml:"access_log_file"`
+	AccessLogFormat string `yaml:"access_log_format"`
+
+	// session recording options, see juggler.Server.Recorder. If
+	// RecordFile is set, the frames of all the connections are appended
+	// as JSON lines to that file, to be replayed with juggler-replay.
+	// It should only be set to reproduce an issue.
+	RecordFile string `yaml:"record_file"`
+
+	// shared policy options, if PolicyKey is set the policy is stored
+	// in that redis key and the changes apply to all the servers that
+	// use the same key. The policy of the configuration file then only
+	// applies until the shared policy is loaded.
+	PolicyKey string `yaml:"policy_key"`
+}
+
+// Webhook defines an endpoint that receives the events of the channels
+// and patterns, signed with Secret if it is set (see webhook.Endpoint).
+// The Secret is redacted in /config.
+type Webhook struct {
+	URL      string   `yaml:"url"`
+	Secret   string   `yaml:"secret"`
+	Channels []string `yaml:"channels"`
+	Patterns []string `yaml:"patterns"`
 }
 
 // Config defines the configuration options of the server.
 type Config struct {
 	Redis        *Redis        `yaml:"redis"`
 	CallerBroker *CallerBroker `yaml:"caller_broker"`
+	PubSubBroker *PubSubBroker `yaml:"pubsub_broker"`
 	Server       *Server       `yaml:"server"`
+
+	// Policy is the policy enforced on the requests, see
+	// srvhandler.Policy. It can be changed at runtime with the admin
+	// endpoints.
+	Policy *srvhandler.Policy `yaml:"policy"`
 }
 
 func getDefaultConfig() *Config {
@@ -70,21 +317,36 @@ func getDefaultConfig() *Config {
 			IdleTimeout: 0,
 		},
 		CallerBroker: &CallerBroker{
-			BlockingTimeout: 0,
-			CallCap:         0,
+			BlockingTimeout:   0,
+			CallCap:           0,
+			ServerID:          "",
+			ConnLeaseTTL:      0,
+			CompressThreshold: 0,
+			CallStreams:       false,
+		},
+		PubSubBroker: &PubSubBroker{
+			HistoryCap:       0,
+			HistoryTTL:       0,
+			EventShards:      0,
+			EventShardBuffer: 0,
+			EventSequence:    false,
 		},
 		Server: &Server{
 			Addr:                    ":" + strconv.Itoa(*portFlag),
 			Paths:                   []string{"/ws"},
+			TLSCertFile:             *tlsCertFlag,
+			TLSKeyFile:              *tlsKeyFlag,
 			ReadLimit:               0,
 			ReadTimeout:             0,
 			WriteLimit:              0,
 			WriteTimeout:            0,
 			AcquireWriteLockTimeout: 0,
 			AllowEmptySubprotocol:   *allowEmptyProtoFlag,
+			Strict:                  *strictFlag,
 			CloseURI:                "",
 			SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold,
 		},
+		Policy: &srvhandler.Policy{},
 	}
 }
 
@@ -101,6 +363,15 @@ func getConfigFromReader(r io.Reader) (*Config, error) {
 			return nil, err
 		}
 	}
+
+	switch conf.Server.LogLevel {
+	case "", "debug", "info":
+	default:
+		return nil, fmt.Errorf("unknown log level %q", conf.Server.LogLevel)
+	}
+	if err := conf.Policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
 	return conf, nil
 }
 
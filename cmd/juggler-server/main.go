@@ -5,22 +5,36 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/accesslog"
+	"github.com/PuerkitoBio/juggler/audit"
+	"github.com/PuerkitoBio/juggler/auth/jwt"
 	"github.com/PuerkitoBio/juggler/broker"
 	"github.com/PuerkitoBio/juggler/broker/redisbroker"
+	"github.com/PuerkitoBio/juggler/internal/circuit"
+	"github.com/PuerkitoBio/juggler/internal/completion"
+	"github.com/PuerkitoBio/juggler/internal/sdnotify"
 	"github.com/PuerkitoBio/juggler/internal/srvhandler"
 	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/juggler/schema"
+	"github.com/PuerkitoBio/juggler/session"
+	"github.com/PuerkitoBio/juggler/wamp"
+	"github.com/PuerkitoBio/juggler/webhook"
 	"github.com/PuerkitoBio/redisc"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/websocket"
@@ -35,6 +49,9 @@ var (
 	redisAddrFlag       = flag.String("redis", ":6379", "Redis `address`.")
 	redisClusterFlag    = flag.Bool("redis-cluster", false, "Use redis cluster.")
 	redisMaxIdleFlag    = flag.Int("redis-max-idle", 0, "Maximum idle `connections`.")
+	strictFlag          = flag.Bool("strict", false, "Reject off-spec requests, for client development.")
+	tlsCertFlag         = flag.String("tls-cert", "", "TLS certificate `file`.")
+	tlsKeyFlag          = flag.String("tls-key", "", "TLS private key `file`.")
 )
 
 func main() {
@@ -44,6 +61,14 @@ func main() {
 		return
 	}
 
+	if ok, err := completion.Run(os.Stdout, "juggler-server", flag.CommandLine, flag.Args()); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	conf, err := getConfigFromFile(*configFlag)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to load configuration file: %v\n", err)
@@ -51,8 +76,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	// TODO : support redis-cluster via the config file
-
 	if err := checkRedisConfig(conf.Redis); err != nil {
 		fmt.Fprintf(os.Stderr, "invalid redis configuration: %v\n", err)
 		flag.Usage()
@@ -64,13 +87,20 @@ func main() {
 		logFn = func(_ string, _ ...interface{}) {}
 	}
 
+	tlsConf, err := newTLSConfig(conf.Server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid TLS configuration: %v\n", err)
+		flag.Usage()
+		os.Exit(5)
+	}
+
 	// create pool, brokers, server, upgrader, HTTP server
 	var poolp, poolc redisbroker.Pool
 	var dialp, dialc func() (redis.Conn, error)
 
 	if conf.Redis.Addr != "" {
 		createPoolFn := redisPoolCreateFunc(conf.Redis)
-		if *redisClusterFlag {
+		if *redisClusterFlag || conf.Redis.Cluster {
 			cluster, err := newRedisCluster(conf.Redis.Addr, createPoolFn)
 			if err != nil {
 				log.Fatalf("failed to connect to redis cluster: %v", err)
@@ -88,7 +118,7 @@ func main() {
 			logFn("redis pool configured on %s", conf.Redis.Addr)
 		}
 	} else {
-		if *redisClusterFlag {
+		if *redisClusterFlag || conf.Redis.Cluster {
 			fmt.Fprintln(os.Stderr, "cannot use redis cluster with different pubsub and caller configuration.")
 			flag.Usage()
 			os.Exit(4)
@@ -108,30 +138,205 @@ func main() {
 		logFn("redis pool configured on %s (pubsub) and %s (caller)", conf.Redis.PubSub.Addr, conf.Redis.Caller.Addr)
 	}
 
-	psb := newPubSubBroker(poolp, dialp, logFn)
-	cb := newCallerBroker(conf.CallerBroker, poolc, dialc, logFn)
+	brokerVars := expvar.NewMap("redisbroker")
+	psb, err := newPubSubBroker(conf.PubSubBroker, poolp, dialp, brokerVars, logFn)
+	if err != nil {
+		log.Fatalf("invalid pubsub broker configuration: %v", err)
+	}
+	cb := newCallerBroker(conf.CallerBroker, poolc, dialc, brokerVars, logFn)
+	if ks := conf.CallerBroker.EncryptionKeys; ks != "" {
+		keys, err := redisbroker.ParseKeys(ks)
+		if err != nil {
+			log.Fatalf("invalid encryption keys: %v", err)
+		}
+		cb.Keys = keys
+		logFn("encrypting the call arguments with key %s", keys.Current)
+	}
+	if poolp == poolc {
+		brokerVars.Set("Pools", poolStats(map[string]*redisbroker.Broker{"redis": psb}))
+	} else {
+		brokerVars.Set("Pools", poolStats(map[string]*redisbroker.Broker{"pubsub": psb, "caller": cb}))
+	}
 
-	srv := newServer(conf.Server, psb, cb, logFn)
-	srv.Handler = newHandler(conf.Server, logFn)
-	srv.Vars = expvar.NewMap("juggler")
+	maint := &srvhandler.Maintenance{ReadOnlyURIs: conf.Server.ReadOnlyURIs}
+	maint.SetEnabled(conf.Server.Maintenance)
+	notifyMaintenance(maint, logFn)
+
+	vars := expvar.NewMap("juggler")
+	nackLimit, err := newNackLimit(conf.Server, vars)
+	if err != nil {
+		log.Fatalf("invalid NACK limit configuration: %v", err)
+	}
+	connLimit, err := newConnLimiter(conf.Server)
+	if err != nil {
+		log.Fatalf("invalid connection limits configuration: %v", err)
+	}
+
+	if conf.Server.AllowEmptySubprotocol {
+		juggler.Subprotocols = append(juggler.Subprotocols, "")
+	}
 	juggler.SlowProcessMsgThreshold = conf.Server.SlowProcessMsgThreshold
 
-	upg := newUpgrader(conf.Server) // must be after newServer, for Subprotocols
+	pm := &policyManager{
+		policies: &srvhandler.Policies{Vars: vars},
+		logFn:    logFn,
+	}
+	if err := pm.apply(&policyChange{At: time.Now().UTC(), By: "configuration file", Policy: conf.Policy}); err != nil {
+		log.Fatalf("invalid policy: %v", err)
+	}
+	if key := conf.Server.PolicyKey; key != "" {
+		pm.source = &redisPolicySource{pool: poolp, dial: dialp, key: key}
+		go pm.watch()
+		logFn("shared policy configured on key %s", key)
+	}
 
-	upgh := juggler.Upgrade(upg, srv)
+	backlog := newBacklogExporter(conf.Server, cb, psb, logFn)
+	if backlog != nil {
+		go backlog.run()
+		logFn("exporting the backlog of %d URIs every %s", len(backlog.uris), backlog.interval)
+	}
+
+	system := newSystemChannels(conf, psb, vars, logFn)
+	auditor, err := newAuditLogger(conf.Server, poolp, vars, logFn)
+	if err != nil {
+		log.Fatalf("invalid audit configuration: %v", err)
+	}
+	accessLog, err := newAccessLogger(conf.Server, vars, logFn)
+	if err != nil {
+		log.Fatalf("invalid access log configuration: %v", err)
+	}
+	var recorder *session.Recorder
+	if f := conf.Server.RecordFile; f != "" {
+		if recorder, err = session.OpenFile(f); err != nil {
+			log.Fatalf("invalid record file: %v", err)
+		}
+		logFn("recording the websocket sessions to %s", f)
+	}
+	auth, err := newAuthenticator(conf.Server, vars, logFn)
+	if err != nil {
+		log.Fatalf("invalid JWT configuration: %v", err)
+	}
+
+	rl := &reloader{
+		file:      *configFlag,
+		psb:       psb,
+		cb:        cb,
+		maint:     maint,
+		nackLimit: nackLimit,
+		connLimit: connLimit,
+		dedup:     &juggler.Deduplicator{},
+		evntAcks:  &juggler.EventAcks{},
+		backlog:   backlog,
+		system:    system,
+		audit:     auditor,
+		accessLog: accessLog,
+		recorder:  recorder,
+		auth:      auth,
+		conns:     &srvhandler.Connections{},
+		policy:    pm,
+		vars:      vars,
+		ready:     pingBrokers(psb, cb),
+		logFn:     logFn,
+	}
+	rl.apply(conf)
+	notifyReload(rl, logFn)
+	if system != nil {
+		system.Privileged = func(c *juggler.Conn) bool {
+			return c.Identity != "" && isIn(rl.config().Server.SystemPrivilegedIdentities, c.Identity)
+		}
+		notifyShutdown(system, logFn)
+		logFn("publishing server events on the %s system channels", message.SystemChannelPrefix)
+	}
+	webhooks, err := newWebhookSubscriber(conf.Server, psb, vars, logFn)
+	if err != nil {
+		log.Fatalf("invalid webhook configuration: %v", err)
+	}
+	if webhooks != nil {
+		go runWebhooks(webhooks, logFn)
+		logFn("delivering the events to %d webhook(s)", len(webhooks.Endpoints))
+	}
+	if conf.Server.RelayBroadcasts {
+		go rl.relayBroadcasts()
+		logFn("relaying the broadcasts of %s", message.BroadcastChannel)
+	}
+
+	mux := http.NewServeMux()
 	for _, p := range conf.Server.Paths {
-		http.Handle(p, upgh)
+		mux.Handle(p, rl)
+	}
+	proxy, err := newWAMPProxy(conf.Server, tlsConf != nil, vars, logFn)
+	if err != nil {
+		log.Fatalf("invalid WAMP configuration: %v", err)
+	}
+	if proxy != nil {
+		mux.Handle(conf.Server.WAMPPath, proxy)
+		logFn("proxying the WAMP clients of %s to %s", conf.Server.WAMPPath, proxy.URL)
+	}
+
+	httpSrv := newHTTPServer(conf.Server, mux)
+
+	if conf.Server.AdminAddr != "" {
+		adminSrv := newAdminServer(rl, logFn)
+		go func() {
+			logFn("serving admin endpoints on %s", conf.Server.AdminAddr)
+			if err := adminSrv.ListenAndServe(); err != nil {
+				log.Fatalf("admin ListenAndServe failed: %v", err)
+			}
+		}()
 	}
 
-	httpSrv := newHTTPServer(conf.Server)
+	if conf.Server.MQTTAddr != "" {
+		if syntax, _ := broker.ParsePatternSyntax(conf.PubSubBroker.PatternSyntax); syntax != broker.MQTTPatterns {
+			logFn("the MQTT topic filters are matched with the %s pattern syntax", syntax)
+		}
+		mqttSrv, err := newMQTTServer(rl)
+		if err != nil {
+			log.Fatalf("invalid MQTT configuration: %v", err)
+		}
+		go func() {
+			logFn("serving MQTT clients on %s", conf.Server.MQTTAddr)
+			if err := serveMQTT(mqttSrv, conf.Server.MQTTAddr, tlsConf); err != nil {
+				log.Fatalf("MQTT ListenAndServe failed: %v", err)
+			}
+		}()
+	}
 
-	logFn("listening for connections on %s", conf.Server.Addr)
-	if err := httpSrv.ListenAndServe(); err != nil {
-		log.Fatalf("ListenAndServe failed: %v", err)
+	l, err := net.Listen("tcp", conf.Server.Addr)
+	if err != nil {
+		log.Fatalf("Listen failed: %v", err)
+	}
+	if tlsConf != nil {
+		l = tls.NewListener(l, tlsConf)
+	}
+
+	// signal readiness to systemd, and ping its watchdog as long as
+	// redis is reachable.
+	sdnotify.ReadyAndWatch(rl.ready, logFn)
+
+	scheme := "ws"
+	if tlsConf != nil {
+		scheme = "wss"
+	}
+	logFn("listening for %s connections on %s", scheme, conf.Server.Addr)
+	if err := httpSrv.Serve(l); err != nil {
+		log.Fatalf("Serve failed: %v", err)
 	}
 }
 
-func newHandler(conf *Server, logFn func(string, ...interface{})) juggler.Handler {
+// pingBrokers returns a health check function that pings the redis
+// to the redis servers of the pools.
+func pingBrokers(brokers ...*redisbroker.Broker) func() error {
+	return func() error {
+		for _, b := range brokers {
+			if err := b.Ping(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func newHandler(conf *Server, maint *srvhandler.Maintenance, nackLimit *srvhandler.NackLimit, conns *srvhandler.Connections, policies *srvhandler.Policies, validator *schema.Validator, breaker *srvhandler.CircuitBreaker, state *srvhandler.StateChannels, system *srvhandler.SystemChannels, auditor *audit.Logger, accessLog *accesslog.Logger, logFn func(string, ...interface{})) juggler.Handler {
 	closeURI := conf.CloseURI
 	panicURI := conf.PanicURI
 	writeTimeout := conf.WriteTimeout
@@ -144,6 +349,8 @@ func newHandler(conf *Server, logFn func(string, ...interface{})) juggler.Handle
 
 				deadline := time.Now().Add(writeTimeout)
 				if writeTimeout == 0 {
+					deadline = time.Now().Add(juggler.DefaultWriteTimeout)
+				} else if writeTimeout < 0 {
 					deadline = time.Time{}
 				}
 
@@ -162,28 +369,370 @@ func newHandler(conf *Server, logFn func(string, ...interface{})) juggler.Handle
 		juggler.ProcessMsg(c, m)
 	})
 
-	chain := []juggler.Handler{process}
-	if !*noLogFlag {
+	var next juggler.Handler = process
+	if state != nil {
+		next = state.Handler(process)
+	}
+	if validator != nil {
+		next = validator.Handler(next)
+	}
+	if breaker != nil {
+		next = breaker.Handler(next)
+	}
+	if system != nil {
+		next = system.Handler(next)
+	}
+
+	next = nackLimit.Handler(conns.Handler(maint.Handler(policies.Handler(next))))
+	if auditor != nil {
+		next = auditor.Handler(next)
+	}
+	if accessLog != nil {
+		next = accessLog.Handler(next)
+	}
+
+	chain := []juggler.Handler{next}
+	if !*noLogFlag && conf.LogLevel != "info" {
 		chain = append([]juggler.Handler{srvhandler.LogMsg(logFn)}, chain...)
 	}
 	return srvhandler.PanicRecover(srvhandler.Chain(chain...), nil)
 }
 
-func newPubSubBroker(pool redisbroker.Pool, dial func() (redis.Conn, error), logFn func(string, ...interface{})) broker.PubSubBroker {
-	return &redisbroker.Broker{
-		Pool:    pool,
-		Dial:    dial,
-		LogFunc: logFn,
+// newStateChannels returns the state channels configured in conf, or nil
+// if there are none.
+func newStateChannels(conf *Server) *srvhandler.StateChannels {
+	if len(conf.StateChannels) == 0 {
+		return nil
+	}
+	return &srvhandler.StateChannels{
+		Channels:      conf.StateChannels,
+		FullSyncEvery: conf.StateFullSyncEvery,
 	}
 }
 
-func newCallerBroker(conf *CallerBroker, pool redisbroker.Pool, dial func() (redis.Conn, error), logFn func(string, ...interface{})) broker.CallerBroker {
+// newValidator returns the schema validator configured in conf, or nil
+// if the validation is disabled or the caller broker does not store
+// schemas.
+func newValidator(conf *Server, cb broker.CallerBroker, vars *expvar.Map) *schema.Validator {
+	if !conf.ValidateSchemas {
+		return nil
+	}
+	sb, ok := cb.(broker.SchemaBroker)
+	if !ok {
+		return nil
+	}
+	return &schema.Validator{
+		Broker:   sb,
+		CacheTTL: conf.SchemaCacheTTL,
+		Vars:     vars,
+	}
+}
+
+// newSystemChannels returns the system channels configured in conf, or
+// nil if they are disabled. The server is identified by the server ID of
+// the caller broker, or by its host name if it is not set.
+func newSystemChannels(conf *Config, psb broker.PubSubBroker, vars *expvar.Map, logFn func(string, ...interface{})) *srvhandler.SystemChannels {
+	if !conf.Server.SystemChannels {
+		return nil
+	}
+	id := conf.CallerBroker.ServerID
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	return &srvhandler.SystemChannels{
+		Broker:   psb,
+		ServerID: id,
+		Vars:     vars,
+		LogFunc:  logFn,
+	}
+}
+
+// newAuthenticator returns the authenticator of the connections with
+// the tokens of the JWKS endpoints configured in conf, or nil if the
+// tokens are not required.
+func newAuthenticator(conf *Server, vars *expvar.Map, logFn func(string, ...interface{})) (*jwt.Authenticator, error) {
+	if len(conf.JWKSURLs) == 0 {
+		return nil, nil
+	}
+
+	var keys jwt.KeySets
+	for _, s := range conf.JWKSURLs {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid JWKS URL %q", s)
+		}
+		keys = append(keys, &jwt.JWKS{URL: s})
+	}
+	logFn("authenticating the connections with the tokens of %d JWKS endpoints", len(keys))
+	return &jwt.Authenticator{
+		Keys:          keys,
+		Issuer:        conf.JWTIssuer,
+		Audience:      conf.JWTAudience,
+		Leeway:        conf.JWTLeeway,
+		IdentityClaim: conf.JWTIdentityClaim,
+		TenantClaim:   conf.JWTTenantClaim,
+		Vars:          vars,
+		LogFunc:       logFn,
+	}, nil
+}
+
+// newAuditLogger returns the audit logger configured in conf, or nil if
+// the audit trail is disabled. The records are written to the file and
+// to the redis stream, if both are set.
+func newAuditLogger(conf *Server, pool redisbroker.Pool, vars *expvar.Map, logFn func(string, ...interface{})) (*audit.Logger, error) {
+	var sinks []audit.Sink
+	if conf.AuditFile != "" {
+		fs, err := audit.OpenFile(conf.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, fs)
+		logFn("writing the audit trail to %s", conf.AuditFile)
+	}
+	if conf.AuditStream != "" {
+		sinks = append(sinks, &audit.RedisStreamSink{Pool: pool, Stream: conf.AuditStream, MaxLen: conf.AuditStreamMaxLen})
+		logFn("writing the audit trail to the redis stream %s", conf.AuditStream)
+	}
+
+	l := &audit.Logger{Vars: vars, LogFunc: logFn}
+	switch len(sinks) {
+	case 0:
+		return nil, nil
+	case 1:
+		l.Sink = sinks[0]
+	default:
+		l.Sink = audit.SinkFunc(func(r *audit.Record) error {
+			var err error
+			for _, s := range sinks {
+				if e := s.Write(r); e != nil && err == nil {
+					err = e
+				}
+			}
+			return err
+		})
+	}
+	return l, nil
+}
+
+// newWAMPProxy returns the proxy of the WAMP clients configured in conf,
+// or nil if it is disabled. If the URL of the juggler server is not set,
+// it is the first path of the server on its loopback address, unless it
+// listens for TLS connections.
+func newWAMPProxy(conf *Server, useTLS bool, vars *expvar.Map, logFn func(string, ...interface{})) (*wamp.Proxy, error) {
+	if conf.WAMPPath == "" {
+		return nil, nil
+	}
+
+	u := conf.WAMPURL
+	if u == "" {
+		if useTLS {
+			return nil, errors.New("the WAMP URL must be set with TLS")
+		}
+		if len(conf.Paths) == 0 {
+			return nil, errors.New("no path to proxy the WAMP clients to")
+		}
+		host, port, err := net.SplitHostPort(conf.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		u = "ws://" + net.JoinHostPort(host, port) + conf.Paths[0]
+	}
+	return &wamp.Proxy{
+		URL:      u,
+		Upgrader: newUpgrader(conf),
+		Vars:     vars,
+		LogFunc:  logFn,
+	}, nil
+}
+
+// newWebhookSubscriber returns the webhook subscriber configured in
+// conf, or nil if there are no webhooks.
+func newWebhookSubscriber(conf *Server, psb broker.PubSubBroker, vars *expvar.Map, logFn func(string, ...interface{})) (*webhook.Subscriber, error) {
+	if len(conf.Webhooks) == 0 {
+		return nil, nil
+	}
+
+	s := &webhook.Subscriber{
+		Broker:      psb,
+		MaxAttempts: conf.WebhookMaxAttempts,
+		RetryDelay:  conf.WebhookRetryDelay,
+		Vars:        vars,
+		LogFunc:     logFn,
+	}
+	for _, wh := range conf.Webhooks {
+		if wh.URL == "" {
+			return nil, errors.New("missing webhook URL")
+		}
+		ep := &webhook.Endpoint{URL: wh.URL}
+		if wh.Secret != "" {
+			ep.Secret = []byte(wh.Secret)
+		}
+		for _, ch := range wh.Channels {
+			ep.Subscriptions = append(ep.Subscriptions, broker.Subscription{Channel: ch})
+		}
+		for _, p := range wh.Patterns {
+			ep.Subscriptions = append(ep.Subscriptions, broker.Subscription{Channel: p, Pattern: true})
+		}
+		if len(ep.Subscriptions) == 0 {
+			return nil, fmt.Errorf("webhook %s has no channel or pattern", wh.URL)
+		}
+		s.Endpoints = append(s.Endpoints, ep)
+	}
+
+	if conf.WebhookLogFile != "" {
+		f, err := os.OpenFile(conf.WebhookLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		s.Log = webhook.NewJSONLog(f)
+		logFn("writing the webhook deliveries to %s", conf.WebhookLogFile)
+	}
+	return s, nil
+}
+
+// runWebhooks delivers the events to the webhooks, reconnecting to the
+// broker if the subscription fails. It never returns.
+func runWebhooks(s *webhook.Subscriber, logFn func(string, ...interface{})) {
+	for {
+		err := s.Listen()
+		logFn("webhooks failed: %v; retrying", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// newAccessLogger returns the access logger configured in conf, or nil
+// if the access log is disabled.
+func newAccessLogger(conf *Server, vars *expvar.Map, logFn func(string, ...interface{})) (*accesslog.Logger, error) {
+	if conf.AccessLogFile == "" {
+		return nil, nil
+	}
+
+	var format accesslog.Format
+	switch conf.AccessLogFormat {
+	case "", "common":
+		format = accesslog.CommonFormat
+	case "json":
+		format = accesslog.JSONFormat
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", conf.AccessLogFormat)
+	}
+
+	f, err := os.OpenFile(conf.AccessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	logFn("writing the access log to %s", conf.AccessLogFile)
+	return &accesslog.Logger{W: f, Format: format, Vars: vars, LogFunc: logFn}, nil
+}
+
+// newCircuitBreaker returns the circuit breaker configured in conf, or
+// nil if it is disabled. The state changes are logged and, if
+// conf.CircuitChannel is set, published on that channel.
+func newCircuitBreaker(conf *Server, psb broker.PubSubBroker, vars *expvar.Map, logFn func(string, ...interface{})) *srvhandler.CircuitBreaker {
+	if conf.CircuitThreshold <= 0 {
+		return nil
+	}
+	channel := conf.CircuitChannel
+	return &srvhandler.CircuitBreaker{
+		Threshold: conf.CircuitThreshold,
+		Cooldown:  conf.CircuitCooldown,
+		Vars:      vars,
+		OnStateChange: func(uri string, from, to circuit.State) {
+			logFn("circuit of %s: %s -> %s", uri, from, to)
+			if channel == "" {
+				return
+			}
+			b, err := json.Marshal(struct {
+				URI   string `json:"uri"`
+				From  string `json:"from"`
+				State string `json:"state"`
+			}{uri, from.String(), to.String()})
+			if err != nil {
+				logFn("failed to marshal circuit state change: %v", err)
+				return
+			}
+			pp := &message.PubPayload{MsgUUID: message.NewID(), Args: b, Timestamp: time.Now().UTC()}
+			if err := psb.Publish(channel, pp); err != nil {
+				logFn("failed to publish circuit state change: %v", err)
+			}
+		},
+	}
+}
+
+// newNackLimit returns the NACK rate limit configured in conf, which
+// is disabled if conf.NackLimit is <= 0.
+func newNackLimit(conf *Server, vars *expvar.Map) (*srvhandler.NackLimit, error) {
+	nl := &srvhandler.NackLimit{
+		Limit:  conf.NackLimit,
+		Window: conf.NackLimitWindow,
+		Vars:   vars,
+	}
+	switch conf.NackLimitAction {
+	case "", "throttle":
+		nl.Action = srvhandler.NackThrottle
+	case "close":
+		nl.Action = srvhandler.NackClose
+	default:
+		return nil, fmt.Errorf("unknown action %q", conf.NackLimitAction)
+	}
+	return nl, nil
+}
+
+// newConnLimiter returns the connection limiter configured in conf.
+func newConnLimiter(conf *Server) (*juggler.ConnLimiter, error) {
+	l := &juggler.ConnLimiter{}
+	l.SetMaxConns(conf.MaxConns)
+	l.SetMaxConnsPerIdentity(conf.MaxConnsPerIdentity)
+	switch conf.ConnLimitAction {
+	case "", "reject":
+		l.SetPolicy(juggler.RejectNewConn)
+	case "evict_oldest":
+		l.SetPolicy(juggler.EvictOldestConn)
+	default:
+		return nil, fmt.Errorf("unknown action %q", conf.ConnLimitAction)
+	}
+	return l, nil
+}
+
+// newPubSubBroker returns the pub-sub broker configured in conf, which
+// fails if the pattern syntax is invalid.
+func newPubSubBroker(conf *PubSubBroker, pool redisbroker.Pool, dial func() (redis.Conn, error), vars *expvar.Map, logFn func(string, ...interface{})) (*redisbroker.Broker, error) {
+	syntax, err := broker.ParsePatternSyntax(conf.PatternSyntax)
+	if err != nil {
+		return nil, err
+	}
 	return &redisbroker.Broker{
-		Pool:            pool,
-		Dial:            dial,
-		BlockingTimeout: conf.BlockingTimeout,
-		CallCap:         conf.CallCap,
-		LogFunc:         logFn,
+		Pool:             pool,
+		Dial:             dial,
+		HistoryCap:       conf.HistoryCap,
+		HistoryTTL:       conf.HistoryTTL,
+		EventShards:      conf.EventShards,
+		EventShardBuffer: conf.EventShardBuffer,
+		EventSequence:    conf.EventSequence,
+		PatternSyntax:    syntax,
+		Vars:             vars,
+		LogFunc:          logFn,
+	}, nil
+}
+
+func newCallerBroker(conf *CallerBroker, pool redisbroker.Pool, dial func() (redis.Conn, error), vars *expvar.Map, logFn func(string, ...interface{})) *redisbroker.Broker {
+	return &redisbroker.Broker{
+		Pool:              pool,
+		Dial:              dial,
+		BlockingTimeout:   conf.BlockingTimeout,
+		CallCap:           conf.CallCap,
+		ServerID:          conf.ServerID,
+		ConnLeaseTTL:      conf.ConnLeaseTTL,
+		CompressThreshold: conf.CompressThreshold,
+		CallStreams:       conf.CallStreams,
+		Vars:              vars,
+		LogFunc:           logFn,
 	}
 }
 
@@ -198,10 +747,11 @@ func isIn(list []string, v string) bool {
 
 func newUpgrader(conf *Server) *websocket.Upgrader {
 	upg := &websocket.Upgrader{
-		HandshakeTimeout: conf.HandshakeTimeout,
-		ReadBufferSize:   conf.ReadBufferSize,
-		WriteBufferSize:  conf.WriteBufferSize,
-		Subprotocols:     juggler.Subprotocols,
+		HandshakeTimeout:  conf.HandshakeTimeout,
+		ReadBufferSize:    conf.ReadBufferSize,
+		WriteBufferSize:   conf.WriteBufferSize,
+		Subprotocols:      juggler.Subprotocols,
+		EnableCompression: conf.EnableCompression,
 	}
 
 	if len(conf.WhitelistedOrigins) > 0 {
@@ -214,23 +764,26 @@ func newUpgrader(conf *Server) *websocket.Upgrader {
 	return upg
 }
 
-func newHTTPServer(conf *Server) *http.Server {
+func newHTTPServer(conf *Server, h http.Handler) *http.Server {
 	return &http.Server{
 		Addr:           conf.Addr,
+		Handler:        h,
 		ReadTimeout:    conf.ReadTimeout,
 		WriteTimeout:   conf.WriteTimeout,
 		MaxHeaderBytes: conf.MaxHeaderBytes,
 	}
 }
 
-func newServer(conf *Server, pubSub broker.PubSubBroker, caller broker.CallerBroker, logFn func(string, ...interface{})) *juggler.Server {
-	if conf.AllowEmptySubprotocol {
-		juggler.Subprotocols = append(juggler.Subprotocols, "")
-	}
-
-	cs := srvhandler.LogConn(logFn)
-	if *noLogFlag {
-		cs = nil
+func newServer(conf *Server, pubSub broker.PubSubBroker, caller broker.CallerBroker, conns *srvhandler.Connections, system *srvhandler.SystemChannels, logFn func(string, ...interface{})) *juggler.Server {
+	logConn := srvhandler.LogConn(logFn)
+	cs := func(c *juggler.Conn, state juggler.ConnState) {
+		if !*noLogFlag {
+			logConn(c, state)
+		}
+		conns.ConnState(c, state)
+		if system != nil {
+			system.ConnState(c, state)
+		}
 	}
 	return &juggler.Server{
 		ReadLimit:               conf.ReadLimit,
@@ -241,6 +794,50 @@ func newServer(conf *Server, pubSub broker.PubSubBroker, caller broker.CallerBro
 		ConnState:               cs,
 		PubSubBroker:            pubSub,
 		CallerBroker:            caller,
+		TimeSync:                conf.TimeSync,
+		CheckCallees:            conf.CheckCallees,
+		History:                 conf.History,
+		Sticky:                  conf.Sticky,
+		FlowControl:             conf.FlowControl,
+		CreditBuffer:            conf.CreditBuffer,
+		Strict:                  conf.Strict,
+		NameValidator:           newNamePolicy(conf),
+		CompressionLevel:        conf.CompressionLevel,
+	}
+}
+
+// newNamePolicy returns the name validation policy configured in conf,
+// or nil if the names are not validated.
+func newNamePolicy(conf *Server) juggler.NameValidator {
+	if !conf.ValidateNames {
+		return nil
+	}
+	return &juggler.NamePolicy{
+		Separator:        conf.NameSeparator,
+		Chars:            conf.NameChars,
+		MaxDepth:         conf.NameMaxDepth,
+		MaxLength:        conf.NameMaxLength,
+		ReservedPrefixes: conf.ReservedNamePrefixes,
+	}
+}
+
+// poolStats returns a function that reports the state of the redis
+// pools of the brokers, by name. For a redis cluster, the pool of each
+// node is reported as name.addr.
+func poolStats(brokers map[string]*redisbroker.Broker) expvar.Func {
+	return func() interface{} {
+		stats := make(map[string]redisbroker.PoolStats)
+		for name, b := range brokers {
+			for addr, st := range b.Stats() {
+				if addr != "" {
+					addr = name + "." + addr
+				} else {
+					addr = name
+				}
+				stats[addr] = st
+			}
+		}
+		return stats
 	}
 }
 
@@ -255,22 +852,14 @@ func newRedisCluster(addr string, createPool func(string, ...redis.DialOption) (
 
 func redisPoolCreateFunc(conf *Redis) func(string, ...redis.DialOption) (*redis.Pool, error) {
 	return func(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
-		p := &redis.Pool{
-			MaxIdle:     conf.MaxIdle,
-			MaxActive:   conf.MaxActive,
-			IdleTimeout: conf.IdleTimeout,
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", addr, opts...)
-				if err != nil {
-					return nil, err
-				}
-				return c, err
-			},
-			TestOnBorrow: func(c redis.Conn, t time.Time) error {
-				_, err := c.Do("PING")
-				return err
-			},
-		}
+		p := redisbroker.NewPool(addr, redisbroker.PoolConfig{
+			MaxIdle:       conf.MaxIdle,
+			MaxActive:     conf.MaxActive,
+			Wait:          conf.Wait,
+			IdleTimeout:   conf.IdleTimeout,
+			TestOnBorrow:  true,
+			TestIdleAfter: conf.TestIdleAfter,
+		}, opts...)
 
 		// test the connection so that it fails fast if redis is not available
 		c := p.Get()
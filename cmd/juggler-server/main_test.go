@@ -1,12 +1,28 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/auth/jwt"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/broker/redisbroker"
+	"github.com/PuerkitoBio/juggler/internal/srvhandler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/juggler/mqtt"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -74,6 +90,8 @@ redis:
 				Redis:        &Redis{Addr: "localhost:1234"},
 				Server:       &Server{Addr: ":9000", Paths: []string{"/ws"}, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
 				CallerBroker: &CallerBroker{},
+				PubSubBroker: &PubSubBroker{},
+				Policy:       &srvhandler.Policy{},
 			},
 		},
 		{
@@ -98,6 +116,8 @@ redis:
 				},
 				Server:       &Server{Addr: ":9000", Paths: []string{"/ws"}, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
 				CallerBroker: &CallerBroker{},
+				PubSubBroker: &PubSubBroker{},
+				Policy:       &srvhandler.Policy{},
 			},
 		},
 		{
@@ -111,6 +131,14 @@ redis:
 caller_broker:
     blocking_timeout: 2s
     call_cap: 987
+    server_id: srv-1
+    conn_lease_ttl: 10s
+
+pubsub_broker:
+    history_cap: 100
+    history_ttl: 24h
+    event_shards: 8
+    event_shard_buffer: 50
 
 server:
     addr: :9876
@@ -134,13 +162,40 @@ server:
     acquire_write_lock_timeout: 3h
 
     allow_empty_subprotocol: true
+    history: true
+
+    maintenance: true
+    read_only_uris:
+    - get.*
+
+    admin_addr: :9002
+    admin_token: secret
+    policy_key: juggler:policy
+
+policy:
+    rate_limit: 10
+    window: 1m
+    channel_acls:
+    - channel: public.*
+      sub: true
+    uri_quotas:
+    - uri: report.*
+      limit: 2
+    features:
+        beta: true
 `, &Config{
 				Redis: &Redis{Addr: "localhost:1234", MaxActive: 34, MaxIdle: 5, IdleTimeout: time.Second},
 				Server: &Server{Addr: ":9876", Paths: []string{"/ws", "/"}, MaxHeaderBytes: 23, ReadBufferSize: 4,
 					WriteBufferSize: 5, HandshakeTimeout: time.Minute, WhitelistedOrigins: []string{"http://localhost:4444"},
 					ReadLimit: 6, WriteLimit: 7, ReadTimeout: time.Hour, WriteTimeout: 2 * time.Hour,
-					AcquireWriteLockTimeout: 3 * time.Hour, AllowEmptySubprotocol: true, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
-				CallerBroker: &CallerBroker{BlockingTimeout: 2 * time.Second, CallCap: 987},
+					AcquireWriteLockTimeout: 3 * time.Hour, AllowEmptySubprotocol: true, History: true, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold,
+					Maintenance: true, ReadOnlyURIs: []string{"get.*"}, AdminAddr: ":9002", AdminToken: "secret", PolicyKey: "juggler:policy"},
+				CallerBroker: &CallerBroker{BlockingTimeout: 2 * time.Second, CallCap: 987, ServerID: "srv-1", ConnLeaseTTL: 10 * time.Second},
+				PubSubBroker: &PubSubBroker{HistoryCap: 100, HistoryTTL: 24 * time.Hour, EventShards: 8, EventShardBuffer: 50},
+				Policy: &srvhandler.Policy{RateLimit: 10, Window: time.Minute,
+					ChannelACLs: []srvhandler.ChannelACL{{Channel: "public.*", Sub: true}},
+					URIQuotas:   []srvhandler.URIQuota{{URI: "report.*", Limit: 2}},
+					Features:    map[string]bool{"beta": true}},
 			},
 		},
 	}
@@ -153,3 +208,581 @@ server:
 		}
 	}
 }
+
+func TestConfigSnapshot(t *testing.T) {
+	conf, err := getConfigFromReader(strings.NewReader(`
+redis:
+    addr: localhost:1234
+    idle_timeout: 1s
+caller_broker:
+    encryption_keys: k1:AAAAAAAAAAAAAAAAAAAAAA==
+server:
+    read_only_uris:
+    - get.*
+    admin_token: secret
+    webhooks:
+    - url: http://localhost:8080/events
+      secret: hush
+      channels: [a]
+`))
+	require.NoError(t, err, "getConfigFromReader")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("port", 9000, "")
+	require.NoError(t, fs.Parse([]string{"-port", "1234"}), "Parse")
+
+	maint := &srvhandler.Maintenance{}
+	maint.SetEnabled(true)
+
+	snap, err := configSnapshot(fs, conf, maint)
+	require.NoError(t, err, "configSnapshot")
+	b, err := json.Marshal(snap)
+	require.NoError(t, err, "Marshal")
+
+	var got struct {
+		Flags  map[string]string
+		Config struct {
+			Redis struct {
+				Addr        string
+				IdleTimeout string `json:"idle_timeout"`
+			}
+			CallerBroker struct {
+				EncryptionKeys string `json:"encryption_keys"`
+			} `json:"caller_broker"`
+			Server struct {
+				ReadOnlyURIs []string `json:"read_only_uris"`
+				AdminToken   string   `json:"admin_token"`
+				Webhooks     []struct {
+					URL    string
+					Secret string
+				}
+			}
+		}
+		Runtime map[string]interface{}
+	}
+	require.NoError(t, json.Unmarshal(b, &got), "Unmarshal")
+	assert.Equal(t, map[string]string{"port": "1234"}, got.Flags, "flags")
+	assert.Equal(t, "localhost:1234", got.Config.Redis.Addr, "redis.addr")
+	assert.Equal(t, "1s", got.Config.Redis.IdleTimeout, "redis.idle_timeout")
+	assert.Equal(t, []string{"get.*"}, got.Config.Server.ReadOnlyURIs, "server.read_only_uris")
+	assert.Equal(t, redacted, got.Config.Server.AdminToken, "server.admin_token redacted")
+	assert.Equal(t, redacted, got.Config.CallerBroker.EncryptionKeys, "caller_broker.encryption_keys redacted")
+	if assert.Equal(t, 1, len(got.Config.Server.Webhooks), "server.webhooks") {
+		assert.Equal(t, "http://localhost:8080/events", got.Config.Server.Webhooks[0].URL, "server.webhooks[0].url")
+		assert.Equal(t, redacted, got.Config.Server.Webhooks[0].Secret, "server.webhooks[0].secret redacted")
+	}
+	assert.Equal(t, "secret", conf.Server.AdminToken, "config left untouched")
+	assert.Equal(t, "hush", conf.Server.Webhooks[0].Secret, "webhook left untouched")
+	assert.Equal(t, true, got.Runtime["maintenance"], "runtime.maintenance")
+}
+
+type fakeRegistryBroker struct {
+	callees map[string][]*message.CalleeInfo
+}
+
+func (f fakeRegistryBroker) Heartbeat(ci *message.CalleeInfo, ttl time.Duration) error { return nil }
+func (f fakeRegistryBroker) Unregister(ci *message.CalleeInfo) error                   { return nil }
+func (f fakeRegistryBroker) Callees(uri string) ([]*message.CalleeInfo, error) {
+	return f.callees[uri], nil
+}
+
+func TestCalleesHandler(t *testing.T) {
+	rb := fakeRegistryBroker{callees: map[string][]*message.CalleeInfo{"a": {{Hostname: "h", URIs: []string{"a"}}}}}
+	h := calleesHandler(rb)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "GET", "/callees?uri=a"))
+	require.Equal(t, http.StatusOK, w.Code, "status")
+	var cis []*message.CalleeInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &cis), "Unmarshal")
+	if assert.Equal(t, 1, len(cis), "callees") {
+		assert.Equal(t, "h", cis[0].Hostname, "hostname")
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "GET", "/callees"))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "missing uri")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "POST", "/callees?uri=a"))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code, "POST")
+}
+
+func newRequest(t *testing.T, method, path string) *http.Request {
+	r, err := http.NewRequest(method, path, nil)
+	require.NoError(t, err, "NewRequest")
+	return r
+}
+
+func TestNewNackLimit(t *testing.T) {
+	nl, err := newNackLimit(&Server{NackLimit: 10, NackLimitWindow: time.Minute}, nil)
+	require.NoError(t, err, "default action")
+	assert.Equal(t, 10, nl.Limit, "limit")
+	assert.Equal(t, time.Minute, nl.Window, "window")
+	assert.Equal(t, srvhandler.NackThrottle, nl.Action, "throttle by default")
+
+	nl, err = newNackLimit(&Server{NackLimitAction: "close"}, nil)
+	require.NoError(t, err, "close action")
+	assert.Equal(t, srvhandler.NackClose, nl.Action, "close")
+
+	_, err = newNackLimit(&Server{NackLimitAction: "ban"}, nil)
+	assert.Error(t, err, "unknown action")
+
+	w := httptest.NewRecorder()
+	nacksHandler(nl).ServeHTTP(w, newRequest(t, "GET", "/nacks"))
+	require.Equal(t, http.StatusOK, w.Code, "status")
+	assert.Equal(t, "[]\n", w.Body.String(), "no offenders")
+}
+
+func TestNewConnLimiter(t *testing.T) {
+	l, err := newConnLimiter(&Server{MaxConns: 10, MaxConnsPerIdentity: 2})
+	require.NoError(t, err, "default action")
+	require.NotNil(t, l, "limiter")
+
+	_, err = newConnLimiter(&Server{ConnLimitAction: "evict_oldest"})
+	require.NoError(t, err, "evict_oldest action")
+
+	_, err = newConnLimiter(&Server{ConnLimitAction: "drop"})
+	assert.Error(t, err, "unknown action")
+}
+
+func TestNewAccessLogger(t *testing.T) {
+	l, err := newAccessLogger(&Server{}, nil, t.Logf)
+	require.NoError(t, err, "disabled")
+	assert.Nil(t, l, "disabled")
+
+	f, err := ioutil.TempFile("", "juggler-server")
+	require.NoError(t, err, "TempFile")
+	defer os.Remove(f.Name())
+	f.Close()
+
+	l, err = newAccessLogger(&Server{AccessLogFile: f.Name(), AccessLogFormat: "json"}, nil, t.Logf)
+	require.NoError(t, err, "json format")
+	require.NotNil(t, l, "logger")
+	l.W.(*os.File).Close()
+
+	_, err = newAccessLogger(&Server{AccessLogFile: f.Name(), AccessLogFormat: "xml"}, nil, t.Logf)
+	assert.Error(t, err, "unknown format")
+}
+
+func TestNewPubSubBroker(t *testing.T) {
+	b, err := newPubSubBroker(&PubSubBroker{}, nil, nil, nil, nil)
+	require.NoError(t, err, "default syntax")
+	assert.Equal(t, broker.GlobPatterns, b.PatternSyntax, "glob by default")
+
+	b, err = newPubSubBroker(&PubSubBroker{PatternSyntax: "mqtt"}, nil, nil, nil, nil)
+	require.NoError(t, err, "mqtt syntax")
+	assert.Equal(t, broker.MQTTPatterns, b.PatternSyntax, "mqtt")
+
+	_, err = newPubSubBroker(&PubSubBroker{PatternSyntax: "regexp"}, nil, nil, nil, nil)
+	assert.Error(t, err, "unknown syntax")
+}
+
+func TestNewWebhookSubscriber(t *testing.T) {
+	s, err := newWebhookSubscriber(&Server{}, nil, nil, nil)
+	require.NoError(t, err, "no webhooks")
+	assert.Nil(t, s, "disabled")
+
+	s, err = newWebhookSubscriber(&Server{
+		Webhooks:           []*Webhook{{URL: "http://localhost/hook", Secret: "k", Channels: []string{"a"}, Patterns: []string{"b.*"}}},
+		WebhookMaxAttempts: 2,
+	}, nil, nil, nil)
+	require.NoError(t, err, "webhooks")
+	require.Equal(t, 1, len(s.Endpoints), "endpoints")
+	assert.Equal(t, 2, s.MaxAttempts, "max attempts")
+	assert.Equal(t, []byte("k"), s.Endpoints[0].Secret, "secret")
+	assert.Equal(t, []broker.Subscription{{Channel: "a"}, {Channel: "b.*", Pattern: true}}, s.Endpoints[0].Subscriptions, "subscriptions")
+
+	_, err = newWebhookSubscriber(&Server{Webhooks: []*Webhook{{URL: "http://localhost/hook"}}}, nil, nil, nil)
+	assert.Error(t, err, "no subscription")
+	_, err = newWebhookSubscriber(&Server{Webhooks: []*Webhook{{Channels: []string{"a"}}}}, nil, nil, nil)
+	assert.Error(t, err, "no URL")
+}
+
+func TestNewWAMPProxy(t *testing.T) {
+	p, err := newWAMPProxy(&Server{Addr: ":9000", Paths: []string{"/ws"}}, false, nil, nil)
+	require.NoError(t, err, "disabled")
+	assert.Nil(t, p, "disabled")
+
+	p, err = newWAMPProxy(&Server{Addr: ":9000", Paths: []string{"/ws", "/juggler"}, WAMPPath: "/wamp"}, false, nil, nil)
+	require.NoError(t, err, "default URL")
+	assert.Equal(t, "ws://127.0.0.1:9000/ws", p.URL, "default URL")
+
+	p, err = newWAMPProxy(&Server{Addr: "10.0.0.1:9000", Paths: []string{"/ws"}, WAMPPath: "/wamp"}, false, nil, nil)
+	require.NoError(t, err, "host")
+	assert.Equal(t, "ws://10.0.0.1:9000/ws", p.URL, "host")
+
+	p, err = newWAMPProxy(&Server{Addr: ":9000", WAMPPath: "/wamp", WAMPURL: "wss://example.com/ws"}, true, nil, nil)
+	require.NoError(t, err, "URL")
+	assert.Equal(t, "wss://example.com/ws", p.URL, "URL")
+
+	_, err = newWAMPProxy(&Server{Addr: ":9000", Paths: []string{"/ws"}, WAMPPath: "/wamp"}, true, nil, nil)
+	assert.Error(t, err, "TLS without URL")
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	logFn := func(string, ...interface{}) {}
+	a, err := newAuthenticator(&Server{}, nil, logFn)
+	require.NoError(t, err, "disabled")
+	assert.Nil(t, a, "disabled")
+
+	a, err = newAuthenticator(&Server{JWKSURLs: []string{"https://a/jwks", "http://b/jwks"}, JWTIssuer: "https://a", JWTTenantClaim: "org"}, nil, logFn)
+	require.NoError(t, err, "JWKS URLs")
+	assert.Len(t, a.Keys, 2, "key sets")
+	assert.Equal(t, "https://a", a.Issuer, "issuer")
+	assert.Equal(t, "org", a.TenantClaim, "tenant claim")
+
+	_, err = newAuthenticator(&Server{JWKSURLs: []string{"ftp://a/jwks"}}, nil, logFn)
+	assert.Error(t, err, "invalid URL")
+}
+
+func TestNewNamePolicy(t *testing.T) {
+	assert.Nil(t, newNamePolicy(&Server{NameMaxDepth: 3}), "disabled")
+
+	v := newNamePolicy(&Server{ValidateNames: true, NameSeparator: ":", NameMaxDepth: 2, ReservedNamePrefixes: []string{"sys:"}})
+	require.NotNil(t, v, "enabled")
+	assert.NoError(t, v.ValidChannel("a:b", false), "valid channel")
+	assert.Error(t, v.ValidChannel("a:b:c", false), "too deep")
+	assert.Error(t, v.ValidURI("sys:x"), "reserved prefix")
+}
+
+func TestReload(t *testing.T) {
+	defer juggler.SetCacheableURIs(nil)
+
+	f, err := ioutil.TempFile("", "juggler-server")
+	require.NoError(t, err, "TempFile")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	writeConf := func(s string) {
+		require.NoError(t, f.Truncate(0), "Truncate")
+		_, err := f.WriteAt([]byte(s), 0)
+		require.NoError(t, err, "WriteAt")
+	}
+
+	writeConf(`
+server:
+    addr: :1234
+    read_limit: 100
+`)
+	conf, err := getConfigFromFile(f.Name())
+	require.NoError(t, err, "getConfigFromFile")
+
+	nl, err := newNackLimit(conf.Server, nil)
+	require.NoError(t, err, "newNackLimit")
+	pm := &policyManager{policies: &srvhandler.Policies{}, logFn: t.Logf}
+	rl := &reloader{file: f.Name(), maint: &srvhandler.Maintenance{}, nackLimit: nl, dedup: &juggler.Deduplicator{}, evntAcks: &juggler.EventAcks{}, conns: &srvhandler.Connections{}, policy: pm, logFn: t.Logf}
+	rl.apply(conf)
+
+	writeConf(`
+server:
+    addr: :1234
+    read_limit: 200
+    log_level: info
+    dedup_window: 1m
+`)
+	ignored, err := rl.reload()
+	require.NoError(t, err, "reload")
+	assert.False(t, ignored, "no ignored change")
+	assert.Equal(t, int64(200), rl.config().Server.ReadLimit, "read_limit reloaded")
+	assert.Equal(t, "info", rl.config().Server.LogLevel, "log_level reloaded")
+
+	writeConf(`
+server:
+    addr: :5678
+    read_limit: 300
+`)
+	ignored, err = rl.reload()
+	require.NoError(t, err, "reload")
+	assert.True(t, ignored, "ignored change")
+	assert.Equal(t, int64(300), rl.config().Server.ReadLimit, "read_limit reloaded")
+	assert.Equal(t, ":1234", rl.config().Server.Addr, "addr not reloaded")
+
+	writeConf(`
+server:
+    addr: :1234
+    read_limit: 300
+policy:
+    rate_limit: 5
+`)
+	_, err = rl.reload()
+	require.NoError(t, err, "reload")
+	assert.Equal(t, 5, pm.policies.Policy().RateLimit, "policy reloaded")
+
+	// a policy changed via the admin endpoint is kept if the policy
+	// of the file does not change
+	require.NoError(t, pm.update(&srvhandler.Policy{RateLimit: 6}, "test"), "update")
+	writeConf(`
+server:
+    addr: :1234
+    read_limit: 350
+policy:
+    rate_limit: 5
+`)
+	_, err = rl.reload()
+	require.NoError(t, err, "reload")
+	assert.Equal(t, 6, pm.policies.Policy().RateLimit, "policy kept")
+
+	writeConf(`
+server:
+    read_limit: 400
+    log_level: trace
+`)
+	_, err = rl.reload()
+	assert.Error(t, err, "invalid log level")
+	assert.Equal(t, int64(350), rl.config().Server.ReadLimit, "configuration kept")
+}
+
+func TestAdminHandlers(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthzHandler().ServeHTTP(w, newRequest(t, "GET", "/healthz"))
+	assert.Equal(t, http.StatusOK, w.Code, "healthz")
+
+	var readyErr error
+	h := readyzHandler(func() error { return readyErr })
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "GET", "/readyz"))
+	assert.Equal(t, http.StatusOK, w.Code, "ready")
+	readyErr = errors.New("redis down")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "GET", "/readyz"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "not ready")
+
+	vars := new(expvar.Map).Init()
+	vars.Add("ActiveConns", 2)
+	w = httptest.NewRecorder()
+	metricsHandler(vars).ServeHTTP(w, newRequest(t, "GET", "/metrics"))
+	require.Equal(t, http.StatusOK, w.Code, "metrics")
+	assert.JSONEq(t, `{"ActiveConns":2}`, w.Body.String(), "metrics")
+
+	var closed []string
+	closeConns := func(identity, channel string, reason error) int {
+		closed = append(closed, identity+"|"+channel)
+		return 2
+	}
+	h = connectionsHandler(&srvhandler.Connections{}, closeConns, t.Logf)
+	cases := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/connections", http.StatusOK},
+		{"POST", "/connections", http.StatusMethodNotAllowed},
+		{"GET", "/connections/close?identity=a", http.StatusMethodNotAllowed},
+		{"POST", "/connections/close", http.StatusBadRequest},
+		{"POST", "/connections/close?identity=a&channel=b", http.StatusBadRequest},
+		{"POST", "/connections/close?identity=a", http.StatusOK},
+		{"POST", "/connections/close?channel=b", http.StatusOK},
+		{"POST", "/connections/123/close", http.StatusNotFound},
+		{"GET", "/connections/123/close", http.StatusMethodNotAllowed},
+		{"POST", "/connections/123/kill", http.StatusNotFound},
+	}
+	for i, c := range cases {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(t, c.method, c.path))
+		assert.Equal(t, c.code, w.Code, "%d: %s %s", i, c.method, c.path)
+	}
+	assert.Equal(t, []string{"a|", "|b"}, closed, "closed connections")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "POST", "/connections/close?identity=a"))
+	assert.Equal(t, "{\"closed\":2}\n", w.Body.String(), "number of closed connections")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "GET", "/connections"))
+	assert.Equal(t, "[]\n", w.Body.String(), "no connection")
+}
+
+func TestBroadcastHandler(t *testing.T) {
+	var sent, published []string
+	broadcast := func(channel string, args json.RawMessage) (int, error) {
+		sent = append(sent, channel+" "+string(args))
+		return 3, nil
+	}
+	broadcastAll := func(channel string, args json.RawMessage) error {
+		published = append(published, channel+" "+string(args))
+		return nil
+	}
+	h := broadcastHandler(broadcast, broadcastAll, t.Logf)
+
+	cases := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/broadcast?channel=a", "", http.StatusMethodNotAllowed},
+		{"POST", "/broadcast", `"x"`, http.StatusBadRequest},
+		{"POST", "/broadcast?channel=a&cluster=maybe", `"x"`, http.StatusBadRequest},
+		{"POST", "/broadcast?channel=a", `{`, http.StatusBadRequest},
+		{"POST", "/broadcast?channel=a", `"in 5 minutes"`, http.StatusOK},
+		{"POST", "/broadcast?channel=b", "", http.StatusOK},
+		{"POST", "/broadcast?channel=c&cluster=true", `{"n":1}`, http.StatusAccepted},
+	}
+	for i, c := range cases {
+		r, err := http.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		require.NoError(t, err, "NewRequest")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, c.code, w.Code, "%d: %s %s", i, c.method, c.path)
+		if c.code == http.StatusOK {
+			assert.Equal(t, "{\"sent\":3}\n", w.Body.String(), "%d: body", i)
+		}
+	}
+	assert.Equal(t, []string{`a "in 5 minutes"`, "b null"}, sent, "sent broadcasts")
+	assert.Equal(t, []string{`c {"n":1}`}, published, "published broadcasts")
+}
+
+func TestAdminDebug(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		rl := &reloader{conf: &Config{Server: &Server{AdminDebug: debug, AdminToken: "secret"}}, conns: &srvhandler.Connections{}}
+		h := newAdminServer(rl, t.Logf).Handler
+
+		want := http.StatusNotFound
+		if debug {
+			want = http.StatusOK
+		}
+		for _, path := range []string{"/debug/vars", "/debug/pprof/"} {
+			r := newRequest(t, "GET", path)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, want, w.Code, "%t: %s", debug, path)
+		}
+	}
+
+	// never served without an admin token
+	rl := &reloader{conf: &Config{Server: &Server{AdminDebug: true}}, conns: &srvhandler.Connections{}}
+	h := newAdminServer(rl, t.Logf).Handler
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "GET", "/debug/vars"))
+	assert.Equal(t, http.StatusForbidden, w.Code, "no token")
+}
+
+func TestMQTTServer(t *testing.T) {
+	pm := &policyManager{policies: &srvhandler.Policies{}, logFn: t.Logf}
+	require.NoError(t, pm.policies.SetPolicy(&srvhandler.Policy{ChannelACLs: []srvhandler.ChannelACL{
+		{Channel: "juggler:*", Sub: true},
+		{Channel: "ro:*", Sub: true},
+		{Channel: "secret:*"},
+		{Channel: "*", Pub: true, Sub: true, Patterns: true},
+	}}), "SetPolicy")
+	conf := &Config{Server: &Server{SystemChannels: true, SystemPrivilegedIdentities: []string{"ops"}}}
+	rl := &reloader{conf: conf, policy: pm, logFn: t.Logf}
+
+	_, err := newMQTTServer(rl)
+	assert.Error(t, err, "without authentication")
+	rl.auth = &jwt.Authenticator{Keys: jwt.Keys{}}
+	conf.Server.JWTTenantClaim = "org"
+	_, err = newMQTTServer(rl)
+	assert.Error(t, err, "with tenants")
+	conf.Server.JWTTenantClaim = ""
+	srv, err := newMQTTServer(rl)
+	require.NoError(t, err, "newMQTTServer")
+
+	_, err = srv.Authenticate("c1", "", []byte("invalid"))
+	assert.Equal(t, mqtt.ErrRefused, err, "invalid token")
+
+	cases := []struct {
+		identity, channel string
+		pattern, publish  bool
+		want              bool
+	}{
+		{"u1", "a", false, true, true},
+		{"u1", "ro:a", false, true, false},
+		{"u1", "ro:a", false, false, true},
+		{"u1", message.ConnsChannel, false, true, false},
+		{"ops", message.ConnsChannel, false, true, false},
+		{"u1", message.ConnsChannel, false, false, false},
+		{"ops", message.ConnsChannel, false, false, true},
+		{"u1", "#", true, false, false},
+		{"u1", "jug+", true, false, false},
+		{"u1", "juggler:+", true, false, false},
+		{"u1", "a:#", true, false, true},
+		{"u1", "secret:+", true, false, false},
+		{"u1", "secret:a", false, false, false},
+		{"u1", "ro:+", true, false, false},
+		{"ops", "#", true, false, true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, srv.Authorize(c.identity, c.channel, c.pattern, c.publish), "%+v", c)
+	}
+
+	conf.Server.SystemChannels = false
+	assert.False(t, srv.Authorize("ops", message.ConnsChannel, false, false), "system channels disabled")
+}
+
+func TestPoolStats(t *testing.T) {
+	fn := poolStats(map[string]*redisbroker.Broker{"redis": {Pool: &redis.Pool{MaxActive: 3}}})
+	assert.JSONEq(t, `{"redis":{"active":0,"idle":0,"max_active":3}}`, fn.String(), "expvar")
+}
+
+type fakeHealthBroker struct {
+	err error
+}
+
+func (f fakeHealthBroker) Ping() error { return f.err }
+func (f fakeHealthBroker) Stats() map[string]redisbroker.PoolStats {
+	return map[string]redisbroker.PoolStats{"": {ActiveCount: 2, IdleCount: 1}}
+}
+
+func TestBrokersHandler(t *testing.T) {
+	h := brokersHandler(map[string]interface{}{
+		"pubsub": fakeHealthBroker{},
+		"caller": fakeHealthBroker{errors.New("redis down")},
+		"other":  struct{}{},
+	})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "GET", "/brokers"))
+	require.Equal(t, http.StatusOK, w.Code, "status")
+	assert.JSONEq(t, `{
+		"pubsub": {"ok": true, "pools": {"": {"active": 2, "idle": 1}}},
+		"caller": {"ok": false, "error": "redis down", "pools": {"": {"active": 2, "idle": 1}}}
+	}`, w.Body.String(), "brokers")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "POST", "/brokers"))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code, "POST")
+}
+
+type fakeBacklogBroker struct {
+	broker.CallerBroker
+	counts map[string]int
+	pubs   []*message.PubPayload
+}
+
+func (f *fakeBacklogBroker) QueueLen(uri string) (int, error) {
+	n, ok := f.counts[uri]
+	if !ok {
+		return 0, errors.New("unknown uri")
+	}
+	return n, nil
+}
+func (f *fakeBacklogBroker) PendingResults(connUUID uuid.UUID) (int, error) { return 0, nil }
+func (f *fakeBacklogBroker) ExpiredCount(uri string) (int, error)           { return 0, nil }
+func (f *fakeBacklogBroker) NewPubSubConn() (broker.PubSubConn, error)      { return nil, nil }
+func (f *fakeBacklogBroker) Publish(channel string, pp *message.PubPayload) error {
+	f.pubs = append(f.pubs, pp)
+	return nil
+}
+
+func TestBacklogExporter(t *testing.T) {
+	fb := &fakeBacklogBroker{counts: map[string]int{"a": 3, `b"c`: 0}}
+	assert.Nil(t, newBacklogExporter(&Server{}, fb, fb, t.Logf), "disabled")
+
+	be := newBacklogExporter(&Server{BacklogURIs: []string{`b"c`, "a", "d"}, BacklogChannel: "backlog"}, fb, fb, t.Logf)
+	require.NotNil(t, be, "enabled")
+	assert.Equal(t, defaultBacklogInterval, be.interval, "default interval")
+
+	be.sample()
+	if assert.Equal(t, 1, len(fb.pubs), "published") {
+		var ev backlogEvent
+		require.NoError(t, json.Unmarshal(fb.pubs[0].Args, &ev), "Unmarshal")
+		assert.Equal(t, map[string]int{"a": 3, `b"c`: 0}, ev.Queues, "queues")
+	}
+
+	w := httptest.NewRecorder()
+	be.ServeHTTP(w, newRequest(t, "GET", "/metrics/backlog"))
+	require.Equal(t, http.StatusOK, w.Code, "status")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if assert.Equal(t, 4, len(lines), "lines") {
+		assert.True(t, strings.HasPrefix(lines[2], `juggler_call_backlog{uri="a"} 3 `), lines[2])
+		assert.True(t, strings.HasPrefix(lines[3], `juggler_call_backlog{uri="b\"c"} 0 `), lines[3])
+	}
+}
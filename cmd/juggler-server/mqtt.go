@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/juggler/mqtt"
+)
+
+// patternWildcards are the characters that start the wildcard part of a
+// channel pattern, in the MQTT and glob pattern syntaxes.
+const patternWildcards = "+#*?["
+
+// newMQTTServer returns the MQTT front-end of the server. The clients
+// must send a JWT as password in their CONNECT packet, validated as the
+// tokens of the websocket connections, so it fails if the JWT
+// authentication is not configured. Their requests, and the events they
+// receive via wildcard filters, are authorized with the channel ACLs of
+// the policy, and as the websocket connections on the system channels.
+// As the MQTT topics are not prefixed with the tenant of the clients,
+// it fails if the tenant claim is configured.
+func newMQTTServer(rl *reloader) (*mqtt.Server, error) {
+	conf := rl.config().Server
+	if rl.auth == nil {
+		return nil, errors.New("the MQTT front-end requires the JWT authentication (jwks_urls)")
+	}
+	if conf.JWTTenantClaim != "" {
+		return nil, errors.New("the MQTT front-end does not support the tenants (jwt_tenant_claim)")
+	}
+
+	return &mqtt.Server{
+		Broker: rl.psb,
+		Authenticate: func(clientID, username string, password []byte) (string, error) {
+			identity, err := rl.auth.IdentityOf(string(password))
+			if err != nil {
+				rl.logFn("mqtt: refused client %s: %v", clientID, err)
+				return "", mqtt.ErrRefused
+			}
+			return identity, nil
+		},
+		Authorize: func(identity, channel string, pattern, publish bool) bool {
+			if mayMatchSystemChannel(channel, pattern) {
+				conf := rl.config().Server
+				if publish || !conf.SystemChannels || !isIn(conf.SystemPrivilegedIdentities, identity) {
+					return false
+				}
+			}
+			return rl.policy.policies.AuthorizeChannel(identity, channel, pattern, publish)
+		},
+		Vars:    rl.vars,
+		LogFunc: rl.logFn,
+	}, nil
+}
+
+// mayMatchSystemChannel returns true if channel is a system channel, or
+// if it is a pattern that may match a system channel.
+func mayMatchSystemChannel(channel string, pattern bool) bool {
+	if !pattern {
+		return message.IsSystemChannel(channel)
+	}
+	prefix := channel
+	if i := strings.IndexAny(channel, patternWildcards); i >= 0 {
+		prefix = channel[:i]
+	}
+	return strings.HasPrefix(prefix, message.SystemChannelPrefix) || strings.HasPrefix(message.SystemChannelPrefix, prefix)
+}
+
+// serveMQTT serves the MQTT clients on addr, over TLS if tlsConf is set.
+func serveMQTT(srv *mqtt.Server, addr string, tlsConf *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tlsConf != nil {
+		// the application protocols of the websocket listener would
+		// refuse the MQTT clients that negotiate one
+		tc := tlsConf.Clone()
+		tc.NextProtos = nil
+		l = tls.NewListener(l, tc)
+	}
+	return srv.Serve(l)
+}
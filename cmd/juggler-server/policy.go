@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker/redisbroker"
+	"github.com/PuerkitoBio/juggler/internal/srvhandler"
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/yaml.v2"
+)
+
+// maxPolicyChanges is the number of policy changes kept for the audit.
+const maxPolicyChanges = 100
+
+// policySource is a shared store of the policy, watched by all the
+// servers of a fleet so that a change made on one server applies to
+// all of them. It can be implemented over redis, etcd or Consul KV.
+type policySource interface {
+	// Load returns the current policy document, or nil if none is
+	// stored.
+	Load() ([]byte, error)
+
+	// Store saves the policy document and notifies the watchers.
+	Store(doc []byte) error
+
+	// Watch calls fn with each policy document stored from then on,
+	// until an error occurs.
+	Watch(fn func(doc []byte)) error
+}
+
+// redisPolicySource is a policySource that stores the policy document
+// in a redis key and notifies the changes on the channel of the same
+// name.
+type redisPolicySource struct {
+	pool redisbroker.Pool
+	dial func() (redis.Conn, error)
+	key  string
+}
+
+func (s *redisPolicySource) Load() ([]byte, error) {
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	doc, err := redis.Bytes(rc.Do("GET", s.key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return doc, err
+}
+
+func (s *redisPolicySource) Store(doc []byte) error {
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	if _, err := rc.Do("SET", s.key, doc); err != nil {
+		return err
+	}
+	_, err := rc.Do("PUBLISH", s.key, doc)
+	return err
+}
+
+func (s *redisPolicySource) Watch(fn func([]byte)) error {
+	rc, err := s.dial()
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: rc}
+	defer psc.Close()
+
+	if err := psc.Subscribe(s.key); err != nil {
+		return err
+	}
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			fn(v.Data)
+		case error:
+			return v
+		}
+	}
+}
+
+// policyChange is a change of the policy, as recorded for the audit and
+// stored in the policy source.
+type policyChange struct {
+	At     time.Time          `yaml:"at"`
+	By     string             `yaml:"by"` // origin of the change
+	Policy *srvhandler.Policy `yaml:"policy"`
+}
+
+// policyManager applies the policy changes to the policies enforced by
+// the server, records them for the audit and, if a source is set,
+// shares them with the other servers.
+type policyManager struct {
+	policies *srvhandler.Policies
+	source   policySource // nil if the policy is not shared
+	logFn    func(string, ...interface{})
+
+	mu      sync.Mutex
+	changes []*policyChange
+}
+
+// update changes the policy on behalf of by. If a source is set, the
+// change is stored so that it applies to all servers.
+func (pm *policyManager) update(p *srvhandler.Policy, by string) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	pc := &policyChange{At: time.Now().UTC(), By: by, Policy: p}
+	if pm.source != nil {
+		doc, err := yaml.Marshal(pc)
+		if err != nil {
+			return err
+		}
+		if err := pm.source.Store(doc); err != nil {
+			return err
+		}
+	}
+	return pm.apply(pc)
+}
+
+// apply sets the policy of the change, unless it is the current one,
+// and records it.
+func (pm *policyManager) apply(pc *policyChange) error {
+	if samePolicy(pc.Policy, pm.policies.Policy()) {
+		return nil
+	}
+	if err := pm.policies.SetPolicy(pc.Policy); err != nil {
+		return err
+	}
+
+	pm.mu.Lock()
+	pm.changes = append(pm.changes, pc)
+	if n := len(pm.changes); n > maxPolicyChanges {
+		pm.changes = pm.changes[n-maxPolicyChanges:]
+	}
+	pm.mu.Unlock()
+
+	pm.logFn("policy changed by %s", pc.By)
+	return nil
+}
+
+// samePolicy returns true if the policies are the same once encoded, as
+// the nil and empty lists and sets are equivalent.
+func samePolicy(a, b *srvhandler.Policy) bool {
+	ba, err1 := yaml.Marshal(a)
+	bb, err2 := yaml.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(ba, bb)
+}
+
+// audit returns the recorded policy changes, the most recent last.
+func (pm *policyManager) audit() []*policyChange {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return append([]*policyChange(nil), pm.changes...)
+}
+
+// applyDoc applies the policy document stored in the source.
+func (pm *policyManager) applyDoc(doc []byte) {
+	var pc policyChange
+	if err := yaml.Unmarshal(doc, &pc); err != nil || pc.Policy == nil {
+		pm.logFn("invalid policy document in source: %v", err)
+		return
+	}
+	if err := pm.apply(&pc); err != nil {
+		pm.logFn("invalid policy in source: %v", err)
+	}
+}
+
+// watch applies the policy stored in the source and the following
+// changes, it never returns. The stored policy is loaded again each
+// time the watch is restarted after an error, so that no change is
+// missed.
+func (pm *policyManager) watch() {
+	for {
+		doc, err := pm.source.Load()
+		if err == nil && doc != nil {
+			pm.applyDoc(doc)
+		}
+		if err == nil {
+			err = pm.source.Watch(pm.applyDoc)
+		}
+		pm.logFn("policy source failed: %v; retrying", err)
+		time.Sleep(time.Second)
+	}
+}
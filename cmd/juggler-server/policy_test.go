@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/internal/srvhandler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memPolicySource is an in-memory policySource shared by the managers
+// of a test.
+type memPolicySource struct {
+	mu       sync.Mutex
+	doc      []byte
+	watchers []chan []byte
+}
+
+func (s *memPolicySource) Load() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc, nil
+}
+
+func (s *memPolicySource) Store(doc []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.doc = doc
+	for _, ch := range s.watchers {
+		ch <- doc
+	}
+	return nil
+}
+
+func (s *memPolicySource) Watch(fn func([]byte)) error {
+	ch := make(chan []byte, 10)
+	s.mu.Lock()
+	s.watchers = append(s.watchers, ch)
+	s.mu.Unlock()
+	for doc := range ch {
+		fn(doc)
+	}
+	return nil
+}
+
+func TestPolicyHandler(t *testing.T) {
+	pm := &policyManager{policies: &srvhandler.Policies{}, logFn: t.Logf}
+	h := policyHandler(pm)
+
+	cases := []struct {
+		method, body string
+		code         int
+	}{
+		{"GET", "", http.StatusOK},
+		{"PUT", `{"rate_limit": 10, "window": "1m", "features": {"beta": true}}`, http.StatusOK},
+		{"PUT", `{"uri_quotas": [{"uri": "[", "limit": 1}]}`, http.StatusBadRequest},
+		{"PUT", `{`, http.StatusBadRequest},
+		{"POST", "", http.StatusMethodNotAllowed},
+	}
+	for i, c := range cases {
+		r, err := http.NewRequest(c.method, "/policy", strings.NewReader(c.body))
+		require.NoError(t, err, "%d: NewRequest", i)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, c.code, w.Code, "%d: %s %s", i, c.method, c.body)
+	}
+
+	p := pm.policies.Policy()
+	assert.Equal(t, 10, p.RateLimit, "rate limit")
+	assert.Equal(t, time.Minute, p.Window, "window")
+	assert.True(t, pm.policies.Feature("beta"), "feature")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "GET", "/policy"))
+	var got map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got), "Unmarshal policy")
+	assert.Equal(t, "1m0s", got["window"], "policy as JSON")
+
+	w = httptest.NewRecorder()
+	policyAuditHandler(pm).ServeHTTP(w, newRequest(t, "GET", "/policy/audit"))
+	var changes []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &changes), "Unmarshal audit")
+	if assert.Equal(t, 1, len(changes), "changes") {
+		assert.Contains(t, changes[0]["by"], "admin endpoint", "change origin")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	token := "secret"
+	h := adminAuth(func() string { return token }, ok)
+
+	cases := []struct {
+		path, auth string
+		code       int
+	}{
+		{"/config", "", http.StatusUnauthorized},
+		{"/config", "Bearer nope", http.StatusUnauthorized},
+		{"/config", "Bearer secret", http.StatusOK},
+		{"/healthz", "", http.StatusOK},
+		{"/readyz", "", http.StatusOK},
+	}
+	for i, c := range cases {
+		r := newRequest(t, "GET", c.path)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, c.code, w.Code, "%d: %s %s", i, c.path, c.auth)
+	}
+
+	// the token is read on each request
+	token = "reloaded"
+	r := newRequest(t, "GET", "/config")
+	r.Header.Set("Authorization", "Bearer reloaded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code, "reloaded token")
+
+	// without a token, the sensitive routes are refused
+	token = ""
+	noToken := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/config", http.StatusForbidden},
+		{"POST", "/maintenance", http.StatusForbidden},
+		{"POST", "/broadcast", http.StatusForbidden},
+		{"PUT", "/policy", http.StatusForbidden},
+		{"GET", "/policy/audit", http.StatusForbidden},
+		{"POST", "/connections/close", http.StatusForbidden},
+		{"POST", "/connections/8b34/close", http.StatusForbidden},
+		{"GET", "/debug/pprof/", http.StatusForbidden},
+		{"GET", "/connections", http.StatusOK},
+		{"GET", "/metrics", http.StatusOK},
+		{"GET", "/healthz", http.StatusOK},
+	}
+	for i, c := range noToken {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(t, c.method, c.path))
+		assert.Equal(t, c.code, w.Code, "%d: no token %s %s", i, c.method, c.path)
+	}
+}
+
+func TestSharedPolicy(t *testing.T) {
+	src := &memPolicySource{}
+	pm1 := &policyManager{policies: &srvhandler.Policies{}, source: src, logFn: t.Logf}
+	pm2 := &policyManager{policies: &srvhandler.Policies{}, source: src, logFn: t.Logf}
+
+	require.NoError(t, pm1.update(&srvhandler.Policy{RateLimit: 1}, "test"), "update before watch")
+	go pm2.watch()
+
+	waitFor := func(pm *policyManager, limit int) bool {
+		for i := 0; i < 100; i++ {
+			if pm.policies.Policy().RateLimit == limit {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	assert.True(t, waitFor(pm2, 1), "stored policy loaded")
+
+	require.NoError(t, pm1.update(&srvhandler.Policy{RateLimit: 2}, "test"), "update after watch")
+	assert.True(t, waitFor(pm2, 2), "policy change applied")
+	assert.Equal(t, 2, pm1.policies.Policy().RateLimit, "policy change applied locally")
+
+	changes := pm2.audit()
+	if assert.Equal(t, 2, len(changes), "changes") {
+		assert.Equal(t, "test", changes[1].By, "change origin")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/accesslog"
+	"github.com/PuerkitoBio/juggler/audit"
+	"github.com/PuerkitoBio/juggler/auth/jwt"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/internal/srvhandler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/juggler/session"
+)
+
+// reloader serves the websocket upgrade requests with the juggler
+// server built from the current configuration. When the configuration
+// file is reloaded, a new juggler server is built for the connections
+// accepted from then on, while the existing connections keep running
+// with the configuration they were accepted with, so that no connection
+// is dropped.
+//
+// Only the options of the websocket upgrade, of the juggler server and
+// of its handler can change on reload, along with the cacheable URIs,
+// the deduplication window, the acknowledged events options and the
+// policy, which applies to all connections unless the policy is shared.
+// The other options (listen address, paths, TLS, redis, brokers,
+// maintenance, NACK limits, connection limits, backlog exporter, system
+// channels, broadcasts relay, audit trail, access log, session
+// recording, JWT authentication, admin and policy key)
+// require a restart. The privileged identities of the system channels
+// can change on reload.
+type reloader struct {
+	file      string
+	psb       broker.PubSubBroker
+	cb        broker.CallerBroker
+	maint     *srvhandler.Maintenance
+	nackLimit *srvhandler.NackLimit
+	connLimit *juggler.ConnLimiter
+	dedup     *juggler.Deduplicator
+	evntAcks  *juggler.EventAcks
+	backlog   *backlogExporter           // nil if the backlog is not exported
+	system    *srvhandler.SystemChannels // nil if the system channels are disabled
+	audit     *audit.Logger              // nil if the audit trail is disabled
+	accessLog *accesslog.Logger          // nil if the access log is disabled
+	recorder  *session.Recorder          // nil if the sessions are not recorded
+	auth      *jwt.Authenticator         // nil if the tokens are not required
+	conns     *srvhandler.Connections
+	policy    *policyManager
+	vars      *expvar.Map
+	ready     func() error
+	logFn     func(string, ...interface{})
+
+	mu      sync.RWMutex
+	conf    *Config
+	upgh    http.Handler
+	servers []*juggler.Server // all the servers built, see closeConns
+}
+
+// ServeHTTP implements http.Handler for the reloader.
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.mu.RLock()
+	h := rl.upgh
+	rl.mu.RUnlock()
+	h.ServeHTTP(w, r)
+}
+
+// config returns the current effective configuration.
+func (rl *reloader) config() *Config {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.conf
+}
+
+// apply builds the upgrade handler and juggler server configured in
+// conf and uses them for the new connections.
+func (rl *reloader) apply(conf *Config) {
+	srv := newServer(conf.Server, rl.psb, rl.cb, rl.conns, rl.system, rl.logFn)
+	state := newStateChannels(conf.Server)
+	srv.Handler = newHandler(conf.Server, rl.maint, rl.nackLimit, rl.conns, rl.policy.policies,
+		newValidator(conf.Server, rl.cb, rl.vars), newCircuitBreaker(conf.Server, rl.psb, rl.vars, rl.logFn), state, rl.system, rl.audit, rl.accessLog, rl.logFn)
+	if state != nil {
+		srv.OnExpiredEvnt = state.Expired
+	}
+	srv.Vars = rl.vars
+	srv.ConnLimiter = rl.connLimit
+	srv.Recorder = rl.recorder
+	srv.AuthorizeActAs = rl.policy.policies.AuthorizeActAs
+	rl.dedup.SetWindow(conf.Server.DedupWindow)
+	srv.Deduplicator = rl.dedup
+	rl.evntAcks.SetTTL(conf.Server.EventAckTTL)
+	if conf.Server.EventAcks {
+		srv.EventAcks = rl.evntAcks
+	}
+	juggler.SetCacheableURIs(conf.Server.CacheableURIs)
+	if conf.Server.SortableIDs {
+		message.SetIDGenerator(message.NewSortableID)
+	} else {
+		message.SetIDGenerator(nil)
+	}
+	upgh := juggler.Upgrade(newUpgrader(conf.Server), srv)
+	if a := rl.auth; a != nil {
+		// the identity of the connections is set before the other states
+		cs := srv.ConnState
+		srv.ConnState = func(c *juggler.Conn, state juggler.ConnState) {
+			a.ConnState(c, state)
+			cs(c, state)
+		}
+		srv.Handler = a.Handler(srv.Handler)
+		upgh = a.Upgrade(newUpgrader(conf.Server), srv)
+	}
+
+	rl.mu.Lock()
+	rl.conf = conf
+	rl.upgh = upgh
+	rl.servers = append(rl.servers, srv)
+	rl.mu.Unlock()
+}
+
+// closeConns closes with reason the connections with the identity if it
+// is set, those subscribed to the channel otherwise, and returns the
+// number of connections closed. The servers of the previous
+// configurations are included, as they keep serving the connections
+// accepted with them.
+func (rl *reloader) closeConns(identity, channel string, reason error) int {
+	rl.mu.RLock()
+	servers := rl.servers
+	rl.mu.RUnlock()
+
+	var n int
+	for _, srv := range servers {
+		if identity != "" {
+			n += srv.CloseConnsByIdentity(identity, reason)
+		} else {
+			n += srv.CloseConnsSubscribedTo(channel, reason)
+		}
+	}
+	return n
+}
+
+// broadcast writes an event with args on channel to all the connections
+// of the servers, and returns the number of connections it was sent to.
+func (rl *reloader) broadcast(channel string, args json.RawMessage) (int, error) {
+	rl.mu.RLock()
+	servers := rl.servers
+	rl.mu.RUnlock()
+
+	var n int
+	for _, srv := range servers {
+		nn, err := srv.Broadcast(channel, args, nil)
+		if err != nil {
+			return n, err
+		}
+		n += nn
+	}
+	return n, nil
+}
+
+// broadcastAll publishes the broadcast of an event with args on channel
+// to all the servers of the cluster that relay the broadcasts.
+func (rl *reloader) broadcastAll(channel string, args json.RawMessage) error {
+	pp, err := message.NewBroadcast(channel, args)
+	if err != nil {
+		return err
+	}
+	return rl.psb.Publish(message.BroadcastChannel, pp)
+}
+
+// relayBroadcasts writes the broadcasts published on the broadcast
+// system channel to all the connections of the servers, reconnecting to
+// the broker if the subscription fails. It never returns.
+func (rl *reloader) relayBroadcasts() {
+	for {
+		err := rl.relay()
+		rl.logFn("broadcasts relay failed: %v; retrying", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (rl *reloader) relay() error {
+	psc, err := rl.psb.NewPubSubConn()
+	if err != nil {
+		return err
+	}
+	defer psc.Close()
+
+	if err := psc.Subscribe(message.BroadcastChannel, false); err != nil {
+		return err
+	}
+	for pld := range psc.Events() {
+		ev, ok := message.BroadcastEvnt(pld)
+		if !ok {
+			if rl.vars != nil {
+				rl.vars.Add("InvalidBroadcasts", 1)
+			}
+			continue
+		}
+		if _, err := rl.broadcast(ev.Channel, ev.Args); err != nil {
+			rl.logFn("broadcast on %s failed: %v", ev.Channel, err)
+		}
+	}
+	return psc.EventsErr()
+}
+
+// reload reads the configuration file and applies the options that
+// can change at runtime. The current configuration is kept if the file
+// cannot be loaded. It returns true if the file contains changes that
+// were ignored because they require a restart.
+func (rl *reloader) reload() (bool, error) {
+	next, err := getConfigFromFile(rl.file)
+	if err != nil {
+		return false, err
+	}
+	if err := checkRedisConfig(next.Redis); err != nil {
+		return false, err
+	}
+
+	cur := rl.config()
+	conf := mergeReloadable(cur, next)
+	rl.apply(conf)
+
+	// only apply the policy of the file if it changed, so that a change
+	// made with the admin endpoint is kept otherwise.
+	if rl.policy.source == nil && !samePolicy(cur.Policy, conf.Policy) {
+		if err := rl.policy.apply(&policyChange{At: time.Now().UTC(), By: "configuration file", Policy: conf.Policy}); err != nil {
+			return false, err
+		}
+	}
+	return !reflect.DeepEqual(conf, next), nil
+}
+
+// mergeReloadable returns a copy of cur with the options that can
+// change at runtime set to their value in next.
+func mergeReloadable(cur, next *Config) *Config {
+	s := *cur.Server
+	n := next.Server
+
+	s.ReadBufferSize = n.ReadBufferSize
+	s.WriteBufferSize = n.WriteBufferSize
+	s.HandshakeTimeout = n.HandshakeTimeout
+	s.WhitelistedOrigins = n.WhitelistedOrigins
+	s.EnableCompression = n.EnableCompression
+	s.CompressionLevel = n.CompressionLevel
+
+	s.ReadLimit = n.ReadLimit
+	s.ReadTimeout = n.ReadTimeout
+	s.WriteLimit = n.WriteLimit
+	s.WriteTimeout = n.WriteTimeout
+	s.AcquireWriteLockTimeout = n.AcquireWriteLockTimeout
+	s.TimeSync = n.TimeSync
+	s.CheckCallees = n.CheckCallees
+	s.History = n.History
+	s.Sticky = n.Sticky
+	s.FlowControl = n.FlowControl
+	s.CreditBuffer = n.CreditBuffer
+	s.Strict = n.Strict
+	s.ValidateNames = n.ValidateNames
+	s.NameSeparator = n.NameSeparator
+	s.NameChars = n.NameChars
+	s.NameMaxDepth = n.NameMaxDepth
+	s.NameMaxLength = n.NameMaxLength
+	s.ReservedNamePrefixes = n.ReservedNamePrefixes
+	s.SortableIDs = n.SortableIDs
+
+	s.CloseURI = n.CloseURI
+	s.PanicURI = n.PanicURI
+	s.LogLevel = n.LogLevel
+	s.CacheableURIs = n.CacheableURIs
+	s.StateChannels = n.StateChannels
+	s.StateFullSyncEvery = n.StateFullSyncEvery
+	s.ValidateSchemas = n.ValidateSchemas
+	s.SchemaCacheTTL = n.SchemaCacheTTL
+	s.CircuitThreshold = n.CircuitThreshold
+	s.CircuitCooldown = n.CircuitCooldown
+	s.CircuitChannel = n.CircuitChannel
+	s.SystemPrivilegedIdentities = n.SystemPrivilegedIdentities
+	s.DedupWindow = n.DedupWindow
+	s.EventAcks = n.EventAcks
+	s.EventAckTTL = n.EventAckTTL
+
+	return &Config{
+		Redis:        cur.Redis,
+		CallerBroker: cur.CallerBroker,
+		PubSubBroker: cur.PubSubBroker,
+		Server:       &s,
+		Policy:       next.Policy,
+	}
+}
@@ -0,0 +1,59 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/PuerkitoBio/juggler/internal/srvhandler"
+)
+
+// notifyMaintenance toggles the maintenance mode each time the process
+// receives a SIGUSR1 signal.
+func notifyMaintenance(maint *srvhandler.Maintenance, logFn func(string, ...interface{})) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			logFn("maintenance mode set to %t via signal", maint.Toggle())
+		}
+	}()
+}
+
+// notifyReload reloads the configuration file each time the process
+// receives a SIGHUP signal.
+func notifyReload(rl *reloader, logFn func(string, ...interface{})) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			ignored, err := rl.reload()
+			if err != nil {
+				logFn("failed to reload configuration: %v", err)
+				continue
+			}
+			logFn("configuration reloaded via signal")
+			if ignored {
+				logFn("some configuration changes require a restart and were ignored")
+			}
+		}
+	}()
+}
+
+// notifyShutdown publishes the shutdown of the server on the system
+// channels when the process receives a SIGINT or SIGTERM signal, and
+// exits.
+func notifyShutdown(system *srvhandler.SystemChannels, logFn func(string, ...interface{})) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		if err := system.Shutdown(); err != nil {
+			logFn("failed to publish the server shutdown: %v", err)
+		}
+		logFn("shutting down via signal %v", sig)
+		os.Exit(0)
+	}()
+}
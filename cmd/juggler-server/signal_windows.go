@@ -0,0 +1,15 @@
+package main
+
+import "github.com/PuerkitoBio/juggler/internal/srvhandler"
+
+// notifyMaintenance is a no-op on windows, where SIGUSR1 is not
+// supported. Use the admin endpoint to toggle the maintenance mode.
+func notifyMaintenance(maint *srvhandler.Maintenance, logFn func(string, ...interface{})) {}
+
+// notifyReload is a no-op on windows, where SIGHUP is not supported.
+// The server must be restarted to apply configuration changes.
+func notifyReload(rl *reloader, logFn func(string, ...interface{})) {}
+
+// notifyShutdown is a no-op on windows, where the server shutdown is not
+// published on the system channels.
+func notifyShutdown(system *srvhandler.SystemChannels, logFn func(string, ...interface{})) {}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newTLSConfig returns the TLS configuration of the server, or nil if
+// it serves plain connections. The certificate is either loaded from
+// conf.TLSCertFile and conf.TLSKeyFile, or obtained and renewed from
+// Let's Encrypt for conf.AutocertHosts. In autocert mode, the server
+// must be reachable on port 443 for the tls-alpn-01 challenge.
+func newTLSConfig(conf *Server) (*tls.Config, error) {
+	var tc *tls.Config
+
+	certFiles := conf.TLSCertFile != "" || conf.TLSKeyFile != ""
+	switch {
+	case len(conf.AutocertHosts) > 0 && certFiles:
+		return nil, errors.New("autocert_hosts cannot be set with tls_cert_file and tls_key_file")
+
+	case len(conf.AutocertHosts) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(conf.AutocertHosts...),
+			Email:      conf.AutocertEmail,
+		}
+		if conf.AutocertCacheDir != "" {
+			m.Cache = autocert.DirCache(conf.AutocertCacheDir)
+		}
+		tc = m.TLSConfig()
+
+	case certFiles:
+		if conf.TLSCertFile == "" || conf.TLSKeyFile == "" {
+			return nil, errors.New("both tls_cert_file and tls_key_file must be set")
+		}
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	default:
+		if conf.TLSClientCAFile != "" || conf.TLSClientAuth != "" {
+			return nil, errors.New("client certificate verification requires TLS")
+		}
+		return nil, nil
+	}
+
+	// websocket connections require HTTP/1.1, do not negotiate HTTP/2
+	tc.NextProtos = []string{"http/1.1", acme.ALPNProto}
+
+	auth, err := clientAuthType(conf.TLSClientAuth, conf.TLSClientCAFile != "")
+	if err != nil {
+		return nil, err
+	}
+	tc.ClientAuth = auth
+
+	if conf.TLSClientCAFile != "" {
+		b, err := ioutil.ReadFile(conf.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.TLSClientCAFile)
+		}
+		tc.ClientCAs = pool
+	}
+	return tc, nil
+}
+
+// clientAuthType returns the client certificate policy named s. The
+// default is to require and verify a certificate if client CAs are
+// set, and to not request one otherwise.
+func clientAuthType(s string, hasCAs bool) (tls.ClientAuthType, error) {
+	switch s {
+	case "":
+		if hasCAs {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	case "verify":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require_and_verify":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return 0, fmt.Errorf("unknown client auth %q", s)
+}
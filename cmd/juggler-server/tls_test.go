@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate and its key in dir,
+// and returns the paths of the files.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "GenerateKey")
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err, "CreateCertificate")
+	kder, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err, "MarshalECPrivateKey")
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), "write cert")
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600), "write key")
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "juggler-server")
+	require.NoError(t, err, "TempDir")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	tc, err := newTLSConfig(&Server{})
+	require.NoError(t, err, "no TLS")
+	assert.Nil(t, tc, "no TLS")
+
+	tc, err = newTLSConfig(&Server{TLSCertFile: certFile, TLSKeyFile: keyFile})
+	require.NoError(t, err, "cert files")
+	assert.Equal(t, 1, len(tc.Certificates), "certificate")
+	assert.Equal(t, tls.NoClientCert, tc.ClientAuth, "no client cert")
+	assert.Equal(t, "http/1.1", tc.NextProtos[0], "HTTP/1.1")
+
+	tc, err = newTLSConfig(&Server{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: certFile})
+	require.NoError(t, err, "client CA")
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tc.ClientAuth, "verify client cert")
+	assert.NotNil(t, tc.ClientCAs, "client CAs")
+
+	tc, err = newTLSConfig(&Server{AutocertHosts: []string{"example.com"}, TLSClientAuth: "request"})
+	require.NoError(t, err, "autocert")
+	assert.NotNil(t, tc.GetCertificate, "autocert certificate")
+	assert.Equal(t, tls.RequestClientCert, tc.ClientAuth, "request client cert")
+
+	invalid := []*Server{
+		{TLSCertFile: certFile},
+		{TLSCertFile: certFile, TLSKeyFile: keyFile, AutocertHosts: []string{"example.com"}},
+		{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientAuth: "always"},
+		{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: keyFile},
+		{TLSClientCAFile: certFile},
+	}
+	for i, conf := range invalid {
+		_, err := newTLSConfig(conf)
+		assert.Error(t, err, "%d", i)
+	}
+}
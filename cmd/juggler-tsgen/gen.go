@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// header is the first line of the generated file.
+const header = "// Code generated by juggler-tsgen; DO NOT EDIT."
+
+// constant is a generated constant, with the name of its Go declaration.
+type constant struct {
+	name  string
+	value interface{}
+}
+
+// The constants generated from the message package, with their values
+// taken from the Go declarations so that they cannot get out of sync.
+var (
+	routingModes = []constant{
+		{"RoundRobin", message.RoundRobin},
+		{"Sticky", message.Sticky},
+		{"Broadcast", message.Broadcast},
+	}
+
+	codes = []constant{
+		{"CodeBadRequest", message.CodeBadRequest},
+		{"CodeUnauthorized", message.CodeUnauthorized},
+		{"CodeForbidden", message.CodeForbidden},
+		{"CodeNoCallee", message.CodeNoCallee},
+		{"CodeUnsupportedVersion", message.CodeUnsupportedVersion},
+		{"CodeTimeout", message.CodeTimeout},
+		{"CodePayloadTooLarge", message.CodePayloadTooLarge},
+		{"CodeRateLimited", message.CodeRateLimited},
+		{"CodeHandlerError", message.CodeHandlerError},
+		{"CodeUnavailable", message.CodeUnavailable},
+	}
+
+	uris = []constant{
+		{"TimeSyncURI", message.TimeSyncURI},
+		{"HistoryURI", message.HistoryURI},
+		{"CreditURI", message.CreditURI},
+		{"EvntAckURI", message.EvntAckURI},
+		{"VersionSeparator", message.VersionSeparator},
+		{"TenantSeparator", message.TenantSeparator},
+		{"SystemChannelPrefix", message.SystemChannelPrefix},
+	}
+)
+
+// tsType is a Go type for which a TypeScript interface is generated.
+type tsType struct {
+	name string
+	typ  reflect.Type
+	msg  message.Type // type of the message, if it is a message
+}
+
+// The types for which an interface is generated, in order. The messages
+// must be listed first.
+var tsTypes = []tsType{
+	{"Call", reflect.TypeOf(message.Call{}), message.CallMsg},
+	{"Pub", reflect.TypeOf(message.Pub{}), message.PubMsg},
+	{"Sub", reflect.TypeOf(message.Sub{}), message.SubMsg},
+	{"Unsb", reflect.TypeOf(message.Unsb{}), message.UnsbMsg},
+	{"Batch", reflect.TypeOf(message.Batch{}), message.BatchMsg},
+	{"Nack", reflect.TypeOf(message.Nack{}), message.NackMsg},
+	{"Ack", reflect.TypeOf(message.Ack{}), message.AckMsg},
+	{"Res", reflect.TypeOf(message.Res{}), message.ResMsg},
+	{"Evnt", reflect.TypeOf(message.Evnt{}), message.EvntMsg},
+	{"Meta", reflect.TypeOf(message.Meta{}), 0},
+	{"Signature", reflect.TypeOf(message.Signature{}), 0},
+	{"ErrResult", reflect.TypeOf(message.ErrResult{}), 0},
+	{"TimeSync", reflect.TypeOf(message.TimeSync{}), 0},
+	{"HistoryQuery", reflect.TypeOf(message.HistoryQuery{}), 0},
+	{"CreditGrant", reflect.TypeOf(message.CreditGrant{}), 0},
+	{"EvntAck", reflect.TypeOf(message.EvntAck{}), 0},
+	{"SystemEvent", reflect.TypeOf(message.SystemEvent{}), 0},
+	{"CalleeInfo", reflect.TypeOf(message.CalleeInfo{}), 0},
+}
+
+// The Go types with a specific TypeScript type.
+var (
+	typeType        = reflect.TypeOf(message.Type(0))
+	routingModeType = reflect.TypeOf(message.RoutingMode(0))
+	uuidType        = reflect.TypeOf(uuid.UUID(nil))
+	timeType        = reflect.TypeOf(time.Time{})
+	durationType    = reflect.TypeOf(time.Duration(0))
+	rawMessageType  = reflect.TypeOf(json.RawMessage(nil))
+	bytesType       = reflect.TypeOf([]byte(nil))
+	msgType         = reflect.TypeOf((*message.Msg)(nil)).Elem()
+)
+
+// generate returns the TypeScript source of the message definitions.
+func generate() ([]byte, error) {
+	g := &generator{names: make(map[reflect.Type]string)}
+	for _, t := range tsTypes {
+		g.names[t.typ] = t.name
+	}
+
+	g.printf("%s\n\n", header)
+	g.printf("// Subprotocols is the list of websocket subprotocols supported by the\n// server.\n")
+	g.printf("export const Subprotocols: string[] = %s;\n\n", jsonString(juggler.Subprotocols))
+
+	var types []message.Type
+	for mt := message.Type(0); mt < 256; mt++ {
+		if mt.IsStd() {
+			types = append(types, mt)
+		}
+	}
+	g.printf("// MsgType is the type of a message, set in its metadata.\nexport enum MsgType {\n")
+	for _, mt := range types {
+		g.printf("  %s = %d,\n", mt, mt)
+	}
+	g.printf("}\n\n")
+
+	g.printf("// RoutingMode defines how a call request is routed to the callees.\nexport enum RoutingMode {\n")
+	for _, c := range routingModes {
+		g.printf("  %s = %d,\n", c.name, c.value)
+	}
+	g.printf("}\n\n")
+
+	g.printf("// The codes of the NACK messages.\n")
+	g.constants(codes)
+	g.printf("// The URIs handled by the server, and the separators of the URIs and\n// channels.\n")
+	g.constants(uris)
+
+	for _, t := range tsTypes {
+		if err := g.iface(t); err != nil {
+			return nil, fmt.Errorf("%s: %v", t.name, err)
+		}
+	}
+
+	var read, write []string
+	for _, t := range tsTypes {
+		switch {
+		case t.msg.IsRead():
+			read = append(read, t.name)
+		case t.msg.IsWrite():
+			write = append(write, t.name)
+		}
+	}
+	g.printf("// RequestMsg is a message sent by the client.\nexport type RequestMsg = %s;\n\n", strings.Join(read, " | "))
+	g.printf("// ResponseMsg is a message sent by the server.\nexport type ResponseMsg = %s;\n\n", strings.Join(write, " | "))
+	g.printf("// Msg is any message.\nexport type Msg = RequestMsg | ResponseMsg;\n")
+	return g.buf.Bytes(), nil
+}
+
+type generator struct {
+	buf   bytes.Buffer
+	names map[reflect.Type]string
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) constants(cs []constant) {
+	for _, c := range cs {
+		switch v := c.value.(type) {
+		case string:
+			g.printf("export const %s = %s;\n", c.name, jsonString(v))
+		default:
+			g.printf("export const %s = %d;\n", c.name, v)
+		}
+	}
+	g.printf("\n")
+}
+
+// iface prints the interface of t.
+func (g *generator) iface(t tsType) error {
+	if t.typ.Kind() != reflect.Struct {
+		return fmt.Errorf("unsupported kind %s", t.typ.Kind())
+	}
+	if t.msg != 0 {
+		g.printf("// %s is the %s message.\n", t.name, t.msg)
+	} else {
+		g.printf("// %s is the JSON encoding of message.%s.\n", t.name, t.typ.Name())
+	}
+	g.printf("export interface %s ", t.name)
+	if err := g.fields(t.typ, t.msg, "  "); err != nil {
+		return err
+	}
+	g.printf("\n\n")
+	return nil
+}
+
+// fields prints the object type of the struct type st, each field on a
+// line with the indent. If mt is not 0, the type of the metadata is
+// narrowed to mt.
+func (g *generator) fields(st reflect.Type, mt message.Type, indent string) error {
+	g.printf("{\n")
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		name, omitempty := parseTag(f.Tag.Get("json"))
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			if f.Anonymous {
+				return fmt.Errorf("field %s: embedded field without JSON name", f.Name)
+			}
+			name = f.Name
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+			omitempty = true
+		}
+		opt := ""
+		if omitempty {
+			opt = "?"
+		}
+		g.printf("%s%s%s: ", indent, name, opt)
+		if ft.Kind() == reflect.Struct && g.names[ft] == "" && ft != timeType {
+			if err := g.fields(ft, mt, indent+"  "); err != nil {
+				return fmt.Errorf("field %s: %v", f.Name, err)
+			}
+		} else {
+			s, err := g.typeName(ft)
+			if err != nil {
+				return fmt.Errorf("field %s: %v", f.Name, err)
+			}
+			if mt != 0 && ft == reflect.TypeOf(message.Meta{}) {
+				s += fmt.Sprintf(" & { type: MsgType.%s }", mt)
+			}
+			g.printf("%s", s)
+		}
+		g.printf(";")
+		if c := typeComment(ft); c != "" {
+			g.printf(" // %s", c)
+		}
+		g.printf("\n")
+	}
+	g.printf("%s}", indent[2:])
+	return nil
+}
+
+// typeName returns the TypeScript type of the Go type t.
+func (g *generator) typeName(t reflect.Type) (string, error) {
+	switch t {
+	case typeType:
+		return "MsgType", nil
+	case routingModeType:
+		return "RoutingMode", nil
+	case uuidType, timeType, bytesType:
+		return "string", nil
+	case durationType:
+		return "number", nil
+	case rawMessageType:
+		return "unknown", nil
+	case msgType:
+		return "Call | Pub", nil
+	}
+	if s := g.names[t]; s != "" {
+		return s, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "string", nil
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number", nil
+	case reflect.Slice:
+		s, err := g.typeName(t.Elem())
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(s, "|") {
+			s = "(" + s + ")"
+		}
+		return s + "[]", nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return "", fmt.Errorf("unsupported map key %s", t.Key())
+		}
+		s, err := g.typeName(t.Elem())
+		if err != nil {
+			return "", err
+		}
+		return "{ [key: string]: " + s + " }", nil
+	}
+	return "", fmt.Errorf("unsupported type %s", t)
+}
+
+// typeComment returns the comment that documents the encoding of the
+// Go type t, if it is not obvious from its TypeScript type.
+func typeComment(t reflect.Type) string {
+	switch t {
+	case uuidType:
+		return "UUID"
+	case timeType:
+		return "RFC 3339 timestamp"
+	case durationType:
+		return "duration in nanoseconds"
+	case bytesType:
+		return "base64"
+	}
+	return ""
+}
+
+// parseTag returns the name and the omitempty option of the JSON tag.
+func parseTag(tag string) (string, bool) {
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			return parts[0], true
+		}
+	}
+	return parts[0], false
+}
+
+func jsonString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
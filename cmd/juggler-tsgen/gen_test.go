@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	b, err := generate()
+	require.NoError(t, err, "generate")
+	src := string(b)
+
+	cases := []string{
+		header + "\n",
+		`export const Subprotocols: string[] = ["juggler.v2.json","juggler.0"];`,
+		"  CALL = 1,\n",
+		"  BTCH = 12,\n",
+		"  Broadcast = 2,\n",
+		"export const CodeNoCallee = 404;\n",
+		`export const EvntAckURI = "juggler.evntack";`,
+		"  meta: Meta & { type: MsgType.EVNT };\n",
+		"    timeout: number; // duration in nanoseconds\n",
+		"    for: string; // UUID\n",
+		"    msgs: (Call | Pub)[];\n",
+		"  sig?: Signature;\n",
+		"  value: string; // base64\n",
+		"export type ResponseMsg = Nack | Ack | Res | Evnt;\n",
+	}
+	for _, c := range cases {
+		assert.Contains(t, src, c)
+	}
+	assert.NotContains(t, src, "Err:", "field ignored by JSON")
+}
+
+func TestTypeName(t *testing.T) {
+	g := &generator{names: map[reflect.Type]string{reflect.TypeOf(message.Meta{}): "Meta"}}
+	cases := []struct {
+		v    interface{}
+		want string
+		err  bool
+	}{
+		{"", "string", false},
+		{uint64(0), "number", false},
+		{[]string(nil), "string[]", false},
+		{map[string]bool(nil), "{ [key: string]: boolean }", false},
+		{message.Meta{}, "Meta", false},
+		{message.RoundRobin, "RoutingMode", false},
+		{map[int]string(nil), "", true},
+		{make(chan int), "", true},
+	}
+	for _, c := range cases {
+		got, err := g.typeName(reflect.TypeOf(c.v))
+		if c.err {
+			assert.Error(t, err, "%T", c.v)
+			continue
+		}
+		if assert.NoError(t, err, "%T", c.v) {
+			assert.Equal(t, c.want, got, "%T", c.v)
+		}
+	}
+}
+
+func TestGeneratedFile(t *testing.T) {
+	want, err := generate()
+	require.NoError(t, err, "generate")
+	got, err := ioutil.ReadFile("../../js/src/messages.ts")
+	require.NoError(t, err, "ReadFile")
+	assert.Equal(t, string(want), string(got), "js/src/messages.ts is out of date, run `npm run generate` in js")
+}
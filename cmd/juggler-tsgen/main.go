@@ -0,0 +1,70 @@
+// Command juggler-tsgen generates the TypeScript definitions of the
+// juggler messages from their Go declarations, for the browser client
+// in the js directory of the repository. The generated file declares:
+//
+//     - the Subprotocols supported by the server
+//     - the MsgType and RoutingMode enums
+//     - the codes of the NACK messages and the URIs handled by the server
+//     - an interface per message, e.g. Call and Evnt, with its metadata
+//       narrowed to its type, and the RequestMsg, ResponseMsg and Msg unions
+//     - the interfaces of the arguments and results of the URIs handled
+//       by the server, e.g. HistoryQuery and EvntAck
+//
+// The UUIDs and timestamps are strings, the durations are numbers of
+// nanoseconds and the arguments are unknown, as they are in JSON. The
+// generated file is written to the -o file, or to stdout. It must be
+// generated again when the messages change, which is done by
+// `npm run generate` in the js directory.
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/PuerkitoBio/juggler/internal/completion"
+)
+
+var (
+	helpFlag   = flag.Bool("help", false, "Show help.")
+	outputFlag = flag.String("o", "", "Output `file`, stdout if empty.")
+)
+
+func main() {
+	flag.Parse()
+	if *helpFlag {
+		flag.Usage()
+		return
+	}
+
+	if ok, err := completion.Run(os.Stdout, "juggler-tsgen", flag.CommandLine, flag.Args()); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "unexpected arguments")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	src, err := generate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate the messages: %v\n", err)
+		os.Exit(3)
+	}
+
+	if *outputFlag == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := ioutil.WriteFile(*outputFlag, src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(3)
+	}
+}
@@ -1,8 +1,11 @@
 package juggler
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
 	"time"
@@ -10,8 +13,10 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/internal/uuidstr"
 	"github.com/PuerkitoBio/juggler/internal/wswriter"
 	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/juggler/session"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
 )
@@ -40,8 +45,29 @@ type Conn struct {
 	// has been received (i.e. after a <-conn.CloseNotify()).
 	CloseErr error
 
+	// Identity is the authenticated identity of the client, if any. It
+	// is set to the common name of the subject of the client certificate
+	// if the connection uses TLS with a verified client certificate.
+	// Otherwise, it can be set by the Server's ConnState function in the
+	// Accepting state, e.g. after validating a token, and it must not be
+	// modified afterwards. Handlers can use it to authorize requests,
+	// and it is sent to the callees in message.CallPayload.Identity.
+	Identity string
+
+	// Tenant is the tenant of the client, if any. It can be set by the
+	// Server's ConnState function in the Accepting state, along with the
+	// Identity, and it must not be modified afterwards. The URIs and
+	// channels of a connection with a tenant are in the namespace of the
+	// tenant in the broker (see message.TenantName), so that it cannot
+	// call, publish or subscribe across tenants, and the connection is
+	// closed with ErrInvalidTenant if it is not a valid tenant (see
+	// message.ValidTenant).
+	Tenant string
+
 	// the underlying websocket connection.
 	wsConn *websocket.Conn
+	// the negotiated version of the protocol
+	proto message.Protocol
 	// allowed types of messages from the client (empty means any)
 	allowedMsgs []message.Type
 
@@ -50,6 +76,27 @@ type Conn struct {
 	psc  broker.PubSubConn  // single pub-sub-dedicated broker connection
 	resc broker.ResultsConn // single results-dedicated broker connection
 
+	// cacheable calls waiting for their result, keyed by message UUID
+	cachemu      sync.Mutex
+	cachePending map[string]*pendingCache
+
+	// calls sent with a rewritten URI, keyed by message UUID
+	rewritemu sync.Mutex
+	rewrites  map[string]*rewrittenCall
+
+	// broker operations of the batch being processed, if any
+	batchmu sync.Mutex
+	batch   *batchOps
+
+	// event credits of the subscriptions with flow control
+	flow flowControl
+
+	// channels subscribed in acknowledged mode
+	acked ackedSubs
+
+	// subscriptions of the connection
+	subs subscriptions
+
 	// ensure the kill channel can only be closed once
 	closeOnce sync.Once
 	kill      chan struct{}
@@ -61,9 +108,17 @@ func newConn(c *websocket.Conn, srv *Server, allowedMsgs ...message.Type) *Conn
 	wmu := make(chan struct{}, 1)
 	wmu <- struct{}{}
 
+	// a detached connection uses the newest version of the protocol
+	proto := message.Protocols()[0]
+	if c != nil {
+		proto = protocolFor(c.Subprotocol())
+	}
+
 	return &Conn{
-		UUID:        uuid.NewRandom(),
+		UUID:        message.NewID(),
+		Identity:    tlsIdentity(c),
 		wsConn:      c,
+		proto:       proto,
 		allowedMsgs: allowedMsgs,
 		wmu:         wmu,
 		srv:         srv,
@@ -71,6 +126,35 @@ func newConn(c *websocket.Conn, srv *Server, allowedMsgs ...message.Type) *Conn
 	}
 }
 
+// NewDetachedConn returns a connection of srv that is not attached to
+// a websocket connection nor to the brokers, to unit test the handlers
+// without a websocket (see the jugglertest package). Its Send method
+// calls the Handler of srv, which must not call ProcessMsg: there is no
+// websocket connection to write the responses to, nor broker connection
+// to subscribe to channels and receive results. Its UnderlyingConn is
+// nil, as are its network addresses.
+func NewDetachedConn(srv *Server) *Conn {
+	return newConn(nil, srv)
+}
+
+// tlsIdentity returns the common name of the subject of the verified
+// client certificate of the websocket connection, or an empty string if
+// it does not use TLS or has no verified client certificate.
+func tlsIdentity(c *websocket.Conn) string {
+	if c == nil {
+		return ""
+	}
+	tc, ok := c.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	st := tc.ConnectionState()
+	if len(st.VerifiedChains) == 0 || len(st.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return st.VerifiedChains[0][0].Subject.CommonName
+}
+
 // UnderlyingConn returns the underlying websocket connection. Care
 // should be taken when using the websocket connection directly,
 // as it may interfere with the normal juggler connection behaviour.
@@ -86,19 +170,37 @@ func (c *Conn) CloseNotify() <-chan struct{} {
 
 // LocalAddr returns the local network address.
 func (c *Conn) LocalAddr() net.Addr {
+	if c.wsConn == nil {
+		return nil
+	}
 	return c.wsConn.LocalAddr()
 }
 
 // RemoteAddr returns the remote network address.
 func (c *Conn) RemoteAddr() net.Addr {
+	if c.wsConn == nil {
+		return nil
+	}
 	return c.wsConn.RemoteAddr()
 }
 
 // Subprotocol returns the negotiated protocol for the connection.
 func (c *Conn) Subprotocol() string {
+	if c.wsConn == nil {
+		return ""
+	}
 	return c.wsConn.Subprotocol()
 }
 
+// Protocol returns the version of the protocol negotiated for the
+// connection, whose codec encodes and decodes its messages. Handlers
+// can use it to serve the clients differently depending on the version
+// they speak, e.g. to only send the messages or fields that their
+// version supports.
+func (c *Conn) Protocol() message.Protocol {
+	return c.proto
+}
+
 // Close closes the connection, setting err as CloseErr to identify
 // the reason of the close. It does not send a websocket close message,
 // nor does it close the underlying websocket connection.
@@ -114,6 +216,7 @@ func (c *Conn) Close(err error) {
 			c.resc.Close()
 		}
 		close(c.kill)
+		uuidstr.Forget(c.UUID)
 	})
 }
 
@@ -135,12 +238,16 @@ func (c *Conn) Close(err error) {
 // The returned writer itself is not safe for concurrent use, but
 // as all Conn methods, Writer can be called concurrently.
 func (c *Conn) Writer(timeout time.Duration) io.WriteCloser {
-	return wswriter.Exclusive(
+	w := wswriter.Exclusive(
 		c.wsConn,
 		c.wmu,
 		timeout,
-		c.srv.WriteTimeout,
+		c.srv.writeTimeout(),
 	)
+	if rec := c.srv.Recorder; rec != nil {
+		w = rec.Writer(w, c.UUID.String(), session.Server)
+	}
+	return w
 }
 
 // Send sends the message to the client. It calls the server's
@@ -164,7 +271,8 @@ func (c *Conn) results() {
 
 	ch := c.resc.Results()
 	for res := range ch {
-		c.Send(message.NewRes(res))
+		c.Send(message.NewRes(c.restoreURI(res)))
+		c.cacheResult(res)
 	}
 
 	// results loop was stopped, the connection should be closed if it
@@ -183,7 +291,11 @@ func (c *Conn) pubSub() {
 
 	ch := c.psc.Events()
 	for ev := range ch {
-		c.Send(message.NewEvnt(ev))
+		if ev = c.tenantEvnt(ev); ev != nil {
+			if ev = c.ackedEvnt(ev); ev != nil {
+				c.sendEvnt(ev)
+			}
+		}
 	}
 
 	// pubsub loop was stopped, the connection should be closed if it
@@ -209,20 +321,71 @@ func (c *Conn) receive() {
 			c.Close(err)
 			return
 		}
+
+		var raw []byte
+		if rec := c.srv.Recorder; rec != nil {
+			if raw, err = ioutil.ReadAll(r); err != nil {
+				c.Close(err)
+				return
+			}
+			rec.Record(c.UUID.String(), session.Client, mt, raw)
+			r = bytes.NewReader(raw)
+		}
+
 		if mt != websocket.TextMessage {
 			c.Close(fmt.Errorf("invalid websocket message type: %d", mt))
 			return
 		}
-		if to := c.srv.ReadTimeout; to > 0 {
+		if to := c.srv.readTimeout(); to > 0 {
 			c.wsConn.SetReadDeadline(time.Now().Add(to))
 		}
 
-		m, err := message.UnmarshalRequest(r, c.allowedMsgs...)
+		if c.srv.Strict && raw == nil {
+			if raw, err = ioutil.ReadAll(r); err != nil {
+				c.Close(err)
+				return
+			}
+			r = bytes.NewReader(raw)
+		}
+
+		m, err := c.proto.DecodeRequest(r, c.allowedMsgs...)
 		if err != nil {
 			c.Close(err)
 			return
 		}
 
+		if c.srv.Strict {
+			if err := message.Lint(raw, m); err != nil {
+				if c.srv.Vars != nil {
+					c.srv.Vars.Add("StrictRejectedMsgs", 1)
+				}
+				c.Send(message.NewNack(m, message.CodeBadRequest, err))
+				continue
+			}
+		}
+
+		if v := c.srv.NameValidator; v != nil {
+			if err := validateNames(v, m); err != nil {
+				if c.srv.Vars != nil {
+					c.srv.Vars.Add("InvalidNameMsgs", 1)
+				}
+				c.Send(message.NewNack(m, message.CodeBadRequest, err))
+				continue
+			}
+		}
+
+		if d := c.srv.Deduplicator; d != nil {
+			if dup, ack := d.check(c, m); dup {
+				if c.srv.Vars != nil {
+					c.srv.Vars.Add("DuplicateMsgs", 1)
+				}
+				if ack != nil {
+					c.Send(ack)
+				}
+				continue
+			}
+		}
+
 		if h := c.srv.Handler; h != nil {
 			h.Handle(context.Background(), c, m)
 		} else {
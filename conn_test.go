@@ -3,6 +3,7 @@ package juggler
 import (
 	"bytes"
 	"errors"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -143,6 +144,48 @@ func TestExclusiveWriter(t *testing.T) {
 	assert.Equal(t, "abcd", buf.String(), "writes are as expected")
 }
 
+func TestWriteExpiredEvnt(t *testing.T) {
+	var buf bytes.Buffer
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	wsc := wstest.Dial(t, srv.URL)
+	defer wsc.Close()
+
+	vars := new(expvar.Map).Init()
+	var expired []*message.Evnt
+	jc := newConn(wsc, &Server{Vars: vars, OnExpiredEvnt: func(c *Conn, m *message.Evnt) {
+		expired = append(expired, m)
+	}})
+
+	w := jc.Writer(100 * time.Millisecond)
+	_, err := fmt.Fprint(w, "a") // acquires the lock
+	require.NoError(t, err, "write a")
+
+	// the event expires while waiting for the write lock
+	ProcessMsg(jc, message.NewEvnt(&message.EvntPayload{Channel: "c", Timestamp: time.Now().UTC(), TTL: 20 * time.Millisecond}))
+	assert.Equal(t, "1", vars.Get("ExpiredEvnts").String(), "expired while waiting")
+	// the event is already expired
+	ProcessMsg(jc, message.NewEvnt(&message.EvntPayload{Channel: "c", Timestamp: time.Now().UTC().Add(-time.Second), TTL: time.Millisecond}))
+	assert.Equal(t, "2", vars.Get("ExpiredEvnts").String(), "already expired")
+	assert.Equal(t, 2, len(expired), "OnExpiredEvnt calls")
+	require.NoError(t, w.Close(), "close a")
+
+	select {
+	case <-jc.CloseNotify():
+		require.Fail(t, "connection closed")
+	default:
+	}
+
+	ProcessMsg(jc, message.NewEvnt(&message.EvntPayload{Channel: "c", Timestamp: time.Now().UTC(), TTL: time.Minute}))
+	assert.Equal(t, "2", vars.Get("ExpiredEvnts").String(), "not expired")
+
+	wsc.Close()
+	<-done
+	assert.Equal(t, 1, strings.Count(buf.String(), `"channel":"c"`), "one event written")
+}
+
 func TestConnClose(t *testing.T) {
 	srv := &Server{}
 	conn := newConn(&websocket.Conn{}, srv)
@@ -0,0 +1,168 @@
+package juggler
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrTooManyConns is the CloseErr of a connection that is rejected
+	// because it exceeds a limit of its Server's ConnLimiter.
+	ErrTooManyConns = errors.New("juggler: too many connections")
+
+	// ErrConnEvicted is the CloseErr of a connection that is closed to
+	// make room for a new connection, when the ConnLimiter of its
+	// Server uses the EvictOldestConn policy.
+	ErrConnEvicted = errors.New("juggler: connection evicted by a newer connection")
+)
+
+// ConnLimitPolicy defines what a ConnLimiter does with a new connection
+// that exceeds a limit.
+type ConnLimitPolicy int
+
+// The list of connection limit policies.
+const (
+	// RejectNewConn closes the new connection with ErrTooManyConns.
+	RejectNewConn ConnLimitPolicy = iota
+
+	// EvictOldestConn accepts the new connection and closes the oldest
+	// connection that counts towards the exceeded limit with
+	// ErrConnEvicted.
+	EvictOldestConn
+)
+
+// ConnLimiter limits the number of concurrent connections of a Server,
+// in total and per identity. The limits are enforced once the Identity
+// of the connection is set, after the Accepting state, so that a client
+// cannot exceed its limit by opening connections faster than they are
+// authenticated. The connections without identity only count towards
+// the total limit.
+//
+// The zero value is ready to use and has no limit. A ConnLimiter is safe
+// for concurrent use, and its limits can be changed at any time, which
+// only applies to the new connections. The same ConnLimiter can be used
+// by many Servers, e.g. when a new Server is created to change its
+// configuration, so that the limits apply to all their connections.
+type ConnLimiter struct {
+	mu       sync.Mutex
+	max      int
+	maxPerID int
+	policy   ConnLimitPolicy
+	conns    []*Conn            // oldest first
+	byID     map[string][]*Conn // oldest first
+}
+
+// SetMaxConns sets the maximum number of concurrent connections. The
+// default of 0 means no limit.
+func (l *ConnLimiter) SetMaxConns(n int) {
+	l.mu.Lock()
+	l.max = n
+	l.mu.Unlock()
+}
+
+// SetMaxConnsPerIdentity sets the maximum number of concurrent
+// connections with the same Identity. The default of 0 means no limit.
+func (l *ConnLimiter) SetMaxConnsPerIdentity(n int) {
+	l.mu.Lock()
+	l.maxPerID = n
+	l.mu.Unlock()
+}
+
+// SetPolicy sets the policy applied to the new connections that exceed
+// a limit. The default is RejectNewConn.
+func (l *ConnLimiter) SetPolicy(p ConnLimitPolicy) {
+	l.mu.Lock()
+	l.policy = p
+	l.mu.Unlock()
+}
+
+// Len returns the number of connections tracked by the limiter, and the
+// number of those connections with the specified identity.
+func (l *ConnLimiter) Len(identity string) (total, forIdentity int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.conns), len(l.byID[identity])
+}
+
+// acquire adds c to the connections if it doesn't exceed a limit. It
+// returns the connections to evict to make room for c, or
+// ErrTooManyConns if c is rejected.
+func (l *ConnLimiter) acquire(c *Conn) ([]*Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var evict []*Conn
+	if id := c.Identity; id != "" && l.maxPerID > 0 {
+		if n := len(l.byID[id]) - l.maxPerID + 1; n > 0 {
+			if l.policy != EvictOldestConn {
+				return nil, ErrTooManyConns
+			}
+			evict = append(evict, l.byID[id][:n]...)
+		}
+	}
+	if l.max > 0 {
+		// connections already evicted for the identity make room too
+		if n := len(l.conns) - len(evict) - l.max + 1; n > 0 {
+			if l.policy != EvictOldestConn {
+				return nil, ErrTooManyConns
+			}
+			for _, ec := range l.conns {
+				if n == 0 {
+					break
+				}
+				if !isInConns(evict, ec) {
+					evict = append(evict, ec)
+					n--
+				}
+			}
+		}
+	}
+
+	for _, ec := range evict {
+		l.remove(ec)
+	}
+	l.conns = append(l.conns, c)
+	if id := c.Identity; id != "" {
+		if l.byID == nil {
+			l.byID = make(map[string][]*Conn)
+		}
+		l.byID[id] = append(l.byID[id], c)
+	}
+	return evict, nil
+}
+
+// release removes c from the connections, if it is still tracked.
+func (l *ConnLimiter) release(c *Conn) {
+	l.mu.Lock()
+	l.remove(c)
+	l.mu.Unlock()
+}
+
+func (l *ConnLimiter) remove(c *Conn) {
+	l.conns = removeConn(l.conns, c)
+	if id := c.Identity; id != "" {
+		if conns := removeConn(l.byID[id], c); len(conns) > 0 {
+			l.byID[id] = conns
+		} else {
+			delete(l.byID, id)
+		}
+	}
+}
+
+func removeConn(list []*Conn, c *Conn) []*Conn {
+	for i, cc := range list {
+		if cc == c {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func isInConns(list []*Conn, c *Conn) bool {
+	for _, cc := range list {
+		if cc == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package juggler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiter(t *testing.T) {
+	a1, a2, a3 := &Conn{Identity: "a"}, &Conn{Identity: "a"}, &Conn{Identity: "a"}
+	b1, anon := &Conn{Identity: "b"}, &Conn{}
+
+	var l ConnLimiter
+	l.SetMaxConns(4)
+	l.SetMaxConnsPerIdentity(2)
+
+	for i, c := range []*Conn{a1, a2, b1, anon} {
+		evict, err := l.acquire(c)
+		require.NoError(t, err, "%d: acquire", i)
+		assert.Empty(t, evict, "%d: evict", i)
+	}
+	total, forA := l.Len("a")
+	assert.Equal(t, 4, total, "total")
+	assert.Equal(t, 2, forA, "for a")
+
+	// reject the new connections
+	_, err := l.acquire(a3)
+	assert.Equal(t, ErrTooManyConns, err, "a3 exceeds identity limit")
+	_, err = l.acquire(&Conn{})
+	assert.Equal(t, ErrTooManyConns, err, "anonymous exceeds total limit")
+
+	// evict the oldest connections
+	l.SetPolicy(EvictOldestConn)
+	evict, err := l.acquire(a3)
+	require.NoError(t, err, "a3 with eviction")
+	assert.Equal(t, []*Conn{a1}, evict, "a1 evicted for a3")
+
+	c := &Conn{Identity: "c"}
+	evict, err = l.acquire(c)
+	require.NoError(t, err, "c with eviction")
+	assert.Equal(t, []*Conn{a2}, evict, "oldest evicted for c")
+
+	total, forA = l.Len("a")
+	assert.Equal(t, 4, total, "total after eviction")
+	assert.Equal(t, 1, forA, "for a after eviction")
+
+	// releasing an evicted connection is a no-op
+	l.release(a1)
+	l.release(b1)
+	total, _ = l.Len("b")
+	assert.Equal(t, 3, total, "total after release")
+}
+
+func TestServerConnLimiter(t *testing.T) {
+	l := &ConnLimiter{}
+	l.SetMaxConns(1)
+	server := &Server{ConnLimiter: l}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	d := &websocket.Dialer{Subprotocols: Subprotocols}
+	hdr := http.Header{"Juggler-Allowed-Messages": {"pub"}}
+	cli1, err := client.Dial(d, srv.URL, hdr)
+	require.NoError(t, err, "Dial 1")
+	defer cli1.Close()
+
+	// wait for the first connection to be tracked
+	deadline := time.Now().Add(time.Second)
+	for n, _ := l.Len(""); n == 0 && time.Now().Before(deadline); n, _ = l.Len("") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cli2, err := client.Dial(d, srv.URL, hdr)
+	require.NoError(t, err, "Dial 2")
+	defer cli2.Close()
+	select {
+	case <-cli2.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "second connection not rejected")
+	}
+
+	// evict the first connection instead
+	l.SetPolicy(EvictOldestConn)
+	cli3, err := client.Dial(d, srv.URL, hdr)
+	require.NoError(t, err, "Dial 3")
+	defer cli3.Close()
+	select {
+	case <-cli1.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "first connection not evicted")
+	}
+	select {
+	case <-cli3.CloseNotify():
+		assert.Fail(t, "third connection closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
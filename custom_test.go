@@ -0,0 +1,81 @@
+package juggler_test
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// cursorMsg is a custom control frame with the cursor position of a
+// collaborative editor, sent by the clients and echoed by the server.
+type cursorMsg struct {
+	message.Meta `json:"meta"`
+	Payload      struct {
+		Line int `json:"line"`
+	} `json:"payload"`
+}
+
+var (
+	cursorReqMsg = message.RegisterRead("CURS", func() message.Msg { return &cursorMsg{} })
+	cursorResMsg = message.RegisterWrite("CURR", func() message.Msg { return &cursorMsg{} })
+)
+
+func TestCustomMsgs(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &juggler.Server{
+		CallerBroker: fakeCallerBroker{},
+		Vars:         vars,
+		CustomMsgHandler: juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+			cur := m.(*cursorMsg)
+			res := &cursorMsg{Meta: message.NewMeta(cursorResMsg)}
+			res.Payload.Line = cur.Payload.Line + 1
+			c.Send(res)
+		}),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	// the custom messages are allowed regardless of the allowed messages
+	cli, err := client.Dial(&websocket.Dialer{}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	cur := &cursorMsg{Meta: message.NewMeta(cursorReqMsg)}
+	cur.Payload.Line = 41
+	require.NoError(t, cli.SendCustom(context.Background(), cur), "SendCustom")
+
+	select {
+	case m := <-msgs:
+		if assert.IsType(t, &cursorMsg{}, m, "response") {
+			assert.Equal(t, cursorResMsg, m.Type(), "response type")
+			assert.Equal(t, 42, m.(*cursorMsg).Payload.Line, "response line")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no response")
+	}
+	assert.Equal(t, "2", vars.Get("CustomMsgs").String(), "custom messages")
+
+	// only the custom requests can be sent
+	assert.Error(t, cli.SendCustom(context.Background(), &cursorMsg{Meta: message.NewMeta(cursorResMsg)}), "SendCustom response")
+	call, err := message.NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	assert.Error(t, cli.SendCustom(context.Background(), call), "SendCustom call")
+}
@@ -0,0 +1,104 @@
+package juggler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// deadlineBroker returns the deadline of each call as its result.
+type deadlineBroker struct {
+	broker.CallerBroker
+	ch chan *message.ResPayload
+}
+
+func (b deadlineBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	args, _ := json.Marshal(cp.Deadline)
+	b.ch <- &message.ResPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: cp.URI, Args: args}
+	return nil
+}
+
+func (b deadlineBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return fakeResultsConn{b.ch}, nil
+}
+
+func TestCallDeadline(t *testing.T) {
+	server := &juggler.Server{CallerBroker: deadlineBroker{ch: make(chan *message.ResPayload, 10)}}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	results := make(chan *message.Res, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		if res, ok := m.(*message.Res); ok {
+			results <- res
+		}
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h),
+		client.SetCallRetry(2, time.Second))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	// each attempt and the backoff delay add up to the deadline
+	start := time.Now()
+	_, err = cli.Call("a", nil, 2*time.Second)
+	require.NoError(t, err, "Call")
+
+	select {
+	case res := <-results:
+		end := time.Now()
+		var deadline time.Time
+		require.NoError(t, json.Unmarshal(res.Payload.Args, &deadline), "Unmarshal deadline")
+		assert.Equal(t, time.UTC, deadline.Location(), "deadline in UTC")
+		assert.False(t, deadline.Before(start.Add(5*time.Second)), "deadline %v after %v", deadline, start)
+		assert.False(t, deadline.After(end.Add(5*time.Second)), "deadline %v before %v", deadline, end)
+	case <-time.After(time.Second):
+		require.FailNow(t, "no result")
+	}
+}
+
+func TestCallTooManyAttempts(t *testing.T) {
+	server := &juggler.Server{CallerBroker: deadlineBroker{ch: make(chan *message.ResPayload, 10)}}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	nacks := make(chan *message.Nack, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		if nack, ok := m.(*message.Nack); ok {
+			nacks <- nack
+		}
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h),
+		client.SetCallRetry(1<<30, time.Second))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	_, err = cli.Call("a", nil, time.Second)
+	require.NoError(t, err, "Call")
+
+	select {
+	case nack := <-nacks:
+		assert.Equal(t, message.CodeBadRequest, nack.Payload.Code, "NACK code")
+		assert.Equal(t, juggler.ErrTooManyAttempts.Error(), nack.Payload.Message, "NACK message")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no NACK")
+	}
+}
@@ -0,0 +1,118 @@
+package juggler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// Deduplicator drops the requests that are resubmitted with the same
+// message UUID within its window, so that a client can safely send a
+// request again after an ambiguous failure, e.g. a timeout waiting for
+// its ACK. If the original request was acknowledged, its ACK is sent
+// again for the duplicate, otherwise the duplicate is dropped while the
+// original is being processed. A request that got a NACK is forgotten,
+// so that it can be retried.
+//
+// The duplicates are detected per Identity and Tenant of the connection,
+// across the connections of the Servers that use the Deduplicator, but
+// the result of a CALL is only sent to the connection of the original
+// request. BATCH requests are not deduplicated.
+//
+// The zero value is ready to use and is disabled until a window is set.
+// A Deduplicator is safe for concurrent use, and the same Deduplicator
+// can be used by many Servers.
+type Deduplicator struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]*dedupEntry
+	sweep  time.Time // next sweep of the expired entries
+}
+
+type dedupEntry struct {
+	ack     *message.Ack // nil while the request is processed
+	expires time.Time
+}
+
+// SetWindow sets the duration during which a request is remembered
+// once it is received, and once it is acknowledged. The default of 0
+// disables the deduplication.
+func (d *Deduplicator) SetWindow(window time.Duration) {
+	d.mu.Lock()
+	d.window = window
+	if window <= 0 {
+		d.seen = nil
+	}
+	d.mu.Unlock()
+}
+
+// Len returns the number of requests remembered by the Deduplicator.
+func (d *Deduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.seen)
+}
+
+func dedupKey(c *Conn, id string) string {
+	return c.Tenant + "\x00" + c.Identity + "\x00" + id
+}
+
+// check registers the request m of c and returns false if it is not a
+// duplicate. Otherwise it returns true with the ACK of the original
+// request, which is nil if it is still being processed.
+func (d *Deduplicator) check(c *Conn, m message.Msg) (bool, *message.Ack) {
+	if !m.Type().IsRead() || m.Type() == message.BatchMsg {
+		return false, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.window <= 0 {
+		return false, nil
+	}
+
+	now := time.Now()
+	if now.After(d.sweep) {
+		for k, e := range d.seen {
+			if now.After(e.expires) {
+				delete(d.seen, k)
+			}
+		}
+		d.sweep = now.Add(d.window)
+	}
+
+	key := dedupKey(c, m.UUID().String())
+	if e := d.seen[key]; e != nil && !now.After(e.expires) {
+		return true, e.ack
+	}
+	if d.seen == nil {
+		d.seen = make(map[string]*dedupEntry)
+	}
+	d.seen[key] = &dedupEntry{expires: now.Add(d.window)}
+	return false, nil
+}
+
+// done records the ACK or NACK m sent to c for a request registered by
+// check.
+func (d *Deduplicator) done(c *Conn, m message.Msg) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.window <= 0 {
+		return
+	}
+
+	switch m := m.(type) {
+	case *message.Ack:
+		key := dedupKey(c, m.Payload.For.String())
+		if e := d.seen[key]; e != nil && e.ack == nil {
+			e.ack = m
+			e.expires = time.Now().Add(d.window)
+		}
+	case *message.Nack:
+		key := dedupKey(c, m.Payload.For.String())
+		if e := d.seen[key]; e != nil && e.ack == nil {
+			delete(d.seen, key)
+		}
+	}
+}
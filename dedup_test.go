@@ -0,0 +1,94 @@
+package juggler_test
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d := &juggler.Deduplicator{}
+	d.SetWindow(100 * time.Millisecond)
+
+	vars := new(expvar.Map).Init()
+	server := &juggler.Server{
+		CallerBroker: echoURIBroker{ch: make(chan *message.ResPayload, 10)},
+		Deduplicator: d,
+		Vars:         vars,
+		Handler: juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+			if call, ok := m.(*message.Call); ok && call.Payload.URI == "rejected" {
+				c.Send(message.NewNack(m, message.CodeForbidden, errors.New("forbidden")))
+				return
+			}
+			juggler.ProcessMsg(c, m)
+		}),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	conn, _, err := (&websocket.Dialer{Subprotocols: juggler.Subprotocols}).Dial(srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}})
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+
+	send := func(m message.Msg) {
+		require.NoError(t, conn.WriteJSON(m), "WriteJSON")
+	}
+	read := func(label string) message.Msg {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, r, err := conn.NextReader()
+		require.NoError(t, err, "%s: NextReader", label)
+		m, err := message.UnmarshalResponse(r)
+		require.NoError(t, err, "%s: UnmarshalResponse", label)
+		return m
+	}
+
+	call, err := message.NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	send(call)
+	ack := read("ack")
+	require.IsType(t, &message.Ack{}, ack, "ack")
+	require.IsType(t, &message.Res{}, read("res"), "res")
+
+	// the duplicate gets the original ACK, without another result
+	send(call)
+	dup := read("duplicate")
+	if assert.IsType(t, &message.Ack{}, dup, "duplicate ack") {
+		assert.Equal(t, ack.UUID().String(), dup.UUID().String(), "original ack")
+	}
+
+	// a rejected request is processed again
+	rejected, err := message.NewCall("rejected", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	send(rejected)
+	assert.IsType(t, &message.Nack{}, read("nack"), "nack")
+	send(rejected)
+	assert.IsType(t, &message.Nack{}, read("nack again"), "nack again")
+
+	// once the window expired, the request is processed again
+	time.Sleep(150 * time.Millisecond)
+	send(call)
+	if m := read("expired ack"); assert.IsType(t, &message.Ack{}, m, "expired ack") {
+		assert.NotEqual(t, ack.UUID().String(), m.UUID().String(), "new ack")
+	}
+	assert.IsType(t, &message.Res{}, read("expired res"), "expired res")
+	assert.Equal(t, 1, d.Len(), "remembered requests")
+
+	assert.Equal(t, "1", vars.Get("DuplicateMsgs").String(), "DuplicateMsgs")
+
+	d.SetWindow(0)
+	assert.Equal(t, 0, d.Len(), "disabled")
+}
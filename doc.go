@@ -6,6 +6,14 @@
 // event is published. Only active clients receive the event - this is
 // not to be confused with a reliable message queue.
 //
+// The events of a channel are sent to a connection in the order in
+// which the broker delivers them, which is the order in which they were
+// published if the broker preserves it (see redisbroker.Broker.EventShards).
+// Some events may still be missed, e.g. if the server drops them for a
+// slow connection. If the broker stamps the events with a sequence
+// number per channel (see message.EvntPayload.Seq), the clients can
+// detect the events they missed (see client.SetGapDetection).
+//
 // All messages sent by the client receive an acknowledge message
 // (ACK) when processed successfully or a negative acknowledge (NACK)
 // if the request was rejected. See the message package documentation
@@ -55,6 +63,14 @@
 // package variable). The negociated subprotocol is available via
 // the Subprotocol connection method.
 //
+// Each subprotocol is a version of the wire protocol (see
+// message.Protocol), e.g. "juggler.v2.json", and the server selects
+// the newest version requested by the client. The messages of the
+// connection are encoded and decoded with the codec of that version,
+// available via the Protocol connection method, so that the format
+// of the messages can evolve in a new version while the deployed
+// clients keep using the version they speak.
+//
 // A connection listens for its RPC call results, pub-sub events and
 // requests from the client end, and ensures the messages flow from client to
 // server and back as needed.
@@ -103,7 +119,7 @@
 //     func CheckAccessHandler(ctx context.Context, c *juggler.Conn, m message.Msg) {
 //       // assume we detected that the caller doesn't have access, in the ok variable
 //       if !ok {
-//         nack := message.NewNack(m, 403, errors.New("caller doesn't have access"))
+//         nack := message.NewNack(m, message.CodeForbidden, errors.New("caller doesn't have access"))
 //         c.Send(nack)
 //         return
 //       }
@@ -116,6 +132,28 @@
 // which have their Type.IsRead method return true. Responses (messages
 // sent by the server) have their Type.IsWrite method return true.
 //
+// Applications can add their own messages, e.g. domain-specific control
+// frames, with message.RegisterRead for the messages sent by the clients
+// and message.RegisterWrite for those sent by the server. ProcessMsg
+// passes the former to the Server's CustomMsgHandler and writes the
+// latter to the connection, and the Handler can check them with their
+// Type.IsCustomRead and Type.IsCustomWrite methods.
+//
+// All messages carry string headers in their metadata, e.g. a trace ID,
+// a tenant ID or a locale, that a handler reads with message.HeadersOf
+// or the Header method of the message. The headers of the CALL and PUB
+// requests are propagated by the brokers to the callees (see
+// message.CallPayload.Headers) and to the EVNT messages, and the callees
+// set the headers of the RES messages (see callee.Result). The clients
+// set the headers of their requests with client.SetHeaders and
+// client.WithHeaders.
+//
+// The callees report the latency of the calls in the metadata of the
+// RES messages (see message.Timing): the time the call request waited
+// in the broker, from the time the broker registered it, and the time
+// spent by the callee to process it, so that a caller can tell a backlog
+// of call requests from a slow callee.
+//
 // A new context.Context is passed for each message processed to maintain
 // values for the duration of a specific message.
 //
@@ -0,0 +1,354 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// DefaultEventAckTTL is the default duration during which the state of
+// a subscription in acknowledged mode is kept after its last activity
+// (see EventAcks.SetTTL).
+var DefaultEventAckTTL = 24 * time.Hour
+
+// MaxUnackedEvnts is the maximum number of events delivered and not yet
+// acknowledged that are remembered per subscription in acknowledged
+// mode. Once it is reached, the oldest ones are forgotten and are not
+// delivered again.
+var MaxUnackedEvnts = 1000
+
+// EventAcks keeps the state of the subscriptions in acknowledged mode
+// (see message.Sub), i.e. the events delivered to them that were not
+// acknowledged yet, so that those events are delivered again when the
+// subscription is made again, e.g. after a reconnect, along with the
+// events published in the meantime.
+//
+// The events are delivered again from the channel history, so the
+// PubSubBroker must implement broker.HistoryBroker, and the broker must
+// retain the events and stamp them with their sequence number (e.g.
+// redisbroker.Broker.HistoryCap and EventSequence). Only the events
+// still retained in the history, and at most MaxHistoryEvents, are
+// delivered again, and an event may be delivered more than once, so
+// the subscribers should use the sequence numbers to drop the
+// duplicates and detect the missed events (see client.SetGapDetection).
+// The events of the subscription without sequence number are delivered
+// without delivery tag, and are never delivered again.
+//
+// The subscriptions are identified by the Tenant, Identity and channel
+// of the connection, so only the connections with an Identity can
+// subscribe in acknowledged mode, and an identity should only have one
+// connection subscribed to a channel in that mode at a time. Pattern
+// subscriptions are not supported. An unsubscription forgets the state
+// of the subscription.
+//
+// The zero value is ready to use. An EventAcks is safe for concurrent
+// use, and the same EventAcks can be used by many Servers. Its state is
+// kept in memory, so the subscriptions are only resumed by the Servers
+// of the same process.
+type EventAcks struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	subs  map[string]*ackedSub
+	sweep time.Time // next sweep of the expired subscriptions
+}
+
+type ackedSub struct {
+	last    uint64               // sequence number of the last delivered event
+	lastTS  time.Time            // timestamp of that event, or of the subscription
+	unacked map[uint64]time.Time // timestamps of the unacknowledged events by sequence number
+	expires time.Time
+}
+
+// SetTTL sets the duration during which the state of a subscription is
+// kept after its last delivery, acknowledgement or subscription. The
+// default of 0 uses DefaultEventAckTTL.
+func (a *EventAcks) SetTTL(ttl time.Duration) {
+	a.mu.Lock()
+	a.ttl = ttl
+	a.mu.Unlock()
+}
+
+// Len returns the number of subscriptions remembered by the EventAcks.
+func (a *EventAcks) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.subs)
+}
+
+func (a *EventAcks) ttlLocked() time.Duration {
+	if a.ttl <= 0 {
+		return DefaultEventAckTTL
+	}
+	return a.ttl
+}
+
+// getLocked returns the state of the subscription key, refreshing its
+// expiration. It creates it if it does not exist, in which case it
+// returns false. The lock must be held.
+func (a *EventAcks) getLocked(key string, now time.Time) (*ackedSub, bool) {
+	ttl := a.ttlLocked()
+	if now.After(a.sweep) {
+		for k, s := range a.subs {
+			if now.After(s.expires) {
+				delete(a.subs, k)
+			}
+		}
+		a.sweep = now.Add(ttl)
+	}
+
+	s, ok := a.subs[key]
+	if !ok {
+		if a.subs == nil {
+			a.subs = make(map[string]*ackedSub)
+		}
+		s = &ackedSub{lastTS: now, unacked: make(map[uint64]time.Time)}
+		a.subs[key] = s
+	}
+	s.expires = now.Add(ttl)
+	return s, ok
+}
+
+// resume returns the time from which the events of the subscription key
+// must be delivered again, i.e. the timestamp of its oldest unacknowledged
+// event or of its last delivered event. It returns false if it is a new
+// subscription, which has nothing to deliver again.
+func (a *EventAcks) resume(key string) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.getLocked(key, time.Now())
+	if !ok {
+		return time.Time{}, false
+	}
+	from := s.lastTS
+	for _, ts := range s.unacked {
+		if ts.Before(from) {
+			from = ts
+		}
+	}
+	return from, true
+}
+
+// deliver records the delivery of the event ev to the subscription key
+// and returns true, or it returns false if ev must not be delivered
+// because it was already delivered. If redeliver is true, the events
+// that were not acknowledged are delivered again.
+func (a *EventAcks) deliver(key string, ev *message.EvntPayload, redeliver bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, _ := a.getLocked(key, time.Now())
+	if ev.Seq <= s.last {
+		_, unacked := s.unacked[ev.Seq]
+		return redeliver && unacked
+	}
+
+	s.last, s.lastTS = ev.Seq, ev.Timestamp
+	if len(s.unacked) >= MaxUnackedEvnts {
+		// forget the oldest event
+		oldest := ev.Seq
+		for seq := range s.unacked {
+			if seq < oldest {
+				oldest = seq
+			}
+		}
+		delete(s.unacked, oldest)
+	}
+	s.unacked[ev.Seq] = ev.Timestamp
+	return true
+}
+
+// ack acknowledges the event seq of the subscription key. It returns
+// false if the event is unknown or was already acknowledged.
+func (a *EventAcks) ack(key string, seq uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := a.subs[key]
+	if s == nil {
+		return false
+	}
+	if _, ok := s.unacked[seq]; !ok {
+		return false
+	}
+	delete(s.unacked, seq)
+	s.expires = time.Now().Add(a.ttlLocked())
+	return true
+}
+
+// forget removes the state of the subscription key.
+func (a *EventAcks) forget(key string) {
+	a.mu.Lock()
+	delete(a.subs, key)
+	a.mu.Unlock()
+}
+
+func ackKey(c *Conn, channel string) string {
+	return c.Tenant + "\x00" + c.Identity + "\x00" + channel
+}
+
+// evntTag returns the delivery tag of the event seq of channel.
+func evntTag(channel string, seq uint64) string {
+	return strconv.FormatUint(seq, 10) + ":" + channel
+}
+
+// parseEvntTag returns the channel and the sequence number of the event
+// from its delivery tag.
+func parseEvntTag(tag string) (string, uint64, error) {
+	ix := strings.Index(tag, ":")
+	if ix <= 0 {
+		return "", 0, errors.New("invalid delivery tag " + strconv.Quote(tag))
+	}
+	seq, err := strconv.ParseUint(tag[:ix], 10, 64)
+	if err != nil || seq == 0 {
+		return "", 0, errors.New("invalid delivery tag " + strconv.Quote(tag))
+	}
+	return tag[ix+1:], seq, nil
+}
+
+// taggedEvnt returns a copy of the event ev with its delivery tag.
+func taggedEvnt(ev *message.EvntPayload) *message.EvntPayload {
+	cp := *ev
+	cp.Tag = evntTag(ev.Channel, ev.Seq)
+	return &cp
+}
+
+// ackedSubs holds the channels subscribed in acknowledged mode by a
+// connection.
+type ackedSubs struct {
+	mu       sync.Mutex
+	channels map[string]bool
+}
+
+// subscribeAcked answers the SUB request in acknowledged mode m with the
+// ACK, followed by the events of the subscription to deliver again. It
+// returns false if the request was rejected with a NACK.
+func subscribeAcked(c *Conn, m *message.Sub, addFn func(string, int64)) bool {
+	a := c.srv.EventAcks
+	hb, _ := c.srv.PubSubBroker.(broker.HistoryBroker)
+	switch {
+	case a == nil || hb == nil:
+		c.Send(message.NewNack(m, message.CodeBadRequest, errors.New("acknowledged mode not supported")))
+		return false
+	case m.Payload.Pattern:
+		c.Send(message.NewNack(m, message.CodeBadRequest, errors.New("acknowledged mode not supported for patterns")))
+		return false
+	case c.Identity == "":
+		c.Send(message.NewNack(m, message.CodeUnauthorized, errors.New("acknowledged mode requires an identity")))
+		return false
+	}
+
+	// the lock is held until the events are delivered again, so that
+	// the events received in the meantime are delivered after them.
+	as := &c.acked
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	channel := m.Payload.Channel
+	if err := c.psc.Subscribe(c.tenantName(channel), false); err != nil {
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return false
+	}
+
+	key := ackKey(c, channel)
+	var evs []*message.EvntPayload
+	if from, ok := a.resume(key); ok {
+		var err error
+		evs, err = hb.History(c.tenantName(channel), from, time.Time{}, MaxHistoryEvents)
+		if err != nil {
+			addFn("FailedEvntRedeliveries", 1)
+			c.psc.Unsubscribe(c.tenantName(channel), false)
+			c.Send(message.NewNack(m, message.CodeHandlerError, err))
+			return false
+		}
+	}
+	if as.channels == nil {
+		as.channels = make(map[string]bool)
+	}
+	as.channels[channel] = true
+
+	sendAck(c, m)
+	for _, ev := range evs {
+		if ev = c.tenantEvnt(ev); ev != nil && ev.Seq > 0 && a.deliver(key, ev, true) {
+			addFn("RedeliveredEvnts", 1)
+			c.sendEvnt(taggedEvnt(ev))
+		}
+	}
+	return true
+}
+
+// ackedEvnt returns the event ev to send, with its delivery tag if its
+// channel is subscribed in acknowledged mode, or nil if it was already
+// delivered.
+func (c *Conn) ackedEvnt(ev *message.EvntPayload) *message.EvntPayload {
+	as := &c.acked
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if ev.Pattern != "" || ev.Seq == 0 || !as.channels[ev.Channel] {
+		return ev
+	}
+	if !c.srv.EventAcks.deliver(ackKey(c, ev.Channel), ev, false) {
+		return nil
+	}
+	return taggedEvnt(ev)
+}
+
+// removeAcked removes the subscription in acknowledged mode to channel,
+// if any, and forgets its state.
+func (c *Conn) removeAcked(channel string, pattern bool) {
+	if pattern {
+		return
+	}
+
+	as := &c.acked
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.channels[channel] {
+		delete(as.channels, channel)
+		c.srv.EventAcks.forget(ackKey(c, channel))
+	}
+}
+
+// ackEvnts answers the events acknowledgement CALL with the ACK and the
+// RES holding the delivery tags that were acknowledged.
+func ackEvnts(c *Conn, m *message.Call, addFn func(string, int64)) {
+	var ea message.EvntAck
+	if err := json.Unmarshal(m.Payload.Args, &ea); err != nil {
+		c.Send(message.NewNack(m, message.CodeBadRequest, err))
+		return
+	}
+
+	acked := make([]string, 0, len(ea.Tags))
+	for _, tag := range ea.Tags {
+		channel, seq, err := parseEvntTag(tag)
+		if err != nil {
+			c.Send(message.NewNack(m, message.CodeBadRequest, err))
+			return
+		}
+		if c.srv.EventAcks.ack(ackKey(c, channel), seq) {
+			acked = append(acked, tag)
+		}
+	}
+	ea.Tags = acked
+	b, err := json.Marshal(ea)
+	if err != nil {
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return
+	}
+
+	addFn("EvntAcks", int64(len(acked)))
+	sendAck(c, m)
+	c.Send(message.NewRes(&message.ResPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      m.Payload.URI,
+		Args:     b,
+	}))
+}
@@ -0,0 +1,231 @@
+package juggler_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// seqPubSubBroker is an in-memory pub-sub broker that stamps the events
+// with their sequence number and retains them for the history.
+type seqPubSubBroker struct {
+	mu      sync.Mutex
+	seqs    map[string]uint64
+	history []*message.EvntPayload
+	conns   []*seqPubSubConn
+}
+
+func (b *seqPubSubBroker) NewPubSubConn() (broker.PubSubConn, error) {
+	c := &seqPubSubConn{b: b, ch: make(chan *message.EvntPayload, 10), channels: make(map[string]bool)}
+	b.mu.Lock()
+	b.conns = append(b.conns, c)
+	b.mu.Unlock()
+	return c, nil
+}
+
+func (b *seqPubSubBroker) Publish(channel string, pp *message.PubPayload) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.seqs == nil {
+		b.seqs = make(map[string]uint64)
+	}
+	b.seqs[channel]++
+	ev := &message.EvntPayload{MsgUUID: pp.MsgUUID, Channel: channel, Args: pp.Args, Timestamp: pp.Timestamp, Seq: b.seqs[channel]}
+	b.history = append(b.history, ev)
+	for _, c := range b.conns {
+		if !c.closed && c.channels[channel] {
+			c.ch <- ev
+		}
+	}
+	return nil
+}
+
+func (b *seqPubSubBroker) History(channel string, from, to time.Time, limit int) ([]*message.EvntPayload, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var evs []*message.EvntPayload
+	for _, ev := range b.history {
+		if ev.Channel == channel && !ev.Timestamp.Before(from) {
+			evs = append(evs, ev)
+		}
+	}
+	return evs, nil
+}
+
+type seqPubSubConn struct {
+	b        *seqPubSubBroker
+	ch       chan *message.EvntPayload
+	channels map[string]bool
+	closed   bool
+}
+
+func (c *seqPubSubConn) Subscribe(channel string, pattern bool) error {
+	c.b.mu.Lock()
+	c.channels[channel] = true
+	c.b.mu.Unlock()
+	return nil
+}
+
+func (c *seqPubSubConn) Unsubscribe(channel string, pattern bool) error {
+	c.b.mu.Lock()
+	delete(c.channels, channel)
+	c.b.mu.Unlock()
+	return nil
+}
+
+func (c *seqPubSubConn) Events() <-chan *message.EvntPayload { return c.ch }
+func (c *seqPubSubConn) EventsErr() error                    { return nil }
+func (c *seqPubSubConn) Close() error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+	return nil
+}
+
+func TestEventAcks(t *testing.T) {
+	psb := &seqPubSubBroker{}
+	vars := new(expvar.Map).Init()
+	acks := &juggler.EventAcks{}
+	closed := make(chan struct{}, 2)
+	server := &juggler.Server{
+		CallerBroker: fakeCallerBroker{},
+		PubSubBroker: psb,
+		EventAcks:    acks,
+		Vars:         vars,
+		ConnState: func(c *juggler.Conn, cs juggler.ConnState) {
+			switch cs {
+			case juggler.Accepting:
+				c.Identity = "u1"
+			case juggler.Closed:
+				closed <- struct{}{}
+			}
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	// the handler of the client is called in a goroutine per message, so
+	// the events are received in random order
+	dial := func() (*client.Client, chan *message.Evnt, chan message.Msg) {
+		evnts, msgs := make(chan *message.Evnt, 10), make(chan message.Msg, 10)
+		h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+			switch m := m.(type) {
+			case *message.Evnt:
+				evnts <- m
+			default:
+				msgs <- m
+			}
+		})
+		cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, nil, client.SetHandler(h))
+		require.NoError(t, err, "Dial")
+		return cli, evnts, msgs
+	}
+	next := func(msgs chan message.Msg, label string) message.Msg {
+		select {
+		case m := <-msgs:
+			return m
+		case <-time.After(time.Second):
+			require.FailNow(t, "no message", label)
+		}
+		return nil
+	}
+	nextEvnts := func(evnts chan *message.Evnt, n int, label string) (args []string, tags map[string]string) {
+		tags = make(map[string]string)
+		for i := 0; i < n; i++ {
+			select {
+			case ev := <-evnts:
+				args = append(args, string(ev.Payload.Args))
+				tags[string(ev.Payload.Args)] = ev.Payload.Tag
+			case <-time.After(time.Second):
+				require.FailNow(t, "no event", label)
+			}
+		}
+		sort.Strings(args)
+		return args, tags
+	}
+	publish := func(args string) {
+		require.NoError(t, psb.Publish("a", &message.PubPayload{MsgUUID: message.NewID(), Args: json.RawMessage(args), Timestamp: time.Now().UTC()}), "Publish")
+	}
+
+	cli, evnts, msgs := dial()
+	_, err := cli.SubAcked(context.Background(), "a")
+	require.NoError(t, err, "SubAcked")
+	assert.IsType(t, &message.Ack{}, next(msgs, "sub"), "ACK of the subscription")
+
+	publish("1")
+	publish("2")
+	publish("3")
+	args, tags := nextEvnts(evnts, 3, "delivered")
+	assert.Equal(t, []string{"1", "2", "3"}, args, "delivered events")
+	assert.Equal(t, "1:a", tags["1"], "delivery tag")
+
+	_, err = cli.AckEvnts(context.Background(), tags["1"], tags["3"], "9:a")
+	require.NoError(t, err, "AckEvnts")
+	var res *message.Res
+	for i := 0; i < 2; i++ {
+		if m, ok := next(msgs, "ack").(*message.Res); ok {
+			res = m
+		}
+	}
+	if assert.NotNil(t, res, "RES of the acknowledgement") {
+		var ea message.EvntAck
+		require.NoError(t, json.Unmarshal(res.Payload.Args, &ea), "Unmarshal")
+		assert.Equal(t, []string{"1:a", "3:a"}, ea.Tags, "acknowledged tags")
+	}
+	cli.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		require.FailNow(t, "connection not closed")
+	}
+	publish("4")
+
+	// the unacknowledged event and the event published while disconnected
+	// are delivered again
+	cli, evnts, msgs = dial()
+	defer cli.Close()
+	_, err = cli.SubAcked(context.Background(), "a")
+	require.NoError(t, err, "SubAcked")
+	assert.IsType(t, &message.Ack{}, next(msgs, "sub"), "ACK of the subscription")
+	args, _ = nextEvnts(evnts, 2, "redelivered")
+	assert.Equal(t, []string{"2", "4"}, args, "redelivered events")
+	assert.Equal(t, "2", vars.Get("RedeliveredEvnts").String(), "RedeliveredEvnts")
+
+	publish("5")
+	args, _ = nextEvnts(evnts, 1, "live")
+	assert.Equal(t, []string{"5"}, args, "live event")
+
+	_, err = cli.Unsb("a", false)
+	require.NoError(t, err, "Unsb")
+	assert.IsType(t, &message.Ack{}, next(msgs, "unsb"), "ACK of the unsubscription")
+	assert.Equal(t, 0, acks.Len(), "state forgotten")
+
+	m := message.NewSub("a*", true)
+	m.Payload.Acked = true
+	require.NoError(t, cli.UnderlyingConn().WriteJSON(m), "WriteJSON")
+	if nack, ok := next(msgs, "pattern").(*message.Nack); assert.True(t, ok, "NACK of the pattern subscription") {
+		assert.Equal(t, message.CodeBadRequest, nack.Payload.Code, "NACK code")
+	}
+}
@@ -0,0 +1,158 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// MaxCreditedSubs is the maximum number of subscriptions of a connection
+// with flow control (see Server.FlowControl). The grants for other
+// subscriptions are rejected once the limit is reached.
+var MaxCreditedSubs = 1000
+
+// flowControl holds the event credits of the subscriptions of a
+// connection, keyed by subKey.
+type flowControl struct {
+	mu   sync.Mutex
+	subs map[string]*creditedSub
+}
+
+// creditedSub is a subscription with flow control. Its events are
+// buffered while it has no credits, oldest first.
+type creditedSub struct {
+	credits int
+	buf     []*message.EvntPayload
+}
+
+func subKey(channel string, pattern bool) string {
+	if pattern {
+		return "p:" + channel
+	}
+	return "c:" + channel
+}
+
+// grantCredits answers the flow control CALL with the ACK and the RES
+// holding the credits left for the subscription, after sending its
+// buffered events.
+func grantCredits(c *Conn, m *message.Call, addFn func(string, int64)) {
+	var g message.CreditGrant
+	if err := json.Unmarshal(m.Payload.Args, &g); err != nil {
+		c.Send(message.NewNack(m, message.CodeBadRequest, err))
+		return
+	}
+	if g.Channel == "" {
+		c.Send(message.NewNack(m, message.CodeBadRequest, errors.New("missing channel")))
+		return
+	}
+	if g.Credits < 0 {
+		c.Send(message.NewNack(m, message.CodeBadRequest, errors.New("negative credits")))
+		return
+	}
+
+	left, err := c.grantCredits(g.Channel, g.Pattern, g.Credits)
+	if err != nil {
+		c.Send(message.NewNack(m, message.CodeBadRequest, err))
+		return
+	}
+	g.Credits = left
+	b, err := json.Marshal(g)
+	if err != nil {
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return
+	}
+
+	addFn("CreditGrants", 1)
+	sendAck(c, m)
+	c.Send(message.NewRes(&message.ResPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      m.Payload.URI,
+		Args:     b,
+	}))
+}
+
+// grantCredits adds n credits to the subscription, enabling its flow
+// control if needed, and sends the buffered events that the credits
+// allow. It returns the credits left.
+func (c *Conn) grantCredits(channel string, pattern bool, n int) (int, error) {
+	fc := &c.flow
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	key := subKey(channel, pattern)
+	sub := fc.subs[key]
+	if sub == nil {
+		if len(fc.subs) >= MaxCreditedSubs {
+			return 0, fmt.Errorf("too many subscriptions with flow control, maximum is %d", MaxCreditedSubs)
+		}
+		if fc.subs == nil {
+			fc.subs = make(map[string]*creditedSub)
+		}
+		sub = &creditedSub{}
+		fc.subs[key] = sub
+	}
+
+	sub.credits += n
+	for sub.credits > 0 && len(sub.buf) > 0 {
+		ev := sub.buf[0]
+		sub.buf[0] = nil
+		sub.buf = sub.buf[1:]
+		sub.credits--
+		c.Send(message.NewEvnt(ev))
+	}
+	return sub.credits, nil
+}
+
+// removeCredits disables the flow control of the subscription, its
+// buffered events are dropped.
+func (c *Conn) removeCredits(channel string, pattern bool) {
+	c.flow.mu.Lock()
+	delete(c.flow.subs, subKey(channel, pattern))
+	c.flow.mu.Unlock()
+}
+
+// sendEvnt sends the event ev, using a credit of its subscription if it
+// has flow control. The event is buffered, or dropped if the buffer is
+// full (see Server.CreditBuffer), if the subscription has no credits.
+func (c *Conn) sendEvnt(ev *message.EvntPayload) {
+	fc := &c.flow
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	// the lock is held while the event is sent, so that the buffered
+	// events sent by grantCredits are not overtaken.
+	var sub *creditedSub
+	if len(fc.subs) > 0 {
+		if ev.Pattern != "" {
+			sub = fc.subs[subKey(ev.Pattern, true)]
+		} else {
+			sub = fc.subs[subKey(ev.Channel, false)]
+		}
+	}
+	if sub == nil {
+		c.Send(message.NewEvnt(ev))
+		return
+	}
+
+	if sub.credits > 0 && len(sub.buf) == 0 {
+		sub.credits--
+		c.Send(message.NewEvnt(ev))
+		return
+	}
+	if max := c.srv.CreditBuffer; len(sub.buf) < max {
+		sub.buf = append(sub.buf, ev)
+		return
+	}
+	if c.srv.Vars != nil {
+		c.srv.Vars.Add("CreditDroppedEvnts", 1)
+	}
+	if len(sub.buf) > 0 {
+		// drop the oldest event, the newest is more relevant
+		copy(sub.buf, sub.buf[1:])
+		sub.buf[len(sub.buf)-1] = ev
+	}
+}
@@ -0,0 +1,135 @@
+package juggler_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// chanPubSubBroker delivers the events sent on its channel to its
+// single pub-sub connection.
+type chanPubSubBroker struct {
+	broker.PubSubBroker
+	ch chan *message.EvntPayload
+}
+
+func (b chanPubSubBroker) NewPubSubConn() (broker.PubSubConn, error) {
+	return &chanPubSubConn{ch: b.ch}, nil
+}
+
+type chanPubSubConn struct {
+	once sync.Once
+	ch   chan *message.EvntPayload
+}
+
+func (c *chanPubSubConn) Subscribe(channel string, pattern bool) error   { return nil }
+func (c *chanPubSubConn) Unsubscribe(channel string, pattern bool) error { return nil }
+func (c *chanPubSubConn) Events() <-chan *message.EvntPayload            { return c.ch }
+func (c *chanPubSubConn) EventsErr() error                               { return nil }
+func (c *chanPubSubConn) Close() error {
+	c.once.Do(func() { close(c.ch) })
+	return nil
+}
+
+func TestFlowControl(t *testing.T) {
+	events := make(chan *message.EvntPayload)
+	vars := new(expvar.Map).Init()
+	server := &juggler.Server{
+		CallerBroker: echoURIBroker{ch: make(chan *message.ResPayload, 10)},
+		PubSubBroker: chanPubSubBroker{ch: events},
+		FlowControl:  true,
+		CreditBuffer: 2,
+		Vars:         vars,
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	// the handler of the client is called in a goroutine per message, so
+	// the events are received in random order
+	evnts, msgs := make(chan string, 10), make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		switch m := m.(type) {
+		case *message.Evnt:
+			evnts <- string(m.Payload.Args)
+		case *message.Res, *message.Nack:
+			msgs <- m
+		}
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, nil, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	next := func(label string) message.Msg {
+		select {
+		case m := <-msgs:
+			return m
+		case <-time.After(time.Second):
+			require.FailNow(t, "no message", label)
+		}
+		return nil
+	}
+	nextEvnts := func(n int, label string) []string {
+		var evs []string
+		for i := 0; i < n; i++ {
+			select {
+			case ev := <-evnts:
+				evs = append(evs, ev)
+			case <-time.After(time.Second):
+				require.FailNow(t, "no event", label)
+			}
+		}
+		sort.Strings(evs)
+		return evs
+	}
+	grant := func(n int) int {
+		_, err := cli.GrantCredits(context.Background(), "a", false, n)
+		require.NoError(t, err, "GrantCredits")
+		m := next("grant")
+		res, ok := m.(*message.Res)
+		require.True(t, ok, "grant RES, got %T", m)
+		var g message.CreditGrant
+		require.NoError(t, json.Unmarshal(res.Payload.Args, &g), "Unmarshal")
+		return g.Credits
+	}
+	publish := func(channel string, args string) {
+		events <- &message.EvntPayload{Channel: channel, Args: json.RawMessage(args)}
+	}
+
+	assert.Equal(t, 2, grant(2), "credits")
+	for _, args := range []string{"1", "2", "3", "4", "5"} {
+		publish("a", args)
+	}
+	assert.Equal(t, []string{"1", "2"}, nextEvnts(2, "credited"), "credited events")
+
+	// the subscriptions without grant are not flow-controlled
+	publish("b", "6")
+	assert.Equal(t, []string{"6"}, nextEvnts(1, "no flow control"), "event without flow control")
+
+	// event 3 was dropped to buffer events 4 and 5
+	assert.Equal(t, "1", vars.Get("CreditDroppedEvnts").String(), "CreditDroppedEvnts")
+	assert.Equal(t, 0, grant(1), "credits after buffered event")
+	assert.Equal(t, []string{"4"}, nextEvnts(1, "buffered"), "buffered event")
+	assert.Equal(t, 4, grant(5), "credits after buffered events")
+	assert.Equal(t, []string{"5"}, nextEvnts(1, "buffered"), "last buffered event")
+
+	_, err = cli.GrantCredits(context.Background(), "a", false, -1)
+	require.NoError(t, err, "GrantCredits")
+	assert.IsType(t, &message.Nack{}, next("negative credits"), "negative credits")
+	assert.Equal(t, "3", vars.Get("CreditGrants").String(), "CreditGrants")
+}
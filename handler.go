@@ -1,17 +1,27 @@
 package juggler
 
 import (
-	"encoding/json"
+	"errors"
 	"expvar"
 	"io"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/PuerkitoBio/juggler/broker"
 	"github.com/PuerkitoBio/juggler/internal/wswriter"
 	"github.com/PuerkitoBio/juggler/message"
 )
 
+// ErrTooManyAttempts is the error of the NACK sent for a CALL request
+// with more than message.MaxAttempts attempts.
+var ErrTooManyAttempts = errors.New("juggler: too many attempts")
+
+// ErrSystemChannel is the error of the NACK sent for a PUB request on a
+// system channel (see message.SystemChannelPrefix), on which only the
+// servers and callees publish.
+var ErrSystemChannel = errors.New("juggler: reserved system channel")
+
 // SlowProcessMsgThreshold defines the threshold at which calls to
 // ProcessMsg are marked as slow in the expvar metrics, if Server.Vars
 // is set. Set to 0 to disable SlowProcessMsg metrics.
@@ -82,55 +92,268 @@ func ProcessMsg(c *Conn, m message.Msg) {
 
 	switch m := m.(type) {
 	case *message.Call:
+		if m.Payload.MaxAttempts > message.MaxAttempts {
+			addFn("TooManyAttemptsCalls", 1)
+			c.Send(message.NewNack(m, message.CodeBadRequest, ErrTooManyAttempts))
+			return
+		}
+		if m.Meta.ActAs != "" && !authorizeActAs(c, m, addFn) {
+			return
+		}
+		if c.srv.TimeSync && m.Payload.URI == message.TimeSyncURI {
+			timeSync(c, m, addFn)
+			return
+		}
+		if hb := c.srv.historyBroker(); hb != nil && m.Payload.URI == message.HistoryURI {
+			fetchHistory(c, m, hb, addFn)
+			return
+		}
+		if c.srv.FlowControl && m.Payload.URI == message.CreditURI {
+			grantCredits(c, m, addFn)
+			return
+		}
+		if c.srv.EventAcks != nil && m.Payload.URI == message.EvntAckURI {
+			ackEvnts(c, m, addFn)
+			return
+		}
+
+		uri := m.Payload.URI
+		if c.srv.RewriteURI != nil {
+			rm, ok := rewriteCall(c, m, addFn)
+			if !ok {
+				return
+			}
+			m = rm
+		}
+
+		// the results of each version are cached and checked separately
+		vuri := message.VersionedURI(m.Payload.URI, m.Payload.Version)
+		if h := localHandler(vuri); h != nil {
+			callLocal(c, m, uri, h, addFn)
+			return
+		}
+		cb, ttl := c.srv.cacheFor(m.Payload.URI)
+		if c.Tenant != "" {
+			m = tenantCall(c, m)
+			vuri = message.VersionedURI(m.Payload.URI, m.Payload.Version)
+		}
+		var cacheKey string
+		if cb != nil {
+			cacheKey = resultCacheKey(m.Payload.Args)
+			args, err := cb.CachedResult(vuri, cacheKey)
+			switch {
+			case err != nil:
+				addFn("FailedCacheLookups", 1)
+			case args != nil:
+				addFn("CacheHits", 1)
+				sendAck(c, m)
+				c.Send(message.NewRes(&message.ResPayload{
+					ConnUUID: c.UUID,
+					MsgUUID:  m.UUID(),
+					URI:      uri,
+					Args:     args,
+				}))
+				return
+			default:
+				addFn("CacheMisses", 1)
+			}
+		}
+
+		if !c.srv.hasCallee(vuri, m.Payload.Routing, addFn) {
+			addFn("NoCalleeCalls", 1)
+			c.Send(message.NewNack(m, message.CodeNoCallee, ErrNoCallee))
+			return
+		}
+
+		if cb != nil {
+			// register before the call, so the result cannot be missed
+			c.addPendingCache(m, cb, cacheKey, ttl)
+		}
+		if uri != m.Payload.URI {
+			c.addRewrite(m, uri)
+		}
+
+		identity, actor := callIdentity(c, m)
 		cp := &message.CallPayload{
-			ConnUUID: c.UUID,
-			MsgUUID:  m.UUID(),
-			URI:      m.Payload.URI,
-			Args:     m.Payload.Args,
+			ConnUUID:    c.UUID,
+			MsgUUID:     m.UUID(),
+			URI:         m.Payload.URI,
+			Args:        m.Payload.Args,
+			ContentType: m.Payload.ContentType,
+			Routing:     m.Payload.Routing,
+			RoutingKey:  m.Payload.RoutingKey,
+			Priority:    m.Payload.Priority,
+			MaxAttempts: m.Payload.MaxAttempts,
+			Backoff:     m.Payload.Backoff,
+			Version:     m.Payload.Version,
+			Identity:    identity,
+			Actor:       actor,
+			Signature:   m.Meta.Sig,
+			Headers:     m.Meta.Headers,
+			Deadline:    time.Now().Add(CallWait(m)).UTC(),
+			Timestamp:   time.Now().UTC(),
+		}
+		if cp.Signature != nil && uri != cp.URI {
+			cp.SignedURI = uri
+		}
+		if c.addBatchCall(m, cp, cb != nil) {
+			return
 		}
 		if err := c.srv.CallerBroker.Call(cp, m.Payload.Timeout); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+			if uri != m.Payload.URI {
+				c.removeRewrite(m.UUID().String())
+			}
+			callFailed(c, m, err, cb != nil, addFn)
 			return
 		}
-		c.Send(message.NewAck(m))
+		sendAck(c, m)
 
 	case *message.Pub:
+		if message.IsSystemChannel(m.Payload.Channel) {
+			addFn("SystemChannelPubs", 1)
+			c.Send(message.NewNack(m, message.CodeForbidden, ErrSystemChannel))
+			return
+		}
 		pp := &message.PubPayload{
-			MsgUUID: m.UUID(),
-			Args:    m.Payload.Args,
+			MsgUUID:     m.UUID(),
+			Args:        m.Payload.Args,
+			ContentType: m.Payload.ContentType,
+			Timestamp:   time.Now().UTC(),
+			TTL:         m.Payload.TTL,
+			Headers:     m.Meta.Headers,
 		}
-		if err := c.srv.PubSubBroker.Publish(m.Payload.Channel, pp); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+		channel := c.tenantName(m.Payload.Channel)
+		if c.addBatchPub(m, channel, pp) {
 			return
 		}
-		c.Send(message.NewAck(m))
+		if err := c.srv.PubSubBroker.Publish(channel, pp); err != nil {
+			c.Send(message.NewNack(m, message.CodeHandlerError, err))
+			return
+		}
+		sendAck(c, m)
 
 	case *message.Sub:
-		if err := c.psc.Subscribe(m.Payload.Channel, m.Payload.Pattern); err != nil {
-			c.Send(message.NewNack(m, 500, err))
-			return
+		if m.Payload.Sticky {
+			if !subscribeSticky(c, m, addFn) {
+				return
+			}
+		} else if m.Payload.Acked {
+			if !subscribeAcked(c, m, addFn) {
+				return
+			}
+		} else {
+			if err := c.psc.Subscribe(c.tenantName(m.Payload.Channel), m.Payload.Pattern); err != nil {
+				c.Send(message.NewNack(m, message.CodeHandlerError, err))
+				return
+			}
+			sendAck(c, m)
+		}
+		c.addSub(c.tenantName(m.Payload.Channel), m.Payload.Pattern)
+		if fn := c.srv.OnSubscribe; fn != nil {
+			fn(c, m.Payload.Channel, m.Payload.Pattern)
 		}
-		c.Send(message.NewAck(m))
 
 	case *message.Unsb:
-		if err := c.psc.Unsubscribe(m.Payload.Channel, m.Payload.Pattern); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+		if m.Payload.Sticky && !unsubscribeSticky(c, m, addFn) {
 			return
 		}
-		c.Send(message.NewAck(m))
+		if err := c.psc.Unsubscribe(c.tenantName(m.Payload.Channel), m.Payload.Pattern); err != nil {
+			c.Send(message.NewNack(m, message.CodeHandlerError, err))
+			return
+		}
+		c.removeCredits(m.Payload.Channel, m.Payload.Pattern)
+		c.removeAcked(m.Payload.Channel, m.Payload.Pattern)
+		c.removeSub(c.tenantName(m.Payload.Channel), m.Payload.Pattern)
+		sendAck(c, m)
+		if fn := c.srv.OnUnsubscribe; fn != nil {
+			fn(c, m.Payload.Channel, m.Payload.Pattern)
+		}
+
+	case *message.Batch:
+		processBatch(c, m, addFn)
 
-	case *message.Ack, *message.Nack, *message.Evnt, *message.Res:
+	case *message.Ack, *message.Nack:
+		if d := c.srv.Deduplicator; d != nil {
+			d.done(c, m)
+		}
+		doWrite(c, m, addFn)
+
+	case *message.Evnt, *message.Res:
 		doWrite(c, m, addFn)
 
 	default:
-		addFn("MsgsUnknown", 1)
+		switch {
+		case m.Type().IsCustomRead() && c.srv.CustomMsgHandler != nil:
+			addFn("CustomMsgs", 1)
+			c.srv.CustomMsgHandler.Handle(context.Background(), c, m)
+		case m.Type().IsCustomWrite():
+			addFn("CustomMsgs", 1)
+			doWrite(c, m, addFn)
+		default:
+			addFn("MsgsUnknown", 1)
+		}
 	}
 }
 
+// sendAck sends the ACK of the request m, unless it is a fire-and-forget
+// request (see message.NoAck).
+func sendAck(c *Conn, m message.Msg) {
+	if !message.NoAck(m) {
+		c.Send(message.NewAck(m))
+	}
+}
+
+// callFailed sends the NACK for the call request m that the broker
+// failed to register. If cached is true, the call was registered to
+// cache its result.
+func callFailed(c *Conn, m *message.Call, err error, cached bool, addFn func(string, int64)) {
+	if cached {
+		c.removePendingCache(m.UUID().String())
+	}
+	code := message.CodeHandlerError
+	switch err {
+	case broker.ErrUnsupportedVersion:
+		addFn("UnsupportedVersionCalls", 1)
+		code = message.CodeUnsupportedVersion
+	case broker.ErrNoCallee:
+		addFn("NoCalleeCalls", 1)
+		code = message.CodeNoCallee
+	}
+	c.Send(message.NewNack(m, code, err))
+}
+
 func doWrite(c *Conn, m message.Msg, addFn func(string, int64)) {
-	if err := writeMsg(c, m); err != nil {
+	// a message that the version of the client does not support is
+	// dropped, the connection is not closed for it.
+	if !c.proto.Supports(m.Type()) {
+		addFn("UnsupportedProtocolMsgs", 1)
+		return
+	}
+
+	// an event with a TTL is not written if it expires before the write
+	// lock can be acquired, and the connection is not dropped for it.
+	timeout := c.srv.AcquireWriteLockTimeout
+	var expires bool
+	ev, _ := m.(*message.Evnt)
+	if ev != nil {
+		if left, ok := ev.TimeLeft(time.Now()); ok {
+			if left <= 0 {
+				evntExpired(c, ev, addFn)
+				return
+			}
+			if timeout <= 0 || left < timeout {
+				timeout, expires = left, true
+			}
+		}
+	}
+
+	if err := writeMsg(c, m, timeout); err != nil {
 		switch err {
 		case wswriter.ErrWriteLockTimeout:
+			if expires {
+				evntExpired(c, ev, addFn)
+				return
+			}
 			addFn("WriteLockTimeouts", 1)
 			c.Close(err)
 
@@ -145,13 +368,22 @@ func doWrite(c *Conn, m message.Msg, addFn func(string, int64)) {
 	}
 }
 
-func writeMsg(c *Conn, m message.Msg) error {
-	w := c.Writer(c.srv.AcquireWriteLockTimeout)
+// evntExpired records that the EVNT message m was not sent on c because
+// it expired.
+func evntExpired(c *Conn, m *message.Evnt, addFn func(string, int64)) {
+	addFn("ExpiredEvnts", 1)
+	if fn := c.srv.OnExpiredEvnt; fn != nil {
+		fn(c, m)
+	}
+}
+
+func writeMsg(c *Conn, m message.Msg, timeout time.Duration) error {
+	w := c.Writer(timeout)
 	defer w.Close()
 
 	lw := io.Writer(w)
 	if l := c.srv.WriteLimit; l > 0 {
 		lw = wswriter.Limit(w, l)
 	}
-	return json.NewEncoder(lw).Encode(m)
+	return c.proto.Encode(lw, m)
 }
@@ -0,0 +1,74 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// MaxHistoryEvents is the maximum number of events returned by a channel
+// history query (see Server.History). Queries without a limit or with a
+// greater limit return at most that number of events.
+var MaxHistoryEvents = 1000
+
+// historyBroker returns the broker to use to answer the channel history
+// queries, or nil if the queries are not answered by the server.
+func (srv *Server) historyBroker() broker.HistoryBroker {
+	if !srv.History {
+		return nil
+	}
+	hb, _ := srv.PubSubBroker.(broker.HistoryBroker)
+	return hb
+}
+
+// fetchHistory answers the channel history CALL with the ACK and the
+// RES holding the retained events.
+func fetchHistory(c *Conn, m *message.Call, hb broker.HistoryBroker, addFn func(string, int64)) {
+	var q message.HistoryQuery
+	if err := json.Unmarshal(m.Payload.Args, &q); err != nil {
+		c.Send(message.NewNack(m, message.CodeBadRequest, err))
+		return
+	}
+	if q.Channel == "" {
+		c.Send(message.NewNack(m, message.CodeBadRequest, errors.New("missing channel")))
+		return
+	}
+	if q.Limit <= 0 || q.Limit > MaxHistoryEvents {
+		q.Limit = MaxHistoryEvents
+	}
+
+	evs, err := hb.History(c.tenantName(q.Channel), q.From, q.To, q.Limit)
+	if err != nil {
+		addFn("FailedHistoryFetches", 1)
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return
+	}
+	if c.Tenant != "" {
+		tevs := evs[:0]
+		for _, ev := range evs {
+			if ev = c.tenantEvnt(ev); ev != nil {
+				tevs = append(tevs, ev)
+			}
+		}
+		evs = tevs
+	}
+	if evs == nil {
+		evs = []*message.EvntPayload{}
+	}
+	b, err := json.Marshal(evs)
+	if err != nil {
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return
+	}
+
+	addFn("HistoryFetches", 1)
+	sendAck(c, m)
+	c.Send(message.NewRes(&message.ResPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      m.Payload.URI,
+		Args:     b,
+	}))
+}
@@ -0,0 +1,86 @@
+package juggler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeHistoryBroker struct {
+	broker.PubSubBroker
+	limit int
+}
+
+func (f *fakeHistoryBroker) History(channel string, from, to time.Time, limit int) ([]*message.EvntPayload, error) {
+	f.limit = limit
+	if channel != "a" {
+		return nil, nil
+	}
+	return []*message.EvntPayload{{Channel: channel, Args: json.RawMessage(`1`)}}, nil
+}
+
+func TestHistory(t *testing.T) {
+	hb := &fakeHistoryBroker{}
+	server := &juggler.Server{CallerBroker: fakeCallerBroker{}, PubSubBroker: hb, History: true}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	cases := []struct {
+		q     message.HistoryQuery
+		code  int
+		res   string
+		limit int
+	}{
+		{message.HistoryQuery{Channel: "a"}, 0, `[{"msg_uuid":"","channel":"a","args":1,"timestamp":"0001-01-01T00:00:00Z"}]`, juggler.MaxHistoryEvents},
+		{message.HistoryQuery{Channel: "b", Limit: 10}, 0, `[]`, 10},
+		{message.HistoryQuery{}, message.CodeBadRequest, "", 0},
+	}
+	for i, c := range cases {
+		hb.limit = 0
+		_, err := cli.Call(message.HistoryURI, c.q, time.Second)
+		require.NoError(t, err, "%d: Call", i)
+
+		if c.code != 0 {
+			m := <-msgs
+			if assert.IsType(t, &message.Nack{}, m, "%d: NACK", i) {
+				assert.Equal(t, c.code, m.(*message.Nack).Payload.Code, "%d: NACK code", i)
+			}
+			continue
+		}
+
+		// the ACK and RES may be received in any order
+		var res *message.Res
+		for j := 0; j < 2; j++ {
+			if m, ok := (<-msgs).(*message.Res); ok {
+				res = m
+			}
+		}
+		if assert.NotNil(t, res, "%d: RES", i) {
+			assert.JSONEq(t, c.res, string(res.Payload.Args), "%d: events", i)
+		}
+		assert.Equal(t, c.limit, hb.limit, "%d: limit", i)
+	}
+}
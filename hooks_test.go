@@ -0,0 +1,138 @@
+package juggler_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakePubSubBroker struct {
+	broker.PubSubBroker
+}
+
+func (f fakePubSubBroker) NewPubSubConn() (broker.PubSubConn, error) {
+	return &fakePubSubConn{ch: make(chan *message.EvntPayload)}, nil
+}
+
+type fakePubSubConn struct {
+	once sync.Once
+	ch   chan *message.EvntPayload
+}
+
+func (f *fakePubSubConn) Subscribe(channel string, pattern bool) error   { return nil }
+func (f *fakePubSubConn) Unsubscribe(channel string, pattern bool) error { return nil }
+func (f *fakePubSubConn) Events() <-chan *message.EvntPayload            { return f.ch }
+func (f *fakePubSubConn) EventsErr() error                               { return nil }
+func (f *fakePubSubConn) Close() error {
+	f.once.Do(func() { close(f.ch) })
+	return nil
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(f string, args ...interface{}) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf(f, args...))
+		mu.Unlock()
+	}
+
+	errTooMany := errors.New("too many connections")
+	disconnected := make(chan struct{}, 2)
+	server := &juggler.Server{
+		PubSubBroker: fakePubSubBroker{},
+		ConnState: func(c *juggler.Conn, cs juggler.ConnState) {
+			if cs == juggler.Accepting {
+				c.Identity = "u1"
+			}
+		},
+		OnConnect: func(c *juggler.Conn) error {
+			mu.Lock()
+			n := len(events)
+			mu.Unlock()
+			if n > 0 {
+				return errTooMany
+			}
+			record("connect %s", c.Identity)
+			return nil
+		},
+		OnDisconnect: func(c *juggler.Conn, reason error) {
+			record("disconnect %s", c.Identity)
+			disconnected <- struct{}{}
+		},
+		OnSubscribe: func(c *juggler.Conn, channel string, pattern bool) {
+			record("sub %s %s %t", c.Identity, channel, pattern)
+		},
+		OnUnsubscribe: func(c *juggler.Conn, channel string, pattern bool) {
+			record("unsb %s %s %t", c.Identity, channel, pattern)
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	acks := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		acks <- m
+	})
+	hdr := http.Header{"Juggler-Allowed-Messages": {"sub, unsb"}}
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, hdr, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+
+	_, err = cli.Sub("a", false)
+	require.NoError(t, err, "Sub")
+	waitMsg(t, acks, message.AckMsg, "Sub")
+	_, err = cli.Unsb("b.*", true)
+	require.NoError(t, err, "Unsb")
+	waitMsg(t, acks, message.AckMsg, "Unsb")
+
+	// a second connection is refused by OnConnect
+	cli2, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, hdr, client.SetHandler(h))
+	require.NoError(t, err, "Dial 2")
+	select {
+	case <-cli2.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "refused connection not closed")
+	}
+	cli2.Close()
+
+	cli.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		assert.Fail(t, "no disconnect")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"connect u1",
+		"sub u1 a false",
+		"unsb u1 b.* true",
+		"disconnect u1",
+	}, events, "hooks")
+}
+
+func waitMsg(t *testing.T, ch <-chan message.Msg, typ message.Type, name string) {
+	select {
+	case m := <-ch:
+		assert.Equal(t, typ, m.Type(), "%s: type", name)
+	case <-time.After(time.Second):
+		assert.Fail(t, "no response", name)
+	}
+}
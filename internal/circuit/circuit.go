@@ -0,0 +1,174 @@
+// Package circuit implements the circuit breakers of the calls to a URI,
+// used by the client and by the juggler-server command to fail fast
+// the calls to a URI whose callees keep failing, instead of piling up
+// calls that time out.
+//
+// The circuit of a URI is closed (the calls are allowed) until
+// Threshold consecutive calls fail, at which point it opens and the
+// calls are rejected for the Cooldown period. It is then half-open:
+// a single trial call is allowed, that closes the circuit if it
+// succeeds, or opens it again if it fails. If the trial call does not
+// complete, another one is allowed after each Cooldown period.
+package circuit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// State is the state of a circuit.
+type State int
+
+// The states of a circuit.
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// IsFailure returns true if a NACK with that code means the call failed
+// because the callees of its URI are unhealthy: no callee is available,
+// the call timed out, or it failed on the server. Invalid and rejected
+// requests do not count as failures, nor do the calls rejected with
+// message.CodeUnavailable, which is the code of the calls rejected by
+// an open circuit.
+func IsFailure(code int) bool {
+	switch {
+	case code == message.CodeNoCallee, code == message.CodeTimeout:
+		return true
+	case code == message.CodeUnavailable:
+		return false
+	}
+	return code >= 500 && code < 600
+}
+
+// Breaker is a set of circuits, one per URI. The zero value is not
+// usable, Threshold must be > 0.
+type Breaker struct {
+	// Threshold is the number of consecutive failures that open the
+	// circuit.
+	Threshold int
+
+	// Cooldown is the duration for which the calls are rejected once
+	// the circuit is open.
+	Cooldown time.Duration
+
+	// OnStateChange, if set, is called when the state of the circuit
+	// of a URI changes. It is called without holding the lock of the
+	// Breaker.
+	OnStateChange func(uri string, from, to State)
+
+	mu       sync.Mutex
+	circuits map[string]*circuitState
+}
+
+type circuitState struct {
+	state    State
+	failures int
+	since    time.Time // time of the opening, or of the last trial call
+}
+
+// Allow returns true if a call to uri is allowed.
+func (b *Breaker) Allow(uri string) bool {
+	b.mu.Lock()
+	cs := b.circuits[uri]
+	if cs == nil || cs.state == Closed {
+		b.mu.Unlock()
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(cs.since) < b.Cooldown {
+		b.mu.Unlock()
+		return false
+	}
+	from := cs.state
+	cs.state = HalfOpen
+	cs.since = now
+	b.mu.Unlock()
+
+	if from != HalfOpen {
+		b.changed(uri, from, HalfOpen)
+	}
+	return true
+}
+
+// Success records a successful call to uri.
+func (b *Breaker) Success(uri string) {
+	b.mu.Lock()
+	cs := b.circuits[uri]
+	if cs == nil {
+		b.mu.Unlock()
+		return
+	}
+	from := cs.state
+	delete(b.circuits, uri)
+	b.mu.Unlock()
+
+	if from != Closed {
+		b.changed(uri, from, Closed)
+	}
+}
+
+// Failure records a failed call to uri.
+func (b *Breaker) Failure(uri string) {
+	b.mu.Lock()
+	if b.circuits == nil {
+		b.circuits = make(map[string]*circuitState)
+	}
+	cs := b.circuits[uri]
+	if cs == nil {
+		cs = &circuitState{}
+		b.circuits[uri] = cs
+	}
+
+	from := cs.state
+	switch from {
+	case Closed:
+		cs.failures++
+		if cs.failures < b.Threshold {
+			b.mu.Unlock()
+			return
+		}
+	case Open:
+		// a call allowed before the opening
+		b.mu.Unlock()
+		return
+	}
+	cs.state = Open
+	cs.since = time.Now()
+	b.mu.Unlock()
+
+	b.changed(uri, from, Open)
+}
+
+// State returns the state of the circuit of uri.
+func (b *Breaker) State(uri string) State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cs := b.circuits[uri]; cs != nil {
+		return cs.state
+	}
+	return Closed
+}
+
+func (b *Breaker) changed(uri string, from, to State) {
+	if b.OnStateChange != nil {
+		b.OnStateChange(uri, from, to)
+	}
+}
@@ -0,0 +1,84 @@
+package circuit
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsFailure(t *testing.T) {
+	cases := map[int]bool{
+		message.CodeBadRequest:      false,
+		message.CodeForbidden:       false,
+		message.CodeNoCallee:        true,
+		message.CodeTimeout:         true,
+		message.CodeRateLimited:     false,
+		message.CodeHandlerError:    true,
+		message.CodeUnavailable:     false,
+		504:                         true,
+		600:                         false,
+		message.CodePayloadTooLarge: false,
+	}
+	for code, want := range cases {
+		assert.Equal(t, want, IsFailure(code), "%d", code)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var mu sync.Mutex
+	var changes []string
+	b := &Breaker{
+		Threshold: 2,
+		Cooldown:  20 * time.Millisecond,
+		OnStateChange: func(uri string, from, to State) {
+			mu.Lock()
+			changes = append(changes, uri+":"+from.String()+">"+to.String())
+			mu.Unlock()
+		},
+	}
+
+	// a success resets the consecutive failures
+	assert.True(t, b.Allow("a"), "closed")
+	b.Failure("a")
+	b.Success("a")
+	b.Failure("a")
+	assert.Equal(t, Closed, b.State("a"), "not consecutive failures")
+
+	// open on the second consecutive failure
+	b.Failure("a")
+	assert.Equal(t, Open, b.State("a"), "open")
+	assert.False(t, b.Allow("a"), "open rejects")
+	assert.True(t, b.Allow("b"), "other URI")
+	b.Failure("a")
+	assert.Equal(t, Open, b.State("a"), "still open")
+
+	// half-open after the cooldown, a single trial call
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, b.Allow("a"), "trial call")
+	assert.Equal(t, HalfOpen, b.State("a"), "half-open")
+	assert.False(t, b.Allow("a"), "single trial call")
+
+	// a failed trial call opens, a successful one closes
+	b.Failure("a")
+	assert.Equal(t, Open, b.State("a"), "open after failed trial")
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, b.Allow("a"), "second trial call")
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, b.Allow("a"), "trial call after incomplete trial")
+	b.Success("a")
+	assert.Equal(t, Closed, b.State("a"), "closed after successful trial")
+	assert.True(t, b.Allow("a"), "closed allows")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"a:closed>open",
+		"a:open>half-open",
+		"a:half-open>open",
+		"a:open>half-open",
+		"a:half-open>closed",
+	}, changes, "state changes")
+}
@@ -0,0 +1,264 @@
+// Package completion generates shell completion scripts for the juggler
+// commands. The scripts complete the flags of the command, as registered
+// on its flag.FlagSet, the subcommands of the command, if any, and the
+// completion subcommand itself.
+package completion
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Command is the name of the subcommand that generates the completion
+// scripts.
+const Command = "completion"
+
+// Shells is the list of supported shells.
+var Shells = []string{"bash", "fish", "zsh"}
+
+// Run handles the completion subcommand if args (typically flag.Args())
+// is "completion SHELL". It writes the completion script of the command
+// identified by name, for the flags defined in fs and the subcommands
+// in cmds, to w. It returns false if args is not a completion subcommand,
+// in which case nothing is written.
+func Run(w io.Writer, name string, fs *flag.FlagSet, args []string, cmds ...string) (bool, error) {
+	if len(args) == 0 || args[0] != Command {
+		return false, nil
+	}
+	if len(args) != 2 {
+		return true, fmt.Errorf("usage: %s %s %s", name, Command, strings.Join(Shells, "|"))
+	}
+	return true, Write(w, args[1], name, fs, cmds...)
+}
+
+// Write writes the completion script for shell of the command identified
+// by name, for the flags defined in fs and the subcommands in cmds, to w.
+// Each subcommand is made of one or two space-separated words, e.g.
+// "config dump".
+func Write(w io.Writer, shell, name string, fs *flag.FlagSet, cmds ...string) error {
+	flags := collectFlags(fs)
+	subs := collectCommands(cmds)
+
+	var err error
+	switch shell {
+	case "bash":
+		err = writeBash(w, name, flags, subs)
+	case "fish":
+		err = writeFish(w, name, flags, subs)
+	case "zsh":
+		err = writeZsh(w, name, flags, subs)
+	default:
+		err = fmt.Errorf("unsupported shell %q, must be one of %s", shell, strings.Join(Shells, ", "))
+	}
+	return err
+}
+
+type flagInfo struct {
+	name   string
+	arg    string // empty for boolean flags
+	usage  string
+	isFile bool
+}
+
+type boolFlag interface {
+	IsBoolFlag() bool
+}
+
+func collectFlags(fs *flag.FlagSet) []flagInfo {
+	var flags []flagInfo
+	fs.VisitAll(func(f *flag.Flag) {
+		arg, usage := flag.UnquoteUsage(f)
+		if bf, ok := f.Value.(boolFlag); ok && bf.IsBoolFlag() {
+			arg = ""
+		}
+		flags = append(flags, flagInfo{
+			name:   f.Name,
+			arg:    arg,
+			usage:  usage,
+			isFile: arg == "file",
+		})
+	})
+	sort.Sort(byName(flags))
+	return flags
+}
+
+// subcommand is a first-level command word and the words that may
+// follow it.
+type subcommand struct {
+	name string
+	args []string
+}
+
+func collectCommands(cmds []string) []subcommand {
+	byWord := map[string][]string{Command: append([]string(nil), Shells...)}
+	for _, c := range cmds {
+		words := strings.Fields(c)
+		if len(words) == 0 {
+			continue
+		}
+		args := byWord[words[0]]
+		if len(words) > 1 {
+			args = append(args, words[1])
+		}
+		byWord[words[0]] = args
+	}
+
+	subs := make([]subcommand, 0, len(byWord))
+	for k, v := range byWord {
+		sort.Strings(v)
+		subs = append(subs, subcommand{name: k, args: v})
+	}
+	sort.Sort(subsByName(subs))
+	return subs
+}
+
+type subsByName []subcommand
+
+func (b subsByName) Len() int           { return len(b) }
+func (b subsByName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b subsByName) Less(i, j int) bool { return b[i].name < b[j].name }
+
+func subNames(subs []subcommand) string {
+	names := make([]string, len(subs))
+	for i, sub := range subs {
+		names[i] = sub.name
+	}
+	return strings.Join(names, " ")
+}
+
+type byName []flagInfo
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].name < b[j].name }
+
+func funcName(name string) string {
+	return "_" + strings.Replace(name, "-", "_", -1)
+}
+
+func writeBash(w io.Writer, name string, flags []flagInfo, subs []subcommand) error {
+	var all, withArg, files []string
+	for _, f := range flags {
+		all = append(all, "-"+f.name)
+		switch {
+		case f.isFile:
+			files = append(files, "-"+f.name)
+		case f.arg != "":
+			withArg = append(withArg, "-"+f.name)
+		}
+	}
+
+	fn := funcName(name)
+	if _, err := fmt.Fprintf(w, `# bash completion for %[1]s
+%[2]s() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	local prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+	case "$prev" in
+`, name, fn); err != nil {
+		return err
+	}
+
+	// subcommands complete their arguments, flags that expect a file get
+	// file completion, other flags that expect a value get no completion.
+	for _, sub := range subs {
+		if len(sub.args) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "\t%s)\n\t\tCOMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n\t\treturn\n\t\t;;\n", sub.name, strings.Join(sub.args, " ")); err != nil {
+			return err
+		}
+	}
+	if len(files) > 0 {
+		if _, err := fmt.Fprintf(w, "\t%s)\n\t\tCOMPREPLY=( $(compgen -f -- \"$cur\") )\n\t\treturn\n\t\t;;\n", strings.Join(files, "|")); err != nil {
+			return err
+		}
+	}
+	if len(withArg) > 0 {
+		if _, err := fmt.Fprintf(w, "\t%s)\n\t\treturn\n\t\t;;\n", strings.Join(withArg, "|")); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `	esac
+
+	COMPREPLY=( $(compgen -W "%[3]s %[4]s" -- "$cur") )
+}
+complete -F %[2]s %[1]s
+`, name, fn, strings.Join(all, " "), subNames(subs))
+	return err
+}
+
+func writeFish(w io.Writer, name string, flags []flagInfo, subs []subcommand) error {
+	if _, err := fmt.Fprintf(w, "# fish completion for %s\n", name); err != nil {
+		return err
+	}
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c %s -o %s -d '%s'", name, f.name, fishEscape(f.usage))
+		if f.isFile {
+			line += " -r -F"
+		} else if f.arg != "" {
+			line += " -r -f"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	for _, sub := range subs {
+		if _, err := fmt.Fprintf(w, "complete -c %s -n '__fish_use_subcommand' -f -a %s\n", name, sub.name); err != nil {
+			return err
+		}
+		if len(sub.args) > 0 {
+			if _, err := fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from %s' -f -a '%s'\n", name, sub.name, strings.Join(sub.args, " ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fishEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, "'", `\'`, -1)
+}
+
+func writeZsh(w io.Writer, name string, flags []flagInfo, subs []subcommand) error {
+	if _, err := fmt.Fprintf(w, "#compdef %s\n# zsh completion for %[1]s\n\n_arguments -C \\\n", name); err != nil {
+		return err
+	}
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.name, zshEscape(f.usage))
+		switch {
+		case f.isFile:
+			spec += ":" + f.arg + ":_files"
+		case f.arg != "":
+			spec += ":" + f.arg + ":"
+		}
+		if _, err := fmt.Fprintf(w, "\t'%s' \\\n", spec); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "\t'1:command:(%s)' \\\n\t'2:argument:->args'\n\ncase $state in\nargs)\n\tcase $line[1] in\n", subNames(subs)); err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if len(sub.args) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "\t%s)\n\t\tcompadd %s\n\t\t;;\n", sub.name, strings.Join(sub.args, " ")); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprint(w, "\tesac\n\t;;\nesac\n")
+	return err
+}
+
+func zshEscape(s string) string {
+	s = strings.Replace(s, "'", `'\''`, -1)
+	s = strings.Replace(s, "[", `\[`, -1)
+	s = strings.Replace(s, "]", `\]`, -1)
+	return strings.Replace(s, ":", `\:`, -1)
+}
@@ -0,0 +1,79 @@
+package completion
+
+import (
+	"bytes"
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("help", false, "Show help.")
+	fs.Int("port", 9000, "Server `port`.")
+	fs.String("config", "", "Path of the configuration `file`.")
+	return fs
+}
+
+func TestRun(t *testing.T) {
+	fs := testFlagSet()
+
+	var buf bytes.Buffer
+	ok, err := Run(&buf, "juggler-test", fs, nil)
+	assert.False(t, ok, "no args")
+	assert.NoError(t, err, "no args")
+	ok, err = Run(&buf, "juggler-test", fs, []string{"other"})
+	assert.False(t, ok, "other command")
+	assert.NoError(t, err, "other command")
+	assert.Equal(t, 0, buf.Len(), "nothing written")
+
+	ok, err = Run(&buf, "juggler-test", fs, []string{Command})
+	assert.True(t, ok, "missing shell")
+	assert.Error(t, err, "missing shell")
+
+	ok, err = Run(&buf, "juggler-test", fs, []string{Command, "csh"})
+	assert.True(t, ok, "invalid shell")
+	assert.Error(t, err, "invalid shell")
+}
+
+func TestWrite(t *testing.T) {
+	fs := testFlagSet()
+
+	cases := []struct {
+		shell string
+		want  []string
+	}{
+		{"bash", []string{"complete -F _juggler_test juggler-test", "-config -help -port", "-config)", "-port)"}},
+		{"fish", []string{"complete -c juggler-test -o config -d 'Path of the configuration file.' -r -F", "complete -c juggler-test -o help -d 'Show help.'\n", "-o port -d 'Server port.' -r -f"}},
+		{"zsh", []string{"#compdef juggler-test", "'-config[Path of the configuration file.]:file:_files'", "'-help[Show help.]'", "'-port[Server port.]:port:'"}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		require.NoError(t, Write(&buf, c.shell, "juggler-test", fs), c.shell)
+		for _, want := range c.want {
+			assert.Contains(t, buf.String(), want, c.shell)
+		}
+	}
+}
+
+func TestWriteCommands(t *testing.T) {
+	fs := testFlagSet()
+
+	cases := []struct {
+		shell string
+		want  []string
+	}{
+		{"bash", []string{"\tconfig)\n\t\tCOMPREPLY=( $(compgen -W \"dump show\" -- \"$cur\") )", "-port completion config version\""}},
+		{"fish", []string{"-n '__fish_use_subcommand' -f -a config\n", "-n '__fish_seen_subcommand_from config' -f -a 'dump show'", "-n '__fish_use_subcommand' -f -a version\n"}},
+		{"zsh", []string{"'1:command:(completion config version)'", "\tconfig)\n\t\tcompadd dump show\n"}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		require.NoError(t, Write(&buf, c.shell, "juggler-test", fs, "config show", "config dump", "version"), c.shell)
+		for _, want := range c.want {
+			assert.Contains(t, buf.String(), want, c.shell)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Package mergepatch implements JSON merge patches as defined in
+// RFC 7396. It is used to send the changes of the state channels
+// instead of the full state.
+//
+// A merge patch cannot set a member to null, as a null value removes
+// the member, so states should not rely on null members.
+package mergepatch
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Create returns the merge patch that turns the JSON document orig
+// into the JSON document mod.
+func Create(orig, mod []byte) ([]byte, error) {
+	var o, m interface{}
+	if err := json.Unmarshal(orig, &o); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(mod, &m); err != nil {
+		return nil, err
+	}
+	return json.Marshal(diff(o, m))
+}
+
+func diff(orig, mod interface{}) interface{} {
+	om, ok1 := orig.(map[string]interface{})
+	mm, ok2 := mod.(map[string]interface{})
+	if !ok1 || !ok2 {
+		return mod
+	}
+
+	patch := make(map[string]interface{})
+	for k := range om {
+		if _, ok := mm[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, mv := range mm {
+		ov, ok := om[k]
+		if ok && reflect.DeepEqual(ov, mv) {
+			continue
+		}
+		if ok {
+			patch[k] = diff(ov, mv)
+		} else {
+			patch[k] = mv
+		}
+	}
+	return patch
+}
+
+// Apply applies the merge patch to the JSON document doc and returns
+// the resulting document.
+func Apply(doc, patch []byte) ([]byte, error) {
+	var d, p interface{}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(merge(d, p))
+}
+
+func merge(doc, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	dm, ok := doc.(map[string]interface{})
+	if !ok {
+		dm = make(map[string]interface{})
+	}
+
+	for k, pv := range pm {
+		if pv == nil {
+			delete(dm, k)
+			continue
+		}
+		dm[k] = merge(dm[k], pv)
+	}
+	return dm
+}
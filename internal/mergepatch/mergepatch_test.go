@@ -0,0 +1,66 @@
+package mergepatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	// examples from RFC 7396, appendix A
+	cases := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for i, c := range cases {
+		got, err := Apply([]byte(c.doc), []byte(c.patch))
+		if assert.NoError(t, err, "%d: Apply", i) {
+			assert.JSONEq(t, c.want, string(got), "%d: result", i)
+		}
+	}
+
+	_, err := Apply([]byte(`{`), []byte(`{}`))
+	assert.Error(t, err, "invalid document")
+}
+
+func TestCreate(t *testing.T) {
+	cases := []struct {
+		orig, mod, want string
+	}{
+		{`{"a":1}`, `{"a":1}`, `{}`},
+		{`{"a":1}`, `{"a":2}`, `{"a":2}`},
+		{`{"a":1,"b":2}`, `{"b":2}`, `{"a":null}`},
+		{`{"a":{"b":1,"c":2}}`, `{"a":{"b":1,"c":3,"d":4}}`, `{"a":{"c":3,"d":4}}`},
+		{`{"a":[1,2]}`, `{"a":[1,3]}`, `{"a":[1,3]}`},
+		{`{"a":1}`, `[1]`, `[1]`},
+		{`"a"`, `{"a":1}`, `{"a":1}`},
+	}
+	for i, c := range cases {
+		patch, err := Create([]byte(c.orig), []byte(c.mod))
+		require.NoError(t, err, "%d: Create", i)
+		assert.JSONEq(t, c.want, string(patch), "%d: patch", i)
+
+		got, err := Apply([]byte(c.orig), patch)
+		require.NoError(t, err, "%d: Apply", i)
+		assert.JSONEq(t, c.mod, string(got), "%d: patched document", i)
+	}
+
+	_, err := Create([]byte(`{}`), []byte(`x`))
+	assert.Error(t, err, "invalid document")
+}
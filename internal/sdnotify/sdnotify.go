@@ -0,0 +1,117 @@
+// Package sdnotify implements the systemd notification protocol, so
+// that the juggler commands can run as Type=notify services. It signals
+// readiness to systemd and sends the watchdog keep-alive pings, as long
+// as the health check of the command succeeds.
+//
+// See sd_notify(3) and systemd.service(5) for details.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The states supported by Notify.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends the state to the systemd notification socket. It returns
+// false if the process is not running under systemd with a notification
+// socket, in which case nothing is sent.
+func Notify(state string) (bool, error) {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return false, nil
+	}
+	// abstract socket
+	if sock[0] == '@' {
+		sock = "\x00" + sock[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return true, err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return true, err
+}
+
+// WatchdogInterval returns the watchdog timeout configured for the
+// process by systemd. It returns 0 if the watchdog is not enabled for
+// the process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		if pid != strconv.Itoa(os.Getpid()) {
+			return 0, nil
+		}
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// RunWatchdog sends a watchdog ping to systemd at half the interval, as
+// required by the protocol, until stop is closed. Before each ping, check
+// is called, and the ping is skipped if it returns an error, so that
+// systemd restarts the process if it stays unhealthy for the whole
+// interval. Errors are logged using logFn.
+func RunWatchdog(interval time.Duration, check func() error, stop <-chan struct{}, logFn func(string, ...interface{})) {
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		if check != nil {
+			if err := check(); err != nil {
+				logFn("watchdog: health check failed, skipping ping: %v", err)
+				continue
+			}
+		}
+		if _, err := Notify(Watchdog); err != nil {
+			logFn("watchdog: notify failed: %v", err)
+		}
+	}
+}
+
+// ReadyAndWatch signals readiness to systemd and, if the watchdog is
+// enabled for the process, starts a goroutine that runs RunWatchdog
+// with check until the process exits. It does nothing if the process
+// is not running under systemd. Errors are logged using logFn.
+func ReadyAndWatch(check func() error, logFn func(string, ...interface{})) {
+	ok, err := Notify(Ready)
+	if !ok {
+		return
+	}
+	if err != nil {
+		logFn("systemd: notify ready failed: %v", err)
+	}
+
+	interval, err := WatchdogInterval()
+	if err != nil {
+		logFn("systemd: invalid watchdog interval: %v", err)
+		return
+	}
+	if interval > 0 {
+		logFn("systemd: watchdog enabled with interval %s", interval)
+		go RunWatchdog(interval, check, nil, logFn)
+	}
+}
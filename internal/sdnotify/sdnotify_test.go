@@ -0,0 +1,106 @@
+package sdnotify
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listenNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	require.NoError(t, err, "TempDir")
+
+	sock := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	require.NoError(t, err, "ListenUnixgram")
+
+	os.Setenv("NOTIFY_SOCKET", sock)
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readState(t *testing.T, conn *net.UnixConn) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 128)
+	n, err := conn.Read(b)
+	require.NoError(t, err, "Read")
+	return string(b[:n])
+}
+
+func TestNotify(t *testing.T) {
+	ok, err := Notify(Ready)
+	assert.False(t, ok, "no socket")
+	assert.NoError(t, err, "no socket")
+
+	conn, cleanup := listenNotifySocket(t)
+	defer cleanup()
+
+	ok, err = Notify(Ready)
+	assert.True(t, ok, "with socket")
+	assert.NoError(t, err, "with socket")
+	assert.Equal(t, Ready, readState(t, conn), "received state")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	cases := []struct {
+		usec, pid string
+		want      time.Duration
+		err       bool
+	}{
+		{"", "", 0, false},
+		{"1000000", "", time.Second, false},
+		{"1000000", strconv.Itoa(os.Getpid()), time.Second, false},
+		{"1000000", "1", 0, false},
+		{"x", "", 0, true},
+	}
+	for i, c := range cases {
+		os.Setenv("WATCHDOG_USEC", c.usec)
+		os.Setenv("WATCHDOG_PID", c.pid)
+		got, err := WatchdogInterval()
+		assert.Equal(t, c.err, err != nil, "%d: error", i)
+		assert.Equal(t, c.want, got, "%d: interval", i)
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	conn, cleanup := listenNotifySocket(t)
+	defer cleanup()
+
+	var fail int32
+	check := func() error {
+		if atomic.LoadInt32(&fail) == 1 {
+			return errors.New("unhealthy")
+		}
+		return nil
+	}
+	stop := make(chan struct{})
+	go RunWatchdog(20*time.Millisecond, check, stop, func(string, ...interface{}) {})
+
+	assert.Equal(t, Watchdog, readState(t, conn), "received ping")
+
+	// a ping may have been sent before the check failed, drain it
+	atomic.StoreInt32(&fail, 1)
+	time.Sleep(20 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	conn.Read(make([]byte, 128))
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 128))
+	assert.Error(t, err, "no ping while unhealthy")
+	close(stop)
+}
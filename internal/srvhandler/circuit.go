@@ -0,0 +1,181 @@
+package srvhandler
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/internal/circuit"
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// DefaultCircuitCooldown is the default duration for which the calls to
+// a URI are rejected once its circuit is open.
+const DefaultCircuitCooldown = 30 * time.Second
+
+// ErrCircuitOpen is the error of the NACK returned for the calls
+// rejected because the circuit of their URI is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitBreaker implements a circuit breaker per URI (see the circuit
+// package): after Threshold consecutive failed calls to a URI, the
+// calls to that URI are rejected with a NACK with
+// message.CodeUnavailable for the Cooldown period, after which a single
+// trial call is allowed to check if the URI recovered. The calls that
+// are not answered before their timeout expires and the NACKs that
+// report unhealthy callees (see circuit.IsFailure) are failures, the
+// results are successes.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failed calls to a URI that
+	// opens its circuit. The circuit breaker is disabled if it is <= 0.
+	Threshold int
+
+	// Cooldown is the duration for which the calls are rejected once
+	// the circuit of a URI is open. If 0, DefaultCircuitCooldown is
+	// used.
+	Cooldown time.Duration
+
+	// OnStateChange, if set, is called when the state of the circuit of
+	// a URI changes.
+	OnStateChange func(uri string, from, to circuit.State)
+
+	// Vars can be set to track the number of CircuitOpenCalls rejected
+	// because their circuit is open, and the number of times a circuit
+	// was opened, in CircuitsOpened.
+	Vars *expvar.Map
+
+	once    sync.Once
+	breaker *circuit.Breaker
+
+	mu      sync.Mutex
+	pending map[string]*circuitCall // by call UUID
+}
+
+type circuitCall struct {
+	uri   string
+	timer *time.Timer
+}
+
+func (cb *CircuitBreaker) init() {
+	cb.once.Do(func() {
+		cooldown := cb.Cooldown
+		if cooldown == 0 {
+			cooldown = DefaultCircuitCooldown
+		}
+		cb.breaker = &circuit.Breaker{
+			Threshold: cb.Threshold,
+			Cooldown:  cooldown,
+			OnStateChange: func(uri string, from, to circuit.State) {
+				if to == circuit.Open {
+					cb.add("CircuitsOpened")
+				}
+				if cb.OnStateChange != nil {
+					cb.OnStateChange(uri, from, to)
+				}
+			},
+		}
+		cb.pending = make(map[string]*circuitCall)
+	})
+}
+
+// State returns the state of the circuit of uri.
+func (cb *CircuitBreaker) State(uri string) circuit.State {
+	cb.init()
+	return cb.breaker.State(uri)
+}
+
+// Handler returns a juggler.Handler that rejects the CALL requests to
+// the URIs whose circuit is open, and records the outcome of the calls
+// before calling h.
+func (cb *CircuitBreaker) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		if cb.Threshold > 0 {
+			cb.init()
+			switch msg := msg.(type) {
+			case *message.Call:
+				if !cb.breaker.Allow(msg.Payload.URI) {
+					cb.add("CircuitOpenCalls")
+					c.Send(message.NewNack(msg, message.CodeUnavailable, ErrCircuitOpen))
+					return
+				}
+				cb.track(c, msg)
+
+			case *message.Nack:
+				if msg.Payload.ForType == message.CallMsg {
+					cb.untrack(msg.Payload.For.String())
+					if circuit.IsFailure(msg.Payload.Code) {
+						cb.breaker.Failure(msg.Payload.URI)
+					}
+				}
+
+			case *message.Res:
+				if cb.untrack(msg.Payload.For.String()) {
+					cb.breaker.Success(msg.Payload.URI)
+				}
+			}
+		}
+		h.Handle(ctx, c, msg)
+	})
+}
+
+// track records the call as pending until its result is received. If
+// it is still pending once all its attempts have timed out, it fails,
+// unless its connection was closed in the meantime.
+func (cb *CircuitBreaker) track(c *juggler.Conn, m *message.Call) {
+	key := m.UUID().String()
+	uri := m.Payload.URI
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.pending[key] = &circuitCall{
+		uri: uri,
+		timer: time.AfterFunc(callExpiration(m), func() {
+			if !cb.untrack(key) {
+				return
+			}
+			select {
+			case <-c.CloseNotify():
+			default:
+				cb.breaker.Failure(uri)
+			}
+		}),
+	}
+}
+
+// untrack removes the pending call and returns true if it was pending.
+func (cb *CircuitBreaker) untrack(key string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cc, ok := cb.pending[key]
+	if ok {
+		cc.timer.Stop()
+		delete(cb.pending, key)
+	}
+	return ok
+}
+
+func (cb *CircuitBreaker) add(key string) {
+	if cb.Vars != nil {
+		cb.Vars.Add(key, 1)
+	}
+}
+
+// callExpiration returns the time after which the result of the call
+// request m is not expected anymore, for all its attempts and backoff
+// delays.
+func callExpiration(m *message.Call) time.Duration {
+	timeout := m.Payload.Timeout
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	total, backoff := timeout, m.Payload.Backoff
+	for i := 1; i < m.Payload.MaxAttempts; i++ {
+		total += backoff + timeout
+		backoff *= 2
+	}
+	return total
+}
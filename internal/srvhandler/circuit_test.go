@@ -0,0 +1,110 @@
+package srvhandler
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/internal/circuit"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	var changes []string
+	healthy := map[string]bool{}
+	cb := &CircuitBreaker{
+		Threshold: 2,
+		Cooldown:  50 * time.Millisecond,
+		Vars:      new(expvar.Map).Init(),
+		OnStateChange: func(uri string, from, to circuit.State) {
+			mu.Lock()
+			changes = append(changes, uri+":"+to.String())
+			mu.Unlock()
+		},
+	}
+
+	server := &juggler.Server{
+		CallerBroker: fakeCallerBroker{},
+		Handler: cb.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+			call, ok := msg.(*message.Call)
+			if !ok {
+				juggler.ProcessMsg(c, msg)
+				return
+			}
+			mu.Lock()
+			ok = healthy[call.Payload.URI]
+			mu.Unlock()
+			switch {
+			case call.Payload.URI == "ko" && !ok:
+				c.Send(message.NewNack(msg, message.CodeHandlerError, errors.New("down")))
+			case call.Payload.URI == "forbidden":
+				c.Send(message.NewNack(msg, message.CodeForbidden, errors.New("forbidden")))
+			default:
+				c.Send(message.NewAck(msg))
+				if ok {
+					c.Send(message.NewRes(&message.ResPayload{MsgUUID: call.UUID(), URI: call.Payload.URI, Args: []byte("1")}))
+				}
+			}
+		})),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}})
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	ctx := context.Background()
+	invoke := func(uri string, timeout time.Duration) error {
+		return cli.Invoke(ctx, uri, nil, nil, timeout)
+	}
+
+	// NACKs that report unhealthy callees open the circuit
+	assert.True(t, client.IsHandlerError(invoke("ko", time.Second)), "first failure")
+	assert.True(t, client.IsHandlerError(invoke("ko", time.Second)), "second failure")
+	assert.Equal(t, circuit.Open, cb.State("ko"), "open")
+	err = invoke("ko", time.Second)
+	if assert.True(t, client.IsCode(err, message.CodeUnavailable), "fail fast") {
+		assert.Equal(t, ErrCircuitOpen.Error(), err.(*client.Error).Message, "NACK message")
+	}
+
+	// other NACKs are not failures
+	assert.Error(t, invoke("forbidden", time.Second), "forbidden")
+	assert.Error(t, invoke("forbidden", time.Second), "forbidden")
+	assert.Equal(t, circuit.Closed, cb.State("forbidden"), "closed after other NACKs")
+
+	// calls without result before their timeout are failures
+	assert.Equal(t, client.ErrCallExpired, invoke("slow", 10*time.Millisecond), "first timeout")
+	assert.Equal(t, client.ErrCallExpired, invoke("slow", 10*time.Millisecond), "second timeout")
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, circuit.Open, cb.State("slow"), "open after timeouts")
+
+	// the trial call after the cooldown closes the circuit
+	mu.Lock()
+	healthy["ko"] = true
+	mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, invoke("ko", time.Second), "trial call")
+	assert.Equal(t, circuit.Closed, cb.State("ko"), "closed")
+
+	mu.Lock()
+	assert.Equal(t, []string{"ko:open", "slow:open", "ko:half-open", "ko:closed"}, changes, "state changes")
+	mu.Unlock()
+	assert.Equal(t, "1", cb.Vars.Get("CircuitOpenCalls").String(), "CircuitOpenCalls")
+	assert.Equal(t, "2", cb.Vars.Get("CircuitsOpened").String(), "CircuitsOpened")
+}
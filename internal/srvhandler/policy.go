@@ -0,0 +1,429 @@
+package srvhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// DefaultPolicyWindow is the default window of the rate limit and
+// quotas of a Policy.
+const DefaultPolicyWindow = time.Second
+
+// ErrChannelDenied is the error of the NACK returned for requests on
+// a channel denied by the ACLs of the policy.
+var ErrChannelDenied = errors.New("access to channel denied")
+
+// Policy is the set of rules enforced on the requests by Policies. The
+// zero value allows everything.
+type Policy struct {
+	// RateLimit is the maximum number of requests received on a
+	// connection during a window. If <= 0, the rate is not limited.
+	RateLimit int `yaml:"rate_limit"`
+
+	// Window is the duration of the window of the rate limit and of the
+	// URI quotas. If 0, DefaultPolicyWindow is used.
+	Window time.Duration `yaml:"window"`
+
+	// ChannelACLs is the list of access rules of the channels, the first
+	// rule that applies to the channel and the connection decides if
+	// the request is allowed. If the list is empty, all channels are
+	// allowed, otherwise the requests on channels without a rule are
+	// denied.
+	ChannelACLs []ChannelACL `yaml:"channel_acls"`
+
+	// URIQuotas is the list of quotas of CALL requests, the first quota
+	// with a URI that matches the request applies.
+	URIQuotas []URIQuota `yaml:"uri_quotas"`
+
+	// ActAsRules is the list of rules that allow connections to make
+	// CALL requests on behalf of other identities (see
+	// message.Meta.ActAs and Policies.AuthorizeActAs). If the list is
+	// empty, no connection can act as another identity.
+	ActAsRules []ActAsRule `yaml:"act_as_rules"`
+
+	// Features is the set of feature flags, see Policies.Feature.
+	Features map[string]bool `yaml:"features"`
+}
+
+// ChannelACL is an access rule of the channels of a Policy.
+type ChannelACL struct {
+	// Channel is the pattern of the channels, as supported by
+	// path.Match. It is matched against the channel of PUB requests,
+	// the channel or pattern of SUB and UNSB requests, and the channel
+	// of the message.HistoryURI CALL requests.
+	Channel string `yaml:"channel"`
+
+	// Identities is the list of identities of the connections the rule
+	// applies to (see juggler.Conn.Identity). If empty, the rule applies
+	// to all connections.
+	Identities []string `yaml:"identities"`
+
+	// Sub allows SUB and UNSB requests, as well as history queries.
+	Sub bool `yaml:"sub"`
+
+	// Pub allows PUB requests.
+	Pub bool `yaml:"pub"`
+
+	// Patterns allows the SUB and UNSB requests with a pattern that
+	// Channel matches, if Sub is set. Without it, the pattern
+	// subscriptions that the rule applies to are denied. The events
+	// received via a pattern subscription are still dropped if the
+	// rules deny the subscription to their channel.
+	Patterns bool `yaml:"patterns"`
+}
+
+// URIQuota is a quota of CALL requests of a Policy.
+type URIQuota struct {
+	// URI is the pattern of the URIs, as supported by path.Match.
+	URI string `yaml:"uri"`
+
+	// Limit is the maximum number of CALL requests to a matching URI
+	// received on a connection during a window. If <= 0, no call is
+	// allowed.
+	Limit int `yaml:"limit"`
+}
+
+// ActAsRule allows connections to make CALL requests on behalf of other
+// identities, e.g. the connections of an API gateway that calls on
+// behalf of its end users.
+type ActAsRule struct {
+	// Identities is the list of identities of the connections the rule
+	// applies to (see juggler.Conn.Identity). It must not be empty.
+	Identities []string `yaml:"identities"`
+
+	// ActAs is the pattern of the identities that the connections can
+	// act as, as supported by path.Match, e.g. "user:*".
+	ActAs string `yaml:"act_as"`
+
+	// URI is the pattern of the URIs of the calls, as supported by
+	// path.Match. If empty, the rule applies to all URIs.
+	URI string `yaml:"uri"`
+}
+
+// Validate returns an error if a pattern of the policy is invalid.
+func (p *Policy) Validate() error {
+	if p.Window < 0 {
+		return errors.New("negative window")
+	}
+	for _, acl := range p.ChannelACLs {
+		if _, err := path.Match(acl.Channel, ""); err != nil {
+			return fmt.Errorf("invalid channel pattern %q: %v", acl.Channel, err)
+		}
+	}
+	for _, q := range p.URIQuotas {
+		if _, err := path.Match(q.URI, ""); err != nil {
+			return fmt.Errorf("invalid URI pattern %q: %v", q.URI, err)
+		}
+	}
+	for _, r := range p.ActAsRules {
+		if len(r.Identities) == 0 {
+			return fmt.Errorf("no identities for the act-as rule of %q", r.ActAs)
+		}
+		if _, err := path.Match(r.ActAs, ""); err != nil {
+			return fmt.Errorf("invalid act-as pattern %q: %v", r.ActAs, err)
+		}
+		if _, err := path.Match(r.URI, ""); err != nil {
+			return fmt.Errorf("invalid URI pattern %q: %v", r.URI, err)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) window() time.Duration {
+	if p.Window == 0 {
+		return DefaultPolicyWindow
+	}
+	return p.Window
+}
+
+// allowed returns true if the ACLs allow the request on the channel for
+// the identity, pattern indicates a SUB or UNSB request with a pattern
+// and pub a PUB request.
+func (p *Policy) allowed(channel, identity string, pattern, pub bool) bool {
+	if len(p.ChannelACLs) == 0 {
+		return true
+	}
+	for _, acl := range p.ChannelACLs {
+		if ok, _ := path.Match(acl.Channel, channel); !ok {
+			continue
+		}
+		if len(acl.Identities) > 0 && !isIn(acl.Identities, identity) {
+			continue
+		}
+		if pub {
+			return acl.Pub
+		}
+		if pattern {
+			return acl.Sub && acl.Patterns
+		}
+		return acl.Sub
+	}
+	return false
+}
+
+// canActAs returns true if a rule of p allows the connection with the
+// identity to call the URI on behalf of actAs.
+func (p *Policy) canActAs(identity, actAs, uri string) bool {
+	for _, r := range p.ActAsRules {
+		if !isIn(r.Identities, identity) {
+			continue
+		}
+		if ok, _ := path.Match(r.ActAs, actAs); !ok {
+			continue
+		}
+		if r.URI != "" {
+			if ok, _ := path.Match(r.URI, uri); !ok {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// quota returns the quota that applies to the URI, or nil.
+func (p *Policy) quota(uri string) *URIQuota {
+	for i, q := range p.URIQuotas {
+		if ok, _ := path.Match(q.URI, uri); ok {
+			return &p.URIQuotas[i]
+		}
+	}
+	return nil
+}
+
+func isIn(list []string, v string) bool {
+	for _, vv := range list {
+		if vv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitError is the error of the NACK returned for requests that
+// exceed the rate limit or a quota of the policy. It implements
+// json.Marshaler so that the delay is sent as details of the NACK.
+type RateLimitError struct {
+	Quota      string        // URI pattern of the quota, or empty for the rate limit
+	RetryAfter time.Duration // delay before the end of the window
+}
+
+// Error returns the error message for the RateLimitError.
+func (e *RateLimitError) Error() string {
+	if e.Quota != "" {
+		return fmt.Sprintf("quota of %s exceeded", e.Quota)
+	}
+	return "rate limit exceeded"
+}
+
+// MarshalJSON implements json.Marshaler for RateLimitError, the delay
+// is rounded up to the second.
+func (e *RateLimitError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		RetryAfter int `json:"retry_after"`
+	}{int((e.RetryAfter + time.Second - 1) / time.Second)})
+}
+
+// Policies enforces a Policy that can be replaced at runtime. Requests
+// that exceed the rate limit or a URI quota are rejected with a NACK
+// with message.CodeRateLimited and a RateLimitError, and requests on
+// a channel denied by the ACLs are rejected with a NACK with
+// message.CodeForbidden and ErrChannelDenied.
+type Policies struct {
+	// Vars can be set to track the number of RateLimitedMsgs,
+	// QuotaExceededCalls and ChannelDeniedMsgs. If nil, no metrics
+	// are recorded.
+	Vars *expvar.Map
+
+	mu     sync.Mutex
+	policy *Policy
+	conns  map[*juggler.Conn]*usage
+}
+
+// usage is the count of requests received on a connection.
+type usage struct {
+	start time.Time      // start of the current window
+	reqs  int            // requests in the current window
+	calls map[string]int // calls per quota in the current window
+}
+
+// Policy returns the current policy. It must not be modified.
+func (ps *Policies) Policy() *Policy {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.policy == nil {
+		return &Policy{}
+	}
+	return ps.policy
+}
+
+// SetPolicy validates and replaces the current policy. It applies
+// immediately to all connections, starting a new window. It is safe
+// to call concurrently.
+func (ps *Policies) SetPolicy(p *Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.policy = p
+	for _, u := range ps.conns {
+		u.start = time.Time{}
+	}
+	return nil
+}
+
+// Feature returns the value of the feature flag of the current policy,
+// or false if it is not set. It is meant for the handlers that enable
+// optional behaviour at runtime.
+func (ps *Policies) Feature(name string) bool {
+	return ps.Policy().Features[name]
+}
+
+// AuthorizeActAs returns true if the act-as rules of the current policy
+// allow the connection to make the call m on behalf of identity. It is
+// meant to be set as juggler.Server.AuthorizeActAs.
+func (ps *Policies) AuthorizeActAs(c *juggler.Conn, m *message.Call, identity string) bool {
+	return ps.Policy().canActAs(c.Identity, identity, m.Payload.URI)
+}
+
+// AuthorizeChannel returns true if the channel ACLs of the current
+// policy allow identity to publish on the channel if pub is true, or
+// to subscribe to it otherwise, as a pattern if pattern is true. It is
+// meant for the front-ends that do not serve their clients with
+// Handler, e.g. the MQTT clients, which must also check the channel
+// of the events received via a pattern subscription.
+func (ps *Policies) AuthorizeChannel(identity, channel string, pattern, pub bool) bool {
+	return ps.Policy().allowed(channel, identity, pattern, pub)
+}
+
+// Handler returns a juggler.Handler that enforces the current policy
+// on the requests before calling h. The events received via a pattern
+// subscription are dropped if the ACLs deny the subscription to their
+// channel.
+func (ps *Policies) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		if ev, ok := msg.(*message.Evnt); ok && ev.Payload.Pattern != "" {
+			if !ps.Policy().allowed(ev.Payload.Channel, c.Identity, false, false) {
+				if ps.Vars != nil {
+					ps.Vars.Add("ChannelDeniedEvnts", 1)
+				}
+				return
+			}
+		}
+		if msg.Type().IsRead() {
+			p := ps.Policy()
+			if !ps.checkACL(p, c, msg) {
+				if ps.Vars != nil {
+					ps.Vars.Add("ChannelDeniedMsgs", 1)
+				}
+				c.Send(message.NewNack(msg, message.CodeForbidden, ErrChannelDenied))
+				return
+			}
+			if err := ps.count(p, c, msg); err != nil {
+				if ps.Vars != nil {
+					if err.Quota != "" {
+						ps.Vars.Add("QuotaExceededCalls", 1)
+					} else {
+						ps.Vars.Add("RateLimitedMsgs", 1)
+					}
+				}
+				c.Send(message.NewNack(msg, message.CodeRateLimited, err))
+				return
+			}
+		}
+		h.Handle(ctx, c, msg)
+	})
+}
+
+// checkACL returns true if the request is allowed by the ACLs of p.
+func (ps *Policies) checkACL(p *Policy, c *juggler.Conn, msg message.Msg) bool {
+	switch msg := msg.(type) {
+	case *message.Pub:
+		return p.allowed(msg.Payload.Channel, c.Identity, false, true)
+	case *message.Sub:
+		return p.allowed(msg.Payload.Channel, c.Identity, msg.Payload.Pattern, false)
+	case *message.Unsb:
+		return p.allowed(msg.Payload.Channel, c.Identity, msg.Payload.Pattern, false)
+	case *message.Call:
+		if msg.Payload.URI == message.HistoryURI && len(p.ChannelACLs) > 0 {
+			var q message.HistoryQuery
+			if err := json.Unmarshal(msg.Payload.Args, &q); err != nil {
+				// invalid query, rejected by the server
+				return true
+			}
+			return p.allowed(q.Channel, c.Identity, false, false)
+		}
+	}
+	return true
+}
+
+// count counts the request received on the connection and returns an
+// error if it exceeds the rate limit or the quota of its URI.
+func (ps *Policies) count(p *Policy, c *juggler.Conn, msg message.Msg) *RateLimitError {
+	var q *URIQuota
+	if call, ok := msg.(*message.Call); ok {
+		q = p.quota(call.Payload.URI)
+	}
+	if p.RateLimit <= 0 && q == nil {
+		return nil
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.conns == nil {
+		ps.conns = make(map[*juggler.Conn]*usage)
+	}
+	now := time.Now()
+	u := ps.conns[c]
+	if u == nil {
+		u = &usage{}
+		ps.conns[c] = u
+		go ps.release(c)
+	}
+	win := p.window()
+	if now.Sub(u.start) >= win {
+		u.start = now
+		u.reqs = 0
+		u.calls = nil
+	}
+	retry := u.start.Add(win).Sub(now)
+
+	if p.RateLimit > 0 {
+		if u.reqs >= p.RateLimit {
+			return &RateLimitError{RetryAfter: retry}
+		}
+	}
+	if q != nil {
+		if u.calls[q.URI] >= q.Limit {
+			return &RateLimitError{Quota: q.URI, RetryAfter: retry}
+		}
+		if u.calls == nil {
+			u.calls = make(map[string]int)
+		}
+		u.calls[q.URI]++
+	}
+	u.reqs++
+	return nil
+}
+
+// release removes the usage of the connection once it is closed.
+func (ps *Policies) release(c *juggler.Conn) {
+	<-c.CloseNotify()
+
+	ps.mu.Lock()
+	delete(ps.conns, c)
+	ps.mu.Unlock()
+}
@@ -0,0 +1,260 @@
+package srvhandler
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeCallerBroker struct {
+	broker.CallerBroker
+}
+
+func (f fakeCallerBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return fakeResultsConn{make(chan *message.ResPayload)}, nil
+}
+
+type fakeResultsConn struct {
+	ch chan *message.ResPayload
+}
+
+func (f fakeResultsConn) Results() <-chan *message.ResPayload { return f.ch }
+func (f fakeResultsConn) ResultsErr() error                   { return nil }
+func (f fakeResultsConn) Close() error                        { close(f.ch); return nil }
+
+func TestPolicyValidate(t *testing.T) {
+	assert.NoError(t, (&Policy{}).Validate(), "zero value")
+	assert.Error(t, (&Policy{ChannelACLs: []ChannelACL{{Channel: "["}}}).Validate(), "invalid channel pattern")
+	assert.Error(t, (&Policy{URIQuotas: []URIQuota{{URI: "["}}}).Validate(), "invalid URI pattern")
+	assert.Error(t, (&Policy{Window: -1}).Validate(), "negative window")
+	assert.Error(t, (&Policy{ActAsRules: []ActAsRule{{ActAs: "user:*"}}}).Validate(), "act-as rule without identities")
+	assert.Error(t, (&Policy{ActAsRules: []ActAsRule{{Identities: []string{"gw"}, ActAs: "["}}}).Validate(), "invalid act-as pattern")
+}
+
+func TestPoliciesAuthorizeActAs(t *testing.T) {
+	ps := &Policies{}
+	require.NoError(t, ps.SetPolicy(&Policy{
+		ActAsRules: []ActAsRule{
+			{Identities: []string{"gw"}, ActAs: "user:*"},
+			{Identities: []string{"admin-gw"}, ActAs: "*", URI: "admin.*"},
+		},
+	}), "SetPolicy")
+
+	cases := []struct {
+		identity string
+		actAs    string
+		uri      string
+		want     bool
+	}{
+		{"gw", "user:1", "a", true},
+		{"gw", "admin", "a", false},
+		{"other", "user:1", "a", false},
+		{"admin-gw", "admin", "admin.users", true},
+		{"admin-gw", "admin", "a", false},
+	}
+	for _, c := range cases {
+		conn := juggler.NewDetachedConn(&juggler.Server{})
+		conn.Identity = c.identity
+		m, err := message.NewCall(c.uri, nil, time.Second)
+		require.NoError(t, err, "NewCall")
+		assert.Equal(t, c.want, ps.AuthorizeActAs(conn, m, c.actAs), "%s as %s for %s", c.identity, c.actAs, c.uri)
+	}
+}
+
+func TestPoliciesPatterns(t *testing.T) {
+	ps := &Policies{Vars: new(expvar.Map).Init()}
+	require.NoError(t, ps.SetPolicy(&Policy{ChannelACLs: []ChannelACL{
+		{Channel: "secret.*", Identities: []string{"admin"}, Sub: true},
+		{Channel: "secret.*"},
+		{Channel: "feeds.*", Sub: true, Patterns: true},
+		{Channel: "*", Sub: true},
+	}}), "SetPolicy")
+
+	var got []message.Msg
+	server := &juggler.Server{}
+	server.Handler = ps.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		got = append(got, msg)
+	}))
+	conn := juggler.NewDetachedConn(server)
+	conn.Identity = "u1"
+
+	cases := []struct {
+		channel string
+		pattern bool
+		want    bool
+	}{
+		{"news", false, true},
+		{"secret.a", false, false},
+		{"*", true, false},
+		{"s*", true, false},
+		{"secret*", true, false},
+		{"secret.*", true, false},
+		{"feeds.*", true, true},
+	}
+	for _, c := range cases {
+		got = nil
+		conn.Send(message.NewSub(c.channel, c.pattern))
+		require.Len(t, got, 1, "%+v", c)
+		_, isNack := got[0].(*message.Nack)
+		assert.Equal(t, c.want, !isNack, "%+v", c)
+	}
+
+	// the events of the denied channels are dropped from the patterns
+	got = nil
+	conn.Send(message.NewEvnt(&message.EvntPayload{Channel: "feeds.a", Pattern: "feeds.*"}))
+	conn.Send(message.NewEvnt(&message.EvntPayload{Channel: "secret.a", Pattern: "*"}))
+	conn.Send(message.NewEvnt(&message.EvntPayload{Channel: "secret.a"}))
+	conn.Identity = "admin"
+	conn.Send(message.NewEvnt(&message.EvntPayload{Channel: "secret.a", Pattern: "*"}))
+	assert.Len(t, got, 3, "events")
+	assert.Equal(t, "1", ps.Vars.Get("ChannelDeniedEvnts").String(), "denied events")
+}
+
+func TestPoliciesAuthorizeChannel(t *testing.T) {
+	ps := &Policies{}
+	assert.True(t, ps.AuthorizeChannel("u1", "a", false, true), "no policy")
+	require.NoError(t, ps.SetPolicy(&Policy{ChannelACLs: []ChannelACL{
+		{Channel: "ro:*", Sub: true},
+		{Channel: "ops:*", Identities: []string{"ops"}, Pub: true, Sub: true},
+	}}), "SetPolicy")
+
+	assert.True(t, ps.AuthorizeChannel("u1", "ro:a", false, false), "sub read-only")
+	assert.False(t, ps.AuthorizeChannel("u1", "ro:a", false, true), "pub read-only")
+	assert.True(t, ps.AuthorizeChannel("ops", "ops:a", false, true), "pub ops")
+	assert.False(t, ps.AuthorizeChannel("u1", "ops:a", false, false), "sub ops")
+	assert.False(t, ps.AuthorizeChannel("u1", "a", false, false), "no ACL")
+	assert.False(t, ps.AuthorizeChannel("u1", "ro:+", true, false), "pattern without the patterns rule")
+}
+
+func TestPolicies(t *testing.T) {
+	ps := &Policies{Vars: new(expvar.Map).Init()}
+	require.NoError(t, ps.SetPolicy(&Policy{
+		RateLimit: 4,
+		Window:    time.Minute,
+		ChannelACLs: []ChannelACL{
+			{Channel: "admin.*", Identities: []string{"admin"}, Sub: true, Pub: true},
+			{Channel: "public.*", Sub: true},
+			{Channel: "open", Pub: true},
+		},
+		URIQuotas: []URIQuota{{URI: "a.*", Limit: 1}},
+		Features:  map[string]bool{"beta": true},
+	}), "SetPolicy")
+	assert.True(t, ps.Feature("beta"), "feature set")
+	assert.False(t, ps.Feature("gamma"), "feature not set")
+
+	server := &juggler.Server{
+		CallerBroker: fakeCallerBroker{},
+		Handler: ps.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+			if msg.Type().IsRead() {
+				c.Send(message.NewAck(msg))
+				return
+			}
+			juggler.ProcessMsg(c, msg)
+		})),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, msg message.Msg) {
+		msgs <- msg
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call, pub"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	next := func() message.Msg {
+		select {
+		case m := <-msgs:
+			return m
+		case <-time.After(time.Second):
+			assert.Fail(t, "no message received")
+			return nil
+		}
+	}
+	wantNack := func(want int, desc string) *message.Nack {
+		m := next()
+		if assert.IsType(t, &message.Nack{}, m, desc) {
+			nack := m.(*message.Nack)
+			assert.Equal(t, want, nack.Payload.Code, "%s: code", desc)
+			return nack
+		}
+		return nil
+	}
+
+	_, err = cli.Pub("open", 1)
+	require.NoError(t, err, "Pub")
+	assert.IsType(t, &message.Ack{}, next(), "PUB allowed")
+
+	_, err = cli.Pub("public.news", 1)
+	require.NoError(t, err, "Pub")
+	wantNack(message.CodeForbidden, "PUB denied")
+
+	_, err = cli.Pub("admin.logs", 1)
+	require.NoError(t, err, "Pub")
+	wantNack(message.CodeForbidden, "PUB denied for identity")
+
+	_, err = cli.Call(message.HistoryURI, message.HistoryQuery{Channel: "private"}, time.Second)
+	require.NoError(t, err, "Call")
+	wantNack(message.CodeForbidden, "history denied")
+
+	_, err = cli.Call("a.b", nil, time.Second)
+	require.NoError(t, err, "Call")
+	assert.IsType(t, &message.Ack{}, next(), "CALL within quota")
+
+	_, err = cli.Call("a.c", nil, time.Second)
+	require.NoError(t, err, "Call")
+	if nack := wantNack(message.CodeRateLimited, "CALL over quota"); nack != nil {
+		var details struct {
+			RetryAfter int `json:"retry_after"`
+		}
+		require.NoError(t, json.Unmarshal(nack.Payload.Details, &details), "Unmarshal details")
+		assert.True(t, details.RetryAfter > 0 && details.RetryAfter <= 60, "retry after %d", details.RetryAfter)
+	}
+
+	// 2 requests counted so far, the rejected ones are not
+	for i := 0; i < 3; i++ {
+		_, err = cli.Pub("open", i)
+		require.NoError(t, err, "Pub %d", i)
+	}
+	// the client may handle the responses in any order
+	var acks, nacks int
+	for i := 0; i < 3; i++ {
+		switch m := next().(type) {
+		case *message.Ack:
+			acks++
+		case *message.Nack:
+			nacks++
+			assert.Equal(t, message.CodeRateLimited, m.Payload.Code, "PUB over rate limit")
+		}
+	}
+	assert.Equal(t, 2, acks, "PUB within rate limit")
+	assert.Equal(t, 1, nacks, "PUB over rate limit")
+
+	// a new policy applies immediately
+	require.NoError(t, ps.SetPolicy(&Policy{}), "SetPolicy")
+	_, err = cli.Pub("public.news", 1)
+	require.NoError(t, err, "Pub")
+	assert.IsType(t, &message.Ack{}, next(), "PUB allowed by new policy")
+
+	assert.Equal(t, "3", ps.Vars.Get("ChannelDeniedMsgs").String(), "ChannelDeniedMsgs")
+	assert.Equal(t, "1", ps.Vars.Get("QuotaExceededCalls").String(), "QuotaExceededCalls")
+	assert.Equal(t, "1", ps.Vars.Get("RateLimitedMsgs").String(), "RateLimitedMsgs")
+}
@@ -3,10 +3,19 @@
 package srvhandler
 
 import (
+	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/internal/mergepatch"
+	"github.com/PuerkitoBio/juggler/internal/uuidstr"
 	"github.com/PuerkitoBio/juggler/message"
 	"golang.org/x/net/context"
 )
@@ -54,7 +63,7 @@ func LogConn(logFn func(string, ...interface{})) func(*juggler.Conn, juggler.Con
 	return func(c *juggler.Conn, state juggler.ConnState) {
 		switch state {
 		case juggler.Connected:
-			logFn("%v: connected from %v with subprotocol %q", c.UUID, c.RemoteAddr(), c.Subprotocol())
+			logFn("%s: connected from %v with subprotocol %q", uuidstr.String(c.UUID), c.RemoteAddr(), c.Subprotocol())
 		case juggler.Closed:
 			logFn("%v: closing from %v with error %v", c.UUID, c.RemoteAddr(), c.CloseErr)
 		}
@@ -66,9 +75,620 @@ func LogConn(logFn func(string, ...interface{})) func(*juggler.Conn, juggler.Con
 func LogMsg(logFn func(string, ...interface{})) juggler.Handler {
 	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
 		if m.Type().IsRead() {
-			logFn("%v: received message %v %s", c.UUID, m.UUID(), m.Type())
+			logFn("%s: received message %v %s", uuidstr.String(c.UUID), m.UUID(), m.Type())
 		} else if m.Type().IsWrite() {
-			logFn("%v: sending message %v %s", c.UUID, m.UUID(), m.Type())
+			logFn("%s: sending message %v %s", uuidstr.String(c.UUID), m.UUID(), m.Type())
 		}
 	})
 }
+
+// MaintenanceCode is the code of the NACK returned for requests rejected
+// because of the maintenance mode.
+const MaintenanceCode = message.CodeUnavailable
+
+// ErrMaintenance is the error of the NACK returned for requests rejected
+// because of the maintenance mode.
+var ErrMaintenance = errors.New("server in maintenance mode")
+
+// Maintenance implements a read-only maintenance mode. When enabled,
+// SUB and UNSB requests are allowed, as well as CALL requests to the
+// read-only URIs, to message.TimeSyncURI, to message.HistoryURI, to
+// message.CreditURI and to message.EvntAckURI, but PUB requests and
+// CALL requests to any other URI are rejected with a NACK.
+type Maintenance struct {
+	// ReadOnlyURIs is the list of URIs that can still be called in
+	// maintenance mode. Each entry is a pattern as supported by
+	// path.Match. It should not be updated once the handler is used.
+	ReadOnlyURIs []string
+
+	enabled int32
+}
+
+// Enabled returns true if the maintenance mode is enabled.
+func (m *Maintenance) Enabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+// SetEnabled enables or disables the maintenance mode. It is safe to
+// call concurrently.
+func (m *Maintenance) SetEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+// Toggle switches the maintenance mode on if it is off, and off if it
+// is on. It returns the new state.
+func (m *Maintenance) Toggle() bool {
+	for {
+		old := atomic.LoadInt32(&m.enabled)
+		if atomic.CompareAndSwapInt32(&m.enabled, old, 1-old) {
+			return old == 0
+		}
+	}
+}
+
+func (m *Maintenance) isReadOnly(uri string) bool {
+	for _, pat := range m.ReadOnlyURIs {
+		if ok, _ := path.Match(pat, uri); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns a juggler.Handler that calls h unless the maintenance
+// mode is enabled and the message is a mutating request, in which case
+// a NACK with MaintenanceCode is sent instead.
+func (m *Maintenance) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		if m.Enabled() {
+			var reject bool
+			switch msg := msg.(type) {
+			case *message.Pub:
+				reject = true
+			case *message.Call:
+				uri := msg.Payload.URI
+				reject = uri != message.TimeSyncURI && uri != message.HistoryURI && uri != message.CreditURI && uri != message.EvntAckURI && !m.isReadOnly(uri)
+			}
+			if reject {
+				c.Send(message.NewNack(msg, MaintenanceCode, ErrMaintenance))
+				return
+			}
+		}
+		h.Handle(ctx, c, msg)
+	})
+}
+
+// DefaultFullSyncEvery is the default number of patches sent on a state
+// channel before the full state is sent again.
+const DefaultFullSyncEvery = 100
+
+// StateChannels implements state channels, where the publishers send
+// the full state of the channel in each event, and the subscribers
+// receive the changes since the previous event as a JSON merge patch
+// (RFC 7396). The full state is sent on the first event received by a
+// connection on a channel, after every FullSyncEvery patches, and
+// whenever the patch would not be smaller than the full state.
+type StateChannels struct {
+	// Channels is the list of state channels. Each entry is a pattern as
+	// supported by path.Match. It should not be updated once the handler
+	// is used.
+	Channels []string
+
+	// FullSyncEvery is the number of patches sent on a channel before
+	// the full state is sent again. If 0, DefaultFullSyncEvery is used,
+	// and if < 0, the full state is only sent on the first event.
+	FullSyncEvery int
+
+	// Vars can be set to track the number of StatePatches and
+	// StateFullSyncs. If nil, no metrics are recorded.
+	Vars *expvar.Map
+
+	mu    sync.Mutex
+	conns map[*juggler.Conn]map[string]*channelState
+}
+
+// channelState is the last state of a channel sent on a connection.
+type channelState struct {
+	pattern string // pattern of the subscription, if any
+	state   json.RawMessage
+	patches int // number of patches since the last full state
+}
+
+func (s *StateChannels) isState(channel string) bool {
+	for _, pat := range s.Channels {
+		if ok, _ := path.Match(pat, channel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns a juggler.Handler that replaces the arguments of the
+// EVNT messages of the state channels with the merge patch from the
+// previous state sent on the connection before calling h. The state is
+// forgotten when the connection unsubscribes from the channel, so that
+// the full state is sent if it subscribes again. The expired events are
+// passed through untouched, as they are not sent, and Expired should be
+// set as juggler.Server.OnExpiredEvnt for the events that expire after
+// the handler.
+func (s *StateChannels) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		switch m := msg.(type) {
+		case *message.Evnt:
+			if left, ok := m.TimeLeft(time.Now()); ok && left <= 0 {
+				break
+			}
+			if s.isState(m.Payload.Channel) {
+				msg = s.diff(c, m)
+			}
+		case *message.Unsb:
+			s.forget(c, m.Payload.Channel, m.Payload.Pattern)
+		}
+		h.Handle(ctx, c, msg)
+	})
+}
+
+// diff returns the event to send on the connection, with the merge patch
+// as arguments if possible, and records the new state.
+func (s *StateChannels) diff(c *juggler.Conn, ev *message.Evnt) *message.Evnt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[*juggler.Conn]map[string]*channelState)
+	}
+	states := s.conns[c]
+	if states == nil {
+		states = make(map[string]*channelState)
+		s.conns[c] = states
+		go s.release(c)
+	}
+
+	every := s.FullSyncEvery
+	if every == 0 {
+		every = DefaultFullSyncEvery
+	}
+
+	if cs := states[ev.Payload.Channel]; cs != nil && (every < 0 || cs.patches < every) {
+		patch, err := mergepatch.Create(cs.state, ev.Payload.Args)
+		if err == nil && len(patch) < len(ev.Payload.Args) {
+			cs.state = ev.Payload.Args
+			cs.patches++
+			if s.Vars != nil {
+				s.Vars.Add("StatePatches", 1)
+			}
+
+			cpy := *ev
+			cpy.Payload.Patch = true
+			cpy.Payload.Args = patch
+			return &cpy
+		}
+	}
+
+	states[ev.Payload.Channel] = &channelState{pattern: ev.Payload.Pattern, state: ev.Payload.Args}
+	if s.Vars != nil {
+		s.Vars.Add("StateFullSyncs", 1)
+	}
+	return ev
+}
+
+// forget removes the states of the connection received via the
+// subscription to channel.
+func (s *StateChannels) forget(c *juggler.Conn, channel string, pattern bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch, cs := range s.conns[c] {
+		if (pattern && cs.pattern == channel) || (!pattern && cs.pattern == "" && ch == channel) {
+			delete(s.conns[c], ch)
+		}
+	}
+}
+
+// Expired forgets the state of the channel of the EVNT message ev that
+// was not sent on the connection because it expired, so that the full
+// state is sent with the next event. It can be set as
+// juggler.Server.OnExpiredEvnt.
+func (s *StateChannels) Expired(c *juggler.Conn, ev *message.Evnt) {
+	if !s.isState(ev.Payload.Channel) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns[c], ev.Payload.Channel)
+}
+
+// release removes the states of the connection once it is closed.
+func (s *StateChannels) release(c *juggler.Conn) {
+	<-c.CloseNotify()
+
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+// ErrTooManyNacks is the error used to close the connections that
+// exceed the NACK rate limit when the action is NackClose.
+var ErrTooManyNacks = errors.New("too many failed requests")
+
+// NackAction is the action taken when a connection exceeds the NACK
+// rate limit.
+type NackAction int
+
+// The list of supported NACK actions.
+const (
+	// NackThrottle drops the NACKs and the requests received on the
+	// connection until the end of the window, without replying to the
+	// requests. This is the default.
+	NackThrottle NackAction = iota
+
+	// NackClose closes the connection with ErrTooManyNacks.
+	NackClose
+)
+
+// DefaultNackWindow is the default window of the NACK rate limit.
+const DefaultNackWindow = time.Second
+
+// NackLimit limits the rate of NACKs sent on each connection, so that
+// broken or abusive clients sending invalid or rejected requests cannot
+// keep the server busy generating error responses. When a connection
+// sends more than Limit NACKs during a window, Action is taken.
+type NackLimit struct {
+	// Limit is the maximum number of NACKs sent on a connection during
+	// a window. If <= 0, the rate is not limited.
+	Limit int
+
+	// Window is the duration of the window in which at most Limit NACKs
+	// can be sent. If 0, DefaultNackWindow is used.
+	Window time.Duration
+
+	// Action is the action taken when the limit is exceeded.
+	Action NackAction
+
+	// Vars can be set to track the number of NackLimitExceeded,
+	// NackThrottledMsgs and NackLimitCloses. If nil, no metrics are
+	// recorded.
+	Vars *expvar.Map
+
+	mu    sync.Mutex
+	conns map[*juggler.Conn]*nackCount
+}
+
+// nackCount is the count of NACKs sent on a connection.
+type nackCount struct {
+	start     time.Time // start of the current window
+	nacks     int       // NACKs in the current window
+	throttled bool      // limit exceeded in the current window
+	exceeded  int       // number of windows where the limit was exceeded
+}
+
+// NackOffender is a connection that exceeded the NACK rate limit, as
+// returned by NackLimit.Offenders.
+type NackOffender struct {
+	ConnUUID   string `json:"conn_uuid"`
+	RemoteAddr string `json:"remote_addr"`
+	Exceeded   int    `json:"exceeded"`  // number of windows where the limit was exceeded
+	Throttled  bool   `json:"throttled"` // currently throttled
+}
+
+// Offenders returns the open connections that exceeded the NACK rate
+// limit at least once.
+func (l *NackLimit) Offenders() []NackOffender {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	offs := make([]NackOffender, 0)
+	for c, nc := range l.conns {
+		if nc.exceeded == 0 {
+			continue
+		}
+		offs = append(offs, NackOffender{
+			ConnUUID:   c.UUID.String(),
+			RemoteAddr: c.RemoteAddr().String(),
+			Exceeded:   nc.exceeded,
+			Throttled:  nc.throttled && now.Sub(nc.start) < l.window(),
+		})
+	}
+	return offs
+}
+
+func (l *NackLimit) window() time.Duration {
+	if l.Window == 0 {
+		return DefaultNackWindow
+	}
+	return l.Window
+}
+
+// Handler returns a juggler.Handler that counts the NACKs sent on each
+// connection before calling h, and takes the Action when the limit is
+// exceeded. With NackThrottle, NACKs and requests are dropped instead
+// of calling h while the connection is throttled.
+func (l *NackLimit) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		if l.Limit > 0 {
+			switch {
+			case msg.Type() == message.NackMsg:
+				if l.addNack(c) {
+					l.exceeded(c)
+					return
+				}
+			case msg.Type().IsRead():
+				if l.isThrottled(c) {
+					l.exceeded(c)
+					return
+				}
+			}
+		}
+		h.Handle(ctx, c, msg)
+	})
+}
+
+// exceeded takes the action for a message sent or received while the
+// connection is over the limit.
+func (l *NackLimit) exceeded(c *juggler.Conn) {
+	if l.Action == NackClose {
+		if l.Vars != nil {
+			l.Vars.Add("NackLimitCloses", 1)
+		}
+		c.Close(ErrTooManyNacks)
+		return
+	}
+	if l.Vars != nil {
+		l.Vars.Add("NackThrottledMsgs", 1)
+	}
+}
+
+// addNack counts a NACK sent on the connection and returns true if
+// it exceeds the limit.
+func (l *NackLimit) addNack(c *juggler.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns == nil {
+		l.conns = make(map[*juggler.Conn]*nackCount)
+	}
+	now := time.Now()
+	nc := l.conns[c]
+	if nc == nil {
+		nc = &nackCount{start: now}
+		l.conns[c] = nc
+		go l.release(c)
+	}
+	if now.Sub(nc.start) >= l.window() {
+		nc.start = now
+		nc.nacks = 0
+		nc.throttled = false
+	}
+
+	nc.nacks++
+	if nc.nacks <= l.Limit {
+		return false
+	}
+	if !nc.throttled {
+		nc.throttled = true
+		nc.exceeded++
+		if l.Vars != nil {
+			l.Vars.Add("NackLimitExceeded", 1)
+		}
+	}
+	return true
+}
+
+// isThrottled returns true if the connection exceeded the limit in the
+// current window.
+func (l *NackLimit) isThrottled(c *juggler.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	nc := l.conns[c]
+	return nc != nil && nc.throttled && time.Since(nc.start) < l.window()
+}
+
+// release removes the count of the connection once it is closed.
+func (l *NackLimit) release(c *juggler.Conn) {
+	<-c.CloseNotify()
+
+	l.mu.Lock()
+	delete(l.conns, c)
+	l.mu.Unlock()
+}
+
+// Connections tracks the open connections of a server along with their
+// subscriptions and in-flight calls, e.g. to expose them on an admin
+// endpoint. Its ConnState method must be called by the Server's
+// ConnState function, and its Handler must be in the Server's handler
+// chain for the subscriptions and calls to be tracked.
+type Connections struct {
+	mu    sync.Mutex
+	conns map[*juggler.Conn]*connState
+}
+
+// connState is the tracked state of a connection.
+type connState struct {
+	connected time.Time
+	channels  map[string]bool
+	patterns  map[string]bool
+	pending   map[string]pendingReq // SUB, UNSB and CALL waiting for their ACK
+	calls     map[string]time.Time  // in-flight calls with their expiration
+}
+
+// pendingReq is a request waiting for its ACK or NACK.
+type pendingReq struct {
+	msg message.Msg
+	at  time.Time
+}
+
+// pendingReqTTL is the delay after which a request that was neither
+// acknowledged nor rejected is forgotten, e.g. if it was dropped by
+// a handler.
+const pendingReqTTL = time.Minute
+
+// ConnInfo is an open connection, as returned by Connections.List.
+type ConnInfo struct {
+	ConnUUID      string    `json:"conn_uuid"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Identity      string    `json:"identity,omitempty"`
+	Connected     time.Time `json:"connected"`
+	Channels      []string  `json:"channels"`
+	Patterns      []string  `json:"patterns"`
+	InFlightCalls int       `json:"in_flight_calls"`
+}
+
+// ConnState records the connection when it is connected, and forgets
+// it when it is closed.
+func (cs *Connections) ConnState(c *juggler.Conn, state juggler.ConnState) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	switch state {
+	case juggler.Connected:
+		if cs.conns == nil {
+			cs.conns = make(map[*juggler.Conn]*connState)
+		}
+		cs.conns[c] = &connState{
+			connected: time.Now(),
+			channels:  make(map[string]bool),
+			patterns:  make(map[string]bool),
+			pending:   make(map[string]pendingReq),
+			calls:     make(map[string]time.Time),
+		}
+	case juggler.Closed:
+		delete(cs.conns, c)
+	}
+}
+
+// Handler returns a juggler.Handler that tracks the subscriptions and
+// in-flight calls of the connection before calling h. A request is
+// tracked once it is acknowledged, and a call is in-flight until its
+// result is sent or it expires. A fire-and-forget call (see
+// message.NoAck) is in-flight once it is received, until its result or
+// NACK is sent.
+func (cs *Connections) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		cs.track(c, msg)
+		h.Handle(ctx, c, msg)
+	})
+}
+
+func (cs *Connections) track(c *juggler.Conn, msg message.Msg) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	st := cs.conns[c]
+	if st == nil {
+		return
+	}
+
+	switch m := msg.(type) {
+	case *message.Sub, *message.Unsb, *message.Call:
+		if call, ok := m.(*message.Call); ok && call.Payload.NoAck {
+			// a fire-and-forget call is in-flight once received
+			st.calls[call.UUID().String()] = time.Now().Add(juggler.CallWait(call))
+			return
+		}
+		now := time.Now()
+		for id, req := range st.pending {
+			if now.Sub(req.at) > pendingReqTTL {
+				delete(st.pending, id)
+			}
+		}
+		st.pending[m.UUID().String()] = pendingReq{msg: m, at: now}
+
+	case *message.Nack:
+		delete(st.pending, m.Payload.For.String())
+		delete(st.calls, m.Payload.For.String())
+
+	case *message.Ack:
+		id := m.Payload.For.String()
+		req := st.pending[id]
+		delete(st.pending, id)
+
+		switch req := req.msg.(type) {
+		case *message.Sub:
+			if req.Payload.Pattern {
+				st.patterns[req.Payload.Channel] = true
+			} else {
+				st.channels[req.Payload.Channel] = true
+			}
+		case *message.Unsb:
+			if req.Payload.Pattern {
+				delete(st.patterns, req.Payload.Channel)
+			} else {
+				delete(st.channels, req.Payload.Channel)
+			}
+		case *message.Call:
+			st.calls[id] = time.Now().Add(juggler.CallWait(req))
+		}
+
+	case *message.Res:
+		delete(st.calls, m.Payload.For.String())
+	}
+}
+
+// List returns the open connections, oldest first.
+func (cs *Connections) List() []ConnInfo {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	infos := make([]ConnInfo, 0, len(cs.conns))
+	for c, st := range cs.conns {
+		for id, exp := range st.calls {
+			if now.After(exp) {
+				delete(st.calls, id)
+			}
+		}
+		infos = append(infos, ConnInfo{
+			ConnUUID:      c.UUID.String(),
+			RemoteAddr:    c.RemoteAddr().String(),
+			Identity:      c.Identity,
+			Connected:     st.connected,
+			Channels:      sortedKeys(st.channels),
+			Patterns:      sortedKeys(st.patterns),
+			InFlightCalls: len(st.calls),
+		})
+	}
+	sort.Sort(byConnected(infos))
+	return infos
+}
+
+// Close closes the open connection identified by id with err, and
+// returns false if there is no such connection.
+func (cs *Connections) Close(id string, err error) bool {
+	cs.mu.Lock()
+	var conn *juggler.Conn
+	for c := range cs.conns {
+		if c.UUID.String() == id {
+			conn = c
+			break
+		}
+	}
+	cs.mu.Unlock()
+
+	if conn == nil {
+		return false
+	}
+	conn.Close(err)
+	return true
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type byConnected []ConnInfo
+
+func (b byConnected) Len() int           { return len(b) }
+func (b byConnected) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byConnected) Less(i, j int) bool { return b[i].Connected.Before(b[j].Connected) }
@@ -1,11 +1,22 @@
 package srvhandler
 
 import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
 	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -24,3 +35,267 @@ func TestChain(t *testing.T) {
 
 	assert.Equal(t, "abc", string(b))
 }
+
+func TestMaintenance(t *testing.T) {
+	m := &Maintenance{ReadOnlyURIs: []string{"get.*"}}
+	assert.False(t, m.Enabled(), "disabled by default")
+	assert.True(t, m.Toggle(), "Toggle enables")
+	assert.False(t, m.Toggle(), "Toggle disables")
+	m.SetEnabled(true)
+	assert.True(t, m.Enabled(), "SetEnabled")
+
+	// allowed requests are passed to the next handler
+	var got []message.Msg
+	h := m.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		got = append(got, msg)
+	}))
+	call, err := message.NewCall("get.user", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	sub := message.NewSub("a", false)
+	unsb := message.NewUnsb("a", false)
+	for _, msg := range []message.Msg{call, sub, unsb} {
+		h.Handle(context.Background(), &juggler.Conn{}, msg)
+	}
+	assert.Equal(t, []message.Msg{call, sub, unsb}, got, "allowed messages")
+
+	// PUB is rejected with a NACK
+	server := &juggler.Server{Handler: m.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		juggler.ProcessMsg(c, msg)
+	}))}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	nacks := make(chan *message.Nack, 1)
+	ch := client.HandlerFunc(func(ctx context.Context, msg message.Msg) {
+		if nack, ok := msg.(*message.Nack); ok {
+			nacks <- nack
+		}
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"pub"}}, client.SetHandler(ch))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	_, err = cli.Pub("a", "b")
+	require.NoError(t, err, "Pub")
+	select {
+	case nack := <-nacks:
+		assert.Equal(t, MaintenanceCode, nack.Payload.Code, "NACK code")
+		assert.Equal(t, ErrMaintenance.Error(), nack.Payload.Message, "NACK message")
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "no NACK received")
+	}
+}
+
+func TestStateChannels(t *testing.T) {
+	s := &StateChannels{Channels: []string{"state.*"}, FullSyncEvery: 2}
+
+	var got []*message.Evnt
+	h := s.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		if ev, ok := msg.(*message.Evnt); ok {
+			got = append(got, ev)
+		}
+	}))
+
+	big := `"` + strings.Repeat("x", 100) + `"`
+	states := []string{
+		`{"a":1,"b":` + big + `}`,
+		`{"a":2,"b":` + big + `}`,
+		`{"a":3,"b":` + big + `}`,
+		`{"a":4,"b":` + big + `}`,
+		`{"c":1}`,
+	}
+	conn := &juggler.Conn{}
+	send := func(channel string, args string) {
+		h.Handle(context.Background(), conn, message.NewEvnt(&message.EvntPayload{Channel: channel, Args: json.RawMessage(args)}))
+	}
+	for _, st := range states {
+		send("state.a", st)
+	}
+	send("other", states[0])
+	send("other", states[1])
+
+	// full, patch, patch, full (after 2 patches), full (patch not smaller),
+	// and events on other channels are left untouched.
+	wantPatch := []bool{false, true, true, false, false, false, false}
+	require.Equal(t, len(wantPatch), len(got), "number of events")
+	var cs client.States
+	for i, ev := range got {
+		assert.Equal(t, wantPatch[i], ev.Payload.Patch, "%d: patch", i)
+		if i < len(states) {
+			state, err := cs.Apply(ev)
+			require.NoError(t, err, "%d: Apply", i)
+			assert.JSONEq(t, states[i], string(state), "%d: state", i)
+		}
+	}
+	assert.JSONEq(t, `{"a":2}`, string(got[1].Payload.Args), "patch arguments")
+
+	// state is forgotten on UNSB
+	h.Handle(context.Background(), conn, message.NewUnsb("state.a", false))
+	got = got[:0]
+	send("state.a", states[0])
+	if assert.Equal(t, 1, len(got), "event after UNSB") {
+		assert.False(t, got[0].Payload.Patch, "full state after UNSB")
+	}
+
+	// an expired event is not diffed, so that the next one is a patch
+	got = got[:0]
+	h.Handle(context.Background(), conn, message.NewEvnt(&message.EvntPayload{Channel: "state.a", Args: json.RawMessage(states[2]),
+		Timestamp: time.Now().UTC().Add(-time.Second), TTL: time.Millisecond}))
+	send("state.a", states[1])
+	if assert.Equal(t, 2, len(got), "events after expired event") {
+		assert.JSONEq(t, states[2], string(got[0].Payload.Args), "expired event untouched")
+		assert.JSONEq(t, `{"a":2}`, string(got[1].Payload.Args), "patch from the last state sent")
+	}
+
+	// the state of an event that expires after the handler is forgotten
+	got = got[:0]
+	send("state.a", states[2])
+	s.Expired(conn, got[0])
+	send("state.a", states[3])
+	if assert.Equal(t, 2, len(got), "events after Expired") {
+		assert.True(t, got[0].Payload.Patch, "patch before Expired")
+		assert.False(t, got[1].Payload.Patch, "full state after Expired")
+	}
+}
+
+func TestNackLimit(t *testing.T) {
+	rejected := errors.New("rejected")
+	nl := &NackLimit{Limit: 2, Window: time.Minute, Vars: new(expvar.Map).Init()}
+	var pubs int32
+	server := &juggler.Server{Handler: nl.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		if pub, ok := msg.(*message.Pub); ok {
+			atomic.AddInt32(&pubs, 1)
+			c.Send(message.NewNack(pub, message.CodeBadRequest, rejected))
+			return
+		}
+		juggler.ProcessMsg(c, msg)
+	}))}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	dial := func() (*client.Client, chan *message.Nack) {
+		nacks := make(chan *message.Nack, 10)
+		ch := client.HandlerFunc(func(ctx context.Context, msg message.Msg) {
+			if nack, ok := msg.(*message.Nack); ok {
+				nacks <- nack
+			}
+		})
+		cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+			http.Header{"Juggler-Allowed-Messages": {"pub"}}, client.SetHandler(ch))
+		require.NoError(t, err, "Dial")
+		return cli, nacks
+	}
+
+	// throttle: the third NACK and the following requests are dropped
+	cli, nacks := dial()
+	defer cli.Close()
+	for i := 0; i < 4; i++ {
+		_, err := cli.Pub("a", nil)
+		require.NoError(t, err, "Pub %d", i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, len(nacks), "NACKs received")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&pubs), "requests processed")
+	assert.Equal(t, "1", nl.Vars.Get("NackLimitExceeded").String(), "NackLimitExceeded")
+	assert.Equal(t, "2", nl.Vars.Get("NackThrottledMsgs").String(), "NackThrottledMsgs")
+
+	offs := nl.Offenders()
+	if assert.Equal(t, 1, len(offs), "offenders") {
+		assert.Equal(t, 1, offs[0].Exceeded, "exceeded")
+		assert.True(t, offs[0].Throttled, "throttled")
+	}
+
+	// close: the connection is closed when the limit is exceeded
+	nl.Action = NackClose
+	cli2, _ := dial()
+	defer cli2.Close()
+	for i := 0; i < 3; i++ {
+		_, err := cli2.Pub("a", nil)
+		require.NoError(t, err, "Pub %d", i)
+	}
+	select {
+	case <-cli2.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "connection not closed")
+	}
+	assert.Equal(t, "1", nl.Vars.Get("NackLimitCloses").String(), "NackLimitCloses")
+}
+
+func TestConnections(t *testing.T) {
+	cs := &Connections{}
+	conns := make(chan *juggler.Conn, 1)
+	server := &juggler.Server{ConnState: func(c *juggler.Conn, state juggler.ConnState) {
+		cs.ConnState(c, state)
+		if state == juggler.Connected {
+			conns <- c
+		}
+	}}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"pub"}})
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	var conn *juggler.Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(time.Second):
+		require.Fail(t, "no connection")
+	}
+
+	h := cs.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {}))
+	send := func(m message.Msg) {
+		h.Handle(context.Background(), conn, m)
+	}
+	sub1, sub2, sub3 := message.NewSub("a", false), message.NewSub("b.*", true), message.NewSub("c", false)
+	call1, err := message.NewCall("x", nil, time.Minute)
+	require.NoError(t, err, "NewCall")
+	call2, err := message.NewCall("y", nil, time.Minute)
+	require.NoError(t, err, "NewCall")
+	for _, m := range []message.Msg{sub1, sub2, sub3, call1, call2} {
+		send(m)
+	}
+	send(message.NewAck(sub1))
+	send(message.NewAck(sub2))
+	send(message.NewNack(sub3, message.CodeForbidden, errors.New("forbidden")))
+	send(message.NewAck(call1))
+	send(message.NewAck(call2))
+	send(message.NewRes(&message.ResPayload{MsgUUID: call2.UUID(), URI: "y"}))
+
+	infos := cs.List()
+	if assert.Equal(t, 1, len(infos), "connections") {
+		assert.Equal(t, conn.UUID.String(), infos[0].ConnUUID, "UUID")
+		assert.Equal(t, []string{"a"}, infos[0].Channels, "channels")
+		assert.Equal(t, []string{"b.*"}, infos[0].Patterns, "patterns")
+		assert.Equal(t, 1, infos[0].InFlightCalls, "in-flight calls")
+	}
+
+	send(message.NewUnsb("a", false))
+	send(message.NewAck(message.NewUnsb("other", false)))
+	infos = cs.List()
+	if assert.Equal(t, 1, len(infos), "connections") {
+		assert.Equal(t, []string{"a"}, infos[0].Channels, "UNSB not acknowledged")
+	}
+
+	assert.False(t, cs.Close("nope", nil), "unknown connection")
+	assert.True(t, cs.Close(conn.UUID.String(), errors.New("closed")), "Close")
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "connection not closed")
+	}
+	// the Closed state may be reported after the client is notified
+	for i := 0; i < 100 && len(cs.List()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, len(cs.List()), "no connection")
+}
@@ -0,0 +1,243 @@
+package srvhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// ErrSystemChannel is the error of the NACK returned for the PUB
+// requests on a system channel, and for the SUB requests on a system
+// channel by connections that are not privileged.
+var ErrSystemChannel = errors.New("reserved system channel")
+
+// SystemChannels publishes the structural events of a server on the
+// system channels (see message.SystemChannelPrefix): the connections
+// opened and closed, the calls that expired without result and the
+// server shutting down. Its ConnState method must be called by the
+// Server's ConnState function, and its Handler must be in the Server's
+// handler chain, so that the calls are tracked and the system channels
+// are reserved.
+type SystemChannels struct {
+	// Broker is the broker used to publish the events.
+	Broker broker.PubSubBroker
+
+	// ServerID identifies the server in the events.
+	ServerID string
+
+	// Privileged returns true if the connection can subscribe to the
+	// system channels. If nil, no connection can.
+	Privileged func(*juggler.Conn) bool
+
+	// Vars can be set to an *expvar.Map to collect metrics about the
+	// system events.
+	Vars *expvar.Map
+
+	// LogFunc is the function used to log the events that could not be
+	// published. If nil, the errors are not logged.
+	LogFunc func(string, ...interface{})
+
+	mu    sync.Mutex
+	conns map[*juggler.Conn]*systemConn
+}
+
+// systemConn is the state of a connection opened on the server.
+type systemConn struct {
+	pending map[string]*message.Call // CALL waiting for their ACK
+	calls   map[string]*time.Timer   // in-flight calls, until they expire
+}
+
+// ConnState publishes the connections when they are connected and
+// when they are closed.
+func (s *SystemChannels) ConnState(c *juggler.Conn, state juggler.ConnState) {
+	switch state {
+	case juggler.Connected:
+		s.mu.Lock()
+		if s.conns == nil {
+			s.conns = make(map[*juggler.Conn]*systemConn)
+		}
+		s.conns[c] = &systemConn{
+			pending: make(map[string]*message.Call),
+			calls:   make(map[string]*time.Timer),
+		}
+		s.mu.Unlock()
+
+		s.publish(message.ConnsChannel, s.connEvent(message.ConnOpenedEvent, c))
+
+	case juggler.Closed:
+		s.mu.Lock()
+		sc := s.conns[c]
+		delete(s.conns, c)
+		if sc != nil {
+			for _, t := range sc.calls {
+				t.Stop()
+			}
+		}
+		s.mu.Unlock()
+
+		// the connections rejected before they were connected are not
+		// published.
+		if sc != nil {
+			ev := s.connEvent(message.ConnClosedEvent, c)
+			if c.CloseErr != nil {
+				ev.Error = c.CloseErr.Error()
+			}
+			s.publish(message.ConnsChannel, ev)
+		}
+	}
+}
+
+// Shutdown publishes that the server is shutting down.
+func (s *SystemChannels) Shutdown() error {
+	return s.publishErr(message.ServerChannel, &message.SystemEvent{
+		Event:     message.ServerShutdownEvent,
+		ServerID:  s.ServerID,
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+func (s *SystemChannels) connEvent(event string, c *juggler.Conn) *message.SystemEvent {
+	return &message.SystemEvent{
+		Event:     event,
+		ServerID:  s.ServerID,
+		ConnUUID:  c.UUID,
+		Identity:  c.Identity,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// Handler returns a juggler.Handler that reserves the system channels
+// and tracks the calls of the connections before calling h. The PUB
+// requests on a system channel, and the SUB requests on a system
+// channel by a connection that is not privileged, are rejected with a
+// NACK with message.CodeForbidden. The events of the system channels
+// received via a pattern subscription are dropped for the connections
+// that are not privileged.
+func (s *SystemChannels) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		switch m := msg.(type) {
+		case *message.Pub:
+			if message.IsSystemChannel(m.Payload.Channel) {
+				c.Send(message.NewNack(m, message.CodeForbidden, ErrSystemChannel))
+				return
+			}
+		case *message.Sub:
+			if !m.Payload.Pattern && message.IsSystemChannel(m.Payload.Channel) && !s.isPrivileged(c) {
+				c.Send(message.NewNack(m, message.CodeForbidden, ErrSystemChannel))
+				return
+			}
+		case *message.Evnt:
+			if message.IsSystemChannel(m.Payload.Channel) && !s.isPrivileged(c) {
+				return
+			}
+		}
+		s.track(c, msg)
+		h.Handle(ctx, c, msg)
+	})
+}
+
+func (s *SystemChannels) isPrivileged(c *juggler.Conn) bool {
+	return s.Privileged != nil && s.Privileged(c)
+}
+
+// track starts the expiration timer of the calls once they are
+// acknowledged, or when they are received for the fire-and-forget calls
+// (see message.NoAck), and stops it when their result or NACK is sent.
+func (s *SystemChannels) track(c *juggler.Conn, msg message.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc := s.conns[c]
+	if sc == nil {
+		return
+	}
+
+	switch m := msg.(type) {
+	case *message.Call:
+		if m.Payload.NoAck {
+			s.startExpiration(c, sc, m)
+			return
+		}
+		sc.pending[m.UUID().String()] = m
+
+	case *message.Nack:
+		id := m.Payload.For.String()
+		delete(sc.pending, id)
+		sc.stopExpiration(id)
+
+	case *message.Ack:
+		id := m.Payload.For.String()
+		call := sc.pending[id]
+		if call == nil {
+			return
+		}
+		delete(sc.pending, id)
+		s.startExpiration(c, sc, call)
+
+	case *message.Res:
+		sc.stopExpiration(m.Payload.For.String())
+	}
+}
+
+func (s *SystemChannels) startExpiration(c *juggler.Conn, sc *systemConn, call *message.Call) {
+	sc.calls[call.UUID().String()] = time.AfterFunc(juggler.CallWait(call), func() {
+		s.expired(c, call)
+	})
+}
+
+func (sc *systemConn) stopExpiration(id string) {
+	if t := sc.calls[id]; t != nil {
+		t.Stop()
+		delete(sc.calls, id)
+	}
+}
+
+// expired publishes the call that expired without result.
+func (s *SystemChannels) expired(c *juggler.Conn, call *message.Call) {
+	s.mu.Lock()
+	sc := s.conns[c]
+	var ok bool
+	if sc != nil {
+		id := call.UUID().String()
+		_, ok = sc.calls[id]
+		delete(sc.calls, id)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ev := s.connEvent(message.CallExpiredEvent, c)
+	ev.MsgUUID = call.UUID()
+	ev.URI = call.Payload.URI
+	s.publish(message.CallsChannel, ev)
+}
+
+func (s *SystemChannels) publish(channel string, ev *message.SystemEvent) {
+	if err := s.publishErr(channel, ev); err != nil && s.LogFunc != nil {
+		s.LogFunc("failed to publish %s system event: %v", ev.Event, err)
+	}
+}
+
+func (s *SystemChannels) publishErr(channel string, ev *message.SystemEvent) error {
+	b, err := json.Marshal(ev)
+	if err == nil {
+		pp := &message.PubPayload{MsgUUID: message.NewID(), Args: b, Timestamp: ev.Timestamp}
+		err = s.Broker.Publish(channel, pp)
+	}
+	if s.Vars != nil {
+		if err != nil {
+			s.Vars.Add("FailedSystemEvents", 1)
+		} else {
+			s.Vars.Add("SystemEvents", 1)
+		}
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package srvhandler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeSystemBroker struct {
+	events chan *message.SystemEvent
+}
+
+func (f fakeSystemBroker) NewPubSubConn() (broker.PubSubConn, error) {
+	return fakePubSubConn{make(chan *message.EvntPayload)}, nil
+}
+
+func (f fakeSystemBroker) Publish(channel string, pp *message.PubPayload) error {
+	var ev message.SystemEvent
+	if err := json.Unmarshal(pp.Args, &ev); err != nil {
+		return err
+	}
+	if !message.IsSystemChannel(channel) {
+		ev.Event = "unexpected channel " + channel
+	}
+	f.events <- &ev
+	return nil
+}
+
+type fakePubSubConn struct {
+	ch chan *message.EvntPayload
+}
+
+func (f fakePubSubConn) Subscribe(channel string, pattern bool) error   { return nil }
+func (f fakePubSubConn) Unsubscribe(channel string, pattern bool) error { return nil }
+func (f fakePubSubConn) Events() <-chan *message.EvntPayload            { return f.ch }
+func (f fakePubSubConn) EventsErr() error                               { return nil }
+func (f fakePubSubConn) Close() error                                   { close(f.ch); return nil }
+
+func TestSystemChannels(t *testing.T) {
+	fb := fakeSystemBroker{make(chan *message.SystemEvent, 10)}
+	var privileged int32
+	s := &SystemChannels{
+		Broker:     fb,
+		ServerID:   "srv-1",
+		Privileged: func(*juggler.Conn) bool { return atomic.LoadInt32(&privileged) == 1 },
+	}
+
+	server := &juggler.Server{
+		ConnState:    s.ConnState,
+		PubSubBroker: fb,
+		CallerBroker: fakeCallerBroker{},
+		Handler: s.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+			if msg.Type() == message.CallMsg {
+				// acknowledge the call, it never gets a result
+				c.Send(message.NewAck(msg))
+				return
+			}
+			juggler.ProcessMsg(c, msg)
+		})),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	replies := make(chan message.Msg, 1)
+	ch := client.HandlerFunc(func(ctx context.Context, msg message.Msg) {
+		switch msg.(type) {
+		case *message.Ack, *message.Nack:
+			replies <- msg
+		}
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, nil, client.SetHandler(ch))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	waitEvent := func(event string) *message.SystemEvent {
+		select {
+		case ev := <-fb.events:
+			assert.Equal(t, event, ev.Event, "event")
+			assert.Equal(t, "srv-1", ev.ServerID, "server ID")
+			return ev
+		case <-time.After(time.Second):
+			assert.Fail(t, "no event", event)
+			return nil
+		}
+	}
+	waitReply := func(typ message.Type, name string) message.Msg {
+		select {
+		case msg := <-replies:
+			assert.Equal(t, typ, msg.Type(), name)
+			return msg
+		case <-time.After(time.Second):
+			assert.Fail(t, "no reply", name)
+			return nil
+		}
+	}
+
+	waitEvent(message.ConnOpenedEvent)
+
+	// the system channels are reserved
+	_, err = cli.Pub(message.ConnsChannel, "x")
+	require.NoError(t, err, "Pub")
+	if nack, ok := waitReply(message.NackMsg, "Pub").(*message.Nack); ok {
+		assert.Equal(t, message.CodeForbidden, nack.Payload.Code, "Pub code")
+	}
+	_, err = cli.Sub(message.ConnsChannel, false)
+	require.NoError(t, err, "Sub")
+	waitReply(message.NackMsg, "Sub not privileged")
+
+	atomic.StoreInt32(&privileged, 1)
+	_, err = cli.Sub(message.ConnsChannel, false)
+	require.NoError(t, err, "Sub privileged")
+	waitReply(message.AckMsg, "Sub privileged")
+
+	// the call expires without result
+	id, err := cli.Call("a", nil, 10*time.Millisecond)
+	require.NoError(t, err, "Call")
+	waitReply(message.AckMsg, "Call")
+	if ev := waitEvent(message.CallExpiredEvent); ev != nil {
+		assert.Equal(t, id.String(), ev.MsgUUID.String(), "call UUID")
+		assert.Equal(t, "a", ev.URI, "call URI")
+	}
+
+	cli.Close()
+	waitEvent(message.ConnClosedEvent)
+}
@@ -0,0 +1,76 @@
+// Package uuidstr interns the string forms of long-lived UUIDs, such
+// as connection UUIDs, that are used repeatedly to build Redis keys and
+// log fields. It avoids allocating a new string on each call to
+// uuid.UUID.String in the hot paths.
+//
+// Only UUIDs that are used many times should be interned, message UUIDs
+// are unique per message and gain nothing from it.
+package uuidstr
+
+import (
+	"sync"
+
+	"github.com/pborman/uuid"
+)
+
+// MaxEntries is the maximum number of interned UUIDs. When it is reached,
+// all interned UUIDs are dropped, so that UUIDs that are never forgotten
+// (e.g. connection UUIDs seen by a callee) cannot grow the table forever.
+const MaxEntries = 10000
+
+var table = struct {
+	sync.RWMutex
+	m map[[16]byte]string
+}{m: make(map[[16]byte]string)}
+
+// String returns the string form of id, from the table of interned
+// UUIDs if possible. If it is not interned yet, it is added to
+// the table. It returns an empty string if id is not a valid UUID.
+func String(id uuid.UUID) string {
+	if len(id) != 16 {
+		return ""
+	}
+
+	var k [16]byte
+	copy(k[:], id)
+
+	table.RLock()
+	s, ok := table.m[k]
+	table.RUnlock()
+	if ok {
+		return s
+	}
+
+	s = id.String()
+	table.Lock()
+	if len(table.m) >= MaxEntries {
+		table.m = make(map[[16]byte]string)
+	}
+	table.m[k] = s
+	table.Unlock()
+	return s
+}
+
+// Forget removes id from the table of interned UUIDs. It should be
+// called once id is not used anymore, e.g. when the connection it
+// identifies is closed.
+func Forget(id uuid.UUID) {
+	if len(id) != 16 {
+		return
+	}
+
+	var k [16]byte
+	copy(k[:], id)
+
+	table.Lock()
+	delete(table.m, k)
+	table.Unlock()
+}
+
+// Len returns the number of interned UUIDs.
+func Len() int {
+	table.RLock()
+	n := len(table.m)
+	table.RUnlock()
+	return n
+}
@@ -0,0 +1,35 @@
+package uuidstr
+
+import (
+	"testing"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestString(t *testing.T) {
+	id := uuid.NewRandom()
+	n := Len()
+
+	s := String(id)
+	assert.Equal(t, id.String(), s, "string form")
+	assert.Equal(t, n+1, Len(), "interned")
+	assert.Equal(t, s, String(uuid.Parse(s)), "same UUID, other slice")
+	assert.Equal(t, n+1, Len(), "interned once")
+
+	allocs := testing.AllocsPerRun(100, func() { String(id) })
+	assert.Equal(t, 0.0, allocs, "allocations of interned UUID")
+
+	Forget(id)
+	assert.Equal(t, n, Len(), "forgotten")
+
+	assert.Equal(t, "", String(uuid.UUID{1, 2}), "invalid UUID")
+	assert.Equal(t, n, Len(), "invalid UUID not interned")
+}
+
+func TestMaxEntries(t *testing.T) {
+	for i := 0; i <= MaxEntries; i++ {
+		String(uuid.NewRandom())
+	}
+	assert.True(t, Len() <= MaxEntries, "bounded table")
+}
@@ -15,6 +15,11 @@ import (
 // the timeout.
 var ErrWriteLockTimeout = errors.New("juggler: timed out waiting for write lock")
 
+// ErrWriteCanceled is returned when a Write call to an exclusive writer
+// fails because its done channel is closed before the write lock of
+// the connection is acquired.
+var ErrWriteCanceled = errors.New("juggler: write canceled")
+
 // exclusiveWriter implements an io.WriteCloser that acquires the
 // connection's write lock prior to writing.
 type exclusiveWriter struct {
@@ -24,6 +29,7 @@ type exclusiveWriter struct {
 	lockTimeout  time.Duration
 	writeTimeout time.Duration
 	wsConn       *websocket.Conn
+	done         <-chan struct{}
 }
 
 // Exclusive creates an exclusive websocket writer. It uses the lock channel
@@ -32,11 +38,19 @@ type exclusiveWriter struct {
 // used to set the write deadline on the connection, and conn is the
 // websocket connection to write to.
 func Exclusive(conn *websocket.Conn, lock chan struct{}, acquireTimeout, writeTimeout time.Duration) io.WriteCloser {
+	return ExclusiveDone(conn, lock, nil, acquireTimeout, writeTimeout)
+}
+
+// ExclusiveDone creates an exclusive websocket writer like Exclusive,
+// that also fails with an ErrWriteCanceled if the done channel is closed
+// before it acquires the lock. A nil done channel is never closed.
+func ExclusiveDone(conn *websocket.Conn, lock chan struct{}, done <-chan struct{}, acquireTimeout, writeTimeout time.Duration) io.WriteCloser {
 	return &exclusiveWriter{
 		writeLock:    lock,
 		lockTimeout:  acquireTimeout,
 		writeTimeout: writeTimeout,
 		wsConn:       conn,
+		done:         done,
 	}
 }
 
@@ -55,6 +69,9 @@ func (w *exclusiveWriter) Write(p []byte) (int, error) {
 		case <-wait:
 			return 0, ErrWriteLockTimeout
 
+		case <-w.done:
+			return 0, ErrWriteCanceled
+
 		case <-w.writeLock:
 			// lock acquired, get next writer from the websocket connection
 			w.init = true
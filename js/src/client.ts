@@ -0,0 +1,595 @@
+// This file implements a juggler client for the browsers, the
+// counterpart of the Go client package. A Client makes calls to the RPC
+// functions identified by a URI and resolves them with their result,
+// subscribes to pub-sub channels with a handler of their events, and
+// publishes events. It reconnects with an exponential backoff when the
+// connection is lost, and subscribes again to its channels.
+//
+// The message definitions are generated from the Go messages by
+// juggler-tsgen (see messages.ts), the UUIDs are generated by the
+// client, and the timeouts and durations of this file are milliseconds.
+
+import {
+  Ack,
+  Call,
+  CodeTimeout,
+  CodeUnavailable,
+  Evnt,
+  EvntAck,
+  EvntAckURI,
+  MsgType,
+  Nack,
+  Pub,
+  RequestMsg,
+  Res,
+  ResponseMsg,
+  RoutingMode,
+  Sub,
+  Subprotocols,
+  Unsb,
+} from "./messages";
+
+// JugglerError is the error of a request rejected by the server with a
+// NACK, or that failed without response, e.g. because the connection
+// was closed (CodeUnavailable) or the call expired (CodeTimeout).
+export class JugglerError extends Error {
+  // code is the code of the NACK, see the Code constants.
+  readonly code: number;
+
+  // details is the details of the NACK, if any.
+  readonly details?: unknown;
+
+  constructor(code: number, message: string, details?: unknown) {
+    super(message);
+    this.name = "JugglerError";
+    this.code = code;
+    this.details = details;
+  }
+}
+
+// ResultError is the error of a call that returns an error result (see
+// message.ErrResult).
+export class ResultError extends Error {
+  // uri is the URI of the call.
+  readonly uri: string;
+
+  // result is the error result, which may have more fields than the
+  // message.
+  readonly result: unknown;
+
+  constructor(uri: string, message: string, result: unknown) {
+    super(`call to ${uri} failed: ${message}`);
+    this.name = "ResultError";
+    this.uri = uri;
+    this.result = result;
+  }
+}
+
+// State is the state of the connection of a Client.
+export type State = "connecting" | "connected" | "disconnected" | "closed";
+
+// WebSocketConstructor is the constructor of the websockets, so that
+// another implementation than the browser's can be used.
+export type WebSocketConstructor = new (url: string, protocols?: string | string[]) => WebSocket;
+
+// ClientOptions are the options of a Client.
+export interface ClientOptions {
+  // token returns the token of the auth handshake. It is called before
+  // each connection, so that an expired token can be renewed, and the
+  // token is sent in the tokenParam query parameter of the URL, as the
+  // browsers cannot set the headers of a websocket request. No token is
+  // sent if it is not set or returns an empty string.
+  token?: () => string | Promise<string>;
+
+  // tokenParam is the query parameter of the token, "access_token" by
+  // default.
+  tokenParam?: string;
+
+  // callTimeout is the default timeout of the calls, 60s by default.
+  callTimeout?: number;
+
+  // reconnect enables the reconnection when the connection is lost,
+  // true by default.
+  reconnect?: boolean;
+
+  // minBackoff and maxBackoff bound the delay before a reconnection,
+  // which doubles after each failed attempt, 500ms and 30s by default.
+  minBackoff?: number;
+  maxBackoff?: number;
+
+  // onStateChange is called when the state of the connection changes,
+  // with the error that caused the disconnection, if any.
+  onStateChange?: (state: State, err?: Error) => void;
+
+  // onError is called with the errors that cannot be returned to a
+  // caller, e.g. a subscription that fails after a reconnection.
+  onError?: (err: Error) => void;
+
+  // WebSocket is the constructor of the websockets, the global
+  // WebSocket by default.
+  WebSocket?: WebSocketConstructor;
+}
+
+// CallOptions are the options of a call.
+export interface CallOptions {
+  // timeout is the timeout of the call, the callTimeout of the client
+  // by default.
+  timeout?: number;
+  routing?: RoutingMode;
+  routingKey?: string;
+  priority?: number;
+  version?: string;
+}
+
+// EventHandler is the handler of the events of a subscription. In
+// acknowledged mode, the event is acknowledged once the handler returns,
+// or once its promise is resolved.
+export type EventHandler = (ev: Evnt) => void | Promise<void>;
+
+// SubOptions are the options of a subscription.
+export interface SubOptions {
+  // pattern subscribes to the channels that match the channel pattern.
+  pattern?: boolean;
+
+  // acked subscribes in acknowledged mode, where the events that are
+  // not acknowledged are delivered again when the client subscribes
+  // again, e.g. after a reconnection. It requires an identity.
+  acked?: boolean;
+
+  // sticky ties the subscription to the identity, so that all its
+  // connections receive the events, e.g. in the other tabs of the
+  // browser, until it is removed by a sticky unsb. A client only
+  // dispatches the events of the channels it has a handler for. It
+  // requires an identity.
+  sticky?: boolean;
+}
+
+// pending is a request waiting for its response.
+interface pending {
+  type: MsgType;
+  resolve: (v: unknown) => void;
+  reject: (err: Error) => void;
+  timer?: ReturnType<typeof setTimeout>;
+}
+
+// subscription is a subscription of the client, made again after a
+// reconnection.
+interface subscription {
+  channel: string;
+  pattern: boolean;
+  acked: boolean;
+  sticky: boolean;
+  handler: EventHandler;
+}
+
+const DefaultCallTimeout = 60000;
+const DefaultMinBackoff = 500;
+const DefaultMaxBackoff = 30000;
+
+// Client is a juggler client. The requests made while it is connecting
+// are sent once it is connected, and they are rejected if the connection
+// is lost before their response.
+export class Client {
+  private readonly url: string;
+  private readonly opts: ClientOptions;
+  private ws?: WebSocket;
+  private state: State = "disconnected";
+  private attempts = 0;
+  private retryTimer?: ReturnType<typeof setTimeout>;
+  private opening?: Promise<void>;
+  private outbox: RequestMsg[] = [];
+  private readonly pendings = new Map<string, pending>();
+  private readonly subs = new Map<string, subscription>();
+
+  constructor(url: string, opts: ClientOptions = {}) {
+    this.url = url;
+    this.opts = opts;
+  }
+
+  // connect opens the connection. The returned promise is resolved once
+  // it is connected, or rejected if the first attempt fails, in which
+  // case the client still reconnects if the reconnection is enabled.
+  connect(): Promise<void> {
+    if (this.state === "closed") {
+      return Promise.reject(new JugglerError(CodeUnavailable, "closed client"));
+    }
+    return this.open();
+  }
+
+  // close closes the connection and rejects the pending requests. The
+  // client cannot be used afterwards.
+  close(): void {
+    this.setState("closed");
+    if (this.retryTimer !== undefined) {
+      clearTimeout(this.retryTimer);
+    }
+    if (this.ws) {
+      this.ws.close(1000);
+      this.ws = undefined;
+    }
+    this.rejectAll(new JugglerError(CodeUnavailable, "closed client"));
+    this.outbox = [];
+  }
+
+  // call makes a call request to uri with args, and resolves with its
+  // result. It is rejected with a JugglerError if the request is
+  // rejected or expires, and with a ResultError if the call returns an
+  // error result.
+  call<T = unknown>(uri: string, args?: unknown, opts: CallOptions = {}): Promise<T> {
+    const timeout = opts.timeout || this.opts.callTimeout || DefaultCallTimeout;
+    const m: Call = {
+      meta: { type: MsgType.CALL, uuid: newUUID() },
+      payload: {
+        uri: uri,
+        timeout: Math.round(timeout * 1e6),
+        args: args === undefined ? null : args,
+        routing: opts.routing,
+        routing_key: opts.routingKey,
+        priority: opts.priority,
+        version: opts.version,
+      },
+    };
+    return this.request(m, timeout).then((res) => {
+      const args = (res as Res).payload.args;
+      const msg = errResultMessage(args);
+      if (msg !== undefined) {
+        throw new ResultError(uri, msg, args);
+      }
+      return args as T;
+    });
+  }
+
+  // pub publishes an event with args on channel, and resolves once it
+  // is acknowledged by the server. The ttl is the time to live of the
+  // event, if any.
+  pub(channel: string, args?: unknown, ttl?: number): Promise<void> {
+    const m: Pub = {
+      meta: { type: MsgType.PUB, uuid: newUUID() },
+      payload: {
+        channel: channel,
+        args: args === undefined ? null : args,
+        ttl: ttl ? Math.round(ttl * 1e6) : undefined,
+      },
+    };
+    return this.request(m).then(() => undefined);
+  }
+
+  // sub subscribes to channel with the handler of its events, replacing
+  // the handler of an existing subscription, and resolves once the
+  // subscription is acknowledged by the server. The client subscribes
+  // again after a reconnection, until unsb is called.
+  sub(channel: string, handler: EventHandler, opts: SubOptions = {}): Promise<void> {
+    const s: subscription = {
+      channel: channel,
+      pattern: !!opts.pattern,
+      acked: !!opts.acked,
+      sticky: !!opts.sticky,
+      handler: handler,
+    };
+    this.subs.set(subKey(s.channel, s.pattern), s);
+    return this.subscribe(s).catch((err) => {
+      if (this.subs.get(subKey(s.channel, s.pattern)) === s) {
+        this.subs.delete(subKey(s.channel, s.pattern));
+      }
+      throw err;
+    });
+  }
+
+  // unsb unsubscribes from channel, and resolves once the unsubscription
+  // is acknowledged by the server. If sticky is true, the sticky
+  // subscription is removed for all the connections of the identity.
+  unsb(channel: string, pattern = false, sticky = false): Promise<void> {
+    this.subs.delete(subKey(channel, pattern));
+    const m: Unsb = {
+      meta: { type: MsgType.UNSB, uuid: newUUID() },
+      payload: { channel: channel, pattern: pattern, sticky: sticky || undefined },
+    };
+    return this.request(m).then(() => undefined);
+  }
+
+  // ackEvnts acknowledges the events of the subscriptions in acknowledged
+  // mode by their delivery tags, and resolves with the tags that were
+  // acknowledged. The events are acknowledged automatically once their
+  // handler is done.
+  ackEvnts(...tags: string[]): Promise<string[]> {
+    const args: EvntAck = { tags: tags };
+    return this.call<EvntAck>(EvntAckURI, args).then((res) => res.tags);
+  }
+
+  private subscribe(s: subscription): Promise<void> {
+    const m: Sub = {
+      meta: { type: MsgType.SUB, uuid: newUUID() },
+      payload: { channel: s.channel, pattern: s.pattern, acked: s.acked || undefined, sticky: s.sticky || undefined },
+    };
+    return this.request(m).then(() => undefined);
+  }
+
+  // request sends m and resolves with its response: the ACK, or the RES
+  // of a CALL. If timeout is set, it is rejected if the response is not
+  // received in time.
+  private request(m: RequestMsg, timeout?: number): Promise<unknown> {
+    if (this.state === "closed") {
+      return Promise.reject(new JugglerError(CodeUnavailable, "closed client"));
+    }
+
+    return new Promise((resolve, reject) => {
+      const p: pending = { type: m.meta.type, resolve: resolve, reject: reject };
+      if (timeout !== undefined) {
+        p.timer = setTimeout(() => {
+          if (this.pendings.delete(m.meta.uuid)) {
+            reject(new JugglerError(CodeTimeout, "call expired"));
+          }
+        }, timeout);
+      }
+      this.pendings.set(m.meta.uuid, p);
+      this.send(m);
+    });
+  }
+
+  private send(m: RequestMsg): void {
+    if (this.state !== "connected" || !this.ws) {
+      this.outbox.push(m);
+      if (this.state === "disconnected" && this.retryTimer === undefined) {
+        this.open().catch(() => undefined);
+      }
+      return;
+    }
+    this.ws.send(JSON.stringify(m));
+  }
+
+  // open opens the connection, unless it is already connected, and
+  // returns the promise of the connection attempt in progress, if any.
+  private open(): Promise<void> {
+    if (this.state === "connected") {
+      return Promise.resolve();
+    }
+    if (!this.opening) {
+      const done = () => {
+        this.opening = undefined;
+      };
+      this.opening = this.dial();
+      this.opening.then(done, done);
+    }
+    return this.opening;
+  }
+
+  private async dial(): Promise<void> {
+    if (this.retryTimer !== undefined) {
+      clearTimeout(this.retryTimer);
+      this.retryTimer = undefined;
+    }
+    this.setState("connecting");
+
+    let url = this.url;
+    try {
+      const token = this.opts.token ? await this.opts.token() : "";
+      if (this.state !== "connecting") {
+        throw new JugglerError(CodeUnavailable, "closed client");
+      }
+      if (token) {
+        const param = this.opts.tokenParam || "access_token";
+        url += (url.indexOf("?") < 0 ? "?" : "&") + encodeURIComponent(param) + "=" + encodeURIComponent(token);
+      }
+    } catch (err) {
+      this.disconnected(asError(err));
+      throw err;
+    }
+
+    const WS = this.opts.WebSocket || WebSocket;
+    return new Promise<void>((resolve, reject) => {
+      const ws = new WS(url, Subprotocols);
+      let opened = false;
+      this.ws = ws;
+
+      ws.onopen = () => {
+        if (Subprotocols.indexOf(ws.protocol) < 0) {
+          ws.close(1000, "unsupported subprotocol");
+          return;
+        }
+        opened = true;
+        this.attempts = 0;
+        this.setState("connected");
+        this.resubscribe();
+        const outbox = this.outbox;
+        this.outbox = [];
+        for (const m of outbox) {
+          this.send(m);
+        }
+        resolve();
+      };
+      ws.onmessage = (ev: MessageEvent) => this.receive(ev.data);
+      ws.onclose = (ev: CloseEvent) => {
+        const err = new JugglerError(CodeUnavailable, `connection closed (${ev.code}${ev.reason ? ": " + ev.reason : ""})`);
+        if (!opened) {
+          reject(err);
+        }
+        // the client may have been closed in the meantime
+        if (this.ws === ws) {
+          this.ws = undefined;
+          this.disconnected(err);
+        }
+      };
+    });
+  }
+
+  // disconnected rejects the pending requests, and reconnects after the
+  // backoff delay if the reconnection is enabled.
+  private disconnected(err: Error): void {
+    if (this.state === "closed") {
+      return;
+    }
+    this.setState("disconnected", err);
+    // the requests that were not sent are rejected too, so that they are
+    // not sent after the reconnection
+    this.outbox = [];
+    this.rejectAll(err);
+    if (this.opts.reconnect === false) {
+      return;
+    }
+
+    const min = this.opts.minBackoff || DefaultMinBackoff;
+    const max = this.opts.maxBackoff || DefaultMaxBackoff;
+    const delay = Math.min(max, min * Math.pow(2, this.attempts));
+    this.attempts++;
+    // the jitter spreads the reconnections of the clients of a server
+    // that went down
+    this.retryTimer = setTimeout(() => {
+      this.retryTimer = undefined;
+      this.open().catch(() => undefined);
+    }, delay / 2 + Math.random() * delay / 2);
+  }
+
+  private resubscribe(): void {
+    this.subs.forEach((s) => {
+      // the server restores the sticky subscriptions that were not
+      // removed by another connection of the identity
+      if (s.sticky) {
+        return;
+      }
+      // the subscription may have been replaced or removed in the meantime
+      this.subscribe(s).catch((err) => {
+        if (this.subs.get(subKey(s.channel, s.pattern)) === s) {
+          this.subs.delete(subKey(s.channel, s.pattern));
+          this.reportError(err);
+        }
+      });
+    });
+  }
+
+  private rejectAll(err: Error): void {
+    const pendings = Array.from(this.pendings.values());
+    this.pendings.clear();
+    for (const p of pendings) {
+      if (p.timer !== undefined) {
+        clearTimeout(p.timer);
+      }
+      p.reject(err);
+    }
+  }
+
+  private receive(data: unknown): void {
+    let m: ResponseMsg;
+    try {
+      m = JSON.parse(String(data));
+    } catch (err) {
+      this.reportError(asError(err));
+      return;
+    }
+
+    switch (m.meta.type) {
+      case MsgType.ACK: {
+        const ack = m as Ack;
+        const p = this.pendings.get(ack.payload.for);
+        // the CALL waits for its RES, that may have been received first
+        if (p && p.type !== MsgType.CALL) {
+          this.settle(ack.payload.for, p).resolve(ack);
+        }
+        break;
+      }
+      case MsgType.NACK: {
+        const nack = m as Nack;
+        const p = this.pendings.get(nack.payload.for);
+        if (p) {
+          this.settle(nack.payload.for, p).reject(new JugglerError(nack.payload.code, nack.payload.message, nack.payload.details));
+        }
+        break;
+      }
+      case MsgType.RES: {
+        const res = m as Res;
+        const p = this.pendings.get(res.payload.for);
+        if (p) {
+          this.settle(res.payload.for, p).resolve(res);
+        }
+        break;
+      }
+      case MsgType.EVNT:
+        this.dispatch(m as Evnt);
+        break;
+    }
+  }
+
+  private settle(id: string, p: pending): pending {
+    this.pendings.delete(id);
+    if (p.timer !== undefined) {
+      clearTimeout(p.timer);
+    }
+    return p;
+  }
+
+  private dispatch(ev: Evnt): void {
+    const pl = ev.payload;
+    const s = pl.pattern ? this.subs.get(subKey(pl.pattern, true)) : this.subs.get(subKey(pl.channel || "", false));
+    if (!s) {
+      return;
+    }
+
+    Promise.resolve()
+      .then(() => s.handler(ev))
+      .then(
+        () => {
+          if (pl.tag) {
+            return this.ackEvnts(pl.tag).then(() => undefined);
+          }
+        },
+        (err) => this.reportError(asError(err))
+      )
+      .catch((err) => this.reportError(asError(err)));
+  }
+
+  private setState(state: State, err?: Error): void {
+    if (this.state === state) {
+      return;
+    }
+    this.state = state;
+    if (this.opts.onStateChange) {
+      this.opts.onStateChange(state, err);
+    }
+  }
+
+  private reportError(err: Error): void {
+    if (this.opts.onError) {
+      this.opts.onError(err);
+    }
+  }
+}
+
+function subKey(channel: string, pattern: boolean): string {
+  return (pattern ? "p:" : "c:") + channel;
+}
+
+// errResultMessage returns the message of the error result args, or
+// undefined if it is not an error result.
+function errResultMessage(args: unknown): string | undefined {
+  if (args && typeof args === "object") {
+    const e = (args as { error?: { message?: unknown } }).error;
+    if (e && typeof e === "object" && typeof e.message === "string") {
+      return e.message;
+    }
+  }
+  return undefined;
+}
+
+function asError(err: unknown): Error {
+  return err instanceof Error ? err : new Error(String(err));
+}
+
+// newUUID returns a random (version 4) UUID.
+function newUUID(): string {
+  const c = typeof crypto !== "undefined" ? crypto : undefined;
+  if (c && typeof c.randomUUID === "function") {
+    return c.randomUUID();
+  }
+
+  const b = new Uint8Array(16);
+  if (c) {
+    c.getRandomValues(b);
+  } else {
+    for (let i = 0; i < b.length; i++) {
+      b[i] = Math.floor(Math.random() * 256);
+    }
+  }
+  b[6] = (b[6] & 0x0f) | 0x40;
+  b[8] = (b[8] & 0x3f) | 0x80;
+  const hex = Array.from(b, (v) => (v + 0x100).toString(16).slice(1)).join("");
+  return `${hex.slice(0, 8)}-${hex.slice(8, 12)}-${hex.slice(12, 16)}-${hex.slice(16, 20)}-${hex.slice(20)}`;
+}
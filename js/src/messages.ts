@@ -0,0 +1,246 @@
+// Code generated by juggler-tsgen; DO NOT EDIT.
+
+// Subprotocols is the list of websocket subprotocols supported by the
+// server.
+export const Subprotocols: string[] = ["juggler.v2.json","juggler.0"];
+
+// MsgType is the type of a message, set in its metadata.
+export enum MsgType {
+  CALL = 1,
+  PUB = 2,
+  SUB = 3,
+  UNSB = 4,
+  NACK = 7,
+  ACK = 8,
+  RES = 9,
+  EVNT = 10,
+  BTCH = 12,
+}
+
+// RoutingMode defines how a call request is routed to the callees.
+export enum RoutingMode {
+  RoundRobin = 0,
+  Sticky = 1,
+  Broadcast = 2,
+}
+
+// The codes of the NACK messages.
+export const CodeBadRequest = 400;
+export const CodeUnauthorized = 401;
+export const CodeForbidden = 403;
+export const CodeNoCallee = 404;
+export const CodeUnsupportedVersion = 406;
+export const CodeTimeout = 408;
+export const CodePayloadTooLarge = 413;
+export const CodeRateLimited = 429;
+export const CodeHandlerError = 500;
+export const CodeUnavailable = 503;
+
+// The URIs handled by the server, and the separators of the URIs and
+// channels.
+export const TimeSyncURI = "juggler.timesync";
+export const HistoryURI = "juggler.history.fetch";
+export const CreditURI = "juggler.credit";
+export const EvntAckURI = "juggler.evntack";
+export const VersionSeparator = "@";
+export const TenantSeparator = "/";
+export const SystemChannelPrefix = "juggler:";
+
+// Call is the CALL message.
+export interface Call {
+  meta: Meta & { type: MsgType.CALL };
+  payload: {
+    uri: string;
+    timeout: number; // duration in nanoseconds
+    args: unknown;
+    routing?: RoutingMode;
+    routing_key?: string;
+    priority?: number;
+    max_attempts?: number;
+    backoff?: number; // duration in nanoseconds
+    version?: string;
+    content_type?: string;
+    no_ack?: boolean;
+  };
+}
+
+// Pub is the PUB message.
+export interface Pub {
+  meta: Meta & { type: MsgType.PUB };
+  payload: {
+    channel: string;
+    args: unknown;
+    content_type?: string;
+    ttl?: number; // duration in nanoseconds
+    no_ack?: boolean;
+  };
+}
+
+// Sub is the SUB message.
+export interface Sub {
+  meta: Meta & { type: MsgType.SUB };
+  payload: {
+    channel: string;
+    pattern: boolean;
+    acked?: boolean;
+    sticky?: boolean;
+  };
+}
+
+// Unsb is the UNSB message.
+export interface Unsb {
+  meta: Meta & { type: MsgType.UNSB };
+  payload: {
+    channel: string;
+    pattern: boolean;
+    acked?: boolean;
+    sticky?: boolean;
+  };
+}
+
+// Batch is the BTCH message.
+export interface Batch {
+  meta: Meta & { type: MsgType.BTCH };
+  payload: {
+    msgs: (Call | Pub)[];
+  };
+}
+
+// Nack is the NACK message.
+export interface Nack {
+  meta: Meta & { type: MsgType.NACK };
+  payload: {
+    for: string; // UUID
+    for_type: MsgType;
+    uri?: string;
+    channel?: string;
+    code: number;
+    message: string;
+    details?: unknown;
+  };
+}
+
+// Ack is the ACK message.
+export interface Ack {
+  meta: Meta & { type: MsgType.ACK };
+  payload: {
+    for: string; // UUID
+    for_type: MsgType;
+    uri?: string;
+    channel?: string;
+  };
+}
+
+// Res is the RES message.
+export interface Res {
+  meta: Meta & { type: MsgType.RES };
+  payload: {
+    for: string; // UUID
+    uri?: string;
+    args: unknown;
+    content_type?: string;
+  };
+}
+
+// Evnt is the EVNT message.
+export interface Evnt {
+  meta: Meta & { type: MsgType.EVNT };
+  payload: {
+    for: string; // UUID
+    channel?: string;
+    pattern?: string;
+    patch?: boolean;
+    timestamp: string; // RFC 3339 timestamp
+    ttl?: number; // duration in nanoseconds
+    seq?: number;
+    tag?: string;
+    args: unknown;
+    content_type?: string;
+  };
+}
+
+// Meta is the JSON encoding of message.Meta.
+export interface Meta {
+  type: MsgType;
+  uuid: string; // UUID
+  sig?: Signature;
+  headers?: { [key: string]: string };
+  act_as?: string;
+  timing?: {
+    queue_wait: number; // duration in nanoseconds
+    handler: number; // duration in nanoseconds
+  };
+}
+
+// Signature is the JSON encoding of message.Signature.
+export interface Signature {
+  key_id?: string;
+  value: string; // base64
+}
+
+// ErrResult is the JSON encoding of message.ErrResult.
+export interface ErrResult {
+  error: {
+    message: string;
+  };
+}
+
+// TimeSync is the JSON encoding of message.TimeSync.
+export interface TimeSync {
+  client_time: string; // RFC 3339 timestamp
+  receive_time?: string; // RFC 3339 timestamp
+  transmit_time?: string; // RFC 3339 timestamp
+}
+
+// HistoryQuery is the JSON encoding of message.HistoryQuery.
+export interface HistoryQuery {
+  channel: string;
+  from: string; // RFC 3339 timestamp
+  to: string; // RFC 3339 timestamp
+  limit?: number;
+}
+
+// CreditGrant is the JSON encoding of message.CreditGrant.
+export interface CreditGrant {
+  channel: string;
+  pattern?: boolean;
+  credits: number;
+}
+
+// EvntAck is the JSON encoding of message.EvntAck.
+export interface EvntAck {
+  tags: string[];
+}
+
+// SystemEvent is the JSON encoding of message.SystemEvent.
+export interface SystemEvent {
+  event: string;
+  server_id?: string;
+  conn_uuid?: string; // UUID
+  identity?: string;
+  error?: string;
+  msg_uuid?: string; // UUID
+  uri?: string;
+  callee?: CalleeInfo;
+  channel?: string;
+  args?: unknown;
+  timestamp: string; // RFC 3339 timestamp
+}
+
+// CalleeInfo is the JSON encoding of message.CalleeInfo.
+export interface CalleeInfo {
+  id: string; // UUID
+  hostname: string;
+  uris: string[];
+  routing?: RoutingMode[];
+  heartbeat: string; // RFC 3339 timestamp
+}
+
+// RequestMsg is a message sent by the client.
+export type RequestMsg = Call | Pub | Sub | Unsb | Batch;
+
+// ResponseMsg is a message sent by the server.
+export type ResponseMsg = Nack | Ack | Res | Evnt;
+
+// Msg is any message.
+export type Msg = RequestMsg | ResponseMsg;
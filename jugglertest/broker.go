@@ -0,0 +1,551 @@
+package jugglertest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// errClosed is the error of the broker connections that are closed.
+var errClosed = errors.New("juggler/jugglertest: closed connection")
+
+// Broker is an in-memory broker that implements broker.CallerBroker,
+// broker.CalleeBroker and broker.PubSubBroker, to run servers and
+// callees in the same process without a redis server. It also
+// implements broker.StickyBroker. The zero value
+// is ready to use, and it is safe for concurrent use.
+//
+// The call requests are queued by URI (or versioned URI, see
+// message.VersionedURI) in the order they are made, regardless of
+// their priority and routing mode, and the callees must listen on the
+// exact URI: URI patterns are not supported. The requests and results
+// expire after their timeout. The pub-sub patterns are matched in the
+// PatternSyntax of the broker.
+type Broker struct {
+	// PatternSyntax is the syntax of the pub-sub patterns, the default
+	// is broker.GlobPatterns. It must not be changed once the broker is
+	// in use.
+	PatternSyntax broker.PatternSyntax
+
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced when calls or results are added
+	calls   map[string][]*pendingCall
+	results map[string][]*pendingRes
+	gone    map[string]bool // UUIDs of the closed results connections
+	psconns map[*pubSubConn]bool
+	sticky  map[string]map[broker.Subscription]bool // by identity
+}
+
+type pendingCall struct {
+	cp       *message.CallPayload
+	deadline time.Time
+}
+
+type pendingRes struct {
+	rp       *message.ResPayload
+	deadline time.Time
+}
+
+// notify signals the connections waiting for calls or results. The
+// lock must be held.
+func (b *Broker) notify() {
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
+
+// waiter returns the channel closed when calls or results are added.
+// The lock must be held.
+func (b *Broker) waiter() <-chan struct{} {
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+	return b.changed
+}
+
+// Call registers a call request in the broker, for the callees of its
+// URI. See broker.CallerBroker.
+func (b *Broker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	cpy := *cp
+	cpy.EnqueueTimestamp = time.Now().UTC()
+	if cpy.MaxAttempts > 1 && cpy.Attempt == 0 {
+		cpy.Attempt = 1
+		cpy.Timeout = timeout
+	}
+
+	key := message.VersionedURI(cpy.URI, cpy.Version)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.calls == nil {
+		b.calls = make(map[string][]*pendingCall)
+	}
+	b.calls[key] = append(b.calls[key], &pendingCall{cp: &cpy, deadline: time.Now().Add(timeout)})
+	b.notify()
+	return nil
+}
+
+// CallAt registers a call request in the broker at the specified time,
+// with the timeout set in cp.Timeout starting at that time.
+func (b *Broker) CallAt(cp *message.CallPayload, at time.Time) error {
+	return b.CallAfter(cp, at.Sub(time.Now()))
+}
+
+// CallAfter registers a call request in the broker after the specified
+// delay, with the timeout set in cp.Timeout starting after that delay.
+func (b *Broker) CallAfter(cp *message.CallPayload, delay time.Duration) error {
+	cpy := *cp
+	time.AfterFunc(delay, func() {
+		b.Call(&cpy, cpy.Timeout)
+	})
+	return nil
+}
+
+// Retry registers the next attempt of the call request after its
+// backoff delay. It returns broker.ErrNoAttemptLeft if the call cannot
+// be retried.
+func (b *Broker) Retry(cp *message.CallPayload) error {
+	if !cp.CanRetry() {
+		return broker.ErrNoAttemptLeft
+	}
+	next := *cp
+	next.Attempt = cp.Attempt + 1
+	if cp.Attempt == 0 {
+		next.Attempt = 2
+	}
+	return b.CallAfter(&next, cp.RetryBackoff())
+}
+
+// Result registers the result of a call request, for the results
+// connection of its caller. It returns broker.ErrCallerGone if that
+// connection is closed.
+func (b *Broker) Result(rp *message.ResPayload, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	cpy := *rp
+
+	key := rp.ConnUUID.String()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.gone[key] {
+		return broker.ErrCallerGone
+	}
+	if b.results == nil {
+		b.results = make(map[string][]*pendingRes)
+	}
+	b.results[key] = append(b.results[key], &pendingRes{rp: &cpy, deadline: time.Now().Add(timeout)})
+	b.notify()
+	return nil
+}
+
+// nextCall removes and returns the first call request for one of the
+// URIs that is not expired, or nil and the channel that is closed when
+// calls are added.
+func (b *Broker) nextCall(uris []string) (*message.CallPayload, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for _, uri := range uris {
+		q := b.calls[uri]
+		for len(q) > 0 {
+			pc := q[0]
+			q = q[1:]
+			if ttl := pc.deadline.Sub(now); ttl > 0 {
+				b.calls[uri] = q
+				cp := *pc.cp
+				if cp.Attempt == 0 {
+					cp.Attempt = 1
+				}
+				cp.TTLAfterRead = ttl
+				cp.ReadTimestamp = now.UTC()
+				return &cp, nil
+			}
+		}
+		delete(b.calls, uri)
+	}
+	return nil, b.waiter()
+}
+
+// Requeue puts back the call request at the front of its queue for its
+// remaining time-to-live, without counting a new attempt.
+func (b *Broker) Requeue(cp *message.CallPayload) error {
+	b.requeue(cp)
+	return nil
+}
+
+// requeue puts back the call request at the front of its queue, if it
+// was taken by a connection that was closed before it was delivered.
+func (b *Broker) requeue(cp *message.CallPayload) {
+	key := message.VersionedURI(cp.URI, cp.Version)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pc := &pendingCall{cp: cp, deadline: cp.ReadTimestamp.Add(cp.TTLAfterRead)}
+	b.calls[key] = append([]*pendingCall{pc}, b.calls[key]...)
+	b.notify()
+}
+
+// nextRes removes and returns the first result of the connection that
+// is not expired, or nil and the channel that is closed when results
+// are added.
+func (b *Broker) nextRes(key string) (*pendingRes, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	q := b.results[key]
+	for len(q) > 0 {
+		pr := q[0]
+		q = q[1:]
+		if now.Before(pr.deadline) {
+			b.results[key] = q
+			return pr, nil
+		}
+	}
+	delete(b.results, key)
+	return nil, b.waiter()
+}
+
+// NewCallsConn returns a new calls connection that receives the call
+// requests made to the URIs.
+func (b *Broker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
+	if len(uris) == 0 {
+		return nil, errors.New("no URI specified")
+	}
+	cc := &callsConn{
+		b:    b,
+		uris: uris,
+		ch:   make(chan *message.CallPayload),
+		kill: make(chan struct{}),
+	}
+	go cc.run()
+	return cc, nil
+}
+
+type callsConn struct {
+	b    *Broker
+	uris []string
+	ch   chan *message.CallPayload
+
+	closeOnce sync.Once
+	kill      chan struct{}
+}
+
+func (c *callsConn) run() {
+	defer close(c.ch)
+	for {
+		cp, wait := c.b.nextCall(c.uris)
+		if cp == nil {
+			select {
+			case <-wait:
+				continue
+			case <-c.kill:
+				return
+			}
+		}
+
+		// drop the call request if it expires before it is received
+		expired := time.NewTimer(cp.TTLAfterRead)
+		select {
+		case c.ch <- cp:
+		case <-expired.C:
+		case <-c.kill:
+			expired.Stop()
+			c.b.requeue(cp)
+			return
+		}
+		expired.Stop()
+	}
+}
+
+// Calls returns the stream of call requests.
+func (c *callsConn) Calls() <-chan *message.CallPayload {
+	return c.ch
+}
+
+// CallsErr returns the error that caused the Calls channel to close,
+// which is always the error of a closed connection.
+func (c *callsConn) CallsErr() error {
+	return errClosed
+}
+
+// Close closes the connection, the pending call requests are kept for
+// the other connections.
+func (c *callsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.kill) })
+	return nil
+}
+
+// NewResultsConn returns a new results connection that receives the
+// results of the call requests made by the connection connUUID.
+func (b *Broker) NewResultsConn(connUUID uuid.UUID) (broker.ResultsConn, error) {
+	rc := &resultsConn{
+		b:    b,
+		key:  connUUID.String(),
+		ch:   make(chan *message.ResPayload),
+		kill: make(chan struct{}),
+	}
+	go rc.run()
+	return rc, nil
+}
+
+type resultsConn struct {
+	b   *Broker
+	key string
+	ch  chan *message.ResPayload
+
+	closeOnce sync.Once
+	kill      chan struct{}
+}
+
+func (c *resultsConn) run() {
+	defer close(c.ch)
+	for {
+		pr, wait := c.b.nextRes(c.key)
+		if pr == nil {
+			select {
+			case <-wait:
+				continue
+			case <-c.kill:
+				return
+			}
+		}
+
+		// drop the result if it expires before it is received
+		expired := time.NewTimer(pr.deadline.Sub(time.Now()))
+		select {
+		case c.ch <- pr.rp:
+		case <-expired.C:
+		case <-c.kill:
+			expired.Stop()
+			return
+		}
+		expired.Stop()
+	}
+}
+
+// Results returns the stream of call results.
+func (c *resultsConn) Results() <-chan *message.ResPayload {
+	return c.ch
+}
+
+// ResultsErr returns the error that caused the Results channel to
+// close, which is always the error of a closed connection.
+func (c *resultsConn) ResultsErr() error {
+	return errClosed
+}
+
+// Close closes the connection, the results stored for it afterwards
+// fail with broker.ErrCallerGone.
+func (c *resultsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.b.mu.Lock()
+		if c.b.gone == nil {
+			c.b.gone = make(map[string]bool)
+		}
+		c.b.gone[c.key] = true
+		delete(c.b.results, c.key)
+		c.b.mu.Unlock()
+		close(c.kill)
+	})
+	return nil
+}
+
+// Publish publishes an event to the pub-sub connections subscribed to
+// the channel, or to a pattern that matches it.
+func (b *Broker) Publish(channel string, pp *message.PubPayload) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for psc := range b.psconns {
+		psc.publish(channel, pp)
+	}
+	return nil
+}
+
+// NewPubSubConn returns a new pub-sub connection that can be used to
+// subscribe to and unsubscribe from channels.
+func (b *Broker) NewPubSubConn() (broker.PubSubConn, error) {
+	psc := &pubSubConn{
+		b:    b,
+		subs: make(map[subKey]bool),
+		ch:   make(chan *message.EvntPayload),
+		wake: make(chan struct{}, 1),
+		kill: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.psconns == nil {
+		b.psconns = make(map[*pubSubConn]bool)
+	}
+	b.psconns[psc] = true
+	b.mu.Unlock()
+
+	go psc.run()
+	return psc, nil
+}
+
+// AddSticky adds the sticky subscription sub of identity.
+func (b *Broker) AddSticky(identity string, sub broker.Subscription) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sticky == nil {
+		b.sticky = make(map[string]map[broker.Subscription]bool)
+	}
+	if b.sticky[identity] == nil {
+		b.sticky[identity] = make(map[broker.Subscription]bool)
+	}
+	b.sticky[identity][sub] = true
+	return nil
+}
+
+// RemoveSticky removes the sticky subscription sub of identity.
+func (b *Broker) RemoveSticky(identity string, sub broker.Subscription) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.sticky[identity], sub)
+	if len(b.sticky[identity]) == 0 {
+		delete(b.sticky, identity)
+	}
+	return nil
+}
+
+// Sticky returns the sticky subscriptions of identity.
+func (b *Broker) Sticky(identity string) ([]broker.Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs := make([]broker.Subscription, 0, len(b.sticky[identity]))
+	for sub := range b.sticky[identity] {
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// subKey identifies a subscription.
+type subKey struct {
+	channel string
+	pattern bool
+}
+
+// match returns true if the channel matches the subscription, in the
+// pattern syntax s.
+func (k subKey) match(s broker.PatternSyntax, channel string) bool {
+	if !k.pattern {
+		return k.channel == channel
+	}
+	return s.Match(k.channel, channel)
+}
+
+type pubSubConn struct {
+	b    *Broker
+	ch   chan *message.EvntPayload
+	wake chan struct{} // signals that events are queued
+
+	mu     sync.Mutex
+	subs   map[subKey]bool
+	queued []*message.EvntPayload
+
+	closeOnce sync.Once
+	kill      chan struct{}
+}
+
+// publish queues the event for each subscription that matches the
+// channel.
+func (c *pubSubConn) publish(channel string, pp *message.PubPayload) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.subs {
+		if !k.match(c.b.PatternSyntax, channel) {
+			continue
+		}
+		ep := &message.EvntPayload{
+			MsgUUID:     pp.MsgUUID,
+			Channel:     channel,
+			Args:        pp.Args,
+			ContentType: pp.ContentType,
+			Timestamp:   pp.Timestamp,
+			TTL:         pp.TTL,
+			Seq:         pp.Seq,
+			Headers:     pp.Headers,
+		}
+		if k.pattern {
+			ep.Pattern = k.channel
+		}
+		c.queued = append(c.queued, ep)
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *pubSubConn) run() {
+	defer close(c.ch)
+	for {
+		c.mu.Lock()
+		queued := c.queued
+		c.queued = nil
+		c.mu.Unlock()
+
+		for _, ep := range queued {
+			select {
+			case c.ch <- ep:
+			case <-c.kill:
+				return
+			}
+		}
+
+		select {
+		case <-c.wake:
+		case <-c.kill:
+			return
+		}
+	}
+}
+
+// Subscribe subscribes the connection to the channel, which is a
+// pattern if pattern is true.
+func (c *pubSubConn) Subscribe(channel string, pattern bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subs[subKey{channel, pattern}] = true
+	return nil
+}
+
+// Unsubscribe unsubscribes the connection from the channel, which is a
+// pattern if pattern is true.
+func (c *pubSubConn) Unsubscribe(channel string, pattern bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subs, subKey{channel, pattern})
+	return nil
+}
+
+// Events returns the stream of events of the subscriptions.
+func (c *pubSubConn) Events() <-chan *message.EvntPayload {
+	return c.ch
+}
+
+// EventsErr returns the error that caused the Events channel to close,
+// which is always the error of a closed connection.
+func (c *pubSubConn) EventsErr() error {
+	return errClosed
+}
+
+// Close closes the connection.
+func (c *pubSubConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.b.mu.Lock()
+		delete(c.b.psconns, c)
+		c.b.mu.Unlock()
+		close(c.kill)
+	})
+	return nil
+}
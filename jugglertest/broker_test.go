@@ -0,0 +1,119 @@
+package jugglertest
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/broker/brokertest"
+	"github.com/PuerkitoBio/juggler/callee"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBrokerConformance(t *testing.T) {
+	brokertest.TestCallBroker(t, func() (brokertest.CallBroker, func(), error) {
+		return &Broker{}, func() {}, nil
+	})
+	brokertest.TestPubSubBroker(t, func() (broker.PubSubBroker, func(), error) {
+		return &Broker{}, func() {}, nil
+	})
+}
+
+func TestBrokerRetry(t *testing.T) {
+	b := &Broker{}
+	cc, err := b.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+
+	cp := &message.CallPayload{ConnUUID: message.NewID(), MsgUUID: message.NewID(), URI: "a", MaxAttempts: 2}
+	require.NoError(t, b.Call(cp, time.Second), "Call")
+	got := <-cc.Calls()
+	assert.Equal(t, 1, got.Attempt, "first attempt")
+	assert.Equal(t, time.Second, got.Timeout, "timeout of the attempts")
+
+	require.NoError(t, b.Retry(got), "Retry")
+	got = <-cc.Calls()
+	assert.Equal(t, 2, got.Attempt, "second attempt")
+	assert.Equal(t, broker.ErrNoAttemptLeft, b.Retry(got), "no attempt left")
+}
+
+func TestBrokerServer(t *testing.T) {
+	b := &Broker{}
+	cle := &callee.Callee{Broker: b}
+	go cle.Listen(map[string]callee.Thunk{
+		"test.echo": func(cp *message.CallPayload) (interface{}, error) {
+			var s string
+			if err := cle.DecodeArgs(cp, &s); err != nil {
+				return nil, err
+			}
+			return s, nil
+		},
+	})
+
+	srv := httptest.NewServer(juggler.Upgrade(&websocket.Upgrader{Subprotocols: juggler.Subprotocols},
+		&juggler.Server{CallerBroker: b, PubSubBroker: b}))
+	defer srv.Close()
+
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols},
+		strings.Replace(srv.URL, "http:", "ws:", 1), nil)
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	var s string
+	require.NoError(t, cli.Invoke(context.Background(), "test.echo", "hello", &s, time.Second), "Invoke")
+	assert.Equal(t, "hello", s, "result")
+}
+
+func TestBrokerSticky(t *testing.T) {
+	b := &Broker{}
+	a, ap := broker.Subscription{Channel: "a"}, broker.Subscription{Channel: "a", Pattern: true}
+	require.NoError(t, b.AddSticky("u1", a), "AddSticky a")
+	require.NoError(t, b.AddSticky("u1", ap), "AddSticky pattern a")
+	require.NoError(t, b.AddSticky("u1", a), "AddSticky a again")
+
+	subs, err := b.Sticky("u1")
+	require.NoError(t, err, "Sticky")
+	assert.ElementsMatch(t, []broker.Subscription{a, ap}, subs, "subscriptions")
+
+	require.NoError(t, b.RemoveSticky("u1", a), "RemoveSticky")
+	subs, err = b.Sticky("u1")
+	require.NoError(t, err, "Sticky after remove")
+	assert.Equal(t, []broker.Subscription{ap}, subs, "subscription left")
+
+	subs, err = b.Sticky("u2")
+	require.NoError(t, err, "Sticky of other identity")
+	assert.Equal(t, 0, len(subs), "no subscriptions")
+}
+
+func TestBrokerPatternSyntax(t *testing.T) {
+	b := &Broker{PatternSyntax: broker.MQTTPatterns}
+	psc, err := b.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn")
+	defer psc.Close()
+
+	require.NoError(t, psc.Subscribe("a.+.c", true), "Subscribe")
+	for _, ch := range []string{"a.b.b.c", "a.b.c", "a.bc"} {
+		require.NoError(t, b.Publish(ch, &message.PubPayload{MsgUUID: message.NewID()}), "Publish %s", ch)
+	}
+
+	select {
+	case ev := <-psc.Events():
+		assert.Equal(t, "a.b.c", ev.Channel, "channel")
+		assert.Equal(t, "a.+.c", ev.Pattern, "pattern")
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	select {
+	case ev := <-psc.Events():
+		t.Fatalf("unexpected event on %s", ev.Channel)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
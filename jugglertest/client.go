@@ -0,0 +1,444 @@
+package jugglertest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/callee"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// Client is an in-memory fake of client.Client, that answers the
+// requests itself instead of sending them to a server. Its methods have
+// the same signatures as those of client.Client, so that the code under
+// test can depend on an interface implemented by both. The responses are
+// sent to the Handler, each in its own goroutine, as client.Client does:
+//
+//     - a CALL is answered with an ACK and the RES of the Thunk set for
+//       its URI with HandleCall, or with an EXP if the Thunk takes longer
+//       than the call timeout. If no Thunk is set for the URI, it is
+//       answered with a NACK with the message.CodeNoCallee code;
+//     - a SUB or an UNSB is answered with an ACK, and the client receives
+//       the events published on the channels that match its
+//       subscriptions, by itself with Pub or by the test with Publish;
+//     - a PUB is answered with an ACK.
+//
+// The arguments and results are always encoded as JSON. It is safe for
+// concurrent use.
+type Client struct {
+	// Handler receives the responses and the events, like the handler
+	// set with client.SetHandler. If nil, they are dropped.
+	Handler client.Handler
+
+	// UUID is the UUID of the fake connection, set in the ConnUUID of
+	// the call requests passed to the Thunks.
+	UUID uuid.UUID
+
+	// Identity is the identity of the client, set in the Identity of the
+	// call requests passed to the Thunks.
+	Identity string
+
+	mu     sync.Mutex
+	thunks map[string]callee.Thunk
+	subs   map[subKey]bool
+	sent   []message.Msg
+	err    error
+	stop   chan struct{}
+}
+
+// NewClient returns a fake client that sends the responses to h.
+func NewClient(h client.Handler) *Client {
+	return &Client{
+		Handler: h,
+		UUID:    message.NewID(),
+		thunks:  make(map[string]callee.Thunk),
+		subs:    make(map[subKey]bool),
+		stop:    make(chan struct{}),
+	}
+}
+
+// HandleCall sets the Thunk that returns the results of the calls to
+// uri, or removes it if fn is nil. The Thunks of the callees can be
+// used as is, their arguments are decoded with message.JSON.
+func (c *Client) HandleCall(uri string, fn callee.Thunk) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fn == nil {
+		delete(c.thunks, uri)
+		return
+	}
+	c.thunks[uri] = fn
+}
+
+// Publish sends an event with the v value on the channel to the client,
+// once per subscription that matches the channel. It returns the number
+// of events sent.
+func (c *Client) Publish(channel string, v interface{}) (int, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return c.publish(channel, &message.PubPayload{
+		MsgUUID:   message.NewID(),
+		Args:      b,
+		Timestamp: time.Now().UTC(),
+	}), nil
+}
+
+func (c *Client) publish(channel string, pp *message.PubPayload) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0
+	}
+
+	var n int
+	for k := range c.subs {
+		if !k.match(broker.GlobPatterns, channel) {
+			continue
+		}
+		ep := &message.EvntPayload{
+			MsgUUID:   pp.MsgUUID,
+			Channel:   channel,
+			Args:      pp.Args,
+			Timestamp: pp.Timestamp,
+			TTL:       pp.TTL,
+			Headers:   pp.Headers,
+		}
+		if k.pattern {
+			ep.Pattern = k.channel
+		}
+		c.send(message.NewEvnt(ep))
+		n++
+	}
+	return n
+}
+
+// Sent returns the requests made with the client so far, in the order
+// they were made.
+func (c *Client) Sent() []message.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]message.Msg(nil), c.sent...)
+}
+
+// send sends m to the handler in its own goroutine.
+func (c *Client) send(m message.Msg) {
+	if h := c.Handler; h != nil {
+		go h.Handle(context.Background(), m)
+	}
+}
+
+// request records the request m, or returns the error of the client if
+// it is closed, or the error of ctx if it is done.
+func (c *Client) request(ctx context.Context, m message.Msg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// as client.Client, the headers of ctx do not override those of m
+	if hm, ok := m.(interface {
+		SetHeader(string, string)
+	}); ok {
+		own := message.HeadersOf(m)
+		for k, v := range client.HeadersFromContext(ctx) {
+			if _, ok := own[k]; !ok {
+				hm.SetHeader(k, v)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.sent = append(c.sent, m)
+	return nil
+}
+
+// Close closes the client. No more messages are sent to the handler,
+// and the requests fail.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.err = errors.New("closed connection")
+	close(c.stop)
+	return nil
+}
+
+// CloseNotify returns a channel that is closed when the client is
+// closed.
+func (c *Client) CloseNotify() <-chan struct{} {
+	return c.stop
+}
+
+// Call makes a call request, see client.Client.Call.
+func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	return c.CallCtx(context.Background(), uri, v, timeout)
+}
+
+// CallCtx makes a call request, see client.Client.CallCtx.
+func (c *Client) CallCtx(ctx context.Context, uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	m, err := message.NewCall(uri, v, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.request(ctx, m); err != nil {
+		return nil, err
+	}
+
+	fn := c.thunk(uri)
+	if fn == nil {
+		c.send(message.NewNack(m, message.CodeNoCallee, juggler.ErrNoCallee))
+		return m.UUID(), nil
+	}
+	c.send(message.NewAck(m))
+	go func() {
+		resp := c.invoke(m, fn, timeout)
+		select {
+		case <-c.stop:
+		default:
+			c.send(resp)
+		}
+	}()
+	return m.UUID(), nil
+}
+
+// Invoke makes a call request and waits for its result, see
+// client.Client.Invoke. The errors are those of client.Client.Invoke,
+// the NACK and the RES of the call are not sent to the handler.
+func (c *Client) Invoke(ctx context.Context, uri string, v, result interface{}, timeout time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return context.DeadlineExceeded
+		}
+		if timeout <= 0 || left < timeout {
+			timeout = left
+		}
+	}
+
+	m, err := message.NewCall(uri, v, timeout)
+	if err != nil {
+		return err
+	}
+	if err := c.request(ctx, m); err != nil {
+		return err
+	}
+
+	fn := c.thunk(uri)
+	if fn == nil {
+		return client.NackError(message.NewNack(m, message.CodeNoCallee, juggler.ErrNoCallee))
+	}
+	ch := make(chan message.Msg, 1)
+	go func() {
+		ch <- c.invoke(m, fn, timeout)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.stop:
+		return errors.New("closed connection")
+	case resp := <-ch:
+		res, ok := resp.(*message.Res)
+		if !ok {
+			return client.ErrCallExpired
+		}
+		var er struct {
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(res.Payload.Args, &er); err == nil && er.Error != nil {
+			return &client.ResultError{URI: uri, Message: er.Error.Message, Result: res.Payload.Args}
+		}
+		if result == nil {
+			return nil
+		}
+		return c.DecodeResult(res, result)
+	}
+}
+
+// thunk returns the Thunk of uri, or nil.
+func (c *Client) thunk(uri string) callee.Thunk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.thunks[uri]
+}
+
+// invoke calls fn for the call request m, and returns its RES, or its
+// EXP if fn does not return before the timeout.
+func (c *Client) invoke(m *message.Call, fn callee.Thunk, timeout time.Duration) message.Msg {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	cp := &message.CallPayload{
+		ConnUUID:      c.UUID,
+		MsgUUID:       m.UUID(),
+		URI:           m.Payload.URI,
+		Args:          m.Payload.Args,
+		Identity:      c.Identity,
+		Headers:       m.Meta.Headers,
+		Attempt:       1,
+		Deadline:      time.Now().Add(timeout).UTC(),
+		Timestamp:     time.Now().UTC(),
+		TTLAfterRead:  timeout,
+		ReadTimestamp: time.Now().UTC(),
+	}
+	cp.EnqueueTimestamp = cp.ReadTimestamp
+
+	ch := make(chan *message.ResPayload, 1)
+	go func() {
+		start := time.Now()
+		v, err := fn(cp)
+		var headers message.Headers
+		if r, ok := v.(*callee.Result); ok {
+			v, headers = r.Value, r.Headers
+		}
+		ch <- &message.ResPayload{
+			ConnUUID: cp.ConnUUID,
+			MsgUUID:  cp.MsgUUID,
+			URI:      cp.URI,
+			Args:     callResult(v, err),
+			Headers:  headers,
+			Timing:   &message.Timing{Handler: time.Now().Sub(start)},
+		}
+	}()
+
+	select {
+	case rp := <-ch:
+		return message.NewRes(rp)
+	case <-time.After(timeout):
+		exp := &client.Exp{Meta: message.NewMeta(client.ExpMsg)}
+		exp.Payload.For = m.UUID()
+		exp.Payload.URI = m.Payload.URI
+		exp.Payload.Args = m.Payload.Args
+		return exp
+	}
+}
+
+// callResult returns the JSON encoding of the result of a Thunk, which
+// is the error result if e is not nil, as stored by callee.Callee.
+func callResult(v interface{}, e error) json.RawMessage {
+	if e != nil {
+		if ms, ok := e.(json.Marshaler); ok {
+			v = ms
+		} else {
+			var er message.ErrResult
+			er.Error.Message = e.Error()
+			v = er
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		var er message.ErrResult
+		er.Error.Message = fmt.Sprintf("invalid result: %v", err)
+		b, _ = json.Marshal(er)
+	}
+	return b
+}
+
+// DecodeResult decodes the value of the result into v. The decoding
+// errors are returned as *message.ArgsError.
+func (c *Client) DecodeResult(res *message.Res, v interface{}) error {
+	if err := message.JSON.Decode(res.Payload.Args, v); err != nil {
+		return &message.ArgsError{Type: res.Type(), Name: res.Payload.URI, Args: res.Payload.Args, Err: err}
+	}
+	return nil
+}
+
+// DecodeEvent decodes the arguments of the event into v. The decoding
+// errors are returned as *message.ArgsError.
+func (c *Client) DecodeEvent(ev *message.Evnt, v interface{}) error {
+	if err := message.JSON.Decode(ev.Payload.Args, v); err != nil {
+		return &message.ArgsError{Type: ev.Type(), Name: ev.Payload.Channel, Args: ev.Payload.Args, Err: err}
+	}
+	return nil
+}
+
+// Sub makes a subscription request, see client.Client.Sub.
+func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
+	return c.SubCtx(context.Background(), channel, pattern)
+}
+
+// SubCtx makes a subscription request, see client.Client.SubCtx.
+func (c *Client) SubCtx(ctx context.Context, channel string, pattern bool) (uuid.UUID, error) {
+	m := message.NewSub(channel, pattern)
+	if err := c.request(ctx, m); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.subs[subKey{channel, pattern}] = true
+	c.mu.Unlock()
+	c.send(message.NewAck(m))
+	return m.UUID(), nil
+}
+
+// Unsb makes an unsubscription request, see client.Client.Unsb.
+func (c *Client) Unsb(channel string, pattern bool) (uuid.UUID, error) {
+	return c.UnsbCtx(context.Background(), channel, pattern)
+}
+
+// UnsbCtx makes an unsubscription request, see client.Client.UnsbCtx.
+func (c *Client) UnsbCtx(ctx context.Context, channel string, pattern bool) (uuid.UUID, error) {
+	m := message.NewUnsb(channel, pattern)
+	if err := c.request(ctx, m); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	delete(c.subs, subKey{channel, pattern})
+	c.mu.Unlock()
+	c.send(message.NewAck(m))
+	return m.UUID(), nil
+}
+
+// Pub makes a publish request, see client.Client.Pub.
+func (c *Client) Pub(channel string, v interface{}) (uuid.UUID, error) {
+	return c.PubTTLCtx(context.Background(), channel, v, 0)
+}
+
+// PubCtx makes a publish request, see client.Client.PubCtx.
+func (c *Client) PubCtx(ctx context.Context, channel string, v interface{}) (uuid.UUID, error) {
+	return c.PubTTLCtx(ctx, channel, v, 0)
+}
+
+// PubTTL makes a publish request, see client.Client.PubTTL.
+func (c *Client) PubTTL(channel string, v interface{}, ttl time.Duration) (uuid.UUID, error) {
+	return c.PubTTLCtx(context.Background(), channel, v, ttl)
+}
+
+// PubTTLCtx makes a publish request, see client.Client.PubTTLCtx.
+func (c *Client) PubTTLCtx(ctx context.Context, channel string, v interface{}, ttl time.Duration) (uuid.UUID, error) {
+	m, err := message.NewPub(channel, v)
+	if err != nil {
+		return nil, err
+	}
+	m.Payload.TTL = ttl
+	if err := c.request(ctx, m); err != nil {
+		return nil, err
+	}
+
+	c.send(message.NewAck(m))
+	c.publish(channel, &message.PubPayload{
+		MsgUUID:   m.UUID(),
+		Args:      m.Payload.Args,
+		Timestamp: time.Now().UTC(),
+		TTL:       ttl,
+		Headers:   m.Meta.Headers,
+	})
+	return m.UUID(), nil
+}
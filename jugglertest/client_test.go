@@ -0,0 +1,147 @@
+package jugglertest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// msgChan returns a handler that sends the messages on the returned
+// channel.
+func msgChan() (client.Handler, <-chan message.Msg) {
+	ch := make(chan message.Msg, 10)
+	return client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		ch <- m
+	}), ch
+}
+
+// nextMsgs returns the next n messages received on ch, by type.
+func nextMsgs(t *testing.T, ch <-chan message.Msg, n int) map[message.Type]message.Msg {
+	msgs := make(map[message.Type]message.Msg)
+	for i := 0; i < n; i++ {
+		select {
+		case m := <-ch:
+			msgs[m.Type()] = m
+		case <-time.After(time.Second):
+			require.FailNow(t, "no message", "%d of %d", i+1, n)
+		}
+	}
+	return msgs
+}
+
+func TestClientCall(t *testing.T) {
+	h, ch := msgChan()
+	cli := NewClient(h)
+	cli.Identity = "u1"
+	cli.HandleCall("test.echo", func(cp *message.CallPayload) (interface{}, error) {
+		var s string
+		if err := message.JSON.Decode(cp.Args, &s); err != nil {
+			return nil, err
+		}
+		if s == "fail" {
+			return nil, errors.New("failed")
+		}
+		return cp.Identity + ":" + s, nil
+	})
+	cli.HandleCall("test.slow", func(cp *message.CallPayload) (interface{}, error) {
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil
+	})
+
+	id, err := cli.Call("test.echo", "hello", time.Second)
+	require.NoError(t, err, "Call")
+	msgs := nextMsgs(t, ch, 2)
+	if assert.Contains(t, msgs, message.AckMsg, "ACK") {
+		assert.Equal(t, id.String(), msgs[message.AckMsg].(*message.Ack).Payload.For.String(), "ACK for the call")
+	}
+	if assert.Contains(t, msgs, message.ResMsg, "RES") {
+		var s string
+		require.NoError(t, cli.DecodeResult(msgs[message.ResMsg].(*message.Res), &s), "DecodeResult")
+		assert.Equal(t, "u1:hello", s, "result")
+	}
+
+	_, err = cli.Call("test.slow", nil, 10*time.Millisecond)
+	require.NoError(t, err, "Call")
+	msgs = nextMsgs(t, ch, 2)
+	assert.Contains(t, msgs, client.ExpMsg, "EXP")
+
+	_, err = cli.Call("test.none", nil, time.Second)
+	require.NoError(t, err, "Call")
+	msgs = nextMsgs(t, ch, 1)
+	if assert.Contains(t, msgs, message.NackMsg, "NACK") {
+		assert.Equal(t, message.CodeNoCallee, msgs[message.NackMsg].(*message.Nack).Payload.Code, "NACK code")
+	}
+	assert.Len(t, cli.Sent(), 3, "sent requests")
+}
+
+func TestClientInvoke(t *testing.T) {
+	cli := NewClient(nil)
+	cli.HandleCall("test.echo", func(cp *message.CallPayload) (interface{}, error) {
+		var s string
+		if err := message.JSON.Decode(cp.Args, &s); err != nil {
+			return nil, err
+		}
+		if s == "fail" {
+			return nil, errors.New("failed")
+		}
+		return s, nil
+	})
+
+	var s string
+	require.NoError(t, cli.Invoke(context.Background(), "test.echo", "hello", &s, time.Second), "Invoke")
+	assert.Equal(t, "hello", s, "result")
+
+	err := cli.Invoke(context.Background(), "test.echo", "fail", &s, time.Second)
+	if assert.IsType(t, &client.ResultError{}, err, "error result") {
+		assert.Equal(t, "failed", err.(*client.ResultError).Message, "error message")
+	}
+	err = cli.Invoke(context.Background(), "test.none", nil, nil, time.Second)
+	assert.True(t, client.IsCode(err, message.CodeNoCallee), "no callee: %v", err)
+
+	require.NoError(t, cli.Close(), "Close")
+	assert.Error(t, cli.Invoke(context.Background(), "test.echo", "hello", &s, time.Second), "closed client")
+	_, err = cli.Pub("a", 1)
+	assert.Error(t, err, "closed client")
+}
+
+func TestClientPubSub(t *testing.T) {
+	h, ch := msgChan()
+	cli := NewClient(h)
+
+	_, err := cli.Sub("a.*", true)
+	require.NoError(t, err, "Sub")
+	nextMsgs(t, ch, 1)
+
+	n, err := cli.Publish("a.b", "x")
+	require.NoError(t, err, "Publish")
+	assert.Equal(t, 1, n, "published events")
+	msgs := nextMsgs(t, ch, 1)
+	if assert.Contains(t, msgs, message.EvntMsg, "EVNT") {
+		ev := msgs[message.EvntMsg].(*message.Evnt)
+		assert.Equal(t, "a.b", ev.Payload.Channel, "channel")
+		assert.Equal(t, "a.*", ev.Payload.Pattern, "pattern")
+		var s string
+		require.NoError(t, cli.DecodeEvent(ev, &s), "DecodeEvent")
+		assert.Equal(t, "x", s, "event")
+	}
+
+	// the events published by the client are received too
+	_, err = cli.Pub("a.c", "y")
+	require.NoError(t, err, "Pub")
+	msgs = nextMsgs(t, ch, 2)
+	assert.Contains(t, msgs, message.AckMsg, "ACK")
+	assert.Contains(t, msgs, message.EvntMsg, "EVNT")
+
+	_, err = cli.Unsb("a.*", true)
+	require.NoError(t, err, "Unsb")
+	nextMsgs(t, ch, 1)
+	n, err = cli.Publish("a.b", "x")
+	require.NoError(t, err, "Publish")
+	assert.Equal(t, 0, n, "published events after Unsb")
+}
@@ -0,0 +1,112 @@
+// Package jugglertest implements in-memory fakes of the juggler client,
+// server and broker, so that the applications that embed juggler can
+// unit test their code without a websocket connection or a redis
+// server:
+//
+//     - Client is a fake of client.Client, whose call results and
+//       events are scripted by the test, to test the code that makes
+//       the requests and the client.Handler that handles the responses;
+//     - Broker is an in-memory broker for the servers and the callees,
+//       to test the callees (callee.Callee) and the servers end-to-end;
+//     - Recorder is a juggler.Handler that records the messages it
+//       handles, and NewConn returns a connection that is not attached
+//       to a websocket connection, to test the server handlers.
+//
+// For example, to test a handler that rejects the calls of anonymous
+// clients, and forwards the other messages to the next handler:
+//
+//     rec := &jugglertest.Recorder{}
+//     h := AuthHandler(rec)
+//     c := jugglertest.NewConn(h)
+//
+//     call, _ := message.NewCall("test.echo", "hello", time.Second)
+//     h.Handle(context.Background(), c, call)
+//     msgs := rec.Msgs() // the NACK sent by AuthHandler with c.Send
+//
+package jugglertest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// NewConn returns a connection that is not attached to a websocket
+// connection, whose Send method calls h (see juggler.NewDetachedConn).
+// The Identity and Tenant of the connection can be set before it is
+// used.
+func NewConn(h juggler.Handler) *juggler.Conn {
+	return juggler.NewDetachedConn(&juggler.Server{Handler: h})
+}
+
+// Recorder is a juggler.Handler that records the messages it handles,
+// and calls Next with them if it is set. It is used as the handler that
+// would otherwise call juggler.ProcessMsg, either as the next handler
+// of the handler under test or as the Handler of a server. It is safe
+// for concurrent use.
+type Recorder struct {
+	// Next is the handler called with the messages once they are
+	// recorded. If nil, the messages are only recorded.
+	Next juggler.Handler
+
+	mu   sync.Mutex
+	msgs []message.Msg
+	wait chan struct{} // closed and replaced when a message is recorded
+}
+
+// Handle implements juggler.Handler for the Recorder.
+func (r *Recorder) Handle(ctx context.Context, c *juggler.Conn, m message.Msg) {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, m)
+	if r.wait != nil {
+		close(r.wait)
+		r.wait = nil
+	}
+	r.mu.Unlock()
+
+	if r.Next != nil {
+		r.Next.Handle(ctx, c, m)
+	}
+}
+
+// Msgs returns the messages recorded so far, in the order they were
+// handled.
+func (r *Recorder) Msgs() []message.Msg {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]message.Msg(nil), r.msgs...)
+}
+
+// Wait waits until at least n messages are recorded or the timeout
+// expires, and returns the messages recorded so far.
+func (r *Recorder) Wait(n int, timeout time.Duration) []message.Msg {
+	expired := time.After(timeout)
+	for {
+		r.mu.Lock()
+		if len(r.msgs) >= n {
+			defer r.mu.Unlock()
+			return append([]message.Msg(nil), r.msgs...)
+		}
+		if r.wait == nil {
+			r.wait = make(chan struct{})
+		}
+		wait := r.wait
+		r.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-expired:
+			return r.Msgs()
+		}
+	}
+}
+
+// Reset clears the recorded messages.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	r.msgs = nil
+	r.mu.Unlock()
+}
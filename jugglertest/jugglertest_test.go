@@ -0,0 +1,50 @@
+package jugglertest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// authHandler rejects the requests of anonymous connections.
+func authHandler(next juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+		if m.Type().IsRead() && c.Identity == "" {
+			c.Send(message.NewNack(m, message.CodeUnauthorized, errors.New("anonymous")))
+			return
+		}
+		next.Handle(ctx, c, m)
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	rec := &Recorder{}
+	h := authHandler(rec)
+	c := NewConn(h)
+	assert.Nil(t, c.RemoteAddr(), "no network address")
+
+	call, err := message.NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	h.Handle(context.Background(), c, call)
+	msgs := rec.Msgs()
+	if assert.Len(t, msgs, 1, "recorded messages") {
+		if assert.IsType(t, &message.Nack{}, msgs[0], "NACK") {
+			assert.Equal(t, message.CodeUnauthorized, msgs[0].(*message.Nack).Payload.Code, "NACK code")
+		}
+	}
+
+	rec.Reset()
+	c = NewConn(h)
+	c.Identity = "u1"
+	go h.Handle(context.Background(), c, call)
+	msgs = rec.Wait(1, time.Second)
+	if assert.Len(t, msgs, 1, "recorded messages") {
+		assert.Equal(t, call, msgs[0], "forwarded call")
+	}
+}
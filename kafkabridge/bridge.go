@@ -0,0 +1,242 @@
+// Package kafkabridge mirrors the events of pub-sub channels into Kafka
+// topics, and publishes the messages of Kafka topics back as juggler
+// events, so that analytics pipelines can ingest the juggler traffic
+// without custom consumers. It does not depend on a Kafka client: the
+// Producer and Consumer interfaces are implemented with the client of
+// choice, e.g. a sarama.SyncProducer and a partition consumer.
+//
+// The events are encoded in Kafka as the JSON-encoded
+// message.EvntPayload, with the channel as key, and the messages
+// consumed from Kafka are decoded the same way. The events published by
+// the bridge have the BridgeHeader, so that they are not mirrored back
+// to Kafka.
+package kafkabridge
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// BridgeHeader is the header of the events published by the bridge from
+// the messages consumed from Kafka (see message.Headers).
+const BridgeHeader = "juggler-bridge"
+
+// ErrClosed is returned by Mirror when the Bridge is closed.
+var ErrClosed = errors.New("kafkabridge: bridge closed")
+
+// Message is a Kafka message.
+type Message struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// Producer defines the method required to write messages to Kafka.
+type Producer interface {
+	// Produce writes m to its topic. It is called by a single goroutine.
+	Produce(m *Message) error
+}
+
+// Consumer defines the methods required to read messages from Kafka.
+type Consumer interface {
+	// Messages returns the stream of messages. The channel is closed
+	// when the consumer is closed or fails.
+	Messages() <-chan *Message
+
+	// MessagesErr returns the error that caused the channel returned
+	// from Messages to be closed.
+	MessagesErr() error
+}
+
+// Route mirrors the events of a channel, or of the channels that match a
+// pattern, into a Kafka topic.
+type Route struct {
+	Channel string
+	Pattern bool
+	Topic   string
+}
+
+// Bridge mirrors the events of its Broker into Kafka, and publishes the
+// messages of a Kafka consumer into the Broker. The events are mirrored
+// and published at most once: they are dropped if the Producer or the
+// Broker fails.
+type Bridge struct {
+	// Broker is the pub-sub broker of the events.
+	Broker broker.PubSubBroker
+
+	// Producer writes the mirrored events to Kafka.
+	Producer Producer
+
+	// Routes are the channels and patterns mirrored by Mirror, with
+	// their topic. An event is mirrored to the topics of all its routes.
+	Routes []Route
+
+	// Vars can be set to track the number of MirroredEvents,
+	// FailedMirroredEvents, ConsumedMessages, InvalidConsumedMessages and
+	// FailedConsumedMessages.
+	Vars *expvar.Map
+
+	// LogFunc is the logging function, log.Printf if nil.
+	LogFunc func(string, ...interface{})
+
+	mu     sync.Mutex
+	psc    broker.PubSubConn
+	closed bool
+}
+
+// Mirror subscribes to the channels and patterns of the routes, and
+// writes their events to the topics until Close is called or the
+// pub-sub connection fails. It returns ErrClosed once closed, or the
+// error of the connection. The events published by the bridge itself
+// (see Consume) are not mirrored.
+func (b *Bridge) Mirror() error {
+	psc, err := b.Broker.NewPubSubConn()
+	if err != nil {
+		return err
+	}
+	defer psc.Close()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	b.psc = psc
+	b.mu.Unlock()
+
+	topics := make(map[broker.Subscription][]string)
+	for _, r := range b.Routes {
+		sub := broker.Subscription{Channel: r.Channel, Pattern: r.Pattern}
+		if _, ok := topics[sub]; !ok {
+			if err := psc.Subscribe(r.Channel, r.Pattern); err != nil {
+				return err
+			}
+		}
+		topics[sub] = append(topics[sub], r.Topic)
+	}
+
+	for ev := range psc.Events() {
+		if _, ok := ev.Headers[BridgeHeader]; ok {
+			continue
+		}
+		sub := broker.Subscription{Channel: ev.Channel}
+		if ev.Pattern != "" {
+			sub = broker.Subscription{Channel: ev.Pattern, Pattern: true}
+		}
+		if len(topics[sub]) == 0 {
+			continue
+		}
+
+		v, err := json.Marshal(ev)
+		if err != nil {
+			b.add("FailedMirroredEvents")
+			b.logf("kafkabridge: failed to encode event %v: %v", ev.MsgUUID, err)
+			continue
+		}
+		for _, topic := range topics[sub] {
+			if err := b.Producer.Produce(&Message{Topic: topic, Key: []byte(ev.Channel), Value: v}); err != nil {
+				b.add("FailedMirroredEvents")
+				b.logf("kafkabridge: failed to mirror event %v to %s: %v", ev.MsgUUID, topic, err)
+				continue
+			}
+			b.add("MirroredEvents")
+		}
+	}
+
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	return psc.EventsErr()
+}
+
+// Close closes the pub-sub connection of Mirror, so that it returns.
+// The Consumer of Consume must be closed by the caller.
+func (b *Bridge) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.psc != nil {
+		return b.psc.Close()
+	}
+	return nil
+}
+
+// Consume publishes the messages of c to the broker until the channel of
+// its messages is closed, and returns c.MessagesErr. Each message is
+// decoded as a message.EvntPayload, and published on its channel, or on
+// the key of the message if the event has no channel, with the
+// BridgeHeader. A message that cannot be decoded is dropped. The events
+// keep their UUID and timestamp, if set.
+func (b *Bridge) Consume(c Consumer) error {
+	for m := range c.Messages() {
+		var ev message.EvntPayload
+		if err := json.Unmarshal(m.Value, &ev); err != nil {
+			b.add("InvalidConsumedMessages")
+			b.logf("kafkabridge: invalid message of %s: %v", m.Topic, err)
+			continue
+		}
+		channel := ev.Channel
+		if channel == "" {
+			channel = string(m.Key)
+		}
+		if channel == "" {
+			b.add("InvalidConsumedMessages")
+			b.logf("kafkabridge: message of %s without channel", m.Topic)
+			continue
+		}
+
+		pp := &message.PubPayload{
+			MsgUUID:     ev.MsgUUID,
+			Args:        ev.Args,
+			ContentType: ev.ContentType,
+			Timestamp:   ev.Timestamp,
+			TTL:         ev.TTL,
+			Headers:     make(message.Headers, len(ev.Headers)+1),
+		}
+		if pp.MsgUUID == nil {
+			pp.MsgUUID = message.NewID()
+		}
+		if pp.Timestamp.IsZero() {
+			pp.Timestamp = time.Now().UTC()
+		}
+		for k, v := range ev.Headers {
+			pp.Headers[k] = v
+		}
+		pp.Headers[BridgeHeader] = m.Topic
+
+		if err := b.Broker.Publish(channel, pp); err != nil {
+			b.add("FailedConsumedMessages")
+			b.logf("kafkabridge: failed to publish message of %s on %s: %v", m.Topic, channel, err)
+			continue
+		}
+		b.add("ConsumedMessages")
+	}
+	return c.MessagesErr()
+}
+
+func (b *Bridge) add(key string) {
+	if b.Vars != nil {
+		b.Vars.Add(key, 1)
+	}
+}
+
+func (b *Bridge) logf(f string, args ...interface{}) {
+	if b.LogFunc != nil {
+		b.LogFunc(f, args...)
+		return
+	}
+	log.Printf(f, args...)
+}
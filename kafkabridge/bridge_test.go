@@ -0,0 +1,138 @@
+package kafkabridge
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/jugglertest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeProducer struct {
+	mu   sync.Mutex
+	msgs []*Message
+	fail string // topic that fails
+}
+
+func (p *fakeProducer) Produce(m *Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m.Topic == p.fail {
+		return errors.New("produce failed")
+	}
+	p.msgs = append(p.msgs, m)
+	return nil
+}
+
+func (p *fakeProducer) messages() []*Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Message(nil), p.msgs...)
+}
+
+type fakeConsumer struct {
+	ch  chan *Message
+	err error
+}
+
+func (c *fakeConsumer) Messages() <-chan *Message { return c.ch }
+func (c *fakeConsumer) MessagesErr() error        { return c.err }
+
+func TestMirror(t *testing.T) {
+	brk := &jugglertest.Broker{}
+	prod := &fakeProducer{fail: "failing"}
+	vars := new(expvar.Map).Init()
+	b := &Bridge{
+		Broker:   brk,
+		Producer: prod,
+		Routes: []Route{
+			{Channel: "a", Topic: "t1"},
+			{Channel: "b.*", Pattern: true, Topic: "t2"},
+			{Channel: "b.*", Pattern: true, Topic: "failing"},
+		},
+		Vars:    vars,
+		LogFunc: func(string, ...interface{}) {},
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- b.Mirror() }()
+	time.Sleep(10 * time.Millisecond) // ensure time to subscribe
+
+	for _, ch := range []string{"a", "b.c", "c"} {
+		require.NoError(t, brk.Publish(ch, &message.PubPayload{MsgUUID: message.NewID(), Args: json.RawMessage(`1`)}), "Publish %s", ch)
+	}
+	require.NoError(t, brk.Publish("a", &message.PubPayload{MsgUUID: message.NewID(), Headers: message.Headers{BridgeHeader: "t1"}}), "Publish from bridge")
+
+	deadline := time.Now().Add(time.Second)
+	for len(prod.messages()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // ensure time to skip the last event
+	require.NoError(t, b.Close(), "Close")
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrClosed, err, "Mirror error")
+	case <-time.After(time.Second):
+		t.Fatal("Mirror did not return")
+	}
+
+	msgs := prod.messages()
+	require.Equal(t, 2, len(msgs), "mirrored messages")
+	assert.Equal(t, "t1", msgs[0].Topic, "topic of a")
+	assert.Equal(t, "a", string(msgs[0].Key), "key of a")
+	assert.Equal(t, "t2", msgs[1].Topic, "topic of b.c")
+
+	var ev message.EvntPayload
+	require.NoError(t, json.Unmarshal(msgs[1].Value, &ev), "decode event")
+	assert.Equal(t, "b.c", ev.Channel, "channel")
+	assert.Equal(t, "b.*", ev.Pattern, "pattern")
+	assert.Equal(t, "1", string(ev.Args), "args")
+
+	assert.Equal(t, "2", vars.Get("MirroredEvents").String(), "MirroredEvents")
+	assert.Equal(t, "1", vars.Get("FailedMirroredEvents").String(), "FailedMirroredEvents")
+}
+
+func TestConsume(t *testing.T) {
+	brk := &jugglertest.Broker{}
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn")
+	defer psc.Close()
+	require.NoError(t, psc.Subscribe("*", true), "Subscribe")
+
+	id := message.NewID()
+	ev, err := json.Marshal(&message.EvntPayload{MsgUUID: id, Channel: "a", Args: json.RawMessage(`"x"`), Headers: message.Headers{"k": "v"}})
+	require.NoError(t, err, "Marshal")
+
+	c := &fakeConsumer{ch: make(chan *Message, 3), err: errors.New("consumer closed")}
+	c.ch <- &Message{Topic: "in", Value: ev}
+	c.ch <- &Message{Topic: "in", Key: []byte("b"), Value: []byte(`{"args":2}`)}
+	c.ch <- &Message{Topic: "in", Value: []byte(`not json`)}
+	close(c.ch)
+
+	vars := new(expvar.Map).Init()
+	b := &Bridge{Broker: brk, Vars: vars, LogFunc: func(string, ...interface{}) {}}
+	assert.Equal(t, c.err, b.Consume(c), "Consume error")
+
+	for i, want := range []string{"a", "b"} {
+		select {
+		case got := <-psc.Events():
+			assert.Equal(t, want, got.Channel, "channel %d", i)
+			assert.Equal(t, "in", got.Headers[BridgeHeader], "bridge header %d", i)
+			assert.NotNil(t, got.MsgUUID, "UUID %d", i)
+			if i == 0 {
+				assert.Equal(t, id, got.MsgUUID, "UUID kept")
+				assert.Equal(t, "v", got.Headers["k"], "headers kept")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not received", i)
+		}
+	}
+	assert.Equal(t, "2", vars.Get("ConsumedMessages").String(), "ConsumedMessages")
+	assert.Equal(t, "1", vars.Get("InvalidConsumedMessages").String(), "InvalidConsumedMessages")
+}
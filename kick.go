@@ -0,0 +1,117 @@
+package juggler
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrConnKicked is the CloseErr of a connection closed by
+// CloseConnsByIdentity or CloseConnsSubscribedTo without reason.
+var ErrConnKicked = errors.New("juggler: connection closed by the server")
+
+// servedConns is the set of the connections served by a Server.
+type servedConns struct {
+	mu    sync.Mutex
+	conns map[*Conn]bool
+}
+
+func (sc *servedConns) add(c *Conn) {
+	sc.mu.Lock()
+	if sc.conns == nil {
+		sc.conns = make(map[*Conn]bool)
+	}
+	sc.conns[c] = true
+	sc.mu.Unlock()
+}
+
+func (sc *servedConns) remove(c *Conn) {
+	sc.mu.Lock()
+	delete(sc.conns, c)
+	sc.mu.Unlock()
+}
+
+// list returns the connections for which fn returns true, or all the
+// connections if fn is nil.
+func (sc *servedConns) list(fn func(*Conn) bool) []*Conn {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	var list []*Conn
+	for c := range sc.conns {
+		if fn == nil || fn(c) {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// closeConnsIf closes with err the connections served by srv for which
+// fn returns true, and returns the number of connections closed.
+func (srv *Server) closeConnsIf(fn func(*Conn) bool, err error) int {
+	if err == nil {
+		err = ErrConnKicked
+	}
+
+	list := srv.served.list(fn)
+	for _, c := range list {
+		c.Close(err)
+	}
+	if srv.Vars != nil {
+		srv.Vars.Add("KickedConns", int64(len(list)))
+	}
+	return len(list)
+}
+
+// CloseConnsByIdentity closes the connections served by srv with the
+// Identity id, e.g. to evict a misbehaving user, and returns the number
+// of connections closed. Their CloseErr is reason, or ErrConnKicked if
+// it is nil. The clients may connect again, the identity should be
+// denied by the authentication for the eviction to last.
+func (srv *Server) CloseConnsByIdentity(id string, reason error) int {
+	return srv.closeConnsIf(func(c *Conn) bool {
+		return c.Identity == id
+	}, reason)
+}
+
+// CloseConnsSubscribedTo closes the connections served by srv that are
+// subscribed to channel, as a channel or as a pattern, e.g. to force
+// their clients to connect again after a change of configuration, and
+// returns the number of connections closed. The channel is the name in
+// the broker, qualified by the tenant of the connections that have one
+// (see message.TenantName). Their CloseErr is reason, or ErrConnKicked
+// if it is nil.
+func (srv *Server) CloseConnsSubscribedTo(channel string, reason error) int {
+	return srv.closeConnsIf(func(c *Conn) bool {
+		return c.subscribedTo(channel)
+	}, reason)
+}
+
+// subscriptions holds the subscriptions of a connection, keyed by
+// subKey with the name of the channel in the broker.
+type subscriptions struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func (c *Conn) addSub(channel string, pattern bool) {
+	c.subs.mu.Lock()
+	if c.subs.keys == nil {
+		c.subs.keys = make(map[string]bool)
+	}
+	c.subs.keys[subKey(channel, pattern)] = true
+	c.subs.mu.Unlock()
+}
+
+func (c *Conn) removeSub(channel string, pattern bool) {
+	c.subs.mu.Lock()
+	delete(c.subs.keys, subKey(channel, pattern))
+	c.subs.mu.Unlock()
+}
+
+// subscribedTo returns true if the connection is subscribed to channel,
+// as a channel or as a pattern.
+func (c *Conn) subscribedTo(channel string) bool {
+	c.subs.mu.Lock()
+	defer c.subs.mu.Unlock()
+	return c.subs.keys[subKey(channel, false)] || c.subs.keys[subKey(channel, true)]
+}
@@ -0,0 +1,102 @@
+package juggler_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestCloseConns(t *testing.T) {
+	var mu sync.Mutex
+	ids := []string{"u1", "u2", "u1"}
+	reasons := make(map[string]error)
+	server := &juggler.Server{
+		PubSubBroker: fakePubSubBroker{},
+		ConnState: func(c *juggler.Conn, cs juggler.ConnState) {
+			mu.Lock()
+			defer mu.Unlock()
+			if cs == juggler.Accepting {
+				c.Identity, ids = ids[0], ids[1:]
+			}
+			if cs == juggler.Closed {
+				reasons[c.Identity] = c.CloseErr
+			}
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	// connect the clients one at a time, so that they get their identity
+	// in order
+	dial := func(channel string, pattern bool) *client.Client {
+		acks := make(chan message.Msg, 1)
+		h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+			acks <- m
+		})
+		hdr := http.Header{"Juggler-Allowed-Messages": {"sub, unsb"}}
+		cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, hdr, client.SetHandler(h))
+		require.NoError(t, err, "Dial")
+		_, err = cli.Sub(channel, pattern)
+		require.NoError(t, err, "Sub")
+		waitMsg(t, acks, message.AckMsg, "Sub "+channel)
+		return cli
+	}
+	closed := func(cli *client.Client) bool {
+		select {
+		case <-cli.CloseNotify():
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	cli1 := dial("a", false)
+	defer cli1.Close()
+	cli2 := dial("b.*", true)
+	defer cli2.Close()
+	cli3 := dial("b", false)
+	defer cli3.Close()
+
+	assert.Equal(t, 0, server.CloseConnsByIdentity("nobody", nil), "unknown identity")
+	assert.Equal(t, 0, server.CloseConnsSubscribedTo("c", nil), "no subscriber")
+
+	assert.Equal(t, 2, server.CloseConnsByIdentity("u1", nil), "u1 connections")
+	assert.True(t, closed(cli1), "u1 connection 1 closed")
+	assert.True(t, closed(cli3), "u1 connection 2 closed")
+
+	errPush := errors.New("configuration changed")
+	assert.Equal(t, 1, server.CloseConnsSubscribedTo("b.*", errPush), "pattern subscribers")
+	assert.True(t, closed(cli2), "u2 connection closed")
+
+	// wait for the connections to be closed on the server side
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(reasons)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, server.CloseConnsByIdentity("u2", nil), "closed connections forgotten")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, juggler.ErrConnKicked, reasons["u1"], "u1 reason")
+	assert.Equal(t, errPush, reasons["u2"], "u2 reason")
+}
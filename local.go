@@ -0,0 +1,100 @@
+package juggler
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// LocalHandler handles the CALL requests of a local URI in the server
+// (see SetLocalURIs). It returns the result of the call, which is
+// encoded as JSON, or the error that is returned as error result (see
+// message.ErrResult). The context is done when the call times out.
+type LocalHandler func(ctx context.Context, c *Conn, m *message.Call) (interface{}, error)
+
+var local = struct {
+	sync.RWMutex
+	uris map[string]LocalHandler
+}{}
+
+// SetLocalURIs sets the URIs whose CALL requests are handled by the
+// server with the local handler, without going through the broker and
+// the callees. It replaces the URIs previously set, and a nil map
+// disables the local handlers. It is safe to call concurrently, and it
+// applies to all servers.
+//
+// The RES is sent directly once the handler returns, or dropped if the
+// call timed out. The handler is called by the goroutine that reads the
+// messages of the connection, so it should be fast, e.g. for cheap
+// built-ins and hot trivial endpoints where the latency of the broker
+// matters. A key can be a versioned URI (see message.VersionedURI), to
+// handle the calls that request that version.
+func SetLocalURIs(uris map[string]LocalHandler) {
+	m := make(map[string]LocalHandler, len(uris))
+	for uri, h := range uris {
+		if h != nil {
+			m[uri] = h
+		}
+	}
+
+	local.Lock()
+	local.uris = m
+	local.Unlock()
+}
+
+// localHandler returns the local handler of the versioned uri, or nil.
+func localHandler(vuri string) LocalHandler {
+	local.RLock()
+	h := local.uris[vuri]
+	local.RUnlock()
+	return h
+}
+
+// callLocal answers the CALL with the ACK and the RES holding the result
+// of the local handler h, with the URI of the request uri.
+func callLocal(c *Conn, m *message.Call, uri string, h LocalHandler, addFn func(string, int64)) {
+	sendAck(c, m)
+
+	timeout := m.Payload.Timeout
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addFn("LocalCalls", 1)
+	v, err := h(ctx, c, m)
+	if ctx.Err() != nil {
+		addFn("ExpiredLocalCalls", 1)
+		return
+	}
+
+	b, err := localResult(v, err)
+	if err != nil {
+		b, _ = localResult(nil, err)
+	}
+	c.Send(message.NewRes(&message.ResPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      uri,
+		Args:     b,
+	}))
+}
+
+// localResult encodes the result v of a local call, or its error result
+// if e is not nil.
+func localResult(v interface{}, e error) (json.RawMessage, error) {
+	if e != nil {
+		if ms, ok := e.(json.Marshaler); ok {
+			v = ms
+		} else {
+			var er message.ErrResult
+			er.Error.Message = e.Error()
+			v = er
+		}
+	}
+	return json.Marshal(v)
+}
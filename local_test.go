@@ -0,0 +1,83 @@
+package juggler_test
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestLocalURIs(t *testing.T) {
+	juggler.SetLocalURIs(map[string]juggler.LocalHandler{
+		"local.echo": func(ctx context.Context, c *juggler.Conn, m *message.Call) (interface{}, error) {
+			return m.Payload.Args, nil
+		},
+		"local.echo@2": func(ctx context.Context, c *juggler.Conn, m *message.Call) (interface{}, error) {
+			return "v2", nil
+		},
+		"local.fail": func(ctx context.Context, c *juggler.Conn, m *message.Call) (interface{}, error) {
+			return nil, errors.New("failed")
+		},
+		"local.slow": func(ctx context.Context, c *juggler.Conn, m *message.Call) (interface{}, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	defer juggler.SetLocalURIs(nil)
+
+	vars := new(expvar.Map).Init()
+	server := &juggler.Server{CallerBroker: fakeCallerBroker{}, Vars: vars}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetCallVersion("local.echo", "2"))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	ctx := context.Background()
+	var res json.RawMessage
+	require.NoError(t, cli.Invoke(ctx, "local.echo", map[string]int{"a": 1}, &res, time.Second), "echo@2")
+	assert.Equal(t, `"v2"`, string(res), "echo@2 result")
+
+	cli2, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}})
+	require.NoError(t, err, "Dial")
+	defer cli2.Close()
+
+	require.NoError(t, cli2.Invoke(ctx, "local.echo", map[string]int{"a": 1}, &res, time.Second), "echo")
+	assert.Equal(t, `{"a":1}`, string(res), "echo result")
+
+	err = cli2.Invoke(ctx, "local.fail", nil, nil, time.Second)
+	if assert.IsType(t, &client.ResultError{}, err, "fail") {
+		assert.Equal(t, "failed", err.(*client.ResultError).Message, "fail message")
+	}
+
+	err = cli2.Invoke(ctx, "local.slow", nil, nil, 50*time.Millisecond)
+	assert.Equal(t, client.ErrCallExpired, err, "slow")
+
+	// the expired call is counted once its handler returns, after the
+	// client gave up on it
+	deadline := time.Now().Add(time.Second)
+	for vars.Get("ExpiredLocalCalls") == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, "4", vars.Get("LocalCalls").String(), "LocalCalls")
+	if assert.NotNil(t, vars.Get("ExpiredLocalCalls"), "ExpiredLocalCalls") {
+		assert.Equal(t, "1", vars.Get("ExpiredLocalCalls").String(), "ExpiredLocalCalls")
+	}
+}
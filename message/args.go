@@ -0,0 +1,55 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ArgsError is the error returned when the arguments of a message
+// cannot be decoded.
+type ArgsError struct {
+	// Type is the type of the message.
+	Type Type
+
+	// Name is the URI of a CALL or RES, or the channel of an EVNT.
+	Name string
+
+	// Args is the raw value of the arguments.
+	Args json.RawMessage
+
+	// Err is the error of the decoding.
+	Err error
+}
+
+// Error returns the error message.
+func (e *ArgsError) Error() string {
+	return fmt.Sprintf("invalid %s arguments for %s: %v", e.Type, e.Name, e.Err)
+}
+
+// UnmarshalArgs decodes the arguments of the event into v, as JSON or,
+// if the event has a ContentType, with the Binary codec. The errors are
+// returned as *ArgsError.
+func (ev *Evnt) UnmarshalArgs(v interface{}) error {
+	return unmarshalArgs(ev.Type(), ev.Payload.Channel, ev.Payload.ContentType, ev.Payload.Args, v)
+}
+
+// UnmarshalArgs decodes the arguments of the result into v, as JSON
+// or, if the result has a ContentType, with the Binary codec. The errors
+// are returned as *ArgsError.
+func (res *Res) UnmarshalArgs(v interface{}) error {
+	return unmarshalArgs(res.Type(), res.Payload.URI, res.Payload.ContentType, res.Payload.Args, v)
+}
+
+func unmarshalArgs(t Type, name, contentType string, args json.RawMessage, v interface{}) error {
+	codec := JSON
+	if contentType != "" {
+		codec = Binary
+	}
+	if len(args) == 0 {
+		args = json.RawMessage("null")
+	}
+	if err := codec.Decode(args, v); err != nil {
+		return &ArgsError{Type: t, Name: name, Args: args, Err: err}
+	}
+	return nil
+}
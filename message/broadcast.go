@@ -0,0 +1,45 @@
+package message
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// NewBroadcast returns the payload to publish on BroadcastChannel so
+// that the servers that relay the broadcasts write an event with args
+// on channel to all their connections, e.g. to announce a maintenance
+// to the whole cluster (see juggler.Server.BroadcastAll).
+func NewBroadcast(channel string, args interface{}) (*PubPayload, error) {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	se, err := json.Marshal(&SystemEvent{
+		Event:     BroadcastEvent,
+		Channel:   channel,
+		Args:      b,
+		Timestamp: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PubPayload{MsgUUID: NewID(), Args: se, Timestamp: now}, nil
+}
+
+// BroadcastEvnt returns the event to write to the connections for the
+// broadcast ev received on BroadcastChannel. It returns false if ev is
+// not a broadcast.
+func BroadcastEvnt(ev *EvntPayload) (*EvntPayload, bool) {
+	var se SystemEvent
+	if err := json.Unmarshal(ev.Args, &se); err != nil || se.Event != BroadcastEvent || se.Channel == "" {
+		return nil, false
+	}
+	return &EvntPayload{
+		MsgUUID:   ev.MsgUUID,
+		Channel:   se.Channel,
+		Args:      se.Args,
+		Timestamp: se.Timestamp,
+	}, true
+}
@@ -0,0 +1,125 @@
+package message
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec encodes and decodes the arguments of call requests and the values
+// of their results, inside the JSON envelope of the messages. The encoded
+// value must be valid JSON, e.g. a string holding a binary encoding.
+//
+// A Codec that stores a binary encoding reports its media type with a
+// ContentType method (see ContentType), which is set in the payloads of
+// the messages so that the peers know how to decode the arguments.
+type Codec interface {
+	// Encode returns the encoded arguments for v.
+	Encode(v interface{}) (json.RawMessage, error)
+
+	// Decode decodes the encoded arguments into v.
+	Decode(args json.RawMessage, v interface{}) error
+}
+
+// JSON is the default Codec, it encodes values as JSON.
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) (json.RawMessage, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(args json.RawMessage, v interface{}) error {
+	return json.Unmarshal(args, v)
+}
+
+// DefaultBinaryContentType is the media type of the values encoded by
+// a Base64 codec without a Type.
+const DefaultBinaryContentType = "application/octet-stream"
+
+// ContentType returns the media type of the values encoded by c, or an
+// empty string for JSON.
+func ContentType(c Codec) string {
+	if ct, ok := c.(interface {
+		ContentType() string
+	}); ok {
+		return ct.ContentType()
+	}
+	return ""
+}
+
+// Base64 is a Codec that encodes values in a binary format, e.g.
+// protocol buffers, using the Marshal and Unmarshal functions, and
+// stores the result as a base64-encoded JSON string. Type is the media
+// type of the binary format, e.g. "application/x-protobuf", it defaults
+// to DefaultBinaryContentType.
+type Base64 struct {
+	Marshal   func(interface{}) ([]byte, error)
+	Unmarshal func([]byte, interface{}) error
+	Type      string
+}
+
+// ContentType returns the media type of the values encoded by c.
+func (c Base64) ContentType() string {
+	if c.Type == "" {
+		return DefaultBinaryContentType
+	}
+	return c.Type
+}
+
+// Encode implements Codec for Base64.
+func (c Base64) Encode(v interface{}) (json.RawMessage, error) {
+	b, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(b))
+}
+
+// Decode implements Codec for Base64.
+func (c Base64) Decode(args json.RawMessage, v interface{}) error {
+	var s string
+	if err := json.Unmarshal(args, &s); err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(b, v)
+}
+
+// Binary is a Codec for raw binary values, e.g. images or compressed
+// blobs. It encodes a []byte as a base64-encoded JSON string, and
+// decodes into a *[]byte.
+var Binary Codec = Base64{Marshal: marshalBytes, Unmarshal: unmarshalBytes}
+
+func marshalBytes(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("binary codec cannot encode %T", v)
+	}
+	return b, nil
+}
+
+func unmarshalBytes(b []byte, v interface{}) error {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("binary codec cannot decode into %T", v)
+	}
+	*p = b
+	return nil
+}
+
+// Codecs maps URIs to the Codec used for the arguments of the calls to
+// that URI and for the values of their results.
+type Codecs map[string]Codec
+
+// Codec returns the Codec registered for uri, or JSON if there is none.
+func (cs Codecs) Codec(uri string) Codec {
+	if c := cs[uri]; c != nil {
+		return c
+	}
+	return JSON
+}
@@ -0,0 +1,74 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bytesCodec is a Base64 codec for []byte values, as a stand-in for a
+// binary encoding.
+var bytesCodec = Base64{
+	Marshal: func(v interface{}) ([]byte, error) {
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, errors.New("not a byte slice")
+		}
+		return b, nil
+	},
+	Unmarshal: func(b []byte, v interface{}) error {
+		p, ok := v.(*[]byte)
+		if !ok {
+			return errors.New("not a byte slice pointer")
+		}
+		*p = b
+		return nil
+	},
+}
+
+func TestCodecs(t *testing.T) {
+	cs := Codecs{"bin": bytesCodec}
+	assert.Equal(t, JSON, cs.Codec("a"), "default codec")
+
+	c := cs.Codec("bin")
+	args, err := c.Encode([]byte{0, 1, 2})
+	require.NoError(t, err, "Encode")
+	assert.Equal(t, `"AAEC"`, string(args), "encoded")
+
+	var got []byte
+	require.NoError(t, c.Decode(args, &got), "Decode")
+	assert.Equal(t, []byte{0, 1, 2}, got, "decoded")
+
+	assert.Error(t, c.Decode(json.RawMessage(`{}`), &got), "decode invalid")
+	_, err = c.Encode("a")
+	assert.Error(t, err, "encode invalid")
+
+	assert.Equal(t, "", ContentType(JSON), "JSON content type")
+	assert.Equal(t, DefaultBinaryContentType, ContentType(c), "default binary content type")
+	assert.Equal(t, "application/x-protobuf", ContentType(Base64{Type: "application/x-protobuf"}), "binary content type")
+
+	args, err = JSON.Encode(map[string]int{"a": 1})
+	require.NoError(t, err, "JSON Encode")
+	var m map[string]int
+	require.NoError(t, JSON.Decode(args, &m), "JSON Decode")
+	assert.Equal(t, map[string]int{"a": 1}, m, "JSON round-trip")
+}
+
+func TestBinaryCodec(t *testing.T) {
+	args, err := Binary.Encode([]byte("\x89PNG"))
+	require.NoError(t, err, "Encode")
+	assert.Equal(t, `"iVBORw=="`, string(args), "encoded")
+
+	var got []byte
+	require.NoError(t, Binary.Decode(args, &got), "Decode")
+	assert.Equal(t, []byte("\x89PNG"), got, "decoded")
+	assert.Equal(t, DefaultBinaryContentType, ContentType(Binary), "content type")
+
+	_, err = Binary.Encode("a")
+	assert.Error(t, err, "encode string")
+	var s string
+	assert.Error(t, Binary.Decode(args, &s), "decode into string")
+}
@@ -0,0 +1,46 @@
+package message
+
+// The codes of Nack messages. They follow the HTTP status codes, so
+// that codes from 400 to 499 mean the request is invalid or not allowed
+// and should not be retried as-is, and codes from 500 to 599 mean the
+// request failed on the server and may be retried later. Handlers may
+// use other codes for their own errors.
+const (
+	// CodeBadRequest means the request is invalid, e.g. its arguments
+	// cannot be decoded.
+	CodeBadRequest = 400
+
+	// CodeUnauthorized means the caller is not authenticated.
+	CodeUnauthorized = 401
+
+	// CodeForbidden means the caller does not have access to the
+	// requested URI or channel.
+	CodeForbidden = 403
+
+	// CodeNoCallee means no callee is listening on the URI of the call
+	// request.
+	CodeNoCallee = 404
+
+	// CodeUnsupportedVersion means no callee supports the version of
+	// the URI requested by the call.
+	CodeUnsupportedVersion = 406
+
+	// CodeTimeout means the request could not be processed in time.
+	CodeTimeout = 408
+
+	// CodePayloadTooLarge means the request or its response is larger
+	// than the allowed limit.
+	CodePayloadTooLarge = 413
+
+	// CodeRateLimited means the caller sent too many requests and must
+	// wait before sending more.
+	CodeRateLimited = 429
+
+	// CodeHandlerError means the server failed to process the request,
+	// e.g. because the broker returned an error.
+	CodeHandlerError = 500
+
+	// CodeUnavailable means the server cannot process the request for
+	// now, e.g. because it is in maintenance mode.
+	CodeUnavailable = 503
+)
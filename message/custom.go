@@ -0,0 +1,104 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Factory returns a new, zero message of a custom type, into which the
+// JSON-encoded messages of that type are unmarshaled. It is typically
+// a pointer to a struct that embeds Meta and has a Payload field, like
+// the standard messages:
+//
+//     type Ping struct {
+//         message.Meta `json:"meta"`
+//         Payload      struct {
+//             Seq int `json:"seq"`
+//         } `json:"payload"`
+//     }
+//
+type Factory func() Msg
+
+// customType is a custom message type that can be exchanged over the
+// network.
+type customType struct {
+	read    bool
+	factory Factory
+}
+
+var customTypes = make(map[Type]customType)
+
+// RegisterRead registers a new custom message having the provided name,
+// as Register does, that is sent by the clients to the server, e.g. a
+// domain-specific control frame. Unlike the other custom messages, the
+// messages of that type can be exchanged over the network: they are
+// unmarshaled by UnmarshalRequest into the message returned by factory,
+// and the server passes them to its custom message handler (see
+// juggler.Server.CustomMsgHandler).
+//
+// As Register, it should be called in the init function of the package
+// that needs the message, by both peers, and it panics if a message by
+// that name has already been registered.
+func RegisterRead(name string, factory Factory) Type {
+	mt := Register(name)
+	customTypes[mt] = customType{read: true, factory: factory}
+	return mt
+}
+
+// RegisterWrite is like RegisterRead for a custom message sent by the
+// server to the clients. The messages of that type are unmarshaled by
+// UnmarshalResponse, and the server writes them to the connection when
+// they are sent, as it does for the RES and EVNT messages.
+func RegisterWrite(name string, factory Factory) Type {
+	mt := Register(name)
+	customTypes[mt] = customType{read: false, factory: factory}
+	return mt
+}
+
+// IsCustomRead returns true if the message type is a custom message
+// registered with RegisterRead.
+func (mt Type) IsCustomRead() bool {
+	ct, ok := customTypes[mt]
+	return ok && ct.read
+}
+
+// IsCustomWrite returns true if the message type is a custom message
+// registered with RegisterWrite.
+func (mt Type) IsCustomWrite() bool {
+	ct, ok := customTypes[mt]
+	return ok && !ct.read
+}
+
+// customTypesOf returns the custom types sent by the clients if read is
+// true, by the server otherwise.
+func customTypesOf(read bool) []Type {
+	var types []Type
+	for mt, ct := range customTypes {
+		if ct.read == read {
+			types = append(types, mt)
+		}
+	}
+	return types
+}
+
+// unmarshalCustom unmarshals the message pm of a custom type into the
+// message returned by its factory.
+func unmarshalCustom(pm *partialMsg) (Msg, error) {
+	ct, ok := customTypes[pm.Meta.T]
+	if !ok {
+		return nil, fmt.Errorf("unknown message %s", pm.Meta.T)
+	}
+
+	b, err := json.Marshal(pm)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s message: %v", pm.Meta.T, err)
+	}
+	m := ct.factory()
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid %s message: %v", pm.Meta.T, err)
+	}
+	if m.Type() != pm.Meta.T {
+		return nil, fmt.Errorf("invalid %s message: factory returned a %s message", pm.Meta.T, m.Type())
+	}
+	return m, nil
+}
@@ -0,0 +1,87 @@
+package message
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testPing struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		Seq int `json:"seq"`
+	} `json:"payload"`
+}
+
+var (
+	// localMsg is a custom message that is not exchanged over the network
+	localMsg = Register("LOCL")
+	pingMsg  = RegisterRead("PING", func() Msg { return &testPing{} })
+	pongMsg  = RegisterWrite("PONG", func() Msg { return &testPing{} })
+)
+
+func TestCustomTypes(t *testing.T) {
+	assert.True(t, pingMsg.IsCustomRead(), "PING read")
+	assert.False(t, pingMsg.IsCustomWrite(), "PING write")
+	assert.False(t, pongMsg.IsCustomRead(), "PONG read")
+	assert.True(t, pongMsg.IsCustomWrite(), "PONG write")
+	assert.False(t, localMsg.IsCustomRead() || localMsg.IsCustomWrite(), "LOCL")
+	assert.False(t, CallMsg.IsCustomRead() || CallMsg.IsCustomWrite(), "CALL")
+
+	assert.True(t, V2.Supports(pingMsg), "PING supported")
+	assert.True(t, V2.Supports(pongMsg), "PONG supported")
+	assert.False(t, V2.Supports(localMsg), "LOCL supported")
+
+	assert.Panics(t, func() { RegisterRead("PING", func() Msg { return &testPing{} }) }, "registered twice")
+}
+
+func TestUnmarshalCustom(t *testing.T) {
+	ping := &testPing{Meta: NewMeta(pingMsg)}
+	ping.Payload.Seq = 42
+
+	var buf bytes.Buffer
+	require.NoError(t, V2.Encode(&buf, ping), "Encode")
+	raw := buf.String()
+
+	m, err := UnmarshalRequest(strings.NewReader(raw))
+	require.NoError(t, err, "UnmarshalRequest")
+	if assert.IsType(t, &testPing{}, m, "decoded") {
+		got := m.(*testPing)
+		assert.Equal(t, pingMsg, got.Type(), "type")
+		assert.Equal(t, ping.UUID(), got.UUID(), "uuid")
+		assert.Equal(t, 42, got.Payload.Seq, "seq")
+	}
+	assert.NoError(t, Lint([]byte(raw), m), "Lint")
+
+	// the custom requests are allowed regardless of the allowed messages
+	_, err = UnmarshalRequest(strings.NewReader(raw), PubMsg)
+	assert.NoError(t, err, "UnmarshalRequest with allowed messages")
+	_, err = UnmarshalResponse(strings.NewReader(raw))
+	assert.Error(t, err, "PING as response")
+	_, err = Unmarshal(strings.NewReader(raw))
+	assert.NoError(t, err, "Unmarshal")
+
+	pong := &testPing{Meta: NewMeta(pongMsg)}
+	buf.Reset()
+	require.NoError(t, V2.Encode(&buf, pong), "Encode")
+	raw = buf.String()
+	m, err = UnmarshalResponse(strings.NewReader(raw))
+	require.NoError(t, err, "UnmarshalResponse")
+	assert.Equal(t, pongMsg, m.Type(), "PONG type")
+	_, err = UnmarshalRequest(strings.NewReader(raw))
+	assert.Error(t, err, "PONG as request")
+
+	// a custom message that is not exchanged is still unknown
+	local := &testPing{Meta: NewMeta(localMsg)}
+	assert.Error(t, V2.Encode(&buf, local), "Encode LOCL")
+	_, err = Unmarshal(strings.NewReader(`{"meta":{"type":` + strconv.Itoa(int(localMsg)) + `},"payload":{}}`))
+	assert.Error(t, err, "Unmarshal LOCL")
+
+	// the payload must decode into the message of the factory
+	_, err = UnmarshalRequest(strings.NewReader(`{"meta":{"type":` + strconv.Itoa(int(pingMsg)) + `},"payload":{"seq":"x"}}`))
+	assert.Error(t, err, "invalid payload")
+}
@@ -0,0 +1,14 @@
+// +build gofuzz
+
+package message
+
+// Fuzz is the entry point of go-fuzz for the message package. It
+// unmarshals data as a message and lints it, and panics if a valid
+// message does not survive a round-trip. Run it with:
+//
+//     go-fuzz-build github.com/PuerkitoBio/juggler/message
+//     go-fuzz -bin=message-fuzz.zip -workdir=fuzz
+//
+func Fuzz(data []byte) int {
+	return fuzz(data)
+}
@@ -0,0 +1,53 @@
+package message
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuzz(t *testing.T) {
+	id := `"` + uuid.NewRandom().String() + `"`
+	cases := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"null", 0},
+		{"[]", 0},
+		{"1", 0},
+		{`""`, 0},
+		{"{}", 0},
+		{`{"meta":`, 0},
+		{`{"meta":{"type":1,"uuid":` + id + `},"payload":{"uri":"a",`, 0},
+		{`{"meta":{"type":"CALL"}}`, 0},
+		{`{"meta":{"type":-1}}`, 0},
+		{`{"meta":{"type":99},"payload":{}}`, 0},
+		{`{"meta":{"type":256},"payload":{}}`, 0},
+		{`{"meta":{"type":3,"uuid":12},"payload":{"channel":"a"}}`, 0},
+		{`{"meta":{"type":3,"uuid":"` + strings.Repeat("a", 4096) + `"},"payload":{"channel":"a"}}`, 0},
+		{`{"meta":{"type":3,"uuid":"1234"},"payload":{"channel":"a"}}`, 0},
+		{`{"meta":{"type":1,"uuid":` + id + `},"payload":"x"}`, 0},
+		{`{"meta":{"type":1,"uuid":` + id + `},"payload":{"uri":1}}`, 0},
+		{`{"meta":{"type":12,"uuid":` + id + `},"payload":{"msgs":[1]}}`, 0},
+		{`{"meta":{"type":12,"uuid":` + id + `},"payload":{"msgs":[{"meta":{"type":12},"payload":{"msgs":[]}}]}}`, 0},
+		{`{"meta":{"type":12,"uuid":` + id + `},"payload":{"msgs":[{"meta":{"type":3},"payload":{"channel":"a"}}]}}`, 0},
+
+		{`{"meta":{"type":3,"uuid":""},"payload":{"channel":"a"}}`, 1},
+		{`{"meta":{"type":1},"payload":{"uri":"a","args":null}}`, 1},
+		{`{"meta":{"type":1,"uuid":` + id + `},"payload":{"uri":"a","timeout":-1,"args":[1,{"b":null}]}}`, 1},
+		{`{"meta":{"type":2,"uuid":` + id + `},"payload":{"channel":"a","args":"x"}}`, 1},
+		{`{"meta":{"type":12,"uuid":` + id + `},"payload":{"msgs":[]}}`, 1},
+		{`{"meta":{"type":12,"uuid":` + id + `},"payload":{"msgs":[{"meta":{"type":1},"payload":{"uri":"a"}}]}}`, 1},
+		{`{"meta":{"type":7,"uuid":` + id + `},"payload":{"for":` + id + `,"code":500,"message":"x"}}`, 1},
+		{`{"meta":{"type":10,"uuid":` + id + `},"payload":{"channel":"a","for":` + id + `,"args":1}}`, 1},
+	}
+	for _, c := range cases {
+		var got int
+		if assert.NotPanics(t, func() { got = fuzz([]byte(c.in)) }, c.in) {
+			assert.Equal(t, c.want, got, c.in)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// fuzz checks that data is either rejected by Unmarshal or is a message
+// that marshals back to the same type. It returns 1 if data is a valid
+// message, 0 otherwise, as expected by go-fuzz.
+func fuzz(data []byte) int {
+	m, err := Unmarshal(bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+	Lint(data, m)
+	if _, err := UnmarshalRequest(bytes.NewReader(data)); err == nil && !m.Type().IsRead() && !m.Type().IsCustomRead() {
+		panic(fmt.Sprintf("request accepted with type %s", m.Type()))
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		// the arguments may be valid JSON that is re-encoded differently,
+		// but the message itself must always marshal.
+		panic(fmt.Sprintf("marshal %s: %v", m.Type(), err))
+	}
+	m2, err := Unmarshal(bytes.NewReader(b))
+	if err != nil {
+		panic(fmt.Sprintf("unmarshal marshaled %s: %v", m.Type(), err))
+	}
+	if m2.Type() != m.Type() {
+		panic(fmt.Sprintf("type changed from %s to %s", m.Type(), m2.Type()))
+	}
+	return 1
+}
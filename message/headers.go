@@ -0,0 +1,39 @@
+package message
+
+// Headers is a string-keyed map of metadata carried by the messages in
+// their Meta, e.g. a trace ID, a tenant ID, a locale or a deadline. The
+// juggler server propagates the headers of the CALL and PUB requests to
+// the callees and the subscribers through the broker payloads (see
+// CallPayload.Headers and EvntPayload.Headers), and the headers of the
+// results set by the callees to the RES messages (see ResPayload.Headers).
+// The keys are case-sensitive, and should be lowercase by convention.
+type Headers map[string]string
+
+// Get returns the value of the header key, or an empty string if it is
+// not set. It is safe to call on a nil Headers.
+func (h Headers) Get(key string) string {
+	return h[key]
+}
+
+// Clone returns a copy of h, or nil if h is empty.
+func (h Headers) Clone() Headers {
+	if len(h) == 0 {
+		return nil
+	}
+	cpy := make(Headers, len(h))
+	for k, v := range h {
+		cpy[k] = v
+	}
+	return cpy
+}
+
+// HeadersOf returns the headers of the message m, or nil if it has no
+// headers or does not embed Meta.
+func HeadersOf(m Msg) Headers {
+	if hm, ok := m.(interface {
+		headers() Headers
+	}); ok {
+		return hm.headers()
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaders(t *testing.T) {
+	call, err := NewCall("a", 1, time.Second)
+	require.NoError(t, err, "NewCall")
+	assert.Nil(t, HeadersOf(call), "no headers")
+	assert.Equal(t, "", call.Header("trace-id"), "no trace ID")
+
+	b, err := json.Marshal(call)
+	require.NoError(t, err, "Marshal")
+	assert.NotContains(t, string(b), "headers", "empty headers omitted")
+
+	call.SetHeader("trace-id", "t1")
+	assert.Equal(t, "t1", call.Header("trace-id"), "trace ID")
+	assert.Equal(t, Headers{"trace-id": "t1"}, HeadersOf(call), "HeadersOf")
+
+	b, err = json.Marshal(call)
+	require.NoError(t, err, "Marshal")
+	m, err := UnmarshalRequest(bytes.NewReader(b))
+	require.NoError(t, err, "UnmarshalRequest")
+	assert.Equal(t, "t1", HeadersOf(m).Get("trace-id"), "decoded trace ID")
+	assert.NoError(t, Lint(b, m), "Lint")
+
+	var nilHeaders Headers
+	assert.Equal(t, "", nilHeaders.Get("a"), "nil Get")
+	assert.Nil(t, nilHeaders.Clone(), "nil Clone")
+	h := Headers{"a": "1"}
+	cpy := h.Clone()
+	cpy["a"] = "2"
+	assert.Equal(t, "1", h.Get("a"), "Clone copies")
+
+	res := NewRes(&ResPayload{Headers: Headers{"a": "1"}})
+	assert.Equal(t, "1", res.Header("a"), "RES headers")
+	ev := NewEvnt(&EvntPayload{Headers: Headers{"a": "1"}})
+	assert.Equal(t, "1", ev.Header("a"), "EVNT headers")
+	assert.Nil(t, HeadersOf(NewAck(call)), "ACK headers")
+}
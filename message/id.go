@@ -0,0 +1,67 @@
+package message
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+var idGen = struct {
+	sync.RWMutex
+	fn func() uuid.UUID
+}{fn: uuid.NewRandom}
+
+// SetIDGenerator sets the function that generates the UUIDs of the
+// messages and of the connections, e.g. NewSortableID for IDs that sort
+// by creation time, or a generator that embeds shard information. It
+// must return 16-byte UUIDs that are unique across all peers, as they
+// are used as-is in the keys of the brokers and to correlate the
+// responses with their requests. A nil fn restores the default, random
+// (version 4) UUIDs. It is safe to call concurrently, and it applies to
+// all messages created afterwards.
+func SetIDGenerator(fn func() uuid.UUID) {
+	if fn == nil {
+		fn = uuid.NewRandom
+	}
+	idGen.Lock()
+	idGen.fn = fn
+	idGen.Unlock()
+}
+
+// NewID returns a new UUID from the generator set with SetIDGenerator.
+// It panics if the generator returns an invalid UUID.
+func NewID() uuid.UUID {
+	idGen.RLock()
+	fn := idGen.fn
+	idGen.RUnlock()
+
+	id := fn()
+	if len(id) != 16 {
+		panic(fmt.Sprintf("message: ID generator returned an invalid UUID of %d bytes", len(id)))
+	}
+	return id
+}
+
+// NewSortableID returns a UUID that sorts by creation time, to use with
+// SetIDGenerator. It has the layout of a version 7 UUID: the first 48
+// bits are the Unix time in milliseconds, the others are random except
+// for the version and variant bits. The IDs created in the same
+// millisecond are not ordered.
+func NewSortableID() uuid.UUID {
+	id := make(uuid.UUID, 16)
+	if _, err := io.ReadFull(rand.Reader, id[6:]); err != nil {
+		panic(fmt.Sprintf("message: failed to generate ID: %v", err))
+	}
+
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(id, ms[2:])
+	id[6] = id[6]&0x0f | 0x70 // version 7
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return id
+}
@@ -0,0 +1,44 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetIDGenerator(t *testing.T) {
+	defer SetIDGenerator(nil)
+
+	SetIDGenerator(NewSortableID)
+	prev := NewMeta(CallMsg).UUID()
+	for i := 0; i < 3; i++ {
+		time.Sleep(2 * time.Millisecond)
+		id := NewMeta(CallMsg).UUID()
+		assert.True(t, bytes.Compare(prev, id) < 0, "%d: sorted IDs", i)
+		v, _ := id.Version()
+		assert.Equal(t, uuid.Version(7), v, "%d: version", i)
+		assert.Equal(t, uuid.RFC4122, id.Variant(), "%d: variant", i)
+		prev = id
+	}
+
+	// the IDs survive the JSON encoding of the messages
+	m, err := NewPub("a", nil)
+	require.NoError(t, err, "NewPub")
+	b, err := json.Marshal(m)
+	require.NoError(t, err, "Marshal")
+	var got Pub
+	require.NoError(t, json.Unmarshal(b, &got), "Unmarshal")
+	assert.Equal(t, m.UUID().String(), got.UUID().String(), "decoded ID")
+
+	SetIDGenerator(func() uuid.UUID { return uuid.UUID("short") })
+	assert.Panics(t, func() { NewID() }, "invalid ID")
+
+	SetIDGenerator(nil)
+	v, _ := NewID().Version()
+	assert.Equal(t, uuid.Version(4), v, "default generator")
+}
@@ -0,0 +1,259 @@
+package message
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// LintError is the error returned by Lint. It lists the deviations from
+// the protocol found in the message, and it implements json.Marshaler
+// so that the list is sent as details of a NACK (see NewNack).
+type LintError struct {
+	Problems []string
+}
+
+// Error returns the error message for the LintError.
+func (e *LintError) Error() string {
+	return "off-spec message: " + strings.Join(e.Problems, "; ")
+}
+
+// MarshalJSON implements json.Marshaler for LintError.
+func (e *LintError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Problems []string `json:"problems"`
+	}{e.Problems})
+}
+
+// Lint checks that the JSON-encoded request b, decoded as m by
+// UnmarshalRequest, strictly conforms to the protocol. The decoding of
+// messages is lenient: it ignores unknown fields, matches field names
+// without regard to case, accepts null values and out-of-range values
+// that the server replaces with defaults. Lint reports those, along
+// with channel names and URIs that are not canonical, so that client
+// implementations can catch integration bugs early. It returns nil or
+// a *LintError.
+func Lint(b []byte, m Msg) error {
+	var l linter
+
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(b, &top); err != nil {
+		return &LintError{Problems: []string{fmt.Sprintf("invalid JSON message: %v", err)}}
+	}
+	t := reflect.TypeOf(m).Elem()
+	l.fields("", top, t)
+
+	if raw, ok := top["meta"]; ok {
+		var meta map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &meta); err == nil {
+			l.fields("meta.", meta, reflect.TypeOf(Meta{}))
+		}
+		if m.UUID() == nil {
+			l.addf("meta.uuid: missing UUID")
+		} else if string(meta["uuid"]) != `"`+m.UUID().String()+`"` {
+			l.addf("meta.uuid: UUID must be in the canonical lowercase form %q", m.UUID().String())
+		}
+	} else {
+		l.addf("meta: missing field")
+	}
+
+	if raw, ok := top["payload"]; ok {
+		var payload map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &payload); err == nil {
+			if f, ok := t.FieldByName("Payload"); ok {
+				l.fields("payload.", payload, f.Type)
+			}
+		}
+	} else {
+		l.addf("payload: missing field")
+	}
+
+	switch m := m.(type) {
+	case *Call:
+		l.uri("payload.uri", m.Payload.URI)
+		if m.Payload.Timeout < 0 {
+			l.addf("payload.timeout: negative timeout")
+		}
+		if _, ok := lookupRoutingMode[m.Payload.Routing]; !ok {
+			l.addf("payload.routing: unknown routing mode %d", m.Payload.Routing)
+		}
+		if m.Payload.Routing == Sticky && m.Payload.RoutingKey == "" {
+			l.addf("payload.routing_key: missing routing key for sticky routing")
+		}
+		if m.Payload.Priority < 0 || m.Payload.Priority > MaxPriority {
+			l.addf("payload.priority: priority must be between 0 and %d", MaxPriority)
+		}
+		if m.Payload.MaxAttempts < 0 || m.Payload.MaxAttempts > MaxAttempts {
+			l.addf("payload.max_attempts: number of attempts must be between 0 and %d", MaxAttempts)
+		}
+		if m.Payload.Backoff < 0 {
+			l.addf("payload.backoff: negative backoff")
+		}
+		l.binary(m.Payload.ContentType, m.Payload.Args)
+	case *Pub:
+		l.channel(m.Payload.Channel, false)
+		if m.Payload.TTL < 0 {
+			l.addf("payload.ttl: negative TTL")
+		}
+		l.binary(m.Payload.ContentType, m.Payload.Args)
+	case *Sub:
+		l.channel(m.Payload.Channel, m.Payload.Pattern)
+	case *Unsb:
+		l.channel(m.Payload.Channel, m.Payload.Pattern)
+	case *Batch:
+		l.batch(top["payload"], m)
+	}
+
+	if len(l.problems) == 0 {
+		return nil
+	}
+	return &LintError{Problems: l.problems}
+}
+
+type linter struct {
+	problems []string
+}
+
+func (l *linter) addf(f string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf(f, args...))
+}
+
+// fields checks the members of the JSON object obj against the fields
+// of the struct type t.
+func (l *linter) fields(prefix string, obj map[string]json.RawMessage, t reflect.Type) {
+	known := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		known[name] = f.Type
+	}
+
+	// sort the members so that the problems are reported in a stable order
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ft, ok := known[k]
+		if !ok {
+			name := ""
+			for kn := range known {
+				if strings.EqualFold(kn, k) {
+					name = kn
+				}
+			}
+			if name != "" {
+				l.addf("%s%s: field name must be %q", prefix, k, name)
+			} else {
+				l.addf("%s%s: unknown field", prefix, k)
+			}
+			continue
+		}
+		if string(obj[k]) == "null" && ft != reflect.TypeOf(json.RawMessage(nil)) {
+			l.addf("%s%s: null value", prefix, k)
+		}
+	}
+}
+
+// batch checks the messages of the batch m, decoded from the raw
+// payload.
+func (l *linter) batch(payload json.RawMessage, m *Batch) {
+	if len(m.Payload.Msgs) == 0 {
+		l.addf("payload.msgs: empty batch")
+		return
+	}
+	var raw struct {
+		Msgs []json.RawMessage `json:"msgs"`
+	}
+	if err := json.Unmarshal(payload, &raw); err != nil || len(raw.Msgs) != len(m.Payload.Msgs) {
+		return
+	}
+	for i, b := range raw.Msgs {
+		if err := Lint(b, m.Payload.Msgs[i]); err != nil {
+			for _, p := range err.(*LintError).Problems {
+				l.addf("payload.msgs[%d].%s", i, p)
+			}
+		}
+	}
+}
+
+// uri checks that uri is a canonical URI to call.
+func (l *linter) uri(field, uri string) {
+	if uri == "" {
+		l.addf("%s: missing URI", field)
+		return
+	}
+	if !canonicalName(uri) {
+		l.addf("%s: URI must not contain whitespace or control characters", field)
+	}
+	for _, seg := range strings.Split(uri, ".") {
+		if seg == "" {
+			l.addf("%s: URI must not contain empty segments", field)
+			break
+		}
+	}
+	if IsURIPattern(uri) {
+		l.addf("%s: URI must not be a pattern", field)
+	}
+}
+
+// channel checks that ch is a canonical channel name, or channel
+// pattern if pattern is true.
+func (l *linter) channel(ch string, pattern bool) {
+	if ch == "" {
+		l.addf("payload.channel: missing channel")
+		return
+	}
+	if !canonicalName(ch) {
+		l.addf("payload.channel: channel must not contain whitespace or control characters")
+	}
+	if !pattern && strings.ContainsAny(ch, "*?[") {
+		l.addf("payload.channel: channel must not contain pattern characters")
+	}
+}
+
+// binary checks that the content type is a valid media type and that
+// the args of a payload with a content type hold a base64-encoded
+// string (see Base64).
+func (l *linter) binary(ct string, args json.RawMessage) {
+	if ct == "" {
+		return
+	}
+	if _, _, err := mime.ParseMediaType(ct); err != nil {
+		l.addf("payload.content_type: invalid media type %q", ct)
+	}
+	if len(args) == 0 {
+		return
+	}
+	var s string
+	if err := json.Unmarshal(args, &s); err != nil {
+		l.addf("payload.args: binary args must be a base64-encoded string")
+	} else if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+		l.addf("payload.args: binary args must be a base64-encoded string")
+	}
+}
+
+// canonicalName returns true if s is valid UTF-8 without whitespace or
+// control characters.
+func canonicalName(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
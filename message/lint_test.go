@@ -0,0 +1,73 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	call, err := NewCall("a.b", "x", time.Second)
+	require.NoError(t, err, "NewCall")
+	pub, err := NewPub("c", 1)
+	require.NoError(t, err, "NewPub")
+
+	batch, err := NewBatch(call, pub)
+	require.NoError(t, err, "NewBatch")
+
+	for i, m := range []Msg{call, pub, NewSub("c.*", true), NewUnsb("c", false), batch} {
+		b, err := json.Marshal(m)
+		require.NoError(t, err, "%d: Marshal", i)
+		assert.NoError(t, Lint(b, m), "%d: valid message", i)
+	}
+
+	id := pub.UUID().String()
+	cases := []struct {
+		msg  string
+		want []string
+	}{
+		{`{"meta":{"type":2,"uuid":"` + id + `"},"payload":{"channel":"c","args":1},"extra":1}`,
+			[]string{"extra: unknown field"}},
+		{`{"meta":{"type":2,"uuid":"` + id + `","Type":2},"payload":{"Channel":"c","args":null}}`,
+			[]string{"meta.Type: field name must be \"type\"", "payload.Channel: field name must be \"channel\""}},
+		{`{"meta":{"type":2,"uuid":"` + id + `"},"payload":{"channel":"a b"}}`,
+			[]string{"payload.channel: channel must not contain whitespace or control characters"}},
+		{`{"meta":{"type":2,"uuid":"` + id + `"},"payload":{"channel":"a*"}}`,
+			[]string{"payload.channel: channel must not contain pattern characters"}},
+		{`{"meta":{"type":2,"uuid":"` + id + `"},"payload":{"channel":"c","args":1,"ttl":-1}}`,
+			[]string{"payload.ttl: negative TTL"}},
+		{`{"meta":{"type":2},"payload":{"channel":null}}`,
+			[]string{"meta.uuid: missing UUID", "payload.channel: null value", "payload.channel: missing channel"}},
+		{`{"meta":{"type":1,"uuid":"` + id + `"},"payload":{"uri":"a..*","timeout":-1,"priority":9,"routing":1}}`,
+			[]string{"payload.uri: URI must not contain empty segments", "payload.uri: URI must not be a pattern",
+				"payload.timeout: negative timeout", "payload.routing_key: missing routing key for sticky routing",
+				"payload.priority: priority must be between 0 and 3"}},
+		{`{"meta":{"type":1,"uuid":"` + id + `"},"payload":{"uri":"a","args":null,"max_attempts":1073741824}}`,
+			[]string{"payload.max_attempts: number of attempts must be between 0 and 10"}},
+		{`{"meta":{"type":2,"uuid":"` + id + `"},"payload":{"channel":"c","args":{},"content_type":"image/"}}`,
+			[]string{"payload.content_type: invalid media type \"image/\"", "payload.args: binary args must be a base64-encoded string"}},
+		{`{"meta":{"type":1,"uuid":"` + id + `"},"payload":{"uri":"a","args":"!","content_type":"image/png"}}`,
+			[]string{"payload.args: binary args must be a base64-encoded string"}},
+		{`{"meta":{"type":12,"uuid":"` + id + `"},"payload":{"msgs":[]}}`,
+			[]string{"payload.msgs: empty batch"}},
+		{`{"meta":{"type":12,"uuid":"` + id + `"},"payload":{"msgs":[{"meta":{"type":2,"uuid":"` + id + `"},"payload":{"channel":"a b","args":1}}]}}`,
+			[]string{"payload.msgs[0].payload.channel: channel must not contain whitespace or control characters"}},
+	}
+	for i, c := range cases {
+		m, err := UnmarshalRequest(bytes.NewReader([]byte(c.msg)))
+		require.NoError(t, err, "%d: UnmarshalRequest", i)
+
+		err = Lint([]byte(c.msg), m)
+		if assert.IsType(t, &LintError{}, err, "%d: Lint", i) {
+			assert.Equal(t, c.want, err.(*LintError).Problems, "%d: problems", i)
+		}
+	}
+
+	b, err := json.Marshal(&LintError{Problems: []string{"a"}})
+	require.NoError(t, err, "Marshal LintError")
+	assert.Equal(t, `{"problems":["a"]}`, string(b), "LintError details")
+}
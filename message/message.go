@@ -1,12 +1,13 @@
 // Package message defines the supported types of messages in the juggler
 // protocol.
 //
-// The juggler.0 protocol defines the following messages for the client:
+// The juggler protocol defines the following messages for the client:
 //
 //     - CALL : to call an RPC function
 //     - SUB  : to subscribe to a pub-sub channel
 //     - UNSB : to unsubscribe from a pub-sub channel
 //     - PUB  : to publish to a pub-sub channel
+//     - BTCH : to send a batch of CALL and PUB requests in one message
 //
 // And the following messages for the server:
 //
@@ -20,9 +21,15 @@
 // peer. That includes sending binary messages and sending unknown (or
 // invalid for the peer) message types.
 //
+// The versions of the protocol (see Protocol) are negotiated as the
+// websocket subprotocol of the connections, each version having its
+// own encoding of the messages. The current versions V1 ("juggler.0")
+// and V2 ("juggler.v2.json") encode the messages in JSON.
+//
 package message
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -50,6 +57,10 @@ const (
 	EvntMsg
 	endWrite
 
+	// BatchMsg is a read message, declared after the others so that
+	// the values of the existing types do not change.
+	BatchMsg
+
 	// customMsg allows for definition of custom message types,
 	// starting at ID 256 (first 255 are reserved).
 	customMsg Type = 256
@@ -58,14 +69,15 @@ const (
 var nextCustomMsg = customMsg
 
 var lookupType = map[Type]string{
-	CallMsg: "CALL",
-	PubMsg:  "PUB",
-	SubMsg:  "SUB",
-	UnsbMsg: "UNSB",
-	NackMsg: "NACK",
-	AckMsg:  "ACK",
-	ResMsg:  "RES",
-	EvntMsg: "EVNT",
+	CallMsg:  "CALL",
+	PubMsg:   "PUB",
+	SubMsg:   "SUB",
+	UnsbMsg:  "UNSB",
+	NackMsg:  "NACK",
+	AckMsg:   "ACK",
+	ResMsg:   "RES",
+	EvntMsg:  "EVNT",
+	BatchMsg: "BTCH",
 }
 
 // Register registers a new custom message having the
@@ -74,11 +86,12 @@ var lookupType = map[Type]string{
 //
 // Custom messages may not be unmarshaled and should not be
 // sent over the network to any peer - only the predefined
-// standard messages can do that. Custom messages can still
-// be useful though, as evidenced by the client package that
-// defines an EXP expiration message that is sent to the
-// client itself when a CALL has expired and no result will
-// be returned.
+// standard messages and the custom messages registered with
+// RegisterRead or RegisterWrite can do that. Custom messages
+// can still be useful though, as evidenced by the client
+// package that defines an EXP expiration message that is sent
+// to the client itself when a CALL has expired and no result
+// will be returned.
 //
 // Register should be called in the init function of the
 // package that needs the message, to guarantee all custom
@@ -109,7 +122,7 @@ func (mt Type) String() string {
 // point of view of the server (that is, if this is a message
 // that was sent by a client).
 func (mt Type) IsRead() bool {
-	return startRead < mt && mt < endRead
+	return startRead < mt && mt < endRead || mt == BatchMsg
 }
 
 // IsWrite returns true if the message type is a "write" from the
@@ -138,11 +151,29 @@ type Msg interface {
 type Meta struct {
 	T Type      `json:"type"`
 	U uuid.UUID `json:"uuid"`
+
+	// Sig is the signature of a CALL message, if it is signed (see
+	// SignCall).
+	Sig *Signature `json:"sig,omitempty"`
+
+	// Headers is the metadata of the message set by the application,
+	// e.g. a trace ID, a locale or a deadline (see Headers).
+	Headers Headers `json:"headers,omitempty"`
+
+	// ActAs is the identity on behalf of which a CALL message is made,
+	// e.g. by an API gateway for its end users, if the server allows
+	// the connection to act as that identity (see
+	// juggler.Server.AuthorizeActAs).
+	ActAs string `json:"act_as,omitempty"`
+
+	// Timing is the latency observed by the callee for the call of a
+	// RES message, if it reports it.
+	Timing *Timing `json:"timing,omitempty"`
 }
 
 // NewMeta returns a new, initialized Meta.
 func NewMeta(t Type) Meta {
-	return Meta{T: t, U: uuid.NewRandom()}
+	return Meta{T: t, U: NewID()}
 }
 
 // partialMsg is a message that decodes only the metadata, leaving
@@ -162,17 +193,47 @@ func (m Meta) UUID() uuid.UUID {
 	return m.U
 }
 
+// Header returns the value of the header key of the message, or an
+// empty string if it is not set.
+func (m Meta) Header(key string) string {
+	return m.Headers[key]
+}
+
+// SetHeader sets the header key of the message to value.
+func (m *Meta) SetHeader(key, value string) {
+	if m.Headers == nil {
+		m.Headers = make(Headers)
+	}
+	m.Headers[key] = value
+}
+
+func (m Meta) headers() Headers {
+	return m.Headers
+}
+
 // Call is a message that triggers an RPC call to a callee
 // listening on the specified URI. The Args opaque field
 // is transferred as-is to the callee. If the result is not
 // available and sent back to the caller before the specified
-// timeout, it is dropped.
+// timeout, it is dropped. The optional Routing and RoutingKey
+// fields control which callees receive the call (see RoutingMode).
+// Calls with a higher Priority are delivered first (see MaxPriority).
+// If MaxAttempts is > 1, the call may be attempted again after a
+// failure, the Timeout then applies to each attempt (see MaxAttempts).
 type Call struct {
 	Meta    `json:"meta"`
 	Payload struct {
-		URI     string          `json:"uri"`
-		Timeout time.Duration   `json:"timeout"`
-		Args    json.RawMessage `json:"args"`
+		URI         string          `json:"uri"`
+		Timeout     time.Duration   `json:"timeout"`
+		Args        json.RawMessage `json:"args"`
+		Routing     RoutingMode     `json:"routing,omitempty"`
+		RoutingKey  string          `json:"routing_key,omitempty"`
+		Priority    int             `json:"priority,omitempty"`
+		MaxAttempts int             `json:"max_attempts,omitempty"`
+		Backoff     time.Duration   `json:"backoff,omitempty"`
+		Version     string          `json:"version,omitempty"`      // accepted version of the URI, see VersionedURI
+		ContentType string          `json:"content_type,omitempty"` // media type of a binary Args, see Codec
+		NoAck       bool            `json:"no_ack,omitempty"`       // no ACK if the call is registered, see NoAck
 	} `json:"payload"`
 }
 
@@ -197,12 +258,22 @@ func NewCall(uri string, args interface{}, timeout time.Duration) (*Call, error)
 
 // Sub is a subscription message. It subscribes the caller to the
 // Channel, which is treated as a pattern if Pattern is true. The
-// pattern behaviour is the same as that of Redis.
+// pattern behaviour is the same as that of Redis. If Acked is true,
+// the subscription is in acknowledged mode, on servers that support
+// it: its events carry a delivery tag to acknowledge with a CALL to
+// EvntAckURI, and those that are not acknowledged are delivered again
+// when the caller subscribes again, e.g. after a reconnect. If Sticky
+// is true, the subscription is tied to the identity of the caller, on
+// servers that support it: all the connections of the identity receive
+// its events, including those opened later, until an Unsb with Sticky
+// set removes it.
 type Sub struct {
 	Meta    `json:"meta"`
 	Payload struct {
 		Channel string `json:"channel"`
 		Pattern bool   `json:"pattern"`
+		Acked   bool   `json:"acked,omitempty"`  // acknowledged mode, ignored for Unsb
+		Sticky  bool   `json:"sticky,omitempty"` // tied to the identity
 	} `json:"payload"`
 }
 
@@ -237,12 +308,16 @@ func NewUnsb(channel string, pattern bool) *Unsb {
 
 // Pub is a publish message. It publishes an event on the specified
 // Channel. The Args opaque field is transferred as-is to subscribers
-// of that channel.
+// of that channel. If TTL is > 0, the event is dropped for the
+// subscribers it cannot be delivered to before it expires.
 type Pub struct {
 	Meta    `json:"meta"`
 	Payload struct {
-		Channel string          `json:"channel"`
-		Args    json.RawMessage `json:"args"`
+		Channel     string          `json:"channel"`
+		Args        json.RawMessage `json:"args"`
+		ContentType string          `json:"content_type,omitempty"` // media type of a binary Args, see Codec
+		TTL         time.Duration   `json:"ttl,omitempty"`
+		NoAck       bool            `json:"no_ack,omitempty"` // no ACK if the event is published, see NoAck
 	} `json:"payload"`
 }
 
@@ -263,6 +338,37 @@ func NewPub(channel string, args interface{}) (*Pub, error) {
 	return p, nil
 }
 
+// Batch is a batch of CALL and PUB requests sent in a single message,
+// so that they are sent in a single websocket frame and, if the broker
+// supports it (see broker.BatchBroker), registered in a single round
+// trip. Each message of the batch is acknowledged and answered as if
+// it was sent on its own. The batch itself is only acknowledged if it
+// is rejected as a whole, with a NACK.
+type Batch struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		Msgs []Msg `json:"msgs"`
+	} `json:"payload"`
+}
+
+// NewBatch creates a Batch message with the msgs, which must be Call
+// or Pub messages.
+func NewBatch(msgs ...Msg) (*Batch, error) {
+	for _, m := range msgs {
+		switch m.(type) {
+		case *Call, *Pub:
+		default:
+			return nil, fmt.Errorf("invalid message %s in batch", m.Type())
+		}
+	}
+
+	b := &Batch{
+		Meta: NewMeta(BatchMsg),
+	}
+	b.Payload.Msgs = msgs
+	return b, nil
+}
+
 // Nack is an negative-acknowledge message. It indicates the source
 // message that failed to be delivered in the For (and ForType)
 // fields. A Nack is sent only when a pub-sub or RPC request failed
@@ -279,11 +385,19 @@ type Nack struct {
 		Code    int       `json:"code"`
 		Message string    `json:"message"` // defaults to Err.Error()
 		Err     error     `json:"-"`       // useful in the handler to have access to the source error, but not sent to the peer
+
+		// Details is an optional structured payload that describes
+		// the error, e.g. the time to wait before retrying for
+		// CodeRateLimited.
+		Details json.RawMessage `json:"details,omitempty"`
 	} `json:"payload"`
 }
 
 // NewNack creates a new Nack message to notify a failure to process
-// the from message.
+// the from message. The code should be one of the Code constants,
+// unless the handler defines its own codes. If e implements
+// json.Marshaler and marshals successfully, the result is set as
+// the Details of the Nack.
 func NewNack(from Msg, code int, e error) *Nack {
 	nack := &Nack{
 		Meta: NewMeta(NackMsg),
@@ -293,6 +407,11 @@ func NewNack(from Msg, code int, e error) *Nack {
 	nack.Payload.Code = code
 	nack.Payload.Err = e
 	nack.Payload.Message = e.Error()
+	if m, ok := e.(json.Marshaler); ok {
+		if b, err := m.MarshalJSON(); err == nil {
+			nack.Payload.Details = b
+		}
+	}
 
 	switch from := from.(type) {
 	case *Call:
@@ -344,6 +463,20 @@ type Ack struct {
 	} `json:"payload"`
 }
 
+// NoAck returns true if the request m is a CALL or a PUB that does not
+// get an ACK when it succeeds, only a NACK when it fails. Such
+// fire-and-forget requests save the ACK frame, e.g. for high-frequency
+// telemetry events. A CALL still gets its RES.
+func NoAck(m Msg) bool {
+	switch m := m.(type) {
+	case *Call:
+		return m.Payload.NoAck
+	case *Pub:
+		return m.Payload.NoAck
+	}
+	return false
+}
+
 // NewAck creates a new Ack message to notify the successful processing
 // of the from message.
 func NewAck(from Msg) *Ack {
@@ -371,9 +504,10 @@ func NewAck(from Msg) *Ack {
 type Res struct {
 	Meta    `json:"meta"`
 	Payload struct {
-		For  uuid.UUID       `json:"for"`           // no ForType, because always CALL
-		URI  string          `json:"uri,omitempty"` // URI of the CALL
-		Args json.RawMessage `json:"args"`
+		For         uuid.UUID       `json:"for"`           // no ForType, because always CALL
+		URI         string          `json:"uri,omitempty"` // URI of the CALL
+		Args        json.RawMessage `json:"args"`
+		ContentType string          `json:"content_type,omitempty"` // media type of a binary Args, see Codec
 	} `json:"payload"`
 }
 
@@ -399,23 +533,43 @@ func NewRes(pld *ResPayload) *Res {
 	res.Payload.For = pld.MsgUUID
 	res.Payload.URI = pld.URI
 	res.Payload.Args = pld.Args
+	res.Payload.ContentType = pld.ContentType
+	res.Headers = pld.Headers
+	res.Timing = pld.Timing
 	return res
 }
 
 // Evnt is a published event. It is sent to all subscribers of the
-// Channel.
+// Channel. If Patch is true, Args is a JSON merge patch (RFC 7396) to
+// apply to the previous state of the channel instead of the full state,
+// see the client.States type. Timestamp is the time at which the event
+// was published, according to the clock of the server. If TTL is > 0,
+// the event expires that long after its Timestamp.
 type Evnt struct {
 	Meta    `json:"meta"`
 	Payload struct {
-		For     uuid.UUID       `json:"for"` // no ForType, because always PUB
-		Channel string          `json:"channel,omitempty"`
-		Pattern string          `json:"pattern,omitempty"` // if triggered because of a pattern-based subscription
-		Args    json.RawMessage `json:"args"`
+		For         uuid.UUID       `json:"for"` // no ForType, because always PUB
+		Channel     string          `json:"channel,omitempty"`
+		Pattern     string          `json:"pattern,omitempty"` // if triggered because of a pattern-based subscription
+		Patch       bool            `json:"patch,omitempty"`
+		Timestamp   time.Time       `json:"timestamp"`
+		TTL         time.Duration   `json:"ttl,omitempty"`
+		Seq         uint64          `json:"seq,omitempty"` // sequence number in the channel, see EvntPayload.Seq
+		Tag         string          `json:"tag,omitempty"` // delivery tag in acknowledged mode, see EvntPayload.Tag
+		Args        json.RawMessage `json:"args"`
+		ContentType string          `json:"content_type,omitempty"` // media type of a binary Args, see Codec
 	} `json:"payload"`
 }
 
+// TimeLeft returns the time left before the event expires at now, which
+// is <= 0 if it is expired. It returns false if the event has no TTL.
+func (ev *Evnt) TimeLeft(now time.Time) (time.Duration, bool) {
+	return timeLeft(ev.Payload.Timestamp, ev.Payload.TTL, now)
+}
+
 // NewEvnt creates a new Evnt message corresponding to an event that
-// occurred on a subscribed channel.
+// occurred on a subscribed channel. If the payload has no timestamp,
+// the current time is used.
 func NewEvnt(pld *EvntPayload) *Evnt {
 	ev := &Evnt{
 		Meta: NewMeta(EvntMsg),
@@ -424,33 +578,48 @@ func NewEvnt(pld *EvntPayload) *Evnt {
 	ev.Payload.Pattern = pld.Pattern
 	ev.Payload.For = pld.MsgUUID
 	ev.Payload.Args = pld.Args
+	ev.Payload.ContentType = pld.ContentType
+	ev.Payload.Timestamp = pld.Timestamp
+	ev.Payload.TTL = pld.TTL
+	ev.Payload.Seq = pld.Seq
+	ev.Payload.Tag = pld.Tag
+	ev.Headers = pld.Headers
+	if ev.Payload.Timestamp.IsZero() {
+		ev.Payload.Timestamp = time.Now().UTC()
+	}
 	return ev
 }
 
-var allReqMsgs = []Type{CallMsg, SubMsg, UnsbMsg, PubMsg}
+var allReqMsgs = []Type{CallMsg, SubMsg, UnsbMsg, PubMsg, BatchMsg}
 
 // UnmarshalRequest unmarshals a JSON-encoded message from r into the
 // correct concrete message type. It returns an error if the message
 // type is invalid for a request (client -> server) and for the restricted
-// list of allowed messages, if any.
+// list of allowed messages, if any. A Batch is allowed if CALL or PUB is
+// allowed, and its messages must be allowed too. The custom messages
+// registered with RegisterRead are always allowed.
 func UnmarshalRequest(r io.Reader, allowedMsgs ...Type) (Msg, error) {
 	var cleaned []Type
 	for _, t := range allowedMsgs {
-		if t.IsRead() {
+		if t.IsRead() && t != BatchMsg {
 			cleaned = append(cleaned, t)
 		}
 	}
 	if len(cleaned) == 0 {
 		cleaned = allReqMsgs
+	} else if isIn(cleaned, CallMsg) || isIn(cleaned, PubMsg) {
+		cleaned = append(cleaned, BatchMsg)
 	}
+	cleaned = append(cleaned[:len(cleaned):len(cleaned)], customTypesOf(true)...)
 	return unmarshalIf(r, cleaned...)
 }
 
 // UnmarshalResponse unmarshals a JSON-encoded message from r into the
 // correct concrete message type. It returns an error if the message
-// type is invalid for a response (client <- server).
+// type is invalid for a response (client <- server). The custom messages
+// registered with RegisterWrite are valid responses.
 func UnmarshalResponse(r io.Reader) (Msg, error) {
-	return unmarshalIf(r, NackMsg, AckMsg, EvntMsg, ResMsg)
+	return unmarshalIf(r, append([]Type{NackMsg, AckMsg, EvntMsg, ResMsg}, customTypesOf(false)...)...)
 }
 
 // Unmarshal unmarshals a JSON-encoded message from r into the correct
@@ -548,8 +717,39 @@ func unmarshalIf(r io.Reader, allowed ...Type) (Msg, error) {
 		}
 		m = &ev
 
+	case BatchMsg:
+		var raw struct {
+			Payload struct {
+				Msgs []json.RawMessage `json:"msgs"`
+			} `json:"payload"`
+		}
+		var b Batch
+		if err := genericUnmarshal(&raw, &b.Meta); err != nil {
+			return nil, err
+		}
+
+		// only CALL and PUB requests can be batched, if allowed
+		inner := []Type{CallMsg, PubMsg}
+		if len(allowed) > 0 {
+			inner = nil
+			for _, t := range allowed {
+				if t == CallMsg || t == PubMsg {
+					inner = append(inner, t)
+				}
+			}
+		}
+		b.Payload.Msgs = make([]Msg, len(raw.Payload.Msgs))
+		for i, p := range raw.Payload.Msgs {
+			im, err := unmarshalIf(bytes.NewReader(p), inner...)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s message: %v", pm.Meta.T, err)
+			}
+			b.Payload.Msgs[i] = im
+		}
+		m = &b
+
 	default:
-		return nil, fmt.Errorf("unknown message %s", pm.Meta.T)
+		return unmarshalCustom(&pm)
 	}
 
 	return m, nil
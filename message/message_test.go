@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"testing"
 	"time"
@@ -45,6 +46,8 @@ func TestMarshalUnmarshal(t *testing.T) {
 		Pattern: "h*",
 		Args:    json.RawMessage(`"string"`),
 	}
+	batch, err := NewBatch(call, pub)
+	require.NoError(t, err, "NewBatch")
 
 	cases := []Msg{
 		call,
@@ -55,6 +58,7 @@ func TestMarshalUnmarshal(t *testing.T) {
 		NewAck(pub),
 		NewRes(rp),
 		NewEvnt(ep),
+		batch,
 	}
 	for i, m := range cases {
 		b, err := json.Marshal(m)
@@ -112,6 +116,139 @@ func TestUnknownType(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("<unknown: %d>", unkTyp), unkTyp.String())
 }
 
+func TestRoutingMode(t *testing.T) {
+	call, err := NewCall("uri", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	call.Payload.Routing = Sticky
+	call.Payload.RoutingKey = "key"
+
+	b, err := json.Marshal(call)
+	require.NoError(t, err, "Marshal")
+	got, err := Unmarshal(bytes.NewReader(b))
+	require.NoError(t, err, "Unmarshal")
+	assert.Equal(t, call, got, "Identical after Unmarshal")
+
+	assert.Equal(t, "round-robin", RoundRobin.String(), "RoundRobin")
+	assert.Equal(t, "sticky", Sticky.String(), "Sticky")
+	assert.Equal(t, "broadcast", Broadcast.String(), "Broadcast")
+	assert.Equal(t, "<unknown: 99>", RoutingMode(99).String(), "unknown")
+}
+
+func TestCallPayloadRetry(t *testing.T) {
+	cases := []struct {
+		cp      CallPayload
+		retry   bool
+		backoff time.Duration
+	}{
+		{CallPayload{}, false, 0},
+		{CallPayload{MaxAttempts: 1}, false, 0},
+		{CallPayload{MaxAttempts: 2, Backoff: time.Second}, true, time.Second},
+		{CallPayload{MaxAttempts: 3, Backoff: time.Second, Attempt: 2}, true, 2 * time.Second},
+		{CallPayload{MaxAttempts: 3, Backoff: time.Second, Attempt: 3}, false, 4 * time.Second},
+		{CallPayload{MaxAttempts: 2, Routing: Broadcast}, false, 0},
+		{CallPayload{MaxAttempts: 1 << 30, Backoff: time.Second, Attempt: 200}, true, time.Duration(math.MaxInt64)},
+		{CallPayload{MaxAttempts: 40, Backoff: time.Second, Attempt: 35}, true, time.Duration(math.MaxInt64)},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.retry, c.cp.CanRetry(), "%d: CanRetry", i)
+		assert.Equal(t, c.backoff, c.cp.RetryBackoff(), "%d: RetryBackoff", i)
+	}
+}
+
+func TestCallPayloadQueueWait(t *testing.T) {
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		cp   CallPayload
+		wait time.Duration
+	}{
+		{CallPayload{}, 0},
+		{CallPayload{EnqueueTimestamp: ts}, 0},
+		{CallPayload{ReadTimestamp: ts}, 0},
+		{CallPayload{EnqueueTimestamp: ts, ReadTimestamp: ts.Add(time.Second)}, time.Second},
+		{CallPayload{EnqueueTimestamp: ts, ReadTimestamp: ts.Add(-time.Second)}, 0},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.wait, c.cp.QueueWait(), "%d: QueueWait", i)
+	}
+}
+
+func TestResTiming(t *testing.T) {
+	res := NewRes(&ResPayload{URI: "a"})
+	assert.Nil(t, res.Timing, "no timing")
+
+	tm := &Timing{QueueWait: time.Second, Handler: 2 * time.Millisecond}
+	res = NewRes(&ResPayload{URI: "a", Timing: tm})
+	b, err := json.Marshal(res)
+	require.NoError(t, err, "Marshal")
+	m, err := UnmarshalResponse(bytes.NewReader(b))
+	require.NoError(t, err, "UnmarshalResponse")
+	require.IsType(t, &Res{}, m, "RES message")
+	assert.Equal(t, tm, m.(*Res).Timing, "timing")
+}
+
+func TestEvntTimestamp(t *testing.T) {
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	ev := NewEvnt(&EvntPayload{Channel: "a", Timestamp: ts})
+	assert.Equal(t, ts, ev.Payload.Timestamp, "timestamp of the payload")
+
+	before := time.Now()
+	ev = NewEvnt(&EvntPayload{Channel: "a"})
+	assert.False(t, ev.Payload.Timestamp.Before(before.Add(-time.Second)), "current time if no timestamp")
+
+	_, ok := ev.TimeLeft(ts)
+	assert.False(t, ok, "no TTL")
+	ev = NewEvnt(&EvntPayload{Channel: "a", Timestamp: ts, TTL: time.Second})
+	assert.Equal(t, time.Second, ev.Payload.TTL, "TTL of the payload")
+	left, ok := ev.TimeLeft(ts.Add(300 * time.Millisecond))
+	assert.True(t, ok, "TTL")
+	assert.Equal(t, 700*time.Millisecond, left, "time left")
+	left, _ = ev.TimeLeft(ts.Add(2 * time.Second))
+	assert.True(t, left <= 0, "expired")
+}
+
+func TestUnmarshalArgs(t *testing.T) {
+	ev := NewEvnt(&EvntPayload{Channel: "a", Args: json.RawMessage(`{"x":1}`)})
+	var v struct{ X int }
+	require.NoError(t, ev.UnmarshalArgs(&v), "UnmarshalArgs event")
+	assert.Equal(t, 1, v.X, "event args")
+
+	var s string
+	err := ev.UnmarshalArgs(&s)
+	if assert.IsType(t, &ArgsError{}, err, "invalid event args") {
+		ae := err.(*ArgsError)
+		assert.Equal(t, EvntMsg, ae.Type, "type")
+		assert.Equal(t, "a", ae.Name, "channel")
+		assert.Contains(t, ae.Error(), "invalid EVNT arguments for a", "message")
+	}
+
+	res := NewRes(&ResPayload{URI: "b", Args: json.RawMessage(`"AAEC"`), ContentType: DefaultBinaryContentType})
+	var b []byte
+	require.NoError(t, res.UnmarshalArgs(&b), "UnmarshalArgs binary result")
+	assert.Equal(t, []byte{0, 1, 2}, b, "binary result")
+	err = res.UnmarshalArgs(&v)
+	if assert.IsType(t, &ArgsError{}, err, "invalid binary result") {
+		assert.Equal(t, "b", err.(*ArgsError).Name, "URI")
+	}
+
+	res = NewRes(&ResPayload{URI: "c"})
+	p := &v
+	require.NoError(t, res.UnmarshalArgs(&p), "UnmarshalArgs no args")
+	assert.Nil(t, p, "no args")
+}
+
+func TestTimeSyncOffset(t *testing.T) {
+	// server clock is 10s ahead, 100ms each way, 5ms on the server
+	t0 := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	ts := &TimeSync{
+		ClientTime:   t0,
+		ReceiveTime:  t0.Add(10*time.Second + 100*time.Millisecond),
+		TransmitTime: t0.Add(10*time.Second + 105*time.Millisecond),
+	}
+	offset, delay := ts.Offset(t0.Add(205 * time.Millisecond))
+	assert.Equal(t, 10*time.Second, offset, "offset")
+	assert.Equal(t, 200*time.Millisecond, delay, "delay")
+}
+
 func TestUnmarshalIfUnknown(t *testing.T) {
 	meta := NewMeta(Type(-1)) // invalid message
 	b, err := json.Marshal(partialMsg{Meta: meta})
@@ -129,6 +266,10 @@ func TestUnmarshalRequest(t *testing.T) {
 	pub, err := NewPub("p", "payload")
 	require.NoError(t, err, "NewPub failed")
 	ack := NewAck(pub)
+	batch, err := NewBatch(call, pub)
+	require.NoError(t, err, "NewBatch failed")
+	pubs, err := NewBatch(pub, pub)
+	require.NoError(t, err, "NewBatch failed")
 
 	cases := []struct {
 		v       interface{}
@@ -150,6 +291,11 @@ func TestUnmarshalRequest(t *testing.T) {
 		{unsb, []Type{CallMsg, PubMsg}, true},
 		{pub, []Type{CallMsg, PubMsg}, false},
 		{ack, []Type{CallMsg, PubMsg}, true},
+		{batch, nil, false},
+		{batch, []Type{CallMsg, PubMsg}, false},
+		{batch, []Type{CallMsg}, true}, // PUB in the batch not allowed
+		{pubs, []Type{PubMsg}, false},
+		{pubs, []Type{SubMsg}, true},
 	}
 	for i, c := range cases {
 		b, err := json.Marshal(c.v)
@@ -161,3 +307,34 @@ func TestUnmarshalRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestNewBatch(t *testing.T) {
+	call, err := NewCall("u", nil, time.Second)
+	require.NoError(t, err, "NewCall failed")
+	b, err := NewBatch(call)
+	require.NoError(t, err, "NewBatch failed")
+	assert.True(t, BatchMsg.IsRead(), "BatchMsg is read")
+	assert.Equal(t, "BTCH", BatchMsg.String(), "BatchMsg string")
+
+	_, err = NewBatch(call, NewSub("c", false))
+	assert.Error(t, err, "SUB in batch")
+	_, err = NewBatch(call, b)
+	assert.Error(t, err, "nested batch")
+}
+
+func TestBroadcast(t *testing.T) {
+	pp, err := NewBroadcast("maintenance", "in 5 minutes")
+	require.NoError(t, err, "NewBroadcast")
+
+	ev, ok := BroadcastEvnt(&EvntPayload{MsgUUID: pp.MsgUUID, Channel: BroadcastChannel, Args: pp.Args})
+	require.True(t, ok, "BroadcastEvnt")
+	assert.Equal(t, pp.MsgUUID, ev.MsgUUID, "msg UUID")
+	assert.Equal(t, "maintenance", ev.Channel, "channel")
+	assert.Equal(t, `"in 5 minutes"`, string(ev.Args), "args")
+	assert.Equal(t, pp.Timestamp, ev.Timestamp, "timestamp")
+
+	for _, args := range []string{`{"event":"shutdown"}`, `{"event":"broadcast"}`, `[]`} {
+		_, ok := BroadcastEvnt(&EvntPayload{Channel: BroadcastChannel, Args: json.RawMessage(args)})
+		assert.False(t, ok, args)
+	}
+}
@@ -2,11 +2,61 @@ package message
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/pborman/uuid"
 )
 
+// RoutingMode defines how a call request is routed to the callees
+// listening on its URI.
+type RoutingMode int
+
+// The list of supported routing modes.
+const (
+	// RoundRobin delivers the call request to a single callee, the first
+	// one available to process it. This is the default.
+	RoundRobin RoutingMode = iota
+
+	// Sticky delivers all call requests with the same routing key to the
+	// same callee instance, as long as that instance is listening.
+	Sticky
+
+	// Broadcast delivers the call request to every callee instance
+	// listening on the URI.
+	Broadcast
+)
+
+var lookupRoutingMode = map[RoutingMode]string{
+	RoundRobin: "round-robin",
+	Sticky:     "sticky",
+	Broadcast:  "broadcast",
+}
+
+// String returns the human-readable representation of the routing mode.
+func (rm RoutingMode) String() string {
+	if s := lookupRoutingMode[rm]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("<unknown: %d>", rm)
+}
+
+// MaxPriority is the highest priority of a call request. Call requests
+// with a higher priority are delivered to the callees before those with
+// a lower priority waiting on the same URI. The priority ranges from 0,
+// the default and lowest priority, to MaxPriority.
+const MaxPriority = 3
+
+// MaxAttempts is the highest number of attempts of a call request. The
+// CALL requests with more attempts are rejected, as the backoff delay
+// doubles on each retry.
+const MaxAttempts = 10
+
+// maxDuration is the value of the delays that overflow.
+const maxDuration = time.Duration(math.MaxInt64)
+
 // CallPayload is the payload stored in the connector for a Call
 // request.
 type CallPayload struct {
@@ -15,6 +65,100 @@ type CallPayload struct {
 	URI      string          `json:"uri"`
 	Args     json.RawMessage `json:"args,omitempty"`
 
+	// ContentType is the media type of Args if it holds a binary
+	// encoding (see Codec), empty for JSON.
+	ContentType string `json:"content_type,omitempty"`
+
+	// Routing is the routing mode of the call request. The zero value
+	// is RoundRobin.
+	Routing RoutingMode `json:"routing,omitempty"`
+
+	// RoutingKey is the key used to select the callee instance when
+	// Routing is Sticky. It is ignored for other routing modes.
+	RoutingKey string `json:"routing_key,omitempty"`
+
+	// Priority is the priority of the call request, from 0 (the default)
+	// to MaxPriority.
+	Priority int `json:"priority,omitempty"`
+
+	// Pattern is the URI pattern of the callees that serve the call
+	// request, if it is routed to callees listening on a pattern that
+	// matches URI (see MatchURI) instead of callees listening on URI.
+	// It is set by the broker.
+	Pattern string `json:"pattern,omitempty"`
+
+	// Version is the version of URI accepted by the caller. If set, the
+	// call request is only delivered to callees that support that version
+	// (see VersionedURI).
+	Version string `json:"version,omitempty"`
+
+	// Identity is the authenticated identity of the caller's connection,
+	// if any, set by the server (see juggler.Conn.Identity), or the
+	// identity on behalf of which the call is made (see Meta.ActAs).
+	// Callees can use it to authorize the request.
+	Identity string `json:"identity,omitempty"`
+
+	// Actor is the identity of the caller's connection when the call is
+	// made on behalf of Identity (see Meta.ActAs), empty
+	// otherwise. Callees can use it to audit the calls made by the
+	// gateways and services on behalf of their users.
+	Actor string `json:"actor,omitempty"`
+
+	// Signature is the signature of the call request made by the caller,
+	// if any, copied by the server from the metadata of the CALL message.
+	// Callees can check it with VerifyCall.
+	Signature *Signature `json:"signature,omitempty"`
+
+	// SignedURI is the URI of the signed CALL message as requested by
+	// the caller, set by the server if it differs from URI because the
+	// server rewrote it (see juggler.Server.RewriteURI and
+	// juggler.Conn.Tenant). The signature covers SignedURI instead of
+	// URI.
+	SignedURI string `json:"signed_uri,omitempty"`
+
+	// Headers is the metadata of the call request, copied by the server
+	// from the metadata of the CALL message (see Meta.Headers).
+	Headers Headers `json:"headers,omitempty"`
+
+	// MaxAttempts is the maximum number of attempts to process the call
+	// request. The call is attempted again if the callee reports a
+	// retryable failure or if the request expires before being picked up
+	// by a callee. The default of 0 means a single attempt. It must not
+	// exceed the package-level MaxAttempts.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	// Backoff is the delay before the first retry. It doubles on each
+	// subsequent retry.
+	Backoff time.Duration `json:"backoff,omitempty"`
+
+	// Attempt is the 1-based number of the current attempt, set by the
+	// broker. A callee can use it to detect that a call may have been
+	// partially processed by a previous attempt.
+	Attempt int `json:"attempt,omitempty"`
+
+	// Timeout is the timeout of each attempt, set by the broker for
+	// calls that may be retried.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// Deadline is the time in UTC after which the caller does not expect
+	// the result of the call anymore, set by the server from the timeout
+	// of the CALL message, including all its attempts. The callees stop
+	// working on the call once it is reached (see callee.CallContext),
+	// and as for ReadTimestamp, it is subject to the clock skew between
+	// the nodes.
+	Deadline time.Time `json:"deadline,omitempty"`
+
+	// Timestamp is the time in UTC at which the server received the
+	// call request, so that the callees can tell how long it has waited
+	// (see callee.Callee.MaxQueueAge).
+	Timestamp time.Time `json:"timestamp,omitempty"`
+
+	// EnqueueTimestamp is the time in UTC at which the call request was
+	// registered in the broker for its current attempt, set by the
+	// broker. The time it waited in the broker is reported to the
+	// caller in the Timing of its result (see QueueWait).
+	EnqueueTimestamp time.Time `json:"enqueue_timestamp,omitempty"`
+
 	// TTLAfterRead is the time-to-live remaining for the call request
 	// once it has been extracted from the connector and just before it
 	// is sent for processing to the callee.
@@ -27,25 +171,353 @@ type CallPayload struct {
 	ReadTimestamp time.Time `json:"-"`
 }
 
+// CanRetry returns true if the call request has attempts left.
+// Broadcast calls are never retried.
+func (cp *CallPayload) CanRetry() bool {
+	return cp.Routing != Broadcast && cp.attempt() < cp.MaxAttempts
+}
+
+// RetryBackoff returns the delay to wait before the next attempt
+// of the call request.
+func (cp *CallPayload) RetryBackoff() time.Duration {
+	return doubled(cp.Backoff, cp.attempt()-1)
+}
+
+// TotalWait returns the maximum time to wait for the result of a call
+// request with maxAttempts attempts of timeout each, and a backoff delay
+// before the first retry that doubles on each subsequent retry. It is
+// computed in constant time, and it is the maximum duration if that
+// overflows.
+func TotalWait(timeout, backoff time.Duration, maxAttempts int) time.Duration {
+	n := maxAttempts
+	if n < 1 {
+		n = 1
+	}
+	if timeout > 0 && time.Duration(n) > maxDuration/timeout {
+		return maxDuration
+	}
+	wait := time.Duration(n) * timeout
+	if backoff <= 0 {
+		return wait
+	}
+
+	// the n-1 backoff delays add up to backoff * (2^(n-1) - 1)
+	last := doubled(backoff, n-1)
+	if last == maxDuration || wait > maxDuration-(last-backoff) {
+		return maxDuration
+	}
+	return wait + last - backoff
+}
+
+// doubled returns d doubled n times, or the maximum duration if that
+// overflows.
+func doubled(d time.Duration, n int) time.Duration {
+	if d <= 0 || n <= 0 {
+		return d
+	}
+	if n >= 63 || d > maxDuration>>uint(n) {
+		return maxDuration
+	}
+	return d << uint(n)
+}
+
+// QueueWait returns the time the call request waited in the broker,
+// from its EnqueueTimestamp to its ReadTimestamp, or 0 if either is
+// unknown. As for those timestamps, it is subject to the clock skew
+// between the nodes.
+func (cp *CallPayload) QueueWait() time.Duration {
+	if cp.EnqueueTimestamp.IsZero() || cp.ReadTimestamp.IsZero() {
+		return 0
+	}
+	if d := cp.ReadTimestamp.Sub(cp.EnqueueTimestamp); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (cp *CallPayload) attempt() int {
+	if cp.Attempt <= 0 {
+		return 1
+	}
+	return cp.Attempt
+}
+
+// DeadLetterPayload is the payload stored in the connector for a call
+// request that was quarantined after too many consecutive failures.
+type DeadLetterPayload struct {
+	Call     *CallPayload `json:"call"`
+	Key      string       `json:"key"`      // identifies the call request to track its failures
+	Failures int          `json:"failures"` // number of consecutive failures
+	Error    string       `json:"error"`    // error or panic value of the last failure
+	Stack    string       `json:"stack,omitempty"`
+
+	// Timestamp is the time in UTC at which the call request was
+	// quarantined.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// CalleeInfo is the payload stored in the connector to register a live
+// callee instance for its URIs.
+type CalleeInfo struct {
+	ID       uuid.UUID `json:"id"`
+	Hostname string    `json:"hostname"`
+	URIs     []string  `json:"uris"`
+
+	// Routing is the list of routing modes of the call requests accepted
+	// by the callee instance. All routing modes are accepted if it is
+	// empty.
+	Routing []RoutingMode `json:"routing,omitempty"`
+
+	// Heartbeat is the time in UTC of the last heartbeat of the callee
+	// instance, according to the clock of the callee.
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+// Accepts returns true if the callee instance accepts the call requests
+// with the routing mode rm.
+func (ci *CalleeInfo) Accepts(rm RoutingMode) bool {
+	if len(ci.Routing) == 0 {
+		return true
+	}
+	for _, r := range ci.Routing {
+		if r == rm {
+			return true
+		}
+	}
+	return false
+}
+
 // ResPayload is the payload stored in the connector for a result
 // of a call request.
 type ResPayload struct {
-	ConnUUID uuid.UUID       `json:"conn_uuid"`
-	MsgUUID  uuid.UUID       `json:"msg_uuid"`
-	URI      string          `json:"uri"`
-	Args     json.RawMessage `json:"args,omitempty"`
+	ConnUUID    uuid.UUID       `json:"conn_uuid"`
+	MsgUUID     uuid.UUID       `json:"msg_uuid"`
+	URI         string          `json:"uri"`
+	Args        json.RawMessage `json:"args,omitempty"`
+	ContentType string          `json:"content_type,omitempty"` // media type of a binary Args, see Codec
+
+	// Headers is the metadata of the result set by the callee, sent in
+	// the metadata of the RES message (see Meta.Headers).
+	Headers Headers `json:"headers,omitempty"`
+
+	// Timing is the latency of the call observed by the callee, sent in
+	// the metadata of the RES message (see Meta.Timing).
+	Timing *Timing `json:"timing,omitempty"`
+}
+
+// Timing is the latency of a call request observed by the callee that
+// processed it, so that the caller can tell a backlog in the broker
+// from a slow callee.
+type Timing struct {
+	// QueueWait is the time the call request waited in the broker
+	// before being received by the callee (see CallPayload.QueueWait).
+	QueueWait time.Duration `json:"queue_wait"`
+
+	// Handler is the time spent by the callee to process the call
+	// request.
+	Handler time.Duration `json:"handler"`
 }
 
 // PubPayload is the payload to publish an event.
 type PubPayload struct {
-	MsgUUID uuid.UUID       `json:"msg_uuid"`
-	Args    json.RawMessage `json:"args,omitempty"`
+	MsgUUID     uuid.UUID       `json:"msg_uuid"`
+	Args        json.RawMessage `json:"args,omitempty"`
+	ContentType string          `json:"content_type,omitempty"` // media type of a binary Args, see Codec
+
+	// Timestamp is the time in UTC at which the event was published,
+	// according to the clock of the server.
+	Timestamp time.Time `json:"timestamp"`
+
+	// TTL is the time-to-live of the event after its Timestamp. If it
+	// is > 0, the event is dropped instead of being delivered after it
+	// expired.
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// Seq is the sequence number of the event in its channel, stamped
+	// by the broker when it publishes the event, if it supports it. It
+	// is ignored when the event is published.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Headers is the metadata of the event, copied by the server from
+	// the metadata of the PUB message (see Meta.Headers).
+	Headers Headers `json:"headers,omitempty"`
 }
 
 // EvntPayload is the payload of an event received by a subscriber.
 type EvntPayload struct {
-	MsgUUID uuid.UUID       `json:"msg_uuid"`
-	Channel string          `json:"channel"`           // channel on which the event was sent
-	Pattern string          `json:"pattern,omitempty"` // if received because of a pattern-based subscription
+	MsgUUID     uuid.UUID       `json:"msg_uuid"`
+	Channel     string          `json:"channel"`           // channel on which the event was sent
+	Pattern     string          `json:"pattern,omitempty"` // if received because of a pattern-based subscription
+	Args        json.RawMessage `json:"args,omitempty"`
+	ContentType string          `json:"content_type,omitempty"` // media type of a binary Args, see Codec
+
+	// Timestamp is the time in UTC at which the event was published,
+	// according to the clock of the server.
+	Timestamp time.Time `json:"timestamp"`
+
+	// TTL is the time-to-live of the event after its Timestamp, if
+	// it is > 0 (see PubPayload.TTL).
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// Seq is the sequence number of the event in its channel, if the
+	// broker stamps one (see PubPayload.Seq). The sequence numbers of a
+	// channel increase by 1 for each event published on it, so that a
+	// subscriber can detect the events it missed. It is 0 if the broker
+	// does not stamp the events.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Tag is the delivery tag of the event, set by the server for the
+	// subscriptions in acknowledged mode (see Sub). The subscriber sends
+	// it in an EvntAck once the event is processed.
+	Tag string `json:"tag,omitempty"`
+
+	// Headers is the metadata of the event (see PubPayload.Headers),
+	// sent in the metadata of the EVNT message.
+	Headers Headers `json:"headers,omitempty"`
+}
+
+// TimeLeft returns the time left before the event expires at now, which
+// is <= 0 if it is expired. It returns false if the event has no TTL.
+func (ep *EvntPayload) TimeLeft(now time.Time) (time.Duration, bool) {
+	return timeLeft(ep.Timestamp, ep.TTL, now)
+}
+
+func timeLeft(ts time.Time, ttl time.Duration, now time.Time) (time.Duration, bool) {
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ts.Add(ttl).Sub(now), true
+}
+
+// TimeSyncURI is the URI of the time synchronization exchange. A CALL
+// to that URI with a TimeSync as argument, with only ClientTime set,
+// is answered directly by servers that support it with the TimeSync
+// with all times set.
+const TimeSyncURI = "juggler.timesync"
+
+// HistoryURI is the URI of the channel history query. A CALL to that
+// URI with a HistoryQuery as argument is answered directly by servers
+// that support it with the events retained for the channel, as a JSON
+// array of EvntPayload, oldest first.
+const HistoryURI = "juggler.history.fetch"
+
+// HistoryQuery is the argument of the channel history query. If there
+// are more events than Limit in the time range, the most recent ones
+// are returned.
+type HistoryQuery struct {
+	Channel string    `json:"channel"`
+	From    time.Time `json:"from"`            // zero for no lower bound
+	To      time.Time `json:"to"`              // zero for no upper bound
+	Limit   int       `json:"limit,omitempty"` // 0 for the server's maximum
+}
+
+// CreditURI is the URI of the flow control grant. A CALL to that URI
+// with a CreditGrant as argument is answered directly by servers that
+// support it with the CreditGrant holding the credits left for the
+// subscription once the buffered events are sent.
+const CreditURI = "juggler.credit"
+
+// CreditGrant is the argument of the flow control grant. It gives the
+// server Credits more events to send for the subscription to Channel,
+// which is a pattern if Pattern is true. Once a subscription got a
+// grant, each event sent for it uses a credit, and its events are
+// buffered or dropped by the server while it has no credit left.
+type CreditGrant struct {
+	Channel string `json:"channel"`
+	Pattern bool   `json:"pattern,omitempty"`
+	Credits int    `json:"credits"`
+}
+
+// EvntAckURI is the URI of the events acknowledgement. A CALL to that
+// URI with an EvntAck as argument is answered directly by servers that
+// support it with the EvntAck holding the tags that were acknowledged,
+// the others being unknown or already acknowledged.
+const EvntAckURI = "juggler.evntack"
+
+// EvntAck is the argument of the events acknowledgement. It holds the
+// delivery tags of the events received on subscriptions in acknowledged
+// mode that were processed, so that they are not delivered again.
+type EvntAck struct {
+	Tags []string `json:"tags"`
+}
+
+// SystemChannelPrefix is the prefix of the system channels, on which
+// the servers and callees publish their structural events, with a
+// SystemEvent as argument. Clients cannot publish on the system
+// channels, and the servers that support them only let privileged
+// clients subscribe to them.
+const SystemChannelPrefix = "juggler:"
+
+// The list of system channels.
+const (
+	ConnsChannel   = SystemChannelPrefix + "conns"   // connections opened and closed
+	CallsChannel   = SystemChannelPrefix + "calls"   // calls expired without result
+	CalleesChannel = SystemChannelPrefix + "callees" // callee instances registered and unregistered
+	ServerChannel  = SystemChannelPrefix + "server"  // servers shutting down
+
+	// BroadcastChannel is the channel of the broadcasts that the
+	// servers write to all their connections (see NewBroadcast).
+	BroadcastChannel = SystemChannelPrefix + "broadcast"
+)
+
+// The list of events of the system channels.
+const (
+	ConnOpenedEvent         = "conn_opened"
+	ConnClosedEvent         = "conn_closed"
+	CallExpiredEvent        = "call_expired"
+	CalleeRegisteredEvent   = "callee_registered"
+	CalleeUnregisteredEvent = "callee_unregistered"
+	ServerShutdownEvent     = "server_shutdown"
+	BroadcastEvent          = "broadcast"
+)
+
+// IsSystemChannel returns true if channel is a system channel.
+func IsSystemChannel(channel string) bool {
+	return strings.HasPrefix(channel, SystemChannelPrefix)
+}
+
+// SystemEvent is the argument of the events published on the system
+// channels. Only the fields relevant to the event are set.
+type SystemEvent struct {
+	Event    string `json:"event"`
+	ServerID string `json:"server_id,omitempty"`
+
+	// connection of the conn and call events
+	ConnUUID uuid.UUID `json:"conn_uuid,omitempty"`
+	Identity string    `json:"identity,omitempty"`
+	Error    string    `json:"error,omitempty"` // why the connection was closed
+
+	// call of the call events
+	MsgUUID uuid.UUID `json:"msg_uuid,omitempty"`
+	URI     string    `json:"uri,omitempty"`
+
+	// callee instance of the callee events
+	Callee *CalleeInfo `json:"callee,omitempty"`
+
+	// event of the broadcast events
+	Channel string          `json:"channel,omitempty"`
 	Args    json.RawMessage `json:"args,omitempty"`
+
+	// Timestamp is the time in UTC at which the event occurred.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TimeSync is the payload of the time synchronization exchange, used
+// to estimate the offset between the clocks of a client and a server,
+// in the same way as NTP.
+type TimeSync struct {
+	ClientTime   time.Time `json:"client_time"`             // when the client sent the request, client clock
+	ReceiveTime  time.Time `json:"receive_time,omitempty"`  // when the server received the request, server clock
+	TransmitTime time.Time `json:"transmit_time,omitempty"` // when the server sent the response, server clock
+}
+
+// Offset returns the estimated offset of the server clock relative to
+// the client clock, and the round-trip delay of the exchange, given the
+// time at which the client received the response. The server time is
+// the client time plus the offset. Samples with the smallest delay give
+// the most accurate offset.
+func (ts *TimeSync) Offset(received time.Time) (offset, delay time.Duration) {
+	offset = (ts.ReceiveTime.Sub(ts.ClientTime) + ts.TransmitTime.Sub(received)) / 2
+	delay = received.Sub(ts.ClientTime) - ts.TransmitTime.Sub(ts.ReceiveTime)
+	return offset, delay
 }
@@ -0,0 +1,139 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Protocol is a version of the juggler wire protocol, negotiated as the
+// websocket subprotocol of a connection. Each version has its own codec
+// for the messages, so that the format of the messages can evolve (new
+// fields, new types) in a new version without breaking the deployed
+// peers, which keep using the version they were built for.
+//
+// The subprotocol of a version is named "juggler.v<version>.<encoding>",
+// e.g. "juggler.v2.json", except for the first version, which keeps its
+// historical name "juggler.0".
+type Protocol interface {
+	// Name returns the websocket subprotocol of the version.
+	Name() string
+
+	// Version returns the number of the version, higher for the newer
+	// versions.
+	Version() int
+
+	// Supports returns true if the messages of type t can be exchanged
+	// in this version.
+	Supports(t Type) bool
+
+	// Encode writes the encoded message m to w.
+	Encode(w io.Writer, m Msg) error
+
+	// DecodeRequest decodes a request (client -> server) from r, as
+	// UnmarshalRequest does for the allowed messages.
+	DecodeRequest(r io.Reader, allowedMsgs ...Type) (Msg, error)
+
+	// DecodeResponse decodes a response (client <- server) from r, as
+	// UnmarshalResponse does.
+	DecodeResponse(r io.Reader) (Msg, error)
+}
+
+// The versions of the protocol supported by this package.
+var (
+	// V1 is the first version of the protocol, named "juggler.0".
+	V1 = NewJSONProtocol("juggler.0", 1)
+
+	// V2 is the current version of the protocol, "juggler.v2.json". Its
+	// messages are encoded as in V1, it introduces the naming of the
+	// subprotocols after their version, and the future versions evolve
+	// from it.
+	V2 = NewJSONProtocol("juggler.v2.json", 2)
+)
+
+var protocols = map[string]Protocol{
+	V1.Name(): V1,
+	V2.Name(): V2,
+}
+
+// RegisterProtocol registers the version p of the protocol, so that it
+// can be negotiated by the servers and clients. As for Register, it
+// should be called in the init function of the package that defines
+// the version. It panics if a version by that name has already been
+// registered.
+func RegisterProtocol(p Protocol) {
+	if _, ok := protocols[p.Name()]; ok {
+		panic("RegisterProtocol called twice for " + p.Name())
+	}
+	protocols[p.Name()] = p
+}
+
+// LookupProtocol returns the registered version of the protocol named
+// name, or false if there is none.
+func LookupProtocol(name string) (Protocol, bool) {
+	p, ok := protocols[name]
+	return p, ok
+}
+
+// Protocols returns the registered versions of the protocol, the newest
+// first, so that the names of the returned versions can be set as-is on
+// the Subprotocols field of a websocket.Dialer to negotiate the newest
+// version supported by the server.
+func Protocols() []Protocol {
+	list := make([]Protocol, 0, len(protocols))
+	for _, p := range protocols {
+		list = append(list, p)
+	}
+	sort.Sort(byVersion(list))
+	return list
+}
+
+// byVersion sorts the versions of the protocol from the newest to the
+// oldest.
+type byVersion []Protocol
+
+func (b byVersion) Len() int      { return len(b) }
+func (b byVersion) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byVersion) Less(i, j int) bool {
+	if b[i].Version() != b[j].Version() {
+		return b[i].Version() > b[j].Version()
+	}
+	return b[i].Name() < b[j].Name()
+}
+
+// NewJSONProtocol returns a version of the protocol that encodes the
+// standard messages and the custom messages registered with RegisterRead
+// and RegisterWrite as JSON, as documented by this package. A version
+// that introduces new fields or new types of messages implements its
+// own Protocol, usually by wrapping the one of the previous version.
+func NewJSONProtocol(name string, version int) Protocol {
+	return &jsonProtocol{name: name, version: version}
+}
+
+type jsonProtocol struct {
+	name    string
+	version int
+}
+
+func (p *jsonProtocol) Name() string { return p.name }
+func (p *jsonProtocol) Version() int { return p.version }
+
+func (p *jsonProtocol) Supports(t Type) bool {
+	return t.IsStd() || t.IsCustomRead() || t.IsCustomWrite()
+}
+
+func (p *jsonProtocol) Encode(w io.Writer, m Msg) error {
+	if !p.Supports(m.Type()) {
+		return fmt.Errorf("message %s is not supported by protocol %s", m.Type(), p.name)
+	}
+	return json.NewEncoder(w).Encode(m)
+}
+
+func (p *jsonProtocol) DecodeRequest(r io.Reader, allowedMsgs ...Type) (Msg, error) {
+	return UnmarshalRequest(r, allowedMsgs...)
+}
+
+func (p *jsonProtocol) DecodeResponse(r io.Reader) (Msg, error) {
+	return UnmarshalResponse(r)
+}
@@ -0,0 +1,60 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocols(t *testing.T) {
+	p, ok := LookupProtocol("juggler.0")
+	require.True(t, ok, "juggler.0")
+	assert.Equal(t, V1, p, "juggler.0")
+	assert.Equal(t, 1, p.Version(), "V1 version")
+
+	p, ok = LookupProtocol("juggler.v2.json")
+	require.True(t, ok, "juggler.v2.json")
+	assert.Equal(t, V2, p, "juggler.v2.json")
+	assert.Equal(t, 2, p.Version(), "V2 version")
+
+	_, ok = LookupProtocol("")
+	assert.False(t, ok, "empty subprotocol")
+
+	v3 := NewJSONProtocol("juggler.v3.test", 3)
+	RegisterProtocol(v3)
+	defer delete(protocols, v3.Name())
+	assert.Equal(t, []Protocol{v3, V2, V1}, Protocols(), "newest first")
+	assert.Panics(t, func() { RegisterProtocol(NewJSONProtocol("juggler.0", 4)) }, "registered twice")
+}
+
+func TestJSONProtocol(t *testing.T) {
+	call, err := NewCall("a", 1, time.Second)
+	require.NoError(t, err, "NewCall")
+
+	var buf bytes.Buffer
+	require.NoError(t, V2.Encode(&buf, call), "Encode")
+	m, err := V2.DecodeRequest(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err, "DecodeRequest")
+	assert.Equal(t, call.UUID(), m.UUID(), "decoded call")
+
+	_, err = V2.DecodeRequest(bytes.NewReader(buf.Bytes()), PubMsg)
+	assert.Error(t, err, "call not allowed")
+	_, err = V2.DecodeResponse(bytes.NewReader(buf.Bytes()))
+	assert.Error(t, err, "call as response")
+
+	buf.Reset()
+	ack := NewAck(call)
+	require.NoError(t, V1.Encode(&buf, ack), "Encode")
+	m, err = V1.DecodeResponse(&buf)
+	require.NoError(t, err, "DecodeResponse")
+	assert.Equal(t, AckMsg, m.Type(), "decoded ack")
+
+	custom := &struct {
+		Meta `json:"meta"`
+	}{NewMeta(customMsg)}
+	assert.False(t, V2.Supports(customMsg), "custom type")
+	assert.Error(t, V2.Encode(&buf, custom), "custom type")
+}
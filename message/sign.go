@@ -0,0 +1,194 @@
+package message
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/pborman/uuid"
+)
+
+var (
+	// ErrMissingSignature is returned by VerifyCall when the call request
+	// is not signed.
+	ErrMissingSignature = errors.New("missing signature")
+
+	// ErrInvalidSignature is returned by a Verifier when the signature
+	// does not match the signed data.
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Signature is the signature of a call request, made by the caller and
+// verified by the callee, so that its URI and arguments cannot be
+// tampered with by the infrastructure between them (e.g. a shared
+// broker). It is set in the metadata of the CALL message (see SignCall)
+// and copied by the server to the call payload.
+type Signature struct {
+	// KeyID is the ID of the key used to sign, so that the verifier
+	// knows which key to verify with.
+	KeyID string `json:"key_id,omitempty"`
+
+	// Value is the signature of the SignedData of the call request.
+	Value []byte `json:"value"`
+}
+
+// Signer defines the method required to sign the arguments of the call
+// requests.
+type Signer interface {
+	// Sign returns the signature of data.
+	Sign(data []byte) (*Signature, error)
+}
+
+// Verifier defines the method required to verify the signature of the
+// arguments of the call requests.
+type Verifier interface {
+	// Verify returns nil if sig is a valid signature of data, or an
+	// error, usually ErrInvalidSignature.
+	Verify(data []byte, sig *Signature) error
+}
+
+// SignedData returns the data that is signed for a call request: its
+// message UUID, its URI as requested by the caller, the identity on
+// behalf of which it is made (see Meta.ActAs), the content type and the
+// arguments. The server may rewrite the URI (e.g. to prefix the tenant),
+// so the requested URI is carried in CallPayload.SignedURI.
+func SignedData(msgUUID uuid.UUID, uri, actAs, contentType string, args []byte) []byte {
+	b := make([]byte, 0, len(msgUUID)+len(uri)+len(actAs)+len(contentType)+3+len(args))
+	b = append(b, msgUUID...)
+	b = append(b, uri...)
+	b = append(b, 0)
+	b = append(b, actAs...)
+	b = append(b, 0)
+	b = append(b, contentType...)
+	b = append(b, 0)
+	return append(b, args...)
+}
+
+// SignCall signs the call request m with s, and sets the signature in
+// its metadata. It must be called once the metadata of m is set.
+func SignCall(s Signer, m *Call) error {
+	sig, err := s.Sign(SignedData(m.UUID(), m.Payload.URI, m.Meta.ActAs, m.Payload.ContentType, m.Payload.Args))
+	if err != nil {
+		return err
+	}
+	m.Meta.Sig = sig
+	return nil
+}
+
+// VerifyCall verifies the signature of the call request cp with v, for
+// its SignedURI, or its URI if it was not rewritten. It returns
+// ErrMissingSignature if cp is not signed. As the SignedURI is set by
+// the server, the callee must also check that its URI is an expected
+// rewrite of the SignedURI (see callee.Callee.SignedURIRewrite). A caller that acts as its
+// own identity is not distinguished from a caller that does not act on
+// behalf of another identity (see CallPayload.Actor), so both are
+// accepted if cp has no Actor.
+func VerifyCall(v Verifier, cp *CallPayload) error {
+	if cp.Signature == nil {
+		return ErrMissingSignature
+	}
+
+	uri := cp.SignedURI
+	if uri == "" {
+		uri = cp.URI
+	}
+	if cp.Actor != "" {
+		return v.Verify(SignedData(cp.MsgUUID, uri, cp.Identity, cp.ContentType, cp.Args), cp.Signature)
+	}
+	err := v.Verify(SignedData(cp.MsgUUID, uri, "", cp.ContentType, cp.Args), cp.Signature)
+	if err == ErrInvalidSignature && cp.Identity != "" {
+		err = v.Verify(SignedData(cp.MsgUUID, uri, cp.Identity, cp.ContentType, cp.Args), cp.Signature)
+	}
+	return err
+}
+
+// HMACKeys is a Signer and a Verifier that uses HMAC-SHA256 with shared
+// secret keys. As the verifiers can also sign, use ECDSASigner and
+// ECDSAVerifier if the callees must not be able to sign call requests.
+type HMACKeys struct {
+	// Current is the ID of the key used to sign.
+	Current string
+
+	// Keys are the keys by ID. It must hold the current key, and the
+	// keys of the signatures to verify.
+	Keys map[string][]byte
+}
+
+// Sign implements Signer for HMACKeys.
+func (k *HMACKeys) Sign(data []byte) (*Signature, error) {
+	key, ok := k.Keys[k.Current]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", k.Current)
+	}
+	return &Signature{KeyID: k.Current, Value: hmacSum(key, data)}, nil
+}
+
+// Verify implements Verifier for HMACKeys.
+func (k *HMACKeys) Verify(data []byte, sig *Signature) error {
+	key, ok := k.Keys[sig.KeyID]
+	if !ok || !hmac.Equal(sig.Value, hmacSum(key, data)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func hmacSum(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// ECDSASigner is a Signer that signs the SHA-256 hash of the data with
+// an ECDSA private key. The signature is the ASN.1 encoding of the
+// ECDSA signature.
+type ECDSASigner struct {
+	// KeyID is the ID of the key, set in the signatures.
+	KeyID string
+
+	// Key is the private key used to sign.
+	Key *ecdsa.PrivateKey
+}
+
+// Sign implements Signer for the ECDSASigner.
+func (s *ECDSASigner) Sign(data []byte) (*Signature, error) {
+	sum := sha256.Sum256(data)
+	r, ss, err := ecdsa.Sign(rand.Reader, s.Key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	b, err := asn1.Marshal(ecdsaSignature{r, ss})
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{KeyID: s.KeyID, Value: b}, nil
+}
+
+// ECDSAVerifier is a Verifier of the signatures made by ECDSASigner,
+// with the public keys by key ID.
+type ECDSAVerifier map[string]*ecdsa.PublicKey
+
+// Verify implements Verifier for the ECDSAVerifier.
+func (v ECDSAVerifier) Verify(data []byte, sig *Signature) error {
+	key := v[sig.KeyID]
+	if key == nil {
+		return ErrInvalidSignature
+	}
+	var es ecdsaSignature
+	if rest, err := asn1.Unmarshal(sig.Value, &es); err != nil || len(rest) > 0 {
+		return ErrInvalidSignature
+	}
+	sum := sha256.Sum256(data)
+	if es.R == nil || es.S == nil || !ecdsa.Verify(key, sum[:], es.R, es.S) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
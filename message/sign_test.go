@@ -0,0 +1,84 @@
+package message
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignCall(t *testing.T) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "GenerateKey")
+	hk := &HMACKeys{Current: "h1", Keys: map[string][]byte{"h1": []byte("secret"), "h0": []byte("old")}}
+
+	cases := []struct {
+		name string
+		s    Signer
+		v    Verifier
+	}{
+		{"hmac", hk, hk},
+		{"ecdsa", &ECDSASigner{KeyID: "e1", Key: pk}, ECDSAVerifier{"e1": &pk.PublicKey}},
+	}
+	for _, c := range cases {
+		m, err := NewCall("a", map[string]int{"x": 1}, time.Second)
+		require.NoError(t, err, "%s: NewCall", c.name)
+		require.NoError(t, SignCall(c.s, m), "%s: SignCall", c.name)
+
+		// the signature travels in the metadata
+		b, err := json.Marshal(m)
+		require.NoError(t, err, "%s: Marshal", c.name)
+		var got Call
+		require.NoError(t, json.Unmarshal(b, &got), "%s: Unmarshal", c.name)
+		require.NotNil(t, got.Meta.Sig, "%s: signature", c.name)
+
+		cp := &CallPayload{MsgUUID: got.UUID(), URI: "tenant.a", SignedURI: "a", Args: got.Payload.Args, Signature: got.Meta.Sig}
+		assert.NoError(t, VerifyCall(c.v, cp), "%s: valid", c.name)
+
+		tampered := *cp
+		tampered.Args = json.RawMessage(`{"x":2}`)
+		assert.Equal(t, ErrInvalidSignature, VerifyCall(c.v, &tampered), "%s: tampered args", c.name)
+		tampered = *cp
+		tampered.MsgUUID = uuid.NewRandom()
+		assert.Equal(t, ErrInvalidSignature, VerifyCall(c.v, &tampered), "%s: other message", c.name)
+		tampered = *cp
+		tampered.ContentType = DefaultBinaryContentType
+		assert.Equal(t, ErrInvalidSignature, VerifyCall(c.v, &tampered), "%s: content type", c.name)
+		tampered = *cp
+		tampered.SignedURI = "b"
+		assert.Equal(t, ErrInvalidSignature, VerifyCall(c.v, &tampered), "%s: other signed URI", c.name)
+		tampered = *cp
+		tampered.SignedURI = ""
+		assert.Equal(t, ErrInvalidSignature, VerifyCall(c.v, &tampered), "%s: rewritten URI", c.name)
+		tampered = *cp
+		tampered.Identity, tampered.Actor = "bob", "gateway"
+		assert.Equal(t, ErrInvalidSignature, VerifyCall(c.v, &tampered), "%s: other identity", c.name)
+		tampered = *cp
+		tampered.Signature = &Signature{KeyID: "x", Value: cp.Signature.Value}
+		assert.Equal(t, ErrInvalidSignature, VerifyCall(c.v, &tampered), "%s: unknown key", c.name)
+		tampered = *cp
+		tampered.Signature = nil
+		assert.Equal(t, ErrMissingSignature, VerifyCall(c.v, &tampered), "%s: not signed", c.name)
+	}
+
+	// the identity the call acts as is signed
+	m, err := NewCall("a", 1, time.Second)
+	require.NoError(t, err, "NewCall act as")
+	m.Meta.ActAs = "alice"
+	require.NoError(t, SignCall(hk, m), "SignCall act as")
+	cp := &CallPayload{MsgUUID: m.UUID(), URI: "a", Args: m.Payload.Args, Signature: m.Meta.Sig, Identity: "alice", Actor: "gateway"}
+	assert.NoError(t, VerifyCall(hk, cp), "valid act as")
+	cp.Actor = ""
+	assert.NoError(t, VerifyCall(hk, cp), "valid act as own identity")
+	cp.Identity, cp.Actor = "bob", "gateway"
+	assert.Equal(t, ErrInvalidSignature, VerifyCall(hk, cp), "other act as")
+
+	_, err = (&HMACKeys{Current: "x"}).Sign([]byte("a"))
+	assert.Error(t, err, "unknown current key")
+}
@@ -0,0 +1,123 @@
+package message
+
+import "strings"
+
+// The wildcards of URI patterns. URIs are made of segments separated by
+// dots, e.g. "billing.invoice.create". In a pattern, the "*" segment
+// matches exactly one segment, and the ">" segment, only allowed as the
+// last segment, matches one or more segments. For example, "billing.*"
+// matches "billing.charge" but not "billing.invoice.create", while
+// "billing.>" matches both.
+const (
+	SegmentWildcard = "*"
+	TailWildcard    = ">"
+)
+
+// IsURIPattern returns true if uri contains a wildcard segment.
+func IsURIPattern(uri string) bool {
+	for _, seg := range strings.Split(uri, ".") {
+		if seg == SegmentWildcard || seg == TailWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchURI returns true if the URI matches the pattern. A pattern
+// without wildcard only matches itself.
+func MatchURI(pattern, uri string) bool {
+	ps, us := strings.Split(pattern, "."), strings.Split(uri, ".")
+	for i, p := range ps {
+		if p == TailWildcard {
+			return i == len(ps)-1 && len(us) > i
+		}
+		if i >= len(us) || (p != SegmentWildcard && p != us[i]) {
+			return false
+		}
+	}
+	return len(ps) == len(us)
+}
+
+// BestURIPattern returns the most specific pattern of the list that
+// matches the URI, or an empty string if none matches. The most
+// specific pattern is the one with the most literal segments, and ties
+// are broken by the lowest pattern in lexical order so that the result
+// does not depend on the order of the list.
+func BestURIPattern(patterns []string, uri string) string {
+	var best string
+	bestLit := -1
+	for _, p := range patterns {
+		if !MatchURI(p, uri) {
+			continue
+		}
+		lit := 0
+		for _, seg := range strings.Split(p, ".") {
+			if seg != SegmentWildcard && seg != TailWildcard {
+				lit++
+			}
+		}
+		if lit > bestLit || (lit == bestLit && p < best) {
+			best, bestLit = p, lit
+		}
+	}
+	return best
+}
+
+// VersionSeparator separates the URI from its version in a versioned URI.
+const VersionSeparator = "@"
+
+// VersionedURI returns the URI for the version of uri, e.g.
+// "billing.charge@2". Callees listen on the versioned URIs of the
+// versions they support, and call requests with a version are only
+// delivered to the callees listening on that versioned URI. It returns
+// uri if version is empty.
+func VersionedURI(uri, version string) string {
+	if version == "" {
+		return uri
+	}
+	return uri + VersionSeparator + version
+}
+
+// SplitVersion returns the URI and the version of a versioned URI. The
+// version is empty if uri is not versioned.
+func SplitVersion(uri string) (string, string) {
+	if ix := strings.LastIndex(uri, VersionSeparator); ix >= 0 {
+		return uri[:ix], uri[ix+1:]
+	}
+	return uri, ""
+}
+
+// TenantSeparator separates the tenant from the URI or channel in a
+// tenant name.
+const TenantSeparator = "/"
+
+// TenantName returns the name of the URI or channel in the namespace of
+// the tenant, e.g. "acme/billing.charge". The server sends the calls and
+// events of the connections with a tenant to the broker under their
+// tenant name, so callees serving a tenant listen on its tenant names.
+// It returns name if tenant is empty.
+func TenantName(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + TenantSeparator + name
+}
+
+// SplitTenant returns the tenant and the URI or channel of a tenant
+// name. The tenant is empty if name is not in a tenant namespace.
+func SplitTenant(name string) (string, string) {
+	if ix := strings.Index(name, TenantSeparator); ix >= 0 {
+		return name[:ix], name[ix+1:]
+	}
+	return "", name
+}
+
+// ValidTenant returns true if tenant can be used as namespace, i.e. if
+// it is not empty and does not contain the TenantSeparator, whitespace,
+// control characters or the pattern characters of URIs and channels.
+func ValidTenant(tenant string) bool {
+	if tenant == "" || !canonicalName(tenant) {
+		return false
+	}
+	return !strings.ContainsAny(tenant, TenantSeparator+".*?[]\\>")
+}
@@ -0,0 +1,74 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchURI(t *testing.T) {
+	cases := []struct {
+		pattern, uri string
+		want         bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a", false},
+		{"a.*", "a.b.c", false},
+		{"*.b", "a.b", true},
+		{"a.*.c", "a.b.c", true},
+		{"a.>", "a.b", true},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{"a.>.c", "a.b.c", false},
+		{">", "a.b", true},
+		{"b.>", "a.b", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, MatchURI(c.pattern, c.uri), "%s ~ %s", c.pattern, c.uri)
+	}
+
+	assert.True(t, IsURIPattern("a.*"), "segment wildcard")
+	assert.True(t, IsURIPattern("a.>"), "tail wildcard")
+	assert.False(t, IsURIPattern("a.b*"), "no wildcard segment")
+}
+
+func TestBestURIPattern(t *testing.T) {
+	patterns := []string{">", "a.>", "a.*", "*.b", "a.b.>"}
+	assert.Equal(t, "*.b", BestURIPattern(patterns, "a.b"), "tie broken by lexical order")
+	assert.Equal(t, "a.b.>", BestURIPattern(patterns, "a.b.c"), "most literal segments")
+	assert.Equal(t, ">", BestURIPattern(patterns, "c.d"), "catch-all")
+	assert.Equal(t, "", BestURIPattern(patterns[1:], "c.d"), "no match")
+}
+
+func TestVersionedURI(t *testing.T) {
+	assert.Equal(t, "a.b", VersionedURI("a.b", ""), "no version")
+	assert.Equal(t, "a.b@2", VersionedURI("a.b", "2"), "version")
+
+	uri, v := SplitVersion("a.b@2")
+	assert.Equal(t, "a.b", uri, "split URI")
+	assert.Equal(t, "2", v, "split version")
+	uri, v = SplitVersion("a.b")
+	assert.Equal(t, "a.b", uri, "unversioned URI")
+	assert.Equal(t, "", v, "no version")
+}
+
+func TestTenantName(t *testing.T) {
+	assert.Equal(t, "a.b", TenantName("", "a.b"), "no tenant")
+	assert.Equal(t, "t1/a.b", TenantName("t1", "a.b"), "tenant")
+
+	tenant, name := SplitTenant("t1/a/b")
+	assert.Equal(t, "t1", tenant, "split tenant")
+	assert.Equal(t, "a/b", name, "split name")
+	tenant, name = SplitTenant("a.b")
+	assert.Equal(t, "", tenant, "no tenant")
+	assert.Equal(t, "a.b", name, "name without tenant")
+
+	for _, s := range []string{"t1", "acme-corp", "a_b"} {
+		assert.True(t, ValidTenant(s), s)
+	}
+	for _, s := range []string{"", "a/b", "a.b", "a*", "a?", "a[b]", "a b", "a\n", ">"} {
+		assert.False(t, ValidTenant(s), "%q", s)
+	}
+}
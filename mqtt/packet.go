@@ -0,0 +1,283 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The types of the control packets, in the high 4 bits of the first
+// byte of the fixed header.
+const (
+	connectPacket     = 1
+	connackPacket     = 2
+	publishPacket     = 3
+	pubackPacket      = 4
+	subscribePacket   = 8
+	subackPacket      = 9
+	unsubscribePacket = 10
+	unsubackPacket    = 11
+	pingreqPacket     = 12
+	pingrespPacket    = 13
+	disconnectPacket  = 14
+)
+
+// The return codes of the CONNACK packet.
+const (
+	connAccepted            = 0
+	connRefusedProtocol     = 1
+	connRefusedIdentifier   = 2
+	connRefusedUnavailable  = 3
+	connRefusedBadAuth      = 4
+	connRefusedUnauthorized = 5
+)
+
+// subackFailure is the return code of a SUBACK for a refused
+// subscription.
+const subackFailure = 0x80
+
+// maxRemainingLength is the maximum remaining length of a packet,
+// encoded on 4 bytes.
+const maxRemainingLength = 268435455
+
+var errMalformed = errors.New("mqtt: malformed packet")
+
+// packet is a decoded control packet.
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte // variable header and payload
+}
+
+// readPacket reads the next control packet from r. It fails if the
+// remaining length of the packet is larger than max, if max > 0.
+func readPacket(r *bufio.Reader, max int) (*packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	var n, shift uint
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMalformed
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n |= uint(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	if max > 0 && int(n) > max {
+		return nil, fmt.Errorf("mqtt: packet of %d bytes exceeds the limit of %d bytes", n, max)
+	}
+
+	p := &packet{typ: b >> 4, flags: b & 0x0f, body: make([]byte, n)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// writePacket writes the control packet of type typ with flags and body
+// to w.
+func writePacket(w io.Writer, typ, flags byte, body []byte) error {
+	if len(body) > maxRemainingLength {
+		return errMalformed
+	}
+	hdr := make([]byte, 1, 5)
+	hdr[0] = typ<<4 | flags
+	n := len(body)
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			c |= 0x80
+		}
+		hdr = append(hdr, c)
+		if n == 0 {
+			break
+		}
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// decoder reads the fields of the body of a packet.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.b) < 1 {
+		d.err = errMalformed
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.b) < 2 {
+		d.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if d.err != nil || len(d.b) < n {
+		d.err = errMalformed
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// encoder appends the fields of the body of a packet.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) byte(c byte) {
+	e.b = append(e.b, c)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *encoder) string(s string) {
+	e.uint16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// connect is the content of a CONNECT packet.
+type connect struct {
+	protocol     string
+	level        byte
+	cleanSession bool
+	keepAlive    uint16
+	clientID     string
+	username     string
+	password     []byte
+}
+
+// The flags of the CONNECT packet.
+const (
+	connectFlagReserved = 0x01
+	connectFlagClean    = 0x02
+	connectFlagWill     = 0x04
+	connectFlagPassword = 0x40
+	connectFlagUsername = 0x80
+)
+
+func decodeConnect(p *packet) (*connect, error) {
+	d := &decoder{b: p.body}
+	c := &connect{protocol: d.string(), level: d.byte()}
+	flags := d.byte()
+	c.keepAlive = d.uint16()
+	if d.err != nil || flags&connectFlagReserved != 0 {
+		return nil, errMalformed
+	}
+	c.cleanSession = flags&connectFlagClean != 0
+	c.clientID = d.string()
+	if flags&connectFlagWill != 0 {
+		// the will message is not supported, it is skipped
+		d.bytes()
+		d.bytes()
+	}
+	if flags&connectFlagUsername != 0 {
+		c.username = d.string()
+	}
+	if flags&connectFlagPassword != 0 {
+		c.password = d.bytes()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return c, nil
+}
+
+// publish is the content of a PUBLISH packet.
+type publish struct {
+	topic    string
+	qos      byte
+	retain   bool
+	packetID uint16
+	payload  []byte
+}
+
+func decodePublish(p *packet) (*publish, error) {
+	d := &decoder{b: p.body}
+	pub := &publish{
+		topic:  d.string(),
+		qos:    (p.flags >> 1) & 0x03,
+		retain: p.flags&0x01 != 0,
+	}
+	if pub.qos > 0 {
+		pub.packetID = d.uint16()
+	}
+	if d.err != nil || pub.qos == 3 {
+		return nil, errMalformed
+	}
+	pub.payload = d.b
+	return pub, nil
+}
+
+func encodePublish(pub *publish) []byte {
+	e := &encoder{b: make([]byte, 0, 2+len(pub.topic)+2+len(pub.payload))}
+	e.string(pub.topic)
+	if pub.qos > 0 {
+		e.uint16(pub.packetID)
+	}
+	e.b = append(e.b, pub.payload...)
+	return e.b
+}
+
+// subscription is a topic filter of a SUBSCRIBE or UNSUBSCRIBE packet.
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+// decodeSubscribe decodes a SUBSCRIBE packet, or an UNSUBSCRIBE packet
+// if unsb is true, whose filters have no QoS.
+func decodeSubscribe(p *packet, unsb bool) (uint16, []subscription, error) {
+	if p.flags != 0x02 {
+		return 0, nil, errMalformed
+	}
+	d := &decoder{b: p.body}
+	id := d.uint16()
+	var subs []subscription
+	for d.err == nil && len(d.b) > 0 {
+		sub := subscription{filter: d.string()}
+		if !unsb {
+			sub.qos = d.byte()
+		}
+		subs = append(subs, sub)
+	}
+	if d.err != nil || len(subs) == 0 {
+		return 0, nil, errMalformed
+	}
+	return id, subs, nil
+}
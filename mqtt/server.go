@@ -0,0 +1,504 @@
+// Package mqtt is an MQTT front-end for the juggler pub-sub brokers, so
+// that the IoT devices that only speak MQTT can publish and subscribe on
+// the same channels as the websocket clients. The Server accepts the
+// MQTT 3.1 and 3.1.1 clients, and maps their PUBLISH and SUBSCRIBE
+// packets to the Publish and Subscribe of the broker, with QoS 0 and 1.
+//
+// The topics are mapped to the channels with ChannelOf, e.g. the topic
+// "sensors/kitchen/temp" is the channel "sensors.kitchen.temp", and the
+// topic filters with wildcards are pattern subscriptions: the broker
+// should use broker.MQTTPatterns so that they match the same topics as
+// in MQTT. The payloads that are valid JSON are the arguments of the
+// events as is, the others are encoded with message.Binary, and the
+// events are sent to the clients the other way around.
+//
+// The sessions are not persisted, a client always starts with a clean
+// session. The retained messages, the will messages and QoS 2 are not
+// supported: a retained PUBLISH is published as a regular event, the
+// will is ignored, the subscriptions with QoS 2 are granted QoS 1 and
+// the clients that PUBLISH with QoS 2 are disconnected. The events sent
+// with QoS 1 are not redelivered if they are not acknowledged.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// The default options of the Server.
+const (
+	DefaultMaxPacketSize  = 1 << 20
+	DefaultConnectTimeout = 10 * time.Second
+)
+
+// ErrRefused can be returned by Server.Authenticate to refuse a client
+// because of its credentials, with the "bad user name or password"
+// return code. The other errors refuse the client as not authorized.
+var ErrRefused = errors.New("mqtt: bad user name or password")
+
+// Server serves the MQTT clients. The zero value is not usable, Broker
+// must be set.
+type Server struct {
+	// Broker is the pub-sub broker of the events.
+	Broker broker.PubSubBroker
+
+	// Authenticate, if set, is called with the client identifier and the
+	// credentials of the CONNECT packet of each client, and returns the
+	// identity of the client, or an error to refuse it.
+	Authenticate func(clientID, username string, password []byte) (identity string, err error)
+
+	// Authorize, if set, is called for each channel that a client
+	// publishes on, or subscribes to with pattern set if it has
+	// wildcards, and returns false to deny the request. The denied
+	// subscriptions fail in the SUBACK, the denied publications are
+	// dropped. It is also called for the channel of each event received
+	// via a pattern subscription, as a subscription to that channel, and
+	// the denied events are dropped.
+	Authorize func(identity, channel string, pattern, publish bool) bool
+
+	// MaxPacketSize is the maximum size of the packets received from
+	// the clients, DefaultMaxPacketSize if it is <= 0. The clients that
+	// send larger packets are disconnected.
+	MaxPacketSize int
+
+	// ConnectTimeout is the time allowed to receive the CONNECT packet
+	// of a client, DefaultConnectTimeout if it is <= 0.
+	ConnectTimeout time.Duration
+
+	// Vars can be set to track the number of TotalMQTTConns,
+	// ActiveMQTTConns, RejectedMQTTConns, MQTTPublishes,
+	// FailedMQTTPublishes, MQTTEvents, DeniedMQTTRequests and
+	// DeniedMQTTEvents.
+	Vars *expvar.Map
+
+	// LogFunc is the logging function, log.Printf if nil.
+	LogFunc func(string, ...interface{})
+}
+
+// ListenAndServe listens on the TCP network address addr and serves the
+// MQTT clients. It returns the error that caused the listener to fail.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the MQTT clients that connect on l, each in its own
+// goroutine. It returns the error that caused the listener to fail,
+// e.g. when it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	var delay time.Duration
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// same backoff as net/http.Server
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				s.logf("mqtt: accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go s.ServeConn(nc)
+	}
+}
+
+// ServeConn serves the MQTT client connected on nc, until it disconnects
+// or the connection fails. It closes nc when it returns.
+func (s *Server) ServeConn(nc net.Conn) {
+	defer nc.Close()
+
+	max := s.MaxPacketSize
+	if max <= 0 {
+		max = DefaultMaxPacketSize
+	}
+	timeout := s.ConnectTimeout
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+
+	r := bufio.NewReader(nc)
+	nc.SetReadDeadline(time.Now().Add(timeout))
+	p, err := readPacket(r, max)
+	if err != nil || p.typ != connectPacket {
+		s.add("RejectedMQTTConns", 1)
+		return
+	}
+	cp, err := decodeConnect(p)
+	if err != nil {
+		s.add("RejectedMQTTConns", 1)
+		return
+	}
+
+	c := &conn{srv: s, nc: nc, w: bufio.NewWriter(nc), subs: make(map[broker.Subscription]byte)}
+	if code := s.accept(c, cp); code != connAccepted {
+		s.add("RejectedMQTTConns", 1)
+		c.write(connackPacket, 0, []byte{0, code})
+		return
+	}
+
+	psc, err := s.Broker.NewPubSubConn()
+	if err != nil {
+		s.add("RejectedMQTTConns", 1)
+		s.logf("mqtt: failed to create pub-sub connection for %s: %v", nc.RemoteAddr(), err)
+		c.write(connackPacket, 0, []byte{0, connRefusedUnavailable})
+		return
+	}
+	c.psc = psc
+	if err := c.write(connackPacket, 0, []byte{0, connAccepted}); err != nil {
+		psc.Close()
+		return
+	}
+	s.add("TotalMQTTConns", 1)
+	s.add("ActiveMQTTConns", 1)
+	defer s.add("ActiveMQTTConns", -1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.sendEvents()
+	}()
+	defer wg.Wait()
+	defer psc.Close()
+
+	var keepAlive time.Duration
+	if cp.keepAlive > 0 {
+		keepAlive = time.Duration(cp.keepAlive) * time.Second * 3 / 2
+	}
+	for {
+		if keepAlive > 0 {
+			nc.SetReadDeadline(time.Now().Add(keepAlive))
+		} else {
+			nc.SetReadDeadline(time.Time{})
+		}
+		p, err := readPacket(r, max)
+		if err != nil {
+			if err != io.EOF {
+				s.logf("mqtt: connection %s (%s) failed: %v", nc.RemoteAddr(), cp.clientID, err)
+			}
+			return
+		}
+		if err := c.handle(p); err != nil {
+			if err != errDisconnect {
+				s.logf("mqtt: closing connection %s (%s): %v", nc.RemoteAddr(), cp.clientID, err)
+			}
+			return
+		}
+	}
+}
+
+// accept returns the return code of the CONNACK packet for the client
+// of cp, and sets its identity.
+func (s *Server) accept(c *conn, cp *connect) byte {
+	switch {
+	case cp.protocol == "MQTT" && cp.level == 4:
+	case cp.protocol == "MQIsdp" && cp.level == 3:
+	default:
+		return connRefusedProtocol
+	}
+	if cp.clientID == "" && !cp.cleanSession {
+		return connRefusedIdentifier
+	}
+	if s.Authenticate != nil {
+		id, err := s.Authenticate(cp.clientID, cp.username, cp.password)
+		if err != nil {
+			if err == ErrRefused {
+				return connRefusedBadAuth
+			}
+			return connRefusedUnauthorized
+		}
+		c.identity = id
+	}
+	return connAccepted
+}
+
+func (s *Server) authorized(identity, channel string, pattern, publish bool) bool {
+	if s.Authorize == nil || s.Authorize(identity, channel, pattern, publish) {
+		return true
+	}
+	s.add("DeniedMQTTRequests", 1)
+	return false
+}
+
+func (s *Server) add(key string, n int64) {
+	if s.Vars != nil {
+		s.Vars.Add(key, n)
+	}
+}
+
+func (s *Server) logf(f string, args ...interface{}) {
+	if s.LogFunc != nil {
+		s.LogFunc(f, args...)
+		return
+	}
+	log.Printf(f, args...)
+}
+
+// errDisconnect is returned by conn.handle when the client sends a
+// DISCONNECT packet.
+var errDisconnect = errors.New("mqtt: disconnected")
+
+// conn is the connection of an MQTT client.
+type conn struct {
+	srv      *Server
+	nc       net.Conn
+	psc      broker.PubSubConn
+	identity string
+
+	// wmu protects the writes to the connection and the packet ID.
+	wmu    sync.Mutex
+	w      *bufio.Writer
+	nextID uint16
+
+	// mu protects the subscriptions, with their QoS.
+	mu   sync.Mutex
+	subs map[broker.Subscription]byte
+}
+
+// write writes the packet to the client.
+func (c *conn) write(typ, flags byte, body []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := writePacket(c.w, typ, flags, body); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// writePublish writes the PUBLISH packet pub to the client, with a new
+// packet ID if its QoS is 1.
+func (c *conn) writePublish(pub *publish) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if pub.qos > 0 {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		pub.packetID = c.nextID
+	}
+	if err := writePacket(c.w, publishPacket, pub.qos<<1, encodePublish(pub)); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// handle handles the packet p received from the client. It returns an
+// error if the connection must be closed.
+func (c *conn) handle(p *packet) error {
+	switch p.typ {
+	case publishPacket:
+		pub, err := decodePublish(p)
+		if err != nil {
+			return err
+		}
+		return c.publish(pub)
+
+	case pubackPacket:
+		// the events are not redelivered, nothing to do
+		return nil
+
+	case subscribePacket:
+		id, subs, err := decodeSubscribe(p, false)
+		if err != nil {
+			return err
+		}
+		e := &encoder{}
+		e.uint16(id)
+		for _, sub := range subs {
+			e.byte(c.subscribe(sub))
+		}
+		return c.write(subackPacket, 0, e.b)
+
+	case unsubscribePacket:
+		id, subs, err := decodeSubscribe(p, true)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subs {
+			if err := c.unsubscribe(sub.filter); err != nil {
+				return err
+			}
+		}
+		e := &encoder{}
+		e.uint16(id)
+		return c.write(unsubackPacket, 0, e.b)
+
+	case pingreqPacket:
+		return c.write(pingrespPacket, 0, nil)
+
+	case disconnectPacket:
+		return errDisconnect
+
+	default:
+		return errMalformed
+	}
+}
+
+// publish publishes the PUBLISH packet pub of the client on the broker,
+// and acknowledges it if its QoS is 1. A failed publication is not
+// acknowledged, so that the client sends it again.
+func (c *conn) publish(pub *publish) error {
+	if pub.qos > 1 {
+		return errors.New("mqtt: QoS 2 is not supported")
+	}
+	channel, _, err := ChannelOf(pub.topic, false)
+	if err != nil {
+		return err
+	}
+
+	if c.srv.authorized(c.identity, channel, false, true) {
+		args, ct := argsOf(pub.payload)
+		pp := &message.PubPayload{
+			MsgUUID:     message.NewID(),
+			Args:        args,
+			ContentType: ct,
+			Timestamp:   time.Now().UTC(),
+		}
+		if err := c.srv.Broker.Publish(channel, pp); err != nil {
+			c.srv.add("FailedMQTTPublishes", 1)
+			c.srv.logf("mqtt: failed to publish on %s: %v", channel, err)
+			return nil
+		}
+		c.srv.add("MQTTPublishes", 1)
+	}
+
+	if pub.qos == 1 {
+		e := &encoder{}
+		e.uint16(pub.packetID)
+		return c.write(pubackPacket, 0, e.b)
+	}
+	return nil
+}
+
+// subscribe subscribes the client to the topic filter of sub, and
+// returns the return code of the SUBACK.
+func (c *conn) subscribe(sub subscription) byte {
+	channel, pattern, err := ChannelOf(sub.filter, true)
+	if err != nil || sub.qos > 2 || !c.srv.authorized(c.identity, channel, pattern, false) {
+		return subackFailure
+	}
+	qos := sub.qos
+	if qos > 1 {
+		qos = 1
+	}
+
+	key := broker.Subscription{Channel: channel, Pattern: pattern}
+	c.mu.Lock()
+	_, ok := c.subs[key]
+	c.subs[key] = qos
+	c.mu.Unlock()
+	if !ok {
+		if err := c.psc.Subscribe(channel, pattern); err != nil {
+			c.mu.Lock()
+			delete(c.subs, key)
+			c.mu.Unlock()
+			c.srv.logf("mqtt: failed to subscribe to %s: %v", channel, err)
+			return subackFailure
+		}
+	}
+	return qos
+}
+
+// unsubscribe unsubscribes the client from the topic filter.
+func (c *conn) unsubscribe(filter string) error {
+	channel, pattern, err := ChannelOf(filter, true)
+	if err != nil {
+		// it cannot be subscribed
+		return nil
+	}
+
+	key := broker.Subscription{Channel: channel, Pattern: pattern}
+	c.mu.Lock()
+	_, ok := c.subs[key]
+	delete(c.subs, key)
+	c.mu.Unlock()
+	if ok {
+		return c.psc.Unsubscribe(channel, pattern)
+	}
+	return nil
+}
+
+// sendEvents sends the events of the subscriptions to the client, until
+// the pub-sub connection is closed.
+func (c *conn) sendEvents() {
+	for ev := range c.psc.Events() {
+		key := broker.Subscription{Channel: ev.Channel}
+		if ev.Pattern != "" {
+			key = broker.Subscription{Channel: ev.Pattern, Pattern: true}
+		}
+		c.mu.Lock()
+		qos, ok := c.subs[key]
+		c.mu.Unlock()
+		if !ok {
+			// unsubscribed since
+			continue
+		}
+		if ev.Pattern != "" && c.srv.Authorize != nil && !c.srv.Authorize(c.identity, ev.Channel, false, false) {
+			c.srv.add("DeniedMQTTEvents", 1)
+			continue
+		}
+
+		payload, err := payloadOf(ev)
+		if err != nil {
+			c.srv.logf("mqtt: invalid payload of event %v: %v", ev.MsgUUID, err)
+			continue
+		}
+		if err := c.writePublish(&publish{topic: TopicOf(ev.Channel), qos: qos, payload: payload}); err != nil {
+			// the connection is closed by the read loop
+			c.nc.Close()
+			continue
+		}
+		c.srv.add("MQTTEvents", 1)
+	}
+}
+
+// argsOf returns the arguments and the content type of the event of the
+// payload of a PUBLISH.
+func argsOf(payload []byte) (json.RawMessage, string) {
+	if len(payload) == 0 {
+		return nil, ""
+	}
+	var raw json.RawMessage
+	if err := json.Unmarshal(payload, &raw); err == nil {
+		return json.RawMessage(payload), ""
+	}
+	b, _ := message.Binary.Encode(payload)
+	return b, message.ContentType(message.Binary)
+}
+
+// payloadOf returns the payload of the PUBLISH of the event ev.
+func payloadOf(ev *message.EvntPayload) ([]byte, error) {
+	if ev.ContentType == "" {
+		return ev.Args, nil
+	}
+	var b []byte
+	if err := message.Binary.Decode(ev.Args, &b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,203 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/jugglertest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelOf(t *testing.T) {
+	cases := []struct {
+		topic   string
+		filter  bool
+		channel string
+		pattern bool
+		err     bool
+	}{
+		{"", false, "", false, true},
+		{"a", false, "a", false, false},
+		{"a/b/c", false, "a.b.c", false, false},
+		{"a/+", false, "", false, true},
+		{"a/+/c", true, "a.+.c", true, false},
+		{"a/#", true, "a.#", true, false},
+		{"#", true, "#", true, false},
+		{"a/#/c", true, "", false, true},
+		{"a/b+", true, "", false, true},
+		{"a/b", true, "a.b", false, false},
+	}
+	for _, c := range cases {
+		ch, pat, err := ChannelOf(c.topic, c.filter)
+		if c.err {
+			assert.Error(t, err, "%q", c.topic)
+			continue
+		}
+		if assert.NoError(t, err, "%q", c.topic) {
+			assert.Equal(t, c.channel, ch, "%q channel", c.topic)
+			assert.Equal(t, c.pattern, pat, "%q pattern", c.topic)
+		}
+	}
+	assert.Equal(t, "a/b/c", TopicOf("a.b.c"), "TopicOf")
+}
+
+func TestPacketLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097152} {
+		var buf bytes.Buffer
+		body := make([]byte, n)
+		require.NoError(t, writePacket(&buf, publishPacket, 0x02, body), "write %d", n)
+		p, err := readPacket(bufio.NewReader(&buf), 0)
+		require.NoError(t, err, "read %d", n)
+		assert.Equal(t, byte(publishPacket), p.typ, "type %d", n)
+		assert.Equal(t, byte(0x02), p.flags, "flags %d", n)
+		assert.Equal(t, n, len(p.body), "length %d", n)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, writePacket(&buf, publishPacket, 0, make([]byte, 200)), "write")
+	_, err := readPacket(bufio.NewReader(&buf), 100)
+	assert.Error(t, err, "exceeds the limit")
+}
+
+// testClient is a minimal MQTT client.
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func dialTest(t *testing.T, addr, password string) (*testClient, byte) {
+	nc, err := net.Dial("tcp", addr)
+	require.NoError(t, err, "Dial")
+	c := &testClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+
+	e := &encoder{}
+	e.string("MQTT")
+	e.byte(4)
+	e.byte(connectFlagClean | connectFlagUsername | connectFlagPassword)
+	e.uint16(60)
+	e.string("dev1")
+	e.string("user")
+	e.string(password)
+	c.write(connectPacket, 0, e.b)
+
+	p := c.read(connackPacket)
+	require.Equal(t, 2, len(p.body), "CONNACK length")
+	return c, p.body[1]
+}
+
+func (c *testClient) write(typ, flags byte, body []byte) {
+	require.NoError(c.t, writePacket(c.nc, typ, flags, body), "write packet %d", typ)
+}
+
+func (c *testClient) read(typ byte) *packet {
+	c.nc.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := readPacket(c.r, 0)
+	require.NoError(c.t, err, "read packet %d", typ)
+	require.Equal(c.t, typ, p.typ, "packet type")
+	return p
+}
+
+func TestServer(t *testing.T) {
+	brk := &jugglertest.Broker{PatternSyntax: broker.MQTTPatterns}
+	vars := new(expvar.Map).Init()
+	srv := &Server{
+		Broker: brk,
+		Authenticate: func(clientID, username string, password []byte) (string, error) {
+			if string(password) != "secret" {
+				return "", ErrRefused
+			}
+			return username, nil
+		},
+		Authorize: func(identity, channel string, pattern, publish bool) bool {
+			return identity == "user" && channel != "private" && channel != "sensors.vault.temp"
+		},
+		Vars:    vars,
+		LogFunc: func(string, ...interface{}) {},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Listen")
+	defer l.Close()
+	go srv.Serve(l)
+
+	bad, code := dialTest(t, l.Addr().String(), "wrong")
+	bad.nc.Close()
+	assert.Equal(t, byte(connRefusedBadAuth), code, "bad password")
+
+	cli, code := dialTest(t, l.Addr().String(), "secret")
+	defer cli.nc.Close()
+	require.Equal(t, byte(connAccepted), code, "accepted")
+
+	// subscribe
+	e := &encoder{}
+	e.uint16(1)
+	e.string("sensors/+/temp")
+	e.byte(2)
+	e.string("bad/#/x")
+	e.byte(0)
+	e.string("private")
+	e.byte(0)
+	cli.write(subscribePacket, 0x02, e.b)
+	p := cli.read(subackPacket)
+	assert.Equal(t, []byte{0, 1, 1, subackFailure, subackFailure}, p.body, "SUBACK")
+
+	// receive an event, not the events of the denied channels
+	require.NoError(t, brk.Publish("sensors.vault.temp", &message.PubPayload{MsgUUID: message.NewID(), Args: json.RawMessage(`0`)}), "Publish")
+	require.NoError(t, brk.Publish("sensors.kitchen.temp", &message.PubPayload{MsgUUID: message.NewID(), Args: json.RawMessage(`21`)}), "Publish")
+	p = cli.read(publishPacket)
+	pub, err := decodePublish(p)
+	require.NoError(t, err, "decode PUBLISH")
+	assert.Equal(t, "sensors/kitchen/temp", pub.topic, "topic")
+	assert.Equal(t, byte(1), pub.qos, "QoS")
+	assert.Equal(t, "21", string(pub.payload), "payload")
+
+	// publish a binary payload
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn")
+	defer psc.Close()
+	require.NoError(t, psc.Subscribe("cmd.light", false), "Subscribe")
+
+	cli.write(publishPacket, 1<<1, encodePublish(&publish{topic: "cmd/light", qos: 1, packetID: 7, payload: []byte("on")}))
+	p = cli.read(pubackPacket)
+	assert.Equal(t, []byte{0, 7}, p.body, "PUBACK")
+	select {
+	case ev := <-psc.Events():
+		assert.Equal(t, message.DefaultBinaryContentType, ev.ContentType, "content type")
+		var b []byte
+		require.NoError(t, message.Binary.Decode(ev.Args, &b), "decode args")
+		assert.Equal(t, "on", string(b), "args")
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+
+	// unsubscribe and ping
+	e = &encoder{}
+	e.uint16(2)
+	e.string("sensors/+/temp")
+	cli.write(unsubscribePacket, 0x02, e.b)
+	p = cli.read(unsubackPacket)
+	assert.Equal(t, []byte{0, 2}, p.body, "UNSUBACK")
+	require.NoError(t, brk.Publish("sensors.kitchen.temp", &message.PubPayload{MsgUUID: message.NewID(), Args: json.RawMessage(`22`)}), "Publish")
+	cli.write(pingreqPacket, 0, nil)
+	cli.read(pingrespPacket)
+
+	cli.write(disconnectPacket, 0, nil)
+	cli.nc.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = readPacket(cli.r, 0)
+	assert.Error(t, err, "connection closed")
+
+	assert.Equal(t, "1", vars.Get("TotalMQTTConns").String(), "TotalMQTTConns")
+	assert.Equal(t, "1", vars.Get("RejectedMQTTConns").String(), "RejectedMQTTConns")
+	assert.Equal(t, "1", vars.Get("MQTTPublishes").String(), "MQTTPublishes")
+	assert.Equal(t, "1", vars.Get("MQTTEvents").String(), "MQTTEvents")
+	assert.Equal(t, "1", vars.Get("DeniedMQTTRequests").String(), "DeniedMQTTRequests")
+	assert.Equal(t, "1", vars.Get("DeniedMQTTEvents").String(), "DeniedMQTTEvents")
+}
@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+// The levels of the MQTT topics are separated by "/", the segments of
+// the juggler channels by "." (see broker.MQTTPatterns).
+const (
+	topicSeparator   = "/"
+	channelSeparator = "."
+)
+
+// ChannelOf returns the juggler channel of the MQTT topic, with the
+// levels separated by "." instead of "/". If filter is true, topic is a
+// topic filter that may have the "+" and "#" wildcards, and pattern is
+// true if it has any: the channel is then a pattern in the syntax of
+// broker.MQTTPatterns. A level of the topic that contains a "." becomes
+// multiple segments of the channel.
+func ChannelOf(topic string, filter bool) (channel string, pattern bool, err error) {
+	if topic == "" {
+		return "", false, errors.New("mqtt: empty topic")
+	}
+	levels := strings.Split(topic, topicSeparator)
+	for i, l := range levels {
+		switch {
+		case l == "+" || l == "#":
+			if !filter {
+				return "", false, errors.New("mqtt: wildcard in topic name")
+			}
+			if l == "#" && i != len(levels)-1 {
+				return "", false, errors.New(`mqtt: "#" is not the last level`)
+			}
+			pattern = true
+		case strings.ContainsAny(l, "+#"):
+			return "", false, errors.New("mqtt: wildcard in a topic level")
+		}
+	}
+	return strings.Join(levels, channelSeparator), pattern, nil
+}
+
+// TopicOf returns the MQTT topic of the juggler channel, with the
+// segments separated by "/" instead of ".".
+func TopicOf(channel string) string {
+	return strings.Replace(channel, channelSeparator, topicSeparator, -1)
+}
@@ -0,0 +1,153 @@
+package juggler
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// NameValidator validates the URIs of the call requests and the channels
+// of the pub-sub requests, so that invalid names are rejected by the
+// server before reaching the Handler and the brokers (see
+// Server.NameValidator).
+type NameValidator interface {
+	// ValidURI returns an error if uri is not a valid URI for a CALL
+	// request.
+	ValidURI(uri string) error
+
+	// ValidChannel returns an error if channel is not a valid channel
+	// for a PUB, SUB or UNSB request. It is treated as a pattern if
+	// pattern is true.
+	ValidChannel(channel string, pattern bool) error
+}
+
+// NameError is the error of an invalid URI or channel name, as returned
+// by NamePolicy.
+type NameError struct {
+	Name   string
+	Reason string
+}
+
+// Error returns the error message for the NameError.
+func (e *NameError) Error() string {
+	return fmt.Sprintf("juggler: invalid name %q: %s", e.Name, e.Reason)
+}
+
+// DefaultNameChars is the set of characters allowed in the names, in
+// addition to the letters and digits, when NamePolicy.Chars is empty.
+// The ":" is allowed for the system channels (see
+// message.SystemChannelPrefix).
+const DefaultNameChars = "-_:"
+
+// patternChars are the characters allowed in the segments of the channel
+// patterns, those of the glob-style and MQTT-style patterns (see
+// broker.PatternSyntax).
+const patternChars = "*?[]^\\+#"
+
+// NamePolicy is a NameValidator that checks the names against a set of
+// rules. The names are made of non-empty segments separated by
+// Separator, with letters, digits and the characters of Chars, and the
+// channel patterns may also use the wildcards of the pattern syntaxes. The
+// zero value only checks the segments and the characters, it is safe
+// for concurrent use as long as it is not modified.
+type NamePolicy struct {
+	// Separator separates the segments of the names. The default is
+	// the "." of the URIs (see message.MatchURI).
+	Separator string
+
+	// Chars is the set of characters allowed in the names in addition
+	// to the Unicode letters and digits. The default is
+	// DefaultNameChars.
+	Chars string
+
+	// MaxDepth is the maximum number of segments of a name. The default
+	// of 0 means no limit.
+	MaxDepth int
+
+	// MaxLength is the maximum length of a name, in bytes. The default
+	// of 0 means no limit.
+	MaxLength int
+
+	// ReservedPrefixes are the prefixes of the names that cannot be
+	// used, e.g. to keep a namespace for the server-side publishers.
+	// They apply to the URIs of the server too, such as
+	// message.TimeSyncURI.
+	ReservedPrefixes []string
+}
+
+// ValidURI returns a *NameError if uri does not follow the policy.
+func (p *NamePolicy) ValidURI(uri string) error {
+	return p.valid(uri, "")
+}
+
+// ValidChannel returns a *NameError if channel does not follow the
+// policy.
+func (p *NamePolicy) ValidChannel(channel string, pattern bool) error {
+	if pattern {
+		return p.valid(channel, patternChars)
+	}
+	return p.valid(channel, "")
+}
+
+func (p *NamePolicy) valid(name, extra string) error {
+	if name == "" {
+		return &NameError{Name: name, Reason: "empty name"}
+	}
+	if p.MaxLength > 0 && len(name) > p.MaxLength {
+		return &NameError{Name: name, Reason: fmt.Sprintf("longer than %d bytes", p.MaxLength)}
+	}
+	for _, pfx := range p.ReservedPrefixes {
+		if strings.HasPrefix(name, pfx) {
+			return &NameError{Name: name, Reason: fmt.Sprintf("reserved prefix %q", pfx)}
+		}
+	}
+
+	sep := p.Separator
+	if sep == "" {
+		sep = "."
+	}
+	chars := p.Chars
+	if chars == "" {
+		chars = DefaultNameChars
+	}
+
+	segs := strings.Split(name, sep)
+	if p.MaxDepth > 0 && len(segs) > p.MaxDepth {
+		return &NameError{Name: name, Reason: fmt.Sprintf("more than %d segments", p.MaxDepth)}
+	}
+	for _, seg := range segs {
+		if seg == "" {
+			return &NameError{Name: name, Reason: "empty segment"}
+		}
+		for _, r := range seg {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(chars, r) && !strings.ContainsRune(extra, r) {
+				return &NameError{Name: name, Reason: fmt.Sprintf("invalid character %q", r)}
+			}
+		}
+	}
+	return nil
+}
+
+// validateNames returns the error of the first invalid URI or channel
+// of the request m, if any.
+func validateNames(v NameValidator, m message.Msg) error {
+	switch m := m.(type) {
+	case *message.Call:
+		return v.ValidURI(m.Payload.URI)
+	case *message.Pub:
+		return v.ValidChannel(m.Payload.Channel, false)
+	case *message.Sub:
+		return v.ValidChannel(m.Payload.Channel, m.Payload.Pattern)
+	case *message.Unsb:
+		return v.ValidChannel(m.Payload.Channel, m.Payload.Pattern)
+	case *message.Batch:
+		for _, bm := range m.Payload.Msgs {
+			if err := validateNames(v, bm); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
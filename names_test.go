@@ -0,0 +1,115 @@
+package juggler_test
+
+import (
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/jugglertest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestNamePolicy(t *testing.T) {
+	cases := []struct {
+		p       juggler.NamePolicy
+		name    string
+		pattern bool
+		valid   bool
+	}{
+		{juggler.NamePolicy{}, "a.b-c_d", false, true},
+		{juggler.NamePolicy{}, "événements.crées", false, true},
+		{juggler.NamePolicy{}, "juggler:conns", false, true},
+		{juggler.NamePolicy{}, "", false, false},
+		{juggler.NamePolicy{}, "a..b", false, false},
+		{juggler.NamePolicy{}, "a.", false, false},
+		{juggler.NamePolicy{}, "a b", false, false},
+		{juggler.NamePolicy{}, "a/b", false, false},
+		{juggler.NamePolicy{}, "a.*", false, false},
+		{juggler.NamePolicy{}, "a.*", true, true},
+		{juggler.NamePolicy{}, "a.[bc]?", true, true},
+		{juggler.NamePolicy{}, "a.\xff", false, false},
+		{juggler.NamePolicy{Separator: "/"}, "a/b", false, true},
+		{juggler.NamePolicy{Separator: "/"}, "a//b", false, false},
+		{juggler.NamePolicy{Chars: "+"}, "a+b", false, true},
+		{juggler.NamePolicy{Chars: "+"}, "a-b", false, false},
+		{juggler.NamePolicy{MaxDepth: 2}, "a.b", false, true},
+		{juggler.NamePolicy{MaxDepth: 2}, "a.b.c", false, false},
+		{juggler.NamePolicy{MaxLength: 3}, "abc", false, true},
+		{juggler.NamePolicy{MaxLength: 3}, "abcd", false, false},
+		{juggler.NamePolicy{ReservedPrefixes: []string{"internal."}}, "internal.jobs", false, false},
+		{juggler.NamePolicy{ReservedPrefixes: []string{"internal."}}, "internals", false, true},
+	}
+	for i, c := range cases {
+		err := c.p.ValidChannel(c.name, c.pattern)
+		if c.valid {
+			assert.NoError(t, err, "%d: %q", i, c.name)
+		} else if assert.Error(t, err, "%d: %q", i, c.name) {
+			assert.IsType(t, &juggler.NameError{}, err, "%d: error type", i)
+		}
+	}
+
+	p := &juggler.NamePolicy{}
+	assert.NoError(t, p.ValidURI("billing.charge"), "valid URI")
+	assert.Error(t, p.ValidURI("billing.*"), "URI pattern")
+}
+
+func TestNameValidator(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	brk := &jugglertest.Broker{}
+	server := &juggler.Server{
+		CallerBroker:  brk,
+		PubSubBroker:  brk,
+		NameValidator: &juggler.NamePolicy{MaxDepth: 2},
+		Vars:          vars,
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, nil, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	nack := func(label string) {
+		select {
+		case m := <-msgs:
+			if nack, ok := m.(*message.Nack); assert.True(t, ok, "%s: got %s", label, m.Type()) {
+				assert.Equal(t, message.CodeBadRequest, nack.Payload.Code, "%s: code", label)
+				assert.Contains(t, nack.Payload.Message, "invalid name", "%s: message", label)
+			}
+		case <-time.After(time.Second):
+			assert.Fail(t, "no response", label)
+		}
+	}
+
+	_, err = cli.Sub("a..b", false)
+	require.NoError(t, err, "Sub")
+	nack("Sub")
+	_, err = cli.Pub("a b", 1)
+	require.NoError(t, err, "Pub")
+	nack("Pub")
+	_, err = cli.Call("a.b.c", nil, time.Second)
+	require.NoError(t, err, "Call")
+	nack("Call")
+	_, err = cli.PubBatch("a.b.c", []interface{}{1, 2})
+	require.NoError(t, err, "PubBatch")
+	nack("PubBatch")
+
+	_, err = cli.Sub("a.*", true)
+	require.NoError(t, err, "Sub pattern")
+	waitMsg(t, msgs, message.AckMsg, "Sub pattern")
+	assert.Equal(t, "4", vars.Get("InvalidNameMsgs").String(), "metric")
+}
@@ -0,0 +1,203 @@
+package juggler_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nopCallerBroker accepts the call requests and never returns results.
+type nopCallerBroker struct {
+	fakeCallerBroker
+}
+
+func (nopCallerBroker) Call(cp *message.CallPayload, timeout time.Duration) error { return nil }
+func (nopCallerBroker) CallAt(cp *message.CallPayload, at time.Time) error        { return nil }
+func (nopCallerBroker) CallAfter(cp *message.CallPayload, delay time.Duration) error {
+	return nil
+}
+
+// protocolFrame is a websocket frame sent to the server.
+type protocolFrame struct {
+	typ  int
+	data string
+}
+
+func textFrames(data ...string) []protocolFrame {
+	frames := make([]protocolFrame, len(data))
+	for i, d := range data {
+		frames[i] = protocolFrame{websocket.TextMessage, d}
+	}
+	return frames
+}
+
+// protocolCases are the malformed or unusual requests that the server
+// must reject with a NACK, close the connection on, or process without
+// failing.
+var protocolCases = []struct {
+	name   string
+	frames []protocolFrame
+}{
+	{"binary frame", []protocolFrame{{websocket.BinaryMessage, `{"meta":{"type":3}}`}}},
+	{"empty frame", textFrames("")},
+	{"not JSON", textFrames("not json")},
+	{"truncated JSON", textFrames(`{"meta":{"type":1,"uuid":"`)},
+	{"truncated payload", textFrames(`{"meta":{"type":1,"uuid":"` + uuid.NewRandom().String() + `"},"payload":{"uri":"a",`)},
+	{"JSON null", textFrames("null")},
+	{"JSON array", textFrames("[1,2]")},
+	{"JSON number", textFrames("1")},
+	{"empty object", textFrames("{}")},
+	{"null meta", textFrames(`{"meta":null,"payload":null}`)},
+	{"string type", textFrames(`{"meta":{"type":"CALL"}}`)},
+	{"float type", textFrames(`{"meta":{"type":1.5}}`)},
+	{"huge type", textFrames(`{"meta":{"type":99999999999999999999}}`)},
+	{"unknown type", textFrames(`{"meta":{"type":99},"payload":{}}`)},
+	{"custom type", textFrames(`{"meta":{"type":256},"payload":{}}`)},
+	{"response type", textFrames(`{"meta":{"type":7},"payload":{"for":"` + uuid.NewRandom().String() + `","code":500}}`)},
+	{"numeric UUID", textFrames(`{"meta":{"type":3,"uuid":12},"payload":{"channel":"a"}}`)},
+	{"oversized UUID", textFrames(`{"meta":{"type":3,"uuid":"` + strings.Repeat("a", 4096) + `"},"payload":{"channel":"a"}}`)},
+	{"truncated UUID", textFrames(`{"meta":{"type":3,"uuid":"1234"},"payload":{"channel":"a"}}`)},
+	{"empty UUID", textFrames(`{"meta":{"type":3,"uuid":""},"payload":{"channel":"a"}}`)},
+	{"missing UUID", textFrames(`{"meta":{"type":1},"payload":{"uri":"a","args":null}}`)},
+	{"missing payload", textFrames(`{"meta":{"type":1,"uuid":"` + uuid.NewRandom().String() + `"}}`)},
+	{"string payload", textFrames(`{"meta":{"type":1,"uuid":"` + uuid.NewRandom().String() + `"},"payload":"x"}`)},
+	{"numeric URI", protocolMsg(`{"type":1}`, `{"uri":1}`)},
+	{"empty URI", protocolMsg(`{"type":1}`, `{"uri":"","args":null}`)},
+	{"negative timeout", protocolMsg(`{"type":1}`, `{"uri":"a","timeout":-1,"args":null}`)},
+	{"huge timeout", protocolMsg(`{"type":1}`, `{"uri":"a","timeout":9223372036854775807,"args":null}`)},
+	{"unknown routing", protocolMsg(`{"type":1}`, `{"uri":"a","routing":99,"routing_key":"k","args":null}`)},
+	{"out of range priority", protocolMsg(`{"type":1}`, `{"uri":"a","priority":1000,"args":null}`)},
+	{"negative retries", protocolMsg(`{"type":1}`, `{"uri":"a","max_attempts":-5,"backoff":-1,"args":null}`)},
+	{"huge retries", protocolMsg(`{"type":1}`, `{"uri":"a","max_attempts":1073741824,"backoff":1000000000,"args":null}`)},
+	{"empty version", protocolMsg(`{"type":1}`, `{"uri":"a@","version":"@","args":null}`)},
+	{"invalid signature", protocolMsg(`{"type":1,"sig":{"value":"!"}}`, `{"uri":"a","args":null}`)},
+	{"deep arguments", protocolMsg(`{"type":1}`, `{"uri":"a","args":`+strings.Repeat("[", 5000)+strings.Repeat("]", 5000)+`}`)},
+	{"empty channel", protocolMsg(`{"type":3}`, `{"channel":""}`)},
+	{"empty pattern", protocolMsg(`{"type":3}`, `{"channel":"","pattern":true}`)},
+	{"acked pattern", protocolMsg(`{"type":3}`, `{"channel":"a*","pattern":true,"acked":true}`)},
+	{"unsubscribed channel", protocolMsg(`{"type":4}`, `{"channel":"nope"}`)},
+	{"system channel", protocolMsg(`{"type":3}`, `{"channel":"juggler:conns"}`)},
+	{"publish without args", protocolMsg(`{"type":2}`, `{"channel":"a"}`)},
+	{"publish on system channel", protocolMsg(`{"type":2}`, `{"channel":"juggler:calls","args":1}`)},
+	{"negative TTL", protocolMsg(`{"type":2}`, `{"channel":"a","ttl":-1,"args":1}`)},
+	{"empty batch", protocolMsg(`{"type":12}`, `{"msgs":[]}`)},
+	{"null batch", protocolMsg(`{"type":12}`, `{"msgs":null}`)},
+	{"nested batch", protocolMsg(`{"type":12}`, `{"msgs":[{"meta":{"type":12,"uuid":"`+uuid.NewRandom().String()+`"},"payload":{"msgs":[]}}]}`)},
+	{"batched SUB", protocolMsg(`{"type":12}`, `{"msgs":[{"meta":{"type":3,"uuid":"`+uuid.NewRandom().String()+`"},"payload":{"channel":"a"}}]}`)},
+	{"invalid batched message", protocolMsg(`{"type":12}`, `{"msgs":[1]}`)},
+	{"batch without UUIDs", protocolMsg(`{"type":12}`, `{"msgs":[{"meta":{"type":1},"payload":{"uri":"a"}},{"meta":{"type":2},"payload":{"channel":"a"}}]}`)},
+	{"invalid time sync", protocolMsg(`{"type":1}`, `{"uri":"`+message.TimeSyncURI+`","args":"x"}`)},
+	{"invalid history query", protocolMsg(`{"type":1}`, `{"uri":"`+message.HistoryURI+`","args":{"channel":"a","from":"x"}}`)},
+	{"negative history limit", protocolMsg(`{"type":1}`, `{"uri":"`+message.HistoryURI+`","args":{"channel":"a","limit":-1}}`)},
+	{"invalid credit grant", protocolMsg(`{"type":1}`, `{"uri":"`+message.CreditURI+`","args":{"channel":"a","credits":-10}}`)},
+	{"invalid delivery tags", protocolMsg(`{"type":1}`, `{"uri":"`+message.EvntAckURI+`","args":{"tags":["",":","0:a","x:a","18446744073709551616:a"]}}`)},
+	{"null delivery tags", protocolMsg(`{"type":1}`, `{"uri":"`+message.EvntAckURI+`","args":null}`)},
+	{"oversized frame", textFrames(`{"meta":{"type":2},"payload":{"channel":"a","args":"` + strings.Repeat("x", protocolReadLimit) + `"}}`)},
+	{"trailing data", textFrames(`{"meta":{"type":3,"uuid":"` + uuid.NewRandom().String() + `"},"payload":{"channel":"a"}}garbage`)},
+	{"duplicate UUID", func() []protocolFrame {
+		id := uuid.NewRandom().String()
+		m := `{"meta":{"type":3,"uuid":"` + id + `"},"payload":{"channel":"a"}}`
+		return textFrames(m, m)
+	}()},
+}
+
+const protocolReadLimit = 1 << 16
+
+// protocolMsg returns the frame of the message with the meta and payload,
+// with a random UUID added to the meta.
+func protocolMsg(meta, payload string) []protocolFrame {
+	meta = strings.Replace(meta, "{", `{"uuid":"`+uuid.NewRandom().String()+`",`, 1)
+	return textFrames(`{"meta":` + meta + `,"payload":` + payload + `}`)
+}
+
+func TestProtocolConformance(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for _, strict := range []bool{false, true} {
+		server := &juggler.Server{
+			CallerBroker: nopCallerBroker{},
+			PubSubBroker: &seqPubSubBroker{},
+			ReadLimit:    protocolReadLimit,
+			TimeSync:     true,
+			History:      true,
+			FlowControl:  true,
+			EventAcks:    &juggler.EventAcks{},
+			Strict:       strict,
+			ConnState: func(c *juggler.Conn, cs juggler.ConnState) {
+				if cs == juggler.Accepting {
+					c.Identity = "u1"
+				}
+			},
+		}
+		upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+		srv := httptest.NewServer(juggler.Upgrade(upg, server))
+		srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+
+		for _, c := range protocolCases {
+			testProtocolCase(t, srv.URL, fmt.Sprintf("%s (strict: %t)", c.name, strict), c.frames)
+		}
+		srv.Close()
+	}
+
+	// all the goroutines of the connections must be done
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		var buf bytes.Buffer
+		pprof.Lookup("goroutine").WriteTo(&buf, 1)
+		assert.Fail(t, "leaked goroutines", "%d goroutines, %d before:\n%s", n, before, buf.String())
+	}
+}
+
+// testProtocolCase sends the frames on a new connection, followed by a
+// SUB request, the probe. The server must either close the connection,
+// or answer the probe, after having answered the frames or not.
+func testProtocolCase(t *testing.T, url, name string, frames []protocolFrame) {
+	conn, _, err := (&websocket.Dialer{Subprotocols: juggler.Subprotocols}).Dial(url, nil)
+	require.NoError(t, err, "%s: Dial", name)
+	defer conn.Close()
+
+	for _, f := range frames {
+		if err := conn.WriteMessage(f.typ, []byte(f.data)); err != nil {
+			return // closed by the server
+		}
+	}
+	probe := message.NewSub("probe", false)
+	if err := conn.WriteJSON(probe); err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, r, err := conn.NextReader()
+		if err != nil {
+			if ne, ok := err.(interface {
+				Timeout() bool
+			}); ok && ne.Timeout() {
+				assert.Fail(t, "no response and connection not closed", name)
+			}
+			return // closed by the server
+		}
+		m, err := message.UnmarshalResponse(r)
+		if !assert.NoError(t, err, "%s: invalid response", name) {
+			return
+		}
+		if ack, ok := m.(*message.Ack); ok && uuid.Equal(ack.Payload.For, probe.UUID()) {
+			return // still served
+		}
+	}
+}
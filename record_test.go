@@ -0,0 +1,114 @@
+package juggler_test
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/juggler/session"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) frames(t *testing.T) []*session.Frame {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	frames, err := session.ReadFrames(bytes.NewReader(b.buf.Bytes()))
+	require.NoError(t, err, "ReadFrames")
+	return frames
+}
+
+func TestRecordSessions(t *testing.T) {
+	var srvBuf, cliBuf syncBuffer
+	hdr := http.Header{"Juggler-Allowed-Messages": {"call"}}
+	server := &juggler.Server{
+		CallerBroker: &nopCallerBroker{},
+		Recorder:     session.NewRecorder(&srvBuf),
+		Vars:         new(expvar.Map).Init(),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, hdr,
+		client.SetHandler(h), client.SetRecorder(session.NewRecorder(&cliBuf)))
+	require.NoError(t, err, "Dial")
+
+	_, err = cli.Call("a", 1, time.Minute)
+	require.NoError(t, err, "Call")
+	select {
+	case m := <-msgs:
+		require.Equal(t, message.AckMsg, m.Type(), "response")
+	case <-time.After(time.Second):
+		t.Fatal("no response")
+	}
+	cli.Close()
+
+	check := func(name string, frames []*session.Frame) {
+		require.Len(t, frames, 2, "%s: frames", name)
+		assert.Equal(t, session.Client, frames[0].From, "%s: from", name)
+		assert.Contains(t, frames[0].Text, `"type":1`, "%s: call", name)
+		assert.Equal(t, session.Server, frames[1].From, "%s: from", name)
+		assert.Contains(t, frames[1].Text, `"type":8`, "%s: ack", name)
+		assert.Equal(t, frames[0].Session, frames[1].Session, "%s: session", name)
+	}
+	srvFrames := srvBuf.frames(t)
+	check("server", srvFrames)
+	check("client", cliBuf.frames(t))
+
+	// replaying the recording of the server gets the same response
+	var (
+		mu       sync.Mutex
+		received []*session.Frame
+	)
+	rp := &session.Replayer{
+		Dialer: &websocket.Dialer{Subprotocols: juggler.Subprotocols},
+		URL:    srv.URL,
+		Header: hdr,
+		Speed:  -1,
+		Linger: 100 * time.Millisecond,
+		Received: func(f *session.Frame) {
+			mu.Lock()
+			received = append(received, f)
+			mu.Unlock()
+		},
+	}
+	require.NoError(t, rp.Replay(srvFrames), "Replay")
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 1, "replayed responses")
+	call, err := message.UnmarshalRequest(strings.NewReader(srvFrames[0].Text))
+	require.NoError(t, err, "UnmarshalRequest")
+	m, err := message.UnmarshalResponse(strings.NewReader(received[0].Text))
+	require.NoError(t, err, "UnmarshalResponse")
+	if assert.IsType(t, &message.Ack{}, m, "replayed response") {
+		assert.Equal(t, call.UUID(), m.(*message.Ack).Payload.For, "replayed ack for")
+	}
+}
@@ -0,0 +1,56 @@
+package juggler
+
+import (
+	"errors"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// ErrNoCallee is the error of the NACK sent for a CALL request to a URI
+// without any live callee, if Server.CheckCallees is set.
+var ErrNoCallee = errors.New("juggler: no callee available")
+
+// hasCallee returns false if the server checks for live callees and no
+// callee that accepts the routing mode rm is registered for uri or, if
+// none is registered for uri and CallerBroker implements
+// broker.PatternBroker, for the most specific live pattern that matches
+// uri. If the check fails, the call is allowed.
+func (srv *Server) hasCallee(uri string, rm message.RoutingMode, addFn func(string, int64)) bool {
+	if !srv.CheckCallees {
+		return true
+	}
+	rb, ok := srv.CallerBroker.(broker.RegistryBroker)
+	if !ok {
+		return true
+	}
+
+	cis, err := rb.Callees(uri)
+	if err != nil {
+		addFn("FailedCalleeChecks", 1)
+		return true
+	}
+	if len(cis) == 0 {
+		// the broker routes the call to the pattern only if no callee
+		// listens on the URI itself
+		if pb, ok := srv.CallerBroker.(broker.PatternBroker); ok {
+			patterns, err := pb.CalleePatterns()
+			if err != nil {
+				addFn("FailedCalleeChecks", 1)
+				return true
+			}
+			if pattern := message.BestURIPattern(patterns, uri); pattern != "" {
+				if cis, err = rb.Callees(pattern); err != nil {
+					addFn("FailedCalleeChecks", 1)
+					return true
+				}
+			}
+		}
+	}
+	for _, ci := range cis {
+		if ci.Accepts(rm) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package juggler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRegistryBroker struct {
+	broker.CallerBroker
+	callees map[string][]*message.CalleeInfo
+	err     error
+}
+
+func (f *fakeRegistryBroker) Heartbeat(ci *message.CalleeInfo, ttl time.Duration) error { return nil }
+func (f *fakeRegistryBroker) Unregister(ci *message.CalleeInfo) error                   { return nil }
+func (f *fakeRegistryBroker) Callees(uri string) ([]*message.CalleeInfo, error) {
+	return f.callees[uri], f.err
+}
+
+type fakePatternBroker struct {
+	*fakeRegistryBroker
+	patterns []string
+}
+
+func (f *fakePatternBroker) CalleePatterns() ([]string, error) { return f.patterns, f.err }
+
+func TestHasCallee(t *testing.T) {
+	rb := &fakeRegistryBroker{callees: map[string][]*message.CalleeInfo{
+		"a": {{Hostname: "h"}},
+		"s": {{Hostname: "h", Routing: []message.RoutingMode{message.Sticky}}},
+	}}
+	srv := &Server{CallerBroker: rb}
+
+	var failed int64
+	addFn := func(k string, n int64) {
+		if k == "FailedCalleeChecks" {
+			failed += n
+		}
+	}
+	assert.True(t, srv.hasCallee("b", message.RoundRobin, addFn), "check disabled")
+
+	srv.CheckCallees = true
+	assert.True(t, srv.hasCallee("a", message.RoundRobin, addFn), "live callee")
+	assert.False(t, srv.hasCallee("b", message.RoundRobin, addFn), "no live callee")
+	assert.True(t, srv.hasCallee("a", message.Broadcast, addFn), "all routing modes")
+	assert.True(t, srv.hasCallee("s", message.Sticky, addFn), "accepted routing mode")
+	assert.False(t, srv.hasCallee("s", message.RoundRobin, addFn), "routing mode not accepted")
+
+	rb.err = errors.New("boom")
+	assert.True(t, srv.hasCallee("b", message.RoundRobin, addFn), "failed check")
+	assert.Equal(t, int64(1), failed, "failed checks")
+
+	srv.CallerBroker = rb.CallerBroker
+	assert.True(t, srv.hasCallee("b", message.RoundRobin, addFn), "broker without registry")
+}
+
+func TestHasCalleePattern(t *testing.T) {
+	rb := &fakeRegistryBroker{callees: map[string][]*message.CalleeInfo{
+		"a.*": {{Hostname: "h", Routing: []message.RoutingMode{message.Sticky}}},
+		"a.>": {{Hostname: "h"}},
+		"a.b": {{Hostname: "h"}},
+	}}
+	pb := &fakePatternBroker{fakeRegistryBroker: rb, patterns: []string{"a.*", "a.>", "c.*"}}
+	srv := &Server{CallerBroker: pb, CheckCallees: true}
+
+	var failed int64
+	addFn := func(k string, n int64) {
+		if k == "FailedCalleeChecks" {
+			failed += n
+		}
+	}
+	assert.True(t, srv.hasCallee("a.b", message.RoundRobin, addFn), "callee on the URI")
+	assert.True(t, srv.hasCallee("a.c", message.Sticky, addFn), "callee on the best pattern")
+	assert.False(t, srv.hasCallee("a.c", message.RoundRobin, addFn), "routing mode not accepted by the best pattern")
+	assert.True(t, srv.hasCallee("a.c.d", message.RoundRobin, addFn), "callee on the only matching pattern")
+	assert.False(t, srv.hasCallee("c.d", message.RoundRobin, addFn), "no live callee on the pattern")
+	assert.False(t, srv.hasCallee("d", message.RoundRobin, addFn), "no matching pattern")
+	assert.Equal(t, int64(0), failed, "no failed checks")
+}
@@ -0,0 +1,82 @@
+package juggler
+
+import (
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// rewrittenCall is a call sent to the broker with a rewritten URI,
+// whose result must be sent with the URI of the request.
+type rewrittenCall struct {
+	uri     string    // URI of the request
+	expires time.Time // when the call can no longer return a result
+}
+
+// rewriteCall returns the call m with the URI returned by the server's
+// RewriteURI hook, or false if the hook failed, in which case the NACK
+// is sent.
+func rewriteCall(c *Conn, m *message.Call, addFn func(string, int64)) (*message.Call, bool) {
+	uri, err := c.srv.RewriteURI(context.Background(), c, m.Payload.URI)
+	if err != nil {
+		addFn("FailedURIRewrites", 1)
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return nil, false
+	}
+	if uri == m.Payload.URI {
+		return m, true
+	}
+
+	addFn("RewrittenCalls", 1)
+	rm := *m
+	rm.Payload.URI = uri
+	return &rm, true
+}
+
+// addRewrite registers the call m sent with a rewritten URI, so that its
+// result is sent with the URI of the request.
+func (c *Conn) addRewrite(m *message.Call, uri string) {
+	now := time.Now()
+	rc := &rewrittenCall{uri: uri, expires: now.Add(CallWait(m))}
+
+	c.rewritemu.Lock()
+	defer c.rewritemu.Unlock()
+
+	if c.rewrites == nil {
+		c.rewrites = make(map[string]*rewrittenCall)
+	}
+	// drop the calls that expired without a result
+	for id, rc := range c.rewrites {
+		if now.After(rc.expires) {
+			delete(c.rewrites, id)
+		}
+	}
+	c.rewrites[m.UUID().String()] = rc
+}
+
+// removeRewrite removes the call from the rewritten calls and returns
+// the URI of its request, or an empty string if it was not rewritten.
+func (c *Conn) removeRewrite(id string) string {
+	c.rewritemu.Lock()
+	defer c.rewritemu.Unlock()
+
+	rc := c.rewrites[id]
+	if rc == nil {
+		return ""
+	}
+	delete(c.rewrites, id)
+	return rc.uri
+}
+
+// restoreURI returns the result with the URI of the request if its
+// call was rewritten, or res otherwise.
+func (c *Conn) restoreURI(res *message.ResPayload) *message.ResPayload {
+	uri := c.removeRewrite(res.MsgUUID.String())
+	if uri == "" {
+		return res
+	}
+	rp := *res
+	rp.URI = uri
+	return &rp
+}
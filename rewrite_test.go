@@ -0,0 +1,176 @@
+package juggler_test
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// echoURIBroker returns the URI of each call as its result.
+type echoURIBroker struct {
+	broker.CallerBroker
+	ch chan *message.ResPayload
+}
+
+func (b echoURIBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	args, _ := json.Marshal(cp.URI)
+	b.ch <- &message.ResPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: cp.URI, Args: args}
+	return nil
+}
+
+func (b echoURIBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return fakeResultsConn{b.ch}, nil
+}
+
+func TestRewriteURI(t *testing.T) {
+	juggler.SetLocalURIs(map[string]juggler.LocalHandler{
+		"local.v2": func(ctx context.Context, c *juggler.Conn, m *message.Call) (interface{}, error) {
+			return "local", nil
+		},
+	})
+	defer juggler.SetLocalURIs(nil)
+
+	vars := new(expvar.Map).Init()
+	server := &juggler.Server{
+		CallerBroker: echoURIBroker{ch: make(chan *message.ResPayload, 10)},
+		Vars:         vars,
+		RewriteURI: func(ctx context.Context, c *juggler.Conn, uri string) (string, error) {
+			switch uri {
+			case "deprecated":
+				return "", errors.New("deprecated URI")
+			case "local":
+				return "local.v2", nil
+			case "same":
+				return uri, nil
+			}
+			return "tenant." + uri, nil
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	results := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		switch m.(type) {
+		case *message.Res, *message.Nack:
+			results <- m
+		}
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	cases := []struct {
+		uri  string
+		args string // empty for a NACK
+	}{
+		{"a", `"tenant.a"`},
+		{"same", `"same"`},
+		{"local", `"local"`},
+		{"deprecated", ``},
+	}
+	for _, c := range cases {
+		_, err := cli.Call(c.uri, nil, time.Second)
+		require.NoError(t, err, "Call %s", c.uri)
+
+		select {
+		case m := <-results:
+			if c.args == "" {
+				assert.IsType(t, &message.Nack{}, m, "%s: NACK", c.uri)
+				continue
+			}
+			if res, ok := m.(*message.Res); assert.True(t, ok, "%s: RES", c.uri) {
+				assert.Equal(t, c.uri, res.Payload.URI, "%s: RES URI", c.uri)
+				assert.Equal(t, c.args, string(res.Payload.Args), "%s: RES args", c.uri)
+			}
+		case <-time.After(time.Second):
+			assert.Fail(t, "no response", c.uri)
+		}
+	}
+
+	assert.Equal(t, "2", vars.Get("RewrittenCalls").String(), "RewrittenCalls")
+	assert.Equal(t, "1", vars.Get("FailedURIRewrites").String(), "FailedURIRewrites")
+}
+
+// verifyBroker returns the result of the verification of the signature
+// of each call, and its signed URI.
+type verifyBroker struct {
+	broker.CallerBroker
+	v  message.Verifier
+	ch chan *message.ResPayload
+}
+
+func (b verifyBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	args, _ := json.Marshal([]interface{}{message.VerifyCall(b.v, cp) == nil, cp.SignedURI})
+	b.ch <- &message.ResPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: cp.URI, Args: args}
+	return nil
+}
+
+func (b verifyBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return fakeResultsConn{b.ch}, nil
+}
+
+func TestRewriteURISigned(t *testing.T) {
+	keys := &message.HMACKeys{Current: "k1", Keys: map[string][]byte{"k1": []byte("secret")}}
+	server := &juggler.Server{
+		CallerBroker: verifyBroker{v: keys, ch: make(chan *message.ResPayload, 10)},
+		RewriteURI: func(ctx context.Context, c *juggler.Conn, uri string) (string, error) {
+			if uri == "same" {
+				return uri, nil
+			}
+			return "tenant." + uri, nil
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	results := make(chan *message.Res, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		if res, ok := m.(*message.Res); ok {
+			results <- res
+		}
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h), client.SetSigner(keys))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	cases := []struct {
+		uri  string
+		args string
+	}{
+		{"a", `[true,"a"]`},
+		{"same", `[true,""]`},
+	}
+	for _, c := range cases {
+		_, err := cli.Call(c.uri, 1, time.Second)
+		require.NoError(t, err, "Call %s", c.uri)
+
+		select {
+		case res := <-results:
+			assert.Equal(t, c.args, string(res.Payload.Args), "%s: verification", c.uri)
+		case <-time.After(time.Second):
+			assert.Fail(t, "no response", c.uri)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package schema
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// common initialisms, in upper case in the generated names.
+var initialisms = map[string]bool{
+	"API":  true,
+	"HTTP": true,
+	"ID":   true,
+	"IP":   true,
+	"JSON": true,
+	"TTL":  true,
+	"URI":  true,
+	"URL":  true,
+	"UUID": true,
+}
+
+// GenerateGo generates the source of a Go file in package pkg with the
+// types of the arguments and the result of the schema document of a
+// URI, named name+"Args" and name+"Result", respectively. The objects
+// with properties are generated as structs, the fields of the optional
+// properties have the omitempty option, and the nested objects are
+// generated as their own types, named after their parent type and
+// their property. The objects without properties are generated as
+// map[string]interface{}, and the values that may be of more than one
+// type (or of any type) as interface{}.
+func GenerateGo(pkg, name string, us *URISchema) ([]byte, error) {
+	types, err := GenerateGoTypes(name, us)
+	if err != nil {
+		return nil, err
+	}
+	src := fmt.Sprintf("// Code generated by schema.GenerateGo; DO NOT EDIT.\n\npackage %s\n%s", pkg, types)
+	return format.Source([]byte(src))
+}
+
+// GenerateGoTypes generates the declarations of the types of
+// GenerateGo, without the package clause, so that they can be included
+// in other generated files. The source is not formatted.
+func GenerateGoTypes(name string, us *URISchema) ([]byte, error) {
+	g := &generator{names: make(map[string]bool)}
+	if us.Args != nil {
+		g.namedType(name+"Args", us.Args)
+	}
+	if us.Result != nil {
+		g.namedType(name+"Result", us.Result)
+	}
+	for len(g.pending) > 0 {
+		nt := g.pending[0]
+		g.pending = g.pending[1:]
+		g.namedType(nt.name, nt.schema)
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	return g.buf.Bytes(), nil
+}
+
+type namedSchema struct {
+	name   string
+	schema *Schema
+}
+
+type generator struct {
+	buf     bytes.Buffer
+	names   map[string]bool
+	pending []namedSchema
+	err     error
+}
+
+// namedType generates the declaration of the type name for s.
+func (g *generator) namedType(name string, s *Schema) {
+	if g.names[name] {
+		g.err = fmt.Errorf("duplicate type name %s", name)
+		return
+	}
+	g.names[name] = true
+
+	g.buf.WriteString("\n")
+	g.comment(name, s)
+	fmt.Fprintf(&g.buf, "type %s %s\n", name, g.typeOf(name, s, true))
+}
+
+// typeOf returns the Go type of s. The objects with properties are
+// returned as a struct if top is true, and as a new named type
+// otherwise.
+func (g *generator) typeOf(name string, s *Schema, top bool) string {
+	if len(s.Type) != 1 {
+		return "interface{}"
+	}
+	switch s.Type[0] {
+	case "boolean":
+		return "bool"
+	case "integer":
+		return "int64"
+	case "number":
+		return "float64"
+	case "string":
+		return "string"
+	case "array":
+		if s.Items == nil {
+			return "[]interface{}"
+		}
+		return "[]" + g.typeOf(name+"Item", s.Items, false)
+	case "object":
+		if len(s.Properties) == 0 {
+			return "map[string]interface{}"
+		}
+		if !top {
+			g.pending = append(g.pending, namedSchema{name, s})
+			return name
+		}
+		return g.structOf(name, s)
+	default:
+		return "interface{}"
+	}
+}
+
+// structOf returns the struct type for the properties of s, sorted by
+// name.
+func (g *generator) structOf(name string, s *Schema) string {
+	required := make(map[string]bool, len(s.Required))
+	for _, r := range s.Required {
+		required[r] = true
+	}
+	props := make([]string, 0, len(s.Properties))
+	for p := range s.Properties {
+		props = append(props, p)
+	}
+	sort.Strings(props)
+
+	var buf bytes.Buffer
+	buf.WriteString("struct {\n")
+	for _, p := range props {
+		ps := s.Properties[p]
+		field := goName(p)
+		if ps.Description != "" {
+			for _, l := range strings.Split(ps.Description, "\n") {
+				fmt.Fprintf(&buf, "// %s\n", l)
+			}
+		}
+		tag := p
+		if !required[p] {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(&buf, "%s %s `json:%q`\n", field, g.typeOf(name+field, ps, false), tag)
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+func (g *generator) comment(name string, s *Schema) {
+	fmt.Fprintf(&g.buf, "// %s is generated from its JSON Schema.\n", name)
+	text := s.Description
+	if text == "" {
+		text = s.Title
+	}
+	if text != "" {
+		g.buf.WriteString("//\n")
+		for _, l := range strings.Split(text, "\n") {
+			fmt.Fprintf(&g.buf, "// %s\n", l)
+		}
+	}
+}
+
+// goName returns the exported Go name for the property p, in camel
+// case with the common initialisms in upper case.
+func goName(p string) string {
+	words := strings.FieldsFunc(p, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var buf bytes.Buffer
+	for _, w := range words {
+		if up := strings.ToUpper(w); initialisms[up] {
+			buf.WriteString(up)
+			continue
+		}
+		rs := []rune(w)
+		rs[0] = unicode.ToUpper(rs[0])
+		buf.WriteString(string(rs))
+	}
+	if buf.Len() == 0 || unicode.IsDigit([]rune(buf.String())[0]) {
+		return "X" + buf.String()
+	}
+	return buf.String()
+}
@@ -0,0 +1,80 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateGo(t *testing.T) {
+	us, err := Parse([]byte(`{
+		"args": {
+			"type": "object",
+			"description": "The user to create.",
+			"properties": {
+				"user_id": {"type": "string", "description": "The ID of the user."},
+				"age": {"type": "integer"},
+				"score": {"type": "number"},
+				"admin": {"type": "boolean"},
+				"extra": {"type": "object"},
+				"any": {"type": ["string", "null"]},
+				"addresses": {"type": "array", "items": {
+					"type": "object",
+					"properties": {"zip-code": {"type": "string"}},
+					"required": ["zip-code"]
+				}}
+			},
+			"required": ["user_id"]
+		},
+		"result": {"type": "array", "items": {"type": "string"}}
+	}`))
+	require.NoError(t, err, "Parse")
+
+	b, err := GenerateGo("users", "CreateUser", us)
+	require.NoError(t, err, "GenerateGo")
+	want := "// Code generated by schema.GenerateGo; DO NOT EDIT.\n" +
+		`
+package users
+
+// CreateUserArgs is generated from its JSON Schema.
+//
+// The user to create.
+type CreateUserArgs struct {
+	Addresses []CreateUserArgsAddressesItem ` + "`json:\"addresses,omitempty\"`" + `
+	Admin     bool                          ` + "`json:\"admin,omitempty\"`" + `
+	Age       int64                         ` + "`json:\"age,omitempty\"`" + `
+	Any       interface{}                   ` + "`json:\"any,omitempty\"`" + `
+	Extra     map[string]interface{}        ` + "`json:\"extra,omitempty\"`" + `
+	Score     float64                       ` + "`json:\"score,omitempty\"`" + `
+	// The ID of the user.
+	UserID string ` + "`json:\"user_id\"`" + `
+}
+
+// CreateUserResult is generated from its JSON Schema.
+type CreateUserResult []string
+
+// CreateUserArgsAddressesItem is generated from its JSON Schema.
+type CreateUserArgsAddressesItem struct {
+	ZipCode string ` + "`json:\"zip-code\"`" + `
+}
+`
+	assert.Equal(t, want, string(b), "generated source")
+}
+
+func TestGoName(t *testing.T) {
+	cases := map[string]string{
+		"name":      "Name",
+		"user_id":   "UserID",
+		"callURI":   "CallURI",
+		"zip-code":  "ZipCode",
+		"2fa":       "X2fa",
+		"":          "X",
+		"http_url":  "HTTPURL",
+		"été":       "Été",
+		"ttl.value": "TTLValue",
+	}
+	for in, want := range cases {
+		assert.Equal(t, want, goName(in), in)
+	}
+}
@@ -0,0 +1,170 @@
+package schema
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/callee"
+	"github.com/PuerkitoBio/juggler/message"
+	"golang.org/x/net/context"
+)
+
+// DefaultCacheTTL is the default duration for which a Validator caches
+// the schema of a URI.
+const DefaultCacheTTL = 10 * time.Second
+
+// Register stores the schema document of uri in the broker, so that the
+// Validator handlers of the servers validate the calls to uri. For
+// versioned URIs, uri should be the message.VersionedURI of the version.
+func Register(b broker.SchemaBroker, uri string, us *URISchema) error {
+	doc, err := json.Marshal(us)
+	if err != nil {
+		return err
+	}
+	return b.RegisterSchema(uri, doc)
+}
+
+// Validator validates the arguments of the CALL requests against the
+// schema registered for their URI (and version) in the Broker, and
+// rejects the invalid ones with a NACK with message.CodeBadRequest,
+// whose details list the problems found. The calls to URIs without a
+// schema are not validated, and the calls are not rejected if the
+// schema cannot be loaded.
+type Validator struct {
+	// Broker is the broker that stores the schemas.
+	Broker broker.SchemaBroker
+
+	// CacheTTL is the duration for which the schema of a URI, or its
+	// absence, is cached. If 0, DefaultCacheTTL is used.
+	CacheTTL time.Duration
+
+	// Vars can be set to track the number of InvalidCalls, of
+	// FailedSchemaLookups and of InvalidSchemas that could not be
+	// parsed.
+	Vars *expvar.Map
+
+	mu    sync.Mutex
+	cache map[string]cachedSchema
+}
+
+type cachedSchema struct {
+	schema  *URISchema
+	expires time.Time
+}
+
+// Handler returns a juggler.Handler that validates the CALL requests
+// before calling h.
+func (v *Validator) Handler(h juggler.Handler) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+		if call, ok := msg.(*message.Call); ok && call.Payload.ContentType == "" {
+			us := v.schema(message.VersionedURI(call.Payload.URI, call.Payload.Version))
+			if us != nil {
+				if err := us.ValidateArgs(call.Payload.Args); err != nil {
+					v.add("InvalidCalls")
+					c.Send(message.NewNack(msg, message.CodeBadRequest, err))
+					return
+				}
+			}
+		}
+		h.Handle(ctx, c, msg)
+	})
+}
+
+// schema returns the schema of uri, or nil if it has none or it cannot
+// be loaded.
+func (v *Validator) schema(uri string) *URISchema {
+	now := time.Now()
+
+	v.mu.Lock()
+	cs, ok := v.cache[uri]
+	v.mu.Unlock()
+	if ok && now.Before(cs.expires) {
+		return cs.schema
+	}
+
+	doc, err := v.Broker.Schema(uri)
+	if err != nil {
+		// not cached, the lookup is attempted again on the next call
+		v.add("FailedSchemaLookups")
+		return nil
+	}
+
+	var us *URISchema
+	if doc != nil {
+		if us, err = Parse(doc); err != nil {
+			v.add("InvalidSchemas")
+			us = nil
+		}
+	}
+
+	ttl := v.CacheTTL
+	if ttl == 0 {
+		ttl = DefaultCacheTTL
+	}
+	v.mu.Lock()
+	if v.cache == nil {
+		v.cache = make(map[string]cachedSchema)
+	}
+	v.cache[uri] = cachedSchema{schema: us, expires: now.Add(ttl)}
+	v.mu.Unlock()
+	return us
+}
+
+func (v *Validator) add(key string) {
+	if v.Vars != nil {
+		v.Vars.Add(key, 1)
+	}
+}
+
+// Wrap returns a callee.Thunk that validates the arguments of the call
+// against us before calling fn, and validates the result returned by
+// fn. An invalid call or result returns an error result that lists
+// the problems found, in addition to the message of message.ErrResult.
+// The result is validated in its JSON encoding, so Wrap should only be
+// used for URIs that use the message.JSON codec. Only the arguments
+// without a content type are validated.
+func Wrap(us *URISchema, fn callee.Thunk) callee.Thunk {
+	return func(cp *message.CallPayload) (interface{}, error) {
+		if cp.ContentType == "" {
+			if err := us.ValidateArgs(cp.Args); err != nil {
+				return nil, callError{err.(*ValidationError)}
+			}
+		}
+
+		v, err := fn(cp)
+		if err != nil || us.Result == nil {
+			return v, err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := us.ValidateResult(b); err != nil {
+			return nil, callError{err.(*ValidationError)}
+		}
+		return json.RawMessage(b), nil
+	}
+}
+
+// callError is the error returned by the thunks of Wrap, encoded as a
+// message.ErrResult with the list of problems.
+type callError struct {
+	*ValidationError
+}
+
+// MarshalJSON implements json.Marshaler for callError.
+func (e callError) MarshalJSON() ([]byte, error) {
+	var v struct {
+		Error struct {
+			Message  string   `json:"message"`
+			Problems []string `json:"problems"`
+		} `json:"error"`
+	}
+	v.Error.Message = e.Error()
+	v.Error.Problems = e.Problems
+	return json.Marshal(v)
+}
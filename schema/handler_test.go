@@ -0,0 +1,166 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeSchemaBroker struct {
+	mu      sync.Mutex
+	docs    map[string]json.RawMessage
+	lookups int
+	err     error
+}
+
+func (f *fakeSchemaBroker) RegisterSchema(uri string, doc json.RawMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.docs == nil {
+		f.docs = make(map[string]json.RawMessage)
+	}
+	f.docs[uri] = doc
+	return nil
+}
+
+func (f *fakeSchemaBroker) Schema(uri string) (json.RawMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups++
+	return f.docs[uri], f.err
+}
+
+type fakeCallerBroker struct {
+	broker.CallerBroker
+}
+
+func (f fakeCallerBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return fakeResultsConn{make(chan *message.ResPayload)}, nil
+}
+
+type fakeResultsConn struct {
+	ch chan *message.ResPayload
+}
+
+func (f fakeResultsConn) Results() <-chan *message.ResPayload { return f.ch }
+func (f fakeResultsConn) ResultsErr() error                   { return nil }
+func (f fakeResultsConn) Close() error                        { close(f.ch); return nil }
+
+func TestValidator(t *testing.T) {
+	sb := &fakeSchemaBroker{}
+	us, err := Parse([]byte(userSchema))
+	require.NoError(t, err, "Parse")
+	require.NoError(t, Register(sb, "a", us), "Register")
+	require.NoError(t, sb.RegisterSchema("bad", json.RawMessage(`{"args": {"type": "x"}}`)), "RegisterSchema")
+
+	vars := new(expvar.Map).Init()
+	v := &Validator{Broker: sb, Vars: vars}
+	server := &juggler.Server{
+		CallerBroker: fakeCallerBroker{},
+		Handler: v.Handler(juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, msg message.Msg) {
+			if msg.Type().IsRead() {
+				c.Send(message.NewAck(msg))
+				return
+			}
+			juggler.ProcessMsg(c, msg)
+		})),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, msg message.Msg) {
+		msgs <- msg
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	expect := func(name string, uri string, args interface{}, typ message.Type) *message.Nack {
+		_, err := cli.Call(uri, args, time.Second)
+		require.NoError(t, err, name)
+		select {
+		case msg := <-msgs:
+			assert.Equal(t, typ, msg.Type(), name)
+			nack, _ := msg.(*message.Nack)
+			return nack
+		case <-time.After(time.Second):
+			assert.Fail(t, "no response", name)
+			return nil
+		}
+	}
+
+	expect("valid", "a", map[string]interface{}{"name": "joe"}, message.AckMsg)
+	nack := expect("invalid", "a", map[string]interface{}{"age": "x"}, message.NackMsg)
+	if assert.NotNil(t, nack, "NACK") {
+		assert.Equal(t, message.CodeBadRequest, nack.Payload.Code, "NACK code")
+		assert.JSONEq(t, `{"problems": ["args.name: missing required property", "args.age: expected integer, got string"]}`,
+			string(nack.Payload.Details), "NACK details")
+	}
+	expect("no schema", "b", "x", message.AckMsg)
+	expect("invalid schema", "bad", "x", message.AckMsg)
+	expect("cached invalid schema", "bad", "x", message.AckMsg)
+
+	assert.Equal(t, "1", vars.Get("InvalidCalls").String(), "InvalidCalls")
+	assert.Equal(t, "1", vars.Get("InvalidSchemas").String(), "InvalidSchemas")
+	sb.mu.Lock()
+	assert.Equal(t, 3, sb.lookups, "schema lookups are cached")
+	sb.err = errors.New("down")
+	sb.mu.Unlock()
+
+	// lookup failures are not cached and do not reject the calls
+	v.mu.Lock()
+	v.cache = nil
+	v.mu.Unlock()
+	expect("lookup failure", "a", 1, message.AckMsg)
+	expect("lookup failure again", "a", 1, message.AckMsg)
+	assert.Equal(t, "2", vars.Get("FailedSchemaLookups").String(), "FailedSchemaLookups")
+}
+
+func TestWrap(t *testing.T) {
+	us, err := Parse([]byte(userSchema))
+	require.NoError(t, err, "Parse")
+
+	var result interface{} = 42
+	fn := Wrap(us, func(cp *message.CallPayload) (interface{}, error) {
+		return result, nil
+	})
+
+	v, err := fn(&message.CallPayload{Args: json.RawMessage(`{"name": "joe"}`)})
+	require.NoError(t, err, "valid call")
+	assert.Equal(t, json.RawMessage(`42`), v, "result")
+
+	_, err = fn(&message.CallPayload{Args: json.RawMessage(`{}`)})
+	if assert.Error(t, err, "invalid args") {
+		b, err := json.Marshal(err)
+		require.NoError(t, err, "Marshal")
+		assert.JSONEq(t, `{"error": {"message": "schema validation failed: args.name: missing required property", "problems": ["args.name: missing required property"]}}`,
+			string(b), "error result")
+	}
+
+	_, err = fn(&message.CallPayload{Args: json.RawMessage(`AAEC`), ContentType: "application/octet-stream"})
+	assert.NoError(t, err, "binary args are not validated")
+
+	result = "x"
+	_, err = fn(&message.CallPayload{Args: json.RawMessage(`{"name": "joe"}`)})
+	assert.EqualError(t, err, "schema validation failed: result: expected number, got string", "invalid result")
+}
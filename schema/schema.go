@@ -0,0 +1,407 @@
+// Package schema implements the validation of the arguments and results
+// of call requests against JSON Schemas. Callees register the schemas of
+// their URIs in a broker.SchemaBroker with Register, and the Validator
+// handler rejects the CALL requests with invalid arguments before they
+// reach the broker, with a NACK that lists the problems found. Callees
+// can also validate their calls themselves with Wrap, and GenerateGo
+// generates the Go types that correspond to a schema.
+//
+// Schemas
+//
+// The schema of a URI is a document with the schema of the arguments of
+// the calls and the schema of their results:
+//
+//     {
+//       "args": {
+//         "type": "object",
+//         "properties": {"name": {"type": "string", "minLength": 1}},
+//         "required": ["name"]
+//       },
+//       "result": {"type": "string"}
+//     }
+//
+// Either part can be omitted, in which case it is not validated. Only a
+// subset of JSON Schema is supported, namely the type (a single type or
+// a list of types), enum, minimum, maximum, minLength, maxLength,
+// pattern, items, minItems, maxItems, properties, required and
+// additionalProperties (as a boolean) keywords. The title and
+// description keywords are used by GenerateGo to document the types.
+// Other keywords are ignored.
+//
+// Only JSON-encoded arguments and results are validated, those with a
+// content type (see message.ContentType) are not.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// the types supported in the type keyword.
+var validTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// Types is the value of the type keyword of a Schema. It is encoded as a
+// single string if it has one type, and as an array otherwise.
+type Types []string
+
+// MarshalJSON implements json.Marshaler for Types.
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// UnmarshalJSON implements json.Unmarshaler for Types.
+func (t *Types) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = Types{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = Types(ss)
+	return nil
+}
+
+// Schema is a JSON Schema, restricted to the keywords supported by the
+// package. It must be compiled with Compile before it is used to
+// validate values, which is done by Parse.
+type Schema struct {
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Type        Types         `json:"type,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+
+	// numbers
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+
+	// strings
+	MinLength *int   `json:"minLength,omitempty"`
+	MaxLength *int   `json:"maxLength,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+
+	// arrays
+	Items    *Schema `json:"items,omitempty"`
+	MinItems *int    `json:"minItems,omitempty"`
+	MaxItems *int    `json:"maxItems,omitempty"`
+
+	// objects
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// URISchema is the schema document of a URI, with the schemas of the
+// arguments and of the results of its calls. A nil schema means that
+// the corresponding value is not validated.
+type URISchema struct {
+	Args   *Schema `json:"args,omitempty"`
+	Result *Schema `json:"result,omitempty"`
+}
+
+// Parse decodes and compiles the schema document of a URI.
+func Parse(doc []byte) (*URISchema, error) {
+	var us URISchema
+	if err := json.Unmarshal(doc, &us); err != nil {
+		return nil, err
+	}
+	if err := us.Compile(); err != nil {
+		return nil, err
+	}
+	return &us, nil
+}
+
+// Compile checks that the schemas of the document are valid and
+// prepares them for validation.
+func (us *URISchema) Compile() error {
+	if us.Args != nil {
+		if err := us.Args.compile("args"); err != nil {
+			return err
+		}
+	}
+	if us.Result != nil {
+		if err := us.Result.compile("result"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateArgs validates the JSON-encoded arguments of a call. It
+// returns nil or a *ValidationError.
+func (us *URISchema) ValidateArgs(args json.RawMessage) error {
+	return us.Args.validate("args", args)
+}
+
+// ValidateResult validates the JSON-encoded result of a call. It
+// returns nil or a *ValidationError.
+func (us *URISchema) ValidateResult(res json.RawMessage) error {
+	return us.Result.validate("result", res)
+}
+
+// Compile checks that the schema is valid and prepares it for
+// validation.
+func (s *Schema) Compile() error {
+	return s.compile("")
+}
+
+func (s *Schema) compile(path string) error {
+	for _, t := range s.Type {
+		if !validTypes[t] {
+			return fmt.Errorf("%s: unknown type %q", pathOrRoot(path), t)
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern: %v", pathOrRoot(path), err)
+		}
+		s.pattern = re
+	}
+	for i, v := range s.Enum {
+		s.Enum[i] = normalize(v)
+	}
+	if s.Items != nil {
+		if err := s.Items.compile(path + "[]"); err != nil {
+			return err
+		}
+	}
+	for name, ps := range s.Properties {
+		if ps == nil {
+			return fmt.Errorf("%s: null schema", joinPath(path, name))
+		}
+		if err := ps.compile(joinPath(path, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate validates the JSON-encoded value b. It returns nil or a
+// *ValidationError.
+func (s *Schema) Validate(b json.RawMessage) error {
+	return s.validate("", b)
+}
+
+func (s *Schema) validate(path string, b json.RawMessage) error {
+	if s == nil {
+		return nil
+	}
+
+	// missing arguments are validated as null
+	var v interface{}
+	if len(bytes.TrimSpace(b)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return &ValidationError{Problems: []string{fmt.Sprintf("%s: invalid JSON: %v", pathOrRoot(path), err)}}
+		}
+	}
+
+	var ve ValidationError
+	s.check(&ve, path, v)
+	if len(ve.Problems) > 0 {
+		return &ve
+	}
+	return nil
+}
+
+// check adds the problems of the value v, decoded with json.Number
+// numbers, to ve.
+func (s *Schema) check(ve *ValidationError, path string, v interface{}) {
+	if len(s.Type) > 0 && !s.hasType(v) {
+		ve.addf(path, "expected %s, got %s", strings.Join(s.Type, " or "), typeOf(v))
+		return
+	}
+	if len(s.Enum) > 0 {
+		nv := normalize(v)
+		var found bool
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, nv) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ve.addf(path, "value is not one of the enumerated values")
+		}
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			ve.addf(path, "must be >= %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			ve.addf(path, "must be <= %v", *s.Maximum)
+		}
+
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			ve.addf(path, "length must be >= %d", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			ve.addf(path, "length must be <= %d", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			ve.addf(path, "must match pattern %q", s.Pattern)
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			ve.addf(path, "must have >= %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			ve.addf(path, "must have <= %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.check(ve, fmt.Sprintf("%s[%d]", path, i), item)
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				ve.addf(joinPath(path, name), "missing required property")
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ps, ok := s.Properties[k]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					ve.addf(joinPath(path, k), "unknown property")
+				}
+				continue
+			}
+			ps.check(ve, joinPath(path, k), v[k])
+		}
+	}
+}
+
+// hasType returns true if v is of one of the types of the schema.
+func (s *Schema) hasType(v interface{}) bool {
+	vt := typeOf(v)
+	for _, t := range s.Type {
+		switch {
+		case t == vt:
+			return true
+		case t == "number" && vt == "integer":
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns the JSON Schema type of v, which is "integer" for the
+// numbers without a fractional part.
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// normalize returns a copy of v where the json.Number values are
+// converted to float64, so that values decoded with or without
+// json.Number can be compared.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		vs := make([]interface{}, len(v))
+		for i, item := range v {
+			vs[i] = normalize(item)
+		}
+		return vs
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = normalize(item)
+		}
+		return m
+	}
+	return v
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "(root)"
+	}
+	return path
+}
+
+// ValidationError is the error returned when a value does not conform
+// to its schema. It lists the problems found, and it implements
+// json.Marshaler so that the list is sent as details of a NACK (see
+// message.NewNack).
+type ValidationError struct {
+	Problems []string
+}
+
+// Error returns the error message for the ValidationError.
+func (e *ValidationError) Error() string {
+	return "schema validation failed: " + strings.Join(e.Problems, "; ")
+}
+
+// MarshalJSON implements json.Marshaler for ValidationError.
+func (e *ValidationError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Problems []string `json:"problems"`
+	}{e.Problems})
+}
+
+func (e *ValidationError) addf(path, f string, args ...interface{}) {
+	e.Problems = append(e.Problems, pathOrRoot(path)+": "+fmt.Sprintf(f, args...))
+}
@@ -0,0 +1,99 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const userSchema = `{
+	"args": {
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 5},
+			"age": {"type": "integer", "minimum": 0, "maximum": 150},
+			"role": {"enum": ["admin", "user", 1]},
+			"tags": {"type": "array", "items": {"type": "string", "pattern": "^[a-z]+$"}, "maxItems": 2},
+			"nick": {"type": ["string", "null"]}
+		},
+		"required": ["name"],
+		"additionalProperties": false
+	},
+	"result": {"type": "number"}
+}`
+
+func TestValidate(t *testing.T) {
+	us, err := Parse([]byte(userSchema))
+	require.NoError(t, err, "Parse")
+
+	cases := []struct {
+		args string
+		want []string
+	}{
+		{`{"name": "joe"}`, nil},
+		{`{"name": "joe", "age": 30, "role": "admin", "tags": ["a", "b"], "nick": null}`, nil},
+		{`{"name": "joe", "role": 1.0}`, nil},
+		{``, []string{"args: expected object, got null"}},
+		{`[]`, []string{"args: expected object, got array"}},
+		{`{}`, []string{"args.name: missing required property"}},
+		{`{"name": "", "x": 1}`, []string{"args.name: length must be >= 1", "args.x: unknown property"}},
+		{`{"name": "joséph"}`, []string{"args.name: length must be <= 5"}},
+		{`{"name": "joe", "age": 1.5}`, []string{"args.age: expected integer, got number"}},
+		{`{"name": "joe", "age": -1}`, []string{"args.age: must be >= 0"}},
+		{`{"name": "joe", "role": "root"}`, []string{"args.role: value is not one of the enumerated values"}},
+		{`{"name": "joe", "tags": ["a", "B", "c"]}`, []string{"args.tags: must have <= 2 items", `args.tags[1]: must match pattern "^[a-z]+$"`}},
+		{`{"name": "joe", "nick": 1}`, []string{"args.nick: expected string or null, got integer"}},
+		{`{"name": `, []string{"args: invalid JSON: unexpected EOF"}},
+	}
+	for _, c := range cases {
+		err := us.ValidateArgs(json.RawMessage(c.args))
+		if c.want == nil {
+			assert.NoError(t, err, c.args)
+			continue
+		}
+		if assert.IsType(t, &ValidationError{}, err, c.args) {
+			assert.Equal(t, c.want, err.(*ValidationError).Problems, c.args)
+		}
+	}
+
+	assert.NoError(t, us.ValidateResult(json.RawMessage(`1.5`)), "valid result")
+	assert.Error(t, us.ValidateResult(json.RawMessage(`"a"`)), "invalid result")
+	assert.NoError(t, (&URISchema{}).ValidateArgs(json.RawMessage(`"a"`)), "no args schema")
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		doc string
+		err string
+	}{
+		{`{}`, ""},
+		{`{"args": {"type": "int"}}`, `args: unknown type "int"`},
+		{`{"args": {"type": 1}}`, "type must be a string or an array of strings"},
+		{`{"result": {"properties": {"a": {"pattern": "("}}}}`, "result.a: invalid pattern: error parsing regexp: missing closing ): `(`"},
+		{`{"args": {"items": {"type": ["string", "x"]}}}`, `args[]: unknown type "x"`},
+	}
+	for _, c := range cases {
+		_, err := Parse([]byte(c.doc))
+		if c.err == "" {
+			assert.NoError(t, err, c.doc)
+		} else if assert.Error(t, err, c.doc) {
+			assert.Equal(t, c.err, err.Error(), c.doc)
+		}
+	}
+
+	// the schema is encoded back with the type as a string
+	us, err := Parse([]byte(`{"args": {"type": ["string"]}, "result": {"type": ["string", "null"]}}`))
+	require.NoError(t, err, "Parse")
+	b, err := json.Marshal(us)
+	require.NoError(t, err, "Marshal")
+	assert.Equal(t, `{"args":{"type":"string"},"result":{"type":["string","null"]}}`, string(b), "encoded schema")
+}
+
+func TestValidationError(t *testing.T) {
+	err := &ValidationError{Problems: []string{"a: x", "b: y"}}
+	assert.Equal(t, "schema validation failed: a: x; b: y", err.Error(), "Error")
+	b, _ := json.Marshal(err)
+	assert.Equal(t, `{"problems":["a: x","b: y"]}`, string(b), "MarshalJSON")
+}
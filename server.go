@@ -9,16 +9,40 @@ import (
 
 	"github.com/PuerkitoBio/juggler/broker"
 	"github.com/PuerkitoBio/juggler/message"
+	"github.com/PuerkitoBio/juggler/session"
 	"github.com/gorilla/websocket"
+	"golang.org/x/net/context"
 )
 
 // Subprotocols is the list of juggler protocol versions supported by this
-// package. It should be set as-is on the websocket.Upgrader Subprotocols
-// field.
+// package, the newest first (see message.Protocol). It should be set
+// as-is on the websocket.Upgrader Subprotocols field, so that the first
+// of those requested by the client, i.e. the newest version it speaks,
+// is used for the connection, which is served with the codec of that
+// version. A subprotocol that is not a registered version, e.g. an empty
+// one, is served as message.V1.
 var Subprotocols = []string{
-	"juggler.0",
+	message.V2.Name(),
+	message.V1.Name(),
 }
 
+// protocolFor returns the version of the protocol named name, or
+// message.V1 if it is not a registered version.
+func protocolFor(name string) message.Protocol {
+	if p, ok := message.LookupProtocol(name); ok {
+		return p
+	}
+	return message.V1
+}
+
+// DefaultReadTimeout is the default timeout to read an incoming message,
+// used when Server.ReadTimeout is 0.
+var DefaultReadTimeout = 30 * time.Second
+
+// DefaultWriteTimeout is the default timeout to write an outgoing
+// message, used when Server.WriteTimeout is 0.
+var DefaultWriteTimeout = 10 * time.Second
+
 func isInStr(list []string, v string) bool {
 	for _, vv := range list {
 		if vv == v {
@@ -45,8 +69,10 @@ type Server struct {
 	ReadLimit int64
 
 	// ReadTimeout is the timeout to read an incoming message. It is
-	// set on the websocket connection with SetReadDeadline before
-	// reading each message. The default of 0 means no timeout.
+	// set on the websocket connection with SetReadDeadline once the
+	// message starts, so that it does not apply to an idle connection.
+	// The default of 0 uses DefaultReadTimeout, a negative value means
+	// no timeout.
 	ReadTimeout time.Duration
 
 	// WriteLimit defines the maximum size, in bytes, of outgoing
@@ -56,7 +82,9 @@ type Server struct {
 
 	// WriteTimeout is the timeout to write an outgoing message. It is
 	// set on the websocket connection with SetWriteDeadline before
-	// writing each message. The default of 0 means no timeout.
+	// writing each message, so that a stalled client cannot hold the
+	// write lock of its connection forever. The default of 0 uses
+	// DefaultWriteTimeout, a negative value means no timeout.
 	WriteTimeout time.Duration
 
 	// AcquireWriteLockTimeout is the time to wait for the exclusive
@@ -79,6 +107,77 @@ type Server struct {
 	//     Connected -> Closed
 	ConnState func(*Conn, ConnState)
 
+	// OnConnect specifies an optional callback function that is called
+	// when a connection is set up, after the Connected state and before
+	// any message is processed. The Identity of the connection is set
+	// at that point. If it returns an error, the connection is closed
+	// with that error, e.g. to enforce a limit of connections per
+	// identity.
+	OnConnect func(*Conn) error
+
+	// OnDisconnect specifies an optional callback function that is
+	// called when a connection for which OnConnect succeeded (or was
+	// nil) is closed, before the Closed state, with the error that
+	// caused the connection to close, as in its CloseErr field.
+	OnDisconnect func(c *Conn, reason error)
+
+	// OnSubscribe specifies an optional callback function that is
+	// called when a SUB request of the connection succeeded, with its
+	// channel and whether it is a pattern.
+	OnSubscribe func(c *Conn, channel string, pattern bool)
+
+	// OnUnsubscribe specifies an optional callback function that is
+	// called when an UNSB request of the connection succeeded, with its
+	// channel and whether it is a pattern. It is not called for the
+	// subscriptions that are dropped when the connection is closed,
+	// OnDisconnect is called instead.
+	OnUnsubscribe func(c *Conn, channel string, pattern bool)
+
+	// OnExpiredEvnt specifies an optional callback function that is
+	// called when an EVNT message is not sent on the connection because
+	// its TTL expired, possibly while waiting for the write lock, with
+	// the message as it would have been sent.
+	OnExpiredEvnt func(c *Conn, m *message.Evnt)
+
+	// RewriteURI specifies an optional function that is called with the
+	// URI of each CALL request of the connection, and returns the URI to
+	// call instead, e.g. to route a share of the calls to a canary
+	// version, to prefix the URI with the tenant of the connection or
+	// to redirect a deprecated URI. The call is processed as if the
+	// client requested the returned URI (local handlers, cache, callees
+	// check and broker), but its RES is sent with the URI of the
+	// request. If it returns an error, the call is rejected with a NACK
+	// with message.CodeHandlerError. The calls to message.TimeSyncURI,
+	// message.HistoryURI, message.CreditURI and message.EvntAckURI are
+	// not rewritten.
+	RewriteURI func(ctx context.Context, c *Conn, uri string) (string, error)
+
+	// AuthorizeActAs specifies an optional function that is called with
+	// each CALL request of the connection made on behalf of another
+	// identity (see message.Meta.ActAs), e.g. by an API gateway for its
+	// end users, and returns true if the connection is allowed to act as
+	// that identity for that call. The authorized calls are delivered to
+	// the callees with that identity as message.CallPayload.Identity,
+	// and the Identity of the connection as message.CallPayload.Actor.
+	// If it is nil or returns false, or if the connection has no
+	// Identity, the call is rejected with a NACK with
+	// message.CodeForbidden and ErrActAsDenied. The local handlers (see
+	// LocalHandler) get the identity in the metadata of the call.
+	AuthorizeActAs func(c *Conn, m *message.Call, identity string) bool
+
+	// ConnLimiter, if set, limits the number of concurrent connections
+	// served by the server, in total and per identity. The connections
+	// that are rejected go from the Accepting state to the Closed state
+	// with ErrTooManyConns as CloseErr, and the connections that are
+	// evicted are closed with ErrConnEvicted.
+	ConnLimiter *ConnLimiter
+
+	// Deduplicator, if set, drops the requests that are resubmitted with
+	// the same message UUID within its window, and sends the ACK of the
+	// original request again if it was acknowledged. The duplicates are
+	// dropped before the Handler is called.
+	Deduplicator *Deduplicator
+
 	// Handler is the handler that is called when a message is
 	// processed. The ProcessMsg function is called if the default
 	// nil value is set. If a custom handler is set, it is assumed
@@ -86,6 +185,14 @@ type Server struct {
 	// manually process the messages.
 	Handler Handler
 
+	// CustomMsgHandler is the handler that ProcessMsg calls with the
+	// messages of the custom types received from the clients (see
+	// message.RegisterRead), e.g. domain-specific control frames. If
+	// nil, those messages are dropped. The messages of the custom types
+	// sent by the server (see message.RegisterWrite) are written to the
+	// connection by ProcessMsg, as the RES and EVNT messages.
+	CustomMsgHandler Handler
+
 	// PubSubBroker is the broker to use for pub-sub messages. It must be
 	// set before the Server can be used.
 	PubSubBroker broker.PubSubBroker
@@ -94,9 +201,103 @@ type Server struct {
 	// set before the server can be used.
 	CallerBroker broker.CallerBroker
 
+	// TimeSync enables the time synchronization exchange. If true, CALL
+	// requests to message.TimeSyncURI are answered directly by the server
+	// with its clock, so that clients can estimate the offset of their
+	// clock (see client.Client.SyncClock).
+	TimeSync bool
+
+	// History enables the channel history query. If true and
+	// PubSubBroker implements broker.HistoryBroker, CALL requests to
+	// message.HistoryURI are answered directly by the server with at
+	// most MaxHistoryEvents events retained for the channel, so that
+	// clients can backfill their state. Access to the channels should
+	// be controlled by a Handler, as for SUB requests.
+	History bool
+
+	// FlowControl enables the credit-based flow control of the events.
+	// If true, CALL requests to message.CreditURI are answered directly
+	// by the server, so that clients can grant event credits to their
+	// subscriptions (see message.CreditGrant). A subscription that got a
+	// grant is sent one event per credit, its other events are buffered
+	// until it gets more credits, at most CreditBuffer events, then the
+	// oldest ones are dropped. The subscriptions without grant are not
+	// flow-controlled.
+	FlowControl bool
+
+	// CreditBuffer is the number of events buffered for each subscription
+	// that has no credits left (see FlowControl). The default of 0 drops
+	// the events.
+	CreditBuffer int
+
+	// EventAcks, if set, enables the subscriptions in acknowledged mode
+	// (see message.Sub) and keeps their state. Their events carry a
+	// delivery tag, and the CALL requests to message.EvntAckURI are
+	// answered directly by the server to acknowledge them. The events
+	// that are not acknowledged are delivered again from the channel
+	// history when the subscription is made again. If it is not set,
+	// the SUB requests in acknowledged mode are rejected.
+	EventAcks *EventAcks
+
+	// Sticky enables the sticky subscriptions (see message.Sub). If true
+	// and PubSubBroker implements broker.StickyBroker, a sticky SUB from
+	// a connection with an Identity subscribes all the connections of
+	// the identity served by the server, and the connections of the
+	// identity are subscribed when they connect, on any server that
+	// uses the same broker. A sticky UNSB unsubscribes them. The
+	// connections of the identity already served by other servers only
+	// get the subscription when they connect again. If it is false, the
+	// sticky SUB and UNSB requests are rejected.
+	Sticky bool
+
+	// CheckCallees enables the check for live callees before registering
+	// a call request. If true and CallerBroker implements
+	// broker.RegistryBroker, CALL requests to a URI without any live
+	// callee are rejected immediately with a NACK with ErrNoCallee and
+	// message.CodeNoCallee, instead of expiring, and so are the CALL
+	// requests whose routing mode is not accepted by any live callee
+	// (see callee.Callee.Routing). If no callee is registered for the URI
+	// and CallerBroker implements broker.PatternBroker, the callees of
+	// the most specific live URI pattern that matches it are checked
+	// instead. It should only be enabled if all callees register
+	// themselves (see callee.Callee.Registry).
+	CheckCallees bool
+
+	// Strict enables the strict protocol mode, meant for the development
+	// of clients. If true, the requests that do not strictly conform to
+	// the protocol, e.g. with unknown fields or non-canonical channel
+	// names, are rejected with a NACK with message.CodeBadRequest that
+	// lists the problems in its details (see message.Lint), instead of
+	// being processed leniently. It should not be enabled in production.
+	Strict bool
+
+	// NameValidator, if set, validates the URIs and channels of the
+	// requests, including those of the batches, before they are
+	// processed. The requests with an invalid name are rejected with a
+	// NACK with message.CodeBadRequest and the error of the validator,
+	// instead of failing in the broker (see NamePolicy).
+	NameValidator NameValidator
+
+	// Recorder, if set, records the data frames received and sent on all
+	// the connections, with the UUID of the connection as session (see
+	// the session package), so that the sessions can be replayed. As the
+	// frames are read in memory to be recorded, it should only be set to
+	// reproduce an issue.
+	Recorder *session.Recorder
+
+	// CompressionLevel is the compression level of the messages written
+	// to the connections that negotiated the permessage-deflate extension
+	// (see websocket.Upgrader.EnableCompression), from flate.BestSpeed to
+	// flate.BestCompression. The default of 0 uses the default level of
+	// the websocket package.
+	CompressionLevel int
+
 	// Vars can be set to an *expvar.Map to collect metrics about the
 	// server.
 	Vars *expvar.Map
+
+	// connections served, see CloseConnsByIdentity
+	served servedConns
 }
 
 var allReqMsgs = []message.Type{message.CallMsg, message.SubMsg, message.UnsbMsg, message.PubMsg}
@@ -122,6 +323,11 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 	}
 
 	conn.SetReadLimit(srv.ReadLimit)
+	if srv.CompressionLevel != 0 {
+		// only fails if the level is invalid, in which case the
+		// default level is used.
+		conn.SetCompressionLevel(srv.CompressionLevel)
+	}
 	c := newConn(conn, srv, allowedMsgs...)
 	if len(allowedMsgs) == 0 {
 		allowedMsgs = allReqMsgs
@@ -135,6 +341,34 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 		cs(c, Accepting)
 	}
 
+	if c.Tenant != "" && !message.ValidTenant(c.Tenant) {
+		if srv.Vars != nil {
+			srv.Vars.Add("InvalidTenantConns", 1)
+		}
+		c.Close(ErrInvalidTenant)
+		return
+	}
+
+	// enforce the connection limits, once the identity is known
+	if l := srv.ConnLimiter; l != nil {
+		evict, err := l.acquire(c)
+		if err != nil {
+			if srv.Vars != nil {
+				srv.Vars.Add("RejectedConns", 1)
+			}
+			c.Close(err)
+			return
+		}
+		defer l.release(c)
+
+		for _, ec := range evict {
+			if srv.Vars != nil {
+				srv.Vars.Add("EvictedConns", 1)
+			}
+			ec.Close(ErrConnEvicted)
+		}
+	}
+
 	// setup results connection if CALL is allowed
 	callOK := isInType(allowedMsgs, message.CallMsg)
 	if callOK {
@@ -162,6 +396,22 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 	if cs := srv.ConnState; cs != nil {
 		cs(c, Connected)
 	}
+	srv.served.add(c)
+	defer srv.served.remove(c)
+	if fn := srv.OnConnect; fn != nil {
+		if err := fn(c); err != nil {
+			c.Close(err)
+			return
+		}
+	}
+	if subOK {
+		restoreSticky(c)
+	}
+	if fn := srv.OnDisconnect; fn != nil {
+		defer func() {
+			fn(c, c.CloseErr)
+		}()
+	}
 
 	// receive, results, pub-sub loops
 	if subOK {
@@ -192,6 +442,9 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 //     Any of "call, sub, unsb, pub"
 //     "*" can be used for any message type (same as if the header wasn't there)
 //
+// Batches of requests (see message.Batch) are allowed if "call" or
+// "pub" is allowed, for the allowed types of requests.
+//
 func Upgrade(upgrader *websocket.Upgrader, srv *Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// upgrade the HTTP connection to the websocket protocol
@@ -237,3 +490,21 @@ func AllowedMessagesFromHeader(h http.Header) []message.Type {
 	}
 	return msgs
 }
+
+// readTimeout returns the ReadTimeout, or the default if it is 0. It
+// is <= 0 if there is no timeout.
+func (srv *Server) readTimeout() time.Duration {
+	if srv.ReadTimeout == 0 {
+		return DefaultReadTimeout
+	}
+	return srv.ReadTimeout
+}
+
+// writeTimeout returns the WriteTimeout, or the default if it is 0. It
+// is <= 0 if there is no timeout.
+func (srv *Server) writeTimeout() time.Duration {
+	if srv.WriteTimeout == 0 {
+		return DefaultWriteTimeout
+	}
+	return srv.WriteTimeout
+}
@@ -1,7 +1,18 @@
 package juggler_test
 
 import (
+	"compress/flate"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"expvar"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -77,6 +88,41 @@ func TestServerServe(t *testing.T) {
 	}
 }
 
+func TestServerReadTimeout(t *testing.T) {
+	closed := make(chan error, 1)
+	server := &juggler.Server{
+		ReadTimeout: 50 * time.Millisecond,
+		ConnState: func(c *juggler.Conn, state juggler.ConnState) {
+			if state == juggler.Closed {
+				closed <- c.CloseErr
+			}
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	wsc, _, err := (&websocket.Dialer{Subprotocols: juggler.Subprotocols}).Dial(srv.URL, http.Header{"Juggler-Allowed-Messages": {"pub"}})
+	require.NoError(t, err, "Dial")
+	defer wsc.Close()
+
+	// start a message larger than the write buffer, and stall
+	w, err := wsc.NextWriter(websocket.TextMessage)
+	require.NoError(t, err, "NextWriter")
+	_, err = w.Write([]byte(strings.Repeat(" ", 10000)))
+	require.NoError(t, err, "Write")
+
+	select {
+	case err := <-closed:
+		if assert.Error(t, err, "close error") {
+			assert.Contains(t, err.Error(), "timeout", "timeout error")
+		}
+	case <-time.After(time.Second):
+		assert.Fail(t, "connection not closed after the read timeout")
+	}
+}
+
 func TestUpgrade(t *testing.T) {
 	cmd, port := redistest.StartServer(t, nil, "")
 	defer cmd.Process.Kill()
@@ -153,3 +199,295 @@ func TestUpgrade(t *testing.T) {
 	}
 	cli.Close()
 }
+
+func TestTLSIdentity(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "GenerateKey")
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "billing-service"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err, "CreateCertificate")
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err, "ParseCertificate")
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	ids := make(chan string, 1)
+	fn := func(c *juggler.Conn, cs juggler.ConnState) {
+		if cs == juggler.Accepting {
+			ids <- c.Identity
+		}
+	}
+	server := &juggler.Server{ConnState: fn}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewUnstartedServer(juggler.Upgrade(upg, server))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	d := &websocket.Dialer{
+		Subprotocols:    juggler.Subprotocols,
+		TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}},
+	}
+	cli, err := client.Dial(d, strings.Replace(srv.URL, "https:", "wss:", 1),
+		http.Header{"Juggler-Allowed-Messages": {"pub"}})
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	select {
+	case id := <-ids:
+		assert.Equal(t, "billing-service", id, "identity")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no accepting state received")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &juggler.Server{
+		Strict: true,
+		Vars:   vars,
+		Handler: juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+			if m.Type() == message.PubMsg {
+				c.Send(message.NewAck(m))
+				return
+			}
+			juggler.ProcessMsg(c, m)
+		}),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	defer srv.Close()
+
+	d := &websocket.Dialer{Subprotocols: juggler.Subprotocols}
+	conn, _, err := d.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), http.Header{"Juggler-Allowed-Messages": {"pub"}})
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+
+	pub, err := message.NewPub("a", 1)
+	require.NoError(t, err, "NewPub")
+	id := pub.UUID().String()
+
+	// off-spec PUB: unknown field and non-canonical channel
+	offSpec := `{"meta":{"type":2,"uuid":"` + id + `"},"payload":{"channel":"a b","args":1,"extra":true}}`
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(offSpec)), "write off-spec PUB")
+	_, r, err := conn.NextReader()
+	require.NoError(t, err, "read NACK")
+	m, err := message.UnmarshalResponse(r)
+	require.NoError(t, err, "UnmarshalResponse")
+	if assert.IsType(t, &message.Nack{}, m, "off-spec PUB") {
+		nack := m.(*message.Nack)
+		assert.Equal(t, message.CodeBadRequest, nack.Payload.Code, "NACK code")
+		assert.Equal(t, pub.UUID(), nack.Payload.For, "NACK for")
+		assert.JSONEq(t, `{"problems":["payload.extra: unknown field","payload.channel: channel must not contain whitespace or control characters"]}`,
+			string(nack.Payload.Details), "NACK details")
+	}
+
+	// valid PUB is processed
+	require.NoError(t, conn.WriteJSON(pub), "write PUB")
+	_, r, err = conn.NextReader()
+	require.NoError(t, err, "read ACK")
+	m, err = message.UnmarshalResponse(r)
+	require.NoError(t, err, "UnmarshalResponse")
+	assert.IsType(t, &message.Ack{}, m, "valid PUB")
+
+	assert.Equal(t, "1", vars.Get("StrictRejectedMsgs").String(), "StrictRejectedMsgs")
+}
+
+func TestCompression(t *testing.T) {
+	server := &juggler.Server{
+		CompressionLevel: flate.BestCompression,
+		Handler: juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+			if m.Type().IsRead() {
+				c.Send(message.NewAck(m))
+				return
+			}
+			juggler.ProcessMsg(c, m)
+		}),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols, EnableCompression: true}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	defer srv.Close()
+
+	d := &websocket.Dialer{Subprotocols: juggler.Subprotocols, EnableCompression: true}
+	conn, res, err := d.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), http.Header{"Juggler-Allowed-Messages": {"pub"}})
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+	assert.Contains(t, res.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate", "compression negotiated")
+
+	pub, err := message.NewPub("a", strings.Repeat("a", 1000))
+	require.NoError(t, err, "NewPub")
+	require.NoError(t, conn.WriteJSON(pub), "write PUB")
+	_, r, err := conn.NextReader()
+	require.NoError(t, err, "read ACK")
+	m, err := message.UnmarshalResponse(r)
+	require.NoError(t, err, "UnmarshalResponse")
+	assert.IsType(t, &message.Ack{}, m, "compressed PUB is processed")
+}
+
+// failPubSubBroker fails to publish on the "fail" channel.
+type failPubSubBroker struct {
+	fakePubSubBroker
+}
+
+func (failPubSubBroker) Publish(channel string, pp *message.PubPayload) error {
+	if channel == "fail" {
+		return errors.New("publish failed")
+	}
+	return nil
+}
+
+func TestNoAck(t *testing.T) {
+	server := &juggler.Server{
+		CallerBroker: echoURIBroker{ch: make(chan *message.ResPayload, 10)},
+		PubSubBroker: failPubSubBroker{},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, nil,
+		client.SetHandler(h), client.SetDefaultAckMode(client.NoAckPubCall))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	next := func(label string) message.Msg {
+		select {
+		case m := <-msgs:
+			return m
+		case <-time.After(time.Second):
+			require.FailNow(t, "no message", label)
+		}
+		return nil
+	}
+
+	// the first response of each request is its outcome, not an ACK
+	_, err = cli.Pub("ok", 1)
+	require.NoError(t, err, "Pub ok")
+	_, err = cli.Pub("fail", 1)
+	require.NoError(t, err, "Pub fail")
+	if m := next("pub"); assert.IsType(t, &message.Nack{}, m, "pub NACK") {
+		assert.Equal(t, "fail", m.(*message.Nack).Payload.Channel, "NACK channel")
+	}
+
+	_, err = cli.Call("a", nil, time.Second)
+	require.NoError(t, err, "Call")
+	assert.IsType(t, &message.Res{}, next("call"), "call RES")
+
+	_, err = cli.Sub("c", false)
+	require.NoError(t, err, "Sub")
+	assert.IsType(t, &message.Ack{}, next("sub"), "sub ACK")
+}
+
+// noEvntProtocol is a version of the protocol that does not support the
+// EVNT messages, as a stand-in for a version that predates a type of
+// message.
+type noEvntProtocol struct {
+	message.Protocol
+}
+
+func (noEvntProtocol) Name() string { return "juggler.test-noevnt" }
+func (noEvntProtocol) Version() int { return 0 }
+func (p noEvntProtocol) Supports(t message.Type) bool {
+	return t != message.EvntMsg && p.Protocol.Supports(t)
+}
+
+func init() {
+	message.RegisterProtocol(noEvntProtocol{message.V1})
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	saved := juggler.Subprotocols
+	defer func() { juggler.Subprotocols = saved }()
+	juggler.Subprotocols = append(juggler.Subprotocols[:len(saved):len(saved)], "juggler.test-noevnt")
+
+	vars := new(expvar.Map).Init()
+	protos := make(chan message.Protocol, 1)
+	server := &juggler.Server{
+		CallerBroker: nopCallerBroker{},
+		Vars:         vars,
+		ConnState: func(c *juggler.Conn, state juggler.ConnState) {
+			if state == juggler.Accepting {
+				protos <- c.Protocol()
+			}
+		},
+		// an EVNT is sent before the ACK of each call
+		Handler: juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+			if m.Type() == message.CallMsg {
+				c.Send(message.NewEvnt(&message.EvntPayload{MsgUUID: m.UUID(), Channel: "a"}))
+			}
+			juggler.ProcessMsg(c, m)
+		}),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	cases := []struct {
+		subprotos []string
+		want      string
+		evnt      bool
+	}{
+		{nil, "juggler.v2.json", true},
+		{[]string{"juggler.0"}, "juggler.0", true},
+		{[]string{"juggler.0", "juggler.v2.json"}, "juggler.v2.json", true},
+		{[]string{"juggler.test-noevnt"}, "juggler.test-noevnt", false},
+	}
+	for i, c := range cases {
+		msgs := make(chan message.Msg, 10)
+		h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+			msgs <- m
+		})
+		cli, err := client.Dial(&websocket.Dialer{Subprotocols: c.subprotos}, srv.URL,
+			http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h))
+		require.NoError(t, err, "%d: Dial", i)
+
+		assert.Equal(t, c.want, cli.Protocol().Name(), "%d: client protocol", i)
+		select {
+		case p := <-protos:
+			assert.Equal(t, c.want, p.Name(), "%d: server protocol", i)
+		case <-time.After(time.Second):
+			t.Fatalf("%d: connection not accepted", i)
+		}
+
+		_, err = cli.Call("a", nil, time.Minute)
+		require.NoError(t, err, "%d: Call", i)
+
+		want := []message.Type{message.AckMsg}
+		if c.evnt {
+			want = append(want, message.EvntMsg)
+		}
+		var got []message.Type
+		for range want {
+			select {
+			case m := <-msgs:
+				got = append(got, m.Type())
+			case <-time.After(time.Second):
+				t.Fatalf("%d: no response", i)
+			}
+		}
+		assert.ElementsMatch(t, want, got, "%d: responses", i)
+		cli.Close()
+	}
+	assert.Equal(t, "1", vars.Get("UnsupportedProtocolMsgs").String(), "unsupported messages")
+}
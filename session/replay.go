@@ -0,0 +1,161 @@
+package session
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultLinger is the default time to wait for the responses of the
+// server after the last frame of a session is replayed, used when
+// Replayer.Linger is 0.
+var DefaultLinger = time.Second
+
+// Replayer replays the frames sent by the clients in recorded sessions
+// against a server.
+type Replayer struct {
+	// Dialer is the websocket dialer used to connect to the server. Its
+	// Subprotocols field should be set to juggler.Subprotocols. If nil,
+	// websocket.DefaultDialer is used.
+	Dialer *websocket.Dialer
+
+	// URL is the websocket URL of the server.
+	URL string
+
+	// Header is the HTTP header of the connection requests.
+	Header http.Header
+
+	// Speed is the factor applied to the pace of the frames: 1 replays
+	// them at their original pace, 2 twice as fast, and so on. If it is
+	// 0, the original pace is used, and if it is negative, the frames
+	// are sent without delay.
+	Speed float64
+
+	// Linger is the time to wait for the responses of the server after
+	// the last frame of a session is sent, before its connection is
+	// closed. If 0, DefaultLinger is used.
+	Linger time.Duration
+
+	// Received, if set, is called with each frame received from the
+	// server, by the goroutine that reads the connection of its session.
+	Received func(*Frame)
+}
+
+// Replay replays the frames of the clients. The sessions are replayed
+// concurrently, each on a new connection opened when its first frame is
+// due, and each frame is sent when its time relative to the first frame
+// of the recording is reached, divided by Speed. The frames of the
+// servers are ignored. Replay returns once all the connections are
+// closed, with the first error to connect or to send a frame, if any.
+func (rp *Replayer) Replay(frames []*Frame) error {
+	var (
+		order    []string
+		sessions = make(map[string][]*Frame)
+		origin   time.Time
+	)
+	for _, f := range frames {
+		if origin.IsZero() || f.Time.Before(origin) {
+			origin = f.Time
+		}
+		if f.From != Client {
+			continue
+		}
+		if _, ok := sessions[f.Session]; !ok {
+			order = append(order, f.Session)
+		}
+		sessions[f.Session] = append(sessions[f.Session], f)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	start := time.Now()
+	for _, id := range order {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := rp.replaySession(id, sessions[id], start, origin); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// wait waits until the frame f is due.
+func (rp *Replayer) wait(f *Frame, start, origin time.Time) {
+	if rp.Speed < 0 {
+		return
+	}
+	offset := f.Time.Sub(origin)
+	if rp.Speed > 0 {
+		offset = time.Duration(float64(offset) / rp.Speed)
+	}
+	if d := start.Add(offset).Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (rp *Replayer) replaySession(id string, frames []*Frame, start, origin time.Time) error {
+	d := rp.Dialer
+	if d == nil {
+		d = websocket.DefaultDialer
+	}
+
+	rp.wait(frames[0], start, origin)
+	conn, _, err := d.Dial(rp.URL, rp.Header)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			mt, r, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return
+			}
+			if fn := rp.Received; fn != nil {
+				fn(newFrame(id, Server, mt, b))
+			}
+		}
+	}()
+
+	// the reading goroutine returns once the connection is closed
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	for _, f := range frames {
+		rp.wait(f, start, origin)
+		if err := conn.WriteMessage(f.Type, f.Data()); err != nil {
+			return err
+		}
+	}
+
+	linger := rp.Linger
+	if linger == 0 {
+		linger = DefaultLinger
+	}
+	select {
+	case <-done:
+	case <-time.After(linger):
+	}
+	return nil
+}
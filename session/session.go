@@ -0,0 +1,193 @@
+// Package session records the frames of websocket sessions, and replays
+// them against a server, to reproduce the issues that depend on the
+// timing of the requests, e.g. race conditions reported from production.
+//
+// A Recorder writes the frames as JSON lines, one Frame per line, to a
+// file or any io.Writer. It is set on a juggler server (see
+// juggler.Server.Recorder) to record the sessions of all its
+// connections, or on a client (see client.SetRecorder). A Replayer reads
+// the frames back and sends those of the clients to a server, on a new
+// connection for each recorded session, at their original pace or
+// faster. The juggler-replay command replays a recording from the
+// command line.
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Origin identifies the peer that sent a frame.
+type Origin string
+
+// The peers that send the frames.
+const (
+	Client Origin = "client"
+	Server Origin = "server"
+)
+
+// Frame is a websocket data frame of a recorded session.
+type Frame struct {
+	// Time is the time in UTC at which the frame was received or sent
+	// by the recording peer.
+	Time time.Time `json:"time"`
+
+	// Session identifies the websocket connection of the frame, e.g. the
+	// UUID of the juggler connection.
+	Session string `json:"session"`
+
+	// From is the peer that sent the frame.
+	From Origin `json:"from"`
+
+	// Type is the websocket message type of the frame, i.e.
+	// websocket.TextMessage or websocket.BinaryMessage.
+	Type int `json:"type"`
+
+	// Text is the payload of the frame if it is valid UTF-8, otherwise
+	// Binary is.
+	Text   string `json:"text,omitempty"`
+	Binary []byte `json:"binary,omitempty"`
+}
+
+// newFrame returns the frame of the data payload received or sent now.
+func newFrame(session string, from Origin, typ int, data []byte) *Frame {
+	f := &Frame{
+		Time:    time.Now().UTC(),
+		Session: session,
+		From:    from,
+		Type:    typ,
+	}
+	if utf8.Valid(data) {
+		f.Text = string(data)
+	} else {
+		f.Binary = data
+	}
+	return f
+}
+
+// Data returns the payload of the frame.
+func (f *Frame) Data() []byte {
+	if f.Binary != nil {
+		return f.Binary
+	}
+	return []byte(f.Text)
+}
+
+// Recorder records the frames of websocket sessions as JSON lines. It
+// is safe for concurrent use. The errors to write the frames are
+// ignored by the servers and clients, use Err to check them.
+type Recorder struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+	err error
+}
+
+// NewRecorder returns a Recorder that writes the frames to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w, enc: json.NewEncoder(w)}
+}
+
+// OpenFile returns a Recorder that appends the frames to the file at
+// path, which is created if it does not exist.
+func OpenFile(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f), nil
+}
+
+// Record records a frame of type typ with the data payload, sent by
+// from in the session.
+func (r *Recorder) Record(session string, from Origin, typ int, data []byte) error {
+	f := newFrame(session, from, typ, data)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(f); err != nil {
+		if r.err == nil {
+			r.err = err
+		}
+		return err
+	}
+	return nil
+}
+
+// Writer returns an io.WriteCloser that writes the payload of a text
+// frame to w, and records it once it is closed, unless a write or the
+// close fails.
+func (r *Recorder) Writer(w io.WriteCloser, session string, from Origin) io.WriteCloser {
+	return &recordWriter{w: w, r: r, session: session, from: from}
+}
+
+type recordWriter struct {
+	w       io.WriteCloser
+	r       *Recorder
+	session string
+	from    Origin
+	buf     []byte
+	failed  bool
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.buf = append(w.buf, p[:n]...)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+func (w *recordWriter) Close() error {
+	err := w.w.Close()
+	if err == nil && !w.failed && w.buf != nil {
+		w.r.Record(w.session, w.from, websocket.TextMessage, w.buf)
+	}
+	return err
+}
+
+// Err returns the first error to write a frame, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ReadFrames reads the frames recorded in r, in the order they were
+// recorded.
+func ReadFrames(r io.Reader) ([]*Frame, error) {
+	var frames []*Frame
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var f Frame
+		if err := dec.Decode(&f); err != nil {
+			if err == io.EOF {
+				return frames, nil
+			}
+			return frames, err
+		}
+		if f.Session == "" {
+			return frames, errors.New("juggler/session: frame without session")
+		}
+		frames = append(frames, &f)
+	}
+}
@@ -0,0 +1,144 @@
+package session
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopWriteCloser struct {
+	bytes.Buffer
+}
+
+func (w *nopWriteCloser) Close() error { return nil }
+
+func TestRecordReadFrames(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+
+	require.NoError(t, rec.Record("s1", Client, websocket.TextMessage, []byte(`{"a":1}`)))
+	require.NoError(t, rec.Record("s1", Server, websocket.BinaryMessage, []byte{0xff, 0x00}))
+
+	var out nopWriteCloser
+	w := rec.Writer(&out, "s2", Server)
+	w.Write([]byte(`{"b"`))
+	w.Write([]byte(`:2}`))
+	require.NoError(t, w.Close())
+	assert.Equal(t, `{"b":2}`, out.String())
+	assert.NoError(t, rec.Err())
+
+	frames, err := ReadFrames(&buf)
+	require.NoError(t, err)
+	require.Len(t, frames, 3)
+
+	assert.Equal(t, "s1", frames[0].Session)
+	assert.Equal(t, Client, frames[0].From)
+	assert.Equal(t, websocket.TextMessage, frames[0].Type)
+	assert.Equal(t, []byte(`{"a":1}`), frames[0].Data())
+	assert.Nil(t, frames[0].Binary)
+
+	assert.Equal(t, Server, frames[1].From)
+	assert.Equal(t, websocket.BinaryMessage, frames[1].Type)
+	assert.Equal(t, []byte{0xff, 0x00}, frames[1].Data())
+	assert.Equal(t, "", frames[1].Text)
+
+	assert.Equal(t, "s2", frames[2].Session)
+	assert.Equal(t, []byte(`{"b":2}`), frames[2].Data())
+	assert.False(t, frames[2].Time.Before(frames[0].Time))
+}
+
+func TestReadFramesInvalid(t *testing.T) {
+	frames, err := ReadFrames(strings.NewReader(`{"session":"s1","from":"client","type":1,"text":"a"}
+{"from":"client","type":1,"text":"b"}
+`))
+	assert.Error(t, err)
+	assert.Len(t, frames, 1)
+
+	_, err = ReadFrames(strings.NewReader(`{"session":`))
+	assert.Error(t, err)
+}
+
+// echoServer returns a websocket server that echoes the frames it
+// receives, and records them under the session "srv".
+func echoServer(t *testing.T, rec *Recorder) *httptest.Server {
+	upg := &websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upg.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			rec.Record("srv", Client, mt, b)
+			if err := conn.WriteMessage(mt, b); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestReplay(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	srv := echoServer(t, rec)
+	defer srv.Close()
+
+	now := time.Now()
+	frames := []*Frame{
+		{Time: now, Session: "a", From: Client, Type: websocket.TextMessage, Text: "a1"},
+		{Time: now.Add(10 * time.Millisecond), Session: "a", From: Server, Type: websocket.TextMessage, Text: "ignored"},
+		{Time: now.Add(200 * time.Millisecond), Session: "a", From: Client, Type: websocket.TextMessage, Text: "a2"},
+		{Time: now.Add(100 * time.Millisecond), Session: "b", From: Client, Type: websocket.BinaryMessage, Binary: []byte{0xff}},
+	}
+
+	var (
+		mu       sync.Mutex
+		received = make(map[string][]string)
+	)
+	rp := &Replayer{
+		URL:    strings.Replace(srv.URL, "http:", "ws:", 1),
+		Speed:  2,
+		Linger: 100 * time.Millisecond,
+		Received: func(f *Frame) {
+			mu.Lock()
+			received[f.Session] = append(received[f.Session], string(f.Data()))
+			mu.Unlock()
+		},
+	}
+
+	start := time.Now()
+	require.NoError(t, rp.Replay(frames))
+	// the last frame is due after 100ms at twice the original pace
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "replayed too fast")
+
+	mu.Lock()
+	assert.Equal(t, []string{"a1", "a2"}, received["a"])
+	assert.Equal(t, []string{"\xff"}, received["b"])
+	mu.Unlock()
+
+	got, err := ReadFrames(&buf)
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	assert.Equal(t, "a1", got[0].Text)
+	assert.Equal(t, []byte{0xff}, got[1].Binary)
+	assert.Equal(t, "a2", got[2].Text)
+}
+
+func TestReplayDialError(t *testing.T) {
+	frames := []*Frame{{Time: time.Now(), Session: "a", From: Client, Type: websocket.TextMessage, Text: "a1"}}
+	rp := &Replayer{URL: "ws://127.0.0.1:1/", Speed: -1}
+	assert.Error(t, rp.Replay(frames))
+}
@@ -0,0 +1,151 @@
+package juggler
+
+import (
+	"errors"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// stickyBroker returns the broker of the sticky subscriptions, or nil if
+// they are not enabled or the PubSubBroker does not support them.
+func (srv *Server) stickyBroker() broker.StickyBroker {
+	if !srv.Sticky {
+		return nil
+	}
+	sb, _ := srv.PubSubBroker.(broker.StickyBroker)
+	return sb
+}
+
+// stickyKey returns the identity of c in the broker of the sticky
+// subscriptions, qualified by its tenant.
+func stickyKey(c *Conn) string {
+	return message.TenantName(c.Tenant, c.Identity)
+}
+
+// checkSticky sends the NACK of the sticky request m and returns nil if
+// the sticky subscriptions are not supported for c.
+func checkSticky(c *Conn, m message.Msg) broker.StickyBroker {
+	sb := c.srv.stickyBroker()
+	switch {
+	case sb == nil:
+		c.Send(message.NewNack(m, message.CodeBadRequest, errors.New("sticky subscriptions not supported")))
+		return nil
+	case c.Identity == "":
+		c.Send(message.NewNack(m, message.CodeUnauthorized, errors.New("sticky subscriptions require an identity")))
+		return nil
+	}
+	return sb
+}
+
+// sameIdentity returns the other connections of the identity of c served
+// by its server that can receive events.
+func sameIdentity(c *Conn) []*Conn {
+	return c.srv.served.list(func(oc *Conn) bool {
+		return oc != c && oc.psc != nil && oc.Identity == c.Identity && oc.Tenant == c.Tenant &&
+			(len(oc.allowedMsgs) == 0 || isInType(oc.allowedMsgs, message.SubMsg))
+	})
+}
+
+// subscribeSticky answers the sticky SUB request m with the ACK once the
+// subscription is stored for the identity of c, and subscribes the other
+// connections of the identity. It returns false if m was NACKed.
+func subscribeSticky(c *Conn, m *message.Sub, addFn func(string, int64)) bool {
+	sb := checkSticky(c, m)
+	if sb == nil {
+		return false
+	}
+	if m.Payload.Acked {
+		c.Send(message.NewNack(m, message.CodeBadRequest, errors.New("acknowledged mode not supported for sticky subscriptions")))
+		return false
+	}
+
+	channel, pattern := m.Payload.Channel, m.Payload.Pattern
+	if err := c.psc.Subscribe(c.tenantName(channel), pattern); err != nil {
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return false
+	}
+	if err := sb.AddSticky(stickyKey(c), broker.Subscription{Channel: channel, Pattern: pattern}); err != nil {
+		addFn("FailedStickyUpdates", 1)
+		c.psc.Unsubscribe(c.tenantName(channel), pattern)
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return false
+	}
+	addFn("StickySubs", 1)
+	sendAck(c, m)
+
+	for _, oc := range sameIdentity(c) {
+		stickySubscribe(oc, channel, pattern)
+	}
+	return true
+}
+
+// unsubscribeSticky removes the sticky subscription of the UNSB request m
+// for the identity of c, and unsubscribes the other connections of the
+// identity. It returns false if m was NACKed, otherwise c itself must
+// still be unsubscribed.
+func unsubscribeSticky(c *Conn, m *message.Unsb, addFn func(string, int64)) bool {
+	sb := checkSticky(c, m)
+	if sb == nil {
+		return false
+	}
+
+	channel, pattern := m.Payload.Channel, m.Payload.Pattern
+	if err := sb.RemoveSticky(stickyKey(c), broker.Subscription{Channel: channel, Pattern: pattern}); err != nil {
+		addFn("FailedStickyUpdates", 1)
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return false
+	}
+	addFn("StickyUnsbs", 1)
+
+	for _, oc := range sameIdentity(c) {
+		if err := oc.psc.Unsubscribe(oc.tenantName(channel), pattern); err != nil {
+			continue
+		}
+		oc.removeCredits(channel, pattern)
+		oc.removeSub(oc.tenantName(channel), pattern)
+		if fn := oc.srv.OnUnsubscribe; fn != nil {
+			fn(oc, channel, pattern)
+		}
+	}
+	return true
+}
+
+// stickySubscribe subscribes c to the sticky subscription of its
+// identity to channel, as if it had sent the SUB request.
+func stickySubscribe(c *Conn, channel string, pattern bool) bool {
+	if err := c.psc.Subscribe(c.tenantName(channel), pattern); err != nil {
+		return false
+	}
+	c.addSub(c.tenantName(channel), pattern)
+	if fn := c.srv.OnSubscribe; fn != nil {
+		fn(c, channel, pattern)
+	}
+	return true
+}
+
+// restoreSticky subscribes the new connection c to the sticky
+// subscriptions of its identity.
+func restoreSticky(c *Conn) {
+	sb := c.srv.stickyBroker()
+	if sb == nil || c.Identity == "" || c.psc == nil {
+		return
+	}
+
+	subs, err := sb.Sticky(stickyKey(c))
+	var restored, failed int64
+	if err != nil {
+		failed++
+	}
+	for _, sub := range subs {
+		if stickySubscribe(c, sub.Channel, sub.Pattern) {
+			restored++
+		} else {
+			failed++
+		}
+	}
+	if c.srv.Vars != nil {
+		c.srv.Vars.Add("RestoredStickySubs", restored)
+		c.srv.Vars.Add("FailedStickyRestores", failed)
+	}
+}
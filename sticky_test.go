@@ -0,0 +1,138 @@
+package juggler_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/jugglertest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestSticky(t *testing.T) {
+	ids := make(chan string, 5)
+	for _, id := range []string{"u1", "u1", "u2", "", "u1"} {
+		ids <- id
+	}
+	vars := new(expvar.Map).Init()
+	brk := &jugglertest.Broker{}
+	server := &juggler.Server{
+		PubSubBroker: brk,
+		CallerBroker: brk,
+		Sticky:       true,
+		Vars:         vars,
+		ConnState: func(c *juggler.Conn, cs juggler.ConnState) {
+			if cs == juggler.Accepting {
+				c.Identity = <-ids
+			}
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	// the non-sticky SUB makes sure that the connection is served, with
+	// its sticky subscriptions restored
+	ctx := context.Background()
+	dial := func() (*client.Client, chan message.Msg) {
+		msgs := make(chan message.Msg, 10)
+		h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+			msgs <- m
+		})
+		cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, nil, client.SetHandler(h))
+		require.NoError(t, err, "Dial")
+		_, err = cli.Sub("z", false)
+		require.NoError(t, err, "Sub")
+		waitMsg(t, msgs, message.AckMsg, "Sub")
+		return cli, msgs
+	}
+	publish := func(label string) {
+		require.NoError(t, brk.Publish("a", &message.PubPayload{MsgUUID: message.NewID(), Args: json.RawMessage(`1`)}), label)
+	}
+	none := func(ch chan message.Msg, label string) {
+		select {
+		case m := <-ch:
+			assert.Fail(t, "unexpected message", "%s: %s", label, m.Type())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	cli1, msgs1 := dial()
+	defer cli1.Close()
+	cli2, msgs2 := dial()
+	defer cli2.Close()
+	cli3, msgs3 := dial()
+	defer cli3.Close()
+	anon, msgsAnon := dial()
+	defer anon.Close()
+
+	_, err := anon.SubSticky(ctx, "a", false)
+	require.NoError(t, err, "SubSticky anonymous")
+	m := <-msgsAnon
+	if nack, ok := m.(*message.Nack); assert.True(t, ok, "anonymous: NACK") {
+		assert.Equal(t, message.CodeUnauthorized, nack.Payload.Code, "anonymous: code")
+	}
+
+	// the sticky subscription applies to the other connection of u1
+	_, err = cli1.SubSticky(ctx, "a", false)
+	require.NoError(t, err, "SubSticky")
+	waitMsg(t, msgs1, message.AckMsg, "SubSticky")
+	publish("Publish")
+	waitMsg(t, msgs1, message.EvntMsg, "u1 connection 1")
+	waitMsg(t, msgs2, message.EvntMsg, "u1 connection 2")
+	none(msgs3, "u2")
+
+	// and to the connections of u1 opened later
+	cli4, msgs4 := dial()
+	defer cli4.Close()
+	publish("Publish after connect")
+	waitMsg(t, msgs4, message.EvntMsg, "u1 new connection")
+	for _, ch := range []chan message.Msg{msgs1, msgs2} {
+		waitMsg(t, ch, message.EvntMsg, "u1 connections")
+	}
+
+	// the sticky unsubscription removes it from all the connections
+	_, err = cli2.UnsbSticky(ctx, "a", false)
+	require.NoError(t, err, "UnsbSticky")
+	waitMsg(t, msgs2, message.AckMsg, "UnsbSticky")
+	publish("Publish after unsubscribe")
+	for i, ch := range []chan message.Msg{msgs1, msgs2, msgs3, msgs4} {
+		none(ch, "unsubscribed "+strconv.Itoa(i+1))
+	}
+	subs, err := brk.Sticky("u1")
+	require.NoError(t, err, "Sticky")
+	assert.Equal(t, 0, len(subs), "no sticky subscriptions")
+
+	assert.Equal(t, "1", vars.Get("StickySubs").String(), "subs metric")
+	assert.Equal(t, "1", vars.Get("StickyUnsbs").String(), "unsbs metric")
+	assert.Equal(t, "1", vars.Get("RestoredStickySubs").String(), "restored metric")
+}
+
+func TestStickyNotSupported(t *testing.T) {
+	server := &juggler.Server{PubSubBroker: &jugglertest.Broker{}}
+	c := juggler.NewDetachedConn(server)
+	c.Identity = "u1"
+	nacks := make(chan message.Msg, 1)
+	server.Handler = juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+		nacks <- m
+	})
+
+	sub := message.NewSub("a", false)
+	sub.Payload.Sticky = true
+	juggler.ProcessMsg(c, sub)
+	m := <-nacks
+	if nack, ok := m.(*message.Nack); assert.True(t, ok, "NACK") {
+		assert.Equal(t, message.CodeBadRequest, nack.Payload.Code, "code")
+	}
+}
@@ -0,0 +1,44 @@
+package juggler
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// ErrInvalidTenant is the error of the connections closed because their
+// Tenant is not a valid tenant (see message.ValidTenant).
+var ErrInvalidTenant = errors.New("juggler: invalid tenant")
+
+// tenantName returns the name of the URI or channel in the broker, in
+// the namespace of the tenant of the connection if it has one.
+func (c *Conn) tenantName(name string) string {
+	return message.TenantName(c.Tenant, name)
+}
+
+// tenantCall returns the call m with its URI in the namespace of the
+// tenant of the connection. The result is sent with the URI of m.
+func tenantCall(c *Conn, m *message.Call) *message.Call {
+	tm := *m
+	tm.Payload.URI = c.tenantName(m.Payload.URI)
+	return &tm
+}
+
+// tenantEvnt returns the event received from the broker with its channel
+// and pattern stripped of the namespace of the tenant of the connection,
+// or nil if it is not in that namespace.
+func (c *Conn) tenantEvnt(ev *message.EvntPayload) *message.EvntPayload {
+	if c.Tenant == "" || ev == nil {
+		return ev
+	}
+
+	prefix := c.Tenant + message.TenantSeparator
+	if !strings.HasPrefix(ev.Channel, prefix) {
+		return nil
+	}
+	te := *ev
+	te.Channel = strings.TrimPrefix(ev.Channel, prefix)
+	te.Pattern = strings.TrimPrefix(ev.Pattern, prefix)
+	return &te
+}
@@ -0,0 +1,145 @@
+package juggler_test
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// memPubSubBroker delivers the events to the connections subscribed to
+// the exact channel.
+type memPubSubBroker struct {
+	mu   sync.Mutex
+	pubs []string
+	subs map[string][]*fakePubSubConn
+}
+
+func (b *memPubSubBroker) Publish(channel string, pp *message.PubPayload) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pubs = append(b.pubs, channel)
+	for _, psc := range b.subs[channel] {
+		psc.ch <- &message.EvntPayload{MsgUUID: pp.MsgUUID, Channel: channel, Args: pp.Args}
+	}
+	return nil
+}
+
+func (b *memPubSubBroker) NewPubSubConn() (broker.PubSubConn, error) {
+	return &memPubSubConn{fakePubSubConn: &fakePubSubConn{ch: make(chan *message.EvntPayload, 10)}, b: b}, nil
+}
+
+type memPubSubConn struct {
+	*fakePubSubConn
+	b *memPubSubBroker
+}
+
+func (c *memPubSubConn) Subscribe(channel string, pattern bool) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.b.subs == nil {
+		c.b.subs = make(map[string][]*fakePubSubConn)
+	}
+	c.b.subs[channel] = append(c.b.subs[channel], c.fakePubSubConn)
+	return nil
+}
+
+func TestTenant(t *testing.T) {
+	psb := &memPubSubBroker{}
+	tenants := make(chan string, 1)
+	vars := new(expvar.Map).Init()
+	server := &juggler.Server{
+		CallerBroker: echoURIBroker{ch: make(chan *message.ResPayload, 10)},
+		PubSubBroker: psb,
+		Vars:         vars,
+		ConnState: func(c *juggler.Conn, cs juggler.ConnState) {
+			if cs == juggler.Accepting {
+				c.Tenant = <-tenants
+			}
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	dial := func(tenant, allowed string) (*client.Client, <-chan message.Msg) {
+		msgs := make(chan message.Msg, 10)
+		h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+			switch m.(type) {
+			case *message.Res, *message.Evnt:
+				msgs <- m
+			}
+		})
+		tenants <- tenant
+		cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+			http.Header{"Juggler-Allowed-Messages": {allowed}}, client.SetHandler(h))
+		require.NoError(t, err, "Dial %s", tenant)
+		return cli, msgs
+	}
+	cli1, msgs1 := dial("t1", "call,pub,sub")
+	defer cli1.Close()
+	cli2, msgs2 := dial("t2", "sub")
+	defer cli2.Close()
+
+	// calls are sent to the URI of the tenant, and answered with the URI
+	// of the request
+	_, err := cli1.Call("a.b", nil, time.Second)
+	require.NoError(t, err, "Call")
+	select {
+	case m := <-msgs1:
+		if res, ok := m.(*message.Res); assert.True(t, ok, "RES") {
+			assert.Equal(t, "a.b", res.Payload.URI, "RES URI")
+			assert.Equal(t, `"t1/a.b"`, string(res.Payload.Args), "called URI")
+		}
+	case <-time.After(time.Second):
+		assert.Fail(t, "no RES")
+	}
+
+	// events are only received by the subscribers of the same tenant
+	for _, cli := range []*client.Client{cli1, cli2} {
+		_, err := cli.Sub("c", false)
+		require.NoError(t, err, "Sub")
+	}
+	time.Sleep(50 * time.Millisecond)
+	_, err = cli1.Pub("c", 1)
+	require.NoError(t, err, "Pub")
+	select {
+	case m := <-msgs1:
+		if ev, ok := m.(*message.Evnt); assert.True(t, ok, "EVNT") {
+			assert.Equal(t, "c", ev.Payload.Channel, "EVNT channel")
+		}
+	case <-time.After(time.Second):
+		assert.Fail(t, "no EVNT")
+	}
+	select {
+	case m := <-msgs2:
+		assert.Fail(t, "EVNT of another tenant", "%v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	psb.mu.Lock()
+	assert.Equal(t, []string{"t1/c"}, psb.pubs, "published channels")
+	psb.mu.Unlock()
+
+	// a connection with an invalid tenant is closed
+	cli3, _ := dial("t1/t2", "sub")
+	select {
+	case <-cli3.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "invalid tenant not closed")
+	}
+	assert.Equal(t, "1", vars.Get("InvalidTenantConns").String(), "InvalidTenantConns")
+}
@@ -0,0 +1,36 @@
+package juggler
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// timeSync answers the time synchronization CALL with the ACK and the
+// RES holding the server times.
+func timeSync(c *Conn, m *message.Call, addFn func(string, int64)) {
+	received := time.Now().UTC()
+
+	var ts message.TimeSync
+	if err := json.Unmarshal(m.Payload.Args, &ts); err != nil {
+		c.Send(message.NewNack(m, message.CodeBadRequest, err))
+		return
+	}
+	ts.ReceiveTime = received
+	ts.TransmitTime = time.Now().UTC()
+	b, err := json.Marshal(ts)
+	if err != nil {
+		c.Send(message.NewNack(m, message.CodeHandlerError, err))
+		return
+	}
+
+	addFn("TimeSyncs", 1)
+	sendAck(c, m)
+	c.Send(message.NewRes(&message.ResPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      m.Payload.URI,
+		Args:     b,
+	}))
+}
@@ -0,0 +1,68 @@
+package juggler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeCallerBroker struct {
+	broker.CallerBroker
+}
+
+func (f fakeCallerBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return fakeResultsConn{make(chan *message.ResPayload)}, nil
+}
+
+type fakeResultsConn struct {
+	ch chan *message.ResPayload
+}
+
+func (f fakeResultsConn) Results() <-chan *message.ResPayload { return f.ch }
+func (f fakeResultsConn) ResultsErr() error                   { return nil }
+func (f fakeResultsConn) Close() error                        { close(f.ch); return nil }
+
+func TestTimeSync(t *testing.T) {
+	server := &juggler.Server{CallerBroker: fakeCallerBroker{}, TimeSync: true}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	offset, err := cli.SyncClock(3, time.Second)
+	require.NoError(t, err, "SyncClock")
+	// same clock for client and server
+	assert.True(t, offset > -100*time.Millisecond && offset < 100*time.Millisecond, "offset %s", offset)
+	assert.Equal(t, offset, cli.ClockOffset(), "ClockOffset")
+
+	select {
+	case m := <-msgs:
+		assert.Fail(t, "unexpected message", "%s", m.Type())
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	ev := message.NewEvnt(&message.EvntPayload{Channel: "a", Timestamp: time.Now().Add(-time.Second)})
+	lag := cli.EventLag(ev)
+	assert.True(t, lag >= 900*time.Millisecond && lag < 1100*time.Millisecond, "lag %s", lag)
+}
@@ -0,0 +1,486 @@
+package wamp
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/client"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// The default options of the Proxy.
+const (
+	DefaultHelloTimeout = 10 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// DefaultForwardHeaders is the list of headers of the handshake of the
+// WAMP clients sent in the handshake of their juggler connection, if
+// Proxy.ForwardHeaders is nil.
+var DefaultForwardHeaders = []string{"Authorization", "Cookie"}
+
+// Proxy is an http.Handler that serves the WAMP clients, and translates
+// their messages to the messages of a juggler connection to the server
+// at URL, one for each WAMP client. The zero value is not usable, URL
+// must be set.
+type Proxy struct {
+	// URL is the websocket URL of the juggler server.
+	URL string
+
+	// Dialer is the websocket dialer of the juggler connections, a zero
+	// Dialer if nil (see client.Dial).
+	Dialer *websocket.Dialer
+
+	// Upgrader upgrades the connections of the WAMP clients, a zero
+	// Upgrader if nil. Its Subprotocols field is ignored, the
+	// connections are upgraded with the Subprotocol of WAMP.
+	Upgrader *websocket.Upgrader
+
+	// ForwardHeaders is the list of headers of the handshake of the WAMP
+	// clients sent in the handshake of their juggler connection,
+	// DefaultForwardHeaders if nil.
+	ForwardHeaders []string
+
+	// Options are the options of the juggler clients, e.g. to set the
+	// default timeout of the calls that have no timeout option. The
+	// handler of the messages is set by the proxy.
+	Options []client.Option
+
+	// HelloTimeout is the time allowed to receive the HELLO message of
+	// a WAMP client, DefaultHelloTimeout if it is <= 0.
+	HelloTimeout time.Duration
+
+	// WriteTimeout is the time allowed to write a message to a WAMP
+	// client, DefaultWriteTimeout if it is <= 0.
+	WriteTimeout time.Duration
+
+	// Vars can be set to track the number of TotalWAMPConns,
+	// ActiveWAMPConns, RejectedWAMPConns, WAMPRequests, WAMPErrors and
+	// InvalidWAMPMsgs.
+	Vars *expvar.Map
+
+	// LogFunc is the logging function, log.Printf if nil.
+	LogFunc func(string, ...interface{})
+}
+
+// ServeHTTP upgrades the connection of the WAMP client and serves it
+// until it says goodbye or the connection fails. The client is
+// disconnected when its juggler connection is closed.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var upg websocket.Upgrader
+	if p.Upgrader != nil {
+		upg = *p.Upgrader
+	}
+	upg.Subprotocols = []string{Subprotocol}
+	conn, err := upg.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	p.add("TotalWAMPConns", 1)
+	if conn.Subprotocol() != Subprotocol {
+		p.add("RejectedWAMPConns", 1)
+		p.logf("wamp: %s: no %s subprotocol", r.RemoteAddr, Subprotocol)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &session{
+		p:      p,
+		conn:   conn,
+		ctx:    ctx,
+		subs:   make(map[string]uint64),
+		topics: make(map[uint64]string),
+		reqs:   make(map[string]uint64),
+		pubs:   make(map[string]uint64),
+	}
+	if err := s.hello(p.forwardHeader(r.Header)); err != nil {
+		p.add("RejectedWAMPConns", 1)
+		p.logf("wamp: %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer s.cli.Close()
+
+	p.add("ActiveWAMPConns", 1)
+	defer p.add("ActiveWAMPConns", -1)
+
+	if err := s.serve(); err != nil {
+		p.logf("wamp: %s: %v", r.RemoteAddr, err)
+	}
+}
+
+// forwardHeader returns the headers of h sent in the handshake of the
+// juggler connection.
+func (p *Proxy) forwardHeader(h http.Header) http.Header {
+	names := p.ForwardHeaders
+	if names == nil {
+		names = DefaultForwardHeaders
+	}
+	fh := make(http.Header)
+	for _, name := range names {
+		if v, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			fh[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	return fh
+}
+
+func (p *Proxy) add(key string, n int64) {
+	if p.Vars != nil {
+		p.Vars.Add(key, n)
+	}
+}
+
+func (p *Proxy) logf(f string, args ...interface{}) {
+	if p.LogFunc != nil {
+		p.LogFunc(f, args...)
+		return
+	}
+	log.Printf(f, args...)
+}
+
+// errGoodbye is returned by session.handle when the client sends a
+// GOODBYE message.
+var errGoodbye = errors.New("wamp: goodbye")
+
+// session is the WAMP session of a client, and its juggler connection.
+type session struct {
+	p    *Proxy
+	conn *websocket.Conn
+	cli  *client.Client
+	ctx  context.Context // canceled when the session ends
+
+	wmu sync.Mutex // lock to write on conn
+
+	// mu protects the subscriptions and the requests waiting for their
+	// ACK. It is held while a request is sent, so that its ACK is
+	// handled once it is registered.
+	mu     sync.Mutex
+	lastID uint64            // last subscription ID, in the session scope
+	subs   map[string]uint64 // subscription IDs by topic
+	topics map[uint64]string // topics by subscription ID
+	reqs   map[string]uint64 // request IDs of the SUBSCRIBE and UNSUBSCRIBE, by UUID of the juggler request
+	pubs   map[string]uint64 // request IDs of the acknowledged PUBLISH, by UUID of the juggler request
+}
+
+// hello receives the HELLO message of the client, connects to the
+// juggler server with header and sends the WELCOME message.
+func (s *session) hello(header http.Header) error {
+	timeout := s.p.HelloTimeout
+	if timeout <= 0 {
+		timeout = DefaultHelloTimeout
+	}
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	_, b, err := s.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if code, _, err := decodeFrame(b); err != nil || code != helloMsg {
+		s.p.add("InvalidWAMPMsgs", 1)
+		s.write(abortMsg, map[string]string{}, errProtocolViolation)
+		return errors.New("wamp: no HELLO message")
+	}
+	s.conn.SetReadDeadline(time.Time{})
+
+	d := s.p.Dialer
+	if d == nil {
+		d = &websocket.Dialer{}
+	}
+	opts := append(append([]client.Option(nil), s.p.Options...), client.SetHandler(client.HandlerFunc(s.handleMsg)))
+	cli, err := client.Dial(d, s.p.URL, header, opts...)
+	if err != nil {
+		s.write(abortMsg, map[string]string{"message": err.Error()}, ErrorURI(message.CodeUnavailable))
+		return err
+	}
+	s.cli = cli
+
+	details := map[string]interface{}{
+		"agent": "juggler",
+		"roles": map[string]interface{}{
+			"broker": map[string]interface{}{},
+			"dealer": map[string]interface{}{},
+		},
+	}
+	return s.write(welcomeMsg, newID(), details)
+}
+
+// serve handles the messages of the client until it says goodbye or
+// the connection fails, or the juggler connection is closed.
+func (s *session) serve() error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.cli.CloseNotify():
+			s.write(goodbyeMsg, map[string]string{}, closeSystemShutdown)
+			s.conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		_, b, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+		if err := s.handle(b); err != nil {
+			if err == errGoodbye {
+				return nil
+			}
+			if err == errMalformed {
+				s.p.add("InvalidWAMPMsgs", 1)
+				s.write(abortMsg, map[string]string{}, errProtocolViolation)
+			}
+			return err
+		}
+	}
+}
+
+// handle translates the WAMP message b to a juggler request. It
+// returns errMalformed if b violates the protocol, or the error of
+// the juggler connection.
+func (s *session) handle(b []byte) error {
+	code, elems, err := decodeFrame(b)
+	if err != nil {
+		return errMalformed
+	}
+
+	switch code {
+	case goodbyeMsg:
+		s.write(goodbyeMsg, map[string]string{}, closeGoodbyeAndOut)
+		return errGoodbye
+
+	case publishMsg:
+		var id uint64
+		var opts struct {
+			Acknowledge bool `json:"acknowledge"`
+		}
+		var topic string
+		if err := fields(elems, &id, &opts, &topic); err != nil {
+			return err
+		}
+		s.p.add("WAMPRequests", 1)
+		args, err := jugglerArgs(elems[3:])
+		if err != nil {
+			return s.error(code, id, errInvalidArgument, err.Error())
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		uid, err := s.cli.Pub(topic, args)
+		if err != nil {
+			return err
+		}
+		if opts.Acknowledge {
+			s.pubs[uid.String()] = id
+		}
+
+	case subscribeMsg:
+		var id uint64
+		var opts struct {
+			Match string `json:"match"`
+		}
+		var topic string
+		if err := fields(elems, &id, &opts, &topic); err != nil {
+			return err
+		}
+		s.p.add("WAMPRequests", 1)
+		if opts.Match != "" && opts.Match != "exact" {
+			return s.error(code, id, errOptionNotAllowed, "only the exact match policy is supported")
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if subID, ok := s.subs[topic]; ok {
+			// already subscribed, the subscription is the same
+			return s.write(subscribedMsg, id, subID)
+		}
+		uid, err := s.cli.Sub(topic, false)
+		if err != nil {
+			return err
+		}
+		s.lastID++
+		s.subs[topic] = s.lastID
+		s.topics[s.lastID] = topic
+		s.reqs[uid.String()] = id
+
+	case unsubscribeMsg:
+		var id, subID uint64
+		if err := fields(elems, &id, &subID); err != nil {
+			return err
+		}
+		s.p.add("WAMPRequests", 1)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		topic, ok := s.topics[subID]
+		if !ok {
+			return s.error(code, id, errNoSuchSubscription, "")
+		}
+		uid, err := s.cli.Unsb(topic, false)
+		if err != nil {
+			return err
+		}
+		delete(s.topics, subID)
+		delete(s.subs, topic)
+		s.reqs[uid.String()] = id
+
+	case callMsg:
+		var id uint64
+		var opts struct {
+			Timeout int64 `json:"timeout"` // in milliseconds
+		}
+		var procedure string
+		if err := fields(elems, &id, &opts, &procedure); err != nil {
+			return err
+		}
+		s.p.add("WAMPRequests", 1)
+		args, err := jugglerArgs(elems[3:])
+		if err != nil {
+			return s.error(code, id, errInvalidArgument, err.Error())
+		}
+		go s.call(id, procedure, args, time.Duration(opts.Timeout)*time.Millisecond)
+
+	case registerMsg, unregisterMsg:
+		var id uint64
+		if err := fields(elems, &id); err != nil {
+			return err
+		}
+		return s.error(code, id, errCalleeNotSupported, "")
+
+	default:
+		return errMalformed
+	}
+	return nil
+}
+
+// call invokes procedure with args and sends its RESULT, or an ERROR.
+// The default call timeout of the client applies if timeout is 0.
+func (s *session) call(id uint64, procedure string, args json.RawMessage, timeout time.Duration) {
+	var res json.RawMessage
+	err := s.cli.Invoke(s.ctx, procedure, args, &res, timeout)
+	switch err := err.(type) {
+	case nil:
+		s.write(resultMsg, id, map[string]string{}, wampArgs(res))
+	case *client.Error:
+		s.error(callMsg, id, ErrorURI(err.Code), err.Message)
+	case *client.ResultError:
+		s.error(callMsg, id, errRuntime, err.Message)
+	default:
+		if err == client.ErrCallExpired {
+			s.error(callMsg, id, ErrorURI(message.CodeTimeout), "call expired")
+			return
+		}
+		s.error(callMsg, id, ErrorURI(message.CodeUnavailable), err.Error())
+	}
+}
+
+// handleMsg translates the messages of the juggler connection
+// to WAMP messages.
+func (s *session) handleMsg(ctx context.Context, m message.Msg) {
+	switch m := m.(type) {
+	case *message.Ack:
+		switch m.Payload.ForType {
+		case message.PubMsg:
+			if id, ok := s.take(s.pubs, m.Payload.For); ok {
+				s.write(publishedMsg, id, newID())
+			}
+		case message.SubMsg:
+			if id, ok := s.take(s.reqs, m.Payload.For); ok {
+				s.mu.Lock()
+				subID := s.subs[m.Payload.Channel]
+				s.mu.Unlock()
+				s.write(subscribedMsg, id, subID)
+			}
+		case message.UnsbMsg:
+			if id, ok := s.take(s.reqs, m.Payload.For); ok {
+				s.write(unsubscribedMsg, id)
+			}
+		}
+
+	case *message.Nack:
+		var id uint64
+		var ok bool
+		var code int
+		switch m.Payload.ForType {
+		case message.PubMsg:
+			id, ok = s.take(s.pubs, m.Payload.For)
+			code = publishMsg
+		case message.SubMsg:
+			id, ok = s.take(s.reqs, m.Payload.For)
+			code = subscribeMsg
+			s.mu.Lock()
+			if subID, sok := s.subs[m.Payload.Channel]; sok {
+				delete(s.subs, m.Payload.Channel)
+				delete(s.topics, subID)
+			}
+			s.mu.Unlock()
+		case message.UnsbMsg:
+			id, ok = s.take(s.reqs, m.Payload.For)
+			code = unsubscribeMsg
+		}
+		if ok {
+			s.error(code, id, ErrorURI(m.Payload.Code), m.Payload.Message)
+		}
+
+	case *message.Evnt:
+		s.mu.Lock()
+		subID, ok := s.subs[m.Payload.Channel]
+		s.mu.Unlock()
+		if ok {
+			s.write(eventMsg, subID, newID(), map[string]string{}, wampArgs(m.Payload.Args))
+		}
+	}
+}
+
+// take removes and returns the request ID of the juggler request id
+// from reqs.
+func (s *session) take(reqs map[string]uint64, id uuid.UUID) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := id.String()
+	reqID, ok := reqs[key]
+	delete(reqs, key)
+	return reqID, ok
+}
+
+// error sends the ERROR message for the request id of type code.
+func (s *session) error(code int, id uint64, uri, msg string) error {
+	s.p.add("WAMPErrors", 1)
+	if msg == "" {
+		return s.write(errorMsg, code, id, map[string]string{}, uri)
+	}
+	return s.write(errorMsg, code, id, map[string]string{}, uri, []string{msg})
+}
+
+// write sends the WAMP message made of elems to the client. A trailing
+// nil element is omitted, e.g. the empty arguments of a RESULT.
+func (s *session) write(elems ...interface{}) error {
+	if n := len(elems); n > 0 {
+		if raw, ok := elems[n-1].(json.RawMessage); ok && raw == nil {
+			elems = elems[:n-1]
+		}
+	}
+	timeout := s.p.WriteTimeout
+	if timeout <= 0 {
+		timeout = DefaultWriteTimeout
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(timeout))
+	return s.conn.WriteJSON(elems)
+}
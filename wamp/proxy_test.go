@@ -0,0 +1,208 @@
+package wamp
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler"
+	"github.com/PuerkitoBio/juggler/callee"
+	"github.com/PuerkitoBio/juggler/jugglertest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestArgs(t *testing.T) {
+	cases := []struct {
+		in   string // elements after the URI of the WAMP message
+		args string
+		err  bool
+	}{
+		{`[]`, ``, false},
+		{`[[]]`, ``, false},
+		{`[[1]]`, `1`, false},
+		{`[[1, "a"]]`, `[1, "a"]`, false},
+		{`[[], {"a": 1}]`, `{"a": 1}`, false},
+		{`[[1], {"a": 1}]`, ``, true},
+		{`[{"a": 1}]`, ``, true},
+		{`[[], 1]`, ``, true},
+	}
+	for _, c := range cases {
+		var elems []json.RawMessage
+		require.NoError(t, json.Unmarshal([]byte(c.in), &elems), c.in)
+		args, err := jugglerArgs(elems)
+		if c.err {
+			assert.Error(t, err, c.in)
+			continue
+		}
+		if assert.NoError(t, err, c.in) {
+			assert.Equal(t, c.args, string(args), c.in)
+		}
+	}
+
+	assert.Equal(t, `[1]`, string(wampArgs(json.RawMessage(`1`))), "single")
+	assert.Equal(t, `[1,2]`, string(wampArgs(json.RawMessage(` [1,2]`))), "array")
+	assert.Nil(t, wampArgs(json.RawMessage(`null`)), "null")
+	assert.Equal(t, "wamp.error.not_authorized", ErrorURI(message.CodeForbidden), "ErrorURI 403")
+	assert.Equal(t, "juggler.error.429", ErrorURI(message.CodeRateLimited), "ErrorURI 429")
+}
+
+// wampClient is a minimal WAMP client.
+type wampClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func (c *wampClient) send(elems ...interface{}) {
+	require.NoError(c.t, c.conn.WriteJSON(elems), "send %v", elems[0])
+}
+
+func (c *wampClient) recv(code int) []json.RawMessage {
+	got, elems := c.recvAny()
+	require.Equal(c.t, code, got, "message code")
+	return elems
+}
+
+func (c *wampClient) recvAny() (int, []json.RawMessage) {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, b, err := c.conn.ReadMessage()
+	require.NoError(c.t, err, "receive")
+	code, elems, err := decodeFrame(b)
+	require.NoError(c.t, err, "decode %s", b)
+	return code, elems
+}
+
+func TestProxy(t *testing.T) {
+	brk := &jugglertest.Broker{}
+	server := &juggler.Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		Handler: juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+			if sub, ok := m.(*message.Sub); ok && sub.Payload.Channel == "private" {
+				c.Send(message.NewNack(m, message.CodeForbidden, errors.New("forbidden")))
+				return
+			}
+			juggler.ProcessMsg(c, m)
+		}),
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	defer srv.Close()
+
+	cle := &callee.Callee{Broker: brk, LogFunc: func(string, ...interface{}) {}}
+	go cle.Listen(map[string]callee.Thunk{
+		"add": func(cp *message.CallPayload) (interface{}, error) {
+			var v []int
+			if err := json.Unmarshal(cp.Args, &v); err != nil {
+				return nil, err
+			}
+			return v[0] + v[1], nil
+		},
+		"fail": func(cp *message.CallPayload) (interface{}, error) {
+			return nil, errors.New("failed")
+		},
+	})
+
+	vars := new(expvar.Map).Init()
+	proxy := &Proxy{
+		URL:     strings.Replace(srv.URL, "http:", "ws:", 1),
+		Vars:    vars,
+		LogFunc: func(string, ...interface{}) {},
+	}
+	psrv := httptest.NewServer(proxy)
+	defer psrv.Close()
+
+	d := &websocket.Dialer{Subprotocols: []string{Subprotocol}}
+	conn, _, err := d.Dial(strings.Replace(psrv.URL, "http:", "ws:", 1), http.Header{})
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+	cli := &wampClient{t: t, conn: conn}
+
+	cli.send(helloMsg, "realm1", map[string]interface{}{"roles": map[string]interface{}{}})
+	cli.recv(welcomeMsg)
+
+	// calls
+	cli.send(callMsg, 1, map[string]interface{}{}, "add", []int{1, 2})
+	elems := cli.recv(resultMsg)
+	assert.Equal(t, "1", string(elems[0]), "RESULT request")
+	assert.Equal(t, "[3]", string(elems[2]), "RESULT arguments")
+
+	cli.send(callMsg, 2, map[string]interface{}{}, "fail")
+	elems = cli.recv(errorMsg)
+	assert.Equal(t, "48", string(elems[0]), "ERROR type")
+	assert.Equal(t, `"wamp.error.runtime_error"`, string(elems[3]), "ERROR URI")
+
+	cli.send(callMsg, 3, map[string]interface{}{"timeout": 50}, "none")
+	elems = cli.recv(errorMsg)
+	assert.Equal(t, `"wamp.error.canceled"`, string(elems[3]), "expired ERROR URI")
+
+	// subscriptions
+	cli.send(subscribeMsg, 4, map[string]interface{}{}, "private")
+	elems = cli.recv(errorMsg)
+	assert.Equal(t, `"wamp.error.not_authorized"`, string(elems[3]), "denied SUBSCRIBE")
+
+	cli.send(subscribeMsg, 5, map[string]interface{}{}, "news")
+	elems = cli.recv(subscribedMsg)
+	assert.Equal(t, "5", string(elems[0]), "SUBSCRIBED request")
+	var subID uint64
+	require.NoError(t, json.Unmarshal(elems[1], &subID), "subscription ID")
+
+	cli.send(publishMsg, 6, map[string]interface{}{"acknowledge": true}, "news", []interface{}{}, map[string]string{"title": "x"})
+	// the juggler messages are handled concurrently, in any order
+	msgs := map[int][]json.RawMessage{}
+	for i := 0; i < 2; i++ {
+		code, elems := cli.recvAny()
+		msgs[code] = elems
+	}
+	require.Contains(t, msgs, publishedMsg, "PUBLISHED")
+	elems = msgs[eventMsg]
+	require.NotNil(t, elems, "EVENT")
+	assert.Equal(t, subID, mustUint(t, elems[0]), "EVENT subscription")
+	assert.JSONEq(t, `[{"title": "x"}]`, string(elems[3]), "EVENT arguments")
+
+	cli.send(unsubscribeMsg, 7, subID)
+	cli.recv(unsubscribedMsg)
+	cli.send(unsubscribeMsg, 8, subID)
+	elems = cli.recv(errorMsg)
+	assert.Equal(t, `"wamp.error.no_such_subscription"`, string(elems[3]), "unknown subscription")
+
+	cli.send(goodbyeMsg, map[string]string{}, "wamp.close.close_realm")
+	cli.recv(goodbyeMsg)
+
+	assert.Equal(t, "1", vars.Get("TotalWAMPConns").String(), "TotalWAMPConns")
+	assert.Equal(t, "8", vars.Get("WAMPRequests").String(), "WAMPRequests")
+	assert.Equal(t, "4", vars.Get("WAMPErrors").String(), "WAMPErrors")
+}
+
+func mustUint(t *testing.T, b json.RawMessage) uint64 {
+	var v uint64
+	require.NoError(t, json.Unmarshal(b, &v), "decode %s", b)
+	return v
+}
+
+func TestProxyNoHello(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	proxy := &Proxy{URL: "ws://127.0.0.1:1", Vars: vars, LogFunc: func(string, ...interface{}) {}}
+	psrv := httptest.NewServer(proxy)
+	defer psrv.Close()
+
+	d := &websocket.Dialer{Subprotocols: []string{Subprotocol}}
+	conn, _, err := d.Dial(strings.Replace(psrv.URL, "http:", "ws:", 1), nil)
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+	cli := &wampClient{t: t, conn: conn}
+
+	cli.send(callMsg, 1, map[string]interface{}{}, "add")
+	elems := cli.recv(abortMsg)
+	assert.Equal(t, `"wamp.error.protocol_violation"`, string(elems[1]), "ABORT reason")
+	assert.Equal(t, "1", vars.Get("RejectedWAMPConns").String(), "RejectedWAMPConns")
+	assert.Equal(t, "1", vars.Get("InvalidWAMPMsgs").String(), "InvalidWAMPMsgs")
+}
@@ -0,0 +1,191 @@
+// Package wamp is an interoperability shim for the WAMP clients (e.g.
+// Autobahn), so that they can connect to a juggler server during a
+// migration. The Proxy accepts the websocket connections of the WAMP
+// clients with the "wamp.2.json" subprotocol, and opens a juggler
+// connection to the server for each of them, with some of the headers
+// of their handshake (see Proxy.ForwardHeaders), so that they are
+// authenticated and authorized by the juggler server as any client.
+//
+// The messages of the basic profile of the publisher, subscriber and
+// caller roles of WAMP are translated to and from juggler messages:
+//
+//	PUBLISH      PUB   (PUBLISHED for the ACK, if acknowledge is set)
+//	SUBSCRIBE    SUB   (SUBSCRIBED for the ACK)
+//	UNSUBSCRIBE  UNSB  (UNSUBSCRIBED for the ACK)
+//	CALL         CALL  (RESULT for the RES)
+//	EVENT        EVNT
+//
+// The NACKs, the error results and the expired calls are sent as ERROR
+// messages, with the URIs returned by ErrorURI. The realm of the HELLO
+// message is ignored, the juggler server has no realms. The callee role
+// is not supported, the juggler callees listen on the broker (see
+// package callee), and neither are the features of the advanced
+// profile, such as the pattern-based subscriptions or the progressive
+// call results.
+//
+// The arguments of the juggler messages are a single JSON value: a WAMP
+// message with a single positional argument has that argument as
+// juggler arguments, one with multiple positional arguments the array
+// of the arguments, and one with keyword arguments only the object of
+// the keyword arguments. The WAMP messages with both are refused. The
+// other way around, the juggler arguments are the positional arguments
+// if they are an array, the single positional argument otherwise.
+package wamp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/PuerkitoBio/juggler/message"
+)
+
+// Subprotocol is the websocket subprotocol of the WAMP clients, the
+// JSON serialization of WAMP v2.
+const Subprotocol = "wamp.2.json"
+
+// The codes of the WAMP messages.
+const (
+	helloMsg        = 1
+	welcomeMsg      = 2
+	abortMsg        = 3
+	goodbyeMsg      = 6
+	errorMsg        = 8
+	publishMsg      = 16
+	publishedMsg    = 17
+	subscribeMsg    = 32
+	subscribedMsg   = 33
+	unsubscribeMsg  = 34
+	unsubscribedMsg = 35
+	eventMsg        = 36
+	callMsg         = 48
+	resultMsg       = 50
+	registerMsg     = 64
+	unregisterMsg   = 66
+)
+
+// The URIs of the reasons and errors of WAMP.
+const (
+	closeGoodbyeAndOut    = "wamp.close.goodbye_and_out"
+	closeSystemShutdown   = "wamp.close.system_shutdown"
+	errProtocolViolation  = "wamp.error.protocol_violation"
+	errInvalidArgument    = "wamp.error.invalid_argument"
+	errNotAuthorized      = "wamp.error.not_authorized"
+	errNoSuchProcedure    = "wamp.error.no_such_procedure"
+	errNoSuchSubscription = "wamp.error.no_such_subscription"
+	errCanceled           = "wamp.error.canceled"
+	errOptionNotAllowed   = "wamp.error.option_not_allowed"
+	errRuntime            = "wamp.error.runtime_error"
+
+	// errCalleeNotSupported is the error of the REGISTER and UNREGISTER
+	// messages.
+	errCalleeNotSupported = "juggler.error.callee_not_supported"
+)
+
+// maxID is the maximum value of the WAMP IDs, 2^53.
+const maxID = 1 << 53
+
+var errMalformed = errors.New("wamp: malformed message")
+
+// ErrorURI returns the URI of the WAMP ERROR message for the code of
+// a juggler NACK, e.g. "wamp.error.not_authorized" for
+// message.CodeUnauthorized and message.CodeForbidden. The codes that
+// have no equivalent in WAMP return "juggler.error.<code>".
+func ErrorURI(code int) string {
+	switch code {
+	case message.CodeBadRequest:
+		return errInvalidArgument
+	case message.CodeUnauthorized, message.CodeForbidden:
+		return errNotAuthorized
+	case message.CodeNoCallee:
+		return errNoSuchProcedure
+	case message.CodeTimeout:
+		return errCanceled
+	}
+	return fmt.Sprintf("juggler.error.%d", code)
+}
+
+// decodeFrame decodes the WAMP message b, and returns its code and its
+// other elements.
+func decodeFrame(b []byte) (int, []json.RawMessage, error) {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(b, &elems); err != nil {
+		return 0, nil, err
+	}
+	if len(elems) == 0 {
+		return 0, nil, errMalformed
+	}
+	var code int
+	if err := json.Unmarshal(elems[0], &code); err != nil {
+		return 0, nil, errMalformed
+	}
+	return code, elems[1:], nil
+}
+
+// fields decodes the first elements of a WAMP message into the values
+// of dst. It fails if the message has fewer elements than dst.
+func fields(elems []json.RawMessage, dst ...interface{}) error {
+	if len(elems) < len(dst) {
+		return errMalformed
+	}
+	for i, v := range dst {
+		if err := json.Unmarshal(elems[i], v); err != nil {
+			return errMalformed
+		}
+	}
+	return nil
+}
+
+// jugglerArgs returns the juggler arguments of the optional positional
+// and keyword arguments of a WAMP message, in elems.
+func jugglerArgs(elems []json.RawMessage) (json.RawMessage, error) {
+	var args []json.RawMessage
+	var kwargs map[string]json.RawMessage
+	if len(elems) > 0 {
+		if err := json.Unmarshal(elems[0], &args); err != nil {
+			return nil, errors.New("wamp: the positional arguments are not an array")
+		}
+	}
+	if len(elems) > 1 {
+		if err := json.Unmarshal(elems[1], &kwargs); err != nil {
+			return nil, errors.New("wamp: the keyword arguments are not an object")
+		}
+	}
+
+	switch {
+	case len(args) > 0 && len(kwargs) > 0:
+		return nil, errors.New("wamp: both positional and keyword arguments")
+	case len(kwargs) > 0:
+		return elems[1], nil
+	case len(args) == 1:
+		return args[0], nil
+	case len(args) > 1:
+		return elems[0], nil
+	}
+	return nil, nil
+}
+
+// wampArgs returns the positional arguments of a WAMP message for the
+// juggler arguments args, or nil if args is null or empty.
+func wampArgs(args json.RawMessage) json.RawMessage {
+	b := bytes.TrimSpace(args)
+	if len(b) == 0 || string(b) == "null" {
+		return nil
+	}
+	if b[0] == '[' {
+		return b
+	}
+	return json.RawMessage(append(append([]byte{'['}, b...), ']'))
+}
+
+// newID returns a random WAMP ID, in the global scope.
+func newID() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(b[:])%maxID + 1
+}
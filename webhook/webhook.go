@@ -0,0 +1,428 @@
+// Package webhook delivers the events of a pub-sub broker to HTTP
+// endpoints, so that external systems can consume the juggler events
+// without speaking the protocol. The Subscriber subscribes to the
+// channels and patterns of its Endpoints, and POSTs each event as the
+// JSON-encoded message.EvntPayload to the endpoints subscribed to it,
+// retrying the failed deliveries and signing the requests with
+// HMAC-SHA256 if the endpoint has a secret (see Verify). Each attempt
+// is recorded in the DeliveryLog.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// The headers set on the requests of the deliveries.
+const (
+	// SignatureHeader is the header of the signature of the body, in the
+	// form "sha256=<hex-encoded HMAC-SHA256>", set if the endpoint has a
+	// secret.
+	SignatureHeader = "Juggler-Signature"
+
+	// AttemptHeader is the header of the attempt number of the delivery,
+	// starting at 1.
+	AttemptHeader = "Juggler-Attempt"
+)
+
+// The default options of the Subscriber.
+const (
+	DefaultMaxAttempts = 5
+	DefaultRetryDelay  = time.Second
+	DefaultQueueSize   = 100
+	DefaultTimeout     = 10 * time.Second
+)
+
+const signaturePrefix = "sha256="
+
+// ErrClosed is returned by Listen when the Subscriber is closed.
+var ErrClosed = errors.New("webhook: subscriber closed")
+
+// Endpoint is an HTTP endpoint that receives the events of its
+// subscriptions.
+type Endpoint struct {
+	// URL is the URL that receives the POST requests of the events.
+	URL string
+
+	// Secret, if set, is the key of the HMAC-SHA256 signature of the
+	// requests, set in the SignatureHeader.
+	Secret []byte
+
+	// Subscriptions are the channels and patterns of the events to
+	// deliver to the endpoint. The names are those of the broker, with
+	// the tenant if any (see message.TenantName).
+	Subscriptions []broker.Subscription
+}
+
+// Delivery is the record of a delivery attempt of an event to an
+// endpoint.
+type Delivery struct {
+	// Time is the time in UTC at which the attempt started.
+	Time time.Time `json:"time"`
+
+	URL     string    `json:"url"`
+	MsgUUID uuid.UUID `json:"msg_uuid"`
+	Channel string    `json:"channel"`
+	Pattern string    `json:"pattern,omitempty"`
+	Attempt int       `json:"attempt"`
+
+	// Status is the HTTP status code of the response, 0 if the request
+	// failed.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// Retry is true if the delivery is attempted again.
+	Retry bool `json:"retry,omitempty"`
+
+	// Latency is the duration of the attempt.
+	Latency time.Duration `json:"latency"`
+}
+
+// DeliveryLog defines the method required to record the delivery
+// attempts.
+type DeliveryLog interface {
+	Write(*Delivery) error
+}
+
+// DeliveryLogFunc is a function signature that implements the
+// DeliveryLog interface.
+type DeliveryLogFunc func(*Delivery) error
+
+// Write implements DeliveryLog for the DeliveryLogFunc by calling the
+// function itself.
+func (fn DeliveryLogFunc) Write(d *Delivery) error {
+	return fn(d)
+}
+
+// JSONLog is a DeliveryLog that writes the deliveries as JSON lines,
+// one delivery per line.
+type JSONLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONLog returns a JSONLog that writes the deliveries to w.
+func NewJSONLog(w io.Writer) *JSONLog {
+	return &JSONLog{enc: json.NewEncoder(w)}
+}
+
+// Write implements DeliveryLog for the JSONLog.
+func (l *JSONLog) Write(d *Delivery) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(d)
+}
+
+// Sign returns the value of the SignatureHeader for body signed with
+// secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns true if sig, the value of the SignatureHeader, is the
+// signature of body with secret. The endpoints should verify the
+// signature of the requests before trusting the events.
+func Verify(secret, body []byte, sig string) bool {
+	if len(sig) <= len(signaturePrefix) || sig[:len(signaturePrefix)] != signaturePrefix {
+		return false
+	}
+	want, err := hex.DecodeString(sig[len(signaturePrefix):])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// Subscriber delivers the events of its Broker to the Endpoints. The
+// events are delivered to each endpoint in order, one at a time, and
+// queued while a delivery is in progress. The events are dropped if the
+// queue of the endpoint is full, or once all attempts failed: as the
+// pub-sub events, the deliveries are at most once.
+type Subscriber struct {
+	// Broker is the pub-sub broker of the events.
+	Broker broker.PubSubBroker
+
+	// Endpoints are the endpoints of the deliveries. They must not be
+	// changed once Listen is called.
+	Endpoints []*Endpoint
+
+	// Client is the HTTP client of the deliveries. If nil, a client
+	// with a timeout of DefaultTimeout is used.
+	Client *http.Client
+
+	// MaxAttempts is the maximum number of attempts to deliver an event,
+	// DefaultMaxAttempts if it is <= 0. The deliveries are attempted
+	// again if the request fails or the status code of the response is
+	// 429 or 5xx, they fail without retry for the other status codes
+	// that are not 2xx.
+	MaxAttempts int
+
+	// RetryDelay is the delay before the second attempt, doubled for
+	// each subsequent attempt. It is DefaultRetryDelay if it is <= 0.
+	RetryDelay time.Duration
+
+	// QueueSize is the number of events queued for each endpoint,
+	// DefaultQueueSize if it is <= 0.
+	QueueSize int
+
+	// Log, if set, records each delivery attempt.
+	Log DeliveryLog
+
+	// Vars can be set to track the number of WebhookDeliveries,
+	// FailedWebhookDeliveries, WebhookRetries and DroppedWebhookEvents.
+	Vars *expvar.Map
+
+	// LogFunc is the logging function, log.Printf if nil.
+	LogFunc func(string, ...interface{})
+
+	mu     sync.Mutex
+	psc    broker.PubSubConn
+	done   chan struct{}
+	closed bool
+}
+
+// Listen subscribes to the channels and patterns of the endpoints and
+// delivers the events until Close is called or the pub-sub connection
+// fails. It returns ErrClosed once closed, or the error of the
+// connection, after the deliveries in progress are done.
+func (s *Subscriber) Listen() error {
+	psc, err := s.Broker.NewPubSubConn()
+	if err != nil {
+		return err
+	}
+	defer psc.Close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.psc = psc
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	s.mu.Unlock()
+
+	subs := make(map[broker.Subscription][]chan *message.EvntPayload)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, ep := range s.Endpoints {
+		size := s.QueueSize
+		if size <= 0 {
+			size = DefaultQueueSize
+		}
+		q := make(chan *message.EvntPayload, size)
+		defer close(q)
+
+		wg.Add(1)
+		go func(ep *Endpoint) {
+			defer wg.Done()
+			for ev := range q {
+				s.deliver(ep, ev)
+			}
+		}(ep)
+
+		for _, sub := range ep.Subscriptions {
+			qs, ok := subs[sub]
+			if !ok {
+				if err := psc.Subscribe(sub.Channel, sub.Pattern); err != nil {
+					return err
+				}
+			}
+			if len(qs) > 0 && qs[len(qs)-1] == q {
+				// same subscription listed twice for the endpoint
+				continue
+			}
+			subs[sub] = append(qs, q)
+		}
+	}
+
+	for ev := range psc.Events() {
+		sub := broker.Subscription{Channel: ev.Channel}
+		if ev.Pattern != "" {
+			sub = broker.Subscription{Channel: ev.Pattern, Pattern: true}
+		}
+		for _, q := range subs[sub] {
+			select {
+			case q <- ev:
+			default:
+				s.add("DroppedWebhookEvents")
+				s.logf("webhook: queue full, dropped event %v on %s", ev.MsgUUID, ev.Channel)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	return psc.EventsErr()
+}
+
+// Close stops the subscriber: the pub-sub connection is closed, the
+// queued events are dropped and the failed deliveries are not attempted
+// again.
+func (s *Subscriber) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.done != nil {
+		close(s.done)
+	}
+	if s.psc != nil {
+		return s.psc.Close()
+	}
+	return nil
+}
+
+// isClosed returns true if the subscriber is closed.
+func (s *Subscriber) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// deliver delivers the event ev to the endpoint ep, with the retries.
+func (s *Subscriber) deliver(ep *Endpoint, ev *message.EvntPayload) {
+	if s.isClosed() {
+		return
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		s.add("FailedWebhookDeliveries")
+		s.logf("webhook: failed to encode event %v: %v", ev.MsgUUID, err)
+		return
+	}
+
+	max := s.MaxAttempts
+	if max <= 0 {
+		max = DefaultMaxAttempts
+	}
+	delay := s.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+
+	for attempt := 1; ; attempt++ {
+		d := &Delivery{
+			Time:    time.Now().UTC(),
+			URL:     ep.URL,
+			MsgUUID: ev.MsgUUID,
+			Channel: ev.Channel,
+			Pattern: ev.Pattern,
+			Attempt: attempt,
+		}
+		status, err := s.post(ep, body, attempt)
+		d.Latency = time.Now().Sub(d.Time)
+		d.Status = status
+
+		retry := false
+		if err != nil {
+			d.Error = err.Error()
+			retry = status == 0 || status == http.StatusTooManyRequests || status >= 500
+		}
+		d.Retry = retry && attempt < max
+		s.record(d)
+
+		if err == nil {
+			s.add("WebhookDeliveries")
+			return
+		}
+		if !d.Retry {
+			s.add("FailedWebhookDeliveries")
+			s.logf("webhook: failed to deliver event %v to %s after %d attempt(s): %v", ev.MsgUUID, ep.URL, attempt, err)
+			return
+		}
+
+		s.add("WebhookRetries")
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return
+		}
+		delay *= 2
+	}
+}
+
+// post sends the request of the attempt to deliver body to ep. It
+// returns the status code of the response, and an error if the request
+// failed or the status code is not 2xx.
+func (s *Subscriber) post(ep *Endpoint, body []byte, attempt int) (int, error) {
+	req, err := http.NewRequest("POST", ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(AttemptHeader, strconv.Itoa(attempt))
+	if len(ep.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(ep.Secret, body))
+	}
+
+	cli := s.Client
+	if cli == nil {
+		cli = defaultClient
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook: unexpected status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+var defaultClient = &http.Client{Timeout: DefaultTimeout}
+
+func (s *Subscriber) record(d *Delivery) {
+	if s.Log == nil {
+		return
+	}
+	if err := s.Log.Write(d); err != nil {
+		s.logf("webhook: failed to log delivery of %v to %s: %v", d.MsgUUID, d.URL, err)
+	}
+}
+
+func (s *Subscriber) add(key string) {
+	if s.Vars != nil {
+		s.Vars.Add(key, 1)
+	}
+}
+
+func (s *Subscriber) logf(f string, args ...interface{}) {
+	if s.LogFunc != nil {
+		s.LogFunc(f, args...)
+		return
+	}
+	log.Printf(f, args...)
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/juggler/broker"
+	"github.com/PuerkitoBio/juggler/jugglertest"
+	"github.com/PuerkitoBio/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	secret, body := []byte("s3cr3t"), []byte(`{"a":1}`)
+	sig := Sign(secret, body)
+	assert.True(t, Verify(secret, body, sig), "valid signature")
+	assert.False(t, Verify([]byte("other"), body, sig), "other secret")
+	assert.False(t, Verify(secret, []byte(`{"a":2}`), sig), "other body")
+	assert.False(t, Verify(secret, body, sig[len(signaturePrefix):]), "missing prefix")
+	assert.False(t, Verify(secret, body, "sha256=zz"), "invalid hex")
+}
+
+func TestSubscriber(t *testing.T) {
+	secret := []byte("s3cr3t")
+
+	var (
+		mu       sync.Mutex
+		channels []string
+		fails    = 1
+	)
+	received := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err, "read body")
+		if !Verify(secret, body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if fails > 0 {
+			fails--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev message.EvntPayload
+		require.NoError(t, json.Unmarshal(body, &ev), "decode event")
+		channels = append(channels, ev.Channel+" "+ev.Pattern+" "+r.Header.Get(AttemptHeader))
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	var deliveries []*Delivery
+	brk := &jugglertest.Broker{}
+	vars := new(expvar.Map).Init()
+	s := &Subscriber{
+		Broker: brk,
+		Endpoints: []*Endpoint{
+			{URL: srv.URL, Secret: secret, Subscriptions: []broker.Subscription{{Channel: "a"}, {Channel: "b.*", Pattern: true}}},
+			{URL: srv.URL, Secret: []byte("wrong"), Subscriptions: []broker.Subscription{{Channel: "a"}}},
+		},
+		RetryDelay: time.Millisecond,
+		Log: DeliveryLogFunc(func(d *Delivery) error {
+			mu.Lock()
+			deliveries = append(deliveries, d)
+			mu.Unlock()
+			return nil
+		}),
+		Vars:    vars,
+		LogFunc: func(string, ...interface{}) {},
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Listen() }()
+	time.Sleep(10 * time.Millisecond) // ensure time to subscribe
+
+	for _, ch := range []string{"a", "b.c", "c"} {
+		require.NoError(t, brk.Publish(ch, &message.PubPayload{MsgUUID: message.NewID(), Args: json.RawMessage(`1`)}), "Publish %s", ch)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("delivery %d not received", i)
+		}
+	}
+
+	// wait for the failed delivery to the endpoint with the wrong secret
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(deliveries)
+		mu.Unlock()
+		if n == 4 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.NoError(t, s.Close(), "Close")
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrClosed, err, "Listen error")
+	case <-time.After(time.Second):
+		t.Fatal("Listen did not return")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"a  2", "b.c b.* 1"}, channels, "delivered events")
+
+	var retried, unauthorized int
+	for _, d := range deliveries {
+		if d.Retry {
+			retried++
+			assert.Equal(t, http.StatusServiceUnavailable, d.Status, "status of retried delivery")
+		}
+		if d.Status == http.StatusUnauthorized {
+			unauthorized++
+			assert.False(t, d.Retry, "4xx is not retried")
+		}
+	}
+	assert.Equal(t, 1, retried, "retried deliveries")
+	assert.Equal(t, 1, unauthorized, "unauthorized deliveries")
+	assert.Equal(t, 4, len(deliveries), "deliveries logged")
+	assert.Equal(t, "2", vars.Get("WebhookDeliveries").String(), "WebhookDeliveries")
+	assert.Equal(t, "1", vars.Get("FailedWebhookDeliveries").String(), "FailedWebhookDeliveries")
+	assert.Equal(t, "1", vars.Get("WebhookRetries").String(), "WebhookRetries")
+}
+
+func TestJSONLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONLog(&buf)
+	require.NoError(t, l.Write(&Delivery{URL: "http://x", Channel: "a", Attempt: 1, Status: 200}), "Write")
+
+	var d Delivery
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &d), "decode")
+	assert.Equal(t, "a", d.Channel, "channel")
+	assert.Equal(t, 200, d.Status, "status")
+}